@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// errUsage is returned for arguments that don't form a command, so the
+// usage can be printed
+var errUsage = errors.New("invalid arguments")
+
+// parseTeam splits a scope:team argument, with or without the scope's @
+func parseTeam(team string) (scope, name string, err error) {
+	scope, name, ok := strings.Cut(strings.TrimPrefix(team, "@"), ":")
+	if !ok || scope == "" || name == "" {
+		return "", "", fmt.Errorf("team must be given as <scope>:<team>, got %q", team)
+	}
+	return scope, name, nil
+}
+
+// setAccess makes a scoped package public or restricted
+func (r *RegistryClient) setAccess(ctx context.Context, name, access string) error {
+	if access != "public" && access != "restricted" {
+		return fmt.Errorf("access must be public or restricted, got %q", access)
+	}
+	if !strings.HasPrefix(name, "@") {
+		return fmt.Errorf("only scoped packages have an access level, %s is unscoped", name)
+	}
+	return r.send(ctx, "POST", "/-/package/"+escapePackage(name)+"/access", map[string]string{"access": access}, nil)
+}
+
+// grantAccess gives a team read-only or read-write access to a package
+func (r *RegistryClient) grantAccess(ctx context.Context, team, permissions, name string) error {
+	if permissions != "read-only" && permissions != "read-write" {
+		return fmt.Errorf("permissions must be read-only or read-write, got %q", permissions)
+	}
+	scope, teamName, err := parseTeam(team)
+	if err != nil {
+		return err
+	}
+	path := "/-/team/" + url.PathEscape(scope) + "/" + url.PathEscape(teamName) + "/package"
+	return r.send(ctx, "PUT", path, map[string]string{"package": name, "permissions": permissions}, nil)
+}
+
+// revokeAccess takes a team's access to a package away
+func (r *RegistryClient) revokeAccess(ctx context.Context, team, name string) error {
+	scope, teamName, err := parseTeam(team)
+	if err != nil {
+		return err
+	}
+	path := "/-/team/" + url.PathEscape(scope) + "/" + url.PathEscape(teamName) + "/package"
+	return r.send(ctx, "DELETE", path, map[string]string{"package": name}, nil)
+}
+
+// Maintainer is an owner of a package
+type Maintainer struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// ownersDocument is the part of a packument owner changes touch. The
+// revision has to be sent back so concurrent changes aren't lost
+type ownersDocument struct {
+	ID          string       `json:"_id"`
+	Rev         string       `json:"_rev"`
+	Maintainers []Maintainer `json:"maintainers"`
+}
+
+// owners fetches a package's maintainers and the revision to update them at
+func (r *RegistryClient) owners(ctx context.Context, name string) (ownersDocument, error) {
+	var doc ownersDocument
+	err := r.send(ctx, "GET", packumentPath(name)+"?write=true", nil, &doc)
+	return doc, err
+}
+
+// setOwners writes a package's maintainers at the revision they were read
+func (r *RegistryClient) setOwners(ctx context.Context, name string, doc ownersDocument) error {
+	return r.send(ctx, "PUT", packumentPath(name)+"/-rev/"+url.PathEscape(doc.Rev), doc, nil)
+}
+
+// addOwner makes a registry user a maintainer of a package. It reports
+// false when they already were one
+func (r *RegistryClient) addOwner(ctx context.Context, user, name string) (bool, error) {
+	var account Maintainer
+	if err := r.send(ctx, "GET", "/-/user/org.couchdb.user:"+url.PathEscape(user), nil, &account); err != nil {
+		return false, fmt.Errorf("error looking up user %s: %w", user, err)
+	}
+	doc, err := r.owners(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	for _, maintainer := range doc.Maintainers {
+		if maintainer.Name == account.Name {
+			return false, nil
+		}
+	}
+	doc.Maintainers = append(doc.Maintainers, account)
+	return true, r.setOwners(ctx, name, doc)
+}
+
+// removeOwner takes a maintainer off a package, refusing to remove the last
+// one. It reports false when they weren't a maintainer
+func (r *RegistryClient) removeOwner(ctx context.Context, user, name string) (bool, error) {
+	doc, err := r.owners(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	kept := []Maintainer{}
+	for _, maintainer := range doc.Maintainers {
+		if maintainer.Name != user {
+			kept = append(kept, maintainer)
+		}
+	}
+	if len(kept) == len(doc.Maintainers) {
+		return false, nil
+	}
+	if len(kept) == 0 {
+		return false, fmt.Errorf("%s is the only owner of %s and can't be removed", user, name)
+	}
+	doc.Maintainers = kept
+	return true, r.setOwners(ctx, name, doc)
+}
+
+// Access runs caladan access: public, restricted, grant, or revoke
+func Access(args []string) error {
+	api, err := authenticatedRegistryClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch {
+	case len(args) == 2 && (args[0] == "public" || args[0] == "restricted"):
+		if err := api.setAccess(ctx, args[1], args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("%s is now %s\n", colorPackage(args[1]), args[0])
+	case len(args) == 4 && args[0] == "grant":
+		if err := api.grantAccess(ctx, args[2], args[1], args[3]); err != nil {
+			return err
+		}
+		fmt.Printf("Granted %s %s access to %s\n", args[2], args[1], colorPackage(args[3]))
+	case len(args) == 3 && args[0] == "revoke":
+		if err := api.revokeAccess(ctx, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %s's access to %s\n", args[1], colorPackage(args[2]))
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// Owner runs caladan owner: ls, add, or rm
+func Owner(args []string) error {
+	api, err := authenticatedRegistryClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch {
+	case len(args) == 2 && args[0] == "ls":
+		doc, err := api.owners(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Print(RenderOwners(doc.Maintainers))
+	case len(args) == 3 && args[0] == "add":
+		added, err := api.addOwner(ctx, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		if !added {
+			fmt.Printf("%s already owns %s\n", args[1], colorPackage(args[2]))
+			return nil
+		}
+		fmt.Printf("Added %s as an owner of %s\n", args[1], colorPackage(args[2]))
+	case len(args) == 3 && args[0] == "rm":
+		removed, err := api.removeOwner(ctx, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		if !removed {
+			fmt.Printf("%s isn't an owner of %s\n", args[1], colorPackage(args[2]))
+			return nil
+		}
+		fmt.Printf("Removed %s as an owner of %s\n", args[1], colorPackage(args[2]))
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// DistTag runs caladan dist-tag: ls, add, or rm
+func DistTag(args []string) error {
+	api, err := authenticatedRegistryClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch {
+	case len(args) == 2 && args[0] == "ls":
+		tags, err := api.distTags(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(tags))
+		for tag := range tags {
+			names = append(names, tag)
+		}
+		sort.Strings(names)
+		for _, tag := range names {
+			fmt.Printf("%s: %s\n", tag, tags[tag])
+		}
+	case (len(args) == 2 || len(args) == 3) && args[0] == "add":
+		i := strings.LastIndex(args[1], "@")
+		if i <= 0 {
+			return fmt.Errorf("dist-tag add needs <package>@<version>, got %q", args[1])
+		}
+		name, version := args[1][:i], args[1][i+1:]
+		tag := "latest"
+		if len(args) == 3 {
+			tag = args[2]
+		}
+		if validRange(tag) {
+			return fmt.Errorf("%s looks like a version range, which can't be a dist-tag", tag)
+		}
+		if err := api.setDistTag(ctx, name, tag, version); err != nil {
+			return err
+		}
+		fmt.Printf("%s is now %s\n", colorPackage(name+"@"+tag), version)
+	case len(args) == 3 && args[0] == "rm":
+		if err := api.removeDistTag(ctx, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s from %s\n", args[2], colorPackage(args[1]))
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// RenderOwners lists maintainers as npm owner ls does, one per line
+func RenderOwners(maintainers []Maintainer) string {
+	var builder strings.Builder
+	for _, maintainer := range maintainers {
+		if maintainer.Email != "" {
+			builder.WriteString(fmt.Sprintf("%s <%s>\n", maintainer.Name, maintainer.Email))
+		} else {
+			builder.WriteString(maintainer.Name + "\n")
+		}
+	}
+	return builder.String()
+}
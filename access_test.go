@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRegistryAccess(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath()+" "+string(body))
+	}))
+	defer server.Close()
+
+	api := newRegistryClient(server.Client(), server.URL, "token")
+	ctx := context.Background()
+	if err := api.setAccess(ctx, "@corp/http", "restricted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.grantAccess(ctx, "@corp:developers", "read-write", "@corp/http"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.revokeAccess(ctx, "corp:developers", "@corp/http"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`POST /-/package/@corp%2Fhttp/access {"access":"restricted"}`,
+		`PUT /-/team/corp/developers/package {"package":"@corp/http","permissions":"read-write"}`,
+		`DELETE /-/team/corp/developers/package {"package":"@corp/http"}`,
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+
+	if err := api.setAccess(ctx, "http", "public"); err == nil {
+		t.Errorf("setAccess() on an unscoped package succeeded")
+	}
+	if err := api.grantAccess(ctx, "developers", "read-only", "@corp/http"); err == nil {
+		t.Errorf("grantAccess() without a scope succeeded")
+	}
+}
+
+func TestRegistryOwners(t *testing.T) {
+	doc := ownersDocument{ID: "@corp/http", Rev: "3-abc", Maintainers: []Maintainer{{Name: "bob", Email: "bob@example.com"}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/-/user/org.couchdb.user:alice":
+			w.Write([]byte(`{"name": "alice", "email": "alice@example.com", "type": "user"}`))
+		case r.Method == "GET" && r.URL.EscapedPath() == "/@corp%2Fhttp":
+			json.NewEncoder(w).Encode(doc)
+		case r.Method == "PUT" && r.URL.EscapedPath() == "/@corp%2Fhttp/-rev/"+doc.Rev:
+			json.NewDecoder(r.Body).Decode(&doc)
+			doc.Rev = "4-def"
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	api := newRegistryClient(server.Client(), server.URL, "token")
+	ctx := context.Background()
+	if added, err := api.addOwner(ctx, "alice", "@corp/http"); err != nil || !added {
+		t.Fatalf("addOwner() = %v, %v", added, err)
+	}
+	if added, err := api.addOwner(ctx, "alice", "@corp/http"); err != nil || added {
+		t.Errorf("adding alice twice = %v, %v", added, err)
+	}
+	if _, err := api.addOwner(ctx, "nobody", "@corp/http"); err == nil {
+		t.Errorf("addOwner() for an unknown user succeeded")
+	}
+	if removed, err := api.removeOwner(ctx, "bob", "@corp/http"); err != nil || !removed {
+		t.Fatalf("removeOwner() = %v, %v", removed, err)
+	}
+	if _, err := api.removeOwner(ctx, "alice", "@corp/http"); err == nil {
+		t.Errorf("removing the last owner succeeded")
+	}
+	if got := RenderOwners(doc.Maintainers); got != "alice <alice@example.com>\n" {
+		t.Errorf("RenderOwners() = %q", got)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// WorkspaceFilter picks the package.json files add and rm edit: the
+// workspaces Filters match, by name, name glob (@corp/*), or directory, and
+// the root with Root. With neither it's the root
+type WorkspaceFilter struct {
+	Filters []string
+	Root    bool
+}
+
+// filterFlags registers --filter and -w
+func filterFlags(flags *flag.FlagSet) *WorkspaceFilter {
+	filter := &WorkspaceFilter{}
+	flags.Func("filter", "edit this workspace's package.json, by name, name glob, or directory (repeatable)", func(value string) error {
+		filter.Filters = append(filter.Filters, value)
+		return nil
+	})
+	flags.BoolVar(&filter.Root, "w", false, "edit the root package.json, along with any --filter workspaces")
+	flags.BoolVar(&filter.Root, "workspace-root", false, "same as -w")
+	return filter
+}
+
+// targets returns the manifests a filter picks, the root first
+func (f WorkspaceFilter) targets(directory string) ([]workspace, error) {
+	manifests, err := projectManifests(directory)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Filters) == 0 {
+		return manifests[:1], nil
+	}
+	if len(manifests) == 1 {
+		return nil, fmt.Errorf("--filter needs workspaces, and package.json has none")
+	}
+
+	picked := make(map[string]bool)
+	for _, filter := range f.Filters {
+		matched := false
+		for _, ws := range manifests[1:] {
+			if ok, _ := path.Match(filter, ws.Name); ok || filepath.Clean(filter) == ws.Dir {
+				picked[ws.Dir] = true
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no workspace matches --filter %s", filter)
+		}
+	}
+	targets := []workspace{}
+	if f.Root {
+		targets = append(targets, manifests[0])
+	}
+	for _, ws := range manifests[1:] {
+		if picked[ws.Dir] {
+			targets = append(targets, ws)
+		}
+	}
+	return targets, nil
+}
+
+// isDistTag reports whether a spec's range is a dist tag like latest or
+// next, rather than a range or a git, file, or alias spec
+func isDistTag(versionRange string) bool {
+	return !validRange(versionRange) && !strings.ContainsAny(versionRange, ":/#")
+}
+
+// sectionFlags registers --dev and --optional, which pick the section add
+// saves packages in
+func sectionFlags(flags *flag.FlagSet) func() (string, error) {
+	var dev, optional bool
+	flags.BoolVar(&dev, "dev", false, "save the packages in devDependencies")
+	flags.BoolVar(&dev, "D", false, "same as --dev")
+	flags.BoolVar(&optional, "optional", false, "save the packages in optionalDependencies")
+	flags.BoolVar(&optional, "O", false, "same as --optional")
+	return func() (string, error) {
+		switch {
+		case dev && optional:
+			return "", fmt.Errorf("--dev and --optional can't be combined")
+		case dev:
+			return "devDependencies", nil
+		case optional:
+			return "optionalDependencies", nil
+		}
+		return "", nil
+	}
+}
+
+// AddDependencies adds packages to the manifests a filter picks, then
+// installs them. When only the root package.json is edited, just the new
+// packages are resolved into the lockfile and installed, keeping the rest
+// of node_modules, and otherwise the whole project is. With a section the
+// packages are saved there, and moved out of any other section they were
+// in. Without one, a package already there has its range replaced in the
+// section it's in, and goes in dependencies otherwise. Dist tags (and no
+// range at all, which is latest) are saved as ^ the version they point at
+func AddDependencies(directory string, specs []string, section string, filter WorkspaceFilter, opts InstallOptions) error {
+	targets, err := filter.targets(directory)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	resolveOpts := opts
+	if err := resolveOpts.applyConfig(config); err != nil {
+		return err
+	}
+	resolver := NewPackageResolver(resolveOpts.registryClient(), semaphore.NewWeighted(resolveOpts.networkConcurrency()))
+	ranges := make([][2]string, 0, len(specs))
+	for _, spec := range specs {
+		name, versionRange := parsePackageSpec(spec)
+		if isDistTag(versionRange) {
+			metadata, _, err := resolver.packageMetadata(resolveOpts.context(), name, versionRange)
+			if err != nil {
+				return fmt.Errorf("error resolving %s: %w", spec, err)
+			}
+			resolved, err := resolveVersion(name, versionRange, metadata, resolveOpts.NoDeprecated)
+			if err != nil {
+				return err
+			}
+			versionRange = "^" + resolved.Version
+		}
+		ranges = append(ranges, [2]string{name, versionRange})
+	}
+
+	for _, target := range targets {
+		manifestPath := filepath.Join(directory, target.Dir, "package.json")
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			return err
+		}
+		for _, nameRange := range ranges {
+			name, versionRange := nameRange[0], nameRange[1]
+			var saveIn string
+			if data, saveIn, err = saveDependency(data, target, section, name, versionRange); err != nil {
+				return fmt.Errorf("error editing %s: %v", manifestPath, err)
+			}
+			fmt.Printf("Added %s to %s %s\n", colorPackage(name+"@"+versionRange), filepath.Join(target.Dir, "package.json"), saveIn)
+		}
+		if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(targets) == 1 && targets[0].Dir == "." {
+		names := make([]string, len(ranges))
+		for i, nameRange := range ranges {
+			names[i] = nameRange[0]
+		}
+		relocked, err := relockAdded(directory, names, resolveOpts)
+		if err != nil {
+			return err
+		}
+		if relocked {
+			lockfilePath := filepath.Join(directory, "package-lock.json")
+			if opts.LockfileOnly {
+				printLockfileOnly(lockfilePath)
+				return nil
+			}
+			opts.keepInstalled = true
+			return InstallLockFile(lockfilePath, opts)
+		}
+	}
+	return Install(directory, opts)
+}
+
+// relockAdded puts the packages add saved in the root package.json in its
+// lockfile, resolving only them and keeping every other entry as it is, the
+// way update does. It reports false, leaving the lockfile alone, when
+// there's no lockfile to build on or the whole project has to be resolved
+// again: it has workspaces or overrides, a package is in more than one
+// section, or the lockfile was already out of date
+func relockAdded(directory string, names []string, opts InstallOptions) (bool, error) {
+	manifests, err := projectManifests(directory)
+	if err != nil {
+		return false, err
+	}
+	lockfilePath := filepath.Join(directory, "package-lock.json")
+	packageLock, err := readLockFile(lockfilePath)
+	if err != nil || len(manifests) > 1 || len(opts.Overrides) > 0 {
+		return false, nil
+	}
+
+	packageJSONPath := filepath.Join(directory, "package.json")
+	data, err := os.ReadFile(packageJSONPath)
+	if err != nil {
+		return false, err
+	}
+	var manifest PackageInfo
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return false, fmt.Errorf("error parsing %s: %v", packageJSONPath, err)
+	}
+	projectCatalogs, err := parseCatalogs(data)
+	if err != nil {
+		return false, err
+	}
+	if err := projectCatalogs.resolveManifestCatalogs(&manifest); err != nil {
+		return false, err
+	}
+	for _, drift := range findLockfileDrift(manifest, packageLock.Packages) {
+		if !slices.Contains(names, drift.Name) {
+			fmt.Printf("Resolving the whole project, %s\n", drift)
+			return false, nil
+		}
+	}
+
+	// Keep a copy of the original entries to diff against
+	oldPackages := make(map[string]json.RawMessage, len(packageLock.Packages))
+	for path, raw := range packageLock.Packages {
+		oldPackages[path] = raw
+	}
+
+	resolver := NewPackageResolver(opts.registryClient(), semaphore.NewWeighted(opts.networkConcurrency()))
+	resolver.stats = opts.cacheStats
+	resolver.avoidDeprecated = opts.NoDeprecated
+	resolver.hideDeprecated = opts.NoDeprecationWarnings
+	resolver.manifestPath = packageJSONPath
+	for _, name := range names {
+		sections := []string{}
+		for _, section := range []string{"dependencies", "devDependencies", "optionalDependencies"} {
+			if _, ok := (workspace{manifest: manifest}).sectionDeps(section)[name]; ok {
+				sections = append(sections, section)
+			}
+		}
+		if len(sections) != 1 {
+			return false, nil
+		}
+		section := sections[0]
+		versionRange := (workspace{manifest: manifest}).sectionDeps(section)[name]
+
+		resolveStart := time.Now()
+		resolveCtx, resolveSpan := startSpan(opts.context(), "resolve", spanKindInternal)
+		resolved, err := resolver.ResolveDependency(resolveCtx, name, versionRange)
+		resolveSpan.finish(err)
+		if err != nil {
+			return false, fmt.Errorf("error resolving %s@%s: %w", name, versionRange, err)
+		}
+		isDev, isOptional := section == "devDependencies", section == "optionalDependencies"
+		resolved = markDirectDependency(resolved, isDev, isOptional)
+		opts.timings.since(phaseResolution, resolveStart)
+
+		linkStart := time.Now()
+		if _, err := relockPackage(packageLock.Packages, name, resolved); err != nil {
+			return false, err
+		}
+		if err := setRootDependency(packageLock.Packages, section, name, resolved.Version); err != nil {
+			return false, err
+		}
+		// Entries it reuses were dev or optional only for what needed them
+		// before, and now a production or required package needs them too
+		reachable := reachableFrom(packageLock.Packages, "node_modules/"+name)
+		if !isDev {
+			if err := clearLockfileFlag(packageLock.Packages, reachable, "dev"); err != nil {
+				return false, err
+			}
+		}
+		if !isOptional {
+			if err := clearLockfileFlag(packageLock.Packages, reachable, "optional"); err != nil {
+				return false, err
+			}
+		}
+		opts.timings.since(phaseLinking, linkStart)
+	}
+
+	changes := diffLockfiles(oldPackages, packageLock.Packages)
+	if len(changes) > 0 {
+		fmt.Println("Lockfile changes:")
+		fmt.Println(RenderLockfileDiff(changes))
+	}
+	if err := writeLockFile(lockfilePath, packageLock); err != nil {
+		return false, fmt.Errorf("error writing lockfile: %v", err)
+	}
+	if err := annotateLockfile(directory, "caladan add "+strings.Join(names, " "), oldPackages, packageLock.Packages, changes, nil, time.Now()); err != nil {
+		return false, fmt.Errorf("error writing lockfile annotations: %v", err)
+	}
+	if opts.ConflictReport {
+		reportConflicts(packageLock.Packages)
+	}
+	return true, nil
+}
+
+// setRootDependency saves a package's version in a section of the root
+// lockfile entry, taking it out of the others
+func setRootDependency(packages map[string]json.RawMessage, section, name, version string) error {
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(packages[""], &root); err != nil {
+		return fmt.Errorf("error parsing root lockfile entry: %v", err)
+	}
+
+	for _, field := range []string{"dependencies", "devDependencies", "optionalDependencies"} {
+		deps := map[string]string{}
+		if raw, ok := root[field]; ok {
+			if err := json.Unmarshal(raw, &deps); err != nil {
+				return fmt.Errorf("error parsing root lockfile %s: %v", field, err)
+			}
+		}
+		delete(deps, name)
+		if field == section {
+			deps[name] = version
+		}
+		if len(deps) == 0 {
+			delete(root, field)
+			continue
+		}
+		data, err := json.Marshal(deps)
+		if err != nil {
+			return err
+		}
+		root[field] = data
+	}
+
+	data, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	packages[""] = data
+	return nil
+}
+
+// clearLockfileFlag takes a flag like dev or optional off the entries at
+// paths
+func clearLockfileFlag(packages map[string]json.RawMessage, paths map[string]bool, flag string) error {
+	for path := range paths {
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(packages[path], &entry); err != nil {
+			return fmt.Errorf("error parsing lockfile entry %s: %v", path, err)
+		}
+		if _, ok := entry[flag]; !ok {
+			continue
+		}
+		delete(entry, flag)
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		packages[path] = data
+	}
+	return nil
+}
+
+// saveDependency sets a package's range in a manifest, in section when
+// it's set, taking the package out of any other section it's in. Without a
+// section it stays where it is, or goes in dependencies. It returns the
+// edited manifest and the section the package was saved in
+func saveDependency(data []byte, target workspace, section, name, versionRange string) ([]byte, string, error) {
+	saveIn := section
+	for _, candidate := range dependencySections {
+		if _, ok := target.sectionDeps(candidate)[name]; !ok {
+			continue
+		}
+		if saveIn == "" {
+			saveIn = candidate
+		} else if candidate != saveIn {
+			var err error
+			if data, err = setJSONDependency(data, candidate, name, ""); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if saveIn == "" {
+		saveIn = "dependencies"
+	}
+	data, err := setJSONDependency(data, saveIn, name, versionRange)
+	return data, saveIn, err
+}
+
+// RemoveDependencies removes packages from every dependency section of the
+// manifests a filter picks, then installs the project. The install leaves
+// out what only they needed and their bins, and links to them in
+// node_modules aren't kept. Nothing is written when a package isn't in any
+// of them
+func RemoveDependencies(directory string, names []string, filter WorkspaceFilter, opts InstallOptions) error {
+	targets, err := filter.targets(directory)
+	if err != nil {
+		return err
+	}
+
+	edited := make([][]byte, len(targets))
+	for _, name := range names {
+		found := false
+		for i, target := range targets {
+			manifestPath := filepath.Join(directory, target.Dir, "package.json")
+			if edited[i] == nil {
+				if edited[i], err = os.ReadFile(manifestPath); err != nil {
+					return err
+				}
+			}
+			for _, section := range dependencySections {
+				if _, ok := target.sectionDeps(section)[name]; !ok {
+					continue
+				}
+				if edited[i], err = setJSONDependency(edited[i], section, name, ""); err != nil {
+					return fmt.Errorf("error editing %s: %v", manifestPath, err)
+				}
+				fmt.Printf("Removed %s from %s %s\n", colorPackage(name), filepath.Join(target.Dir, "package.json"), section)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s isn't a dependency of the package.json files picked", name)
+		}
+	}
+
+	for i, target := range targets {
+		if err := os.WriteFile(filepath.Join(directory, target.Dir, "package.json"), edited[i], 0644); err != nil {
+			return err
+		}
+	}
+	opts.removed = names
+	return Install(directory, opts)
+}
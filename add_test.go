@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetJSONDependency(t *testing.T) {
+	manifest := `{
+    "name": "app",
+    "dependencies": {
+        "lodash": "^4.17.0",
+        "react": "^18.0.0"
+    },
+    "scripts": {"test": "node test.js"}
+}
+`
+	for _, tt := range []struct {
+		name, section, dep, versionRange, want string
+	}{
+		{"insert sorted", "dependencies", "left-pad", "^1.3.0", `{
+    "name": "app",
+    "dependencies": {
+        "left-pad": "^1.3.0",
+        "lodash": "^4.17.0",
+        "react": "^18.0.0"
+    },
+    "scripts": {"test": "node test.js"}
+}
+`},
+		{"replace", "dependencies", "react", ">=18 <20", `{
+    "name": "app",
+    "dependencies": {
+        "lodash": "^4.17.0",
+        "react": ">=18 <20"
+    },
+    "scripts": {"test": "node test.js"}
+}
+`},
+		{"remove", "dependencies", "lodash", "", `{
+    "name": "app",
+    "dependencies": {
+        "react": "^18.0.0"
+    },
+    "scripts": {"test": "node test.js"}
+}
+`},
+		{"missing section", "devDependencies", "typescript", "^5.4.0", `{
+    "name": "app",
+    "dependencies": {
+        "lodash": "^4.17.0",
+        "react": "^18.0.0"
+    },
+    "scripts": {"test": "node test.js"},
+    "devDependencies": {
+        "typescript": "^5.4.0"
+    }
+}
+`},
+		{"remove missing", "devDependencies", "typescript", "", manifest},
+	} {
+		got, err := setJSONDependency([]byte(manifest), tt.section, tt.dep, tt.versionRange)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+
+	got, err := setJSONDependency([]byte(`{"name": "empty"}`), "dependencies", "lodash", "^4.17.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"name\": \"empty\",\n  \"dependencies\": {\n    \"lodash\": \"^4.17.0\"\n  }\n}"; string(got) != want {
+		t.Errorf("one-line manifest: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func writeTestWorkspaces(t *testing.T) string {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "root", "workspaces": ["packages/*"], "devDependencies": {"typescript": "^5.4.0"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages", "ui", "package.json"), `{"name": "@corp/ui", "dependencies": {"react": "^18.0.0", "typescript": "^5.0.0"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages", "web", "package.json"), `{"name": "@corp/web", "dependencies": {"@corp/ui": "workspace:*", "react": "^17.0.0", "lodash": "^4.17.0"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages", "cli", "package.json"), `{"name": "corp-cli"}`)
+	return dir
+}
+
+func TestWorkspaceFilterTargets(t *testing.T) {
+	dir := writeTestWorkspaces(t)
+	for _, tt := range []struct {
+		filter WorkspaceFilter
+		want   []string
+	}{
+		{WorkspaceFilter{}, []string{"."}},
+		{WorkspaceFilter{Filters: []string{"@corp/ui"}}, []string{filepath.Join("packages", "ui")}},
+		{WorkspaceFilter{Filters: []string{"@corp/*"}}, []string{filepath.Join("packages", "ui"), filepath.Join("packages", "web")}},
+		{WorkspaceFilter{Filters: []string{"packages/cli"}, Root: true}, []string{".", filepath.Join("packages", "cli")}},
+	} {
+		targets, err := tt.filter.targets(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs := []string{}
+		for _, target := range targets {
+			dirs = append(dirs, target.Dir)
+		}
+		if strings.Join(dirs, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%+v picked %v, want %v", tt.filter, dirs, tt.want)
+		}
+	}
+
+	if _, err := (WorkspaceFilter{Filters: []string{"@other/*"}}).targets(dir); err == nil {
+		t.Error("a filter that matches nothing picked something")
+	}
+}
+
+func TestWithWorkspaceDependencies(t *testing.T) {
+	dir := writeTestWorkspaces(t)
+	root := PackageInfo{Name: "root", DevDependencies: map[string]string{"typescript": "^5.4.0"}}
+	merged, conflicts, err := withWorkspaceDependencies(dir, root, catalogs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"react": "^18.0.0", "lodash": "^4.17.0"}
+	if len(merged.Dependencies) != len(want) {
+		t.Errorf("merged dependencies = %v, want %v", merged.Dependencies, want)
+	}
+	for name, versionRange := range want {
+		if merged.Dependencies[name] != versionRange {
+			t.Errorf("merged %s = %q, want %q", name, merged.Dependencies[name], versionRange)
+		}
+	}
+	if merged.DevDependencies["typescript"] != "^5.4.0" {
+		t.Errorf("the root's typescript range lost: %v", merged.DevDependencies)
+	}
+	if len(root.Dependencies) != 0 {
+		t.Error("merging changed the root manifest")
+	}
+	if len(conflicts) != 2 {
+		t.Errorf("conflicts = %q, want typescript and react", conflicts)
+	}
+}
+
+func TestRemoveDependenciesMissing(t *testing.T) {
+	dir := writeTestWorkspaces(t)
+	manifest := readTestFile(t, filepath.Join(dir, "packages", "ui", "package.json"))
+	err := RemoveDependencies(dir, []string{"lodash"}, WorkspaceFilter{Filters: []string{"@corp/ui"}}, InstallOptions{})
+	if err == nil {
+		t.Fatal("removing a package that isn't a dependency succeeded")
+	}
+	if readTestFile(t, filepath.Join(dir, "packages", "ui", "package.json")) != manifest {
+		t.Error("a failed remove wrote package.json")
+	}
+}
+
+func TestSaveDependency(t *testing.T) {
+	manifest := `{
+  "name": "app",
+  "dependencies": {
+    "react": "^18.0.0",
+    "typescript": "^5.0.0"
+  }
+}
+`
+	target := workspace{Dir: ".", manifest: PackageInfo{Dependencies: map[string]string{"react": "^18.0.0", "typescript": "^5.0.0"}}}
+
+	data, section, err := saveDependency([]byte(manifest), target, "", "react", "^18.3.0")
+	if err != nil || section != "dependencies" || !strings.Contains(string(data), `"react": "^18.3.0"`) {
+		t.Errorf("saveDependency() = %s, %q, %v", data, section, err)
+	}
+
+	data, section, err = saveDependency([]byte(manifest), target, "devDependencies", "typescript", "^5.4.0")
+	if err != nil || section != "devDependencies" {
+		t.Fatalf("saveDependency() = %q, %v", section, err)
+	}
+	want := `{
+  "name": "app",
+  "dependencies": {
+    "react": "^18.0.0"
+  },
+  "devDependencies": {
+    "typescript": "^5.4.0"
+  }
+}
+`
+	if string(data) != want {
+		t.Errorf("moving to devDependencies gave\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestAddDependenciesKeepsInstall(t *testing.T) {
+	t.Setenv("CALADAN_HOME", t.TempDir())
+
+	tarballs := map[string][]byte{}
+	packuments := map[string]PackageMetadata{}
+	var server *httptest.Server
+	var lock sync.Mutex
+	downloads := map[string]int{}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if tarball, ok := tarballs[r.URL.Path]; ok {
+			downloads[r.URL.Path]++
+			w.Write(tarball)
+			return
+		}
+		if metadata, ok := packuments[strings.TrimPrefix(r.URL.Path, "/")]; ok {
+			json.NewEncoder(w).Encode(metadata)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	publish := func(name string, deps map[string]string, files map[string]string) {
+		files["package.json"] = fmt.Sprintf(`{"name":%q,"version":"1.0.0"}`, name)
+		tarball, integrity := storeTarball(t, files)
+		path := fmt.Sprintf("/%s/-/%s-1.0.0.tgz", name, name)
+		tarballs[path] = tarball
+		metadata := testPackument(name, "1.0.0", deps)
+		info := metadata.Versions["1.0.0"]
+		info.Dist.Tarball, info.Dist.Integrity = server.URL+path, integrity
+		if name == "b" {
+			info.Bin = "cli.js"
+		}
+		metadata.Versions["1.0.0"] = info
+		packuments[name] = metadata
+	}
+	publish("a", map[string]string{"shared": "^1.0.0"}, map[string]string{"index.js": "a"})
+	publish("b", map[string]string{"shared": "^1.0.0"}, map[string]string{"cli.js": "b"})
+	publish("shared", nil, map[string]string{"index.js": "shared"})
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), fmt.Sprintf(`{
+  "name": "app",
+  "dependencies": {
+    "a": "^1.0.0"
+  },
+  "caladan": {"mirrors": [%q]}
+}
+`, server.URL))
+	opts := InstallOptions{NoAudit: true, noPrompt: true}
+	if err := Install(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	// A full install would replace the folder, and this with it
+	writeTestFile(t, filepath.Join(dir, "node_modules", "a", "kept"), "")
+	before, err := readLockFile(filepath.Join(dir, "package-lock.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddDependencies(dir, []string{"b@^1.0.0"}, "", WorkspaceFilter{}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "node_modules", "a", "kept")); err != nil {
+		t.Errorf("add reinstalled a: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "node_modules", ".bin", "b")); err != nil || string(data) != "b" {
+		t.Errorf(".bin/b = %q, %v", data, err)
+	}
+	for path, n := range downloads {
+		if n != 1 {
+			t.Errorf("%s was downloaded %d times", path, n)
+		}
+	}
+	after, err := readLockFile(filepath.Join(dir, "package-lock.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, raw := range before.Packages {
+		if path != "" && string(after.Packages[path]) != string(raw) {
+			t.Errorf("lockfile entry %s changed to %s", path, after.Packages[path])
+		}
+	}
+	if version := lockfileEntryVersion(after.Packages["node_modules/b"]); version != "1.0.0" {
+		t.Errorf("lockfile has b@%q", version)
+	}
+	if drift := findLockfileDrift(PackageInfo{Dependencies: map[string]string{"a": "^1.0.0", "b": "^1.0.0"}}, after.Packages); len(drift) > 0 {
+		t.Errorf("lockfile drift = %+v", drift)
+	}
+	state, err := readInstallState(filepath.Join(dir, "node_modules"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"node_modules/a", "node_modules/b", "node_modules/shared"} {
+		if _, ok := state.Packages[path]; !ok {
+			t.Errorf("install state is missing %s", path)
+		}
+	}
+	hidden := readTestFile(t, filepath.Join(dir, "node_modules", hiddenLockfileName))
+	if !strings.Contains(hidden, `"node_modules/a"`) || !strings.Contains(hidden, `"node_modules/b"`) {
+		t.Errorf("%s = %s", hiddenLockfileName, hidden)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// AdvisorySource looks up the advisories affecting package versions, given
+// as versions by package name
+type AdvisorySource interface {
+	Name() string
+	Lookup(ctx context.Context, versions map[string][]string) ([]Advisory, error)
+}
+
+// Advisory source types, as used in the auditSources config
+const (
+	sourceNPM    = "npm"    // The registry's bulk advisory endpoint
+	sourceOSV    = "osv"    // OSV's API, or an OSV snapshot with a path
+	sourceGitHub = "github" // GitHub's global security advisories
+	sourceFeed   = "feed"   // A JSON array of OSV advisories at a URL or path
+)
+
+// AuditSourceConfig is an entry of the auditSources config
+type AuditSourceConfig struct {
+	Type     string `json:"type"`
+	URL      string `json:"url,omitempty"`  // Overrides the source's endpoint, required for feed
+	Path     string `json:"path,omitempty"` // An OSV snapshot for osv, or a file for feed
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// advisorySources builds the sources an audit uses. An audit database
+// replaces them with the snapshot, so nothing goes over the network, and
+// without config the registry is used
+func advisorySources(db string, configs []AuditSourceConfig) ([]AdvisorySource, error) {
+	if db != "" {
+		return []AdvisorySource{&osvAdvisories{path: db}}, nil
+	}
+	if len(configs) == 0 {
+		configs = []AuditSourceConfig{{Type: sourceNPM}}
+	}
+
+	sources := []AdvisorySource{}
+	for _, config := range configs {
+		if config.Disabled {
+			continue
+		}
+		switch config.Type {
+		case sourceNPM:
+			registry := config.URL
+			if registry == "" {
+				registry = npmRegistryURL
+			}
+			sources = append(sources, &npmAdvisories{registry: strings.TrimSuffix(registry, "/")})
+		case sourceOSV:
+			sources = append(sources, &osvAdvisories{api: config.URL, path: config.Path})
+		case sourceGitHub:
+			sources = append(sources, &githubAdvisories{api: config.URL, token: os.Getenv("GITHUB_TOKEN")})
+		case sourceFeed:
+			location := config.URL
+			if location == "" {
+				location = config.Path
+			}
+			if location == "" {
+				return nil, fmt.Errorf("feed advisory source needs a url or path")
+			}
+			sources = append(sources, &feedAdvisories{location: location})
+		default:
+			return nil, fmt.Errorf("unknown advisory source %q, must be npm, osv, github, or feed", config.Type)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("every advisory source is disabled")
+	}
+	return sources, nil
+}
+
+// lookupAll queries every source at once and merges what they found
+func lookupAll(ctx context.Context, sources []AdvisorySource, versions map[string][]string) ([]Advisory, error) {
+	results := make([][]Advisory, len(sources))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, source := range sources {
+		i, source := i, source
+		g.Go(func() error {
+			found, err := source.Lookup(gctx, versions)
+			if err != nil {
+				return fmt.Errorf("%s advisories: %w", source.Name(), err)
+			}
+			for j := range found {
+				found[j].Sources = []string{source.Name()}
+			}
+			results[i] = found
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return mergeAdvisories(results...), nil
+}
+
+// ghsaPattern finds GitHub advisory IDs, which every source uses either as
+// the ID, an alias, or in the advisory URL
+var ghsaPattern = regexp.MustCompile(`GHSA(-[23456789cfghjmpqrvwx]{4}){3}`)
+
+// advisoryKeys returns the IDs an advisory is known by
+func advisoryKeys(advisory Advisory) []string {
+	keys := []string{advisory.ID}
+	keys = append(keys, advisory.Aliases...)
+	if ghsa := ghsaPattern.FindString(advisory.URL); ghsa != "" {
+		keys = append(keys, ghsa)
+	}
+	return keys
+}
+
+// mergeAdvisories combines advisories from several sources, merging those
+// that are the same advisory for the same package version. The merged one
+// keeps the highest severity and lists every source that reported it
+func mergeAdvisories(lists ...[]Advisory) []Advisory {
+	merged := []Advisory{}
+	index := make(map[string]int) // name@version#id to its position in merged
+	for _, list := range lists {
+		for _, advisory := range list {
+			target := -1
+			for _, key := range advisoryKeys(advisory) {
+				if i, ok := index[advisory.Name+"@"+advisory.Version+"#"+key]; ok {
+					target = i
+					break
+				}
+			}
+
+			if target < 0 {
+				target = len(merged)
+				merged = append(merged, advisory)
+			} else {
+				existing := &merged[target]
+				if severityRank(advisory.Severity) > severityRank(existing.Severity) {
+					existing.Severity = advisory.Severity
+				}
+				existing.Aliases = appendUnique(existing.Aliases, advisory.Aliases...)
+				if advisory.ID != existing.ID {
+					existing.Aliases = appendUnique(existing.Aliases, advisory.ID)
+				}
+				existing.Sources = appendUnique(existing.Sources, advisory.Sources...)
+			}
+			for _, key := range advisoryKeys(merged[target]) {
+				index[advisory.Name+"@"+advisory.Version+"#"+key] = target
+			}
+		}
+	}
+	return merged
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// bulkAdvisory is an entry of the registry's bulk advisory response
+type bulkAdvisory struct {
+	ID                 int    `json:"id"`
+	URL                string `json:"url"`
+	Title              string `json:"title"`
+	Severity           string `json:"severity"`
+	VulnerableVersions string `json:"vulnerable_versions"`
+}
+
+// npmAdvisories asks the registry's bulk advisory endpoint, which is what
+// npm audit uses
+type npmAdvisories struct {
+	registry string
+}
+
+func (n *npmAdvisories) Name() string { return sourceNPM }
+
+func (n *npmAdvisories) Lookup(ctx context.Context, versions map[string][]string) ([]Advisory, error) {
+	client := newRegistryClient(&http.Client{Timeout: 30 * time.Second}, n.registry, "")
+	advisories, err := client.advisories(ctx, versions)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []Advisory{}
+	for name, list := range advisories {
+		for _, advisory := range list {
+			// The bulk response doesn't say which of a package's versions an
+			// advisory affects, so it's reported against all of them
+			for _, version := range versions[name] {
+				found = append(found, Advisory{
+					ID:                 strconv.Itoa(advisory.ID),
+					Name:               name,
+					Version:            version,
+					Title:              advisory.Title,
+					Severity:           advisory.Severity,
+					URL:                advisory.URL,
+					VulnerableVersions: advisory.VulnerableVersions,
+				})
+			}
+		}
+	}
+	return found, nil
+}
+
+// defaultGitHubAdvisoriesURL is GitHub's global advisories REST endpoint
+const defaultGitHubAdvisoriesURL = "https://api.github.com/advisories"
+
+// githubAffectsBatch is how many package versions go in one request, well
+// under GitHub's limit so the query string stays short
+const githubAffectsBatch = 100
+
+// githubAdvisories queries GitHub's global security advisories. A
+// GITHUB_TOKEN raises the rate limit but isn't required
+type githubAdvisories struct {
+	api   string
+	token string
+}
+
+// githubAdvisory is the part of a GitHub global advisory caladan needs
+type githubAdvisory struct {
+	GHSAID          string `json:"ghsa_id"`
+	CVEID           string `json:"cve_id"`
+	Summary         string `json:"summary"`
+	Severity        string `json:"severity"`
+	HTMLURL         string `json:"html_url"`
+	Vulnerabilities []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		VulnerableVersionRange string `json:"vulnerable_version_range"`
+	} `json:"vulnerabilities"`
+}
+
+func (g *githubAdvisories) Name() string { return sourceGitHub }
+
+func (g *githubAdvisories) Lookup(ctx context.Context, versions map[string][]string) ([]Advisory, error) {
+	api := g.api
+	if api == "" {
+		api = defaultGitHubAdvisoriesURL
+	}
+
+	affects := []string{}
+	for name, list := range versions {
+		for _, version := range list {
+			affects = append(affects, name+"@"+version)
+		}
+	}
+	sort.Strings(affects)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	found := []Advisory{}
+	for start := 0; start < len(affects); start += githubAffectsBatch {
+		batch := affects[start:min(start+githubAffectsBatch, len(affects))]
+		query := url.Values{"ecosystem": {"npm"}, "affects": {strings.Join(batch, ",")}, "per_page": {"100"}}
+		next := api + "?" + query.Encode()
+		// Follow pagination through the Link header
+		for next != "" {
+			advisories, link, err := g.fetch(ctx, client, next)
+			if err != nil {
+				return nil, err
+			}
+			for _, advisory := range advisories {
+				found = append(found, advisory.affecting(versions)...)
+			}
+			next = link
+		}
+	}
+	return found, nil
+}
+
+// linkNextPattern finds the next page in a Link header
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+func (g *githubAdvisories) fetch(ctx context.Context, client *http.Client, url string) ([]githubAdvisory, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &RegistryError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var advisories []githubAdvisory
+	if err := json.NewDecoder(resp.Body).Decode(&advisories); err != nil {
+		return nil, "", fmt.Errorf("error parsing advisories: %v", err)
+	}
+	next := ""
+	if match := linkNextPattern.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+		next = match[1]
+	}
+	return advisories, next, nil
+}
+
+// affecting returns the advisory for each installed version it affects
+func (a githubAdvisory) affecting(versions map[string][]string) []Advisory {
+	severity := a.Severity
+	if severity == "medium" {
+		severity = "moderate"
+	}
+	if severityRank(severity) < 0 {
+		severity = "moderate"
+	}
+	aliases := []string{}
+	if a.CVEID != "" {
+		aliases = append(aliases, a.CVEID)
+	}
+
+	found := []Advisory{}
+	for _, vulnerability := range a.Vulnerabilities {
+		if vulnerability.Package.Ecosystem != "npm" {
+			continue
+		}
+		for _, version := range versions[vulnerability.Package.Name] {
+			if !inGitHubRange(version, vulnerability.VulnerableVersionRange) {
+				continue
+			}
+			found = append(found, Advisory{
+				ID:                 a.GHSAID,
+				Aliases:            aliases,
+				Name:               vulnerability.Package.Name,
+				Version:            version,
+				Title:              a.Summary,
+				Severity:           severity,
+				URL:                a.HTMLURL,
+				VulnerableVersions: vulnerability.VulnerableVersionRange,
+			})
+		}
+	}
+	return found
+}
+
+// inGitHubRange reports whether version satisfies a GitHub vulnerable
+// version range, a comma-separated list of comparisons like ">= 1.0.0, < 1.2.6"
+func inGitHubRange(version, versionRange string) bool {
+	for _, comparison := range strings.Split(versionRange, ",") {
+		comparison = strings.TrimSpace(comparison)
+		if comparison == "" {
+			continue
+		}
+		i := strings.IndexFunc(comparison, unicode.IsDigit)
+		if i < 0 {
+			return false
+		}
+		cmp, ok := compareSemver(version, comparison[i:])
+		if !ok {
+			return false
+		}
+		var satisfied bool
+		switch strings.TrimSpace(comparison[:i]) {
+		case "<":
+			satisfied = cmp < 0
+		case "<=":
+			satisfied = cmp <= 0
+		case ">":
+			satisfied = cmp > 0
+		case ">=":
+			satisfied = cmp >= 0
+		case "=", "":
+			satisfied = cmp == 0
+		default:
+			return false
+		}
+		if !satisfied {
+			return false
+		}
+	}
+	return true
+}
+
+// feedAdvisories reads an internal feed, a JSON array of OSV advisories
+// served over HTTP or stored in a file
+type feedAdvisories struct {
+	location string
+
+	once    sync.Once
+	entries []osvEntry
+	err     error
+}
+
+func (f *feedAdvisories) Name() string { return sourceFeed }
+
+func (f *feedAdvisories) Lookup(ctx context.Context, versions map[string][]string) ([]Advisory, error) {
+	f.once.Do(func() {
+		f.entries, f.err = f.load(ctx)
+	})
+	if f.err != nil {
+		return nil, f.err
+	}
+	found := []Advisory{}
+	for _, entry := range f.entries {
+		found = append(found, entry.advisories(versions)...)
+	}
+	return found, nil
+}
+
+func (f *feedAdvisories) load(ctx context.Context) ([]osvEntry, error) {
+	var data []byte
+	if strings.HasPrefix(f.location, "http://") || strings.HasPrefix(f.location, "https://") {
+		client := &http.Client{Timeout: 30 * time.Second}
+		var err error
+		data, err = fetchURL(ctx, client, f.location)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(f.location)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []osvEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", f.location, err)
+	}
+	return entries, nil
+}
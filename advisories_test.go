@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAdvisorySources(t *testing.T) {
+	sources, err := advisorySources("", nil)
+	if err != nil || len(sources) != 1 || sources[0].Name() != sourceNPM {
+		t.Fatalf("advisorySources() default = %v, %v, want npm", sources, err)
+	}
+
+	sources, err = advisorySources("", []AuditSourceConfig{
+		{Type: sourceNPM, Disabled: true},
+		{Type: sourceOSV},
+		{Type: sourceGitHub},
+		{Type: sourceFeed, URL: "https://advisories.example.com/feed.json"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sourceNames(sources); got != "osv, github, feed" {
+		t.Errorf("sourceNames() = %q", got)
+	}
+
+	// A database replaces the configured sources
+	sources, err = advisorySources("npm.zip", []AuditSourceConfig{{Type: sourceGitHub}})
+	if err != nil || len(sources) != 1 || sources[0].Name() != sourceOSV {
+		t.Errorf("advisorySources() with a database = %v, %v, want osv", sources, err)
+	}
+
+	for _, configs := range [][]AuditSourceConfig{
+		{{Type: "snyk"}},
+		{{Type: sourceFeed}},
+		{{Type: sourceNPM, Disabled: true}},
+	} {
+		if _, err := advisorySources("", configs); err == nil {
+			t.Errorf("advisorySources(%+v) succeeded, want an error", configs)
+		}
+	}
+}
+
+func TestMergeAdvisories(t *testing.T) {
+	npm := []Advisory{{ID: "1096366", Name: "minimist", Version: "0.0.8", Severity: "moderate", URL: "https://github.com/advisories/GHSA-xvch-5gv4-984h", Sources: []string{sourceNPM}}}
+	osv := []Advisory{
+		{ID: "GHSA-xvch-5gv4-984h", Aliases: []string{"CVE-2021-44906"}, Name: "minimist", Version: "0.0.8", Severity: "critical", Sources: []string{sourceOSV}},
+		// The same advisory on another version isn't merged
+		{ID: "GHSA-xvch-5gv4-984h", Aliases: []string{"CVE-2021-44906"}, Name: "minimist", Version: "1.2.5", Severity: "critical", Sources: []string{sourceOSV}},
+	}
+	github := []Advisory{{ID: "GHSA-xvch-5gv4-984h", Aliases: []string{"CVE-2021-44906"}, Name: "minimist", Version: "0.0.8", Severity: "critical", Sources: []string{sourceGitHub}}}
+
+	merged := mergeAdvisories(npm, osv, github)
+	if len(merged) != 2 {
+		t.Fatalf("mergeAdvisories() = %+v, want 2 advisories", merged)
+	}
+	first := merged[0]
+	if first.ID != "1096366" || first.Severity != "critical" {
+		t.Errorf("merged = %+v, want npm's ID with the highest severity", first)
+	}
+	if want := []string{"CVE-2021-44906", "GHSA-xvch-5gv4-984h"}; !reflect.DeepEqual(first.Aliases, want) {
+		t.Errorf("Aliases = %v, want %v", first.Aliases, want)
+	}
+	if want := []string{sourceNPM, sourceOSV, sourceGitHub}; !reflect.DeepEqual(first.Sources, want) {
+		t.Errorf("Sources = %v, want %v", first.Sources, want)
+	}
+}
+
+func TestGitHubAdvisories(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if r.URL.Query().Get("page") == "" {
+			if got := r.URL.Query().Get("affects"); got != "left-pad@1.0.0,minimist@0.0.8,minimist@1.2.6" {
+				t.Errorf("affects = %q", got)
+			}
+			w.Header().Set("Link", `<`+server.URL+`/advisories?page=2>; rel="next"`)
+			w.Write([]byte(`[{"ghsa_id": "GHSA-xvch-5gv4-984h", "cve_id": "CVE-2021-44906", "summary": "Prototype Pollution", "severity": "critical", "html_url": "https://github.com/advisories/GHSA-xvch-5gv4-984h",
+				"vulnerabilities": [{"package": {"ecosystem": "npm", "name": "minimist"}, "vulnerable_version_range": "< 0.2.4"}]}]`))
+			return
+		}
+		w.Write([]byte(`[{"ghsa_id": "GHSA-vh95-rmgr-6w4m", "summary": "Prototype Pollution", "severity": "medium", "html_url": "https://github.com/advisories/GHSA-vh95-rmgr-6w4m",
+			"vulnerabilities": [{"package": {"ecosystem": "npm", "name": "minimist"}, "vulnerable_version_range": ">= 1.0.0, < 1.2.3"}]}]`))
+	}))
+	defer server.Close()
+
+	source := &githubAdvisories{api: server.URL + "/advisories", token: "token"}
+	versions := map[string][]string{"minimist": {"0.0.8", "1.2.6"}, "left-pad": {"1.0.0"}}
+	found, err := source.Lookup(context.Background(), versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only 0.0.8 is affected, and only by the first page's advisory
+	if len(found) != 1 || found[0].Version != "0.0.8" || found[0].Severity != "critical" || found[0].Aliases[0] != "CVE-2021-44906" {
+		t.Errorf("Lookup() = %+v", found)
+	}
+}
+
+func TestInGitHubRange(t *testing.T) {
+	tests := []struct {
+		version, versionRange string
+		want                  bool
+	}{
+		{"1.2.5", ">= 1.0.0, < 1.2.6", true},
+		{"1.2.6", ">= 1.0.0, < 1.2.6", false},
+		{"0.9.0", ">= 1.0.0, < 1.2.6", false},
+		{"2.0.0", "<= 2.0.0", true},
+		{"2.0.0", "= 2.0.0", true},
+		{"2.0.1", "> 2.0.0", true},
+		{"1.0.0", "~> 1.0", false},
+	}
+	for _, tt := range tests {
+		if got := inGitHubRange(tt.version, tt.versionRange); got != tt.want {
+			t.Errorf("inGitHubRange(%s, %q) = %v, want %v", tt.version, tt.versionRange, got, tt.want)
+		}
+	}
+}
+
+func TestFeedAdvisories(t *testing.T) {
+	feed := filepath.Join(t.TempDir(), "feed.json")
+	entries := `[{"id": "INTERNAL-1", "summary": "Leaks tokens", "database_specific": {"severity": "HIGH"},
+		"affected": [{"package": {"ecosystem": "npm", "name": "@corp/auth"}, "ranges": [{"type": "SEMVER", "events": [{"introduced": "0"}, {"fixed": "2.0.0"}]}]}]}]`
+	if err := os.WriteFile(feed, []byte(entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := advisorySources("", []AuditSourceConfig{{Type: sourceFeed, Path: feed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := auditVersions(context.Background(), map[string][]string{"@corp/auth": {"1.4.0"}}, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Advisories) != 1 || report.Advisories[0].ID != "INTERNAL-1" || report.Advisories[0].Severity != "high" {
+		t.Fatalf("Advisories = %+v", report.Advisories)
+	}
+	if got := RenderAdvisories(report); !strings.Contains(got, "@corp/auth@1.4.0") {
+		t.Errorf("RenderAdvisories() = %q", got)
+	}
+}
+
+func TestOSVAdvisoriesAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/querybatch":
+			w.Write([]byte(`{"results": [{"vulns": [{"id": "GHSA-xvch-5gv4-984h"}]}]}`))
+		case "/v1/vulns/GHSA-xvch-5gv4-984h":
+			w.Write([]byte(`{"id": "GHSA-xvch-5gv4-984h", "aliases": ["CVE-2021-44906"], "summary": "Prototype Pollution", "database_specific": {"severity": "CRITICAL"},
+				"affected": [{"package": {"ecosystem": "npm", "name": "minimist"}, "ranges": [{"type": "SEMVER", "events": [{"introduced": "0"}, {"fixed": "0.2.4"}]}]}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source := &osvAdvisories{api: server.URL + "/v1"}
+	found, err := source.Lookup(context.Background(), map[string][]string{"minimist": {"0.0.8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Severity != "critical" || !reflect.DeepEqual(found[0].Aliases, []string{"CVE-2021-44906"}) {
+		t.Errorf("Lookup() = %+v", found)
+	}
+}
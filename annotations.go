@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// annotationsFile sits next to package-lock.json and records why each
+// lockfile entry last changed. It's a sidecar so the lockfile stays readable
+// by npm
+const annotationsFile = "caladan-annotations.json"
+
+// LockfileAnnotation records the command that last changed a lockfile entry
+type LockfileAnnotation struct {
+	Command    string   `json:"command"` // e.g. "caladan update lodash"
+	Date       string   `json:"date"`    // RFC 3339
+	Causes     []string `json:"causes"`  // The direct dependencies the entry is there for
+	OldVersion string   `json:"oldVersion,omitempty"`
+	NewVersion string   `json:"newVersion,omitempty"`
+	Override   string   `json:"override,omitempty"` // The --override range that forced the version
+}
+
+// LockfileAnnotations are the annotations of a lockfile, by path
+type LockfileAnnotations struct {
+	Packages map[string]LockfileAnnotation `json:"packages"`
+}
+
+// readAnnotations reads a project's annotations, empty when it has none
+func readAnnotations(directory string) (*LockfileAnnotations, error) {
+	annotations := &LockfileAnnotations{Packages: make(map[string]LockfileAnnotation)}
+	data, err := os.ReadFile(filepath.Join(directory, annotationsFile))
+	if os.IsNotExist(err) {
+		return annotations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, annotations); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", annotationsFile, err)
+	}
+	if annotations.Packages == nil {
+		annotations.Packages = make(map[string]LockfileAnnotation)
+	}
+	return annotations, nil
+}
+
+// annotateLockfile records command as the cause of changes, dropping
+// annotations of entries that were removed by an earlier command. Entries
+// of packages in overrides are annotated with their override even when they
+// didn't change
+func annotateLockfile(directory, command string, oldPackages, newPackages map[string]json.RawMessage, changes []lockfileChange, overrides map[string]string, now time.Time) error {
+	if len(changes) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	annotations, err := readAnnotations(directory)
+	if err != nil {
+		return err
+	}
+
+	newCauses := lockfileCauses(newPackages)
+	oldCauses := lockfileCauses(oldPackages)
+	changed := make(map[string]bool)
+	for _, change := range changes {
+		changed[change.Path] = true
+		causes := newCauses[change.Path]
+		if change.NewVersion == "" {
+			causes = oldCauses[change.Path]
+		}
+		annotations.Packages[change.Path] = LockfileAnnotation{
+			Command:    command,
+			Date:       now.UTC().Format(time.RFC3339),
+			Causes:     causes,
+			OldVersion: change.OldVersion,
+			NewVersion: change.NewVersion,
+		}
+	}
+	for path, raw := range newPackages {
+		override, ok := overrides[packageNameFromPath(path)]
+		if !ok || path == "" {
+			continue
+		}
+		annotation, annotated := annotations.Packages[path]
+		if !changed[path] || !annotated {
+			version := lockfileEntryVersion(raw)
+			annotation = LockfileAnnotation{Command: command, Date: now.UTC().Format(time.RFC3339), Causes: newCauses[path], NewVersion: version}
+		}
+		annotation.Override = override
+		annotations.Packages[path] = annotation
+	}
+	for path := range annotations.Packages {
+		if _, ok := newPackages[path]; !ok && !changed[path] {
+			delete(annotations.Packages, path)
+		}
+	}
+
+	out, err := json.MarshalIndent(annotations, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(directory, annotationsFile), append(out, '\n'), 0644)
+}
+
+// lockfileCauses returns, for each lockfile path, the direct dependencies of
+// the root that it's reachable from
+func lockfileCauses(packages map[string]json.RawMessage) map[string][]string {
+	causes := make(map[string][]string)
+	var root PackageInfo
+	if err := json.Unmarshal(packages[""], &root); err != nil {
+		return causes
+	}
+
+	direct := []string{}
+	for _, deps := range []map[string]string{root.Dependencies, root.DevDependencies, root.OptionalDependencies, root.PeerDependencies} {
+		for name := range deps {
+			direct = append(direct, name)
+		}
+	}
+	sort.Strings(direct)
+
+	for _, name := range direct {
+		path, ok := findLockfileDependency(packages, "", name)
+		if !ok {
+			continue
+		}
+		for reached := range reachableFrom(packages, path) {
+			causes[reached] = appendUnique(causes[reached], name)
+		}
+	}
+	return causes
+}
+
+// Diff compares a project's lockfile with an older one, by default the one
+// committed at git's HEAD, showing why each entry changed
+func Diff(directory, oldLockfilePath string) error {
+	packageLock, err := readLockFile(filepath.Join(directory, "package-lock.json"))
+	if err != nil {
+		return fmt.Errorf("error reading lockfile: %v", err)
+	}
+
+	var oldLock PackageLock
+	if oldLockfilePath != "" {
+		old, err := readLockFile(oldLockfilePath)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", oldLockfilePath, err)
+		}
+		oldLock = *old
+	} else {
+		cmd := exec.Command("git", "show", "HEAD:./package-lock.json")
+		cmd.Dir = directory
+		data, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("error reading the committed lockfile (pass one to compare with instead): %v", err)
+		}
+		if err := json.Unmarshal(data, &oldLock); err != nil {
+			return fmt.Errorf("error parsing the committed lockfile: %v", err)
+		}
+	}
+
+	annotations, err := readAnnotations(directory)
+	if err != nil {
+		return err
+	}
+	changes := diffLockfiles(oldLock.Packages, packageLock.Packages)
+	if len(changes) == 0 {
+		fmt.Println("No lockfile changes")
+		return nil
+	}
+	fmt.Print(RenderAnnotatedDiff(changes, annotations))
+	return nil
+}
+
+// RenderAnnotatedDiff renders lockfile changes one per line, each followed by
+// the command that made it when it's annotated
+func RenderAnnotatedDiff(changes []lockfileChange, annotations *LockfileAnnotations) string {
+	var builder strings.Builder
+	for _, change := range changes {
+		builder.WriteString(renderLockfileChange(change) + "\n")
+
+		// An annotation for another version is stale, the entry has been
+		// changed by hand or by a tool that doesn't annotate since
+		annotation, ok := annotations.Packages[change.Path]
+		if !ok || annotation.NewVersion != change.NewVersion {
+			continue
+		}
+		date := annotation.Date
+		if t, err := time.Parse(time.RFC3339, annotation.Date); err == nil {
+			date = t.Format("2006-01-02")
+		}
+		line := fmt.Sprintf("    %s on %s", annotation.Command, date)
+		if len(annotation.Causes) > 0 {
+			line += ", for " + strings.Join(annotation.Causes, ", ")
+		}
+		if annotation.Override != "" {
+			line += ", overridden to " + annotation.Override
+		}
+		builder.WriteString(colorDim(line) + "\n")
+	}
+	return builder.String()
+}
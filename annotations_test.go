@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotateLockfile(t *testing.T) {
+	oldPackages := map[string]json.RawMessage{
+		"":                       json.RawMessage(`{"dependencies": {"express": "4.17.0", "lodash": "4.17.20"}}`),
+		"node_modules/express":   json.RawMessage(`{"version": "4.17.0", "dependencies": {"qs": "6.7.0"}}`),
+		"node_modules/qs":        json.RawMessage(`{"version": "6.7.0"}`),
+		"node_modules/lodash":    json.RawMessage(`{"version": "4.17.20"}`),
+		"node_modules/left-pad":  json.RawMessage(`{"version": "1.0.0"}`),
+		"node_modules/is-number": json.RawMessage(`{"version": "7.0.0"}`),
+	}
+	newPackages := map[string]json.RawMessage{
+		"":                       json.RawMessage(`{"dependencies": {"express": "4.18.0", "lodash": "4.17.20"}}`),
+		"node_modules/express":   json.RawMessage(`{"version": "4.18.0", "dependencies": {"qs": "6.11.0", "lodash": "^4.17.0"}}`),
+		"node_modules/qs":        json.RawMessage(`{"version": "6.11.0"}`),
+		"node_modules/lodash":    json.RawMessage(`{"version": "4.17.20"}`),
+		"node_modules/is-number": json.RawMessage(`{"version": "7.0.0"}`),
+	}
+
+	dir := t.TempDir()
+	// A removed entry's annotation from an earlier command is dropped
+	writeTestFile(t, dir+"/"+annotationsFile, `{"packages": {"node_modules/gone": {"command": "caladan install"}, "node_modules/is-number": {"command": "caladan install", "newVersion": "7.0.0"}}}`)
+
+	changes := diffLockfiles(oldPackages, newPackages)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	if err := annotateLockfile(dir, "caladan update express", oldPackages, newPackages, changes, nil, now); err != nil {
+		t.Fatal(err)
+	}
+
+	annotations, err := readAnnotations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs := annotations.Packages["node_modules/qs"]
+	want := LockfileAnnotation{Command: "caladan update express", Date: "2026-10-16T12:00:00Z", Causes: []string{"express"}, OldVersion: "6.7.0", NewVersion: "6.11.0"}
+	if !reflect.DeepEqual(qs, want) {
+		t.Errorf("qs annotation = %+v, want %+v", qs, want)
+	}
+	if _, ok := annotations.Packages["node_modules/left-pad"]; !ok {
+		t.Errorf("removed left-pad wasn't annotated")
+	}
+	if _, ok := annotations.Packages["node_modules/gone"]; ok {
+		t.Errorf("stale annotation for node_modules/gone was kept")
+	}
+	if _, ok := annotations.Packages["node_modules/is-number"]; !ok {
+		t.Errorf("unchanged is-number lost its annotation")
+	}
+	if causes := lockfileCauses(newPackages)["node_modules/lodash"]; !reflect.DeepEqual(causes, []string{"express", "lodash"}) {
+		t.Errorf("lodash causes = %v", causes)
+	}
+
+	rendered := RenderAnnotatedDiff(changes, annotations)
+	if !strings.Contains(rendered, "~ node_modules/qs 6.7.0 -> 6.11.0\n    caladan update express on 2026-10-16, for express\n") {
+		t.Errorf("RenderAnnotatedDiff() = %q", rendered)
+	}
+
+	// Edited by hand since, so the annotation no longer applies
+	stale := []lockfileChange{{Path: "node_modules/qs", OldVersion: "6.7.0", NewVersion: "6.12.0"}}
+	if rendered := RenderAnnotatedDiff(stale, annotations); strings.Contains(rendered, "caladan update") {
+		t.Errorf("RenderAnnotatedDiff() showed a stale annotation: %q", rendered)
+	}
+}
+
+func TestAnnotateLockfileOverrides(t *testing.T) {
+	oldPackages := map[string]json.RawMessage{
+		"":                     json.RawMessage(`{"dependencies": {"express": "4.18.0"}}`),
+		"node_modules/express": json.RawMessage(`{"version": "4.18.0", "dependencies": {"qs": "6.11.0"}}`),
+		"node_modules/qs":      json.RawMessage(`{"version": "6.11.0"}`),
+	}
+	newPackages := map[string]json.RawMessage{
+		"":                     json.RawMessage(`{"dependencies": {"express": "4.18.0"}}`),
+		"node_modules/express": json.RawMessage(`{"version": "4.18.0", "dependencies": {"qs": "6.11.2"}}`),
+		"node_modules/qs":      json.RawMessage(`{"version": "6.11.2"}`),
+	}
+
+	dir := t.TempDir()
+	overrides := map[string]string{"qs": "6.11.2", "express": "4.18.0"}
+	command := overrideCommand("caladan install", overrides)
+	if command != "caladan install --override express@4.18.0 --override qs@6.11.2" {
+		t.Errorf("overrideCommand() = %q", command)
+	}
+	changes := diffLockfiles(oldPackages, newPackages)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	if err := annotateLockfile(dir, command, oldPackages, newPackages, changes, overrides, now); err != nil {
+		t.Fatal(err)
+	}
+
+	annotations, err := readAnnotations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qs := annotations.Packages["node_modules/qs"]; qs.Override != "6.11.2" || qs.OldVersion != "6.11.0" || qs.Command != command {
+		t.Errorf("qs annotation = %+v, want the override with the change", qs)
+	}
+	// An override that didn't change the entry is still recorded
+	if express := annotations.Packages["node_modules/express"]; express.Override != "4.18.0" || express.NewVersion != "4.18.0" {
+		t.Errorf("express annotation = %+v, want the override", express)
+	}
+	if rendered := RenderAnnotatedDiff(changes, annotations); !strings.Contains(rendered, "overridden to 6.11.2") {
+		t.Errorf("RenderAnnotatedDiff() = %q, want the override", rendered)
+	}
+}
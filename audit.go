@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// auditSeverities are the advisory severities, least severe first
+var auditSeverities = []string{"info", "low", "moderate", "high", "critical"}
+
+// validAuditLevel reports whether level can be used with --audit-level
+func validAuditLevel(level string) bool {
+	// info advisories aren't vulnerabilities, so they can't fail a build
+	return level != "info" && severityRank(level) >= 0
+}
+
+// severityRank orders severities, -1 for unknown ones
+func severityRank(severity string) int {
+	for i, s := range auditSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// Advisory is a vulnerability affecting an installed package
+type Advisory struct {
+	ID                 string   `json:"id"`
+	Aliases            []string `json:"aliases,omitempty"` // Other IDs for the same advisory, e.g. CVEs
+	Name               string   `json:"name"`
+	Version            string   `json:"version"` // The installed version it affects
+	Title              string   `json:"title"`
+	Severity           string   `json:"severity"`
+	URL                string   `json:"url"`
+	VulnerableVersions string   `json:"vulnerableVersions"`
+	Sources            []string `json:"sources,omitempty"` // The advisory sources that reported it
+
+	// The project's exception for it, accepted or expired
+	Exception *AuditException `json:"exception,omitempty"`
+}
+
+// AuditReport is what an audit of the installed packages found
+type AuditReport struct {
+	Advisories []Advisory     `json:"advisories"`
+	Counts     map[string]int `json:"counts"` // Advisories by severity
+
+	// Advisories the project's exceptions file accepts, which don't count,
+	// and the exceptions that have expired
+	Accepted []Advisory       `json:"accepted,omitempty"`
+	Expired  []AuditException `json:"expiredExceptions,omitempty"`
+}
+
+// atOrAbove counts the advisories at least as severe as level
+func (r *AuditReport) atOrAbove(level string) int {
+	if r == nil {
+		return 0
+	}
+	count := 0
+	for _, advisory := range r.Advisories {
+		if severityRank(advisory.Severity) >= severityRank(level) {
+			count++
+		}
+	}
+	return count
+}
+
+// auditedVersions returns the installed versions of each package
+func auditedVersions(summary *InstallSummary) map[string][]string {
+	versions := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, stats := range summary.Packages {
+		name := packageNameFromPath(stats.Path)
+		if seen[name+"@"+stats.Version] {
+			continue
+		}
+		seen[name+"@"+stats.Version] = true
+		versions[name] = append(versions[name], stats.Version)
+	}
+	for _, list := range versions {
+		sort.Strings(list)
+	}
+	return versions
+}
+
+// packageNameFromPath returns the package name of a lockfile path, which is
+// whatever follows its last node_modules
+func packageNameFromPath(path string) string {
+	if i := strings.LastIndex(path, "node_modules/"); i >= 0 {
+		return path[i+len("node_modules/"):]
+	}
+	return path
+}
+
+// auditInstall checks the installed packages against advisory sources
+func auditInstall(ctx context.Context, summary *InstallSummary, sources []AdvisorySource) (*AuditReport, error) {
+	return auditVersions(ctx, auditedVersions(summary), sources)
+}
+
+// auditVersions builds a report of the advisories affecting package versions
+func auditVersions(ctx context.Context, versions map[string][]string, sources []AdvisorySource) (*AuditReport, error) {
+	report := &AuditReport{Advisories: []Advisory{}, Counts: make(map[string]int)}
+	if len(versions) == 0 {
+		return report, nil
+	}
+
+	advisories, err := lookupAll(ctx, sources, versions)
+	if err != nil {
+		return nil, err
+	}
+	for _, advisory := range advisories {
+		report.Advisories = append(report.Advisories, advisory)
+		report.Counts[advisory.Severity]++
+	}
+	sort.Slice(report.Advisories, func(i, j int) bool {
+		a, b := report.Advisories[i], report.Advisories[j]
+		if severityRank(a.Severity) != severityRank(b.Severity) {
+			return severityRank(a.Severity) > severityRank(b.Severity)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.ID < b.ID
+	})
+	return report, nil
+}
+
+// RenderAuditCounts formats the advisories by severity, most severe first
+func RenderAuditCounts(report *AuditReport) string {
+	accepted := ""
+	if len(report.Accepted) > 0 {
+		accepted = fmt.Sprintf(", %d accepted", len(report.Accepted))
+	}
+	if len(report.Advisories) == 0 {
+		return colorSuccess("found 0 vulnerabilities") + accepted
+	}
+
+	counts := []string{}
+	for i := len(auditSeverities) - 1; i >= 0; i-- {
+		severity := auditSeverities[i]
+		if n := report.Counts[severity]; n > 0 {
+			text := fmt.Sprintf("%d %s", n, severity)
+			if severityRank(severity) >= severityRank("high") {
+				text = colorError(text)
+			} else {
+				text = colorWarn(text)
+			}
+			counts = append(counts, text)
+		}
+	}
+	return fmt.Sprintf("found %d vulnerabilities (%s)%s", len(report.Advisories), strings.Join(counts, ", "), accepted)
+}
+
+// AuditOptions configures caladan audit
+type AuditOptions struct {
+	DB    string // OSV database snapshot to use instead of the registry
+	Level string // Exit nonzero on advisories at or above this severity
+	JSON  bool   // Print the report as JSON
+
+	jsonOutput io.Writer
+}
+
+// lockfileVersions returns the versions of each package in a lockfile
+func lockfileVersions(packageLock *PackageLock) (map[string][]string, error) {
+	versions := make(map[string][]string)
+	seen := make(map[string]bool)
+	for path, raw := range packageLock.Packages {
+		if path == "" {
+			continue
+		}
+		var entry PackageInfo
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("error parsing lockfile entry %s: %v", path, err)
+		}
+		name := packageNameFromPath(path)
+		if entry.Version == "" || seen[name+"@"+entry.Version] {
+			continue
+		}
+		seen[name+"@"+entry.Version] = true
+		versions[name] = append(versions[name], entry.Version)
+	}
+	for _, list := range versions {
+		sort.Strings(list)
+	}
+	return versions, nil
+}
+
+// Audit checks the packages in a project's lockfile for advisories
+func Audit(directory string, opts AuditOptions) error {
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	if opts.DB == "" {
+		opts.DB = os.Getenv("CALADAN_AUDIT_DB")
+	}
+	if opts.DB == "" {
+		opts.DB = config.AuditDB
+	}
+	if opts.Level == "" {
+		opts.Level = config.AuditLevel
+	}
+	if opts.Level == "" {
+		opts.Level = "low"
+	}
+	if !validAuditLevel(opts.Level) {
+		return fmt.Errorf("audit level must be low, moderate, high, or critical, got %s", opts.Level)
+	}
+
+	lockfilePath := filepath.Join(directory, "package-lock.json")
+	packageLock, err := readLockFile(lockfilePath)
+	if err != nil {
+		return fmt.Errorf("error reading lockfile (run caladan install first): %v", err)
+	}
+	versions, err := lockfileVersions(packageLock)
+	if err != nil {
+		return err
+	}
+
+	sources, err := advisorySources(opts.DB, config.AuditSources)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Auditing %d packages against %s\n", len(versions), sourceNames(sources))
+	exceptions, err := readAuditExceptions(directory)
+	if err != nil {
+		return err
+	}
+	report, err := auditVersions(context.Background(), versions, sources)
+	if err != nil {
+		return err
+	}
+	report.applyExceptions(exceptions, time.Now())
+
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("error writing JSON report: %v", err)
+		}
+	} else {
+		fmt.Print(RenderAdvisories(report))
+		fmt.Println(RenderAuditCounts(report))
+	}
+	warnExpiredExceptions(report)
+	annotateAdvisories(report, lockfilePath, packageLock.Packages)
+
+	if n := report.atOrAbove(opts.Level); n > 0 {
+		return fmt.Errorf("found %d vulnerabilities at or above %s severity", n, opts.Level)
+	}
+	return nil
+}
+
+// sourceNames lists the sources an audit uses
+func sourceNames(sources []AdvisorySource) string {
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = source.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+// RenderAdvisories lists each advisory, most severe first
+func RenderAdvisories(report *AuditReport) string {
+	var builder strings.Builder
+	for _, advisory := range report.Advisories {
+		severity := colorWarn(advisory.Severity)
+		if severityRank(advisory.Severity) >= severityRank("high") {
+			severity = colorError(advisory.Severity)
+		}
+		builder.WriteString(fmt.Sprintf("%s %s: %s\n", severity, colorPackage(advisory.Name+"@"+advisory.Version), advisory.Title))
+		builder.WriteString(fmt.Sprintf("  vulnerable: %s\n  %s\n", advisory.VulnerableVersions, colorDim(advisory.URL)))
+		if len(advisory.Sources) > 1 {
+			builder.WriteString(fmt.Sprintf("  reported by %s\n", strings.Join(advisory.Sources, ", ")))
+		}
+	}
+	for _, advisory := range report.Accepted {
+		builder.WriteString(fmt.Sprintf("%s %s: %s\n", colorDim("accepted"), colorPackage(advisory.Name+"@"+advisory.Version), advisory.Title))
+		builder.WriteString(fmt.Sprintf("  until %s by %s\n", advisory.Exception.Expires, advisory.Exception.Owner))
+	}
+	return builder.String()
+}
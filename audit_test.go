@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuditInstall(t *testing.T) {
+	var sent map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/-/npm/v1/security/advisories/bulk" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Write([]byte(`{
+			"minimist": [{"id": 1, "title": "Prototype Pollution", "severity": "critical", "url": "https://github.com/advisories/1", "vulnerable_versions": "<0.2.4"}],
+			"lodash": [{"id": 2, "title": "ReDoS", "severity": "moderate", "url": "https://github.com/advisories/2", "vulnerable_versions": "<4.17.21"}]
+		}`))
+	}))
+	defer server.Close()
+
+	summary := &InstallSummary{}
+	summary.add(PackageStats{Path: "node_modules/minimist", Version: "0.0.8"})
+	summary.add(PackageStats{Path: "node_modules/lodash", Version: "4.17.20"})
+	summary.add(PackageStats{Path: "node_modules/a/node_modules/lodash", Version: "4.17.20"})
+	summary.add(PackageStats{Path: "node_modules/@scope/safe", Version: "1.0.0"})
+
+	report, err := auditInstall(context.Background(), summary, []AdvisorySource{&npmAdvisories{registry: server.URL}})
+	if err != nil {
+		t.Fatalf("auditInstall() error = %v", err)
+	}
+
+	wantSent := map[string][]string{"minimist": {"0.0.8"}, "lodash": {"4.17.20"}, "@scope/safe": {"1.0.0"}}
+	if !reflect.DeepEqual(sent, wantSent) {
+		t.Errorf("sent %v, want %v", sent, wantSent)
+	}
+	if len(report.Advisories) != 2 || report.Advisories[0].Name != "minimist" || report.Advisories[0].Version != "0.0.8" {
+		t.Fatalf("Advisories = %+v, want minimist first", report.Advisories)
+	}
+	if report.Counts["critical"] != 1 || report.Counts["moderate"] != 1 {
+		t.Errorf("Counts = %v", report.Counts)
+	}
+
+	for level, want := range map[string]int{"low": 2, "moderate": 2, "high": 1, "critical": 1} {
+		if got := report.atOrAbove(level); got != want {
+			t.Errorf("atOrAbove(%s) = %d, want %d", level, got, want)
+		}
+	}
+
+	if got := RenderAuditCounts(report); !strings.Contains(got, "found 2 vulnerabilities (1 critical, 1 moderate)") {
+		t.Errorf("RenderAuditCounts() = %q", got)
+	}
+}
+
+func TestAuditInstallRegistryError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	summary := &InstallSummary{}
+	summary.add(PackageStats{Path: "node_modules/a", Version: "1.0.0"})
+	_, err := auditInstall(context.Background(), summary, []AdvisorySource{&npmAdvisories{registry: server.URL}})
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) || registryErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("auditInstall() error = %v, want a 503 RegistryError", err)
+	}
+
+	// Not auditing means nothing can fail the build
+	var report *AuditReport
+	if report.atOrAbove("low") != 0 {
+		t.Errorf("nil report has advisories")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// auditExceptionsFile lists the advisories a project has accepted the risk
+// of, next to its package.json, and is meant to be committed
+const auditExceptionsFile = "audit-exceptions.json"
+
+// AuditException accepts the risk of an advisory until it expires, after
+// which the advisory fails audits again
+type AuditException struct {
+	ID      string `json:"id"`      // The advisory's ID or any alias, e.g. a GHSA or CVE
+	Owner   string `json:"owner"`   // Who accepted it, and is asked about it once it expires
+	Expires string `json:"expires"` // The last day it applies, as YYYY-MM-DD
+	Reason  string `json:"reason,omitempty"`
+
+	until time.Time // The end of the Expires day, local time
+}
+
+// readAuditExceptions reads a project's exceptions file, which is optional
+func readAuditExceptions(directory string) ([]AuditException, error) {
+	path := filepath.Join(directory, auditExceptionsFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var exceptions []AuditException
+	if err := json.Unmarshal(data, &exceptions); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	for i := range exceptions {
+		exception := &exceptions[i]
+		if exception.ID == "" || exception.Owner == "" || exception.Expires == "" {
+			return nil, fmt.Errorf("%s: exception %d needs an id, owner, and expires", path, i+1)
+		}
+		day, err := time.ParseInLocation("2006-01-02", exception.Expires, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("%s: exception for %s expires on %q, want YYYY-MM-DD", path, exception.ID, exception.Expires)
+		}
+		exception.until = day.AddDate(0, 0, 1)
+	}
+	return exceptions, nil
+}
+
+// applyExceptions moves the advisories with an unexpired exception out of
+// the report's advisories and counts into Accepted. Advisories whose
+// exception has expired stay, and the exception is listed in Expired
+func (r *AuditReport) applyExceptions(exceptions []AuditException, now time.Time) {
+	if r == nil || len(exceptions) == 0 {
+		return
+	}
+	byID := make(map[string]*AuditException, len(exceptions))
+	for i := range exceptions {
+		byID[exceptions[i].ID] = &exceptions[i]
+	}
+
+	active := []Advisory{}
+	expired := make(map[string]bool)
+	for _, advisory := range r.Advisories {
+		var exception *AuditException
+		for _, key := range advisoryKeys(advisory) {
+			if byID[key] != nil {
+				exception = byID[key]
+				break
+			}
+		}
+		if exception == nil {
+			active = append(active, advisory)
+			continue
+		}
+		accepted := *exception
+		advisory.Exception = &accepted
+		if now.Before(exception.until) {
+			r.Accepted = append(r.Accepted, advisory)
+			r.Counts[advisory.Severity]--
+			if r.Counts[advisory.Severity] == 0 {
+				delete(r.Counts, advisory.Severity)
+			}
+			continue
+		}
+		active = append(active, advisory)
+		if !expired[exception.ID] {
+			expired[exception.ID] = true
+			r.Expired = append(r.Expired, accepted)
+		}
+	}
+	r.Advisories = active
+}
+
+// warnExpiredExceptions warns about each exception that no longer applies,
+// naming its owner
+func warnExpiredExceptions(report *AuditReport) {
+	if report == nil {
+		return
+	}
+	for _, exception := range report.Expired {
+		printWarning("the audit exception for %s expired on %s, ask %s to renew or drop it", exception.ID, exception.Expires, exception.Owner)
+	}
+}
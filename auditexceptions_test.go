@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditExceptions(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, auditExceptionsFile), `[
+		{"id": "CVE-2024-0001", "owner": "security@example.com", "expires": "2026-03-31", "reason": "not reachable"},
+		{"id": "GHSA-aaaa-bbbb-cccc", "owner": "platform@example.com", "expires": "2026-01-31"}
+	]`)
+	exceptions, err := readAuditExceptions(dir)
+	if err != nil {
+		t.Fatalf("readAuditExceptions() error = %v", err)
+	}
+
+	newReport := func() *AuditReport {
+		return &AuditReport{
+			Advisories: []Advisory{
+				{ID: "1001", Aliases: []string{"CVE-2024-0001"}, Name: "a", Version: "1.0.0", Severity: "high"},
+				{ID: "GHSA-aaaa-bbbb-cccc", Name: "b", Version: "1.0.0", Severity: "moderate"},
+				{ID: "1003", Name: "c", Version: "1.0.0", Severity: "high"},
+			},
+			Counts: map[string]int{"high": 2, "moderate": 1},
+		}
+	}
+
+	// On its expiry date an exception still applies
+	report := newReport()
+	report.applyExceptions(exceptions, time.Date(2026, 1, 31, 23, 0, 0, 0, time.Local))
+	if len(report.Advisories) != 1 || len(report.Accepted) != 2 || len(report.Expired) != 0 {
+		t.Fatalf("advisories = %+v, accepted = %+v, want only c left", report.Advisories, report.Accepted)
+	}
+	if report.atOrAbove("low") != 1 || report.Counts["moderate"] != 0 || report.Counts["high"] != 1 {
+		t.Errorf("counts = %v, want accepted advisories not counted", report.Counts)
+	}
+	if got := RenderAuditCounts(report); !strings.Contains(got, "2 accepted") {
+		t.Errorf("RenderAuditCounts() = %q, want the accepted count", got)
+	}
+
+	// Once it's expired the advisory fails audits again
+	report = newReport()
+	report.applyExceptions(exceptions, time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local))
+	if len(report.Advisories) != 2 || len(report.Expired) != 1 || report.Expired[0].Owner != "platform@example.com" {
+		t.Errorf("advisories = %+v, expired = %+v, want b's exception expired", report.Advisories, report.Expired)
+	}
+}
+
+func TestReadAuditExceptionsInvalid(t *testing.T) {
+	for _, content := range []string{
+		`[{"id": "CVE-2024-0001", "expires": "2026-03-31"}]`,
+		`[{"id": "CVE-2024-0001", "owner": "security@example.com", "expires": "next month"}]`,
+	} {
+		dir := t.TempDir()
+		writeTestFile(t, filepath.Join(dir, auditExceptionsFile), content)
+		if _, err := readAuditExceptions(dir); err == nil {
+			t.Errorf("readAuditExceptions(%s) succeeded, want an error", content)
+		}
+	}
+
+	if exceptions, err := readAuditExceptions(t.TempDir()); err != nil || exceptions != nil {
+		t.Errorf("readAuditExceptions() without a file = %v, %v", exceptions, err)
+	}
+}
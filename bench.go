@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BenchOptions configures caladan bench
+type BenchOptions struct {
+	Runs int  // Timed runs per scenario
+	JSON bool // Print the results as JSON
+
+	// Where the JSON results go, progress output is moved to stderr
+	jsonOutput io.Writer
+}
+
+// benchScenario is one kind of install that bench times
+type benchScenario struct {
+	name string
+	// prepare puts the project and cache in the state the scenario starts from
+	prepare func(projectDir, cacheDir string) error
+}
+
+// BenchResult holds the timings of one scenario
+type BenchResult struct {
+	Scenario string
+	Runs     []time.Duration
+	Mean     time.Duration
+	Median   time.Duration
+	Stddev   time.Duration
+	Min      time.Duration
+	Max      time.Duration
+}
+
+func (r BenchResult) MarshalJSON() ([]byte, error) {
+	runs := make([]float64, len(r.Runs))
+	for i, run := range r.Runs {
+		runs[i] = milliseconds(run)
+	}
+	return json.Marshal(struct {
+		Scenario string    `json:"scenario"`
+		RunsMs   []float64 `json:"runsMs"`
+		MeanMs   float64   `json:"meanMs"`
+		MedianMs float64   `json:"medianMs"`
+		StddevMs float64   `json:"stddevMs"`
+		MinMs    float64   `json:"minMs"`
+		MaxMs    float64   `json:"maxMs"`
+	}{r.Scenario, runs, milliseconds(r.Mean), milliseconds(r.Median), milliseconds(r.Stddev), milliseconds(r.Min), milliseconds(r.Max)})
+}
+
+var benchScenarios = []benchScenario{
+	{
+		// Nothing cached and nothing installed
+		name: "cold",
+		prepare: func(projectDir, cacheDir string) error {
+			if err := os.RemoveAll(cacheDir); err != nil {
+				return err
+			}
+			return resetBenchProject(projectDir)
+		},
+	},
+	{
+		// Registry metadata cached by an earlier run, nothing installed
+		name: "warm",
+		prepare: func(projectDir, cacheDir string) error {
+			return resetBenchProject(projectDir)
+		},
+	},
+	{
+		// Everything already installed by an earlier run
+		name: "no-op",
+		prepare: func(projectDir, cacheDir string) error {
+			return nil
+		},
+	},
+}
+
+// Bench times installs of a project. It works on a copy of the project's
+// manifest in a temporary directory, with its own cache, so neither the
+// project nor the user's cache is touched
+func Bench(directory string, opts BenchOptions) error {
+	if opts.Runs < 1 {
+		return fmt.Errorf("--runs must be at least 1")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding caladan executable: %v", err)
+	}
+
+	workDir, err := os.MkdirTemp("", "caladan-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	projectDir := filepath.Join(workDir, "project")
+	cacheDir := filepath.Join(workDir, "cache")
+	if err := os.MkdirAll(projectDir, 0755); err != nil {
+		return err
+	}
+	if err := copyFile(filepath.Join(directory, "package.json"), filepath.Join(projectDir, "package.json")); err != nil {
+		return fmt.Errorf("error copying package.json: %v", err)
+	}
+
+	results := []BenchResult{}
+	for _, scenario := range benchScenarios {
+		fmt.Printf("Benchmarking %s installs of %s (%d runs)\n", scenario.name, directory, opts.Runs)
+
+		// Warm up once so warm and no-op runs have something to start from
+		if err := scenario.prepare(projectDir, cacheDir); err != nil {
+			return err
+		}
+		if _, err := runBenchInstall(executable, projectDir, cacheDir); err != nil {
+			return err
+		}
+
+		runs := make([]time.Duration, opts.Runs)
+		for i := range runs {
+			if err := scenario.prepare(projectDir, cacheDir); err != nil {
+				return err
+			}
+			runs[i], err = runBenchInstall(executable, projectDir, cacheDir)
+			if err != nil {
+				return err
+			}
+		}
+		results = append(results, summarizeBench(scenario.name, runs))
+	}
+
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+	fmt.Print(RenderBenchResults(results))
+	return nil
+}
+
+// resetBenchProject removes everything an install creates
+func resetBenchProject(projectDir string) error {
+	if err := os.RemoveAll(filepath.Join(projectDir, "node_modules")); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(projectDir, "package-lock.json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// runBenchInstall runs caladan install in a child process and times it
+func runBenchInstall(executable, projectDir, cacheDir string) (time.Duration, error) {
+	// The audit is a registry round trip that has nothing to do with install speed
+	cmd := exec.Command(executable, "install", "--audit=false", projectDir)
+
+	// Profiling the benchmark runs would overwrite the bench command's own profiles
+	env := []string{"CALADAN_CACHE_DIR=" + cacheDir}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if key != "CPU_PROFILE" && key != "MEM_PROFILE" && key != "TRACE" && key != "CALADAN_CACHE_DIR" {
+			env = append(env, kv)
+		}
+	}
+	cmd.Env = env
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	err := cmd.Run()
+	elapsed := time.Since(start)
+	if err != nil {
+		return 0, fmt.Errorf("install failed: %v\n%s", err, output.String())
+	}
+	return elapsed, nil
+}
+
+// summarizeBench computes the statistics for a scenario's runs
+func summarizeBench(scenario string, runs []time.Duration) BenchResult {
+	result := BenchResult{Scenario: scenario, Runs: runs}
+	if len(runs) == 0 {
+		return result
+	}
+
+	sorted := make([]time.Duration, len(runs))
+	copy(sorted, runs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	result.Min = sorted[0]
+	result.Max = sorted[len(sorted)-1]
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		result.Median = (sorted[middle-1] + sorted[middle]) / 2
+	} else {
+		result.Median = sorted[middle]
+	}
+
+	var total float64
+	for _, run := range runs {
+		total += float64(run)
+	}
+	mean := total / float64(len(runs))
+	result.Mean = time.Duration(mean)
+
+	// Sample standard deviation, zero for a single run
+	if len(runs) > 1 {
+		var squares float64
+		for _, run := range runs {
+			squares += (float64(run) - mean) * (float64(run) - mean)
+		}
+		result.Stddev = time.Duration(math.Sqrt(squares / float64(len(runs)-1)))
+	}
+
+	return result
+}
+
+// RenderBenchResults formats bench results as a table
+func RenderBenchResults(results []BenchResult) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("\n%-8s %10s %10s %10s %10s %10s\n", "scenario", "mean", "median", "stddev", "min", "max"))
+	for _, r := range results {
+		builder.WriteString(fmt.Sprintf("%-8s %10s %10s %10s %10s %10s\n", r.Scenario,
+			r.Mean.Round(time.Millisecond), r.Median.Round(time.Millisecond), r.Stddev.Round(time.Millisecond),
+			r.Min.Round(time.Millisecond), r.Max.Round(time.Millisecond)))
+	}
+	return builder.String()
+}
+
+// copyFile copies a regular file
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
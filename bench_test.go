@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarizeBench(t *testing.T) {
+	runs := []time.Duration{4 * time.Second, 2 * time.Second, 6 * time.Second, 4 * time.Second}
+	got := summarizeBench("cold", runs)
+
+	want := BenchResult{
+		Scenario: "cold",
+		Runs:     runs,
+		Mean:     4 * time.Second,
+		Median:   4 * time.Second,
+		Stddev:   1632993161, // sqrt(8/3) seconds
+		Min:      2 * time.Second,
+		Max:      6 * time.Second,
+	}
+	if got.Mean != want.Mean || got.Median != want.Median || got.Stddev != want.Stddev ||
+		got.Min != want.Min || got.Max != want.Max {
+		t.Errorf("summarizeBench() = %+v, want %+v", got, want)
+	}
+	if runs[0] != 4*time.Second {
+		t.Errorf("summarizeBench() reordered the runs it was given")
+	}
+
+	single := summarizeBench("no-op", []time.Duration{time.Second})
+	if single.Median != time.Second || single.Stddev != 0 {
+		t.Errorf("summarizeBench() of one run = %+v, want median 1s and no stddev", single)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// binaryMirrorVariables are the variables that point the postinstall
+// downloads of binary-heavy packages at a mirror, by the name they're
+// configured under
+var binaryMirrorVariables = map[string][]string{
+	"electron":                  {"ELECTRON_MIRROR", "npm_config_electron_mirror"},
+	"electron-builder-binaries": {"ELECTRON_BUILDER_BINARIES_MIRROR"},
+	"node":                      {"NODEJS_ORG_MIRROR", "npm_config_disturl"}, // Headers node-gyp builds against
+	"node-sass":                 {"SASS_BINARY_SITE"},
+	"sharp":                     {"npm_config_sharp_binary_host"},
+	"sharp-libvips":             {"npm_config_sharp_libvips_binary_host"},
+	"puppeteer":                 {"PUPPETEER_DOWNLOAD_BASE_URL"},
+	"puppeteer-legacy":          {"PUPPETEER_DOWNLOAD_HOST"}, // Before puppeteer 20
+	"playwright":                {"PLAYWRIGHT_DOWNLOAD_HOST"},
+	"chromedriver":              {"CHROMEDRIVER_CDNURL"},
+	"cypress":                   {"CYPRESS_DOWNLOAD_MIRROR"},
+	"nwjs":                      {"NWJS_URLBASE"},
+	"prisma":                    {"PRISMA_ENGINES_MIRROR"},
+	"geckodriver":               {"GECKODRIVER_CDNURL"},
+	"operadriver":               {"OPERADRIVER_CDNURL"},
+	"phantomjs":                 {"PHANTOMJS_CDNURL"},
+}
+
+// BinaryMirrors maps the binaries a project's install scripts download to
+// mirrors, by the names in binaryMirrorVariables. Any other name is a
+// node-pre-gyp module_name or prebuild-install package name, which both read
+// npm_config_<name>_binary_host_mirror
+type BinaryMirrors map[string]string
+
+// hostMirrorVariable is the variable node-pre-gyp and prebuild-install read
+// a package's mirror from, which can't have a scope's punctuation in it
+func hostMirrorVariable(name string) string {
+	return "npm_config_" + nonIdentifier.ReplaceAllString(strings.TrimPrefix(name, "@"), "_") + "_binary_host_mirror"
+}
+
+// nonIdentifier matches what can't be in an environment variable's name
+var nonIdentifier = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// hostMirror returns the mirror node-pre-gyp or prebuild-install would use
+// for a module or package name, from the environment or the config
+func (m BinaryMirrors) hostMirror(name string) string {
+	if value := os.Getenv(hostMirrorVariable(name)); value != "" {
+		return value
+	}
+	return m[name]
+}
+
+// env returns the variables for the configured mirrors. Variables the user
+// already set are left as they are
+func (m BinaryMirrors) env() map[string]string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	env := make(map[string]string)
+	for _, name := range names {
+		variables, known := binaryMirrorVariables[name]
+		if !known {
+			variables = []string{hostMirrorVariable(name)}
+		}
+		for _, variable := range variables {
+			if _, set := os.LookupEnv(variable); !set {
+				env[variable] = m[name]
+			}
+		}
+	}
+	return env
+}
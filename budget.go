@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BudgetConfig caps what a project's dependencies may grow to. Installs
+// check it once packages are extracted and before node_modules is replaced,
+// so an add that blows the budget leaves the project as it was. Zero values
+// don't cap anything, except MaxInstallScripts which is a pointer so that 0
+// allows none
+type BudgetConfig struct {
+	MaxDependencies   int    `json:"maxDependencies,omitempty"`
+	MaxUnpackedSize   string `json:"maxUnpackedSize,omitempty"` // Like 200MB, 1.5GiB, or a byte count
+	MaxInstallScripts *int   `json:"maxInstallScripts,omitempty"`
+}
+
+// budgetUsage is what an install uses of the budget
+type budgetUsage struct {
+	Dependencies   int
+	UnpackedBytes  int64
+	InstallScripts []string // Paths of packages with preinstall, install, or postinstall scripts
+}
+
+// byteUnits are the units parseByteSize accepts, longest first so MiB
+// isn't read as B
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"kB", 1000}, {"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseByteSize parses a size like 200MB, 1.5 GiB, or 1048576
+func parseByteSize(size string) (int64, error) {
+	number, multiplier := strings.TrimSpace(size), int64(1)
+	for _, unit := range byteUnits {
+		if rest, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(rest), unit.size
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q, use a byte count or a unit like 200MB", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// measureBudget works out an install's usage from its summary and the
+// extracted packages
+func measureBudget(summary *InstallSummary, nodeModulesPath string) budgetUsage {
+	usage := budgetUsage{Dependencies: len(summary.Packages)}
+	for _, stats := range summary.Packages {
+		usage.UnpackedBytes += stats.UnpackedBytes
+		pkg, err := readScriptPackage(filepath.Join(nodeModulesPath, strings.TrimPrefix(stats.Path, "node_modules/")))
+		if err != nil {
+			continue
+		}
+		for _, event := range installScripts {
+			if _, ok := pkg.Scripts[event]; ok {
+				usage.InstallScripts = append(usage.InstallScripts, stats.Path)
+				break
+			}
+		}
+	}
+	sort.Strings(usage.InstallScripts)
+	return usage
+}
+
+// exceeded describes each way usage goes over the budget
+func (b BudgetConfig) exceeded(usage budgetUsage) ([]string, error) {
+	over := []string{}
+	if b.MaxDependencies > 0 && usage.Dependencies > b.MaxDependencies {
+		over = append(over, fmt.Sprintf("%d dependencies, the budget is %d", usage.Dependencies, b.MaxDependencies))
+	}
+	if b.MaxUnpackedSize != "" {
+		limit, err := parseByteSize(b.MaxUnpackedSize)
+		if err != nil {
+			return nil, fmt.Errorf("budget maxUnpackedSize: %v", err)
+		}
+		if usage.UnpackedBytes > limit {
+			over = append(over, fmt.Sprintf("%s unpacked, the budget is %s", formatBytes(usage.UnpackedBytes), formatBytes(limit)))
+		}
+	}
+	if b.MaxInstallScripts != nil && len(usage.InstallScripts) > *b.MaxInstallScripts {
+		over = append(over, fmt.Sprintf("%d packages with install scripts (%s), the budget is %d",
+			len(usage.InstallScripts), strings.Join(usage.InstallScripts, ", "), *b.MaxInstallScripts))
+	}
+	return over, nil
+}
+
+// enforceBudget fails an install that goes over the project's budget.
+// When confirm isn't nil it's asked whether to go ahead anyway
+func enforceBudget(budget BudgetConfig, summary *InstallSummary, nodeModulesPath string, confirm func(question string) (bool, error)) error {
+	over, err := budget.exceeded(measureBudget(summary, nodeModulesPath))
+	if err != nil || len(over) == 0 {
+		return err
+	}
+	for _, line := range over {
+		printWarning("over the dependency budget: %s", line)
+	}
+	if confirm != nil {
+		ok, err := confirm("Install anyway?")
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("install is over the dependency budget: %s", strings.Join(over, "; "))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for size, want := range map[string]int64{
+		"1048576": 1048576,
+		"200MB":   200 * 1000 * 1000,
+		"1.5 GiB": 3 << 29,
+		"512KiB":  512 << 10,
+		"10 B":    10,
+	} {
+		got, err := parseByteSize(size)
+		if err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", size, got, err, want)
+		}
+	}
+	for _, size := range []string{"", "big", "-1MB", "10 TB"} {
+		if _, err := parseByteSize(size); err == nil {
+			t.Errorf("parseByteSize(%q) succeeded", size)
+		}
+	}
+}
+
+func TestEnforceBudget(t *testing.T) {
+	modules := t.TempDir()
+	writeTestFile(t, filepath.Join(modules, "esbuild", "package.json"), `{"name": "esbuild", "scripts": {"postinstall": "node install.js"}}`)
+	writeTestFile(t, filepath.Join(modules, "ms", "package.json"), `{"name": "ms", "scripts": {"test": "mocha"}}`)
+	summary := &InstallSummary{Packages: []PackageStats{
+		{Path: "node_modules/esbuild", UnpackedBytes: 9 << 20},
+		{Path: "node_modules/ms", UnpackedBytes: 6 << 10},
+	}}
+
+	none := 0
+	budget := BudgetConfig{MaxDependencies: 1, MaxUnpackedSize: "5MiB", MaxInstallScripts: &none}
+	err := enforceBudget(budget, summary, modules, nil)
+	if err == nil {
+		t.Fatal("enforceBudget() over every budget succeeded")
+	}
+	for _, want := range []string{"2 dependencies, the budget is 1", "9.0 MiB unpacked, the budget is 5.0 MiB", "1 packages with install scripts (node_modules/esbuild), the budget is 0"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want it to mention %q", err, want)
+		}
+	}
+
+	// Going ahead when asked lets the install through
+	asked := ""
+	err = enforceBudget(budget, summary, modules, func(question string) (bool, error) {
+		asked = question
+		return true, nil
+	})
+	if err != nil || asked == "" {
+		t.Errorf("enforceBudget() with confirmation = %v, asked %q", err, asked)
+	}
+
+	one := 1
+	if err := enforceBudget(BudgetConfig{MaxDependencies: 2, MaxUnpackedSize: "10MB", MaxInstallScripts: &one}, summary, modules, nil); err != nil {
+		t.Errorf("enforceBudget() within budget = %v", err)
+	}
+}
@@ -1,4 +1,5 @@
 #!/bin/bash
 
-npm install
-go build -o ./caladan
+# Release builds set CALADAN_VERSION and CALADAN_RELEASE_KEY, the base64
+# ed25519 public key that checks the signature of checksums.txt on self-update
+go build -ldflags "-X main.version=${CALADAN_VERSION:-dev} -X main.releasePublicKey=${CALADAN_RELEASE_KEY}" -o ./caladan
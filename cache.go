@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metadataMaxAge is how long cached metadata is used without asking the
+// registry, matching the max-age the npm registry sends for packuments
+const metadataMaxAge = 5 * time.Minute
+
+// ResolutionCache persists registry metadata and resolution decisions between runs
+type ResolutionCache struct {
+	dir string
+}
+
+// cachedMetadata is a packument along with the validator needed to revalidate it
+type cachedMetadata struct {
+	ETag      string          `json:"etag"`
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Metadata  PackageMetadata `json:"metadata"`
+}
+
+// NewResolutionCache returns a cache rooted at dir, or nil if dir is empty.
+// All methods are safe to call on a nil cache
+func NewResolutionCache(dir string) *ResolutionCache {
+	if dir == "" {
+		return nil
+	}
+	return &ResolutionCache{dir: dir}
+}
+
+// cacheKey hashes its parts into a fixed-length file name
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getMetadata returns the cached packument for a package, if any
+func (c *ResolutionCache) getMetadata(registry, name string) (*cachedMetadata, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, "metadata", cacheKey(registry, name)+".json"))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cachedMetadata
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// putMetadata stores a packument for later runs
+func (c *ResolutionCache) putMetadata(registry, name string, entry cachedMetadata) error {
+	if c == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.dir, "metadata", cacheKey(registry, name)+".json"), data)
+}
+
+// evictMetadata drops the cached packument for a package
+func (c *ResolutionCache) evictMetadata(registry, name string) error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(filepath.Join(c.dir, "metadata", cacheKey(registry, name)+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// getDecision returns the version previously picked for name@versionRange
+// when the registry metadata (identified by its etag) hasn't changed since
+func (c *ResolutionCache) getDecision(registry, name, versionRange, etag string) (string, bool) {
+	if c == nil || etag == "" {
+		return "", false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, "decisions", cacheKey(registry, name, versionRange, etag)))
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// putDecision records the version picked for name@versionRange
+func (c *ResolutionCache) putDecision(registry, name, versionRange, etag, version string) error {
+	if c == nil || etag == "" {
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(c.dir, "decisions", cacheKey(registry, name, versionRange, etag)), []byte(version))
+}
+
+// cachedSuggestions are registry search results for some text
+type cachedSuggestions struct {
+	FetchedAt   time.Time           `json:"fetchedAt"`
+	Suggestions []PackageSuggestion `json:"suggestions"`
+}
+
+// getSuggestions returns cached search results for text, if any
+func (c *ResolutionCache) getSuggestions(registry, text string) (*cachedSuggestions, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, "search", cacheKey(registry, text)+".json"))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cachedSuggestions
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// putSuggestions stores search results for later completions
+func (c *ResolutionCache) putSuggestions(registry, text string, entry cachedSuggestions) error {
+	if c == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.dir, "search", cacheKey(registry, text)+".json"), data)
+}
+
+// writeFileAtomic writes to a temporary file and renames it into place so
+// concurrent readers never observe a partial write
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
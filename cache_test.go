@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolutionCache(t *testing.T) {
+	cache := NewResolutionCache(t.TempDir())
+
+	if _, ok := cache.getMetadata(npmRegistryURL, "is-odd"); ok {
+		t.Fatalf("getMetadata() found an entry in an empty cache")
+	}
+
+	entry := cachedMetadata{
+		ETag:      `"abc"`,
+		FetchedAt: time.Now(),
+		Metadata: PackageMetadata{
+			Name:     "is-odd",
+			DistTags: map[string]string{"latest": "3.0.1"},
+		},
+	}
+	if err := cache.putMetadata(npmRegistryURL, "is-odd", entry); err != nil {
+		t.Fatalf("putMetadata() error = %v", err)
+	}
+	got, ok := cache.getMetadata(npmRegistryURL, "is-odd")
+	if !ok || got.ETag != entry.ETag || got.Metadata.DistTags["latest"] != "3.0.1" {
+		t.Errorf("getMetadata() = %+v, %v, want %+v", got, ok, entry)
+	}
+
+	if err := cache.putDecision(npmRegistryURL, "is-odd", "^3.0.0", `"abc"`, "3.0.1"); err != nil {
+		t.Fatalf("putDecision() error = %v", err)
+	}
+	if version, ok := cache.getDecision(npmRegistryURL, "is-odd", "^3.0.0", `"abc"`); !ok || version != "3.0.1" {
+		t.Errorf("getDecision() = %v, %v, want 3.0.1, true", version, ok)
+	}
+
+	// A new etag means the registry metadata changed
+	if _, ok := cache.getDecision(npmRegistryURL, "is-odd", "^3.0.0", `"def"`); ok {
+		t.Errorf("getDecision() reused a decision made against different metadata")
+	}
+}
+
+func TestNilResolutionCache(t *testing.T) {
+	var cache *ResolutionCache
+
+	if _, ok := cache.getMetadata(npmRegistryURL, "is-odd"); ok {
+		t.Errorf("getMetadata() on nil cache found an entry")
+	}
+	if err := cache.putDecision(npmRegistryURL, "is-odd", "^3.0.0", `"abc"`, "3.0.1"); err != nil {
+		t.Errorf("putDecision() on nil cache error = %v", err)
+	}
+}
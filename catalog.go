@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultCatalog is the catalog that catalog: and catalog:default refer to
+const defaultCatalog = "default"
+
+// catalogs are the root manifest's version catalogs, by name, each mapping
+// package names to ranges. Workspaces depend on "catalog:" (the default
+// catalog) or "catalog:<name>" instead of a range, so the range is pinned
+// in one place
+type catalogs map[string]map[string]string
+
+// parseCatalogs reads the catalogs of a root package.json. The default
+// catalog is the catalog field and named ones are under catalogs, either at
+// the top level or, as bun writes them, inside an object workspaces field
+func parseCatalogs(data []byte) (catalogs, error) {
+	type catalogFields struct {
+		Catalog  map[string]string            `json:"catalog"`
+		Catalogs map[string]map[string]string `json:"catalogs"`
+	}
+	var manifest struct {
+		catalogFields
+		Workspaces json.RawMessage `json:"workspaces"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing catalogs: %v", err)
+	}
+	var nested catalogFields
+	// A list of globs has no catalogs
+	json.Unmarshal(manifest.Workspaces, &nested)
+
+	result := make(catalogs)
+	add := func(name string, entries map[string]string) error {
+		if result[name] == nil {
+			result[name] = make(map[string]string)
+		}
+		for pkg, versionRange := range entries {
+			if strings.HasPrefix(versionRange, "catalog:") || strings.HasPrefix(versionRange, "workspace:") {
+				return fmt.Errorf("catalog %s pins %s to %s, catalogs need a range", name, pkg, versionRange)
+			}
+			if existing, ok := result[name][pkg]; ok && existing != versionRange {
+				return fmt.Errorf("catalog %s pins %s to both %s and %s", name, pkg, existing, versionRange)
+			}
+			result[name][pkg] = versionRange
+		}
+		return nil
+	}
+	for _, fields := range []catalogFields{manifest.catalogFields, nested} {
+		if err := add(defaultCatalog, fields.Catalog); err != nil {
+			return nil, err
+		}
+		for name, entries := range fields.Catalogs {
+			if err := add(name, entries); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// catalogRange returns the range a catalog: specifier pins a package to.
+// Other specifiers are returned as they are
+func (c catalogs) catalogRange(name, spec string) (string, error) {
+	catalogName, ok := strings.CutPrefix(spec, "catalog:")
+	if !ok {
+		return spec, nil
+	}
+	if catalogName == "" {
+		catalogName = defaultCatalog
+	}
+	entries, ok := c[catalogName]
+	if !ok || len(entries) == 0 {
+		return "", fmt.Errorf("%s depends on catalog %s, which the root package.json doesn't define", name, catalogName)
+	}
+	versionRange, ok := entries[name]
+	if !ok {
+		return "", fmt.Errorf("%s depends on catalog %s, which doesn't pin it", name, catalogName)
+	}
+	return versionRange, nil
+}
+
+// resolveCatalogDeps replaces the catalog: specifiers of a set of
+// dependencies with the ranges they're pinned to, in place
+func (c catalogs) resolveCatalogDeps(deps map[string]string) error {
+	for name, spec := range deps {
+		versionRange, err := c.catalogRange(name, spec)
+		if err != nil {
+			return err
+		}
+		deps[name] = versionRange
+	}
+	return nil
+}
+
+// resolveManifestCatalogs replaces the catalog: specifiers in a manifest's
+// dependencies, dev, optional, and peer dependencies with their ranges
+func (c catalogs) resolveManifestCatalogs(manifest *PackageInfo) error {
+	for _, deps := range []map[string]string{manifest.Dependencies, manifest.DevDependencies, manifest.OptionalDependencies, manifest.PeerDependencies} {
+		if err := c.resolveCatalogDeps(deps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCatalogs(t *testing.T) {
+	root := []byte(`{
+  "catalog": {"react": "^18.2.0"},
+  "catalogs": {"legacy": {"react": "^17.0.2"}},
+  "workspaces": {"packages": ["packages/*"], "catalogs": {"testing": {"vitest": "~1.6.0"}}}
+}`)
+	projectCatalogs, err := parseCatalogs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := PackageInfo{
+		Dependencies:     map[string]string{"react": "catalog:", "lodash": "^4.17.21"},
+		DevDependencies:  map[string]string{"vitest": "catalog:testing"},
+		PeerDependencies: map[string]string{"react": "catalog:legacy"},
+	}
+	if err := projectCatalogs.resolveManifestCatalogs(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"react": "^18.2.0", "lodash": "^4.17.21"}; !reflect.DeepEqual(manifest.Dependencies, want) {
+		t.Errorf("dependencies = %v, want %v", manifest.Dependencies, want)
+	}
+	if manifest.DevDependencies["vitest"] != "~1.6.0" || manifest.PeerDependencies["react"] != "^17.0.2" {
+		t.Errorf("manifest = %+v, want named catalogs resolved", manifest)
+	}
+
+	if _, err := projectCatalogs.catalogRange("react", "catalog:default"); err != nil {
+		t.Errorf("catalog:default error = %v, want the default catalog", err)
+	}
+	if _, err := projectCatalogs.catalogRange("vue", "catalog:"); err == nil || !strings.Contains(err.Error(), "doesn't pin it") {
+		t.Errorf("unpinned error = %v", err)
+	}
+	if _, err := projectCatalogs.catalogRange("react", "catalog:missing"); err == nil || !strings.Contains(err.Error(), "doesn't define") {
+		t.Errorf("missing catalog error = %v", err)
+	}
+
+	if _, err := parseCatalogs([]byte(`{"catalog": {"a": "1.0.0"}, "workspaces": {"catalog": {"a": "2.0.0"}}}`)); err == nil {
+		t.Error("parseCatalogs() with conflicting pins succeeded")
+	}
+	if _, err := parseCatalogs([]byte(`{"catalog": {"a": "catalog:other"}}`)); err == nil {
+		t.Error("parseCatalogs() with a catalog: pin succeeded")
+	}
+}
+
+func TestPublishManifestCatalogs(t *testing.T) {
+	data := []byte(`{"name": "app", "dependencies": {"react": "catalog:", "lib": "workspace:^"}}`)
+	var manifest PackageInfo
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	ws := workspace{Name: "app", manifest: manifest}
+	published, err := publishManifest(data, ws, map[string]string{"lib": "1.2.0"}, catalogs{defaultCatalog: {"react": "^18.2.0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name": "app", "dependencies": {"react": "^18.2.0", "lib": "^1.2.0"}}`; string(published) != want {
+		t.Errorf("publishManifest() = %s, want %s", published, want)
+	}
+	if _, err := publishManifest(data, ws, map[string]string{"lib": "1.2.0"}, catalogs{}); err == nil {
+		t.Error("publishManifest() without the catalog succeeded")
+	}
+}
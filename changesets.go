@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// changesetDir holds the changesets of a monorepo, in the root
+const changesetDir = ".changeset"
+
+// publishSetFile lists what version-workspaces bumped, for the publish step
+const publishSetFile = "publish.json"
+
+// Bump types, smallest first
+var bumpTypes = []string{"patch", "minor", "major"}
+
+func bumpRank(bump string) int {
+	for i, b := range bumpTypes {
+		if b == bump {
+			return i
+		}
+	}
+	return -1
+}
+
+// Changeset is an intent to release workspaces: the bump each needs and a
+// summary for their changelogs. It's stored as markdown with the bumps in
+// front matter, the same format as the changesets tool
+type Changeset struct {
+	ID       string
+	Releases map[string]string // Bump type by workspace name
+	Summary  string
+}
+
+// parseChangeset parses a changeset file:
+//
+//	---
+//	"@scope/a": minor
+//	"b": patch
+//	---
+//
+//	Summary
+func parseChangeset(id, content string) (Changeset, error) {
+	changeset := Changeset{ID: id, Releases: make(map[string]string)}
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	rest, ok := strings.CutPrefix(strings.TrimLeft(content, "\n"), "---\n")
+	if !ok {
+		return changeset, fmt.Errorf("changeset %s has no front matter", id)
+	}
+	frontMatter, summary, ok := strings.Cut(rest, "---\n")
+	if !ok {
+		frontMatter, ok = strings.CutSuffix(rest, "---")
+		if !ok {
+			return changeset, fmt.Errorf("changeset %s has unterminated front matter", id)
+		}
+	}
+	for _, line := range strings.Split(frontMatter, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			return changeset, fmt.Errorf("changeset %s: invalid line %q", id, line)
+		}
+		name := strings.Trim(strings.TrimSpace(line[:i]), `"'`)
+		bump := strings.TrimSpace(line[i+1:])
+		if bumpRank(bump) < 0 {
+			return changeset, fmt.Errorf("changeset %s: %s must be a patch, minor, or major bump, got %q", id, name, bump)
+		}
+		changeset.Releases[name] = bump
+	}
+	changeset.Summary = strings.TrimSpace(summary)
+	return changeset, nil
+}
+
+// renderChangeset formats a changeset for its file
+func renderChangeset(changeset Changeset) string {
+	names := make([]string, 0, len(changeset.Releases))
+	for name := range changeset.Releases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	builder.WriteString("---\n")
+	for _, name := range names {
+		builder.WriteString(fmt.Sprintf("%q: %s\n", name, changeset.Releases[name]))
+	}
+	builder.WriteString("---\n\n" + changeset.Summary + "\n")
+	return builder.String()
+}
+
+// AddChangeset writes a changeset for the given releases, given as
+// name:bump, and returns its path
+func AddChangeset(directory string, releases []string, summary string) (string, error) {
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return "", err
+	}
+	known := make(map[string]bool)
+	for _, ws := range workspaces {
+		known[ws.Name] = true
+	}
+
+	changeset := Changeset{Releases: make(map[string]string), Summary: summary}
+	for _, release := range releases {
+		i := strings.LastIndex(release, ":")
+		if i < 0 {
+			return "", fmt.Errorf("release %q must be <workspace>:<patch|minor|major>", release)
+		}
+		name, bump := release[:i], release[i+1:]
+		if !known[name] {
+			return "", fmt.Errorf("%s isn't a workspace", name)
+		}
+		if bumpRank(bump) < 0 {
+			return "", fmt.Errorf("%s must be a patch, minor, or major bump, got %q", name, bump)
+		}
+		changeset.Releases[name] = bump
+	}
+
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	changeset.ID = time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+	path := filepath.Join(directory, changesetDir, changeset.ID+".md")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, []byte(renderChangeset(changeset)), 0644)
+}
+
+// readChangesets reads every changeset of a project, sorted by ID so the
+// oldest come first
+func readChangesets(directory string) ([]Changeset, error) {
+	entries, err := os.ReadDir(filepath.Join(directory, changesetDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	changesets := []Changeset{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".md") || strings.EqualFold(name, "README.md") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(directory, changesetDir, name))
+		if err != nil {
+			return nil, err
+		}
+		changeset, err := parseChangeset(strings.TrimSuffix(name, ".md"), string(data))
+		if err != nil {
+			return nil, err
+		}
+		changesets = append(changesets, changeset)
+	}
+	sort.Slice(changesets, func(i, j int) bool {
+		return changesets[i].ID < changesets[j].ID
+	})
+	return changesets, nil
+}
+
+// WorkspaceRelease is a planned version bump of a workspace
+type WorkspaceRelease struct {
+	Name       string `json:"name"`
+	Dir        string `json:"dir"`
+	OldVersion string `json:"oldVersion"`
+	NewVersion string `json:"version"`
+	Bump       string `json:"bump"`
+	Private    bool   `json:"private,omitempty"`
+
+	summaries     map[string][]string // Changeset summaries by bump type
+	updatedDeps   []string            // name@version of internal dependencies bumped with it
+	changedRanges map[string]string   // New ranges of internal dependencies, by section/name
+}
+
+// bumpVersion applies a bump to a major.minor.patch version, dropping any
+// prerelease
+func bumpVersion(version, bump string) (string, error) {
+	parsed, ok := parseSemver(version)
+	if !ok {
+		return "", fmt.Errorf("%q isn't a semver version", version)
+	}
+	major, minor, patch := parsed.core[0], parsed.core[1], parsed.core[2]
+	switch bump {
+	case "major":
+		major, minor, patch = major+1, 0, 0
+	case "minor":
+		minor, patch = minor+1, 0
+	default:
+		// 1.0.0-rc.1 becomes 1.0.0 rather than 1.0.1
+		if len(parsed.prerelease) == 0 {
+			patch++
+		}
+	}
+	return fmt.Sprintf("%d.%d.%d", major, minor, patch), nil
+}
+
+// internalRange rewrites a dependent's range on an internal package for its
+// new version, keeping the range's operator. workspace: ranges always
+// resolve locally and catalog: ranges are pinned in the root, so they're
+// left as they are
+func internalRange(current, version string) string {
+	if strings.HasPrefix(current, "workspace:") || strings.HasPrefix(current, "catalog:") || current == "*" {
+		return current
+	}
+	// Anything more complicated than an operator and a version is left alone
+	for _, prefix := range []string{">=", "^", "~", ""} {
+		if rest, ok := strings.CutPrefix(current, prefix); ok {
+			if _, ok := parseSemver(rest); ok {
+				return prefix + version
+			}
+		}
+	}
+	return current
+}
+
+// planReleases works out every workspace's bump from the changesets. A
+// workspace whose dependency, optional dependency, or peer dependency on
+// another workspace is bumped gets at least a patch bump itself so it's
+// published with the new range, and so on for its own dependents.
+// devDependency ranges are updated without a release
+func planReleases(workspaces []workspace, changesets []Changeset) ([]WorkspaceRelease, error) {
+	byName := make(map[string]workspace)
+	for _, ws := range workspaces {
+		byName[ws.Name] = ws
+	}
+
+	releases := make(map[string]*WorkspaceRelease)
+	release := func(name, bump string) bool {
+		r, ok := releases[name]
+		if !ok {
+			ws := byName[name]
+			r = &WorkspaceRelease{Name: name, Dir: ws.Dir, OldVersion: ws.Version, Private: ws.Private, summaries: make(map[string][]string), changedRanges: make(map[string]string)}
+			releases[name] = r
+		}
+		if bumpRank(bump) <= bumpRank(r.Bump) {
+			return false
+		}
+		r.Bump = bump
+		return true
+	}
+
+	for _, changeset := range changesets {
+		for name, bump := range changeset.Releases {
+			if _, ok := byName[name]; !ok {
+				return nil, fmt.Errorf("changeset %s releases %s, which isn't a workspace", changeset.ID, name)
+			}
+			release(name, bump)
+			if changeset.Summary != "" {
+				releases[name].summaries[bump] = append(releases[name].summaries[bump], changeset.Summary)
+			}
+		}
+	}
+
+	// Cascade to dependents until nothing else changes
+	for changed := true; changed; {
+		changed = false
+		for _, ws := range workspaces {
+			for _, section := range dependencySections {
+				for dep := range ws.sectionDeps(section) {
+					if _, ok := releases[dep]; !ok || section == "devDependencies" {
+						continue
+					}
+					if release(ws.Name, "patch") {
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	planned := []WorkspaceRelease{}
+	for _, ws := range workspaces {
+		r, ok := releases[ws.Name]
+		if !ok {
+			continue
+		}
+		version, err := bumpVersion(ws.Version, r.Bump)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ws.Name, err)
+		}
+		r.NewVersion = version
+	}
+	for _, ws := range workspaces {
+		for _, section := range dependencySections {
+			for dep, current := range ws.sectionDeps(section) {
+				depRelease, ok := releases[dep]
+				if !ok {
+					continue
+				}
+				updated := internalRange(current, depRelease.NewVersion)
+				if updated == current && section == "devDependencies" {
+					continue
+				}
+				if _, ok := releases[ws.Name]; !ok {
+					// Only devDependencies are left, updated in place
+					releases[ws.Name] = &WorkspaceRelease{Name: ws.Name, Dir: ws.Dir, OldVersion: ws.Version, NewVersion: ws.Version, changedRanges: make(map[string]string)}
+				}
+				r := releases[ws.Name]
+				r.changedRanges[section+"/"+dep] = updated
+				if section != "devDependencies" {
+					r.updatedDeps = append(r.updatedDeps, dep+"@"+depRelease.NewVersion)
+				}
+			}
+		}
+		if r, ok := releases[ws.Name]; ok {
+			sort.Strings(r.updatedDeps)
+			planned = append(planned, *r)
+		}
+	}
+	return planned, nil
+}
+
+// VersionWorkspacesOptions configures caladan version-workspaces
+type VersionWorkspacesOptions struct {
+	DryRun bool // Only print the plan
+}
+
+// VersionWorkspaces consumes a project's changesets: it bumps workspace
+// versions and internal ranges, prepends changelog entries, deletes the
+// changesets, and writes the publish set to .changeset/publish.json
+func VersionWorkspaces(directory string, opts VersionWorkspacesOptions) error {
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return err
+	}
+	changesets, err := readChangesets(directory)
+	if err != nil {
+		return err
+	}
+	if len(changesets) == 0 {
+		fmt.Println("No changesets to release")
+		return nil
+	}
+	planned, err := planReleases(workspaces, changesets)
+	if err != nil {
+		return err
+	}
+
+	publish := []WorkspaceRelease{}
+	for _, r := range planned {
+		if r.Bump == "" {
+			fmt.Printf("%s: devDependency ranges updated\n", colorPackage(r.Name))
+			continue
+		}
+		fmt.Printf("%s: %s -> %s (%s)\n", colorPackage(r.Name), r.OldVersion, colorSuccess(r.NewVersion), r.Bump)
+		if !r.Private {
+			publish = append(publish, r)
+		}
+	}
+	if opts.DryRun {
+		return nil
+	}
+
+	date := time.Now().Format("2006-01-02")
+	for _, r := range planned {
+		manifestPath := filepath.Join(directory, r.Dir, "package.json")
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			return err
+		}
+		if r.Bump != "" {
+			if data, _, err = editJSONString(data, []string{"version"}, r.NewVersion); err != nil {
+				return fmt.Errorf("error updating %s: %v", manifestPath, err)
+			}
+		}
+		for key, updated := range r.changedRanges {
+			section, dep, _ := strings.Cut(key, "/")
+			if data, _, err = editJSONString(data, []string{section, dep}, updated); err != nil {
+				return fmt.Errorf("error updating %s: %v", manifestPath, err)
+			}
+		}
+		if err := writeFileAtomic(manifestPath, data); err != nil {
+			return err
+		}
+		if r.Bump != "" {
+			if err := prependChangelog(filepath.Join(directory, r.Dir, "CHANGELOG.md"), r, date); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, changeset := range changesets {
+		if err := os.Remove(filepath.Join(directory, changesetDir, changeset.ID+".md")); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(publish, "", "  ")
+	if err != nil {
+		return err
+	}
+	publishPath := filepath.Join(directory, changesetDir, publishSetFile)
+	if err := writeFileAtomic(publishPath, append(data, '\n')); err != nil {
+		return err
+	}
+	fmt.Printf("%d workspaces to publish, listed in %s\n", len(publish), publishPath)
+	return nil
+}
+
+// renderChangelogEntry formats a release's changelog section
+func renderChangelogEntry(r WorkspaceRelease, date string) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("## %s (%s)\n", r.NewVersion, date))
+	for i := len(bumpTypes) - 1; i >= 0; i-- {
+		bump := bumpTypes[i]
+		lines := []string{}
+		for _, summary := range r.summaries[bump] {
+			lines = append(lines, "- "+strings.ReplaceAll(summary, "\n", "\n  "))
+		}
+		if bump == "patch" && len(r.updatedDeps) > 0 {
+			lines = append(lines, "- Updated dependencies: "+strings.Join(r.updatedDeps, ", "))
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		title := strings.ToUpper(bump[:1]) + bump[1:]
+		builder.WriteString(fmt.Sprintf("\n### %s Changes\n\n%s\n", title, strings.Join(lines, "\n")))
+	}
+	return builder.String()
+}
+
+// prependChangelog adds a release's entry to the top of a changelog, below
+// its title, creating it when there isn't one
+func prependChangelog(path string, r WorkspaceRelease, date string) error {
+	entry := renderChangelogEntry(r, date)
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	title := "# " + r.Name + "\n"
+	body := string(existing)
+	if rest, ok := strings.CutPrefix(body, title); ok {
+		body = rest
+	}
+	content := title + "\n" + entry
+	if body = strings.TrimLeft(body, "\n"); body != "" {
+		content += "\n" + body
+	}
+	return writeFileAtomic(path, []byte(content))
+}
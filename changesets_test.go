@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditJSONString(t *testing.T) {
+	data := []byte(`{
+  "name": "a",
+  "version": "1.0.0",
+  "scripts": {"version": "echo \"version\""},
+  "dependencies": {
+    "b": "^1.0.0"
+  }
+}
+`)
+	edited, ok, err := editJSONString(data, []string{"dependencies", "b"}, "^1.1.0")
+	if err != nil || !ok {
+		t.Fatalf("editJSONString() = %v, %v", ok, err)
+	}
+	edited, ok, err = editJSONString(edited, []string{"version"}, "1.0.1")
+	if err != nil || !ok {
+		t.Fatalf("editJSONString() = %v, %v", ok, err)
+	}
+	want := strings.Replace(strings.Replace(string(data), `"^1.0.0"`, `"^1.1.0"`, 1), `"version": "1.0.0"`, `"version": "1.0.1"`, 1)
+	if string(edited) != want {
+		t.Errorf("editJSONString() =\n%s\nwant\n%s", edited, want)
+	}
+
+	if _, ok, _ := editJSONString(data, []string{"dependencies", "missing"}, "1.0.0"); ok {
+		t.Errorf("editJSONString() found a missing key")
+	}
+}
+
+func TestVersionWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "monorepo", "private": true, "workspaces": ["packages/*"]}`)
+	writeTestFile(t, filepath.Join(dir, "packages/a/package.json"), `{"name": "@corp/a", "version": "1.0.0"}`)
+	writeTestFile(t, filepath.Join(dir, "packages/b/package.json"), `{"name": "b", "version": "1.2.0", "dependencies": {"@corp/a": "^1.0.0"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages/c/package.json"), `{"name": "c", "version": "0.1.0", "private": true, "devDependencies": {"b": "^1.2.0"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages/d/package.json"), `{"name": "d", "version": "2.0.0", "peerDependencies": {"b": "workspace:*"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages/README.md"), "not a workspace")
+	writeTestFile(t, filepath.Join(dir, "packages/b/CHANGELOG.md"), "# b\n\n## 1.2.0 (2026-01-01)\n\n### Minor Changes\n\n- Add things\n")
+
+	if _, err := AddChangeset(dir, []string{"@corp/a:minor"}, "Add a flag"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddChangeset(dir, []string{"@corp/a:patch", "b:patch"}, "Fix a crash"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddChangeset(dir, []string{"e:patch"}, ""); err == nil {
+		t.Errorf("AddChangeset() accepted an unknown workspace")
+	}
+
+	if err := VersionWorkspaces(dir, VersionWorkspacesOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(path string) string {
+		data, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for path, want := range map[string]string{
+		"packages/a/package.json": `{"name": "@corp/a", "version": "1.1.0"}`,
+		"packages/b/package.json": `{"name": "b", "version": "1.2.1", "dependencies": {"@corp/a": "^1.1.0"}}`,
+		"packages/c/package.json": `{"name": "c", "version": "0.1.0", "private": true, "devDependencies": {"b": "^1.2.1"}}`,
+		"packages/d/package.json": `{"name": "d", "version": "2.0.1", "peerDependencies": {"b": "workspace:*"}}`,
+	} {
+		if got := read(path); got != want {
+			t.Errorf("%s = %s, want %s", path, got, want)
+		}
+	}
+
+	changelog := read("packages/b/CHANGELOG.md")
+	if !strings.HasPrefix(changelog, "# b\n\n## 1.2.1 (") || !strings.Contains(changelog, "### Patch Changes\n\n- Fix a crash\n- Updated dependencies: @corp/a@1.1.0\n\n## 1.2.0") {
+		t.Errorf("b's changelog = %q", changelog)
+	}
+	if changelog := read("packages/a/CHANGELOG.md"); !strings.Contains(changelog, "### Minor Changes\n\n- Add a flag\n\n### Patch Changes\n\n- Fix a crash\n") {
+		t.Errorf("a's changelog = %q", changelog)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "packages/c/CHANGELOG.md")); err == nil {
+		t.Errorf("c wasn't released but got a changelog")
+	}
+
+	var publish []WorkspaceRelease
+	if err := json.Unmarshal([]byte(read(".changeset/publish.json")), &publish); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, r := range publish {
+		names = append(names, r.Name+"@"+r.NewVersion)
+	}
+	if got := strings.Join(names, " "); got != "@corp/a@1.1.0 b@1.2.1 d@2.0.1" {
+		t.Errorf("publish set = %s", got)
+	}
+	if changesets, err := readChangesets(dir); err != nil || len(changesets) != 0 {
+		t.Errorf("changesets left = %v, %v", changesets, err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes target a copy-on-write clone of src with clonefile(2),
+// which APFS supports. The clone keeps src's mode
+func cloneFile(src, target string, mode os.FileMode) error {
+	if err := unix.Clonefile(src, target, unix.CLONE_NOFOLLOW); err != nil {
+		return &os.LinkError{Op: "clone", Old: src, New: target, Err: err}
+	}
+	return nil
+}
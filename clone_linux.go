@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes target a copy-on-write clone of src with the FICLONE
+// ioctl, which btrfs and XFS (with reflink) support
+func cloneFile(src, target string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		out.Close()
+		os.Remove(target)
+		return &os.LinkError{Op: "clone", Old: src, New: target, Err: err}
+	}
+	return out.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile isn't supported here, so cloning always falls back
+func cloneFile(src, target string, mode os.FileMode) error {
+	return &os.LinkError{Op: "clone", Old: src, New: target, Err: errors.ErrUnsupported}
+}
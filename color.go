@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ANSI styles for terminal output
+const (
+	styleReset  = "\033[0m"
+	styleBold   = "\033[1m"
+	styleDim    = "\033[2m"
+	styleRed    = "\033[31m"
+	styleGreen  = "\033[32m"
+	styleYellow = "\033[33m"
+	styleCyan   = "\033[36m"
+)
+
+// noColor is set by --no-color
+var noColor bool
+
+var (
+	colorOnce    sync.Once
+	colorEnabled bool
+)
+
+// colorFlag registers --no-color
+func colorFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&noColor, "no-color", false, "don't color output (also NO_COLOR=1)")
+}
+
+// useColor reports whether output is colored. --no-color and NO_COLOR turn
+// colors off, FORCE_COLOR turns them on, and otherwise they're used when
+// stdout is a terminal. It's decided on first use, after flags are parsed
+// and stdout has been moved to stderr for --json
+func useColor() bool {
+	colorOnce.Do(func() {
+		colorEnabled = detectColor(os.Stdout)
+	})
+	return colorEnabled
+}
+
+func detectColor(out *os.File) bool {
+	if noColor {
+		return false
+	}
+	// https://no-color.org: any non-empty value disables color
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if force, ok := os.LookupEnv("FORCE_COLOR"); ok {
+		return force != "0" && force != "false"
+	}
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := out.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// paint wraps text in a style when output is colored
+func paint(style, text string) string {
+	if !useColor() || text == "" {
+		return text
+	}
+	return style + text + styleReset
+}
+
+func colorSuccess(text string) string { return paint(styleGreen, text) }
+func colorWarn(text string) string    { return paint(styleYellow, text) }
+func colorError(text string) string   { return paint(styleRed, text) }
+func colorPackage(text string) string { return paint(styleCyan, text) }
+func colorDim(text string) string     { return paint(styleDim, text) }
+func colorBold(text string) string    { return paint(styleBold, text) }
+
+// printWarning prints a line prefixed with a highlighted "Warning:"
+func printWarning(format string, args ...interface{}) {
+	fmt.Println(paint(styleBold+styleYellow, "Warning:") + " " + fmt.Sprintf(format, args...))
+}
+
+// printError prints a line prefixed with a highlighted "Error"
+func printError(format string, args ...interface{}) {
+	fmt.Println(paint(styleBold+styleRed, "Error") + " " + fmt.Sprintf(format, args...))
+}
+
+// stripGlobalColorFlag removes a --no-color given before the command, so it
+// works for commands that pass their arguments through, like run
+func stripGlobalColorFlag(args []string) []string {
+	for len(args) > 1 && (args[1] == "--no-color" || args[1] == "-no-color") {
+		noColor = true
+		args = append(args[:1:1], args[2:]...)
+	}
+	return args
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setColor turns colored output on or off for the rest of a test
+func setColor(t *testing.T, enabled bool) {
+	t.Helper()
+	colorOnce.Do(func() {})
+	previous := colorEnabled
+	colorEnabled = enabled
+	t.Cleanup(func() { colorEnabled = previous })
+}
+
+func TestDetectColor(t *testing.T) {
+	// A regular file stands in for piped output
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	tests := []struct {
+		name    string
+		noColor bool
+		env     map[string]string
+		want    bool
+	}{
+		{name: "not a terminal", want: false},
+		{name: "FORCE_COLOR", env: map[string]string{"FORCE_COLOR": "1"}, want: true},
+		{name: "FORCE_COLOR=0", env: map[string]string{"FORCE_COLOR": "0"}, want: false},
+		{name: "NO_COLOR wins over FORCE_COLOR", env: map[string]string{"FORCE_COLOR": "1", "NO_COLOR": "1"}, want: false},
+		{name: "--no-color wins over FORCE_COLOR", noColor: true, env: map[string]string{"FORCE_COLOR": "1"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NO_COLOR", "")
+			// Set first so it's restored after the test
+			t.Setenv("FORCE_COLOR", "")
+			os.Unsetenv("FORCE_COLOR")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			noColor = tt.noColor
+			defer func() { noColor = false }()
+
+			if got := detectColor(out); got != tt.want {
+				t.Errorf("detectColor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripGlobalColorFlag(t *testing.T) {
+	defer func() { noColor = false }()
+	args := stripGlobalColorFlag([]string{"caladan", "--no-color", "run", "dir", "test", "--no-color"})
+	if strings.Join(args, " ") != "caladan run dir test --no-color" || !noColor {
+		t.Errorf("stripGlobalColorFlag() = %v, noColor = %v", args, noColor)
+	}
+}
+
+func TestRenderDepTreeHighlightsConflicts(t *testing.T) {
+	setColor(t, true)
+	deps := []PackageInfo{
+		{Name: "a", Version: "1.0.0", ResolvedDeps: map[string]PackageInfo{
+			"lodash": {Name: "lodash", Version: "3.0.0"},
+		}},
+		{Name: "lodash", Version: "4.0.0"},
+	}
+
+	tree := RenderDepTree(deps)
+	for _, want := range []string{
+		colorPackage("lodash") + "@" + colorWarn("3.0.0"),
+		colorPackage("lodash") + "@" + colorWarn("4.0.0"),
+		colorPackage("a") + "@" + colorDim("1.0.0"),
+	} {
+		if !strings.Contains(tree, want) {
+			t.Errorf("RenderDepTree() = %q, missing %q", tree, want)
+		}
+	}
+
+	setColor(t, false)
+	if tree := RenderDepTree(deps); strings.Contains(tree, "\033[") {
+		t.Errorf("RenderDepTree() colored output with color off: %q", tree)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Ways node_modules can differ from what npm ci would install
+const (
+	compatMissing       = "missing"        // npm would install a package that isn't there
+	compatVersion       = "version"        // The package is there at another version
+	compatExtraneous    = "extraneous"     // A package is there that npm wouldn't install
+	compatBinMissing    = "bin-missing"    // npm would link a bin that isn't there
+	compatBinTarget     = "bin-target"     // The bin links to another script
+	compatBinExtraneous = "bin-extraneous" // A bin is linked that npm wouldn't link
+)
+
+// CompatIssue is one place node_modules differs from npm ci's layout.
+// Paths are lockfile paths, relative to the project
+type CompatIssue struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// CheckOptions configures caladan check, which runs the checks asked for
+type CheckOptions struct {
+	NPMCompat bool // Compare node_modules with what npm ci would install
+	Manifest  bool // Validate the fields of package.json
+	JSON      bool
+
+	// Where the JSON report goes, stdout is moved to stderr so it stays
+	// parseable
+	jsonOutput io.Writer
+}
+
+// npmLayout is where npm ci would put each package and bin link of a
+// lockfile. bins maps a link, like node_modules/.bin/tsc, to the script it
+// points at
+type npmLayout struct {
+	packages map[string]string // Path to version, empty for workspace links
+	bins     map[string]string
+}
+
+// expectedNPMLayout works out what npm ci installs on a platform from a
+// lockfile: every entry under node_modules except optional packages for
+// other platforms and whatever is nested inside them. Each package's bins
+// are linked into the .bin of the node_modules folder it's in
+func expectedNPMLayout(packageLock *PackageLock, platform Platform) (npmLayout, error) {
+	layout := npmLayout{packages: make(map[string]string), bins: make(map[string]string)}
+	paths := make([]string, 0, len(packageLock.Packages))
+	for p := range packageLock.Packages {
+		if strings.HasPrefix(p, "node_modules/") || strings.Contains(p, "/node_modules/") {
+			paths = append(paths, p)
+		}
+	}
+	// Sorted so parents come before what's nested in them, and so the first
+	// package to claim a bin name keeps it
+	sort.Strings(paths)
+
+	skipped := []string{}
+	for _, p := range paths {
+		var entry PackageInfo
+		var link struct {
+			Link bool `json:"link"`
+		}
+		if err := json.Unmarshal(packageLock.Packages[p], &entry); err != nil {
+			return layout, fmt.Errorf("error parsing lockfile entry %s: %v", p, err)
+		}
+		json.Unmarshal(packageLock.Packages[p], &link)
+
+		if nestedIn(p, skipped) {
+			continue
+		}
+		if ok, _ := platform.isCompatible(entry); !ok && entry.Optional {
+			skipped = append(skipped, p)
+			continue
+		}
+		if link.Link {
+			layout.packages[p] = ""
+			continue
+		}
+		layout.packages[p] = entry.Version
+
+		binDir := p[:strings.LastIndex(p, "node_modules/")] + "node_modules/.bin"
+		name := entry.Name
+		if name == "" {
+			name = packageNameFromPath(p)
+		}
+		for cmd, script := range npmBins(entry.Bin, name) {
+			linkPath := binDir + "/" + cmd
+			if _, ok := layout.bins[linkPath]; !ok {
+				layout.bins[linkPath] = path.Join(p, script)
+			}
+		}
+	}
+	return layout, nil
+}
+
+// nestedIn reports whether a lockfile path is inside one of the packages
+func nestedIn(p string, packages []string) bool {
+	for _, parent := range packages {
+		if strings.HasPrefix(p, parent+"/node_modules/") {
+			return true
+		}
+	}
+	return false
+}
+
+// npmBins normalizes a bin field like npm does: a string is linked under
+// the package's unscoped name, and names can't contain a path
+func npmBins(bin interface{}, name string) map[string]string {
+	bins := make(map[string]string)
+	switch v := bin.(type) {
+	case string:
+		bins[path.Base(name)] = path.Clean(v)
+	case map[string]interface{}:
+		for cmd, script := range v {
+			if scriptPath, ok := script.(string); ok && cmd != "" && scriptPath != "" {
+				bins[path.Base(cmd)] = path.Clean(scriptPath)
+			}
+		}
+	}
+	return bins
+}
+
+// installedLayout reads what's actually in a modules directory, naming
+// packages and bins by the lockfile path they'd have
+func installedLayout(modulesPath string) (npmLayout, error) {
+	layout := npmLayout{packages: make(map[string]string), bins: make(map[string]string)}
+	err := readInstalledLayout(modulesPath, "node_modules", layout)
+	return layout, err
+}
+
+func readInstalledLayout(dir, prefix string, layout npmLayout) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case name == ".bin":
+			if err := readInstalledBins(filepath.Join(dir, name), prefix, layout); err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, "."):
+			// .cache, .caladan, .package-lock.json, and other tools' state
+		case strings.HasPrefix(name, "@") && entry.IsDir():
+			scoped, err := os.ReadDir(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			for _, pkg := range scoped {
+				if err := readInstalledPackage(filepath.Join(dir, name, pkg.Name()), prefix+"/"+name+"/"+pkg.Name(), pkg, layout); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := readInstalledPackage(filepath.Join(dir, name), prefix+"/"+name, entry, layout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readInstalledPackage records a package's version and what's nested in it.
+// Linked packages are recorded without a version, like the lockfile does
+func readInstalledPackage(dir, p string, entry os.DirEntry, layout npmLayout) error {
+	if entry.Type()&os.ModeSymlink != 0 {
+		layout.packages[p] = ""
+		return nil
+	}
+	if !entry.IsDir() {
+		return nil
+	}
+	var packageJSON struct {
+		Version string `json:"version"`
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "package.json")); err == nil {
+		json.Unmarshal(data, &packageJSON)
+	}
+	layout.packages[p] = packageJSON.Version
+	return readInstalledLayout(filepath.Join(dir, "node_modules"), p+"/node_modules", layout)
+}
+
+// readInstalledBins records where each link in a .bin folder points
+func readInstalledBins(dir, prefix string, layout npmLayout) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		linkPath := prefix + "/.bin/" + entry.Name()
+		target, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			// Not a link, so not pointing at any package's script
+			layout.bins[linkPath] = ""
+			continue
+		}
+		if filepath.IsAbs(target) {
+			layout.bins[linkPath] = target
+			continue
+		}
+		layout.bins[linkPath] = path.Join(prefix+"/.bin", filepath.ToSlash(target))
+	}
+	return nil
+}
+
+// compareLayouts lists every difference between npm's layout and the
+// installed one, sorted by path
+func compareLayouts(expected, actual npmLayout) []CompatIssue {
+	issues := []CompatIssue{}
+	for p, version := range expected.packages {
+		installed, ok := actual.packages[p]
+		switch {
+		case !ok:
+			issues = append(issues, CompatIssue{Kind: compatMissing, Path: p, Expected: version})
+		case installed != version:
+			issues = append(issues, CompatIssue{Kind: compatVersion, Path: p, Expected: version, Actual: installed})
+		}
+	}
+	for p, version := range actual.packages {
+		if _, ok := expected.packages[p]; !ok {
+			issues = append(issues, CompatIssue{Kind: compatExtraneous, Path: p, Actual: version})
+		}
+	}
+	for link, target := range expected.bins {
+		installed, ok := actual.bins[link]
+		switch {
+		case !ok:
+			issues = append(issues, CompatIssue{Kind: compatBinMissing, Path: link, Expected: target})
+		case installed != target:
+			issues = append(issues, CompatIssue{Kind: compatBinTarget, Path: link, Expected: target, Actual: installed})
+		}
+	}
+	for link, target := range actual.bins {
+		if _, ok := expected.bins[link]; !ok {
+			issues = append(issues, CompatIssue{Kind: compatBinExtraneous, Path: link, Actual: target})
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Path != issues[j].Path {
+			return issues[i].Path < issues[j].Path
+		}
+		return issues[i].Kind < issues[j].Kind
+	})
+	return issues
+}
+
+// CheckNPMCompat compares a project's installed packages with what npm ci
+// would install on this machine from the same lockfile
+func CheckNPMCompat(directory string) ([]CompatIssue, error) {
+	config, err := loadConfig(directory)
+	if err != nil {
+		return nil, err
+	}
+	packageLock, err := readLockFile(filepath.Join(directory, "package-lock.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading lockfile: %v", err)
+	}
+	expected, err := expectedNPMLayout(packageLock, hostPlatform())
+	if err != nil {
+		return nil, err
+	}
+	opts := InstallOptions{ModulesDir: config.ModulesDir}
+	actual, err := installedLayout(opts.modulesPath(directory))
+	if err != nil {
+		return nil, fmt.Errorf("error reading node_modules: %v", err)
+	}
+	return compareLayouts(expected, actual), nil
+}
+
+// Check runs caladan check on a project, failing when it finds differences
+func Check(directory string, opts CheckOptions) error {
+	// With --json, one check prints its issues and several print an object
+	// of each check's issues
+	results := make(map[string]interface{})
+	failures := []string{}
+	if opts.NPMCompat {
+		issues, err := CheckNPMCompat(directory)
+		if err != nil {
+			return err
+		}
+		results["npmCompat"] = issues
+		if !opts.JSON {
+			fmt.Print(RenderCompatIssues(issues))
+		}
+		if len(issues) > 0 {
+			failures = append(failures, fmt.Sprintf("node_modules differs from what npm ci would install in %d places", len(issues)))
+		}
+	}
+	if opts.Manifest {
+		issues, err := CheckManifest(directory)
+		if err != nil {
+			return err
+		}
+		results["manifest"] = issues
+		if !opts.JSON {
+			fmt.Print(RenderManifestIssues(issues))
+		}
+		if count := manifestErrors(issues); count > 0 {
+			failures = append(failures, fmt.Sprintf("package.json has %d errors", count))
+		}
+	}
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		var document interface{} = results
+		if len(results) == 1 {
+			for _, issues := range results {
+				document = issues
+			}
+		}
+		if err := encoder.Encode(document); err != nil {
+			return err
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// RenderCompatIssues lists the differences, one per line
+func RenderCompatIssues(issues []CompatIssue) string {
+	if len(issues) == 0 {
+		return colorSuccess("node_modules matches what npm ci would install") + "\n"
+	}
+	var builder strings.Builder
+	for _, issue := range issues {
+		var detail string
+		switch issue.Kind {
+		case compatMissing:
+			detail = "missing, npm would install " + versionOrLink(issue.Expected)
+		case compatVersion:
+			detail = fmt.Sprintf("is %s, npm would install %s", versionOrLink(issue.Actual), versionOrLink(issue.Expected))
+		case compatExtraneous:
+			detail = "is installed, npm wouldn't install it"
+		case compatBinMissing:
+			detail = "missing, npm would link it to " + issue.Expected
+		case compatBinTarget:
+			detail = fmt.Sprintf("links to %s, npm would link it to %s", issue.Actual, issue.Expected)
+		case compatBinExtraneous:
+			detail = "is linked, npm wouldn't link it"
+		}
+		builder.WriteString(fmt.Sprintf("%s %s %s\n", colorWarn(issue.Kind), colorPackage(issue.Path), colorDim(detail)))
+	}
+	return builder.String()
+}
+
+// versionOrLink describes a layout's version, which is empty for links
+func versionOrLink(version string) string {
+	if version == "" {
+		return "a link"
+	}
+	return version
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckNPMCompat(t *testing.T) {
+	project := t.TempDir()
+	lockfile := `{
+  "lockfileVersion": 3,
+  "packages": {
+    "": {"name": "project"},
+    "node_modules/tool": {"version": "1.0.0", "bin": {"tool": "bin/tool.js"}},
+    "node_modules/@scope/cli": {"version": "2.0.0", "bin": "./cli.js"},
+    "node_modules/tool/node_modules/dep": {"version": "3.0.0", "bin": {"dep": "dep.js"}},
+    "node_modules/old": {"version": "1.2.0"},
+    "node_modules/gone": {"version": "1.0.0"},
+    "node_modules/other-os": {"version": "1.0.0", "os": ["none"], "optional": true},
+    "node_modules/other-os/node_modules/child": {"version": "1.0.0"},
+    "node_modules/ws": {"resolved": "packages/ws", "link": true},
+    "packages/ws": {"version": "0.1.0"}
+  }
+}`
+	writeTestFile(t, filepath.Join(project, "package-lock.json"), lockfile)
+
+	modules := filepath.Join(project, "node_modules")
+	for path, version := range map[string]string{"tool": "1.0.0", "@scope/cli": "2.0.0", "tool/node_modules/dep": "3.0.0", "old": "1.1.0", "stray": "0.0.1"} {
+		writeTestFile(t, filepath.Join(modules, path, "package.json"), `{"version":"`+version+`"}`)
+	}
+	writeTestFile(t, filepath.Join(modules, "tool/bin/tool.js"), "")
+	writeTestFile(t, filepath.Join(modules, "@scope/cli/cli.js"), "")
+	writeTestFile(t, filepath.Join(modules, "tool/node_modules/dep/dep.js"), "")
+	writeTestFile(t, filepath.Join(modules, ".caladan/state.json"), "{}")
+	if err := os.MkdirAll(filepath.Join(project, "packages/ws"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"ws":        "../packages/ws",
+		".bin/tool": "../tool/bin/tool.js",
+		".bin/cli":  "../@scope/cli/cli.js",
+		// npm links nested bins next to the package, not at the top
+		".bin/dep": "../tool/node_modules/dep/dep.js",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(modules, link)), 0755)
+		if err := os.Symlink(target, filepath.Join(modules, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	issues, err := CheckNPMCompat(project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CompatIssue{
+		{Kind: compatBinExtraneous, Path: "node_modules/.bin/dep", Actual: "node_modules/tool/node_modules/dep/dep.js"},
+		{Kind: compatMissing, Path: "node_modules/gone", Expected: "1.0.0"},
+		{Kind: compatVersion, Path: "node_modules/old", Expected: "1.2.0", Actual: "1.1.0"},
+		{Kind: compatExtraneous, Path: "node_modules/stray", Actual: "0.0.1"},
+		{Kind: compatBinMissing, Path: "node_modules/tool/node_modules/.bin/dep", Expected: "node_modules/tool/node_modules/dep/dep.js"},
+	}
+	if !reflect.DeepEqual(issues, want) {
+		got, _ := json.MarshalIndent(issues, "", "  ")
+		t.Errorf("issues = %s", got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// suggestionMaxAge is how long search results are reused for completion.
+	// New packages showing up an hour late doesn't matter when completing
+	suggestionMaxAge = time.Hour
+	// suggestionLimit is how many packages a search returns
+	suggestionLimit = 10
+	// completionTimeout bounds the registry search behind a completion, so
+	// a slow network doesn't hang the shell
+	completionTimeout = 2 * time.Second
+)
+
+// PackageSuggestion is a package the registry's search offers
+type PackageSuggestion struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"` // The latest version
+	Description string `json:"description,omitempty"`
+}
+
+// suggestPackages returns packages matching text, from the cache while it's
+// fresh. When the registry can't be reached stale results are better than
+// none
+func suggestPackages(ctx context.Context, client *RegistryClient, cache *ResolutionCache, text string) ([]PackageSuggestion, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	cached, ok := cache.getSuggestions(client.registry, text)
+	if ok && time.Since(cached.FetchedAt) < suggestionMaxAge {
+		return cached.Suggestions, nil
+	}
+	suggestions, err := client.search(ctx, text, suggestionLimit)
+	if err != nil {
+		if ok {
+			return cached.Suggestions, nil
+		}
+		return nil, err
+	}
+	if err := cache.putSuggestions(client.registry, text, cachedSuggestions{FetchedAt: time.Now(), Suggestions: suggestions}); err != nil {
+		printWarning("couldn't cache search results: %v", err)
+	}
+	return suggestions, nil
+}
+
+// completionCommands are the commands offered for the first word
+var completionCommands = []string{
+	"access", "add", "audit", "bench", "changeset", "check", "completion", "constraints", "create", "credentials", "diff",
+	"dist-tag", "explain", "init", "install", "install-lockfile", "ls", "owner", "pack", "publish", "rewrite-lockfile", "rm", "run",
+	"self-update", "token", "update", "version-workspaces", "view-tarball", "workspaces",
+}
+
+// completions returns the candidates for the last of words, the command
+// line after caladan, as "candidate\tdescription" lines. Only commands and
+// the packages of add and view-tarball are completed, anything else is left
+// to the shell
+func completions(words []string, suggest func(text string) ([]PackageSuggestion, error)) []string {
+	if len(words) == 0 {
+		return nil
+	}
+	current := words[len(words)-1]
+	candidates := []string{}
+	if len(words) == 1 {
+		for _, command := range completionCommands {
+			if strings.HasPrefix(command, current) {
+				candidates = append(candidates, command)
+			}
+		}
+		return candidates
+	}
+	// Packages are only searched for once there's something to search for,
+	// and not once a version is being typed
+	if (words[0] != "add" && words[0] != "view-tarball") || current == "" || strings.HasPrefix(current, "-") || strings.LastIndex(current, "@") > 0 {
+		return nil
+	}
+	suggestions, err := suggest(current)
+	if err != nil {
+		return nil
+	}
+	for _, suggestion := range suggestions {
+		if strings.HasPrefix(suggestion.Name, current) {
+			candidates = append(candidates, suggestion.Name+"\t"+suggestion.Version)
+		}
+	}
+	return candidates
+}
+
+// Complete runs caladan __complete, which the completion scripts call with
+// the words typed so far
+func Complete(words []string, out io.Writer) {
+	// Completion can't wait on retries, the cache covers a registry that's
+	// down
+	client := newRegistryClient(&http.Client{Timeout: completionTimeout}, npmRegistryURL, "")
+	client.retries = 0
+	cache := NewResolutionCache(defaultCacheDir())
+	suggest := func(text string) ([]PackageSuggestion, error) {
+		return suggestPackages(context.Background(), client, cache, text)
+	}
+	for _, candidate := range completions(words, suggest) {
+		fmt.Fprintln(out, candidate)
+	}
+}
+
+// Completion scripts for caladan completion. Each hands the words typed so
+// far to caladan __complete, and falls back to file names when it has
+// nothing to offer
+var completionScripts = map[string]string{
+	"bash": `_caladan() {
+  local IFS=$'\n'
+  COMPREPLY=($(caladan __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null | cut -f1))
+}
+complete -o default -F _caladan caladan
+`,
+	"zsh": `#compdef caladan
+_caladan() {
+  local -a candidates
+  local line
+  for line in "${(@f)$(caladan __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+    [[ -n $line ]] && candidates+=("${line/$'\t'/:}")
+  done
+  if (( ${#candidates} )); then
+    _describe 'caladan' candidates
+  else
+    _files
+  fi
+}
+compdef _caladan caladan
+`,
+	"fish": `complete -c caladan -a '(caladan __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+`,
+}
+
+// CompletionScript returns the completion script for a shell
+func CompletionScript(shell string) (string, error) {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return "", fmt.Errorf("completion is available for bash, zsh, and fish, not %s", shell)
+	}
+	return script, nil
+}
+
+// promptPackage asks for a package when add is run without one: it
+// searches for what's typed and offers the results by number
+func promptPackage(p *prompter, suggest func(text string) ([]PackageSuggestion, error)) (string, error) {
+	text, err := p.ask("search packages", "", func(text string) error {
+		if text == "" {
+			return fmt.Errorf("type part of a package name")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for {
+		suggestions, err := suggest(text)
+		if err != nil {
+			return "", err
+		}
+		if len(suggestions) == 0 {
+			fmt.Fprintf(p.out, "No packages match %s\n", text)
+		}
+		for i, suggestion := range suggestions {
+			fmt.Fprintf(p.out, "%2d) %s %s\n", i+1, colorPackage(suggestion.Name), colorDim(suggestion.Version+" "+suggestion.Description))
+		}
+		answer, err := p.ask("pick a number, or search again", "", func(answer string) error {
+			if answer == "" {
+				return fmt.Errorf("pick a number or type a new search")
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		if n, err := strconv.Atoi(answer); err == nil {
+			if n < 1 || n > len(suggestions) {
+				printError("pick a number from 1 to %d", len(suggestions))
+				continue
+			}
+			return suggestions[n-1].Name, nil
+		}
+		text = answer
+	}
+}
+
+// PromptPackage runs promptPackage on the terminal, searching the registry
+func PromptPackage() (string, error) {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return "", fmt.Errorf("no package given, and stdin isn't a terminal to ask for one")
+	}
+	client := newRegistryClient(&http.Client{Timeout: 30 * time.Second}, npmRegistryURL, "")
+	cache := NewResolutionCache(defaultCacheDir())
+	return promptPackage(&prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}, func(text string) ([]PackageSuggestion, error) {
+		return suggestPackages(context.Background(), client, cache, text)
+	})
+}
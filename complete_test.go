@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSuggestPackages(t *testing.T) {
+	var requests atomic.Int32
+	up := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/-/v1/search" || r.URL.Query().Get("text") != "rea" {
+			t.Errorf("request = %s", r.URL)
+		}
+		w.Write([]byte(`{"objects":[{"package":{"name":"react","version":"18.3.1","description":"UI"}},{"package":{"name":"react-dom","version":"18.3.1"}}]}`))
+	}))
+	defer server.Close()
+
+	client := newRegistryClient(server.Client(), server.URL, "")
+	client.retries = 0
+	cache := NewResolutionCache(t.TempDir())
+	want := []PackageSuggestion{{Name: "react", Version: "18.3.1", Description: "UI"}, {Name: "react-dom", Version: "18.3.1"}}
+	for i := 0; i < 2; i++ {
+		suggestions, err := suggestPackages(context.Background(), client, cache, "Rea")
+		if err != nil || !reflect.DeepEqual(suggestions, want) {
+			t.Fatalf("suggestPackages() = %v, %v", suggestions, err)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("requests = %d, want the second search served from the cache", requests.Load())
+	}
+
+	// Stale results stand in when the registry is down
+	cache.putSuggestions(server.URL, "rea", cachedSuggestions{FetchedAt: time.Now().Add(-2 * suggestionMaxAge), Suggestions: want})
+	up = false
+	if suggestions, err := suggestPackages(context.Background(), client, cache, "rea"); err != nil || len(suggestions) != 2 {
+		t.Errorf("suggestPackages() with the registry down = %v, %v", suggestions, err)
+	}
+	if _, err := suggestPackages(context.Background(), client, cache, "vue"); err == nil {
+		t.Errorf("suggestPackages() with nothing cached and the registry down = nil error")
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	searched := []string{}
+	suggest := func(text string) ([]PackageSuggestion, error) {
+		searched = append(searched, text)
+		return []PackageSuggestion{{Name: "react", Version: "18.3.1"}, {Name: "preact", Version: "10.0.0"}}, nil
+	}
+	for _, tt := range []struct {
+		words []string
+		want  []string
+	}{
+		{[]string{"ins"}, []string{"install", "install-lockfile"}},
+		{[]string{"add", "--global", "rea"}, []string{"react\t18.3.1"}},
+		{[]string{"add", "--glo"}, nil},
+		{[]string{"add", "react@"}, nil},
+		{[]string{"add", ""}, nil},
+		{[]string{"run", "rea"}, nil},
+	} {
+		if got := completions(tt.words, suggest); len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("completions(%q) = %q, want %q", tt.words, got, tt.want)
+		}
+	}
+	if !reflect.DeepEqual(searched, []string{"rea"}) {
+		t.Errorf("searched = %q, want only the add package", searched)
+	}
+}
+
+func TestPromptPackage(t *testing.T) {
+	suggest := func(text string) ([]PackageSuggestion, error) {
+		if text == "vue" {
+			return []PackageSuggestion{{Name: "vue", Version: "3.4.0"}, {Name: "vue-router", Version: "4.3.0"}}, nil
+		}
+		return nil, nil
+	}
+	// A search with no results, an out of range pick, then a good one
+	p := &prompter{in: bufio.NewReader(strings.NewReader("nothing\nvue\n7\n2\n")), out: io.Discard}
+	name, err := promptPackage(p, suggest)
+	if err != nil || name != "vue-router" {
+		t.Errorf("promptPackage() = %q, %v, want vue-router", name, err)
+	}
+}
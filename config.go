@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Config is a project's caladan configuration, read from the "caladan"
+// field of its package.json
+type Config struct {
+	SupportedArchitectures SupportedArchitectures      `json:"supportedArchitectures"`
+	NetworkConcurrency     int                         `json:"networkConcurrency,omitempty"`
+	TarWorkers             int                         `json:"tarWorkers,omitempty"`
+	StaticConcurrency      bool                        `json:"staticConcurrency,omitempty"`
+	PackageImportMethod    string                      `json:"packageImportMethod,omitempty"`
+	Durability             string                      `json:"durability,omitempty"`
+	ModulesDir             string                      `json:"modulesDir,omitempty"`
+	VirtualStoreDir        string                      `json:"virtualStoreDir,omitempty"`
+	IgnoreScripts          bool                        `json:"ignoreScripts,omitempty"`
+	NoDeprecated           bool                        `json:"noDeprecated,omitempty"`
+	AuditLevel             string                      `json:"auditLevel,omitempty"`
+	AuditDB                string                      `json:"auditDb,omitempty"`
+	AuditSources           []AuditSourceConfig         `json:"auditSources,omitempty"`
+	Credentials            map[string]CredentialConfig `json:"credentials,omitempty"`
+	Mirrors                []string                    `json:"mirrors,omitempty"`
+	DNS                    DNSConfig                   `json:"dns,omitempty"`
+	Budget                 BudgetConfig                `json:"budget,omitempty"`
+	ScriptNetwork          ScriptNetworkConfig         `json:"scriptNetwork,omitempty"`
+	ScriptTimeout          ScriptTimeoutConfig         `json:"scriptTimeout,omitempty"`
+	Prebuilt               PrebuiltConfig              `json:"prebuilt,omitempty"`
+	BinaryMirrors          BinaryMirrors               `json:"binaryMirrors,omitempty"`
+	Registries             Registries                  `json:"registries,omitempty"`
+	RewriteResolved        bool                        `json:"rewriteResolved,omitempty"`
+	ScriptShell            string                      `json:"scriptShell,omitempty"`
+	ReadOnly               bool                        `json:"readOnly,omitempty"`
+	Gitignore              string                      `json:"gitignore,omitempty"`
+	Jobs                   int                         `json:"jobs,omitempty"`
+	Tasks                  map[string]TaskConfig       `json:"tasks,omitempty"`
+}
+
+// defaultNetworkConcurrency is how many registry requests run at once
+const defaultNetworkConcurrency = 64
+
+// maxConcurrency bounds the concurrency settings to something sane
+const maxConcurrency = 1024
+
+// SupportedArchitectures lists the platforms a project installs packages for,
+// so platform-specific optional dependencies for all of them end up in
+// node_modules. "current" stands for the host's value
+type SupportedArchitectures struct {
+	OS   []string `json:"os,omitempty"`
+	CPU  []string `json:"cpu,omitempty"`
+	Libc []string `json:"libc,omitempty"`
+}
+
+// loadConfig reads the caladan config of the project in directory, on top
+// of the user's config file. A missing package.json or config field gives
+// the user's config, or the default config when there's none
+func loadConfig(directory string) (Config, error) {
+	var config Config
+
+	if path := userConfigPath(); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return config, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &config); err != nil {
+				return config, fmt.Errorf("error parsing %s: %v", path, err)
+			}
+		}
+	}
+
+	packageJSONPath := filepath.Join(directory, "package.json")
+	data, err := os.ReadFile(packageJSONPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+
+	// The project's settings are decoded over the user's, so only the ones
+	// it sets replace them
+	packageJSON := struct {
+		Caladan *Config `json:"caladan"`
+	}{Caladan: &config}
+	if err := json.Unmarshal(data, &packageJSON); err != nil {
+		return config, fmt.Errorf("error parsing %s: %v", packageJSONPath, err)
+	}
+
+	return config, nil
+}
+
+// applyConfig fills in the settings that weren't given as flags, from the
+// environment and then the project config, and validates them
+func (opts *InstallOptions) applyConfig(config Config) error {
+	if opts.NetworkConcurrency == 0 {
+		opts.NetworkConcurrency = config.NetworkConcurrency
+	}
+
+	if opts.TarWorkers == 0 {
+		// TAR_WORKERS predates the flag and is still used for profiling
+		if tarWorkersEnv := os.Getenv("TAR_WORKERS"); tarWorkersEnv != "" {
+			tw, err := parseFloat64(tarWorkersEnv)
+			if err != nil || tw < 1 {
+				return fmt.Errorf("invalid TAR_WORKERS value '%s'", tarWorkersEnv)
+			}
+			opts.TarWorkers = int(tw)
+			fmt.Printf("Using custom TAR_WORKERS value: %v\n", opts.TarWorkers)
+		} else {
+			opts.TarWorkers = config.TarWorkers
+		}
+	}
+
+	if opts.Jobs == 0 {
+		opts.Jobs = config.Jobs
+	}
+	opts.StaticConcurrency = opts.StaticConcurrency || config.StaticConcurrency
+	opts.IgnoreScripts = opts.IgnoreScripts || config.IgnoreScripts
+	opts.NoDeprecated = opts.NoDeprecated || config.NoDeprecated
+	opts.ReadOnly = opts.ReadOnly || config.ReadOnly
+
+	if opts.ImportMethod == "" {
+		opts.ImportMethod = config.PackageImportMethod
+	}
+	if opts.Durability == "" {
+		opts.Durability = config.Durability
+	}
+	if opts.ModulesDir == "" {
+		opts.ModulesDir = config.ModulesDir
+	}
+	if opts.VirtualStoreDir == "" {
+		opts.VirtualStoreDir = config.VirtualStoreDir
+	}
+	if opts.AuditLevel == "" {
+		opts.AuditLevel = config.AuditLevel
+	}
+	if opts.AuditDB == "" {
+		opts.AuditDB = os.Getenv("CALADAN_AUDIT_DB")
+	}
+	if opts.AuditDB == "" {
+		opts.AuditDB = config.AuditDB
+	}
+	opts.auditSources = config.AuditSources
+	timeouts, err := config.ScriptTimeout.parse()
+	if err != nil {
+		return err
+	}
+	if opts.ScriptTimeout > 0 {
+		timeouts.fallback = opts.ScriptTimeout
+	}
+	opts.scriptTimeouts = timeouts
+	opts.ScriptShell = config.scriptShell(opts.ScriptShell)
+	opts.binaryMirrors = config.BinaryMirrors
+	if err := config.Registries.validate(); err != nil {
+		return err
+	}
+	opts.registries = config.Registries
+	opts.RewriteResolved = opts.RewriteResolved || config.RewriteResolved
+	if opts.RewriteResolved && len(opts.registries) == 0 {
+		return fmt.Errorf("rewriting resolved URLs needs registries in the config")
+	}
+	opts.scriptNetwork = config.ScriptNetwork
+	if opts.ScriptNetwork != "" {
+		opts.scriptNetwork.Policy = opts.ScriptNetwork
+	}
+	if opts.scriptNetwork.Policy != "" && !validScriptNetworkPolicy(opts.scriptNetwork.Policy) {
+		return fmt.Errorf("script network policy must be allow, deny, or log, got %s", opts.scriptNetwork.Policy)
+	}
+	opts.gitignore = config.Gitignore
+	if opts.gitignore != "" && !validGitignore(opts.gitignore) {
+		return fmt.Errorf("gitignore must be prompt, add, or off, got %s", opts.gitignore)
+	}
+	if opts.transport == nil {
+		dns, err := newDNSCache(config.DNS)
+		if err != nil {
+			return err
+		}
+		opts.transport = registryTransport(dns)
+		if opts.HTTP3 {
+			opts.transport = newHTTP3Transport(dns, opts.transport)
+		}
+	}
+	if opts.mirrors == nil && len(config.Mirrors) > 0 {
+		router, err := newMirrorRouter(npmRegistryURL, config.Mirrors)
+		if err != nil {
+			return err
+		}
+		router.transport = opts.transport
+		opts.mirrors = router
+	}
+
+	if opts.NetworkConcurrency < 0 || opts.NetworkConcurrency > maxConcurrency {
+		return fmt.Errorf("network concurrency must be between 1 and %d, got %d", maxConcurrency, opts.NetworkConcurrency)
+	}
+	if opts.Jobs < 0 || opts.Jobs > maxConcurrency {
+		return fmt.Errorf("jobs must be between 1 and %d, got %d", maxConcurrency, opts.Jobs)
+	}
+	if opts.TarWorkers < 0 || opts.TarWorkers > maxConcurrency {
+		return fmt.Errorf("tar workers must be between 1 and %d, got %d", maxConcurrency, opts.TarWorkers)
+	}
+	if opts.ImportMethod != "" && !validImportMethod(opts.ImportMethod) {
+		return fmt.Errorf("package import method must be auto, hardlink, clone, or copy, got %s", opts.ImportMethod)
+	}
+	// Making a hard link read-only makes the store's file read-only, and
+	// every other project's linked to it, so read-only installs clone or copy
+	if opts.ReadOnly {
+		switch opts.ImportMethod {
+		case "", importAuto:
+			opts.ImportMethod = importClone
+		case importHardlink:
+			return fmt.Errorf("read-only installs can't hard link from the store, use the clone or copy import method")
+		}
+	}
+	if opts.Durability != "" && !validDurability(opts.Durability) {
+		return fmt.Errorf("durability must be none, dir, or full, got %s", opts.Durability)
+	}
+	if opts.AuditLevel != "" && !validAuditLevel(opts.AuditLevel) {
+		return fmt.Errorf("audit level must be low, moderate, high, or critical, got %s", opts.AuditLevel)
+	}
+
+	return nil
+}
+
+// modulesPath returns where packages are installed for the project in workDir
+func (opts InstallOptions) modulesPath(workDir string) string {
+	return projectPath(workDir, opts.ModulesDir, "node_modules")
+}
+
+// virtualStorePath returns where installs are staged for the project in workDir
+func (opts InstallOptions) virtualStorePath(workDir string) string {
+	return projectPath(workDir, opts.VirtualStoreDir, stateDirName)
+}
+
+// projectPath resolves a directory setting against the project, using
+// fallback when it isn't set
+func projectPath(workDir, dir, fallback string) string {
+	if dir == "" {
+		dir = fallback
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(workDir, dir)
+}
+
+// networkConcurrency returns how many HTTP requests may run at once
+func (opts InstallOptions) networkConcurrency() int64 {
+	if opts.NetworkConcurrency > 0 {
+		return int64(opts.NetworkConcurrency)
+	}
+	return defaultNetworkConcurrency
+}
+
+// tarWorkers returns how many tarballs may be extracted at once, which
+// defaults to 1.5x cores
+func (opts InstallOptions) tarWorkers() int64 {
+	if opts.TarWorkers > 0 {
+		return int64(opts.TarWorkers)
+	}
+	return max(int64(float64(runtime.NumCPU())*1.5), 1)
+}
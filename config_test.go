@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	packageJSON := `{"name":"app","caladan":{"networkConcurrency":8,"supportedArchitectures":{"os":["linux"]}}}`
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(packageJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(dir)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if config.NetworkConcurrency != 8 || len(config.SupportedArchitectures.OS) != 1 {
+		t.Errorf("loadConfig() = %+v", config)
+	}
+
+	// No package.json means the default config
+	if _, err := loadConfig(t.TempDir()); err != nil {
+		t.Errorf("loadConfig() without package.json error = %v", err)
+	}
+}
+
+func TestLoadConfigUserConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("CALADAN_HOME", home)
+	writeTestFile(t, filepath.Join(home, "config.json"), `{"networkConcurrency":8,"tarWorkers":2}`)
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name":"app","caladan":{"tarWorkers":4}}`)
+	config, err := loadConfig(dir)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if config.NetworkConcurrency != 8 || config.TarWorkers != 4 {
+		t.Errorf("loadConfig() = %+v, want the user's networkConcurrency and the project's tarWorkers", config)
+	}
+
+	config, err = loadConfig(t.TempDir())
+	if err != nil || config.TarWorkers != 2 {
+		t.Errorf("loadConfig() without package.json = %+v, %v, want the user's config", config, err)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    InstallOptions
+		config  Config
+		tarEnv  string
+		wantNet int64
+		wantTar int64
+		wantErr bool
+	}{
+		{
+			name:    "config fills unset flags",
+			config:  Config{NetworkConcurrency: 8, TarWorkers: 2},
+			wantNet: 8,
+			wantTar: 2,
+		},
+		{
+			name:    "flags win over config",
+			opts:    InstallOptions{NetworkConcurrency: 16, TarWorkers: 4},
+			config:  Config{NetworkConcurrency: 8, TarWorkers: 2},
+			wantNet: 16,
+			wantTar: 4,
+		},
+		{
+			name:    "env wins over config",
+			config:  Config{TarWorkers: 2},
+			tarEnv:  "6",
+			wantNet: defaultNetworkConcurrency,
+			wantTar: 6,
+		},
+		{
+			name:    "negative concurrency",
+			opts:    InstallOptions{NetworkConcurrency: -1},
+			wantErr: true,
+		},
+		{
+			name:    "invalid env",
+			tarEnv:  "lots",
+			wantErr: true,
+		},
+		{
+			name:    "invalid durability",
+			opts:    InstallOptions{Durability: "fsync"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid audit level",
+			opts:    InstallOptions{AuditLevel: "severe"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid import method",
+			config:  Config{PackageImportMethod: "symlink"},
+			wantErr: true,
+		},
+		{
+			name:    "read-only hard links",
+			opts:    InstallOptions{ReadOnly: true, ImportMethod: "hardlink"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TAR_WORKERS", tt.tarEnv)
+			opts := tt.opts
+			err := opts.applyConfig(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := opts.networkConcurrency(); got != tt.wantNet {
+				t.Errorf("networkConcurrency() = %v, want %v", got, tt.wantNet)
+			}
+			if got := opts.tarWorkers(); got != tt.wantTar {
+				t.Errorf("tarWorkers() = %v, want %v", got, tt.wantTar)
+			}
+		})
+	}
+}
+
+func TestReadOnlyImportMethod(t *testing.T) {
+	opts := InstallOptions{}
+	if err := opts.applyConfig(Config{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if opts.ImportMethod != importClone {
+		t.Errorf("import method = %s, want clone so the store's files stay writable", opts.ImportMethod)
+	}
+}
+
+func TestInstallPaths(t *testing.T) {
+	workDir := filepath.Join("projects", "app")
+	tests := []struct {
+		name             string
+		opts             InstallOptions
+		wantModules      string
+		wantVirtualStore string
+	}{
+		{
+			name:             "defaults",
+			wantModules:      filepath.Join(workDir, "node_modules"),
+			wantVirtualStore: filepath.Join(workDir, ".caladan"),
+		},
+		{
+			name:             "relative to the project",
+			opts:             InstallOptions{ModulesDir: "build/node_modules", VirtualStoreDir: "build/.staging"},
+			wantModules:      filepath.Join(workDir, "build", "node_modules"),
+			wantVirtualStore: filepath.Join(workDir, "build", ".staging"),
+		},
+		{
+			name:             "absolute",
+			opts:             InstallOptions{ModulesDir: filepath.Join(string(filepath.Separator), "opt", "lambda", "node_modules")},
+			wantModules:      filepath.Join(string(filepath.Separator), "opt", "lambda", "node_modules"),
+			wantVirtualStore: filepath.Join(workDir, ".caladan"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.modulesPath(workDir); got != tt.wantModules {
+				t.Errorf("modulesPath() = %v, want %v", got, tt.wantModules)
+			}
+			if got := tt.opts.virtualStorePath(workDir); got != tt.wantVirtualStore {
+				t.Errorf("virtualStorePath() = %v, want %v", got, tt.wantVirtualStore)
+			}
+		})
+	}
+}
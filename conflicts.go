@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RangeRequest is a range dependents ask for a package at
+type RangeRequest struct {
+	Range string   `json:"range"`
+	From  []string `json:"from"` // Lockfile paths of the dependents, "" for the project
+}
+
+// ConflictVersion is one of the versions a package was split into
+type ConflictVersion struct {
+	Version  string         `json:"version"`
+	Paths    []string       `json:"paths"`
+	Requests []RangeRequest `json:"requests"`
+}
+
+// ResolutionConflict is a package resolved to more than one version.
+// Incompatible lists the pairs of ranges that no single version of the
+// package satisfies, which forced the split. When there are none the split
+// is avoidable, and Satisfying is a version every range accepts
+type ResolutionConflict struct {
+	Name         string            `json:"name"`
+	Versions     []ConflictVersion `json:"versions"`
+	Incompatible [][2]RangeRequest `json:"incompatible"`
+	Satisfying   string            `json:"satisfying,omitempty"`
+}
+
+// resolutionConflicts finds every package in a lockfile with more than one
+// version. match lists which of the versions satisfy a range, and the
+// candidates are every version of the package that was resolved
+func resolutionConflicts(packages map[string]json.RawMessage, match func(versionRange string, versions []string) ([]string, error)) ([]ResolutionConflict, error) {
+	pathsByName := make(map[string]map[string][]string) // name -> version -> paths
+	for path, raw := range packages {
+		if path == "" || !strings.Contains(path, "node_modules/") {
+			continue
+		}
+		name := packageNameFromPath(path)
+		version := lockfileEntryVersion(raw)
+		if version == "" {
+			continue
+		}
+		if pathsByName[name] == nil {
+			pathsByName[name] = make(map[string][]string)
+		}
+		pathsByName[name][version] = append(pathsByName[name][version], path)
+	}
+
+	conflicts := []ResolutionConflict{}
+	for name, byVersion := range pathsByName {
+		if len(byVersion) < 2 {
+			continue
+		}
+		conflict := ResolutionConflict{Name: name}
+		versions := []string{}
+		for version := range byVersion {
+			versions = append(versions, version)
+		}
+		sortVersions(versions)
+
+		// Every range asked for, and which of the versions satisfy it
+		satisfies := make(map[string]map[string]bool)
+		allRequests := []RangeRequest{}
+		for _, version := range versions {
+			paths := byVersion[version]
+			sort.Strings(paths)
+			entry := ConflictVersion{Version: version, Paths: paths}
+			for _, path := range paths {
+				requirements, err := lockfileRequirements(packages, name, path)
+				if err != nil {
+					return nil, err
+				}
+				for _, requirement := range requirements {
+					entry.Requests = addRangeRequest(entry.Requests, requirement.Range, requirement.From)
+				}
+			}
+			for _, request := range entry.Requests {
+				if satisfies[request.Range] != nil {
+					continue
+				}
+				satisfies[request.Range] = make(map[string]bool)
+				// A range that isn't semver, like a tag or an alias, is
+				// only known to be satisfied by what it resolved to
+				matches, err := match(request.Range, versions)
+				if err != nil {
+					matches = []string{version}
+				}
+				for _, matched := range matches {
+					satisfies[request.Range][matched] = true
+				}
+			}
+			allRequests = append(allRequests, entry.Requests...)
+			conflict.Versions = append(conflict.Versions, entry)
+		}
+
+		// Prefer the newest version, since that's what the ranges resolve to
+		for i := len(versions) - 1; i >= 0 && conflict.Satisfying == ""; i-- {
+			all := true
+			for _, request := range allRequests {
+				all = all && satisfies[request.Range][versions[i]]
+			}
+			if all {
+				conflict.Satisfying = versions[i]
+			}
+		}
+		if conflict.Satisfying == "" {
+			seen := make(map[string]bool)
+			for i, a := range allRequests {
+				for _, b := range allRequests[i+1:] {
+					key := a.Range + "\x00" + b.Range
+					if a.Range == b.Range || seen[key] || rangesOverlap(satisfies[a.Range], satisfies[b.Range]) {
+						continue
+					}
+					seen[key] = true
+					conflict.Incompatible = append(conflict.Incompatible, [2]RangeRequest{a, b})
+				}
+			}
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Name < conflicts[j].Name })
+	return conflicts, nil
+}
+
+// addRangeRequest adds a dependent to the request for its range
+func addRangeRequest(requests []RangeRequest, versionRange, from string) []RangeRequest {
+	for i := range requests {
+		if requests[i].Range == versionRange {
+			requests[i].From = appendUnique(requests[i].From, from)
+			return requests
+		}
+	}
+	return append(requests, RangeRequest{Range: versionRange, From: []string{from}})
+}
+
+// rangesOverlap reports whether some version satisfies both ranges
+func rangesOverlap(a, b map[string]bool) bool {
+	for version := range a {
+		if b[version] {
+			return true
+		}
+	}
+	return false
+}
+
+// sortVersions orders versions oldest first, by semver where they parse
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		if cmp, ok := compareSemver(versions[i], versions[j]); ok {
+			return cmp < 0
+		}
+		return versions[i] < versions[j]
+	})
+}
+
+// RenderConflicts lists each split package with the ranges behind each of
+// its versions, then what forced the split
+func RenderConflicts(conflicts []ResolutionConflict) string {
+	if len(conflicts) == 0 {
+		return "Every package resolved to a single version\n"
+	}
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%d packages resolved to more than one version:\n", len(conflicts)))
+	for _, conflict := range conflicts {
+		builder.WriteString("\n" + colorPackage(conflict.Name) + "\n")
+		for _, version := range conflict.Versions {
+			builder.WriteString(fmt.Sprintf("  %s %s\n", version.Version, colorDim(fmt.Sprintf("(%d copies)", len(version.Paths)))))
+			for _, request := range version.Requests {
+				builder.WriteString(colorDim(fmt.Sprintf("    %s from %s", request.Range, describeDependents(request.From))) + "\n")
+			}
+		}
+		if conflict.Satisfying != "" {
+			builder.WriteString(colorWarn(fmt.Sprintf("  avoidable: %s satisfies every range", conflict.Satisfying)) + "\n")
+			continue
+		}
+		for _, pair := range conflict.Incompatible {
+			builder.WriteString(fmt.Sprintf("  %s (%s) and %s (%s) don't overlap\n",
+				pair[0].Range, describeDependents(pair[0].From), pair[1].Range, describeDependents(pair[1].From)))
+		}
+	}
+	return builder.String()
+}
+
+// describeDependents names the dependents behind a range by package
+func describeDependents(paths []string) string {
+	names := []string{}
+	for _, path := range paths {
+		name := "the project"
+		if path != "" {
+			name = packageNameFromPath(path)
+		}
+		names = appendUnique(names, name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// reportConflicts prints the conflict report for a lockfile's packages
+func reportConflicts(packages map[string]json.RawMessage) {
+	conflicts, err := resolutionConflicts(packages, GetMatchingVersions)
+	if err != nil {
+		printWarning("couldn't build the conflict report: %v", err)
+		return
+	}
+	fmt.Print("\n" + RenderConflicts(conflicts))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestResolutionConflicts(t *testing.T) {
+	packages := map[string]json.RawMessage{
+		"":                                  json.RawMessage(`{"dependencies": {"debug": "^4.1.0", "ms": "^2.0.0", "a": "^1.0.0", "b": "^1.0.0"}}`),
+		"node_modules/debug":                json.RawMessage(`{"version": "4.3.4", "dependencies": {"ms": "^2.1.0"}}`),
+		"node_modules/ms":                   json.RawMessage(`{"version": "2.1.3"}`),
+		"node_modules/a":                    json.RawMessage(`{"version": "1.0.0", "dependencies": {"debug": "^3.0.0", "ms": "2.0.0"}}`),
+		"node_modules/a/node_modules/debug": json.RawMessage(`{"version": "3.2.7"}`),
+		"node_modules/a/node_modules/ms":    json.RawMessage(`{"version": "2.0.0"}`),
+		"node_modules/b":                    json.RawMessage(`{"version": "1.0.0", "dependencies": {"debug": "^4.0.0"}}`),
+		"node_modules/b/node_modules/debug": json.RawMessage(`{"version": "4.3.1"}`),
+	}
+	conflicts, err := resolutionConflicts(packages, caretMatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 || conflicts[0].Name != "debug" || conflicts[1].Name != "ms" {
+		t.Fatalf("conflicts = %+v, want debug and ms", conflicts)
+	}
+
+	debug := conflicts[0]
+	if len(debug.Versions) != 3 || debug.Versions[0].Version != "3.2.7" || debug.Versions[2].Version != "4.3.4" {
+		t.Fatalf("debug versions = %+v, want oldest first", debug.Versions)
+	}
+	if debug.Satisfying != "" {
+		t.Errorf("debug satisfying = %q, ^3 and ^4 can't share a version", debug.Satisfying)
+	}
+	// ^3.0.0 clashes with both ^4 ranges, but they overlap each other
+	if len(debug.Incompatible) != 2 {
+		t.Fatalf("debug incompatible = %+v", debug.Incompatible)
+	}
+	for _, pair := range debug.Incompatible {
+		if pair[0].Range != "^3.0.0" || pair[0].From[0] != "node_modules/a" {
+			t.Errorf("pair = %+v, want ^3.0.0 from a first", pair)
+		}
+	}
+
+	ms := conflicts[1]
+	// 2.0.0 satisfies the project's ^2.0.0, so only ^2.1.0 clashes with it
+	if ms.Satisfying != "" || len(ms.Incompatible) != 1 || ms.Incompatible[0][1].Range != "^2.1.0" {
+		t.Fatalf("ms = %+v, want 2.0.0 to clash with ^2.1.0", ms)
+	}
+
+	// Two copies of ^4 are avoidable, 4.3.4 satisfies both
+	delete(packages, "node_modules/a")
+	delete(packages, "node_modules/a/node_modules/debug")
+	delete(packages, "node_modules/a/node_modules/ms")
+	conflicts, err = resolutionConflicts(packages, caretMatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Satisfying != "4.3.4" || len(conflicts[0].Incompatible) != 0 {
+		t.Fatalf("conflicts = %+v, want an avoidable debug split", conflicts)
+	}
+	output := RenderConflicts(conflicts)
+	if !strings.Contains(output, "avoidable: 4.3.4 satisfies every range") || !strings.Contains(output, "^4.1.0 from the project") {
+		t.Errorf("output = %q", output)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// constraintsFileName is the project's dependency policy, next to its
+// package.json
+const constraintsFileName = "caladan-constraints.json"
+
+// Rules a constraints file can set
+const (
+	ruleSameVersion = "sameVersion"
+	ruleBanned      = "banned"
+	ruleLicenses    = "licenses"
+)
+
+// Constraints is a project's dependency policy, checked across the root and
+// every workspace before each install and by caladan constraints
+type Constraints struct {
+	// Dependencies the root and workspaces must all ask for at the same
+	// range, "*" for every dependency
+	SameVersion []string `json:"sameVersion,omitempty"`
+	// Packages nothing may depend on, directly or not, with why
+	Banned map[string]string `json:"banned,omitempty"`
+	// SPDX licenses installed packages may have. An expression passes when
+	// the licenses it needs are allowed, so (MIT OR GPL-3.0) passes with MIT
+	Licenses []string `json:"licenses,omitempty"`
+	// Packages whose license isn't checked, e.g. after a legal review
+	LicenseExceptions []string `json:"licenseExceptions,omitempty"`
+}
+
+// ConstraintViolation is a place the project breaks one of its rules.
+// Where lists the workspaces or lockfile paths involved
+type ConstraintViolation struct {
+	Rule    string   `json:"rule"`
+	Package string   `json:"package"`
+	Message string   `json:"message"`
+	Where   []string `json:"where"`
+}
+
+// ConstraintsOptions configures caladan constraints
+type ConstraintsOptions struct {
+	JSON bool
+
+	// Where the JSON goes, stdout is moved to stderr so it stays parseable
+	jsonOutput io.Writer
+}
+
+// readConstraints reads the constraints file of the project in directory.
+// ok is false when there isn't one
+func readConstraints(directory string) (constraints Constraints, ok bool, err error) {
+	path := filepath.Join(directory, constraintsFileName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return constraints, false, nil
+	} else if err != nil {
+		return constraints, false, err
+	}
+	if err := json.Unmarshal(data, &constraints); err != nil {
+		return constraints, false, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return constraints, true, nil
+}
+
+// projectManifests returns the root of the project as a workspace in ".",
+// followed by its workspaces when it has any
+func projectManifests(directory string) ([]workspace, error) {
+	data, err := os.ReadFile(filepath.Join(directory, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	var root struct {
+		PackageInfo
+		Private    bool            `json:"private"`
+		Workspaces json.RawMessage `json:"workspaces"`
+	}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("error parsing package.json: %v", err)
+	}
+	manifests := []workspace{{Dir: ".", Name: root.Name, Version: root.Version, Private: root.Private, manifest: root.PackageInfo}}
+	if len(root.Workspaces) == 0 {
+		return manifests, nil
+	}
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return nil, err
+	}
+	return append(manifests, workspaces...), nil
+}
+
+// checkSameVersion finds dependencies the manifests ask for at different
+// ranges. catalog: ranges count as the range they pin, and dependencies on
+// workspaces are left out since they always resolve locally
+func checkSameVersion(names []string, manifests []workspace, rootCatalogs catalogs) []ConstraintViolation {
+	all := false
+	checked := make(map[string]bool)
+	for _, name := range names {
+		all = all || name == "*"
+		checked[name] = true
+	}
+	local := make(map[string]bool)
+	for _, ws := range manifests {
+		local[ws.Name] = true
+	}
+
+	// Dependency name -> range -> where it's asked for
+	ranges := make(map[string]map[string][]string)
+	for _, ws := range manifests {
+		for _, section := range []string{"dependencies", "optionalDependencies", "devDependencies"} {
+			for dep, depRange := range ws.sectionDeps(section) {
+				if !(all || checked[dep]) || local[dep] || strings.HasPrefix(depRange, "workspace:") {
+					continue
+				}
+				if pinned, err := rootCatalogs.catalogRange(dep, depRange); err == nil {
+					depRange = pinned
+				}
+				if ranges[dep] == nil {
+					ranges[dep] = make(map[string][]string)
+				}
+				ranges[dep][depRange] = appendUnique(ranges[dep][depRange], ws.Dir)
+			}
+		}
+	}
+
+	violations := []ConstraintViolation{}
+	for dep, byRange := range ranges {
+		if len(byRange) < 2 {
+			continue
+		}
+		depRanges := make([]string, 0, len(byRange))
+		for depRange := range byRange {
+			depRanges = append(depRanges, depRange)
+		}
+		sort.Strings(depRanges)
+		parts := []string{}
+		where := []string{}
+		for _, depRange := range depRanges {
+			sort.Strings(byRange[depRange])
+			parts = append(parts, fmt.Sprintf("%s in %s", depRange, strings.Join(byRange[depRange], ", ")))
+			where = appendUnique(where, byRange[depRange]...)
+		}
+		sort.Strings(where)
+		violations = append(violations, ConstraintViolation{
+			Rule:    ruleSameVersion,
+			Package: dep,
+			Message: "asked for at different ranges: " + strings.Join(parts, "; "),
+			Where:   where,
+		})
+	}
+	return violations
+}
+
+// checkBanned finds manifests and lockfile entries that bring in a banned
+// package
+func checkBanned(banned map[string]string, manifests []workspace, packages map[string]json.RawMessage) []ConstraintViolation {
+	where := make(map[string][]string)
+	for _, ws := range manifests {
+		for _, section := range dependencySections {
+			for dep := range ws.sectionDeps(section) {
+				if _, ok := banned[dep]; ok {
+					where[dep] = append(where[dep], fmt.Sprintf("%s (%s)", ws.Dir, section))
+				}
+			}
+		}
+	}
+	for path := range packages {
+		if !strings.Contains(path, "node_modules/") {
+			continue
+		}
+		name := packageNameFromPath(path)
+		if _, ok := banned[name]; ok {
+			where[name] = append(where[name], path)
+		}
+	}
+
+	violations := []ConstraintViolation{}
+	for name, places := range where {
+		sort.Strings(places)
+		message := "is banned"
+		if reason := banned[name]; reason != "" {
+			message += ": " + reason
+		}
+		violations = append(violations, ConstraintViolation{Rule: ruleBanned, Package: name, Message: message, Where: places})
+	}
+	return violations
+}
+
+// checkLicenses finds lockfile entries whose license isn't allowed
+func checkLicenses(allowed, exceptions []string, packages map[string]json.RawMessage) []ConstraintViolation {
+	allowedSet := make(map[string]bool)
+	for _, license := range allowed {
+		allowedSet[license] = true
+	}
+	excepted := make(map[string]bool)
+	for _, name := range exceptions {
+		excepted[name] = true
+	}
+
+	// name@version -> violation, so copies of a package are reported once
+	found := make(map[string]*ConstraintViolation)
+	for path, raw := range packages {
+		if !strings.Contains(path, "node_modules/") {
+			continue
+		}
+		var entry struct {
+			Version string      `json:"version"`
+			License interface{} `json:"license"`
+			Link    bool        `json:"link"`
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil || entry.Link {
+			continue
+		}
+		name := packageNameFromPath(path)
+		if excepted[name] {
+			continue
+		}
+		license := entryLicense(entry.License)
+		if license != "" && licenseAllowed(license, allowedSet) {
+			continue
+		}
+		key := name + "@" + entry.Version
+		if found[key] == nil {
+			message := "has no license"
+			if license != "" {
+				message = fmt.Sprintf("is licensed %s, which isn't allowed", license)
+			}
+			found[key] = &ConstraintViolation{Rule: ruleLicenses, Package: key, Message: message}
+		}
+		found[key].Where = append(found[key].Where, path)
+	}
+
+	violations := []ConstraintViolation{}
+	for _, violation := range found {
+		sort.Strings(violation.Where)
+		violations = append(violations, *violation)
+	}
+	return violations
+}
+
+// entryLicense returns a lockfile entry's license, which old packages give
+// as an object with a type
+func entryLicense(license interface{}) string {
+	switch license := license.(type) {
+	case string:
+		return license
+	case map[string]interface{}:
+		if licenseType, ok := license["type"].(string); ok {
+			return licenseType
+		}
+	}
+	return ""
+}
+
+// licenseAllowed evaluates an SPDX expression against the allowed licenses:
+// OR needs one side allowed and AND needs both. A license with + or an
+// exception is allowed when its base license is
+func licenseAllowed(expression string, allowed map[string]bool) bool {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expression))
+	ok, rest := evalLicenseOr(tokens, allowed)
+	return ok && len(rest) == 0
+}
+
+func evalLicenseOr(tokens []string, allowed map[string]bool) (bool, []string) {
+	ok, rest := evalLicenseAnd(tokens, allowed)
+	for len(rest) > 0 && rest[0] == "OR" {
+		var next bool
+		next, rest = evalLicenseAnd(rest[1:], allowed)
+		ok = ok || next
+	}
+	return ok, rest
+}
+
+func evalLicenseAnd(tokens []string, allowed map[string]bool) (bool, []string) {
+	ok, rest := evalLicenseTerm(tokens, allowed)
+	for len(rest) > 0 && rest[0] == "AND" {
+		var next bool
+		next, rest = evalLicenseTerm(rest[1:], allowed)
+		ok = ok && next
+	}
+	return ok, rest
+}
+
+func evalLicenseTerm(tokens []string, allowed map[string]bool) (bool, []string) {
+	if len(tokens) == 0 {
+		return false, nil
+	}
+	if tokens[0] == "(" {
+		ok, rest := evalLicenseOr(tokens[1:], allowed)
+		if len(rest) == 0 || rest[0] != ")" {
+			return false, nil
+		}
+		return ok, rest[1:]
+	}
+	ok := allowed[tokens[0]] || allowed[strings.TrimSuffix(tokens[0], "+")]
+	rest := tokens[1:]
+	if len(rest) >= 2 && rest[0] == "WITH" {
+		rest = rest[2:]
+	}
+	return ok, rest
+}
+
+// checkConstraints checks a project against its rules. packages are the
+// lockfile's entries, nil when there's no lockfile, so only the manifests
+// are checked
+func checkConstraints(directory string, constraints Constraints, packages map[string]json.RawMessage) ([]ConstraintViolation, error) {
+	manifests, err := projectManifests(directory)
+	if err != nil {
+		return nil, err
+	}
+	rootManifest, err := os.ReadFile(filepath.Join(directory, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	rootCatalogs, err := parseCatalogs(rootManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	violations := checkSameVersion(constraints.SameVersion, manifests, rootCatalogs)
+	violations = append(violations, checkBanned(constraints.Banned, manifests, packages)...)
+	if len(constraints.Licenses) > 0 {
+		violations = append(violations, checkLicenses(constraints.Licenses, constraints.LicenseExceptions, packages)...)
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Rule != violations[j].Rule {
+			return violations[i].Rule < violations[j].Rule
+		}
+		return violations[i].Package < violations[j].Package
+	})
+	return violations, nil
+}
+
+// enforceConstraints fails an install that would break the project's rules,
+// before anything is downloaded
+func enforceConstraints(directory string, packageLock *PackageLock) error {
+	constraints, ok, err := readConstraints(directory)
+	if err != nil || !ok {
+		return err
+	}
+	violations, err := checkConstraints(directory, constraints, packageLock.Packages)
+	if err != nil {
+		return fmt.Errorf("error checking constraints: %v", err)
+	}
+	if len(violations) > 0 {
+		fmt.Print(RenderConstraintViolations(violations))
+		return fmt.Errorf("%d constraint violations, see %s", len(violations), constraintsFileName)
+	}
+	return nil
+}
+
+// CheckConstraints runs caladan constraints, checking the project and its
+// lockfile, when there is one, against its rules
+func CheckConstraints(directory string, opts ConstraintsOptions) error {
+	constraints, ok, err := readConstraints(directory)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s has no %s", directory, constraintsFileName)
+	}
+	var packages map[string]json.RawMessage
+	packageLock, err := readLockFile(filepath.Join(directory, "package-lock.json"))
+	if err == nil {
+		packages = packageLock.Packages
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	violations, err := checkConstraints(directory, constraints, packages)
+	if err != nil {
+		return err
+	}
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(violations); err != nil {
+			return err
+		}
+	} else {
+		fmt.Print(RenderConstraintViolations(violations))
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d constraint violations", len(violations))
+	}
+	return nil
+}
+
+// RenderConstraintViolations lists each violation with where it happens
+func RenderConstraintViolations(violations []ConstraintViolation) string {
+	if len(violations) == 0 {
+		return colorSuccess("Every constraint is met") + "\n"
+	}
+	var builder strings.Builder
+	for _, violation := range violations {
+		builder.WriteString(fmt.Sprintf("%s %s %s\n", colorError(violation.Rule), colorPackage(violation.Package), violation.Message))
+		for _, where := range violation.Where {
+			builder.WriteString(colorDim("  "+where) + "\n")
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckConstraints(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{
+  "name": "root",
+  "workspaces": ["packages/*"],
+  "catalog": {"typescript": "^5.4.0"},
+  "devDependencies": {"typescript": "catalog:"}
+}`)
+	writeTestFile(t, filepath.Join(dir, "packages/app/package.json"), `{"name": "app", "dependencies": {"lib": "workspace:*", "left-pad": "^1.3.0"}, "devDependencies": {"typescript": "~5.3.0"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages/lib/package.json"), `{"name": "lib", "devDependencies": {"typescript": "^5.4.0"}}`)
+	constraints := Constraints{
+		SameVersion:       []string{"typescript", "lib"},
+		Banned:            map[string]string{"left-pad": "use String.prototype.padStart"},
+		Licenses:          []string{"MIT", "Apache-2.0"},
+		LicenseExceptions: []string{"caniuse-lite"},
+	}
+	packages := map[string]json.RawMessage{
+		"":                                 json.RawMessage(`{}`),
+		"node_modules/lib":                 json.RawMessage(`{"resolved": "packages/lib", "link": true}`),
+		"node_modules/left-pad":            json.RawMessage(`{"version": "1.3.0", "license": "WTFPL"}`),
+		"node_modules/typescript":          json.RawMessage(`{"version": "5.4.5", "license": "Apache-2.0"}`),
+		"node_modules/dual":                json.RawMessage(`{"version": "1.0.0", "license": "(MIT OR GPL-3.0-only)"}`),
+		"node_modules/both":                json.RawMessage(`{"version": "1.0.0", "license": "MIT AND GPL-3.0-only"}`),
+		"node_modules/legacy":              json.RawMessage(`{"version": "0.1.0", "license": {"type": "MIT"}}`),
+		"node_modules/caniuse-lite":        json.RawMessage(`{"version": "1.0.0", "license": "CC-BY-4.0"}`),
+		"node_modules/a/node_modules/both": json.RawMessage(`{"version": "1.0.0", "license": "MIT AND GPL-3.0-only"}`),
+	}
+
+	violations, err := checkConstraints(dir, constraints, packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ConstraintViolation{
+		{Rule: ruleBanned, Package: "left-pad", Message: "is banned: use String.prototype.padStart", Where: []string{"node_modules/left-pad", "packages/app (dependencies)"}},
+		{Rule: ruleLicenses, Package: "both@1.0.0", Message: "is licensed MIT AND GPL-3.0-only, which isn't allowed", Where: []string{"node_modules/a/node_modules/both", "node_modules/both"}},
+		{Rule: ruleLicenses, Package: "left-pad@1.3.0", Message: "is licensed WTFPL, which isn't allowed", Where: []string{"node_modules/left-pad"}},
+		{Rule: ruleSameVersion, Package: "typescript", Message: "asked for at different ranges: ^5.4.0 in ., packages/lib; ~5.3.0 in packages/app", Where: []string{".", "packages/app", "packages/lib"}},
+	}
+	if !reflect.DeepEqual(violations, want) {
+		t.Errorf("checkConstraints() =\n%+v\nwant\n%+v", violations, want)
+	}
+
+	// Without a lockfile only the manifests are checked
+	violations, err = checkConstraints(dir, Constraints{Banned: map[string]string{"left-pad": ""}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || !reflect.DeepEqual(violations[0].Where, []string{"packages/app (dependencies)"}) {
+		t.Errorf("violations = %+v, want left-pad in packages/app", violations)
+	}
+}
+
+func TestLicenseAllowed(t *testing.T) {
+	allowed := map[string]bool{"MIT": true, "Apache-2.0": true}
+	for expression, want := range map[string]bool{
+		"MIT":                                  true,
+		"GPL-3.0-only":                         false,
+		"(MIT OR GPL-3.0-only)":                true,
+		"MIT AND Apache-2.0":                   true,
+		"MIT AND (GPL-2.0-only OR Apache-2.0)": true,
+		"MIT AND GPL-2.0-only OR ISC":          false,
+		"Apache-2.0 WITH LLVM-exception":       true,
+		"(MIT":                                 false,
+	} {
+		if got := licenseAllowed(expression, allowed); got != want {
+			t.Errorf("licenseAllowed(%q) = %v, want %v", expression, got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// createPackage returns the package caladan create runs for a starter, by
+// the same convention as npm init: vite is create-vite, @scope is
+// @scope/create, and @scope/app is @scope/create-app. A version or range
+// after the starter carries over, so vite@5 is create-vite@5
+func createPackage(starter string) (string, string, error) {
+	name, versionRange := starter, "latest"
+	// The @ of a scope isn't a version separator
+	if at := strings.LastIndex(starter, "@"); at > 0 {
+		name, versionRange = starter[:at], starter[at+1:]
+	}
+	if name == "" || name == "@" || versionRange == "" {
+		return "", "", fmt.Errorf("invalid starter %q", starter)
+	}
+	if !strings.HasPrefix(name, "@") {
+		return "create-" + name, versionRange, nil
+	}
+	scope, rest, ok := strings.Cut(name, "/")
+	if !ok {
+		return scope + "/create", versionRange, nil
+	}
+	if rest == "" || strings.Contains(rest, "/") {
+		return "", "", fmt.Errorf("invalid starter %q", starter)
+	}
+	return scope + "/create-" + rest, versionRange, nil
+}
+
+// createBin picks the bin to run from a package's bins like npm exec: its
+// only one, or else the one named after the package
+func createBin(name string, bins map[string]string) (string, error) {
+	if len(bins) == 1 {
+		for cmd := range bins {
+			return cmd, nil
+		}
+	}
+	if _, ok := bins[path.Base(name)]; ok {
+		return path.Base(name), nil
+	}
+	return "", fmt.Errorf("%s has no bin to run, or more than one and none named %s", name, path.Base(name))
+}
+
+// Create runs caladan create: it installs a starter's create-* package into
+// a throwaway project and runs its bin in the current directory, passing
+// args through
+func Create(starter string, args []string, opts InstallOptions) error {
+	name, versionRange, err := createPackage(starter)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "caladan-create-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"private":      true,
+		"dependencies": map[string]string{name: versionRange},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), manifest, 0644); err != nil {
+		return err
+	}
+
+	// Like npm exec, a throwaway install isn't worth auditing
+	opts.NoAudit = true
+	opts.NoFund = true
+	fmt.Printf("Installing %s...\n", colorPackage(name+"@"+versionRange))
+	if err := Install(dir, opts); err != nil {
+		return err
+	}
+
+	modulesPath := filepath.Join(dir, "node_modules")
+	bins, err := readPackageJSONBin(filepath.Join(modulesPath, name, "package.json"), name)
+	if err != nil {
+		return fmt.Errorf("%s wasn't installed: %v", name, err)
+	}
+	bin, err := createBin(name, bins)
+	if err != nil {
+		return err
+	}
+
+	binDir := filepath.Join(modulesPath, ".bin")
+	cmd := exec.Command(filepath.Join(binDir, bin), args...)
+	cmd.Env = scriptEnv(npmConfigEnv(opts), binDir)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fmt.Printf("\nRunning %s\n", colorPackage(strings.Join(append([]string{bin}, args...), " ")))
+	return cmd.Run()
+}
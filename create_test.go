@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestCreatePackage(t *testing.T) {
+	for _, tt := range []struct {
+		starter, name, versionRange string
+	}{
+		{"vite", "create-vite", "latest"},
+		{"vite@5", "create-vite", "5"},
+		{"@corp", "@corp/create", "latest"},
+		{"@corp@2.1.0", "@corp/create", "2.1.0"},
+		{"@corp/app", "@corp/create-app", "latest"},
+		{"@corp/app@^1", "@corp/create-app", "^1"},
+	} {
+		name, versionRange, err := createPackage(tt.starter)
+		if err != nil || name != tt.name || versionRange != tt.versionRange {
+			t.Errorf("createPackage(%q) = %q, %q, %v, want %q, %q", tt.starter, name, versionRange, err, tt.name, tt.versionRange)
+		}
+	}
+	for _, starter := range []string{"", "@", "vite@", "@corp/", "@corp/a/b"} {
+		if _, _, err := createPackage(starter); err == nil {
+			t.Errorf("createPackage(%q) = nil error", starter)
+		}
+	}
+}
+
+func TestCreateBin(t *testing.T) {
+	if bin, err := createBin("create-vite", map[string]string{"cva": "index.js"}); err != nil || bin != "cva" {
+		t.Errorf("createBin() with one bin = %q, %v", bin, err)
+	}
+	if bin, err := createBin("@corp/create-app", map[string]string{"create-app": "a.js", "helper": "b.js"}); err != nil || bin != "create-app" {
+		t.Errorf("createBin() = %q, %v, want the bin named after the package", bin, err)
+	}
+	if _, err := createBin("create-x", map[string]string{"a": "a.js", "b": "b.js"}); err == nil {
+		t.Errorf("createBin() with no matching bin = nil error")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// credentialService names caladan's entries in the OS keychain
+const credentialService = "caladan"
+
+// CredentialConfig picks where a registry's token is kept: "keychain" (the
+// macOS Keychain), "libsecret" (the Secret Service on Linux, through
+// secret-tool), or "helper", an executable speaking the credential helper
+// protocol. The default is the keychain on macOS and libsecret elsewhere
+type CredentialConfig struct {
+	Backend string `json:"backend,omitempty"`
+	Helper  string `json:"helper,omitempty"`
+}
+
+// credentialStore keeps registry tokens somewhere other than a plaintext
+// file. get returns "" when there's no token for the registry
+type credentialStore interface {
+	get(registry string) (string, error)
+	store(registry, token string) error
+	erase(registry string) error
+}
+
+// credentialStoreFor returns the backend configured for a registry
+func credentialStoreFor(config Config, registry string) (credentialStore, error) {
+	cfg := config.Credentials[normalizeRegistry(registry)]
+	backend := cfg.Backend
+	if backend == "" && cfg.Helper != "" {
+		backend = "helper"
+	}
+	if backend == "" {
+		backend = "libsecret"
+		if runtime.GOOS == "darwin" {
+			backend = "keychain"
+		}
+	}
+	switch backend {
+	case "keychain":
+		return keychainStore{}, nil
+	case "libsecret":
+		return libsecretStore{}, nil
+	case "helper":
+		if cfg.Helper == "" {
+			return nil, fmt.Errorf("credential helper backend for %s needs a helper executable", registry)
+		}
+		return helperStore{path: cfg.Helper}, nil
+	}
+	return nil, fmt.Errorf("credential backend must be keychain, libsecret, or helper, got %s", backend)
+}
+
+// normalizeRegistry drops a trailing slash so config keys match however the
+// registry URL was written
+func normalizeRegistry(registry string) string {
+	return strings.TrimSuffix(registry, "/")
+}
+
+// registryToken returns the token for a registry: NPM_TOKEN when it's set,
+// so CI keeps working unchanged, otherwise the one in its credential store
+func registryToken(config Config, registry string) (string, error) {
+	if token := os.Getenv("NPM_TOKEN"); token != "" {
+		return token, nil
+	}
+	store, err := credentialStoreFor(config, registry)
+	if err != nil {
+		return "", err
+	}
+	token, err := store.get(normalizeRegistry(registry))
+	if err != nil {
+		return "", fmt.Errorf("error reading the token for %s: %v", registry, err)
+	}
+	if token == "" {
+		return "", fmt.Errorf("no token for %s, set NPM_TOKEN or save one with caladan credentials store", registry)
+	}
+	return token, nil
+}
+
+// runCredentialCommand runs a backend's command, returning its trimmed
+// stdout and folding its stderr into the error
+func runCredentialCommand(cmd *exec.Cmd, stdin string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%s: %v: %s", cmd.Args[0], err, message)
+		}
+		return "", fmt.Errorf("%s: %v", cmd.Args[0], err)
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// keychainStore keeps tokens as generic passwords in the macOS Keychain,
+// one per registry
+type keychainStore struct{}
+
+// keychainNotFound is the exit status of security when there's no such item
+const keychainNotFound = 44
+
+func (keychainStore) get(registry string) (string, error) {
+	cmd := exec.Command("security", "find-generic-password", "-s", credentialService, "-a", registry, "-w")
+	token, err := runCredentialCommand(cmd, "")
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == keychainNotFound {
+		return "", nil
+	}
+	return token, err
+}
+
+func (keychainStore) store(registry, token string) error {
+	// security only takes the password as an argument, where any user could
+	// read it in ps, so the command goes to its interactive mode on stdin
+	// instead. -U updates an existing item rather than failing
+	var stderr bytes.Buffer
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(keychainCommandLine("add-generic-password", "-U", "-s", credentialService, "-a", registry, "-w", token) + "\n")
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	// Interactive mode carries on past a failed command, so a failure may
+	// only show on stderr
+	message := strings.TrimSpace(stderr.String())
+	if err != nil || message != "" {
+		if message == "" {
+			return fmt.Errorf("security: %v", err)
+		}
+		return fmt.Errorf("security: %s", message)
+	}
+	return nil
+}
+
+// keychainCommandLine quotes a command for security's interactive mode
+func keychainCommandLine(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (keychainStore) erase(registry string) error {
+	cmd := exec.Command("security", "delete-generic-password", "-s", credentialService, "-a", registry)
+	_, err := runCredentialCommand(cmd, "")
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == keychainNotFound {
+		return nil
+	}
+	return err
+}
+
+// libsecretStore keeps tokens in the Secret Service (GNOME Keyring, KWallet)
+// through secret-tool, with the token passed on stdin
+type libsecretStore struct{}
+
+func (libsecretStore) get(registry string) (string, error) {
+	cmd := exec.Command("secret-tool", "lookup", "service", credentialService, "registry", registry)
+	token, err := runCredentialCommand(cmd, "")
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 1 && token == "" {
+		// secret-tool exits 1 with no output when nothing matches
+		return "", nil
+	}
+	return token, err
+}
+
+func (libsecretStore) store(registry, token string) error {
+	_, err := runCredentialCommand(exec.Command("secret-tool", "store", "--label", "caladan token for "+registry, "service", credentialService, "registry", registry), token)
+	return err
+}
+
+func (libsecretStore) erase(registry string) error {
+	_, err := runCredentialCommand(exec.Command("secret-tool", "clear", "service", credentialService, "registry", registry), "")
+	return err
+}
+
+// helperStore runs a credential helper as `<helper> get|store|erase`, like
+// git's: it's given key=value lines on stdin, registry= and for store
+// token=, and get prints token=<token>, or nothing when it has none
+type helperStore struct {
+	path string
+}
+
+func (h helperStore) run(action string, fields ...string) (string, error) {
+	return runCredentialCommand(exec.Command(h.path, action), strings.Join(fields, "\n")+"\n")
+}
+
+func (h helperStore) get(registry string) (string, error) {
+	output, err := h.run("get", "registry="+registry)
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if token, ok := strings.CutPrefix(scanner.Text(), "token="); ok {
+			return token, nil
+		}
+	}
+	return "", nil
+}
+
+func (h helperStore) store(registry, token string) error {
+	_, err := h.run("store", "registry="+registry, "token="+token)
+	return err
+}
+
+func (h helperStore) erase(registry string) error {
+	_, err := h.run("erase", "registry="+registry)
+	return err
+}
+
+// StoreCredentials saves a registry's token, read from the first line of
+// stdin, in its credential store
+func StoreCredentials(directory, registry string) error {
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	store, err := credentialStoreFor(config, registry)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, "Token: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	token := strings.TrimSpace(line)
+	if token == "" {
+		if err != nil {
+			return fmt.Errorf("no token given on stdin: %v", err)
+		}
+		return fmt.Errorf("no token given on stdin")
+	}
+	if err := store.store(normalizeRegistry(registry), token); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Saved the token for %s\n", registry)
+	return nil
+}
+
+// EraseCredentials removes a registry's token from its credential store
+func EraseCredentials(directory, registry string) error {
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	store, err := credentialStoreFor(config, registry)
+	if err != nil {
+		return err
+	}
+	if err := store.erase(normalizeRegistry(registry)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Removed the token for %s\n", registry)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCredentialHelper(t *testing.T) {
+	dir := t.TempDir()
+	helper := filepath.Join(dir, "helper")
+	// Keeps the token in a file and logs every call
+	writeTestFile(t, helper, `#!/bin/sh
+input=$(cat)
+echo "$1 $input" | tr '\n' ' ' >> "`+dir+`/log"
+echo >> "`+dir+`/log"
+case "$1" in
+  get) if [ -f "`+dir+`/token" ]; then echo "token=$(cat "`+dir+`/token")"; fi ;;
+  store) echo "$input" | sed -n 's/^token=//p' > "`+dir+`/token" ;;
+  erase) rm -f "`+dir+`/token" ;;
+esac
+`)
+	if err := os.Chmod(helper, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NPM_TOKEN", "")
+
+	config := Config{Credentials: map[string]CredentialConfig{"https://npm.corp.example": {Helper: helper}}}
+	store, err := credentialStoreFor(config, "https://npm.corp.example/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registryToken(config, "https://npm.corp.example/"); err == nil || !strings.Contains(err.Error(), "no token") {
+		t.Errorf("registryToken() with nothing stored = %v", err)
+	}
+	if err := store.store("https://npm.corp.example", "npm_secret"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := registryToken(config, "https://npm.corp.example/"); err != nil || token != "npm_secret" {
+		t.Errorf("registryToken() = %q, %v", token, err)
+	}
+
+	t.Setenv("NPM_TOKEN", "from-env")
+	if token, _ := registryToken(config, "https://npm.corp.example"); token != "from-env" {
+		t.Errorf("NPM_TOKEN didn't take precedence, got %q", token)
+	}
+
+	if err := store.erase("https://npm.corp.example"); err != nil {
+		t.Fatal(err)
+	}
+	log, _ := os.ReadFile(filepath.Join(dir, "log"))
+	want := "get registry=https://npm.corp.example \n" +
+		"store registry=https://npm.corp.example token=npm_secret \n" +
+		"get registry=https://npm.corp.example \n" +
+		"erase registry=https://npm.corp.example \n"
+	if string(log) != want {
+		t.Errorf("helper calls:\n%s\nwant:\n%s", log, want)
+	}
+
+	if _, err := credentialStoreFor(Config{Credentials: map[string]CredentialConfig{"https://npm.corp.example": {Backend: "vault"}}}, "https://npm.corp.example"); err == nil {
+		t.Errorf("credentialStoreFor() accepted an unknown backend")
+	}
+}
+
+func TestKeychainStoreKeepsTokenOutOfArgs(t *testing.T) {
+	dir := t.TempDir()
+	// Logs its arguments and stdin
+	writeTestFile(t, filepath.Join(dir, "security"), `#!/bin/sh
+echo "args: $*" > "`+dir+`/log"
+cat >> "`+dir+`/log"
+`)
+	if err := os.Chmod(filepath.Join(dir, "security"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if err := (keychainStore{}).store("https://npm.corp.example", `npm_se"cret`); err != nil {
+		t.Fatal(err)
+	}
+	log := readTestFile(t, filepath.Join(dir, "log"))
+	want := "args: -i\n" + `"add-generic-password" "-U" "-s" "` + credentialService + `" "-a" "https://npm.corp.example" "-w" "npm_se\"cret"` + "\n"
+	if log != want {
+		t.Errorf("security got:\n%s\nwant:\n%s", log, want)
+	}
+}
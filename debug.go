@@ -5,7 +5,32 @@ import (
 	"strings"
 )
 
+// RenderDepTree draws the dependency tree. Packages that appear at more than
+// one version, which can't all be hoisted, have their versions highlighted
 func RenderDepTree(deps []PackageInfo) string {
+	versions := make(map[string]map[string]bool)
+	collectTreeVersions(deps, versions)
+	conflicts := make(map[string]bool)
+	for name, seen := range versions {
+		conflicts[name] = len(seen) > 1
+	}
+	return renderDepTree(deps, conflicts)
+}
+
+// collectTreeVersions records every version of each package in the tree
+func collectTreeVersions(deps []PackageInfo, versions map[string]map[string]bool) {
+	for _, dep := range deps {
+		if versions[dep.Name] == nil {
+			versions[dep.Name] = make(map[string]bool)
+		}
+		versions[dep.Name][dep.Version] = true
+		for _, child := range dep.ResolvedDeps {
+			collectTreeVersions([]PackageInfo{child}, versions)
+		}
+	}
+}
+
+func renderDepTree(deps []PackageInfo, conflicts map[string]bool) string {
 	var builder strings.Builder
 
 	for i, dep := range deps {
@@ -17,7 +42,11 @@ func RenderDepTree(deps []PackageInfo) string {
 		}
 
 		// Add package name and version
-		builder.WriteString(fmt.Sprintf("%s@%s\n", dep.Name, dep.Version))
+		version := colorDim(dep.Version)
+		if conflicts[dep.Name] {
+			version = colorWarn(dep.Version)
+		}
+		builder.WriteString(fmt.Sprintf("%s@%s\n", colorPackage(dep.Name), version))
 
 		// Recursively render dependencies with proper indentation
 		if len(dep.ResolvedDeps) > 0 {
@@ -33,7 +62,7 @@ func RenderDepTree(deps []PackageInfo) string {
 			}
 
 			// Recursively render child dependencies
-			childTree := RenderDepTree(childDeps)
+			childTree := renderDepTree(childDeps, conflicts)
 			for _, line := range strings.Split(childTree, "\n") {
 				if line != "" {
 					builder.WriteString(prefix + line + "\n")
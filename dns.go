@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultDNSTTL is how long resolved addresses are cached when the config
+// doesn't say
+const defaultDNSTTL = 60 * time.Second
+
+// DNSConfig configures how registry hostnames are resolved. Servers are
+// plain DNS servers (host:port, port 53 by default) used instead of the
+// system's, DoH is a DNS-over-HTTPS endpoint speaking the JSON API
+// (application/dns-json), and TTL is how many seconds answers are cached
+type DNSConfig struct {
+	Servers []string `json:"servers,omitempty"`
+	DoH     string   `json:"doh,omitempty"`
+	TTL     int      `json:"ttl,omitempty"`
+}
+
+// dnsEntry is a cached answer
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache resolves hostnames at most once per TTL, so the thousands of
+// connections a large install opens to the registry don't each wait on DNS.
+// When a lookup fails an expired answer is used rather than failing the
+// request, which rides out flaky DNS servers
+type dnsCache struct {
+	lookup func(ctx context.Context, host string) ([]string, error)
+	ttl    time.Duration
+	now    func() time.Time
+
+	lock     sync.Mutex
+	entries  map[string]dnsEntry
+	inflight singleflight.Group
+}
+
+// newDNSCache returns a cache in front of the system resolver, the
+// configured DNS servers, or the DoH endpoint
+func newDNSCache(config DNSConfig) (*dnsCache, error) {
+	if config.TTL < 0 {
+		return nil, fmt.Errorf("dns ttl must be positive, got %d", config.TTL)
+	}
+	if len(config.Servers) > 0 && config.DoH != "" {
+		return nil, fmt.Errorf("dns servers and doh can't both be set")
+	}
+	cache := &dnsCache{ttl: defaultDNSTTL, now: time.Now, entries: make(map[string]dnsEntry)}
+	if config.TTL > 0 {
+		cache.ttl = time.Duration(config.TTL) * time.Second
+	}
+
+	switch {
+	case config.DoH != "":
+		endpoint, err := url.Parse(config.DoH)
+		if err != nil || endpoint.Scheme != "https" && endpoint.Scheme != "http" {
+			return nil, fmt.Errorf("invalid doh endpoint %q", config.DoH)
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		cache.lookup = func(ctx context.Context, host string) ([]string, error) {
+			return dohLookup(ctx, client, config.DoH, host)
+		}
+	case len(config.Servers) > 0:
+		servers := make([]string, len(config.Servers))
+		for i, server := range config.Servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			servers[i] = server
+		}
+		resolver := &net.Resolver{
+			PreferGo: true,
+			// Each query goes to the servers in turn until one answers
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				var lastErr error
+				for _, server := range servers {
+					conn, err := dialer.DialContext(ctx, network, server)
+					if err == nil {
+						return conn, nil
+					}
+					lastErr = err
+				}
+				return nil, lastErr
+			},
+		}
+		cache.lookup = resolver.LookupHost
+	default:
+		cache.lookup = net.DefaultResolver.LookupHost
+	}
+	return cache, nil
+}
+
+// resolve returns a host's addresses, from the cache while they're fresh
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	c.lock.Lock()
+	entry, ok := c.entries[host]
+	c.lock.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	result, err, _ := c.inflight.Do(host, func() (interface{}, error) {
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		c.lock.Lock()
+		c.entries[host] = dnsEntry{addrs: addrs, expires: c.now().Add(c.ttl)}
+		c.lock.Unlock()
+		return addrs, nil
+	})
+	if err != nil {
+		if ok {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	return result.([]string), nil
+}
+
+// dialContext dials an address, resolving its host through the cache and
+// trying each of its addresses until one connects
+func (c *dnsCache) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := c.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dohLookup resolves a host's A and AAAA records with a DNS-over-HTTPS JSON
+// query, IPv4 addresses first
+func dohLookup(ctx context.Context, client *http.Client, endpoint, host string) ([]string, error) {
+	addrs := []string{}
+	for _, recordType := range []string{"A", "AAAA"} {
+		query := url.Values{"name": {host}, "type": {recordType}}
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/dns-json")
+		data, err := doRequest(client, req)
+		if err != nil {
+			return nil, err
+		}
+		var answer struct {
+			Status int `json:"Status"`
+			Answer []struct {
+				Type int    `json:"type"`
+				Data string `json:"data"`
+			} `json:"Answer"`
+		}
+		if err := json.Unmarshal(data, &answer); err != nil {
+			return nil, fmt.Errorf("error parsing DoH answer for %s: %v", host, err)
+		}
+		for _, record := range answer.Answer {
+			// Answers can include the CNAMEs that led to the address
+			if (record.Type == 1 || record.Type == 28) && net.ParseIP(record.Data) != nil {
+				addrs = append(addrs, record.Data)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// registryTransport is the transport registry requests share, dialing
+// through the DNS cache
+func registryTransport(dns *dnsCache) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dns.dialContext
+	return transport
+}
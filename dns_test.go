@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	lookups := 0
+	failing := false
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	cache, err := newDNSCache(DNSConfig{TTL: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.now = func() time.Time { return now }
+	cache.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		if failing {
+			return nil, errors.New("server misbehaving")
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if addrs, err := cache.resolve(ctx, "registry.test"); err != nil || !reflect.DeepEqual(addrs, []string{"127.0.0.1"}) {
+			t.Fatalf("resolve() = %v, %v", addrs, err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("looked up %d times within the TTL, want 1", lookups)
+	}
+
+	// Expired, and DNS is down: the stale answer is better than nothing
+	now = now.Add(301 * time.Second)
+	failing = true
+	if addrs, err := cache.resolve(ctx, "registry.test"); err != nil || len(addrs) != 1 {
+		t.Errorf("resolve() with DNS down = %v, %v", addrs, err)
+	}
+	if _, err := cache.resolve(ctx, "other.test"); err == nil {
+		t.Errorf("resolve() of a never-resolved host succeeded with DNS down")
+	}
+
+	// Connections to the host go through the cache
+	failing = false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: registryTransport(cache)}
+	resp, err := client.Get("http://registry.test:" + serverURL.Port() + "/is-odd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("got %q through the cache", body)
+	}
+}
+
+func TestDoHLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/dns-json" || r.URL.Query().Get("name") != "registry.npmjs.org" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("type") == "A" {
+			w.Write([]byte(`{"Status": 0, "Answer": [{"name": "registry.npmjs.org", "type": 5, "data": "registry.npmjs.org.cdn."}, {"name": "registry.npmjs.org.cdn", "type": 1, "TTL": 300, "data": "104.16.1.35"}]}`))
+			return
+		}
+		w.Write([]byte(`{"Status": 0, "Answer": [{"type": 28, "data": "2606:4700::6810:123"}]}`))
+	}))
+	defer server.Close()
+
+	cache, err := newDNSCache(DNSConfig{DoH: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := cache.resolve(context.Background(), "registry.npmjs.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"104.16.1.35", "2606:4700::6810:123"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("resolve() = %v, want %v", addrs, want)
+	}
+
+	if _, err := newDNSCache(DNSConfig{DoH: server.URL, Servers: []string{"10.0.0.2"}}); err == nil {
+		t.Errorf("newDNSCache() accepted both servers and doh")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// How much of an install is flushed to disk before it replaces node_modules.
+// Without syncing, a power loss shortly after an install can leave files
+// empty or missing even though the install reported success
+const (
+	durabilityNone = "none" // Leave flushing to the OS
+	durabilityDir  = "dir"  // Sync directory entries, so every file exists
+	durabilityFull = "full" // Also sync file contents
+)
+
+// syncConcurrency is how many files are synced at once. fsync mostly waits
+// on the disk, so this is well above the number of cores
+const syncConcurrency = 32
+
+// validDurability reports whether durability is a known durability mode
+func validDurability(durability string) bool {
+	switch durability {
+	case durabilityNone, durabilityDir, durabilityFull:
+		return true
+	}
+	return false
+}
+
+// syncTree flushes the directories under root, and with full durability the
+// files too. Symlinks are skipped since syncing their directory covers them
+func syncTree(root, durability string) error {
+	if durability != durabilityDir && durability != durabilityFull {
+		return nil
+	}
+
+	g := &errgroup.Group{}
+	g.SetLimit(syncConcurrency)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || (durability == durabilityFull && d.Type().IsRegular()) {
+			g.Go(func() error {
+				return syncPath(path)
+			})
+		}
+		return nil
+	})
+	if waitErr := g.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// syncPath flushes a file, or a directory's entries, to disk
+func syncPath(path string) error {
+	// Windows can't sync directories, their entries are flushed with the files
+	if runtime.GOOS == "windows" {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncTree(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "pkg", "lib", "index.js"), "module.exports = 1")
+	if err := os.Symlink("lib/index.js", filepath.Join(root, "pkg", "main.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, durability := range []string{durabilityNone, durabilityDir, durabilityFull} {
+		if err := syncTree(root, durability); err != nil {
+			t.Errorf("syncTree(%s) error = %v", durability, err)
+		}
+	}
+
+	if err := syncTree(filepath.Join(root, "missing"), durabilityDir); err == nil {
+		t.Error("syncTree() of a missing directory succeeded")
+	}
+}
+
+func TestInstallTransactionCommitDurable(t *testing.T) {
+	workDir := t.TempDir()
+
+	tx, err := beginInstall(filepath.Join(workDir, "node_modules"), filepath.Join(workDir, stateDirName), durabilityFull)
+	if err != nil {
+		t.Fatalf("beginInstall() error = %v", err)
+	}
+	writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+
+	if err := tx.commit(); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(workDir, "node_modules", "new", "index.js")); got != "new" {
+		t.Errorf("new install isn't in node_modules")
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for the network access of install scripts
+const (
+	scriptNetworkAllow = "allow" // Connect anywhere the deny list doesn't match
+	scriptNetworkDeny  = "deny"  // Connect only where the allow list matches
+	scriptNetworkLog   = "log"   // Like allow, and print every host connected to
+)
+
+// ScriptNetworkConfig is the egress policy for lifecycle scripts. Allow and
+// Deny are hosts, where "*.example.com" also matches subdomains. Deny wins
+// over Allow under every policy
+type ScriptNetworkConfig struct {
+	Policy string   `json:"policy,omitempty"`
+	Allow  []string `json:"allow,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+}
+
+// validScriptNetworkPolicy reports whether policy is allow, deny, or log
+func validScriptNetworkPolicy(policy string) bool {
+	return policy == scriptNetworkAllow || policy == scriptNetworkDeny || policy == scriptNetworkLog
+}
+
+// hostMatches reports whether a host, without its port, matches a pattern
+func hostMatches(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	return host == pattern
+}
+
+// allows reports whether scripts may connect to host
+func (c ScriptNetworkConfig) allows(host string) bool {
+	for _, pattern := range c.Deny {
+		if hostMatches(pattern, host) {
+			return false
+		}
+	}
+	if c.Policy != scriptNetworkDeny {
+		return true
+	}
+	for _, pattern := range c.Allow {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScriptConnection is a host the scripts of a package connected to, or
+// were stopped from connecting to
+type ScriptConnection struct {
+	Package  string `json:"package"` // Lockfile path, or "the project" for its prepare scripts
+	Host     string `json:"host"`    // host:port
+	Allowed  bool   `json:"allowed"`
+	Requests int    `json:"requests"`
+}
+
+// egressProxy is the HTTP proxy install scripts are pointed at with the
+// proxy variables, which applies the policy and records each connection.
+// Scripts identify themselves with the user in their proxy URL. It's not a
+// sandbox: a script that ignores the proxy variables isn't stopped
+type egressProxy struct {
+	config   ScriptNetworkConfig
+	listener net.Listener
+	server   *http.Server
+	// Where connections go from here, through the proxy caladan itself
+	// uses when there is one
+	upstream  func(*http.Request) (*url.URL, error)
+	transport *http.Transport
+
+	mu          sync.Mutex
+	owners      []string // The packages scripts run for, by the ID in their proxy URL
+	connections map[[2]string]*ScriptConnection
+}
+
+// startEgressProxy starts a proxy for the policy on a loopback port
+func startEgressProxy(config ScriptNetworkConfig) (*egressProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error starting the script network proxy: %v", err)
+	}
+	p := &egressProxy{
+		config:      config,
+		listener:    listener,
+		upstream:    http.ProxyFromEnvironment,
+		connections: make(map[[2]string]*ScriptConnection),
+	}
+	p.transport = &http.Transport{Proxy: p.upstream}
+	p.server = &http.Server{Handler: p, ReadHeaderTimeout: 30 * time.Second}
+	go p.server.Serve(listener)
+	return p, nil
+}
+
+// env adds the variables that send a package's scripts through the proxy
+// to configEnv. A nil proxy leaves configEnv as it is
+func (p *egressProxy) env(configEnv map[string]string, pkg string) map[string]string {
+	if p == nil {
+		return configEnv
+	}
+	p.mu.Lock()
+	id := len(p.owners)
+	p.owners = append(p.owners, pkg)
+	p.mu.Unlock()
+
+	proxyURL := fmt.Sprintf("http://script%d@%s", id, p.listener.Addr())
+	env := make(map[string]string, len(configEnv)+12)
+	for key, value := range configEnv {
+		env[key] = value
+	}
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "http_proxy", "https_proxy", "all_proxy",
+		"npm_config_proxy", "npm_config_https_proxy", "GLOBAL_AGENT_HTTP_PROXY"} {
+		env[name] = proxyURL
+	}
+	// Nothing bypasses the proxy, and node 24 and later use it for fetch
+	// and https without an agent
+	for _, name := range []string{"NO_PROXY", "no_proxy", "npm_config_noproxy"} {
+		env[name] = ""
+	}
+	env["NODE_USE_ENV_PROXY"] = "1"
+	return env
+}
+
+// owner returns the package behind a request, from its proxy credentials
+func (p *egressProxy) owner(r *http.Request) string {
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "an unknown script"
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "an unknown script"
+	}
+	user, _, _ := strings.Cut(string(decoded), ":")
+	id, err := strconv.Atoi(strings.TrimPrefix(user, "script"))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil || id < 0 || id >= len(p.owners) {
+		return "an unknown script"
+	}
+	return p.owners[id]
+}
+
+// check applies the policy to a connection and records it, printing the
+// first connection of a package to a host when it's denied or logged
+func (p *egressProxy) check(r *http.Request, hostport string) bool {
+	pkg := p.owner(r)
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	allowed := p.config.allows(host)
+
+	p.mu.Lock()
+	key := [2]string{pkg, hostport}
+	connection, seen := p.connections[key]
+	if !seen {
+		connection = &ScriptConnection{Package: pkg, Host: hostport, Allowed: allowed}
+		p.connections[key] = connection
+	}
+	connection.Requests++
+	p.mu.Unlock()
+
+	if !seen && !allowed {
+		printWarning("Script network: denied %s connecting to %s", pkg, hostport)
+	} else if !seen && p.config.Policy == scriptNetworkLog {
+		fmt.Println(colorDim(fmt.Sprintf("Script network: %s connected to %s", pkg, hostport)))
+	}
+	return allowed
+}
+
+// ServeHTTP tunnels CONNECT requests and forwards plain HTTP ones
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "caladan's script network proxy only forwards requests", http.StatusBadRequest)
+		return
+	}
+	hostport := r.URL.Host
+	if r.URL.Port() == "" {
+		hostport = net.JoinHostPort(r.URL.Hostname(), "80")
+	}
+	if !p.check(r, hostport) {
+		http.Error(w, "caladan's script network policy denies "+r.URL.Hostname(), http.StatusForbidden)
+		return
+	}
+
+	outgoing := r.Clone(r.Context())
+	outgoing.RequestURI = ""
+	outgoing.Header.Del("Proxy-Authorization")
+	outgoing.Header.Del("Proxy-Connection")
+	resp, err := p.transport.RoundTrip(outgoing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects a CONNECT request to its host and copies bytes both ways
+func (p *egressProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	if !p.check(r, r.Host) {
+		http.Error(w, "caladan's script network policy denies "+r.Host, http.StatusForbidden)
+		return
+	}
+	upstream, err := p.dial(r.Context(), r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "can't tunnel this connection", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// Whatever the client sent after the CONNECT is already buffered
+		io.Copy(upstream, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+}
+
+// dial opens a connection to hostport, tunneled through the upstream proxy
+// when there is one
+func (p *egressProxy) dial(ctx context.Context, hostport string) (net.Conn, error) {
+	var dialer net.Dialer
+	proxyURL, err := p.upstream(&http.Request{URL: &url.URL{Scheme: "https", Host: hostport}})
+	if err != nil || proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", hostport)
+	}
+	proxyHost := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyHost = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyHost)
+	if err != nil {
+		return nil, err
+	}
+	connect := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: hostport}, Host: hostport, Header: make(http.Header)}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		connect.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username()+":"+password)))
+	}
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyURL.Host, hostport, resp.Status)
+	}
+	return conn, nil
+}
+
+// close stops the proxy and returns the connections scripts made, by
+// package and host
+func (p *egressProxy) close() []ScriptConnection {
+	if p == nil {
+		return nil
+	}
+	p.server.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	connections := make([]ScriptConnection, 0, len(p.connections))
+	for _, connection := range p.connections {
+		connections = append(connections, *connection)
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		if connections[i].Package != connections[j].Package {
+			return connections[i].Package < connections[j].Package
+		}
+		return connections[i].Host < connections[j].Host
+	})
+	return connections
+}
+
+// RenderScriptNetwork lists the hosts install scripts connected to
+func RenderScriptNetwork(connections []ScriptConnection) string {
+	if len(connections) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteString("Install scripts connected to:\n")
+	for _, connection := range connections {
+		host := connection.Host
+		if !connection.Allowed {
+			host = colorError(host + " (denied)")
+		}
+		builder.WriteString(fmt.Sprintf("  %s %s %s\n", colorPackage(connection.Package), host, colorDim(fmt.Sprintf("(%d requests)", connection.Requests))))
+	}
+	return builder.String()
+}
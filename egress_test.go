@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestScriptNetworkAllows(t *testing.T) {
+	tests := []struct {
+		config ScriptNetworkConfig
+		host   string
+		want   bool
+	}{
+		{ScriptNetworkConfig{Policy: scriptNetworkAllow}, "github.com", true},
+		{ScriptNetworkConfig{Policy: scriptNetworkAllow, Deny: []string{"*.evil.test"}}, "cdn.evil.test", false},
+		{ScriptNetworkConfig{Policy: scriptNetworkAllow, Deny: []string{"*.evil.test"}}, "evil.test", false},
+		{ScriptNetworkConfig{Policy: scriptNetworkAllow, Deny: []string{"*.evil.test"}}, "notevil.test", true},
+		{ScriptNetworkConfig{Policy: scriptNetworkLog}, "github.com", true},
+		{ScriptNetworkConfig{Policy: scriptNetworkDeny}, "github.com", false},
+		{ScriptNetworkConfig{Policy: scriptNetworkDeny, Allow: []string{"GitHub.com"}}, "github.com", true},
+		{ScriptNetworkConfig{Policy: scriptNetworkDeny, Allow: []string{"github.com"}}, "objects.github.com", false},
+		// Deny wins over allow
+		{ScriptNetworkConfig{Policy: scriptNetworkDeny, Allow: []string{"*.github.com"}, Deny: []string{"gist.github.com"}}, "gist.github.com", false},
+	}
+	for _, tt := range tests {
+		if got := tt.config.allows(tt.host); got != tt.want {
+			t.Errorf("%+v allows(%s) = %v, want %v", tt.config, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestEgressProxy(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "plain")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	defer secure.Close()
+
+	proxy, err := startEgressProxy(ScriptNetworkConfig{Policy: scriptNetworkDeny, Allow: []string{"127.0.0.1"}, Deny: []string{"localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.upstream = func(*http.Request) (*url.URL, error) { return nil, nil }
+	proxy.transport.Proxy = nil
+
+	env := proxy.env(map[string]string{"npm_config_registry": "r"}, "node_modules/esbuild")
+	if env["npm_config_registry"] != "r" || env["NO_PROXY"] != "" || env["HTTPS_PROXY"] != env["HTTP_PROXY"] {
+		t.Fatalf("env = %v", env)
+	}
+	proxyURL, err := url.Parse(env["HTTPS_PROXY"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	get := func(target string) (int, string) {
+		resp, err := client.Get(target)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get(plain.URL); status != http.StatusOK || body != "plain" {
+		t.Errorf("plain HTTP = %d %q", status, body)
+	}
+	if status, body := get(secure.URL); status != http.StatusOK || body != "secure" {
+		t.Errorf("HTTPS through CONNECT = %d %q", status, body)
+	}
+	secureURL, _ := url.Parse(secure.URL)
+	if status, _ := get("http://localhost:" + secureURL.Port()); status != http.StatusForbidden {
+		t.Errorf("denied host = %d, want 403", status)
+	}
+
+	connections := proxy.close()
+	if len(connections) != 3 {
+		t.Fatalf("connections = %+v", connections)
+	}
+	for _, connection := range connections {
+		if connection.Package != "node_modules/esbuild" {
+			t.Errorf("connection %+v isn't attributed to esbuild", connection)
+		}
+		if connection.Allowed != (connection.Host != "localhost:"+secureURL.Port()) {
+			t.Errorf("connection %+v", connection)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Errors that callers can tell apart with errors.As. They're returned wrapped
+// in context, so compare with errors.As rather than a type assertion
+
+// IntegrityError reports a tarball whose hash doesn't match its integrity
+type IntegrityError struct {
+	URL      string
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for %s: expected %s, got %s", e.URL, e.Expected, e.Actual)
+}
+
+// RegistryError reports a registry request that got an unexpected status,
+// after any retries
+type RegistryError struct {
+	URL        string
+	StatusCode int
+	Status     string // e.g. "404 Not Found"
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("registry returned %s for %s", e.Status, e.URL)
+}
+
+// ResolutionError reports a range or dist tag that no published version of
+// a package satisfies
+type ResolutionError struct {
+	Name       string
+	Range      string
+	Candidates []string // The versions that were considered
+	Err        error    // Why the range didn't match, if there's more to say
+}
+
+func (e *ResolutionError) Error() string {
+	return fmt.Sprintf("no version of %s matches '%s' (%d versions published)", e.Name, e.Range, len(e.Candidates))
+}
+
+func (e *ResolutionError) Unwrap() error {
+	return e.Err
+}
+
+// ScriptError reports a lifecycle script that failed
+type ScriptError struct {
+	Package  string
+	Event    string // e.g. "postinstall"
+	Script   string
+	ExitCode int           // -1 when the script didn't exit normally
+	Timeout  time.Duration // Nonzero when the script was killed for running this long
+	LogPath  string        // Where the script's output was saved, empty when it wasn't
+	Err      error
+}
+
+func (e *ScriptError) Error() string {
+	msg := fmt.Sprintf("%s script failed with exit code %d", e.Event, e.ExitCode)
+	if e.Timeout > 0 {
+		msg = fmt.Sprintf("%s script timed out after %s and was killed", e.Event, e.Timeout)
+	}
+	if e.LogPath != "" {
+		msg += ", see " + e.LogPath
+	}
+	return msg
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// failuresError is returned by an install that carried on past failed
+// packages. It unwraps to each package's error
+type failuresError struct {
+	failures []PackageFailure
+}
+
+func (e *failuresError) Error() string {
+	return fmt.Sprintf("%d packages failed to install", len(e.failures))
+}
+
+func (e *failuresError) Unwrap() []error {
+	errs := make([]error, 0, len(e.failures))
+	for _, failure := range e.failures {
+		if failure.err != nil {
+			errs = append(errs, failure.err)
+		}
+	}
+	return errs
+}
+
+// LockfileError reports a lockfile that doesn't hold together, listing every
+// problem found so they can be fixed in one go
+type LockfileError struct {
+	Path     string
+	Problems []LockfileProblem
+}
+
+// LockfileProblem is one problem in a lockfile. Field is where it is, like
+// packages["node_modules/ms"].integrity
+type LockfileProblem struct {
+	Line    int
+	Field   string
+	Message string
+}
+
+func (e *LockfileError) Error() string {
+	msg := fmt.Sprintf("%s has %d problems:", e.Path, len(e.Problems))
+	if len(e.Problems) == 1 {
+		msg = fmt.Sprintf("%s has a problem:", e.Path)
+	}
+	for _, problem := range e.Problems {
+		msg += fmt.Sprintf("\n  line %d: %s: %s", problem.Line, problem.Field, problem.Message)
+	}
+	return msg
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Strategies that pick a version from the candidates
+const (
+	strategyHighest       = "highest satisfying version"
+	strategyNotDeprecated = "newest satisfying version that isn't deprecated"
+	strategyDistTag       = "dist-tag"
+	strategyOverride      = "override"
+)
+
+// Requirement is a range a dependent asks for a package at, and what the
+// registry offers for it
+type Requirement struct {
+	From       string   `json:"from"` // Lockfile path of the dependent, "" for the project
+	Type       string   `json:"type"` // dependencies, devDependencies, optionalDependencies, or peerDependencies
+	Range      string   `json:"range"`
+	DistTag    string   `json:"distTag,omitempty"`    // Set when the range is a dist-tag, like latest
+	Candidates []string `json:"candidates,omitempty"` // Versions satisfying the range, oldest first
+	Picked     string   `json:"picked,omitempty"`     // What the strategy picks from them today
+}
+
+// Explanation is why one lockfile entry of a package has its version
+type Explanation struct {
+	Path         string              `json:"path"`
+	Version      string              `json:"version"`
+	Requirements []Requirement       `json:"requirements"`
+	Strategy     string              `json:"strategy"`
+	Override     string              `json:"override,omitempty"` // The project's override for the package
+	Annotation   *LockfileAnnotation `json:"annotation,omitempty"`
+	// Set when the registry couldn't be asked, so there are no candidates
+	MetadataError string `json:"metadataError,omitempty"`
+}
+
+// ExplainOptions configures caladan explain
+type ExplainOptions struct {
+	JSON bool
+
+	// Where the JSON goes, stdout is moved to stderr so it stays parseable
+	jsonOutput io.Writer
+}
+
+// dependencyTypes are the fields of a lockfile entry that request packages
+var dependencyTypes = []string{"dependencies", "devDependencies", "optionalDependencies", "peerDependencies"}
+
+// lockfileRequirements returns the ranges every entry asks for name at,
+// keeping the ones that resolve to path through node's module resolution
+func lockfileRequirements(packages map[string]json.RawMessage, name, path string) ([]Requirement, error) {
+	requirements := []Requirement{}
+	for from, raw := range packages {
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("error parsing lockfile entry %s: %v", from, err)
+		}
+		for _, depType := range dependencyTypes {
+			var deps map[string]string
+			if err := json.Unmarshal(entry[depType], &deps); err != nil || deps[name] == "" {
+				continue
+			}
+			if resolved, ok := findLockfileDependency(packages, from, name); ok && resolved == path {
+				requirements = append(requirements, Requirement{From: from, Type: depType, Range: deps[name]})
+			}
+		}
+	}
+	sort.Slice(requirements, func(i, j int) bool {
+		if requirements[i].From != requirements[j].From {
+			return requirements[i].From < requirements[j].From
+		}
+		return requirements[i].Type < requirements[j].Type
+	})
+	return requirements, nil
+}
+
+// projectOverride returns the range the project's overrides force a package
+// to, like npm's overrides field: "pkg": "1.2.3" or "pkg": {".": "1.2.3"}
+func projectOverride(directory, name string) string {
+	data, err := os.ReadFile(filepath.Join(directory, "package.json"))
+	if err != nil {
+		return ""
+	}
+	var packageJSON struct {
+		Overrides map[string]interface{} `json:"overrides"`
+	}
+	if err := json.Unmarshal(data, &packageJSON); err != nil {
+		return ""
+	}
+	switch override := packageJSON.Overrides[name].(type) {
+	case string:
+		return override
+	case map[string]interface{}:
+		if self, ok := override["."].(string); ok {
+			return self
+		}
+	}
+	return ""
+}
+
+// explainChoice fills in what the registry offers each requirement and
+// which version the strategy picks. match lists the versions satisfying a
+// range, oldest first
+func explainChoice(explanation *Explanation, metadata *PackageMetadata, avoidDeprecated bool, match func(versionRange string, versions []string) ([]string, error)) {
+	versions := make([]string, 0, len(metadata.Versions))
+	for version := range metadata.Versions {
+		versions = append(versions, version)
+	}
+	for i := range explanation.Requirements {
+		requirement := &explanation.Requirements[i]
+		versionRange := requirement.Range
+		if tagged, ok := metadata.DistTags[versionRange]; ok {
+			requirement.DistTag = versionRange
+			versionRange = tagged
+		}
+		candidates, err := match(versionRange, versions)
+		if err != nil {
+			continue
+		}
+		requirement.Candidates = candidates
+		if len(candidates) == 0 {
+			continue
+		}
+		requirement.Picked = candidates[len(candidates)-1]
+		if avoidDeprecated {
+			requirement.Picked = newestNotDeprecated(candidates, metadata)
+		}
+	}
+}
+
+// explanationStrategy names how a version was picked
+func explanationStrategy(explanation Explanation, avoidDeprecated bool) string {
+	if explanation.Override != "" {
+		return strategyOverride
+	}
+	for _, requirement := range explanation.Requirements {
+		if requirement.DistTag != "" {
+			return strategyDistTag
+		}
+	}
+	if avoidDeprecated {
+		return strategyNotDeprecated
+	}
+	return strategyHighest
+}
+
+// explainPackage explains every lockfile entry of a package
+func explainPackage(directory string, packageLock *PackageLock, name string, fetch func(name string) (*PackageMetadata, error), match func(string, []string) ([]string, error)) ([]Explanation, error) {
+	config, err := loadConfig(directory)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := readAnnotations(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for path := range packageLock.Packages {
+		if path != "" && packageNameFromPath(path) == name {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s isn't in the lockfile", name)
+	}
+	sort.Strings(paths)
+
+	metadata, metadataErr := fetch(name)
+	override := projectOverride(directory, name)
+	explanations := []Explanation{}
+	for _, path := range paths {
+		requirements, err := lockfileRequirements(packageLock.Packages, name, path)
+		if err != nil {
+			return nil, err
+		}
+		explanation := Explanation{
+			Path:         path,
+			Version:      lockfileEntryVersion(packageLock.Packages[path]),
+			Requirements: requirements,
+			Override:     override,
+		}
+		if annotation, ok := annotations.Packages[path]; ok && annotation.NewVersion == explanation.Version {
+			explanation.Annotation = &annotation
+		}
+		if metadataErr != nil {
+			explanation.MetadataError = metadataErr.Error()
+		} else {
+			explainChoice(&explanation, metadata, config.NoDeprecated, match)
+		}
+		explanation.Strategy = explanationStrategy(explanation, config.NoDeprecated)
+		explanations = append(explanations, explanation)
+	}
+	return explanations, nil
+}
+
+// Explain runs caladan explain, showing why each copy of a package in the
+// lockfile has its version
+func Explain(directory, name string, opts ExplainOptions) error {
+	packageLock, err := readLockFile(filepath.Join(directory, "package-lock.json"))
+	if err != nil {
+		return fmt.Errorf("error reading lockfile: %v", err)
+	}
+	resolver := NewPackageResolver(newRegistryClient(&http.Client{Timeout: 30 * time.Second}, npmRegistryURL, ""), semaphore.NewWeighted(1))
+	fetch := func(name string) (*PackageMetadata, error) {
+		metadata, _, err := resolver.packageMetadata(context.Background(), name, "")
+		return metadata, err
+	}
+	explanations, err := explainPackage(directory, packageLock, name, fetch, GetMatchingVersions)
+	if err != nil {
+		return err
+	}
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(explanations)
+	}
+	fmt.Print(RenderExplanations(explanations))
+	return nil
+}
+
+// RenderExplanations shows each entry's requirements, candidates, and how
+// its version was picked
+func RenderExplanations(explanations []Explanation) string {
+	var builder strings.Builder
+	for i, explanation := range explanations {
+		if i > 0 {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(colorPackage(explanation.Path+"@"+explanation.Version) + "\n")
+		if len(explanation.Requirements) == 0 {
+			builder.WriteString(colorDim("  nothing in the lockfile depends on it") + "\n")
+		}
+		for _, requirement := range explanation.Requirements {
+			from := requirement.From
+			if from == "" {
+				from = "the project"
+			}
+			line := fmt.Sprintf("  %s asks for %s in %s", from, requirement.Range, requirement.Type)
+			if requirement.DistTag != "" && len(requirement.Candidates) > 0 {
+				line += fmt.Sprintf(", tagged %s", requirement.Candidates[len(requirement.Candidates)-1])
+			}
+			builder.WriteString(line + "\n")
+			if requirement.Candidates != nil {
+				builder.WriteString(colorDim(fmt.Sprintf("    %d candidates: %s", len(requirement.Candidates), summarizeVersions(requirement.Candidates))) + "\n")
+			}
+		}
+		builder.WriteString(fmt.Sprintf("  picked by %s\n", explanation.Strategy))
+		if explanation.Override != "" {
+			builder.WriteString(fmt.Sprintf("  the project overrides it to %s\n", explanation.Override))
+		}
+		for _, requirement := range explanation.Requirements {
+			if requirement.Picked != "" && requirement.Picked != explanation.Version {
+				builder.WriteString(colorWarn(fmt.Sprintf("  locked at %s, resolving %s today picks %s", explanation.Version, requirement.Range, requirement.Picked)) + "\n")
+			}
+		}
+		if explanation.MetadataError != "" {
+			builder.WriteString(colorWarn("  couldn't fetch its versions: "+explanation.MetadataError) + "\n")
+		}
+		if annotation := explanation.Annotation; annotation != nil {
+			date := annotation.Date
+			if t, err := time.Parse(time.RFC3339, annotation.Date); err == nil {
+				date = t.Format("2006-01-02")
+			}
+			line := fmt.Sprintf("  last changed by %s on %s", annotation.Command, date)
+			if len(annotation.Causes) > 0 {
+				line += ", for " + strings.Join(annotation.Causes, ", ")
+			}
+			builder.WriteString(colorDim(line) + "\n")
+		}
+	}
+	return builder.String()
+}
+
+// summarizeVersions lists versions, eliding the middle of long lists
+func summarizeVersions(versions []string) string {
+	if len(versions) == 0 {
+		return "none"
+	}
+	if len(versions) <= 6 {
+		return strings.Join(versions, ", ")
+	}
+	return strings.Join(versions[:3], ", ") + ", ..., " + strings.Join(versions[len(versions)-3:], ", ")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// caretMatch stands in for node's semver in tests, matching exact versions
+// and ^ ranges
+func caretMatch(versionRange string, versions []string) ([]string, error) {
+	matches := []string{}
+	base, caret := strings.CutPrefix(versionRange, "^")
+	want, ok := parseSemver(base)
+	if !ok {
+		return nil, errors.New("invalid range")
+	}
+	for _, version := range versions {
+		parsed, ok := parseSemver(version)
+		if !ok {
+			continue
+		}
+		if cmp, _ := compareSemver(version, base); cmp == 0 || (caret && cmp > 0 && parsed.core[0] == want.core[0]) {
+			matches = append(matches, version)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		cmp, _ := compareSemver(matches[i], matches[j])
+		return cmp < 0
+	})
+	return matches, nil
+}
+
+func TestExplainPackage(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "app", "overrides": {"other": {".": "2.0.0"}}}`)
+	writeTestFile(t, filepath.Join(dir, annotationsFile), `{"packages": {"node_modules/debug": {"command": "caladan install", "date": "2024-05-01T10:00:00Z", "causes": ["express"], "newVersion": "4.3.4"}}}`)
+	packageLock := &PackageLock{Packages: map[string]json.RawMessage{
+		"":                     json.RawMessage(`{"dependencies": {"debug": "^4.3.0", "express": "^4.0.0"}}`),
+		"node_modules/debug":   json.RawMessage(`{"version": "4.3.4"}`),
+		"node_modules/express": json.RawMessage(`{"version": "4.19.0", "dependencies": {"debug": "2.6.9"}}`),
+		"node_modules/express/node_modules/debug": json.RawMessage(`{"version": "2.6.9"}`),
+		"node_modules/send":                       json.RawMessage(`{"version": "1.0.0", "dependencies": {"debug": "latest"}}`),
+	}}
+	metadata := &PackageMetadata{
+		Versions: map[string]PackageInfo{"2.6.9": {}, "4.3.0": {}, "4.3.4": {}, "4.3.7": {}, "5.0.0": {}},
+		DistTags: map[string]string{"latest": "4.3.4"},
+	}
+	fetch := func(name string) (*PackageMetadata, error) { return metadata, nil }
+
+	explanations, err := explainPackage(dir, packageLock, "debug", fetch, caretMatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(explanations) != 2 {
+		t.Fatalf("explanations = %+v, want one per copy", explanations)
+	}
+
+	top := explanations[0]
+	if top.Path != "node_modules/debug" || len(top.Requirements) != 2 {
+		t.Fatalf("top = %+v", top)
+	}
+	project, send := top.Requirements[0], top.Requirements[1]
+	if project.From != "" || project.Range != "^4.3.0" || strings.Join(project.Candidates, ",") != "4.3.0,4.3.4,4.3.7" || project.Picked != "4.3.7" {
+		t.Errorf("project requirement = %+v", project)
+	}
+	if send.From != "node_modules/send" || send.DistTag != "latest" || send.Picked != "4.3.4" {
+		t.Errorf("send requirement = %+v", send)
+	}
+	if top.Strategy != strategyDistTag || top.Annotation == nil || top.Annotation.Command != "caladan install" {
+		t.Errorf("top = %+v", top)
+	}
+
+	nested := explanations[1]
+	if nested.Path != "node_modules/express/node_modules/debug" || len(nested.Requirements) != 1 || nested.Requirements[0].From != "node_modules/express" || nested.Strategy != strategyHighest {
+		t.Errorf("nested = %+v", nested)
+	}
+
+	rendered := RenderExplanations(explanations)
+	for _, want := range []string{"the project asks for ^4.3.0 in dependencies", "3 candidates: 4.3.0, 4.3.4, 4.3.7", "resolving ^4.3.0 today picks 4.3.7", "last changed by caladan install on 2024-05-01, for express"} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("rendered = %s, want %q", rendered, want)
+		}
+	}
+
+	// Overrides win, and the explanation survives the registry being down
+	offline := func(name string) (*PackageMetadata, error) { return nil, errors.New("offline") }
+	packageLock.Packages["node_modules/other"] = json.RawMessage(`{"version": "2.0.0"}`)
+	explanations, err = explainPackage(dir, packageLock, "other", offline, caretMatch)
+	if err != nil || explanations[0].Strategy != strategyOverride || explanations[0].Override != "2.0.0" || explanations[0].MetadataError != "offline" {
+		t.Errorf("explanations = %+v, %v", explanations, err)
+	}
+
+	if _, err := explainPackage(dir, packageLock, "missing", fetch, caretMatch); err == nil {
+		t.Errorf("explainPackage() for a package not in the lockfile = nil error")
+	}
+}
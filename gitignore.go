@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The gitignore settings: ask on the terminal (and only suggest it without
+// one), add the entries without asking, or leave .gitignore alone
+const (
+	gitignorePrompt = "prompt"
+	gitignoreAdd    = "add"
+	gitignoreOff    = "off"
+)
+
+func validGitignore(setting string) bool {
+	switch setting {
+	case gitignorePrompt, gitignoreAdd, gitignoreOff:
+		return true
+	}
+	return false
+}
+
+// unignoredPaths returns the directories under dir that git would track.
+// Outside a git repository, or without git, there's nothing to ignore and
+// it returns none
+func unignoredPaths(dir string, paths []string) []string {
+	var unignored []string
+	for _, path := range paths {
+		// The trailing slash matches directory patterns like node_modules/
+		// whether or not the directory exists yet
+		cmd := exec.Command("git", "check-ignore", "-q", filepath.ToSlash(path)+"/")
+		cmd.Dir = dir
+		err := cmd.Run()
+		if err == nil {
+			continue
+		}
+		// check-ignore exits 1 for a path that isn't ignored, and 128 when
+		// dir isn't in a repository
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return nil
+		}
+		unignored = append(unignored, path)
+	}
+	return unignored
+}
+
+// gitignoreEntry is the .gitignore line for a directory relative to the
+// project. A top-level directory is ignored by name, like node_modules/ in
+// most projects, and a nested one is anchored to the project
+func gitignoreEntry(rel string) string {
+	rel = filepath.ToSlash(rel)
+	if !strings.Contains(rel, "/") {
+		return rel + "/"
+	}
+	return "/" + rel + "/"
+}
+
+// appendGitignore adds entries to the .gitignore in dir, creating it when
+// there's none
+func appendGitignore(dir string, entries []string) error {
+	path := filepath.Join(dir, ".gitignore")
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var b strings.Builder
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		b.WriteString("\n")
+	}
+	for _, entry := range entries {
+		b.WriteString(entry + "\n")
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// checkGitignore makes sure git ignores the directories an install creates
+// in the project in workDir, so node_modules doesn't end up committed. Paths
+// outside the project are left to whoever configured them. With the prompt
+// setting, confirm is asked before .gitignore is changed, and a nil confirm
+// only prints a hint
+func checkGitignore(workDir string, dirs []string, setting string, confirm func(question string) (bool, error)) error {
+	if setting == gitignoreOff {
+		return nil
+	}
+	var rels []string
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(workDir, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		rels = append(rels, rel)
+	}
+	rels = unignoredPaths(workDir, rels)
+	if len(rels) == 0 {
+		return nil
+	}
+	entries := make([]string, len(rels))
+	for i, rel := range rels {
+		entries[i] = gitignoreEntry(rel)
+	}
+
+	if setting != gitignoreAdd {
+		if confirm == nil {
+			fmt.Printf("%s isn't ignored by git, add %s to .gitignore (or set gitignore to \"add\" in the config)\n", rels[0], strings.Join(entries, " "))
+			return nil
+		}
+		ok, err := confirm(fmt.Sprintf("Add %s to .gitignore?", strings.Join(entries, " ")))
+		if err != nil || !ok {
+			return err
+		}
+	}
+	if err := appendGitignore(workDir, entries); err != nil {
+		return fmt.Errorf("error updating .gitignore: %v", err)
+	}
+	fmt.Printf("Added %s to .gitignore\n", strings.Join(entries, " "))
+	return nil
+}
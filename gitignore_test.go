@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitignoreEntry(t *testing.T) {
+	for rel, want := range map[string]string{
+		"node_modules":          "node_modules/",
+		".caladan":              ".caladan/",
+		"packages/node_modules": "/packages/node_modules/",
+	} {
+		if got := gitignoreEntry(rel); got != want {
+			t.Errorf("gitignoreEntry(%q) = %q, want %q", rel, got, want)
+		}
+	}
+}
+
+func TestCheckGitignore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	if err := exec.Command("git", "init", "-q", dir).Run(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, ".gitignore"), "dist/\n.caladan/")
+	dirs := []string{filepath.Join(dir, "node_modules"), filepath.Join(dir, ".caladan"), filepath.Join(t.TempDir(), "store")}
+
+	// Declining leaves .gitignore alone, and only unignored paths are asked about
+	asked := ""
+	decline := func(question string) (bool, error) {
+		asked = question
+		return false, nil
+	}
+	if err := checkGitignore(dir, dirs, gitignorePrompt, decline); err != nil {
+		t.Fatal(err)
+	}
+	if asked != "Add node_modules/ to .gitignore?" {
+		t.Errorf("asked %q", asked)
+	}
+	if got := readTestFile(t, filepath.Join(dir, ".gitignore")); got != "dist/\n.caladan/" {
+		t.Errorf(".gitignore = %q after declining", got)
+	}
+
+	if err := checkGitignore(dir, dirs, gitignoreAdd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(dir, ".gitignore")); got != "dist/\n.caladan/\nnode_modules/\n" {
+		t.Errorf(".gitignore = %q", got)
+	}
+	if unignored := unignoredPaths(dir, []string{"node_modules", ".caladan"}); len(unignored) != 0 {
+		t.Errorf("still not ignored: %v", unignored)
+	}
+
+	// Outside a repository there's nothing to ignore
+	if unignored := unignoredPaths(t.TempDir(), []string{"node_modules"}); len(unignored) != 0 {
+		t.Errorf("outside a repository: %v", unignored)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Global packages are installed into a project of their own under the
+// global prefix, so they get a lockfile and hoisting like any other install.
+// Their bins are linked into the prefix's bin directory, which goes on PATH
+type globalDirs struct {
+	project string // The global project, holding package.json and node_modules
+	bin     string // Where global bins are linked
+}
+
+// globalManifest is the global project's package.json
+type globalManifest struct {
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// globalPrefix returns CALADAN_HOME, or ~/.caladan
+func globalPrefix() (string, error) {
+	if dir := os.Getenv("CALADAN_HOME"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding home directory (set CALADAN_HOME): %v", err)
+	}
+	return filepath.Join(home, ".caladan"), nil
+}
+
+func getGlobalDirs() (globalDirs, error) {
+	prefix, err := globalPrefix()
+	if err != nil {
+		return globalDirs{}, err
+	}
+	return globalDirs{
+		project: filepath.Join(prefix, "global"),
+		bin:     filepath.Join(prefix, "bin"),
+	}, nil
+}
+
+// parsePackageSpec splits name@range, defaulting the range to latest
+func parsePackageSpec(spec string) (string, string) {
+	// The @ of a scope isn't a version separator
+	at := strings.LastIndex(spec, "@")
+	if at <= 0 {
+		return spec, "latest"
+	}
+	return spec[:at], spec[at+1:]
+}
+
+func readGlobalManifest(dirs globalDirs) (globalManifest, error) {
+	manifest := globalManifest{Dependencies: map[string]string{}}
+	data, err := os.ReadFile(filepath.Join(dirs.project, "package.json"))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("error parsing global package.json: %v", err)
+	}
+	if manifest.Dependencies == nil {
+		manifest.Dependencies = map[string]string{}
+	}
+	return manifest, nil
+}
+
+func writeGlobalManifest(dirs globalDirs, manifest globalManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dirs.project, "package.json"), append(data, '\n'))
+}
+
+// installedVersion returns the version of a package in the global project
+func installedVersion(dirs globalDirs, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dirs.project, "node_modules", name, "package.json"))
+	if err != nil {
+		return "", err
+	}
+	var packageJSON struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(data, &packageJSON); err != nil {
+		return "", err
+	}
+	return packageJSON.Version, nil
+}
+
+// AddGlobal installs packages into the global prefix and links their bins
+func AddGlobal(specs []string, opts InstallOptions) error {
+	dirs, err := getGlobalDirs()
+	if err != nil {
+		return err
+	}
+	manifest, err := readGlobalManifest(dirs)
+	if err != nil {
+		return err
+	}
+
+	previous := globalManifest{Dependencies: make(map[string]string, len(manifest.Dependencies))}
+	for name, versionRange := range manifest.Dependencies {
+		previous.Dependencies[name] = versionRange
+	}
+
+	names := []string{}
+	for _, spec := range specs {
+		name, versionRange := parsePackageSpec(spec)
+		manifest.Dependencies[name] = versionRange
+		names = append(names, name)
+	}
+	if err := writeGlobalManifest(dirs, manifest); err != nil {
+		return err
+	}
+
+	if err := Install(dirs.project, opts); err != nil {
+		// Don't leave a package that failed to install in the manifest
+		if restoreErr := writeGlobalManifest(dirs, previous); restoreErr != nil {
+			printError("restoring global package.json: %v", restoreErr)
+		}
+		return err
+	}
+
+	// Save what was installed like npm does, so a later add doesn't move
+	// the other global packages to a new version
+	for _, name := range names {
+		version, err := installedVersion(dirs, name)
+		if err != nil {
+			return fmt.Errorf("%s wasn't installed: %v", name, err)
+		}
+		manifest.Dependencies[name] = "^" + version
+		fmt.Printf("%s %s globally\n", colorSuccess("Installed"), colorPackage(name+"@"+version))
+	}
+	if err := writeGlobalManifest(dirs, manifest); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := linkGlobalBins(dirs, name); err != nil {
+			return err
+		}
+	}
+	warnIfNotOnPath(dirs.bin)
+	return nil
+}
+
+// RemoveGlobal uninstalls global packages and unlinks their bins
+func RemoveGlobal(names []string, opts InstallOptions) error {
+	dirs, err := getGlobalDirs()
+	if err != nil {
+		return err
+	}
+	manifest, err := readGlobalManifest(dirs)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, ok := manifest.Dependencies[name]; !ok {
+			return fmt.Errorf("%s isn't installed globally", name)
+		}
+	}
+	for _, name := range names {
+		// Bins are found through the package, so unlink them before it goes
+		if err := unlinkGlobalBins(dirs, name); err != nil {
+			return err
+		}
+		delete(manifest.Dependencies, name)
+	}
+	if err := writeGlobalManifest(dirs, manifest); err != nil {
+		return err
+	}
+
+	if err := Install(dirs.project, opts); err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Printf("Removed %s\n", name)
+	}
+	return nil
+}
+
+// ListGlobal returns the global packages as name@version, sorted by name
+func ListGlobal() ([]string, error) {
+	dirs, err := getGlobalDirs()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readGlobalManifest(dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []string{}
+	for name := range manifest.Dependencies {
+		version, err := installedVersion(dirs, name)
+		if err != nil {
+			version = "missing"
+		}
+		packages = append(packages, name+"@"+version)
+	}
+	sort.Strings(packages)
+	return packages, nil
+}
+
+// globalBins returns the bins a global package declares, by command name,
+// as paths to its scripts
+func globalBins(dirs globalDirs, name string) (map[string]string, error) {
+	pkgPath := filepath.Join(dirs.project, "node_modules", name)
+	bins, err := readPackageJSONBin(filepath.Join(pkgPath, "package.json"), name)
+	if err != nil {
+		return nil, err
+	}
+	scripts := make(map[string]string, len(bins))
+	for cmdName, scriptPath := range bins {
+		// Command names come from the registry, so keep them in the bin directory
+		if cmdName == "" || scriptPath == "" || strings.ContainsAny(cmdName, `/\`) {
+			continue
+		}
+		scripts[cmdName] = filepath.Join(pkgPath, scriptPath)
+	}
+	return scripts, nil
+}
+
+// linkGlobalBins links a global package's bins into the bin directory. A
+// bin that belongs to something outside the global project is left alone
+func linkGlobalBins(dirs globalDirs, name string) error {
+	bins, err := globalBins(dirs, name)
+	if err != nil {
+		return fmt.Errorf("error reading bins of %s: %v", name, err)
+	}
+	if err := os.MkdirAll(dirs.bin, 0755); err != nil {
+		return err
+	}
+
+	for cmdName, script := range bins {
+		linkPath := filepath.Join(dirs.bin, cmdName)
+		if target, err := os.Readlink(linkPath); err == nil && !ownsBin(dirs, linkPath, target) {
+			printWarning("not linking %s, %s already points to %s", cmdName, linkPath, target)
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			printWarning("not linking %s, %s already exists", cmdName, linkPath)
+			continue
+		}
+		if err := createExecutableSymlink(script, linkPath); err != nil {
+			return fmt.Errorf("error linking %s: %v", cmdName, err)
+		}
+		fmt.Printf("Linked %s\n", linkPath)
+	}
+	return nil
+}
+
+// unlinkGlobalBins removes a global package's bins from the bin directory
+func unlinkGlobalBins(dirs globalDirs, name string) error {
+	bins, err := globalBins(dirs, name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading bins of %s: %v", name, err)
+	}
+
+	for cmdName, script := range bins {
+		linkPath := filepath.Join(dirs.bin, cmdName)
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			continue
+		}
+		if resolveLink(linkPath, target) != script {
+			// Another package has since claimed the command
+			continue
+		}
+		if err := os.Remove(linkPath); err != nil {
+			return err
+		}
+		fmt.Printf("Unlinked %s\n", linkPath)
+	}
+	return nil
+}
+
+// ownsBin reports whether a bin link points into the global project
+func ownsBin(dirs globalDirs, linkPath, target string) bool {
+	rel, err := filepath.Rel(filepath.Join(dirs.project, "node_modules"), resolveLink(linkPath, target))
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// resolveLink returns the path a symlink's target refers to
+func resolveLink(linkPath, target string) string {
+	if filepath.IsAbs(target) {
+		return filepath.Clean(target)
+	}
+	return filepath.Join(filepath.Dir(linkPath), target)
+}
+
+// warnIfNotOnPath tells the user to add the bin directory to PATH
+func warnIfNotOnPath(binDir string) {
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if filepath.Clean(dir) == filepath.Clean(binDir) {
+			return
+		}
+	}
+	fmt.Printf("\n%s is not on your PATH, add it to run globally installed bins:\n  export PATH=\"%s:$PATH\"\n", binDir, binDir)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePackageSpec(t *testing.T) {
+	tests := []struct {
+		spec      string
+		wantName  string
+		wantRange string
+	}{
+		{"typescript", "typescript", "latest"},
+		{"typescript@^5.0.0", "typescript", "^5.0.0"},
+		{"@angular/cli", "@angular/cli", "latest"},
+		{"@angular/cli@17", "@angular/cli", "17"},
+	}
+
+	for _, tt := range tests {
+		name, versionRange := parsePackageSpec(tt.spec)
+		if name != tt.wantName || versionRange != tt.wantRange {
+			t.Errorf("parsePackageSpec(%q) = %q, %q, want %q, %q", tt.spec, name, versionRange, tt.wantName, tt.wantRange)
+		}
+	}
+}
+
+// writeGlobalPackage fakes an installed global package
+func writeGlobalPackage(t *testing.T, dirs globalDirs, name, version, bin string) {
+	t.Helper()
+	pkgPath := filepath.Join(dirs.project, "node_modules", name)
+	writeTestFile(t, filepath.Join(pkgPath, "package.json"),
+		`{"name":"`+name+`","version":"`+version+`","bin":{"`+name+`":"`+bin+`"}}`)
+	writeTestFile(t, filepath.Join(pkgPath, bin), "#!/usr/bin/env node\n")
+}
+
+func TestGlobalBins(t *testing.T) {
+	t.Setenv("CALADAN_HOME", t.TempDir())
+	dirs, err := getGlobalDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeGlobalPackage(t, dirs, "tool", "1.2.3", "cli.js")
+	writeGlobalPackage(t, dirs, "other", "2.0.0", "bin/other.js")
+	if err := writeGlobalManifest(dirs, globalManifest{Dependencies: map[string]string{"tool": "^1.2.3", "other": "^2.0.0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A command that belongs to something else is left alone
+	if err := os.MkdirAll(dirs.bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/local/bin/other", filepath.Join(dirs.bin, "other")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"tool", "other"} {
+		if err := linkGlobalBins(dirs, name); err != nil {
+			t.Fatalf("linkGlobalBins(%s) error = %v", name, err)
+		}
+	}
+	if got := readTestFile(t, filepath.Join(dirs.bin, "tool")); got != "#!/usr/bin/env node\n" {
+		t.Errorf("tool bin isn't linked to its script")
+	}
+	if target, _ := os.Readlink(filepath.Join(dirs.bin, "other")); target != "/usr/local/bin/other" {
+		t.Errorf("other bin = %s, want the existing link kept", target)
+	}
+
+	packages, err := ListGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"other@2.0.0", "tool@1.2.3"}; !reflect.DeepEqual(packages, want) {
+		t.Errorf("ListGlobal() = %v, want %v", packages, want)
+	}
+
+	for _, name := range []string{"tool", "other"} {
+		if err := unlinkGlobalBins(dirs, name); err != nil {
+			t.Fatalf("unlinkGlobalBins(%s) error = %v", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dirs.bin, "tool")); !os.IsNotExist(err) {
+		t.Errorf("tool bin left behind after unlinking")
+	}
+	if _, err := os.Lstat(filepath.Join(dirs.bin, "other")); err != nil {
+		t.Errorf("unlinking removed a bin it didn't create")
+	}
+}
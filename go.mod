@@ -5,14 +5,17 @@ go 1.23.0
 toolchain go1.23.7
 
 require (
-	github.com/aquasecurity/go-npm-version v0.0.1
-	github.com/kr/pretty v0.3.1
+	github.com/quic-go/quic-go v0.54.0
 	golang.org/x/sync v0.12.0
+	golang.org/x/sys v0.30.0
 )
 
 require (
-	github.com/aquasecurity/go-version v0.0.0-20201107203531-5e48ac5d022a // indirect
-	github.com/kr/text v0.2.0 // indirect
-	github.com/rogpeppe/go-internal v1.9.0 // indirect
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// HoistedPackage is a package moved up to the root of node_modules, shared
+// by every dependent that asked for its version
+type HoistedPackage struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	Dependents []string `json:"dependents"` // name@version, "" for the project
+}
+
+// NestedPackage is a package left in the node_modules of its dependents.
+// Either another version of it took the root, asked for by RootDependents,
+// or only one dependent wanted it and it stays under that one
+type NestedPackage struct {
+	Name           string   `json:"name"`
+	Version        string   `json:"version"`
+	Dependents     []string `json:"dependents"`
+	RootVersion    string   `json:"rootVersion,omitempty"`
+	RootDependents []string `json:"rootDependents,omitempty"`
+}
+
+// HoistReport records the decisions HoistDependencies made, and how deep
+// the resulting node_modules is
+type HoistReport struct {
+	Hoisted []HoistedPackage `json:"hoisted"`
+	Nested  []NestedPackage  `json:"nested"`
+	// Depths counts installed packages by how many node_modules they're
+	// nested in, starting at 1 for the root's
+	Depths   []int  `json:"depths"`
+	Deepest  string `json:"deepest"` // The path of one of the deepest packages
+	Packages int    `json:"packages"`
+}
+
+func (r *HoistReport) hoisted(pkg PackageInfo, dependents []string) {
+	r.Hoisted = append(r.Hoisted, HoistedPackage{Name: pkg.Name, Version: pkg.Version, Dependents: dependents})
+}
+
+func (r *HoistReport) nested(pkg PackageInfo, dependents []string, rootVersion string, rootDependents []string) {
+	r.Nested = append(r.Nested, NestedPackage{
+		Name:           pkg.Name,
+		Version:        pkg.Version,
+		Dependents:     dependents,
+		RootVersion:    rootVersion,
+		RootDependents: rootDependents,
+	})
+}
+
+// measure records the depth of every package in a hoisted tree, and sorts
+// the decisions by name for printing
+func (r *HoistReport) measure(tree []PackageInfo) {
+	var walk func(deps []PackageInfo, path string, depth int)
+	walk = func(deps []PackageInfo, path string, depth int) {
+		for _, dep := range deps {
+			depPath := path + "node_modules/" + dep.Name
+			for len(r.Depths) < depth {
+				r.Depths = append(r.Depths, 0)
+			}
+			r.Depths[depth-1]++
+			r.Packages++
+			if depth == len(r.Depths) && (r.Deepest == "" || strings.Count(r.Deepest, "node_modules/") < depth || depPath < r.Deepest) {
+				r.Deepest = depPath
+			}
+			nested := make([]PackageInfo, 0, len(dep.ResolvedDeps))
+			for _, child := range dep.ResolvedDeps {
+				nested = append(nested, child)
+			}
+			walk(nested, depPath+"/", depth+1)
+		}
+	}
+	walk(tree, "", 1)
+
+	sort.Slice(r.Hoisted, func(i, j int) bool {
+		return r.Hoisted[i].Name+"@"+r.Hoisted[i].Version < r.Hoisted[j].Name+"@"+r.Hoisted[j].Version
+	})
+	sort.Slice(r.Nested, func(i, j int) bool {
+		return r.Nested[i].Name+"@"+r.Nested[i].Version < r.Nested[j].Name+"@"+r.Nested[j].Version
+	})
+}
+
+// describePackageDependents names the dependents behind a hoisting
+// decision, which are name@version or "" for the project
+func describePackageDependents(dependents []string) string {
+	names := make([]string, len(dependents))
+	for i, dependent := range dependents {
+		names[i] = dependent
+		if dependent == "" {
+			names[i] = "the project"
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// RenderHoistReport lists what was hoisted and for whom, what stayed
+// nested and why, then how many packages sit at each depth
+func RenderHoistReport(r *HoistReport) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("Hoisting: %d packages hoisted to node_modules, %d left nested\n", len(r.Hoisted), len(r.Nested)))
+	if len(r.Hoisted) > 0 {
+		builder.WriteString("\nHoisted:\n")
+		for _, pkg := range r.Hoisted {
+			builder.WriteString(fmt.Sprintf("  %s %s\n", colorPackage(pkg.Name+"@"+pkg.Version), colorDim("shared by "+describePackageDependents(pkg.Dependents))))
+		}
+	}
+	if len(r.Nested) > 0 {
+		builder.WriteString("\nNested:\n")
+		for _, pkg := range r.Nested {
+			reason := "only " + describePackageDependents(pkg.Dependents) + " depends on it"
+			if pkg.RootVersion != "" {
+				reason = fmt.Sprintf("under %s, node_modules has %s@%s for %s", describePackageDependents(pkg.Dependents), pkg.Name, pkg.RootVersion, describePackageDependents(pkg.RootDependents))
+			}
+			builder.WriteString(fmt.Sprintf("  %s %s\n", colorPackage(pkg.Name+"@"+pkg.Version), colorDim(reason)))
+		}
+	}
+	builder.WriteString(fmt.Sprintf("\n%d packages installed:\n", r.Packages))
+	for i, count := range r.Depths {
+		builder.WriteString(fmt.Sprintf("  depth %d: %d\n", i+1, count))
+	}
+	if r.Deepest != "" {
+		builder.WriteString(colorDim("  deepest: "+r.Deepest) + "\n")
+	}
+	return builder.String()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3HandshakeTimeout is how long a host gets to answer over QUIC before
+// its requests go over TCP instead. Networks that drop UDP never answer, so
+// this is what --http3 costs there, once per host
+const http3HandshakeTimeout = 3 * time.Second
+
+// http3Transport sends registry requests over HTTP/3 (QUIC), and over TCP
+// with fallback for hosts that don't answer over QUIC. A host that fails
+// once isn't tried over QUIC again, so a flaky path doesn't cost a
+// handshake timeout per request
+type http3Transport struct {
+	quic     *http3.Transport
+	fallback http.RoundTripper
+
+	lock   sync.Mutex
+	broken map[string]bool
+}
+
+// newHTTP3Transport returns a transport that tries HTTP/3 first, resolving
+// hosts through the DNS cache
+func newHTTP3Transport(dns *dnsCache, fallback http.RoundTripper) *http3Transport {
+	return &http3Transport{
+		quic: &http3.Transport{
+			QUICConfig: &quic.Config{HandshakeIdleTimeout: http3HandshakeTimeout},
+			Dial: func(ctx context.Context, address string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+				host, port, err := net.SplitHostPort(address)
+				if err != nil {
+					return nil, err
+				}
+				addrs := []string{host}
+				if net.ParseIP(host) == nil {
+					if addrs, err = dns.resolve(ctx, host); err != nil {
+						return nil, err
+					}
+				}
+				var lastErr error
+				for _, addr := range addrs {
+					conn, err := quic.DialAddrEarly(ctx, net.JoinHostPort(addr, port), tlsConf, conf)
+					if err == nil {
+						return conn, nil
+					}
+					lastErr = err
+				}
+				return nil, lastErr
+			},
+		},
+		fallback: fallback,
+		broken:   make(map[string]bool),
+	}
+}
+
+func (t *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A request with a body can't be sent again over TCP once QUIC has
+	// read it, and registry writes aren't worth the risk
+	if req.URL.Scheme != "https" || (req.Body != nil && req.Body != http.NoBody) || t.isBroken(req.URL.Host) {
+		return t.fallback.RoundTrip(req)
+	}
+	resp, err := t.quic.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+	if req.Context().Err() != nil {
+		return nil, err
+	}
+	if t.markBroken(req.URL.Host) {
+		printWarning("%s didn't answer over HTTP/3 (%v), using HTTP/2", req.URL.Host, err)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+func (t *http3Transport) isBroken(host string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.broken[host]
+}
+
+// markBroken stops sending a host's requests over QUIC, reporting whether
+// it was the first to
+func (t *http3Transport) markBroken(host string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.broken[host] {
+		return false
+	}
+	t.broken[host] = true
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3Transport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	dns, err := newDNSCache(DNSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(transport *http3Transport, url string) string {
+		t.Helper()
+		resp, err := (&http.Client{Transport: transport}).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// Nothing answers over QUIC on the TCP server's port, so it falls back
+	transport := newHTTP3Transport(dns, server.Client().Transport)
+	transport.quic.TLSClientConfig = &tls.Config{RootCAs: roots}
+	transport.quic.QUICConfig.HandshakeIdleTimeout = 200 * time.Millisecond
+	if proto := get(transport, server.URL); proto != "HTTP/1.1" || !transport.isBroken(server.Listener.Addr().String()) {
+		t.Errorf("got %s, want a fallback to TCP that's remembered", proto)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quicServer := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: server.TLS.Certificates})}
+	go quicServer.Serve(conn)
+	defer quicServer.Close()
+
+	transport = newHTTP3Transport(dns, server.Client().Transport)
+	transport.quic.TLSClientConfig = &tls.Config{RootCAs: roots}
+	if proto := get(transport, "https://"+conn.LocalAddr().String()); proto != "HTTP/3.0" {
+		t.Errorf("got %s, want HTTP/3", proto)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InitOptions configures caladan init
+type InitOptions struct {
+	Yes bool // Take every default instead of prompting
+}
+
+// initAnswers is what caladan init asks for
+type initAnswers struct {
+	Name       string
+	Version    string
+	License    string
+	Main       string
+	Test       string
+	Workspaces []string // Globs, e.g. packages/*
+	TypeScript bool
+	ESLint     bool
+}
+
+// defaultTestScript is npm init's placeholder test script
+const defaultTestScript = `echo "Error: no test specified" && exit 1`
+
+// defaultInitAnswers are the answers for a project in directory when every
+// prompt is left blank
+func defaultInitAnswers(directory string) initAnswers {
+	name := ""
+	if abs, err := filepath.Abs(directory); err == nil {
+		name = strings.ReplaceAll(strings.ToLower(filepath.Base(abs)), " ", "-")
+	}
+	return initAnswers{Name: name, Version: "1.0.0", License: "ISC", Main: "index.js", Test: defaultTestScript}
+}
+
+// prompter asks questions on out and reads the answers from in, one per
+// line. At the end of input every remaining question takes its default
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	eof bool
+}
+
+// ask returns the answer to a question, or def when it's left blank. An
+// answer that validate rejects is asked for again
+func (p *prompter) ask(question, def string, validate func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s: %s ", question, colorDim("("+def+")"))
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		answer := ""
+		if !p.eof {
+			line, err := p.in.ReadString('\n')
+			if err == io.EOF {
+				p.eof = true
+			} else if err != nil {
+				return "", err
+			}
+			answer = strings.TrimSpace(line)
+		}
+		if p.eof {
+			fmt.Fprintln(p.out)
+		}
+		if answer == "" {
+			answer = def
+		}
+		if validate == nil {
+			return answer, nil
+		}
+		err := validate(answer)
+		if err == nil {
+			return answer, nil
+		}
+		if p.eof {
+			return "", fmt.Errorf("%s: %v", question, err)
+		}
+		printError("%v", err)
+	}
+}
+
+// confirm asks a yes or no question
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := p.ask(question+" "+hint, "", func(answer string) error {
+		switch strings.ToLower(answer) {
+		case "", "y", "yes", "n", "no":
+			return nil
+		}
+		return fmt.Errorf("answer y or n")
+	})
+	if err != nil || answer == "" {
+		return def, err
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+// terminalConfirm asks yes/no questions on the terminal, with def as the
+// answer to an empty line. It's nil in CI or without a terminal, where
+// callers fall back to not asking
+func terminalConfirm(def bool) func(question string) (bool, error) {
+	if os.Getenv("CI") != "" {
+		return nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	return func(question string) (bool, error) {
+		return p.confirm(question, def)
+	}
+}
+
+// confirm is terminalConfirm, unless the install mustn't prompt
+func (opts InstallOptions) confirm(def bool) func(question string) (bool, error) {
+	if opts.noPrompt {
+		return nil
+	}
+	return terminalConfirm(def)
+}
+
+// promptInit asks for each answer, offering the defaults
+func promptInit(p *prompter, defaults initAnswers) (initAnswers, error) {
+	answers := defaults
+	var err error
+	if answers.Name, err = p.ask("package name", defaults.Name, validatePackageName); err != nil {
+		return answers, err
+	}
+	if answers.Version, err = p.ask("version", defaults.Version, func(version string) error {
+		if _, ok := parseSemver(version); !ok || strings.HasPrefix(version, "v") {
+			return fmt.Errorf("%q isn't a semver version like 1.0.0", version)
+		}
+		return nil
+	}); err != nil {
+		return answers, err
+	}
+	if answers.License, err = p.ask("license", defaults.License, validateLicense); err != nil {
+		return answers, err
+	}
+	if answers.TypeScript, err = p.confirm("use TypeScript?", defaults.TypeScript); err != nil {
+		return answers, err
+	}
+	mainDefault := defaults.Main
+	if answers.TypeScript && mainDefault == "index.js" {
+		mainDefault = "dist/index.js"
+	}
+	if answers.Main, err = p.ask("entry point", mainDefault, nil); err != nil {
+		return answers, err
+	}
+	if answers.Test, err = p.ask("test command", defaults.Test, nil); err != nil {
+		return answers, err
+	}
+	workspaces, err := p.ask("workspaces (comma-separated globs, blank for none)", strings.Join(defaults.Workspaces, ","), nil)
+	if err != nil {
+		return answers, err
+	}
+	answers.Workspaces = nil
+	for _, glob := range strings.Split(workspaces, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			answers.Workspaces = append(answers.Workspaces, glob)
+		}
+	}
+	if answers.ESLint, err = p.confirm("set up ESLint?", defaults.ESLint); err != nil {
+		return answers, err
+	}
+	return answers, nil
+}
+
+// validatePackageName checks a name against npm's rules for new packages
+func validatePackageName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("package name can't be empty")
+	case len(name) > 214:
+		return fmt.Errorf("package name can't be longer than 214 characters")
+	case strings.ToLower(name) != name:
+		return fmt.Errorf("package name %q can't have capital letters", name)
+	case strings.TrimSpace(name) != name:
+		return fmt.Errorf("package name %q can't start or end with spaces", name)
+	case name == "node_modules" || name == "favicon.ico":
+		return fmt.Errorf("%s isn't allowed as a package name", name)
+	}
+	bare := name
+	if strings.HasPrefix(name, "@") {
+		scope, rest, ok := strings.Cut(name[1:], "/")
+		if !ok || scope == "" || rest == "" || strings.Contains(rest, "/") {
+			return fmt.Errorf("scoped package name %q must look like @scope/name", name)
+		}
+		if url.PathEscape(scope) != scope {
+			return fmt.Errorf("package scope %q can only have URL-safe characters", scope)
+		}
+		bare = rest
+	}
+	if strings.HasPrefix(bare, ".") || strings.HasPrefix(bare, "_") {
+		return fmt.Errorf("package name %q can't start with a period or underscore", name)
+	}
+	if url.PathEscape(bare) != bare || strings.ContainsAny(bare, "~'!()*") {
+		return fmt.Errorf("package name %q can only have URL-safe characters", name)
+	}
+	return nil
+}
+
+// spdxLicenses are the SPDX identifiers caladan init accepts, the ones
+// packages on the registry use in practice
+var spdxLicenses = map[string]bool{
+	"0BSD": true, "AFL-3.0": true, "AGPL-3.0-only": true, "AGPL-3.0-or-later": true,
+	"Apache-2.0": true, "Artistic-2.0": true, "BlueOak-1.0.0": true,
+	"BSD-2-Clause": true, "BSD-3-Clause": true, "BSD-3-Clause-Clear": true, "BSD-4-Clause": true,
+	"BSL-1.0": true, "CC-BY-3.0": true, "CC-BY-4.0": true, "CC-BY-SA-4.0": true, "CC0-1.0": true,
+	"CDDL-1.0": true, "CDDL-1.1": true, "EPL-1.0": true, "EPL-2.0": true, "EUPL-1.2": true,
+	"GPL-2.0-only": true, "GPL-2.0-or-later": true, "GPL-3.0-only": true, "GPL-3.0-or-later": true,
+	"ISC": true, "LGPL-2.1-only": true, "LGPL-2.1-or-later": true, "LGPL-3.0-only": true, "LGPL-3.0-or-later": true,
+	"MIT": true, "MIT-0": true, "MPL-2.0": true, "MS-PL": true, "NCSA": true, "OFL-1.1": true,
+	"Python-2.0": true, "Unlicense": true, "UPL-1.0": true, "WTFPL": true, "Zlib": true,
+	// Deprecated identifiers still widely used
+	"AGPL-3.0": true, "GPL-2.0": true, "GPL-3.0": true, "LGPL-2.1": true, "LGPL-3.0": true,
+}
+
+// spdxExceptions are the identifiers allowed after WITH
+var spdxExceptions = map[string]bool{
+	"Classpath-exception-2.0": true, "GCC-exception-3.1": true, "LLVM-exception": true,
+}
+
+// validateLicense checks a license is an SPDX expression, like MIT or
+// (MIT OR Apache-2.0), or one of npm's special values
+func validateLicense(license string) error {
+	if license == "UNLICENSED" || strings.HasPrefix(license, "SEE LICENSE IN ") {
+		return nil
+	}
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(license))
+	rest, err := parseLicenseExpression(tokens)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("unexpected %q", rest[0])
+	}
+	if err != nil {
+		return fmt.Errorf("license %q isn't a valid SPDX expression: %v", license, err)
+	}
+	return nil
+}
+
+// parseLicenseExpression consumes `term (AND|OR term)*` from the tokens,
+// returning what's left
+func parseLicenseExpression(tokens []string) ([]string, error) {
+	rest, err := parseLicenseTerm(tokens)
+	for err == nil && len(rest) > 0 && (rest[0] == "AND" || rest[0] == "OR") {
+		rest, err = parseLicenseTerm(rest[1:])
+	}
+	return rest, err
+}
+
+// parseLicenseTerm consumes a parenthesized expression or a license, with
+// an optional + and WITH exception
+func parseLicenseTerm(tokens []string) ([]string, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("expected a license")
+	}
+	if tokens[0] == "(" {
+		rest, err := parseLicenseExpression(tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 || rest[0] != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return rest[1:], nil
+	}
+	id := strings.TrimSuffix(tokens[0], "+")
+	if !spdxLicenses[id] && !strings.HasPrefix(id, "LicenseRef-") {
+		return nil, fmt.Errorf("unknown license %q", tokens[0])
+	}
+	rest := tokens[1:]
+	if len(rest) > 0 && rest[0] == "WITH" {
+		if len(rest) < 2 || !spdxExceptions[rest[1]] {
+			return nil, fmt.Errorf("unknown license exception after WITH")
+		}
+		rest = rest[2:]
+	}
+	return rest, nil
+}
+
+// initPackageJSON is the package.json caladan init writes, in npm's order
+type initPackageJSON struct {
+	Name            string            `json:"name"`
+	Version         string            `json:"version"`
+	Private         bool              `json:"private,omitempty"`
+	Main            string            `json:"main,omitempty"`
+	Scripts         map[string]string `json:"scripts"`
+	Workspaces      []string          `json:"workspaces,omitempty"`
+	License         string            `json:"license"`
+	DevDependencies map[string]string `json:"devDependencies,omitempty"`
+}
+
+// Config files scaffolded for TypeScript and ESLint
+const (
+	initTSConfig = `{
+  "compilerOptions": {
+    "target": "ES2022",
+    "module": "NodeNext",
+    "moduleResolution": "NodeNext",
+    "outDir": "dist",
+    "rootDir": "src",
+    "declaration": true,
+    "strict": true,
+    "esModuleInterop": true,
+    "skipLibCheck": true
+  },
+  "include": ["src"]
+}
+`
+	initESLintConfig = `import js from "@eslint/js";
+
+export default [js.configs.recommended];
+`
+	initESLintTSConfig = `import js from "@eslint/js";
+import tseslint from "typescript-eslint";
+
+export default tseslint.config(js.configs.recommended, ...tseslint.configs.recommended);
+`
+)
+
+// initFiles returns the files a project starts with, by path
+func initFiles(answers initAnswers) (map[string][]byte, error) {
+	manifest := initPackageJSON{
+		Name:       answers.Name,
+		Version:    answers.Version,
+		Private:    len(answers.Workspaces) > 0,
+		Main:       answers.Main,
+		Scripts:    map[string]string{"test": answers.Test},
+		Workspaces: answers.Workspaces,
+		License:    answers.License,
+	}
+	files := map[string][]byte{}
+	devDependencies := map[string]string{}
+	if answers.TypeScript {
+		manifest.Scripts["build"] = "tsc"
+		devDependencies["typescript"] = "^5.0.0"
+		files["tsconfig.json"] = []byte(initTSConfig)
+	}
+	if answers.ESLint {
+		manifest.Scripts["lint"] = "eslint ."
+		devDependencies["eslint"] = "^9.0.0"
+		devDependencies["@eslint/js"] = "^9.0.0"
+		files["eslint.config.mjs"] = []byte(initESLintConfig)
+		if answers.TypeScript {
+			devDependencies["typescript-eslint"] = "^8.0.0"
+			files["eslint.config.mjs"] = []byte(initESLintTSConfig)
+		}
+	}
+	if len(devDependencies) > 0 {
+		manifest.DevDependencies = devDependencies
+	}
+
+	// Without HTML escaping, so the && in the default test script stays
+	// readable
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return nil, err
+	}
+	files["package.json"] = buf.Bytes()
+	return files, nil
+}
+
+// Init runs caladan init, writing a package.json (and any scaffolded config)
+// into directory. Files that already exist are never overwritten
+func Init(directory string, opts InitOptions) error {
+	answers := defaultInitAnswers(directory)
+	if !opts.Yes {
+		var err error
+		answers, err = promptInit(&prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}, answers)
+		if err != nil {
+			return err
+		}
+	} else if err := validatePackageName(answers.Name); err != nil {
+		return fmt.Errorf("%v, run without --yes to pick another", err)
+	}
+
+	files, err := initFiles(answers)
+	if err != nil {
+		return err
+	}
+	for path := range files {
+		if _, err := os.Stat(filepath.Join(directory, path)); err == nil {
+			return fmt.Errorf("%s already exists", filepath.Join(directory, path))
+		}
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	for _, glob := range answers.Workspaces {
+		// packages/* gets its packages directory, ready for the first one
+		if dir, ok := strings.CutSuffix(glob, "/*"); ok && !strings.ContainsAny(dir, "*?[") {
+			if err := os.MkdirAll(filepath.Join(directory, dir), 0755); err != nil {
+				return err
+			}
+		}
+	}
+	for _, path := range []string{"package.json", "tsconfig.json", "eslint.config.mjs"} {
+		if data, ok := files[path]; ok {
+			if err := os.WriteFile(filepath.Join(directory, path), data, 0644); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %s\n", filepath.Join(directory, path))
+		}
+	}
+	if answers.TypeScript || answers.ESLint {
+		fmt.Printf("Run caladan install %s to install the dev dependencies\n", directory)
+	}
+	return nil
+}
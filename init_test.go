@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidatePackageName(t *testing.T) {
+	for _, name := range []string{"caladan", "@corp/http-client", "a.b_c-d"} {
+		if err := validatePackageName(name); err != nil {
+			t.Errorf("validatePackageName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Caladan", ".hidden", "_under", "@corp", "@corp/a/b", "with space", "node_modules", "a~b"} {
+		if err := validatePackageName(name); err == nil {
+			t.Errorf("validatePackageName(%q) = nil, want an error", name)
+		}
+	}
+}
+
+func TestValidateLicense(t *testing.T) {
+	for _, license := range []string{"MIT", "(MIT OR Apache-2.0)", "GPL-2.0-or-later WITH Classpath-exception-2.0", "Apache-2.0 AND (MIT OR BSD-3-Clause)", "GPL-3.0+", "UNLICENSED", "SEE LICENSE IN LICENSE.md", "LicenseRef-Corp"} {
+		if err := validateLicense(license); err != nil {
+			t.Errorf("validateLicense(%q) = %v", license, err)
+		}
+	}
+	for _, license := range []string{"", "mit", "MIT OR", "(MIT", "MIT Apache-2.0", "MIT WITH nothing", "Proprietary"} {
+		if err := validateLicense(license); err == nil {
+			t.Errorf("validateLicense(%q) = nil, want an error", license)
+		}
+	}
+}
+
+func TestPromptInit(t *testing.T) {
+	// An invalid name and license are asked for again, and blank answers
+	// take the defaults
+	input := strings.Join([]string{"Bad Name", "app", "", "Proprietary", "MIT", "y", "", "vitest", "packages/*", "y"}, "\n") + "\n"
+	p := &prompter{in: bufio.NewReader(strings.NewReader(input)), out: io.Discard}
+	answers, err := promptInit(p, initAnswers{Name: "dir", Version: "1.0.0", License: "ISC", Main: "index.js", Test: defaultTestScript})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := initAnswers{Name: "app", Version: "1.0.0", License: "MIT", Main: "dist/index.js", Test: "vitest", Workspaces: []string{"packages/*"}, TypeScript: true, ESLint: true}
+	if !reflect.DeepEqual(answers, want) {
+		t.Errorf("answers = %+v, want %+v", answers, want)
+	}
+
+	// Input running out takes the defaults for the rest
+	p = &prompter{in: bufio.NewReader(strings.NewReader("lib\n")), out: io.Discard}
+	answers, err = promptInit(p, defaultInitAnswers("."))
+	if err != nil || answers.Name != "lib" || answers.License != "ISC" || answers.TypeScript {
+		t.Errorf("answers = %+v, %v", answers, err)
+	}
+}
+
+func TestInitYes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "my-app")
+	if err := Init(dir, InitOptions{Yes: true}); err != nil {
+		t.Fatal(err)
+	}
+	data := readTestFile(t, filepath.Join(dir, "package.json"))
+	var manifest initPackageJSON
+	if err := json.Unmarshal([]byte(data), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Name != "my-app" || manifest.Version != "1.0.0" || manifest.License != "ISC" || manifest.Scripts["test"] != defaultTestScript {
+		t.Errorf("package.json = %s", data)
+	}
+	if !strings.Contains(data, `"test": "echo \"Error: no test specified\" && exit 1"`) {
+		t.Errorf("package.json = %s, want the test script unescaped", data)
+	}
+	if err := Init(dir, InitOptions{Yes: true}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("second Init() error = %v, want it to refuse", err)
+	}
+}
+
+func TestInitFiles(t *testing.T) {
+	files, err := initFiles(initAnswers{Name: "mono", Version: "0.1.0", License: "MIT", Test: "vitest", Workspaces: []string{"packages/*"}, TypeScript: true, ESLint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest initPackageJSON
+	if err := json.Unmarshal(files["package.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Private || manifest.Scripts["build"] != "tsc" || manifest.Scripts["lint"] != "eslint ." {
+		t.Errorf("package.json = %s", files["package.json"])
+	}
+	for _, dep := range []string{"typescript", "eslint", "@eslint/js", "typescript-eslint"} {
+		if manifest.DevDependencies[dep] == "" {
+			t.Errorf("devDependencies = %v, missing %s", manifest.DevDependencies, dep)
+		}
+	}
+	if files["tsconfig.json"] == nil || !strings.Contains(string(files["eslint.config.mjs"]), "typescript-eslint") {
+		t.Errorf("files = %v, want tsconfig.json and a TypeScript ESLint config", files)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Integrity algorithms caladan can verify, strongest first
+var integrityAlgorithms = []string{"sha512", "sha256", "sha1"}
+
+// parseIntegrity picks the strongest supported hash out of an SRI integrity
+// string, which may list several space-separated hashes. An empty integrity
+// returns an empty algorithm
+func parseIntegrity(integrity string) (string, []byte, error) {
+	if integrity == "" {
+		return "", nil, nil
+	}
+
+	digests := make(map[string]string)
+	for _, entry := range strings.Fields(integrity) {
+		algorithm, digest, ok := strings.Cut(entry, "-")
+		if !ok {
+			continue
+		}
+		// Options after a '?' don't affect the hash
+		digest, _, _ = strings.Cut(digest, "?")
+		if _, seen := digests[algorithm]; !seen {
+			digests[algorithm] = digest
+		}
+	}
+
+	for _, algorithm := range integrityAlgorithms {
+		digest, ok := digests[algorithm]
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			return "", nil, fmt.Errorf("error decoding integrity hash: %v", err)
+		}
+		return algorithm, decoded, nil
+	}
+
+	return "", nil, fmt.Errorf("unsupported integrity check: %s", integrity)
+}
+
+// normalizeIntegrity returns a package's integrity, converting a legacy hex
+// sha1 shasum into SRI form when that's all there is
+func normalizeIntegrity(integrity, shasum string) (string, error) {
+	if integrity != "" || shasum == "" {
+		return integrity, nil
+	}
+	digest, err := hex.DecodeString(shasum)
+	if err != nil || len(digest) != 20 {
+		return "", fmt.Errorf("invalid shasum: %s", shasum)
+	}
+	return "sha1-" + base64.StdEncoding.EncodeToString(digest), nil
+}
+
+// hasSHA512 reports whether an integrity string includes a sha512 hash
+func hasSHA512(integrity string) bool {
+	for _, entry := range strings.Fields(integrity) {
+		if strings.HasPrefix(entry, "sha512-") {
+			return true
+		}
+	}
+	return false
+}
+
+// saveBackfilledIntegrity writes computed integrity into a lockfile
+func saveBackfilledIntegrity(lockfilePath string, integrities map[string]string) error {
+	packageLock, err := readLockFile(lockfilePath)
+	if err != nil {
+		return fmt.Errorf("error reading lockfile: %v", err)
+	}
+	if err := backfillIntegrity(packageLock.Packages, integrities); err != nil {
+		return err
+	}
+	if err := writeLockFile(lockfilePath, packageLock); err != nil {
+		return fmt.Errorf("error writing lockfile: %v", err)
+	}
+	return nil
+}
+
+// backfillIntegrity sets the integrity of lockfile entries, keeping every
+// other field of each entry as it was
+func backfillIntegrity(packages map[string]json.RawMessage, integrities map[string]string) error {
+	for path, integrity := range integrities {
+		raw, ok := packages[path]
+		if !ok {
+			continue
+		}
+
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return fmt.Errorf("error parsing lockfile entry %s: %v", path, err)
+		}
+		value, err := json.Marshal(integrity)
+		if err != nil {
+			return err
+		}
+		entry["integrity"] = value
+		delete(entry, "shasum")
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		packages[path] = data
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseIntegrity(t *testing.T) {
+	tests := []struct {
+		name          string
+		integrity     string
+		wantAlgorithm string
+		wantLen       int
+		wantErr       bool
+	}{
+		{name: "empty", integrity: ""},
+		{name: "sha1", integrity: "sha1-2jmj7l5rSw0yVb/vlWAYkK/YBwk=", wantAlgorithm: "sha1", wantLen: 20},
+		{
+			name:          "strongest of several",
+			integrity:     "sha1-2jmj7l5rSw0yVb/vlWAYkK/YBwk= sha512-z4PhNX7vuL3xVChQ1m2AB9Yg5AULVxXcg/SpIdNs6c5H0NE8XYXysP+DGNKHfuwvY7kxvUdBeoGlODJ6+SfaPg==",
+			wantAlgorithm: "sha512",
+			wantLen:       64,
+		},
+		{name: "unsupported", integrity: "md5-1B2M2Y8AsgTpgAmY7PhCfg==", wantErr: true},
+		{name: "bad base64", integrity: "sha512-!!!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algorithm, digest, err := parseIntegrity(tt.integrity)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIntegrity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if algorithm != tt.wantAlgorithm || len(digest) != tt.wantLen {
+				t.Errorf("parseIntegrity() = %s with %d bytes, want %s with %d", algorithm, len(digest), tt.wantAlgorithm, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestNormalizeIntegrity(t *testing.T) {
+	got, err := normalizeIntegrity("", "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	if err != nil || got != "sha1-2jmj7l5rSw0yVb/vlWAYkK/YBwk=" {
+		t.Errorf("normalizeIntegrity() of a shasum = %q, %v", got, err)
+	}
+
+	got, err = normalizeIntegrity("sha512-abc", "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+	if err != nil || got != "sha512-abc" {
+		t.Errorf("normalizeIntegrity() with an integrity = %q, %v, want it kept", got, err)
+	}
+
+	if _, err := normalizeIntegrity("", "not-hex"); err == nil {
+		t.Errorf("normalizeIntegrity() of an invalid shasum succeeded")
+	}
+}
+
+func TestBackfillIntegrity(t *testing.T) {
+	packages := map[string]json.RawMessage{
+		"node_modules/a": json.RawMessage(`{"version":"1.0.0","resolved":"https://example.com/a.tgz","shasum":"da39a3ee5e6b4b0d3255bfef95601890afd80709"}`),
+		"node_modules/b": json.RawMessage(`{"version":"1.0.0"}`),
+	}
+	if err := backfillIntegrity(packages, map[string]string{"node_modules/a": "sha512-abc"}); err != nil {
+		t.Fatalf("backfillIntegrity() error = %v", err)
+	}
+
+	want := `{"integrity":"sha512-abc","resolved":"https://example.com/a.tgz","version":"1.0.0"}`
+	if got := string(packages["node_modules/a"]); got != want {
+		t.Errorf("entry = %s, want %s", got, want)
+	}
+	if got := string(packages["node_modules/b"]); got != `{"version":"1.0.0"}` {
+		t.Errorf("untouched entry changed to %s", got)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// errInterrupted is the cause of an install's context being cancelled by
+// Ctrl-C or SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// withInterrupt returns a context that's cancelled with errInterrupted on
+// the first Ctrl-C (or SIGTERM), so downloads stop and extractions finish
+// the file they're writing before the install rolls back. A second one
+// exits straight away, and the journal has the next install clean up. stop
+// stops listening for signals
+func withInterrupt(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+		fmt.Fprintln(os.Stderr, "\n"+colorWarn("Interrupted, stopping (Ctrl-C again to quit now)"))
+		cancel(errInterrupted)
+		select {
+		case <-signals:
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// interrupted reports whether ctx was cancelled by withInterrupt
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errInterrupted)
+}
+
+// resumeCommand is the command line that picks an interrupted install back
+// up, with arguments quoted for the shell where they need it
+func resumeCommand(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`|&;<>()*?[]{}~#!") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted[i] = arg
+	}
+	return "caladan " + strings.Join(quoted, " ")
+}
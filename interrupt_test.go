@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestResumeCommand(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"install", "--http3", "."}, "caladan install --http3 ."},
+		{[]string{"update", "my app", "lodash@^4"}, "caladan update 'my app' lodash@^4"},
+		{[]string{"install", "it's"}, `caladan install 'it'\''s'`},
+		{[]string{"install", ""}, "caladan install ''"},
+	} {
+		if got := resumeCommand(tt.args...); got != tt.want {
+			t.Errorf("resumeCommand(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
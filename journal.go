@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Packages are extracted into a staging directory in the virtual store
+// directory (.caladan next to node_modules by default) and only swapped into
+// place once the whole install has succeeded, so node_modules is always
+// either the previous install or the new one. The journal records how far an
+// install got, so one that was killed part way through is cleaned up by the
+// next
+const (
+	stateDirName    = ".caladan"
+	stagingDirName  = "node_modules.staging"
+	previousDirName = "node_modules.previous"
+	journalFileName = "journal.json"
+)
+
+// Journal states
+const (
+	journalStaging  = "staging"  // Packages are being extracted into staging
+	journalSwapping = "swapping" // Staging is replacing node_modules
+	// The install was stopped with Ctrl-C and is rolling back
+	journalInterrupted = "interrupted"
+)
+
+type installJournal struct {
+	State string `json:"state"`
+}
+
+// installTransaction is an install in progress
+type installTransaction struct {
+	nodeModulesPath string
+	stateDir        string
+	stagingPath     string
+	previousPath    string
+	journalPath     string
+	durability      string   // What to sync before and after swapping, see syncTree
+	clean           bool     // Replace all of node_modules, not just the packages caladan installed
+	removed         []string // Packages removed from the project, whose links aren't kept
+	done            bool
+}
+
+// keptEntries are kept in node_modules across installs: tool caches, and
+// caladan's own state when the new install doesn't write its own
+var keptEntries = []string{".cache", stateDirName}
+
+func newInstallTransaction(nodeModulesPath, stateDir string) *installTransaction {
+	return &installTransaction{
+		nodeModulesPath: nodeModulesPath,
+		stateDir:        stateDir,
+		stagingPath:     filepath.Join(stateDir, stagingDirName),
+		previousPath:    filepath.Join(stateDir, previousDirName),
+		journalPath:     filepath.Join(stateDir, journalFileName),
+		durability:      durabilityNone,
+	}
+}
+
+// beginInstall recovers from any interrupted install into nodeModulesPath
+// and creates an empty staging directory in stateDir to install into. The
+// two must be on the same filesystem. durability is what gets synced to
+// disk along the way, empty meaning none
+func beginInstall(nodeModulesPath, stateDir, durability string) (*installTransaction, error) {
+	tx := newInstallTransaction(nodeModulesPath, stateDir)
+	if durability != "" {
+		tx.durability = durability
+	}
+	if err := tx.recover(); err != nil {
+		return nil, fmt.Errorf("error recovering from an interrupted install: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tx.nodeModulesPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tx.stagingPath, 0755); err != nil {
+		return nil, err
+	}
+	if err := tx.writeJournal(journalStaging); err != nil {
+		tx.finish()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// commit swaps the staged install into place and removes the previous one
+func (tx *installTransaction) commit() error {
+	// Flush the new install before it's the only copy
+	if err := syncTree(tx.stagingPath, tx.durability); err != nil {
+		return fmt.Errorf("error syncing the new install: %v", err)
+	}
+	if err := tx.writeJournal(journalSwapping); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(tx.nodeModulesPath); err == nil {
+		if err := os.Rename(tx.nodeModulesPath, tx.previousPath); err != nil {
+			return fmt.Errorf("error moving node_modules aside: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(tx.stagingPath, tx.nodeModulesPath); err != nil {
+		// Put the previous install back before giving up
+		if _, statErr := os.Stat(tx.previousPath); statErr == nil {
+			os.Rename(tx.previousPath, tx.nodeModulesPath)
+		}
+		return fmt.Errorf("error moving the new install into node_modules: %v", err)
+	}
+	tx.done = true
+	if !tx.clean {
+		tx.keepUnmanaged()
+	}
+	if tx.durability != durabilityNone {
+		if err := syncPath(filepath.Dir(tx.nodeModulesPath)); err != nil {
+			return fmt.Errorf("error syncing node_modules: %v", err)
+		}
+	}
+
+	// Removes the previous install along with the journal
+	return tx.finish()
+}
+
+// merge moves the packages an add staged into node_modules, along with
+// their bins and the install state, leaving the rest of node_modules as it
+// is. A package nested in another staged package moves with it, and a
+// package node_modules has a link for keeps the link
+func (tx *installTransaction) merge(packages []PackageStats) error {
+	if err := syncTree(tx.stagingPath, tx.durability); err != nil {
+		return fmt.Errorf("error syncing the added packages: %v", err)
+	}
+
+	paths := make([]string, 0, len(packages))
+	for _, stats := range packages {
+		paths = append(paths, strings.TrimPrefix(stats.Path, "node_modules/"))
+	}
+	// Packages sort before the ones nested in them
+	slices.Sort(paths)
+	moved := []string{}
+	for _, rel := range paths {
+		if slices.ContainsFunc(moved, func(parent string) bool { return strings.HasPrefix(rel, parent+"/") }) {
+			continue
+		}
+		top, _, _ := strings.Cut(rel, "/node_modules/")
+		if info, err := os.Lstat(filepath.Join(tx.nodeModulesPath, top)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			fmt.Printf("Keeping linked %s instead of the installed copy\n", colorPackage(top))
+			continue
+		}
+		if err := tx.replace(rel); err != nil {
+			return err
+		}
+		moved = append(moved, rel)
+	}
+
+	bins, err := os.ReadDir(filepath.Join(tx.stagingPath, ".bin"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, bin := range bins {
+		if err := tx.replace(".bin/" + bin.Name()); err != nil {
+			return err
+		}
+	}
+	if err := tx.replace(stateDirName + "/" + stateFileName); err != nil {
+		return err
+	}
+
+	tx.done = true
+	if tx.durability != durabilityNone {
+		if err := syncPath(tx.nodeModulesPath); err != nil {
+			return fmt.Errorf("error syncing node_modules: %v", err)
+		}
+	}
+	return tx.finish()
+}
+
+// replace moves rel, a slash-separated path, from staging over whatever
+// node_modules has there
+func (tx *installTransaction) replace(rel string) error {
+	target := filepath.Join(tx.nodeModulesPath, filepath.FromSlash(rel))
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(tx.stagingPath, filepath.FromSlash(rel)), target); err != nil {
+		return fmt.Errorf("error moving %s into node_modules: %v", rel, err)
+	}
+	return nil
+}
+
+// keepUnmanaged moves what the previous node_modules held that caladan
+// doesn't install into the new one: linked packages (symlinks, which win
+// over an installed copy) other than removed ones, and keptEntries. It runs once the new install is
+// in place, so a failed install never loses them, and only warns when
+// something can't be moved
+func (tx *installTransaction) keepUnmanaged() {
+	move := func(rel string) {
+		target := filepath.Join(tx.nodeModulesPath, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = os.Rename(filepath.Join(tx.previousPath, rel), target)
+			if err == nil {
+				return
+			}
+		}
+		printWarning("couldn't keep %s in node_modules", rel)
+	}
+	keepLink := func(rel string) {
+		if slices.Contains(tx.removed, filepath.ToSlash(rel)) {
+			fmt.Printf("Removing linked %s\n", colorPackage(filepath.ToSlash(rel)))
+			return
+		}
+		target := filepath.Join(tx.nodeModulesPath, rel)
+		if _, err := os.Lstat(target); err == nil {
+			fmt.Printf("Keeping linked %s instead of the installed copy\n", colorPackage(filepath.ToSlash(rel)))
+			if err := os.RemoveAll(target); err != nil {
+				printWarning("couldn't replace %s with its link: %v", rel, err)
+				return
+			}
+		}
+		move(rel)
+	}
+
+	entries, err := os.ReadDir(tx.previousPath)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.Type()&os.ModeSymlink != 0:
+			keepLink(name)
+		case slices.Contains(keptEntries, name):
+			if _, err := os.Lstat(filepath.Join(tx.nodeModulesPath, name)); os.IsNotExist(err) {
+				move(name)
+			}
+		case strings.HasPrefix(name, "@") && entry.IsDir():
+			scoped, _ := os.ReadDir(filepath.Join(tx.previousPath, name))
+			for _, pkg := range scoped {
+				if pkg.Type()&os.ModeSymlink != 0 {
+					keepLink(filepath.Join(name, pkg.Name()))
+				}
+			}
+		}
+	}
+}
+
+// interrupt records that the install was stopped, before it rolls back. If
+// the rollback is cut short too, the next install finds the journal and
+// finishes it
+func (tx *installTransaction) interrupt() {
+	if err := tx.writeJournal(journalInterrupted); err != nil {
+		printWarning("couldn't write the install journal: %v", err)
+	}
+}
+
+// rollback discards the staged install, leaving node_modules as it was. It
+// does nothing once the install has been committed
+func (tx *installTransaction) rollback() error {
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+
+	fmt.Println("Rolling back: removing packages extracted during this install")
+	if err := os.RemoveAll(tx.stagingPath); err != nil {
+		return err
+	}
+	return tx.finish()
+}
+
+// recover finishes or undoes an install that was interrupted
+func (tx *installTransaction) recover() error {
+	data, err := os.ReadFile(tx.journalPath)
+	if os.IsNotExist(err) {
+		// Leftovers without a journal never got as far as being used
+		return tx.finish()
+	}
+	if err != nil {
+		return err
+	}
+
+	var journal installJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return tx.finish()
+	}
+
+	if journal.State == journalSwapping {
+		_, stagingErr := os.Stat(tx.stagingPath)
+		_, nodeModulesErr := os.Stat(tx.nodeModulesPath)
+		if stagingErr == nil && os.IsNotExist(nodeModulesErr) {
+			// Interrupted between moving node_modules aside and moving the
+			// new install in, so put the previous install back
+			if _, err := os.Stat(tx.previousPath); err == nil {
+				fmt.Println("Restoring node_modules from an interrupted install")
+				if err := os.Rename(tx.previousPath, tx.nodeModulesPath); err != nil {
+					return err
+				}
+			}
+		}
+	} else if journal.State == journalInterrupted {
+		fmt.Println("Cleaning up an install that was stopped with Ctrl-C")
+	} else {
+		fmt.Println("Cleaning up an interrupted install")
+	}
+
+	// Whatever is left in the state directory is no longer needed: either
+	// the staging directory of an abandoned install or the previous
+	// node_modules of a completed one
+	return tx.finish()
+}
+
+// writeJournal records the install's state
+func (tx *installTransaction) writeJournal(state string) error {
+	data, err := json.Marshal(installJournal{State: state})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(tx.journalPath, data); err != nil {
+		return err
+	}
+	if tx.durability != durabilityNone {
+		return syncPath(tx.stateDir)
+	}
+	return nil
+}
+
+// finish removes the journal and everything else the install left in the
+// state directory, and the directory itself once it's empty. Anything else
+// in a user-provided state directory is left alone
+func (tx *installTransaction) finish() error {
+	for _, path := range []string{tx.stagingPath, tx.previousPath, tx.journalPath} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	os.Remove(tx.stateDir)
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFile creates a file and its parent directories
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns a file's content, or "" if it doesn't exist
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInstallTransactionCommit(t *testing.T) {
+	workDir := t.TempDir()
+	writeTestFile(t, filepath.Join(workDir, "node_modules", "old", "index.js"), "old")
+
+	tx, err := beginInstall(filepath.Join(workDir, "node_modules"), filepath.Join(workDir, stateDirName), durabilityNone)
+	if err != nil {
+		t.Fatalf("beginInstall() error = %v", err)
+	}
+	writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+
+	// node_modules is untouched until the install commits
+	if got := readTestFile(t, filepath.Join(workDir, "node_modules", "old", "index.js")); got != "old" {
+		t.Errorf("previous install changed before commit")
+	}
+
+	if err := tx.commit(); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(workDir, "node_modules", "new", "index.js")); got != "new" {
+		t.Errorf("new install isn't in node_modules")
+	}
+	if got := readTestFile(t, filepath.Join(workDir, "node_modules", "old", "index.js")); got != "" {
+		t.Errorf("previous install wasn't replaced")
+	}
+	if _, err := os.Stat(filepath.Join(workDir, stateDirName)); !os.IsNotExist(err) {
+		t.Errorf("state directory left behind after commit")
+	}
+}
+
+func TestInstallTransactionKeepsUnmanaged(t *testing.T) {
+	for _, clean := range []bool{false, true} {
+		workDir := t.TempDir()
+		nodeModules := filepath.Join(workDir, "node_modules")
+		writeTestFile(t, filepath.Join(nodeModules, "old", "index.js"), "old")
+		writeTestFile(t, filepath.Join(nodeModules, ".cache", "babel", "entry"), "cached")
+		writeTestFile(t, filepath.Join(workDir, "local", "index.js"), "local")
+		writeTestFile(t, filepath.Join(workDir, "lib", "index.js"), "lib")
+		os.Symlink(filepath.Join(workDir, "local"), filepath.Join(nodeModules, "local"))
+		os.MkdirAll(filepath.Join(nodeModules, "@corp"), 0755)
+		os.Symlink(filepath.Join(workDir, "lib"), filepath.Join(nodeModules, "@corp", "lib"))
+
+		tx, err := beginInstall(nodeModules, filepath.Join(workDir, stateDirName), durabilityNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.clean = clean
+		writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+		// Installed from the registry, but linked locally
+		writeTestFile(t, filepath.Join(tx.stagingPath, "@corp", "lib", "index.js"), "registry")
+		if err := tx.commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"new/index.js":       "new",
+			"old/index.js":       "",
+			".cache/babel/entry": "cached",
+			"local/index.js":     "local",
+			"@corp/lib/index.js": "lib",
+		}
+		if clean {
+			want[".cache/babel/entry"] = ""
+			want["local/index.js"] = ""
+			want["@corp/lib/index.js"] = "registry"
+		}
+		for path, content := range want {
+			if got := readTestFile(t, filepath.Join(nodeModules, path)); got != content {
+				t.Errorf("clean=%v: %s = %q, want %q", clean, path, got, content)
+			}
+		}
+	}
+}
+
+func TestInstallTransactionDropsRemovedLinks(t *testing.T) {
+	workDir := t.TempDir()
+	nodeModules := filepath.Join(workDir, "node_modules")
+	writeTestFile(t, filepath.Join(workDir, "local", "index.js"), "local")
+	writeTestFile(t, filepath.Join(workDir, "lib", "index.js"), "lib")
+	os.MkdirAll(filepath.Join(nodeModules, "@corp"), 0755)
+	os.Symlink(filepath.Join(workDir, "local"), filepath.Join(nodeModules, "local"))
+	os.Symlink(filepath.Join(workDir, "lib"), filepath.Join(nodeModules, "@corp", "lib"))
+
+	tx, err := beginInstall(nodeModules, filepath.Join(workDir, stateDirName), durabilityNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.removed = []string{"@corp/lib"}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(nodeModules, "local", "index.js")); got != "local" {
+		t.Errorf("local link wasn't kept: %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(nodeModules, "@corp", "lib")); !os.IsNotExist(err) {
+		t.Errorf("removed @corp/lib link was kept: %v", err)
+	}
+}
+
+func TestInstallTransactionRollback(t *testing.T) {
+	workDir := t.TempDir()
+	writeTestFile(t, filepath.Join(workDir, "node_modules", "old", "index.js"), "old")
+
+	tx, err := beginInstall(filepath.Join(workDir, "node_modules"), filepath.Join(workDir, stateDirName), durabilityNone)
+	if err != nil {
+		t.Fatalf("beginInstall() error = %v", err)
+	}
+	writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+
+	if err := tx.rollback(); err != nil {
+		t.Fatalf("rollback() error = %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(workDir, "node_modules", "old", "index.js")); got != "old" {
+		t.Errorf("previous install wasn't kept")
+	}
+	if got := readTestFile(t, filepath.Join(workDir, "node_modules", "new", "index.js")); got != "" {
+		t.Errorf("package from the failed install is in node_modules")
+	}
+	if _, err := os.Stat(filepath.Join(workDir, stateDirName)); !os.IsNotExist(err) {
+		t.Errorf("state directory left behind after rollback")
+	}
+}
+
+func TestInstallTransactionRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+		// Set up the state an interrupted install left behind
+		setup   func(t *testing.T, tx *installTransaction)
+		wantOld string
+	}{
+		{
+			name:    "interrupted while staging",
+			journal: journalStaging,
+			setup: func(t *testing.T, tx *installTransaction) {
+				writeTestFile(t, filepath.Join(tx.nodeModulesPath, "old", "index.js"), "old")
+				writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+			},
+			wantOld: "old",
+		},
+		{
+			name:    "stopped with Ctrl-C",
+			journal: journalInterrupted,
+			setup: func(t *testing.T, tx *installTransaction) {
+				writeTestFile(t, filepath.Join(tx.nodeModulesPath, "old", "index.js"), "old")
+				writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+			},
+			wantOld: "old",
+		},
+		{
+			name:    "interrupted after moving node_modules aside",
+			journal: journalSwapping,
+			setup: func(t *testing.T, tx *installTransaction) {
+				writeTestFile(t, filepath.Join(tx.previousPath, "old", "index.js"), "old")
+				writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+			},
+			wantOld: "old",
+		},
+		{
+			name:    "interrupted after swapping in the new install",
+			journal: journalSwapping,
+			setup: func(t *testing.T, tx *installTransaction) {
+				writeTestFile(t, filepath.Join(tx.previousPath, "old", "index.js"), "old")
+				writeTestFile(t, filepath.Join(tx.nodeModulesPath, "new", "index.js"), "new")
+			},
+			wantOld: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := t.TempDir()
+			interrupted := newInstallTransaction(filepath.Join(workDir, "node_modules"), filepath.Join(workDir, stateDirName))
+			tt.setup(t, interrupted)
+			if err := interrupted.writeJournal(tt.journal); err != nil {
+				t.Fatal(err)
+			}
+
+			tx, err := beginInstall(filepath.Join(workDir, "node_modules"), filepath.Join(workDir, stateDirName), durabilityNone)
+			if err != nil {
+				t.Fatalf("beginInstall() error = %v", err)
+			}
+			defer tx.rollback()
+
+			if got := readTestFile(t, filepath.Join(workDir, "node_modules", "old", "index.js")); got != tt.wantOld {
+				t.Errorf("node_modules/old/index.js = %q, want %q", got, tt.wantOld)
+			}
+			entries, err := os.ReadDir(tx.stagingPath)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("staging directory isn't empty after recovery: %v %v", entries, err)
+			}
+			if _, err := os.Stat(tx.previousPath); !os.IsNotExist(err) {
+				t.Errorf("previous install left behind after recovery")
+			}
+		})
+	}
+}
+
+func TestInstallTransactionSharedStateDir(t *testing.T) {
+	workDir := t.TempDir()
+	stateDir := filepath.Join(workDir, "build")
+	writeTestFile(t, filepath.Join(stateDir, "bundle.zip"), "zip")
+
+	tx, err := beginInstall(filepath.Join(workDir, "build", "node_modules"), stateDir, durabilityNone)
+	if err != nil {
+		t.Fatalf("beginInstall() error = %v", err)
+	}
+	writeTestFile(t, filepath.Join(tx.stagingPath, "new", "index.js"), "new")
+	if err := tx.commit(); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+
+	if got := readTestFile(t, filepath.Join(stateDir, "node_modules", "new", "index.js")); got != "new" {
+		t.Errorf("new install isn't in the modules directory")
+	}
+	if got := readTestFile(t, filepath.Join(stateDir, "bundle.zip")); got != "zip" {
+		t.Errorf("commit removed a file it didn't create from the state directory")
+	}
+	if _, err := os.Stat(tx.journalPath); !os.IsNotExist(err) {
+		t.Errorf("journal left behind after commit")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// limiter bounds how many downloads or extractions run at once. Callers report
+// how each unit of work went so adaptive limiters can retune themselves
+type limiter interface {
+	Acquire(ctx context.Context, n int64) error
+	Release(n int64)
+
+	// done reports a finished unit of work that moved the given bytes
+	done(bytes int64)
+	// backoff reports that the other side is overloaded (429s, 5xxs)
+	backoff()
+	// current returns the limit in effect
+	current() int
+}
+
+// staticLimiter is a fixed-size limiter
+type staticLimiter struct {
+	*semaphore.Weighted
+	limit int
+}
+
+func newStaticLimiter(limit int64) *staticLimiter {
+	return &staticLimiter{Weighted: semaphore.NewWeighted(limit), limit: int(limit)}
+}
+
+func (l *staticLimiter) done(int64)   {}
+func (l *staticLimiter) backoff()     {}
+func (l *staticLimiter) current() int { return l.limit }
+
+// How often an adaptive limiter looks at its throughput, and how long it
+// ignores further backoffs after halving (a burst of 429s is one signal)
+const (
+	adaptiveWindow       = 500 * time.Millisecond
+	adaptiveBackoffQuiet = time.Second
+)
+
+// adaptiveLimiter is a limiter whose size changes while it's in use. It
+// hill-climbs on throughput, adding a slot while throughput keeps improving
+// and removing one when it drops, and halves when the server pushes back
+type adaptiveLimiter struct {
+	name               string
+	minLimit, maxLimit int
+
+	mu    sync.Mutex
+	limit int
+	inUse int
+	wake  chan struct{} // Closed and replaced whenever slots may have freed up
+
+	windowStart    time.Time
+	windowBytes    int64
+	lastThroughput float64
+	lastBackoff    time.Time
+
+	// Returns how busy the CPUs are from 0 to 1, nil when CPU doesn't matter
+	cpuBusy func() float64
+	now     func() time.Time
+}
+
+func newAdaptiveLimiter(name string, start, minLimit, maxLimit int) *adaptiveLimiter {
+	start = clampInt(start, minLimit, maxLimit)
+	return &adaptiveLimiter{
+		name:        name,
+		minLimit:    minLimit,
+		maxLimit:    maxLimit,
+		limit:       start,
+		wake:        make(chan struct{}),
+		windowStart: time.Now(),
+		now:         time.Now,
+	}
+}
+
+func (l *adaptiveLimiter) Acquire(ctx context.Context, n int64) error {
+	for {
+		l.mu.Lock()
+		if l.inUse+int(n) <= l.limit {
+			l.inUse += int(n)
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (l *adaptiveLimiter) Release(n int64) {
+	l.mu.Lock()
+	l.inUse -= int(n)
+	l.notify()
+	l.mu.Unlock()
+}
+
+func (l *adaptiveLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// notify wakes every waiter so they can re-check the limit. Must hold mu
+func (l *adaptiveLimiter) notify() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+func (l *adaptiveLimiter) done(bytes int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.windowBytes += bytes
+	now := l.now()
+	elapsed := now.Sub(l.windowStart)
+	if elapsed < adaptiveWindow {
+		return
+	}
+
+	throughput := float64(l.windowBytes) / elapsed.Seconds()
+	l.windowStart = now
+	l.windowBytes = 0
+
+	cpuSaturated := false
+	if l.cpuBusy != nil {
+		cpuSaturated = l.cpuBusy() > 0.9
+	}
+
+	switch {
+	case cpuSaturated && throughput <= l.lastThroughput:
+		// More workers would only fight over the CPU
+		l.limit = max(l.limit-1, l.minLimit)
+	case cpuSaturated:
+		// Hold steady
+	case l.lastThroughput == 0 || throughput > l.lastThroughput*1.05:
+		l.limit = min(l.limit+1, l.maxLimit)
+		l.notify()
+	case throughput < l.lastThroughput*0.85:
+		l.limit = max(l.limit-1, l.minLimit)
+	}
+	l.lastThroughput = throughput
+}
+
+func (l *adaptiveLimiter) backoff() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastBackoff) < adaptiveBackoffQuiet {
+		return
+	}
+	l.lastBackoff = now
+
+	previous := l.limit
+	l.limit = max(l.limit/2, l.minLimit)
+	l.lastThroughput = 0
+	if l.limit != previous {
+		fmt.Printf("Backing off: %s concurrency %d -> %d\n", l.name, previous, l.limit)
+	}
+}
+
+// newInstallLimiters returns the limiters for downloads and extractions.
+// Unless pinned with --static-concurrency they start at the configured values
+// and adapt from there. Downloads back off no lower than 4, or the configured
+// value when it's lower, so asking for fewer is respected. A configured value
+// is also the most they climb back up to; only the defaults may grow past it
+func newInstallLimiters(opts InstallOptions) (limiter, limiter) {
+	if opts.StaticConcurrency {
+		return newStaticLimiter(opts.networkConcurrency()), newStaticLimiter(opts.tarWorkers())
+	}
+
+	network := int(opts.networkConcurrency())
+	networkCeiling := network
+	if opts.NetworkConcurrency == 0 {
+		networkCeiling = max(network, maxConcurrency/4)
+	}
+	httpLimiter := newAdaptiveLimiter("network", network, min(network, 4), networkCeiling)
+
+	tarWorkers := int(opts.tarWorkers())
+	tarCeiling := tarWorkers
+	if opts.TarWorkers == 0 {
+		tarCeiling = max(tarWorkers, runtime.NumCPU()*4)
+	}
+	tarLimiter := newAdaptiveLimiter("extraction", tarWorkers, 1, tarCeiling)
+	tarLimiter.cpuBusy = cpuSampler()
+
+	return httpLimiter, tarLimiter
+}
+
+// clampInt limits v to the range [lo, hi]
+func clampInt(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
+
+// cpuSampler returns a function reporting how busy the CPUs were, from 0 to 1,
+// since it was last called. It uses the runtime's own CPU accounting, which
+// is an estimate but good enough to tell whether extraction is CPU bound
+func cpuSampler() func() float64 {
+	sample := []metrics.Sample{{Name: "/cpu/classes/total:cpu-seconds"}, {Name: "/cpu/classes/idle:cpu-seconds"}}
+	read := func() (float64, float64) {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() != metrics.KindFloat64 || sample[1].Value.Kind() != metrics.KindFloat64 {
+			return 0, 0
+		}
+		return sample[0].Value.Float64(), sample[1].Value.Float64()
+	}
+
+	var mu sync.Mutex
+	lastTotal, lastIdle := read()
+
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// total is the CPU time GOMAXPROCS made available, idle the part of it unused
+		total, idle := read()
+		available := total - lastTotal
+		busy := available - (idle - lastIdle)
+		lastTotal, lastIdle = total, idle
+
+		if available <= 0 {
+			return 0
+		}
+		return min(busy/available, 1)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock returns a now function that advances by step on every call
+func fakeClock(step time.Duration) func() time.Time {
+	now := time.Unix(0, 0)
+	return func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+}
+
+func TestAdaptiveLimiterHillClimbs(t *testing.T) {
+	l := newAdaptiveLimiter("test", 4, 1, 8)
+	l.now = fakeClock(adaptiveWindow)
+	l.windowStart = time.Unix(0, 0)
+
+	// Throughput keeps improving, so the limit grows until the maximum
+	for i := 1; i <= 10; i++ {
+		l.done(int64(i * 1000))
+	}
+	if got := l.current(); got != 8 {
+		t.Errorf("limit after improving throughput = %d, want 8", got)
+	}
+
+	// A sharp drop gives a slot back
+	l.done(100)
+	if got := l.current(); got != 7 {
+		t.Errorf("limit after throughput drop = %d, want 7", got)
+	}
+}
+
+func TestAdaptiveLimiterBackoff(t *testing.T) {
+	l := newAdaptiveLimiter("test", 16, 4, 64)
+	l.now = fakeClock(adaptiveBackoffQuiet / 4)
+
+	l.backoff()
+	if got := l.current(); got != 8 {
+		t.Errorf("limit after backoff = %d, want 8", got)
+	}
+
+	// Further backoffs within the quiet period are part of the same burst
+	l.backoff()
+	if got := l.current(); got != 8 {
+		t.Errorf("limit after second backoff = %d, want 8", got)
+	}
+
+	l.now = fakeClock(adaptiveBackoffQuiet * 2)
+	l.backoff()
+	l.backoff()
+	if got := l.current(); got != 4 {
+		t.Errorf("limit after repeated backoffs = %d, want minimum 4", got)
+	}
+}
+
+func TestAdaptiveLimiterCPUSaturated(t *testing.T) {
+	l := newAdaptiveLimiter("test", 4, 1, 8)
+	l.now = fakeClock(adaptiveWindow)
+	l.windowStart = time.Unix(0, 0)
+	l.cpuBusy = func() float64 { return 1 }
+
+	l.done(1000)
+	l.done(1000)
+	if got := l.current(); got != 3 {
+		t.Errorf("limit with saturated CPU = %d, want 3", got)
+	}
+}
+
+func TestAdaptiveLimiterWakesWaiters(t *testing.T) {
+	l := newAdaptiveLimiter("test", 1, 1, 1)
+	ctx := context.Background()
+
+	if err := l.Acquire(ctx, 1); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		l.Acquire(ctx, 1)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second Acquire() succeeded while the limit was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.Release(1)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("second Acquire() wasn't woken by Release()")
+	}
+}
+
+func TestInstallLimitersKeepLowConcurrency(t *testing.T) {
+	httpLimiter, _ := newInstallLimiters(InstallOptions{NetworkConcurrency: 2})
+	if got := httpLimiter.current(); got != 2 {
+		t.Errorf("network limit = %d, want the configured 2", got)
+	}
+	httpLimiter.backoff()
+	if got := httpLimiter.current(); got != 2 {
+		t.Errorf("network limit after backoff = %d, want 2", got)
+	}
+}
+
+func TestInstallLimitersNeverExceedConfigured(t *testing.T) {
+	httpLimiter, tarLimiter := newInstallLimiters(InstallOptions{NetworkConcurrency: 6, TarWorkers: 3})
+	for _, tc := range []struct {
+		l    limiter
+		want int
+	}{{httpLimiter, 6}, {tarLimiter, 3}} {
+		l := tc.l.(*adaptiveLimiter)
+		l.now = fakeClock(adaptiveWindow)
+		l.windowStart = time.Unix(0, 0)
+		l.cpuBusy = nil
+
+		// Throughput keeps improving, which would grow a default limit
+		for i := 1; i <= 20; i++ {
+			l.done(int64(i * 1000))
+			if got := l.current(); got > tc.want {
+				t.Fatalf("%s limit = %d, want at most the configured %d", l.name, got, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lockfileChange describes how a single lockfile path differs between two lockfiles
+type lockfileChange struct {
+	Path       string
+	OldVersion string // Empty when the path was added
+	NewVersion string // Empty when the path was removed
+}
+
+// readLockFile reads and parses a package-lock.json file
+func readLockFile(lockfilePath string) (*PackageLock, error) {
+	data, err := os.ReadFile(lockfilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var packageLock PackageLock
+	if err := json.Unmarshal(data, &packageLock); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", lockfilePath, err)
+	}
+	if packageLock.Packages == nil {
+		packageLock.Packages = make(map[string]json.RawMessage)
+	}
+
+	return &packageLock, nil
+}
+
+// writeLockFile writes a lockfile back to disk, entries are sorted by path
+func writeLockFile(lockfilePath string, packageLock *PackageLock) error {
+	out, err := json.MarshalIndent(packageLock, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to generate lockfile JSON: %v", err)
+	}
+	return os.WriteFile(lockfilePath, append(out, '\n'), 0644)
+}
+
+// lockfileEntryVersion returns the version recorded in a raw lockfile entry
+func lockfileEntryVersion(raw json.RawMessage) string {
+	var entry struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return ""
+	}
+	return entry.Version
+}
+
+// lockfileParentPath returns the path of the package that owns a nested
+// node_modules entry, or "" for packages installed at the root
+func lockfileParentPath(path string) string {
+	idx := strings.LastIndex(path, "/node_modules/")
+	if idx == -1 {
+		return ""
+	}
+	return path[:idx]
+}
+
+// findLockfileDependency walks up from fromPath the same way node's module
+// resolution does and returns the path that depName resolves to
+func findLockfileDependency[V any](packages map[string]V, fromPath, depName string) (string, bool) {
+	for p := fromPath; ; p = lockfileParentPath(p) {
+		candidate := "node_modules/" + depName
+		if p != "" {
+			candidate = p + "/node_modules/" + depName
+		}
+		if _, ok := packages[candidate]; ok {
+			return candidate, true
+		}
+		if p == "" {
+			return "", false
+		}
+	}
+}
+
+// reachableLockfilePaths returns every lockfile path that can be reached from the
+// root package. It returns nil when the lockfile has no root entry to start from
+func reachableLockfilePaths(packages map[string]json.RawMessage) map[string]bool {
+	if _, ok := packages[""]; !ok {
+		return nil
+	}
+	return reachableFrom(packages, "")
+}
+
+// reachableFrom returns every lockfile path that can be reached from start,
+// start included
+func reachableFrom(packages map[string]json.RawMessage, start string) map[string]bool {
+	reachable := make(map[string]bool)
+	var visit func(path string)
+	visit = func(path string) {
+		if reachable[path] {
+			return
+		}
+		reachable[path] = true
+
+		var entry PackageInfo
+		if err := json.Unmarshal(packages[path], &entry); err != nil {
+			return
+		}
+
+		depMaps := []map[string]string{entry.Dependencies, entry.OptionalDependencies, entry.PeerDependencies}
+		if path == "" {
+			// Only the root's devDependencies are ever installed
+			depMaps = append(depMaps, entry.DevDependencies)
+		}
+		for _, deps := range depMaps {
+			for name := range deps {
+				if depPath, ok := findLockfileDependency(packages, path, name); ok {
+					visit(depPath)
+				}
+			}
+		}
+	}
+	visit(start)
+
+	return reachable
+}
+
+// placeLockfilePackage adds a resolved package and its dependencies to the
+// lockfile at path. Dependencies are hoisted to the root when nothing is in
+// the way, reuse an existing entry with the same version, and are nested
+// under the package otherwise
+func placeLockfilePackage(packages map[string]json.RawMessage, pkg PackageInfo, path string) error {
+	data, err := json.Marshal(pkg)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", pkg.Name, err)
+	}
+	packages[path] = data
+
+	// Sort for a deterministic layout
+	depNames := make([]string, 0, len(pkg.ResolvedDeps))
+	for name := range pkg.ResolvedDeps {
+		depNames = append(depNames, name)
+	}
+	sort.Strings(depNames)
+
+	for _, name := range depNames {
+		dep := pkg.ResolvedDeps[name]
+		existingPath, found := findLockfileDependency(packages, path, name)
+		if found && lockfileEntryVersion(packages[existingPath]) == dep.Version {
+			continue
+		}
+
+		depPath := "node_modules/" + name
+		if found {
+			// A different version is visible from here, so shadow it
+			depPath = path + "/node_modules/" + name
+		}
+		if err := placeLockfilePackage(packages, dep, depPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diffLockfiles compares the packages of two lockfiles, sorted by path
+func diffLockfiles(oldPackages, newPackages map[string]json.RawMessage) []lockfileChange {
+	changes := []lockfileChange{}
+
+	for path, raw := range oldPackages {
+		if path == "" {
+			continue
+		}
+		oldVersion := lockfileEntryVersion(raw)
+		newRaw, ok := newPackages[path]
+		if !ok {
+			changes = append(changes, lockfileChange{Path: path, OldVersion: oldVersion})
+			continue
+		}
+		if newVersion := lockfileEntryVersion(newRaw); newVersion != oldVersion {
+			changes = append(changes, lockfileChange{Path: path, OldVersion: oldVersion, NewVersion: newVersion})
+		}
+	}
+
+	for path, raw := range newPackages {
+		if path == "" {
+			continue
+		}
+		if _, ok := oldPackages[path]; !ok {
+			changes = append(changes, lockfileChange{Path: path, NewVersion: lockfileEntryVersion(raw)})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// RenderLockfileDiff renders lockfile changes one per line
+func RenderLockfileDiff(changes []lockfileChange) string {
+	var builder strings.Builder
+
+	for _, change := range changes {
+		builder.WriteString(renderLockfileChange(change) + "\n")
+	}
+
+	return builder.String()
+}
+
+// renderLockfileChange renders a single change, + for added, - for removed,
+// and ~ for a version change
+func renderLockfileChange(change lockfileChange) string {
+	switch {
+	case change.OldVersion == "":
+		return fmt.Sprintf("+ %s@%s", change.Path, change.NewVersion)
+	case change.NewVersion == "":
+		return fmt.Sprintf("- %s@%s", change.Path, change.OldVersion)
+	default:
+		return fmt.Sprintf("~ %s %s -> %s", change.Path, change.OldVersion, change.NewVersion)
+	}
+}
+
+// hiddenLockfileName is npm's record of what's in node_modules. npm reads it
+// instead of walking the tree when it's newer than every package folder
+const hiddenLockfileName = ".package-lock.json"
+
+// writeHiddenLockFile writes node_modules/.package-lock.json for the packages
+// an install put there, so npm trusts the tree instead of reinstalling it.
+// Entries are the lockfile's own, with any integrity computed during the
+// install, and it has to be written after anything that touches the package
+// folders, scripts included, or npm sees it as stale
+func writeHiddenLockFile(nodeModulesPath string, packageLock *PackageLock, summary *InstallSummary) error {
+	packages := make(map[string]json.RawMessage, len(summary.Packages))
+	for _, stats := range summary.Packages {
+		if raw, ok := packageLock.Packages[stats.Path]; ok {
+			packages[stats.Path] = raw
+		}
+	}
+	if err := backfillIntegrity(packages, summary.backfilled); err != nil {
+		return err
+	}
+	hidden := PackageLock{
+		Name:            packageLock.Name,
+		Version:         packageLock.Version,
+		LockfileVersion: 3,
+		Requires:        true,
+		Packages:        packages,
+	}
+	out, err := json.MarshalIndent(hidden, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(nodeModulesPath, hiddenLockfileName), append(out, '\n'))
+}
+
+// jsonKeyLines maps the keys of a JSON document, three levels deep, to the
+// line each is on: a lockfile's top level, its packages, and their fields,
+// or a package.json's dependencies. Keys are joined with a NUL, like
+// "packages\x00node_modules/ms\x00integrity"
+func jsonKeyLines(data []byte) (map[string]int, error) {
+	lines := make(map[string]int)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	line, counted := 1, 0
+	lineAt := func(offset int64) int {
+		line += bytes.Count(data[counted:offset], []byte("\n"))
+		counted = int(offset)
+		return line
+	}
+
+	var walk func(path []string) error
+	walk = func(path []string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'):
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				keyPath := append(path[:len(path):len(path)], key.(string))
+				if len(keyPath) <= 3 {
+					lines[strings.Join(keyPath, "\x00")] = lineAt(decoder.InputOffset())
+				}
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+		case json.Delim('['):
+			for decoder.More() {
+				if err := walk(path); err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+		}
+		return err
+	}
+	return lines, walk(nil)
+}
+
+// validateLockfilePath checks a packages key is a relative path whose
+// node_modules folders each hold a package name
+func validateLockfilePath(path string) error {
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "/") || strings.Contains(path, `\`) {
+		return fmt.Errorf("paths are relative and use /")
+	}
+	// Linked folders outside the project start with .., nothing else may
+	// climb out of where it is
+	segments := strings.Split(path, "/")
+	leading := true
+	for _, segment := range segments {
+		leading = leading && segment == ".."
+		if segment == "" || segment == "." || (segment == ".." && !leading) {
+			return fmt.Errorf("empty, . and .. segments aren't allowed")
+		}
+	}
+	for i := 0; i < len(segments); i++ {
+		if segments[i] == "node_modules" {
+			if i+1 == len(segments) || segments[i+1] == "node_modules" {
+				return fmt.Errorf("node_modules isn't followed by a package name")
+			}
+			if strings.HasPrefix(segments[i+1], "@") {
+				if i+2 == len(segments) || segments[i+2] == "node_modules" {
+					return fmt.Errorf("scope %s isn't followed by a package name", segments[i+1])
+				}
+				i++
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+// supportedLockfileVersions are the lockfileVersions with a packages section
+var supportedLockfileVersions = map[int]bool{2: true, 3: true}
+
+// validateLockfile checks a lockfile's structure before it's installed: its
+// version, that every entry parses, has a sensible path, has somewhere to
+// download it from, and has an integrity that can be checked. Every problem
+// found is returned, with the line it's on
+func validateLockfile(data []byte) []LockfileProblem {
+	lines, err := jsonKeyLines(data)
+	if err != nil {
+		problem := LockfileProblem{Line: 1, Field: "(document)", Message: "invalid JSON: " + err.Error()}
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			problem.Line = 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n"))
+		}
+		return []LockfileProblem{problem}
+	}
+	lineOf := func(keys ...string) int {
+		// Fall back to the enclosing key when a field is missing
+		for ; len(keys) > 0; keys = keys[:len(keys)-1] {
+			if line, ok := lines[strings.Join(keys, "\x00")]; ok {
+				return line
+			}
+		}
+		return 1
+	}
+
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		return []LockfileProblem{{Line: 1, Field: "(document)", Message: "a lockfile is a JSON object"}}
+	}
+
+	problems := []LockfileProblem{}
+	var version int
+	if raw, ok := document["lockfileVersion"]; !ok {
+		problems = append(problems, LockfileProblem{Line: 1, Field: "lockfileVersion", Message: "missing, caladan reads lockfileVersion 2 and 3"})
+	} else if err := json.Unmarshal(raw, &version); err != nil || !supportedLockfileVersions[version] {
+		message := fmt.Sprintf("unsupported version %s, caladan reads lockfileVersion 2 and 3", raw)
+		if version == 1 {
+			message = "lockfileVersion 1 has no packages section, regenerate the lockfile with npm 7 or later"
+		}
+		problems = append(problems, LockfileProblem{Line: lineOf("lockfileVersion"), Field: "lockfileVersion", Message: message})
+	}
+
+	var packages map[string]json.RawMessage
+	if raw, ok := document["packages"]; !ok {
+		if version != 1 {
+			problems = append(problems, LockfileProblem{Line: 1, Field: "packages", Message: "missing, so there's nothing to install"})
+		}
+		return problems
+	} else if err := json.Unmarshal(raw, &packages); err != nil {
+		return append(problems, LockfileProblem{Line: lineOf("packages"), Field: "packages", Message: "expected an object of paths to entries"})
+	}
+
+	paths := make([]string, 0, len(packages))
+	for path := range packages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		field := fmt.Sprintf("packages[%q]", path)
+		problem := func(key, message string) {
+			name := field
+			if key != "" {
+				name += "." + key
+			}
+			problems = append(problems, LockfileProblem{Line: lineOf("packages", path, key), Field: name, Message: message})
+		}
+
+		if err := validateLockfilePath(path); err != nil {
+			problem("", "invalid path: "+err.Error())
+		}
+		var pkg PackageInfo
+		if err := json.Unmarshal(packages[path], &pkg); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) && typeErr.Field != "" {
+				problem(strings.SplitN(typeErr.Field, ".", 2)[0], fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value))
+			} else {
+				problem("", "invalid entry: "+err.Error())
+			}
+			continue
+		}
+		var flags struct {
+			Link     bool `json:"link"`
+			InBundle bool `json:"inBundle"`
+		}
+		json.Unmarshal(packages[path], &flags)
+
+		// The root and workspace folders are in the project, not downloaded
+		if strings.Contains(path, "node_modules/") && pkg.Resolved == "" && !flags.Link && !flags.InBundle {
+			problem("resolved", "missing, so there's nowhere to download it from")
+		}
+		if _, _, err := parseIntegrity(pkg.Integrity); err != nil {
+			problem("integrity", err.Error())
+		}
+		if _, err := normalizeIntegrity("", pkg.Shasum); err != nil {
+			problem("shasum", err.Error())
+		}
+	}
+	return problems
+}
+
+// checkLockfile returns a LockfileError for every problem validateLockfile
+// finds in a lockfile, nil when there are none
+func checkLockfile(lockfilePath string, data []byte) error {
+	if problems := validateLockfile(data); len(problems) > 0 {
+		return &LockfileError{Path: lockfilePath, Problems: problems}
+	}
+	return nil
+}
+
+// lockfileDrift is a direct dependency package.json and the lockfile's root
+// entry disagree on, because package.json was edited without reinstalling
+type lockfileDrift struct {
+	Name          string
+	Section       string // Where package.json has it, or the lockfile when package.json doesn't
+	ManifestRange string // Empty when package.json doesn't have it
+	LockfileRange string // Empty when the lockfile doesn't have it
+}
+
+// findLockfileDrift compares the dependencies, dev, and optional
+// dependencies of package.json with the ones the lockfile was generated
+// from. A version the lockfile pins is only drift when it's in another
+// section or the range no longer matches it
+func findLockfileDrift(manifest PackageInfo, packages map[string]json.RawMessage) []lockfileDrift {
+	var root PackageInfo
+	if raw, ok := packages[""]; !ok || json.Unmarshal(raw, &root) != nil {
+		return nil
+	}
+	type declared struct{ section, versionRange string }
+	collect := func(info PackageInfo) map[string]declared {
+		all := make(map[string]declared)
+		for _, section := range []string{"dependencies", "devDependencies", "optionalDependencies"} {
+			for name, versionRange := range (workspace{manifest: info}).sectionDeps(section) {
+				all[name] = declared{section, versionRange}
+			}
+		}
+		return all
+	}
+	wanted, locked := collect(manifest), collect(root)
+
+	drift := []lockfileDrift{}
+	for name, want := range wanted {
+		have, ok := locked[name]
+		if ok && have != want && have.section == want.section {
+			// caladan's own lockfiles have the version the range resolved to
+			if matches, err := GetMatchingVersions(driftRange(want.versionRange), []string{driftRange(have.versionRange)}); err == nil && len(matches) == 1 {
+				continue
+			}
+		}
+		if !ok || have != want {
+			drift = append(drift, lockfileDrift{Name: name, Section: want.section, ManifestRange: want.versionRange, LockfileRange: have.versionRange})
+		}
+	}
+	for name, have := range locked {
+		if _, ok := wanted[name]; !ok {
+			drift = append(drift, lockfileDrift{Name: name, Section: have.section, LockfileRange: have.versionRange})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Name < drift[j].Name })
+	return drift
+}
+
+// driftRange returns the semver range in a dependency spec, without the
+// npm: alias or workspace: protocol around it. Callers resolve catalog:
+// specs when they have the catalogs, otherwise any version matches them
+func driftRange(spec string) string {
+	if target, ok := strings.CutPrefix(spec, "npm:"); ok {
+		// The target's own name may be scoped, so its range follows the last @
+		if at := strings.LastIndex(target, "@"); at > 0 {
+			return target[at+1:]
+		}
+		return "*"
+	}
+	if strings.HasPrefix(spec, "catalog:") {
+		return "*"
+	}
+	if versionRange, ok := strings.CutPrefix(spec, "workspace:"); ok {
+		switch versionRange {
+		case "", "^", "~":
+			return "*"
+		}
+		return versionRange
+	}
+	return spec
+}
+
+// String describes the drift the way it's fixed, by reinstalling
+func (d lockfileDrift) String() string {
+	switch {
+	case d.LockfileRange == "":
+		return fmt.Sprintf("package.json %s has %s@%s, which isn't in the lockfile", d.Section, d.Name, d.ManifestRange)
+	case d.ManifestRange == "":
+		return fmt.Sprintf("the lockfile has %s@%s, which package.json no longer depends on", d.Name, d.LockfileRange)
+	default:
+		return fmt.Sprintf("package.json %s has %s@%s, the lockfile has %s", d.Section, d.Name, d.ManifestRange, d.LockfileRange)
+	}
+}
+
+// warnLockfileDrift warns about lockfile drift against the package.json
+// next to the lockfile, which is still installed as the lockfile has it
+func warnLockfileDrift(lockfilePath string, packages map[string]json.RawMessage) {
+	manifestPath := filepath.Join(filepath.Dir(lockfilePath), "package.json")
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return
+	}
+	var manifest PackageInfo
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return
+	}
+	// The lockfile has the ranges catalogs pin
+	projectCatalogs, err := parseCatalogs(data)
+	if err != nil || projectCatalogs.resolveManifestCatalogs(&manifest) != nil {
+		return
+	}
+	if manifest, _, err = withWorkspaceDependencies(filepath.Dir(lockfilePath), manifest, projectCatalogs); err != nil {
+		return
+	}
+	for _, drift := range findLockfileDrift(manifest, packages) {
+		printWarning("%s, run caladan install to update it", drift)
+		annotation := Annotation{Severity: "warning", Title: "lockfile out of date", Message: drift.String()}
+		if drift.ManifestRange != "" {
+			annotation.File = manifestPath
+			annotation.Line = annotationLine(manifestPath, drift.Section, drift.Name)
+		} else {
+			annotation.File = lockfilePath
+			annotation.Line = annotationLine(lockfilePath, "packages", "node_modules/"+drift.Name)
+		}
+		annotate(annotation)
+	}
+}
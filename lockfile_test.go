@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindLockfileDependency(t *testing.T) {
+	packages := map[string]json.RawMessage{
+		"":                                 json.RawMessage(`{}`),
+		"node_modules/a":                   json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/b":                   json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/a/node_modules/b":    json.RawMessage(`{"version":"2.0.0"}`),
+		"node_modules/a/node_modules/@s/c": json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/a/node_modules/@s/c/node_modules/d": json.RawMessage(`{"version":"1.0.0"}`),
+	}
+
+	tests := []struct {
+		name      string
+		fromPath  string
+		depName   string
+		wantPath  string
+		wantFound bool
+	}{
+		{
+			name:      "root dependency",
+			fromPath:  "",
+			depName:   "b",
+			wantPath:  "node_modules/b",
+			wantFound: true,
+		},
+		{
+			name:      "nested copy shadows root",
+			fromPath:  "node_modules/a",
+			depName:   "b",
+			wantPath:  "node_modules/a/node_modules/b",
+			wantFound: true,
+		},
+		{
+			name:      "walks up from scoped package",
+			fromPath:  "node_modules/a/node_modules/@s/c",
+			depName:   "b",
+			wantPath:  "node_modules/a/node_modules/b",
+			wantFound: true,
+		},
+		{
+			name:      "missing dependency",
+			fromPath:  "node_modules/b",
+			depName:   "d",
+			wantPath:  "",
+			wantFound: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPath, gotFound := findLockfileDependency(packages, tt.fromPath, tt.depName)
+			if gotPath != tt.wantPath || gotFound != tt.wantFound {
+				t.Errorf("findLockfileDependency() = %v, %v, want %v, %v", gotPath, gotFound, tt.wantPath, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestReachableLockfilePaths(t *testing.T) {
+	packages := map[string]json.RawMessage{
+		"":               json.RawMessage(`{"dependencies":{"a":"1.0.0"},"devDependencies":{"c":"1.0.0"}}`),
+		"node_modules/a": json.RawMessage(`{"version":"1.0.0","dependencies":{"b":"^1.0.0"}}`),
+		"node_modules/b": json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/c": json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/d": json.RawMessage(`{"version":"1.0.0"}`),
+	}
+
+	want := map[string]bool{
+		"":               true,
+		"node_modules/a": true,
+		"node_modules/b": true,
+		"node_modules/c": true,
+	}
+	if got := reachableLockfilePaths(packages); !reflect.DeepEqual(got, want) {
+		t.Errorf("reachableLockfilePaths() = %v, want %v", got, want)
+	}
+}
+
+func TestPlaceLockfilePackage(t *testing.T) {
+	packages := map[string]json.RawMessage{
+		"":               json.RawMessage(`{}`),
+		"node_modules/b": json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/c": json.RawMessage(`{"version":"2.0.0"}`),
+	}
+
+	pkg := PackageInfo{
+		Name:    "a",
+		Version: "1.0.0",
+		ResolvedDeps: map[string]PackageInfo{
+			"b": {Name: "b", Version: "1.0.0"},
+			"c": {Name: "c", Version: "3.0.0"},
+			"d": {Name: "d", Version: "1.0.0"},
+		},
+	}
+	if err := placeLockfilePackage(packages, pkg, "node_modules/a"); err != nil {
+		t.Fatalf("placeLockfilePackage() error = %v", err)
+	}
+
+	want := map[string]string{
+		"node_modules/a":                "1.0.0",
+		"node_modules/b":                "1.0.0",
+		"node_modules/c":                "2.0.0",
+		"node_modules/a/node_modules/c": "3.0.0",
+		"node_modules/d":                "1.0.0",
+	}
+	for path, version := range want {
+		if got := lockfileEntryVersion(packages[path]); got != version {
+			t.Errorf("version at %s = %q, want %q", path, got, version)
+		}
+	}
+}
+
+func TestDiffLockfiles(t *testing.T) {
+	oldPackages := map[string]json.RawMessage{
+		"":               json.RawMessage(`{}`),
+		"node_modules/a": json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/b": json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/c": json.RawMessage(`{"version":"1.0.0"}`),
+	}
+	newPackages := map[string]json.RawMessage{
+		"":               json.RawMessage(`{}`),
+		"node_modules/a": json.RawMessage(`{"version":"1.1.0"}`),
+		"node_modules/c": json.RawMessage(`{"version":"1.0.0"}`),
+		"node_modules/d": json.RawMessage(`{"version":"2.0.0"}`),
+	}
+
+	want := []lockfileChange{
+		{Path: "node_modules/a", OldVersion: "1.0.0", NewVersion: "1.1.0"},
+		{Path: "node_modules/b", OldVersion: "1.0.0"},
+		{Path: "node_modules/d", NewVersion: "2.0.0"},
+	}
+	if got := diffLockfiles(oldPackages, newPackages); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffLockfiles() = %v, want %v", got, want)
+	}
+}
+
+func TestWriteHiddenLockFile(t *testing.T) {
+	packageLock := &PackageLock{
+		Name:            "project",
+		Version:         "1.0.0",
+		LockfileVersion: 3,
+		Packages: map[string]json.RawMessage{
+			"":                   json.RawMessage(`{"name":"project"}`),
+			"node_modules/a":     json.RawMessage(`{"version":"1.0.0","resolved":"https://r/a.tgz","integrity":"sha1-old","license":"MIT"}`),
+			"node_modules/fsevs": json.RawMessage(`{"version":"2.0.0","os":["darwin"],"optional":true}`),
+		},
+	}
+	// fsevs was skipped for the platform, and a's sha512 was computed
+	summary := &InstallSummary{
+		Packages:   []PackageStats{{Path: "node_modules/a", Version: "1.0.0"}},
+		backfilled: map[string]string{"node_modules/a": "sha512-new"},
+	}
+	dir := t.TempDir()
+	if err := writeHiddenLockFile(dir, packageLock, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	var hidden struct {
+		Name            string                            `json:"name"`
+		LockfileVersion int                               `json:"lockfileVersion"`
+		Requires        bool                              `json:"requires"`
+		Packages        map[string]map[string]interface{} `json:"packages"`
+	}
+	if err := json.Unmarshal([]byte(readTestFile(t, filepath.Join(dir, hiddenLockfileName))), &hidden); err != nil {
+		t.Fatal(err)
+	}
+	if hidden.Name != "project" || hidden.LockfileVersion != 3 || !hidden.Requires {
+		t.Errorf("header = %+v", hidden)
+	}
+	want := map[string]map[string]interface{}{
+		"node_modules/a": {"version": "1.0.0", "resolved": "https://r/a.tgz", "integrity": "sha512-new", "license": "MIT"},
+	}
+	if !reflect.DeepEqual(hidden.Packages, want) {
+		t.Errorf("packages = %v, want %v", hidden.Packages, want)
+	}
+}
+
+func TestValidateLockfile(t *testing.T) {
+	data := []byte(`{
+  "lockfileVersion": 3,
+  "packages": {
+    "": {"dependencies": {"ms": "^2.0.0"}},
+    "node_modules/ms": {
+      "version": "2.1.3",
+      "resolved": "https://registry.npmjs.org/ms/-/ms-2.1.3.tgz",
+      "integrity": "sha512-6FlzubTLZG3J2a/NVCAleEhjzq5oxgHyaCU9yYXvcLsvoVaHJq/s5xXI6/XXP6tz7R9xAOtHnSO/tXtF3WRTlA=="
+    },
+    "node_modules/debug": {
+      "version": "4.3.4",
+      "integrity": "sha512-not base64!"
+    },
+    "node_modules/@types": {"version": "1.0.0", "resolved": "https://example.com/t.tgz"},
+    "node_modules/../escape": {"version": "1.0.0", "resolved": "https://example.com/e.tgz"},
+    "node_modules/bad": {"version": "1.0.0", "os": "linux", "resolved": "https://example.com/b.tgz"},
+    "node_modules/linked": {"resolved": "packages/linked", "link": true},
+    "packages/linked": {"version": "1.0.0"}
+  }
+}`)
+	got := validateLockfile(data)
+	want := []LockfileProblem{
+		{Line: 15, Field: `packages["node_modules/../escape"]`, Message: "invalid path: empty, . and .. segments aren't allowed"},
+		{Line: 14, Field: `packages["node_modules/@types"]`, Message: "invalid path: scope @types isn't followed by a package name"},
+		{Line: 16, Field: `packages["node_modules/bad"].os`, Message: "expected []string, got string"},
+		{Line: 10, Field: `packages["node_modules/debug"].resolved`, Message: "missing, so there's nowhere to download it from"},
+		{Line: 12, Field: `packages["node_modules/debug"].integrity`, Message: "error decoding integrity hash: illegal base64 data at input byte 0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("validateLockfile() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	got = validateLockfile([]byte(`{"lockfileVersion": 1, "dependencies": {}}`))
+	if len(got) != 1 || got[0].Field != "lockfileVersion" {
+		t.Errorf("v1 problems = %+v, want one for lockfileVersion", got)
+	}
+
+	got = validateLockfile([]byte("{\n  \"lockfileVersion\": 3,\n  \"packages\": {\n    \"\": {},\n  }\n}"))
+	if len(got) != 1 || got[0].Line != 4 {
+		t.Errorf("syntax problems = %+v, want one on line 4", got)
+	}
+}
@@ -5,10 +5,9 @@ import (
 	"bufio"
 	"compress/gzip"
 	"context"
-	"crypto/sha1"
-	"crypto/sha512"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,8 +15,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
-	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -25,10 +26,12 @@ import (
 )
 
 type PackageLock struct {
-	Name         string                     `json:"name"`
-	Version      string                     `json:"version"`
-	Dependencies map[string]json.RawMessage `json:"dependencies"`
-	Packages     map[string]json.RawMessage `json:"packages"`
+	Name            string                     `json:"name,omitempty"`
+	Version         string                     `json:"version,omitempty"`
+	LockfileVersion int                        `json:"lockfileVersion,omitempty"`
+	Requires        bool                       `json:"requires,omitempty"`
+	Dependencies    map[string]json.RawMessage `json:"dependencies,omitempty"`
+	Packages        map[string]json.RawMessage `json:"packages"`
 }
 
 type PackageInfo struct {
@@ -41,25 +44,125 @@ type PackageInfo struct {
 	Resolved             string                 `json:"resolved,omitempty"`
 	ResolvedDeps         map[string]PackageInfo `json:"-"`
 	Integrity            string                 `json:"integrity,omitempty"`
+	Shasum               string                 `json:"shasum,omitempty"` // Legacy hex sha1, only in old lockfiles
 	CPU                  []string               `json:"cpu,omitempty"`
 	OS                   []string               `json:"os,omitempty"`
+	Libc                 []string               `json:"libc,omitempty"`
 	Optional             bool                   `json:"optional,omitempty"`
+	Dev                  bool                   `json:"dev,omitempty"`
 	Bin                  interface{}            `json:"bin,omitempty"`
 	License              interface{}            `json:"license,omitempty"`
 	Engines              map[string]string      `json:"engines,omitempty"`
+	Deprecated           string                 `json:"deprecated,omitempty"` // Registry deprecation message
+	Funding              interface{}            `json:"funding,omitempty"`
 	Dist                 struct {
 		Tarball   string `json:"tarball"`
 		Integrity string `json:"integrity"`
+		Shasum    string `json:"shasum"`
 	} `json:"dist"`
 }
 
+// InstallOptions tunes how packages are installed. The zero value installs
+// for the host platform with default settings
+type InstallOptions struct {
+	ForcePlatform bool       // Install packages regardless of their os/cpu/libc fields
+	Target        Platform   // Platform to install for, empty fields default to the host's
+	Platforms     []Platform // Platforms to install for, defaults to the target
+	JSON          bool       // Print the install summary as JSON
+
+	NetworkConcurrency int               // Concurrent HTTP requests, 0 uses the config or default
+	TarWorkers         int               // Concurrent tarball extractions, 0 uses the config or default
+	StaticConcurrency  bool              // Don't adapt concurrency to observed throughput and errors
+	HTTP3              bool              // Try registry requests over HTTP/3 (QUIC) before HTTP/2
+	Timing             bool              // Print the time spent in each install phase
+	MetricsFile        string            // Write timings, cache, and transfer metrics here as JSON
+	FailFast           bool              // Abort the install at the first package that fails
+	Clean              bool              // Replace all of node_modules, dropping linked packages and tool caches too
+	LockfileOnly       bool              // Resolve and write package-lock.json without touching node_modules
+	ReadOnly           bool              // Make installed package files read-only
+	Overrides          map[string]string // Ranges forced on every dependency on a package, from --override
+	NoVerify           bool              // Skip integrity checks
+	RewriteResolved    bool              // Fetch tarballs from the config's registries instead of the lockfile's URLs
+	UpdateIntegrity    bool              // Compute and save sha512 integrity for entries that lack it
+	ImportMethod       string            // How files are put into node_modules from the store, empty uses the config or auto
+	Durability         string            // What's synced to disk before the install replaces node_modules, empty uses the config or none
+	ModulesDir         string            // Where packages are installed, relative to the project, empty uses the config or node_modules
+	VirtualStoreDir    string            // Where installs are staged, relative to the project, empty uses the config or .caladan
+	IgnoreScripts      bool              // Don't run packages' install scripts
+	ForegroundScripts  bool              // Stream install scripts' output instead of saving it to logs
+	Jobs               int               // Job slots install scripts share, the number of CPUs when 0
+	ScriptNetwork      string            // Network policy for install scripts, empty uses the config or no policy
+	ScriptTimeout      time.Duration     // How long each install script may run, 0 uses the config or no limit
+	ScriptShell        string            // What runs scripts, empty uses npm_config_script_shell, the config, or sh
+	NoDeprecated       bool              // Resolve ranges to their newest version that isn't deprecated
+	ConflictReport     bool              // List packages resolved to more than one version, and why
+	HoistReport        bool              // List what hoisting moved to the root, what it left nested and why
+	NoAudit            bool              // Don't check installed packages for security advisories
+	AuditLevel         string            // Fail on advisories at or above this severity, empty uses the config or never fails
+	AuditDB            string            // OSV database snapshot to audit against instead of the registry
+
+	NoFund                bool // Don't list packages looking for funding
+	NoDeprecationWarnings bool // Don't list deprecated packages
+
+	// Advisory sources from the project config
+	auditSources []AuditSourceConfig
+	// The network policy for scripts, and the proxy applying it while
+	// they run, nil without a policy
+	scriptNetwork ScriptNetworkConfig
+	scriptProxy   *egressProxy
+	// How long scripts may run, from the config and --script-timeout
+	scriptTimeouts scriptTimeouts
+	// Mirrors for the binaries install scripts download
+	binaryMirrors BinaryMirrors
+	// The registries tarballs are fetched from with RewriteResolved
+	registries Registries
+	// The transport registry requests share, with its DNS cache, and the
+	// router that sends them to the project's mirrors, nil without any
+	transport http.RoundTripper
+	mirrors   *mirrorRouter
+
+	// Where the JSON summary goes. Progress output is moved to stderr when
+	// printing JSON so that stdout stays parseable
+	jsonOutput io.Writer
+	// Collect phase timings and cache lookups for --timing and
+	// --metrics-file, nil when neither was asked for
+	timings    *Timings
+	cacheStats *CacheStats
+	// Carries the span the install's spans nest under, nil when not tracing
+	ctx context.Context
+	// The packages of the node_modules being replaced, by lockfile path,
+	// so upgraded packages only write the files that changed
+	previous map[string]PackageState
+	// Whether to add node_modules to .gitignore on a first install, from
+	// the config
+	gitignore string
+	// The packages rm took out of package.json, so links to them go too
+	removed []string
+	// Only install the lockfile entries node_modules doesn't have, for add,
+	// when what it has can be kept
+	keepInstalled bool
+	// Don't ask questions on the terminal, for installs running alongside
+	// others that would interleave their prompts and read each other's
+	// answers
+	noPrompt bool
+}
+
+// context returns the context installs run in
+func (opts InstallOptions) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
 // DepCollection holds all the extracted dependency information
 type DepCollection struct {
-	DirectDeps      map[string]PackageInfo // Direct dependencies
-	AllPackages     map[string]PackageInfo // All packages in the lockfile
-	OSSpecificPkgs  map[string][]string    // Map of OS to package names
-	CPUSpecificPkgs map[string][]string    // Map of CPU arch to package names
-	OptionalPkgs    []string               // List of optional packages
+	DirectDeps       map[string]PackageInfo // Direct dependencies
+	AllPackages      map[string]PackageInfo // All packages in the lockfile
+	OSSpecificPkgs   map[string][]string    // Map of OS to package names
+	CPUSpecificPkgs  map[string][]string    // Map of CPU arch to package names
+	LibcSpecificPkgs map[string][]string    // Map of libc family to package names
+	OptionalPkgs     []string               // List of optional packages
 }
 
 // PackageMetadata represents the metadata returned from the npm registry
@@ -75,22 +178,66 @@ type PackageMetadata struct {
 }
 
 func main() {
-	if cpuProfilePath := os.Getenv("CPU_PROFILE"); cpuProfilePath != "" {
-		f, err := os.Create(cpuProfilePath)
-		if err != nil {
-			fmt.Printf("Error creating CPU profile file: %v\n", err)
-			os.Exit(1)
-		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
-		fmt.Printf("CPU profiling enabled, writing to: %s\n", cpuProfilePath)
+	stopProfiling, err := startProfiling()
+	if err != nil {
+		stopProfiling()
+		printError("starting profiling: %v", err)
+		os.Exit(1)
 	}
+	defer stopProfiling()
 
-	usage := `Usage:
-  caladan install-lockfile <directory>
-  caladan install <directory>
-  caladan run <directory> <script> <args>`
+	// Spans are only recorded when an OTLP endpoint is configured
+	tracer := newTracerFromEnv()
 
+	usage := `Usage:
+  caladan init [--yes] <directory>
+  caladan install-lockfile [flags] <directory>
+  caladan install [flags] <directory>
+  caladan update [flags] <directory> <package>
+  caladan run [--timeout <duration>] [--script-shell <shell>] <directory> <script> <args>
+  caladan run [--list] <directory>
+  caladan run --workspaces [--jobs <n>] <directory> <script> <args>
+  caladan create [flags] <starter> [args]
+  caladan bench [flags] [directory]
+  caladan add [flags] [--dev|--optional] [--filter <workspace>] [-w] <directory> [<package>[@range]...]
+  caladan add --global [flags] [<package>[@range]...]
+  caladan rm [flags] [--filter <workspace>] [-w] <directory> <package>...
+  caladan rm --global [flags] <package>...
+  caladan ls --global
+  caladan audit [flags] <directory>
+  caladan audit db update [--audit-db <path>]
+  caladan audit signatures [--json] <directory>
+  caladan diff <directory> [<old lockfile>]
+  caladan rewrite-lockfile [--dry-run] <directory>
+  caladan check [--npm-compat] [--manifest] [--json] <directory>
+  caladan constraints [--json] <directory>
+  caladan explain [--json] <directory> <package>
+  caladan changeset [--summary <text>] <directory> <workspace>:<bump>...
+  caladan version-workspaces [--dry-run] <directory>
+  caladan workspaces list [--json] <directory>
+  caladan workspaces info [--json] <directory> <workspace>
+  caladan workspaces graph [--json|--dot] <directory>
+  caladan pack [--dry-run] [--pack-destination <dir>] <directory>
+  caladan view-tarball [--json] <package>[@version]
+  caladan publish --workspaces [flags] <directory>
+  caladan access public|restricted <package>
+  caladan access grant read-only|read-write <scope:team> <package>
+  caladan access revoke <scope:team> <package>
+  caladan owner ls|add|rm [<user>] <package>
+  caladan dist-tag ls <package>
+  caladan dist-tag add <package>@<version> [<tag>]
+  caladan dist-tag rm <package> <tag>
+  caladan token create [flags]
+  caladan token list [--json]
+  caladan token revoke <key>...
+  caladan credentials store|erase [--registry <url>]
+  caladan self-update [--check] [--force] [--allow-unsigned]
+  caladan completion bash|zsh|fish
+
+Run a command with -h to see its flags. --no-color (or NO_COLOR=1) turns
+off colored output for any command, FORCE_COLOR=1 keeps it on when piped.`
+
+	os.Args = stripGlobalColorFlag(os.Args)
 	if len(os.Args) < 2 {
 		fmt.Println(usage)
 		os.Exit(1)
@@ -102,25 +249,672 @@ func main() {
 		os.Exit(1)
 	}
 
-	if os.Args[1] == "install-lockfile" && len(os.Args) == 3 {
-		lockfilePath := filepath.Join(os.Args[2], "package-lock.json")
-		err := InstallLockFile(lockfilePath)
+	switch os.Args[1] {
+	case "init":
+		flags := flag.NewFlagSet("init", flag.ExitOnError)
+		colorFlag(flags)
+		opts := InitOptions{}
+		flags.BoolVar(&opts.Yes, "yes", false, "take the defaults instead of prompting")
+		flags.BoolVar(&opts.Yes, "y", false, "shorthand for --yes")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		if err := Init(args[0], opts); err != nil {
+			printError("initializing project: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "install-lockfile":
+		flags := flag.NewFlagSet("install-lockfile", flag.ExitOnError)
+		opts := installFlags(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		lockfilePath := filepath.Join(args[0], "package-lock.json")
+		setupOutput(opts)
+		err := traceCommand("install-lockfile", resumeCommand(os.Args[1:]...), tracer, opts, func() error {
+			return InstallLockFile(lockfilePath, *opts)
+		})
+		if err != nil {
+			printError("installing lockfile: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "install":
+		flags := flag.NewFlagSet("install", flag.ExitOnError)
+		opts := installFlags(flags)
+		lockfileOnlyFlag(flags, opts)
+		overrideFlag(flags, opts)
+		recursive := flags.Bool("recursive", false, "install every project (package.json and package-lock.json) under the directory")
+		flags.BoolVar(recursive, "r", false, "shorthand for --recursive")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		setupOutput(opts)
+		err := traceCommand("install", resumeCommand(os.Args[1:]...), tracer, opts, func() error {
+			if *recursive {
+				return InstallRecursive(args[0], *opts)
+			}
+			return Install(args[0], *opts)
+		})
+		if err != nil {
+			printError("installing: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "update":
+		flags := flag.NewFlagSet("update", flag.ExitOnError)
+		opts := installFlags(flags)
+		lockfileOnlyFlag(flags, opts)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 2 {
+			break
+		}
+		setupOutput(opts)
+		err := traceCommand("update", resumeCommand(os.Args[1:]...), tracer, opts, func() error {
+			return Update(args[0], args[1], *opts)
+		})
+		if err != nil {
+			printError("updating: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "add":
+		flags := flag.NewFlagSet("add", flag.ExitOnError)
+		opts := installFlags(flags)
+		lockfileOnlyFlag(flags, opts)
+		overrideFlag(flags, opts)
+		global := globalFlag(flags)
+		filter := filterFlags(flags)
+		section := sectionFlags(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if !*global {
+			if len(args) == 0 {
+				break
+			}
+			saveIn, err := section()
+			if err != nil {
+				printError("%v", err)
+				os.Exit(1)
+			}
+			if len(args) == 1 {
+				name, err := PromptPackage()
+				if err != nil {
+					printError("adding: %v", err)
+					os.Exit(1)
+				}
+				args = append(args, name)
+			}
+			setupOutput(opts)
+			// package.json is saved before the install, so installing
+			// picks up where it stopped
+			resume := resumeCommand("install", args[0])
+			if opts.LockfileOnly {
+				resume = resumeCommand("install", "--lockfile-only", args[0])
+			}
+			err = traceCommand("add", resume, tracer, opts, func() error {
+				return AddDependencies(args[0], args[1:], saveIn, *filter, *opts)
+			})
+			if err != nil {
+				printError("adding: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if opts.LockfileOnly {
+			printError("--lockfile-only doesn't apply to global packages")
+			os.Exit(1)
+		}
+		if saveIn, _ := section(); saveIn != "" {
+			printError("--dev and --optional don't apply to global packages")
+			os.Exit(1)
+		}
+		if len(args) == 0 {
+			// Without a package, search for one
+			name, err := PromptPackage()
+			if err != nil {
+				printError("adding: %v", err)
+				os.Exit(1)
+			}
+			args = []string{name}
+		}
+		setupOutput(opts)
+		err := traceCommand("add", resumeCommand(os.Args[1:]...), tracer, opts, func() error {
+			return AddGlobal(args, *opts)
+		})
+		if err != nil {
+			printError("adding: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "completion":
+		if len(os.Args) != 3 {
+			break
+		}
+		script, err := CompletionScript(os.Args[2])
+		if err != nil {
+			printError("%v", err)
+			os.Exit(1)
+		}
+		fmt.Print(script)
+		return
+	case "__complete":
+		Complete(os.Args[2:], os.Stdout)
+		return
+	case "create":
+		flags := flag.NewFlagSet("create", flag.ExitOnError)
+		opts := installFlags(flags)
+		// Everything after the starter is its own, flags included
+		flags.Parse(os.Args[2:])
+		args := flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		err := traceCommand("create", "", tracer, opts, func() error {
+			return Create(args[0], args[1:], *opts)
+		})
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			printError("creating: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "rm", "remove":
+		flags := flag.NewFlagSet("rm", flag.ExitOnError)
+		opts := installFlags(flags)
+		global := globalFlag(flags)
+		filter := filterFlags(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) == 0 {
+			break
+		}
+		if !*global {
+			if len(args) < 2 {
+				break
+			}
+			setupOutput(opts)
+			err := traceCommand("rm", resumeCommand("install", args[0]), tracer, opts, func() error {
+				return RemoveDependencies(args[0], args[1:], *filter, *opts)
+			})
+			if err != nil {
+				printError("removing: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+		setupOutput(opts)
+		err := traceCommand("rm", resumeCommand(os.Args[1:]...), tracer, opts, func() error {
+			return RemoveGlobal(args, *opts)
+		})
+		if err != nil {
+			printError("removing: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "ls", "list":
+		flags := flag.NewFlagSet("ls", flag.ExitOnError)
+		colorFlag(flags)
+		global := globalFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			break
+		}
+		if !*global {
+			fmt.Println("Only global packages can be listed, use --global")
+			os.Exit(1)
+		}
+		packages, err := ListGlobal()
+		if err != nil {
+			printError("listing: %v", err)
+			os.Exit(1)
+		}
+		for _, pkg := range packages {
+			fmt.Println(pkg)
+		}
+		return
+	case "audit":
+		flags := flag.NewFlagSet("audit", flag.ExitOnError)
+		reporterFlag(flags)
+		colorFlag(flags)
+		opts := AuditOptions{}
+		flags.StringVar(&opts.DB, "audit-db", "", "OSV database snapshot (directory or zip) to use instead of the registry")
+		flags.StringVar(&opts.Level, "audit-level", "", "exit nonzero on advisories at or above low (the default), moderate, high, or critical")
+		flags.BoolVar(&opts.JSON, "json", false, "print the report as JSON on stdout")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) == 2 && args[0] == "db" && args[1] == "update" {
+			path := opts.DB
+			if path == "" {
+				path = os.Getenv("CALADAN_AUDIT_DB")
+			}
+			if path == "" {
+				path = defaultAuditDB()
+			}
+			if err := UpdateAuditDB(path); err != nil {
+				printError("updating advisory database: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if len(args) == 2 && args[0] == "signatures" {
+			sigOpts := SignaturesOptions{JSON: opts.JSON}
+			if sigOpts.JSON {
+				sigOpts.jsonOutput = os.Stdout
+				os.Stdout = os.Stderr
+			}
+			if err := AuditSignatures(args[1], sigOpts); err != nil {
+				printError("verifying signatures: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if len(args) != 1 {
+			break
+		}
+		if opts.JSON {
+			opts.jsonOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		if err := Audit(args[0], opts); err != nil {
+			printError("auditing: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "changeset":
+		flags := flag.NewFlagSet("changeset", flag.ExitOnError)
+		colorFlag(flags)
+		summary := flags.String("summary", "", "what changed, for the changelogs")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) < 2 {
+			break
+		}
+		path, err := AddChangeset(args[0], args[1:], *summary)
+		if err != nil {
+			printError("adding changeset: %v", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s\n", path)
+		return
+	case "workspaces":
+		flags := flag.NewFlagSet("workspaces", flag.ExitOnError)
+		colorFlag(flags)
+		opts := WorkspacesOptions{}
+		flags.BoolVar(&opts.JSON, "json", false, "print JSON on stdout")
+		flags.BoolVar(&opts.DOT, "dot", false, "print the graph in Graphviz's DOT language")
+		args := parseArgs(flags, os.Args[2:])
+		if opts.JSON && opts.DOT {
+			break
+		}
+		if opts.JSON {
+			opts.jsonOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		var err error
+		switch {
+		case len(args) == 2 && args[0] == "list" && !opts.DOT:
+			err = ListWorkspaces(args[1], opts)
+		case len(args) == 3 && args[0] == "info" && !opts.DOT:
+			err = ShowWorkspace(args[1], args[2], opts)
+		case len(args) == 2 && args[0] == "graph":
+			err = WorkspaceGraph(args[1], opts)
+		default:
+			err = errUsage
+		}
+		if err == errUsage {
+			break
+		}
 		if err != nil {
-			fmt.Printf("Error installing lockfile: %v\n", err)
+			printError("querying workspaces: %v", err)
 			os.Exit(1)
 		}
 		return
-	} else if os.Args[1] == "install" && len(os.Args) == 3 {
-		err := Install(os.Args[2])
+	case "version-workspaces":
+		flags := flag.NewFlagSet("version-workspaces", flag.ExitOnError)
+		colorFlag(flags)
+		opts := VersionWorkspacesOptions{}
+		flags.BoolVar(&opts.DryRun, "dry-run", false, "print the planned versions without changing anything")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		if err := VersionWorkspaces(args[0], opts); err != nil {
+			printError("versioning workspaces: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "pack":
+		flags := flag.NewFlagSet("pack", flag.ExitOnError)
+		colorFlag(flags)
+		opts := PackOptions{}
+		flags.BoolVar(&opts.DryRun, "dry-run", false, "list what would be packed without writing the tarball")
+		flags.StringVar(&opts.Destination, "pack-destination", "", "directory to write the tarball to (default the package's)")
+		flags.BoolVar(&opts.IgnoreScripts, "ignore-scripts", false, "don't run prepack, prepare, and postpack scripts")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		path, err := Pack(args[0], opts)
+		if err != nil {
+			printError("packing: %v", err)
+			os.Exit(1)
+		}
+		if !opts.DryRun {
+			fmt.Printf("Wrote %s\n", path)
+		}
+		return
+	case "view-tarball":
+		flags := flag.NewFlagSet("view-tarball", flag.ExitOnError)
+		colorFlag(flags)
+		opts := ViewTarballOptions{}
+		flags.BoolVar(&opts.JSON, "json", false, "print the listing as JSON on stdout")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		if opts.JSON {
+			opts.jsonOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		if err := ViewTarball(args[0], opts); err != nil {
+			printError("viewing tarball: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "publish":
+		flags := flag.NewFlagSet("publish", flag.ExitOnError)
+		colorFlag(flags)
+		workspaces := flags.Bool("workspaces", false, "publish every workspace whose version isn't on the registry, dependencies first")
+		opts := PublishOptions{}
+		flags.StringVar(&opts.Tag, "tag", "latest", "dist tag to publish under")
+		flags.BoolVar(&opts.DryRun, "dry-run", false, "pack and report without uploading")
+		flags.BoolVar(&opts.IgnoreScripts, "ignore-scripts", false, "don't run prepublishOnly, prepack, prepare, postpack, publish, and postpublish scripts")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 || !*workspaces {
+			break
+		}
+		results, err := PublishWorkspaces(args[0], opts)
+		fmt.Print(RenderPublishSummary(results, opts.DryRun))
+		if err != nil {
+			printError("publishing: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "access":
+		flags := flag.NewFlagSet("access", flag.ExitOnError)
+		colorFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if err := Access(args); err == errUsage {
+			break
+		} else if err != nil {
+			printError("changing access: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "owner":
+		flags := flag.NewFlagSet("owner", flag.ExitOnError)
+		colorFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if err := Owner(args); err == errUsage {
+			break
+		} else if err != nil {
+			printError("changing owners: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "dist-tag":
+		flags := flag.NewFlagSet("dist-tag", flag.ExitOnError)
+		colorFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if err := DistTag(args); err == errUsage {
+			break
+		} else if err != nil {
+			printError("changing dist-tags: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "token":
+		flags := flag.NewFlagSet("token", flag.ExitOnError)
+		colorFlag(flags)
+		opts := TokenOptions{}
+		list := func(values *[]string) func(string) error {
+			return func(value string) error {
+				for _, item := range strings.Split(value, ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						*values = append(*values, item)
+					}
+				}
+				return nil
+			}
+		}
+		flags.BoolVar(&opts.ReadOnly, "read-only", false, "create a token that can install but not publish")
+		flags.BoolVar(&opts.Automation, "automation", false, "create an automation token, which skips two-factor authentication, for CI")
+		flags.Func("cidr", "comma-separated IP ranges the token may be used from (repeatable)", list(&opts.CIDR))
+		flags.StringVar(&opts.Name, "name", "", "create a granular access token with this name")
+		flags.StringVar(&opts.Description, "description", "", "description of a granular token")
+		flags.IntVar(&opts.ExpiresDays, "expires", 0, "days until a granular token expires")
+		flags.Func("packages", "comma-separated packages a granular token can access (repeatable)", list(&opts.Packages))
+		flags.Func("scopes", "comma-separated scopes a granular token can access (repeatable)", list(&opts.Scopes))
+		flags.Func("orgs", "comma-separated orgs a granular token can manage (repeatable)", list(&opts.Orgs))
+		flags.StringVar(&opts.PackagesPermission, "packages-permission", "read-only", "read-only, read-write, or no-access for a granular token's packages and scopes")
+		flags.StringVar(&opts.OrgsPermission, "orgs-permission", "no-access", "read-only, read-write, or no-access for a granular token's orgs")
+		flags.StringVar(&opts.OTP, "otp", "", "one-time password, for accounts with two-factor authentication")
+		jsonOutput := flags.Bool("json", false, "print tokens as JSON")
+		args := parseArgs(flags, os.Args[2:])
+		var err error
+		switch {
+		case len(args) == 1 && args[0] == "create":
+			err = CreateToken(opts)
+		case len(args) == 1 && args[0] == "list":
+			err = ListTokens(*jsonOutput)
+		case len(args) > 1 && args[0] == "revoke":
+			err = RevokeToken(args[1:], opts.OTP)
+		default:
+			err = errUsage
+		}
+		if err == errUsage {
+			break
+		}
+		if err != nil {
+			printError("managing tokens: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "credentials":
+		flags := flag.NewFlagSet("credentials", flag.ExitOnError)
+		colorFlag(flags)
+		registry := flags.String("registry", npmRegistryURL, "registry the token is for")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 || (args[0] != "store" && args[0] != "erase") {
+			break
+		}
+		var err error
+		if args[0] == "store" {
+			err = StoreCredentials(".", *registry)
+		} else {
+			err = EraseCredentials(".", *registry)
+		}
+		if err != nil {
+			printError("updating credentials: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "constraints":
+		flags := flag.NewFlagSet("constraints", flag.ExitOnError)
+		colorFlag(flags)
+		opts := ConstraintsOptions{}
+		flags.BoolVar(&opts.JSON, "json", false, "print the violations as JSON on stdout")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		if opts.JSON {
+			opts.jsonOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		if err := CheckConstraints(args[0], opts); err != nil {
+			printError("checking constraints: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "explain":
+		flags := flag.NewFlagSet("explain", flag.ExitOnError)
+		colorFlag(flags)
+		opts := ExplainOptions{}
+		flags.BoolVar(&opts.JSON, "json", false, "print the explanation as JSON on stdout")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 2 {
+			break
+		}
+		if opts.JSON {
+			opts.jsonOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		if err := Explain(args[0], args[1], opts); err != nil {
+			printError("explaining: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "check":
+		flags := flag.NewFlagSet("check", flag.ExitOnError)
+		colorFlag(flags)
+		opts := CheckOptions{}
+		flags.BoolVar(&opts.NPMCompat, "npm-compat", false, "compare node_modules with what npm ci would install from the lockfile")
+		flags.BoolVar(&opts.Manifest, "manifest", false, "validate the fields of package.json")
+		flags.BoolVar(&opts.JSON, "json", false, "print the issues as JSON on stdout")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 || !(opts.NPMCompat || opts.Manifest) {
+			break
+		}
+		if opts.JSON {
+			opts.jsonOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		if err := Check(args[0], opts); err != nil {
+			printError("checking: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "rewrite-lockfile":
+		flags := flag.NewFlagSet("rewrite-lockfile", flag.ExitOnError)
+		colorFlag(flags)
+		opts := RewriteLockfileOptions{}
+		flags.BoolVar(&opts.DryRun, "dry-run", false, "print the URLs that would change without writing the lockfile")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 {
+			break
+		}
+		if err := RewriteLockfile(args[0], opts); err != nil {
+			printError("rewriting lockfile: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "diff":
+		flags := flag.NewFlagSet("diff", flag.ExitOnError)
+		colorFlag(flags)
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 1 && len(args) != 2 {
+			break
+		}
+		oldLockfilePath := ""
+		if len(args) == 2 {
+			oldLockfilePath = args[1]
+		}
+		if err := Diff(args[0], oldLockfilePath); err != nil {
+			printError("diffing lockfile: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "self-update":
+		flags := flag.NewFlagSet("self-update", flag.ExitOnError)
+		colorFlag(flags)
+		opts := SelfUpdateOptions{}
+		flags.BoolVar(&opts.Check, "check", false, "only report whether a newer release is available")
+		flags.BoolVar(&opts.Force, "force", false, "install the latest release even if it's already installed or older")
+		flags.BoolVar(&opts.AllowUnsigned, "allow-unsigned", false, "update without checking the release signature when this build has no release key")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) != 0 {
+			break
+		}
+		if err := SelfUpdate(opts); err != nil {
+			printError("updating caladan: %v", err)
+			os.Exit(1)
+		}
+		return
+	case "bench":
+		flags := flag.NewFlagSet("bench", flag.ExitOnError)
+		colorFlag(flags)
+		opts := BenchOptions{}
+		flags.IntVar(&opts.Runs, "runs", 5, "timed runs per scenario")
+		flags.BoolVar(&opts.JSON, "json", false, "print the results as JSON on stdout")
+		fixture := flags.String("fixture", "", "benchmark fixtures/<name> instead of a directory")
+		args := parseArgs(flags, os.Args[2:])
+		if len(args) > 1 || (len(args) == 1 && *fixture != "") {
+			break
+		}
+		directory := "."
+		if len(args) == 1 {
+			directory = args[0]
+		}
+		if *fixture != "" {
+			directory = filepath.Join("fixtures", *fixture)
+		}
+		if opts.JSON {
+			opts.jsonOutput = os.Stdout
+			os.Stdout = os.Stderr
+		}
+		err := Bench(directory, opts)
 		if err != nil {
-			fmt.Printf("Error installing: %v\n", err)
+			printError("benchmarking: %v", err)
 			os.Exit(1)
 		}
 		return
-	} else if os.Args[1] == "run" && len(os.Args) >= 4 {
-		err := Run(os.Args[2], os.Args[3:])
+	case "run":
+		// Flags only come before the directory, everything after the
+		// script is its arguments
+		flags := flag.NewFlagSet("run", flag.ExitOnError)
+		timeout := flags.Duration("timeout", 0, "kill the bin (and its children) if it runs longer than this, e.g. 10m (default the config's scriptTimeout)")
+		shell := flags.String("script-shell", "", "run the bin with this shell instead of sh, e.g. bash")
+		list := flags.Bool("list", false, "list the project's scripts and their commands")
+		workspaces := flags.Bool("workspaces", false, "run a package.json script in every workspace that has it, dependencies first")
+		jobs := flags.Int("jobs", 0, "job slots workspace scripts share (default the config's jobs, or the number of CPUs)")
+		flags.Parse(os.Args[2:])
+		if *workspaces {
+			if flags.NArg() < 2 {
+				break
+			}
+			results, err := RunWorkspaces(flags.Arg(0), flags.Args()[1:], RunWorkspacesOptions{Jobs: *jobs, Timeout: *timeout, Shell: *shell})
+			fmt.Print("\n" + RenderTaskResults(results))
+			if err != nil {
+				printError("running workspace scripts: %v", err)
+				os.Exit(1)
+			}
+			for _, result := range results {
+				if result.Status != "done" {
+					os.Exit(1)
+				}
+			}
+			return
+		}
+		if flags.NArg() == 1 || (*list && flags.NArg() > 0) {
+			project, scripts, err := ProjectScripts(flags.Arg(0))
+			if err != nil {
+				printError("listing scripts: %v", err)
+				os.Exit(1)
+			}
+			fmt.Print(RenderScripts(project, scripts))
+			return
+		}
+		if flags.NArg() < 2 {
+			break
+		}
+		err := Run(flags.Arg(0), flags.Args()[1:], *timeout, *shell)
 		if err != nil {
-			fmt.Printf("Error running script: %v\n", err)
+			printError("running script: %v", err)
 			os.Exit(1)
 		}
 		return
@@ -131,15 +925,190 @@ func main() {
 	os.Exit(1)
 }
 
-func Run(directory string, args []string) error {
+// installFlags registers the flags shared by every command that installs packages
+func installFlags(flags *flag.FlagSet) *InstallOptions {
+	opts := &InstallOptions{}
+	flags.BoolVar(&opts.ForcePlatform, "force-platform", false, "install packages even if their os/cpu/libc doesn't match")
+	flags.StringVar(&opts.Target.OS, "target-os", "", "install for this os instead of the host's (e.g. linux, darwin, win32)")
+	flags.StringVar(&opts.Target.CPU, "target-cpu", "", "install for this cpu instead of the host's (e.g. x64, arm64)")
+	flags.StringVar(&opts.Target.Libc, "target-libc", "", "install for this libc instead of the host's (glibc or musl)")
+	flags.BoolVar(&opts.JSON, "json", false, "print the install summary as JSON on stdout")
+	flags.IntVar(&opts.NetworkConcurrency, "network-concurrency", 0, fmt.Sprintf("maximum concurrent HTTP requests (default %d)", defaultNetworkConcurrency))
+	flags.IntVar(&opts.TarWorkers, "tar-workers", 0, "maximum concurrent tarball extractions (default 1.5x cores)")
+	flags.BoolVar(&opts.StaticConcurrency, "static-concurrency", false, "pin concurrency instead of adapting it to throughput and errors")
+	flags.BoolVar(&opts.HTTP3, "http3", false, "experimental: fetch from the registry over HTTP/3 (QUIC), falling back to HTTP/2 for hosts that don't answer")
+	flags.BoolVar(&opts.Timing, "timing", false, "print the time spent resolving, downloading, extracting, linking, and setting up bins")
+	flags.BoolVar(&opts.NoVerify, "no-verify", false, "don't check package integrity")
+	flags.BoolVar(&opts.RewriteResolved, "rewrite-resolved", false, "fetch tarballs from the registries in the config, by scope, instead of the lockfile's resolved URLs")
+	flags.BoolVar(&opts.UpdateIntegrity, "update-integrity", false, "compute sha512 integrity for lockfile entries without it and save it to the lockfile")
+	flags.BoolVar(&opts.Clean, "clean", false, "replace all of node_modules, including linked packages and .cache, which are kept by default")
+	flags.BoolVar(&opts.ReadOnly, "read-only", false, "make installed package files read-only, so accidental edits fail")
+	flags.BoolVar(&opts.FailFast, "fail-fast", false, "stop at the first package that fails instead of reporting every failure at the end")
+	flags.StringVar(&opts.ImportMethod, "package-import-method", "", "how files get into node_modules from the store: auto (clone, else hard link), hardlink, clone, or copy")
+	flags.StringVar(&opts.Durability, "durability", "", "what to fsync before replacing node_modules: none (default), dir (directory entries), or full (files too)")
+	flags.StringVar(&opts.ModulesDir, "modules-dir", "", "install packages into this directory instead of node_modules, relative to the project")
+	flags.StringVar(&opts.VirtualStoreDir, "virtual-store-dir", "", "stage installs in this directory instead of .caladan, on the same filesystem as the modules directory")
+	flags.BoolVar(&opts.IgnoreScripts, "ignore-scripts", false, "don't run preinstall, install, and postinstall scripts of packages")
+	flags.BoolVar(&opts.ForegroundScripts, "foreground-scripts", false, "stream install scripts' output instead of saving it to node_modules/.caladan/logs")
+	flags.IntVar(&opts.Jobs, "jobs", 0, "install scripts to run at once (default the number of CPUs)")
+	flags.StringVar(&opts.ScriptShell, "script-shell", "", "run scripts with this shell or interpreter instead of sh, e.g. bash")
+	flags.DurationVar(&opts.ScriptTimeout, "script-timeout", 0, "kill install scripts (and their children) that run longer than this, e.g. 10m")
+	flags.StringVar(&opts.ScriptNetwork, "script-network", "", "send install scripts through a proxy that allows, denies (except the config's allow list), or logs where they connect")
+	flags.BoolVar(&opts.NoFund, "no-fund", false, "don't list installed packages that are looking for funding")
+	flags.BoolVar(&opts.NoDeprecationWarnings, "no-deprecation-warnings", false, "don't warn about or list deprecated packages")
+	flags.BoolVar(&opts.NoDeprecated, "no-deprecated", false, "resolve ranges to their newest version that isn't deprecated")
+	flags.BoolVar(&opts.ConflictReport, "conflict-report", false, "list packages resolved to more than one version and the ranges that forced it")
+	flags.BoolVar(&opts.HoistReport, "hoist-report", false, "list packages hoisted to node_modules, the ones left nested and why, and how deep the tree is")
+	flags.BoolFunc("audit", "check installed packages for security advisories, --audit=false skips it (default true)", func(value string) error {
+		audit, err := strconv.ParseBool(value)
+		opts.NoAudit = !audit
+		return err
+	})
+	flags.StringVar(&opts.AuditLevel, "audit-level", "", "fail when advisories at or above low, moderate, high, or critical are found")
+	flags.StringVar(&opts.AuditDB, "audit-db", "", "audit against this OSV database snapshot (directory or zip) instead of the registry")
+	flags.StringVar(&opts.MetricsFile, "metrics-file", "", "write timings, cache hit rates, bytes, and retries to this JSON file")
+	reporterFlag(flags)
+	colorFlag(flags)
+	return opts
+}
+
+// globalFlag registers --global and its -g shorthand
+func globalFlag(flags *flag.FlagSet) *bool {
+	global := flags.Bool("global", false, "act on the global packages in CALADAN_HOME (default ~/.caladan)")
+	flags.BoolVar(global, "g", false, "shorthand for --global")
+	return global
+}
+
+// lockfileOnlyFlag registers --lockfile-only for the commands that resolve
+func lockfileOnlyFlag(flags *flag.FlagSet, opts *InstallOptions) {
+	flags.BoolVar(&opts.LockfileOnly, "lockfile-only", false, "resolve and write package-lock.json without touching node_modules")
+}
+
+// overrideFlag registers --override for the commands that resolve
+func overrideFlag(flags *flag.FlagSet, opts *InstallOptions) {
+	flags.Func("override", "resolve every dependency on a package to this version or range, e.g. lodash@4.17.21 (repeatable)", func(value string) error {
+		name, versionRange := parsePackageSpec(value)
+		if strings.LastIndex(value, "@") <= 0 || !validRange(versionRange) {
+			return fmt.Errorf("want <package>@<version or range>, got %s", value)
+		}
+		if opts.Overrides == nil {
+			opts.Overrides = make(map[string]string)
+		}
+		opts.Overrides[name] = versionRange
+		return nil
+	})
+}
+
+// overrideCommand is the command line an install with overrides is
+// annotated with
+func overrideCommand(command string, overrides map[string]string) string {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		command += " --override " + name + "@" + overrides[name]
+	}
+	return command
+}
+
+// setupOutput prepares what an install command reports. Progress output goes
+// to stderr when the command prints JSON, so stdout only carries the JSON
+// document, and timings and cache lookups are collected when asked for
+func setupOutput(opts *InstallOptions) {
+	if opts.JSON {
+		opts.jsonOutput = os.Stdout
+		os.Stdout = os.Stderr
+	}
+	if opts.Timing || opts.MetricsFile != "" {
+		opts.timings = NewTimings()
+	}
+	if opts.MetricsFile != "" {
+		opts.cacheStats = &CacheStats{}
+	}
+}
+
+// traceCommand runs an install command under a root span and exports the
+// trace when it's done. Spans started from opts.context() nest under it.
+// With a resume command, Ctrl-C stops the install cleanly and prints it.
+// Without one, Ctrl-C is left alone, for commands that hand the terminal to
+// a child process
+func traceCommand(name, resume string, tracer *Tracer, opts *InstallOptions, run func() error) error {
+	ctx := context.Background()
+	if resume != "" {
+		var stop func()
+		ctx, stop = withInterrupt(ctx)
+		defer stop()
+	}
+	ctx, span := startSpan(withTracer(ctx, tracer), "caladan "+name, spanKindInternal)
+	opts.ctx = ctx
+	err := run()
+	if interrupted(ctx) {
+		err = errInterrupted
+	}
+	span.finish(err)
+	if exportErr := tracer.shutdown(); exportErr != nil {
+		printWarning("%v", exportErr)
+	}
+	if err == errInterrupted {
+		// Verified tarballs stay in the cache, so resuming only downloads
+		// what hadn't arrived yet
+		fmt.Printf("\n%s, resume with %s\n", colorWarn("Install interrupted"), resume)
+		os.Exit(130)
+	}
+	return err
+}
+
+// parseArgs parses flags that may appear before, between, or after the
+// positional arguments and returns the positional arguments
+func parseArgs(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func Run(directory string, args []string, timeout time.Duration, shell string) error {
 	scriptName := args[0]
 	scriptArgs := args[1:]
 
 	fmt.Printf("Running %s with args: %v\n", scriptName, scriptArgs)
 
+	// Bins live in the project's modules directory, which may be configured
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	modulesDir := config.ModulesDir
+	if modulesDir == "" {
+		modulesDir = "./node_modules"
+	}
+	if timeout == 0 {
+		timeouts, err := config.ScriptTimeout.parse()
+		if err != nil {
+			return err
+		}
+		timeout = timeouts.fallback
+	}
+
 	// Set up command to run script using project-relative path
-	binScriptName := filepath.Join("./node_modules/.bin", scriptName)
-	cmd := exec.Command("sh", "-c", binScriptName+" "+strings.Join(scriptArgs, " "))
+	binScriptName := filepath.Join(modulesDir, ".bin", scriptName)
+	shell = config.scriptShell(shell)
+	cmd := shellCommand(shell, binScriptName+" "+strings.Join(scriptArgs, " "))
+
+	// Bins read the same npm_config_* settings as install scripts
+	binDir, err := filepath.Abs(filepath.Join(projectPath(directory, config.ModulesDir, "node_modules"), ".bin"))
+	if err != nil {
+		return err
+	}
+	cmd.Env = scriptEnv(npmConfigEnv(InstallOptions{ScriptShell: shell, binaryMirrors: config.BinaryMirrors}), binDir)
 
 	// Set working directory to the specified directory (project root)
 	cmd.Dir = directory
@@ -151,7 +1120,7 @@ func Run(directory string, args []string) error {
 	cmd.Stdin = os.Stdin
 
 	// Run the command and wait for it to finish
-	err := cmd.Run()
+	err = runWithTimeout(cmd, timeout)
 
 	// Exit with same code as the script
 	if err != nil {
@@ -159,24 +1128,49 @@ func Run(directory string, args []string) error {
 			os.Exit(exitErr.ExitCode())
 		}
 		// If not an ExitError, something else went wrong
-		fmt.Printf("Error executing script: %v\n", err)
+		printError("executing script: %v", err)
 		return err
 	}
 
 	return nil
 }
 
-func Install(directory string) error {
+func Install(directory string, opts InstallOptions) error {
 	packageJSONPath := filepath.Join(directory, "package.json")
 	data, err := os.ReadFile(packageJSONPath)
 	if err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
+		printError("reading file: %v", err)
 		return err
 	}
 
 	var packageJSON PackageInfo
 	if err := json.Unmarshal(data, &packageJSON); err != nil {
-		fmt.Printf("Error parsing JSON: %v\n", err)
+		printError("parsing JSON: %v", err)
+		return err
+	}
+	// The lockfile gets the ranges catalogs pin, never catalog: itself
+	projectCatalogs, err := parseCatalogs(data)
+	if err == nil {
+		err = projectCatalogs.resolveManifestCatalogs(&packageJSON)
+	}
+	var conflicts []string
+	if err == nil {
+		packageJSON, conflicts, err = withWorkspaceDependencies(directory, packageJSON, projectCatalogs)
+	}
+	if err != nil {
+		printError("%v", err)
+		return err
+	}
+	for _, conflict := range conflicts {
+		printWarning("%s", conflict)
+	}
+
+	config, err := loadConfig(directory)
+	if err != nil {
+		printError("loading config: %v", err)
+		return err
+	}
+	if err := opts.applyConfig(config); err != nil {
 		return err
 	}
 
@@ -185,21 +1179,36 @@ func Install(directory string) error {
 		initialDeps = append(initialDeps, PackageInfo{Name: name, Version: version})
 	}
 	for name, version := range packageJSON.DevDependencies {
-		initialDeps = append(initialDeps, PackageInfo{Name: name, Version: version})
+		initialDeps = append(initialDeps, PackageInfo{Name: name, Version: version, Dev: true})
+	}
+	for name, version := range packageJSON.OptionalDependencies {
+		initialDeps = append(initialDeps, PackageInfo{Name: name, Version: version, Optional: true})
 	}
 
 	// Resolve dependencies
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-	httpSemaphore := semaphore.NewWeighted(64)
+	client := opts.registryClient()
+	httpSemaphore := semaphore.NewWeighted(opts.networkConcurrency())
 	resolver := NewPackageResolver(client, httpSemaphore)
-	depTree, err := resolver.ResolveDependencies(context.Background(), initialDeps)
+	resolver.stats = opts.cacheStats
+	resolver.avoidDeprecated = opts.NoDeprecated
+	resolver.hideDeprecated = opts.NoDeprecationWarnings
+	resolver.manifestPath = packageJSONPath
+	resolver.overrides = opts.Overrides
+	resolveStart := time.Now()
+	resolveCtx, resolveSpan := startSpan(opts.context(), "resolve", spanKindInternal)
+	depTree, err := resolver.ResolveDependencies(resolveCtx, initialDeps)
+	resolveSpan.finish(err)
 	if err != nil {
-		fmt.Printf("Error resolving dependencies: %v\n", err)
-		os.Exit(1)
+		printError("resolving dependencies: %v", err)
+		return err
 	}
 
+	// Anything only reachable from the root's devDependencies is marked dev,
+	// and anything only reachable through optionalDependencies is optional
+	depTree = MarkDevDependencies(depTree)
+	depTree = MarkOptionalDependencies(depTree)
+	opts.timings.since(phaseResolution, resolveStart)
+
 	// Show tree (we might want to update this to show the hoisted structure)
 	renderedDepTree := RenderDepTree(depTree)
 	fmt.Println("Dependency tree:")
@@ -207,56 +1216,100 @@ func Install(directory string) error {
 	fmt.Println("")
 
 	// Calculate hoisted install paths
-	hoistedTree := HoistDependencies(depTree)
+	linkStart := time.Now()
+	_, linkSpan := startSpan(opts.context(), "link", spanKindInternal)
+	var hoistReport *HoistReport
+	if opts.HoistReport {
+		hoistReport = &HoistReport{}
+	}
+	hoistedTree := hoistDependencies(depTree, hoistReport)
 	renderedHoistedTree := RenderDepTree(hoistedTree)
 	fmt.Println("Hoisted tree:")
 	fmt.Println(renderedHoistedTree)
 	fmt.Println("")
 
 	lockfile, err := GenerateLockFile(hoistedTree)
+	linkSpan.finish(err)
 	if err != nil {
-		fmt.Printf("Error generating lockfile: %v\n", err)
-		os.Exit(1)
+		printError("generating lockfile: %v", err)
+		return err
 	}
+	opts.timings.since(phaseLinking, linkStart)
 	fmt.Printf("Lockfile:")
 	fmt.Println(lockfile)
 
 	lockfilePath := filepath.Join(directory, "package-lock.json")
+	oldPackages := map[string]json.RawMessage{}
+	if oldLock, err := readLockFile(lockfilePath); err == nil {
+		oldPackages = oldLock.Packages
+	}
 	err = os.WriteFile(lockfilePath, []byte(lockfile), 0644)
 	if err != nil {
-		fmt.Printf("Error writing lockfile: %v\n", err)
-		os.Exit(1)
+		printError("writing lockfile: %v", err)
+		return err
+	}
+	var newLock PackageLock
+	if err := json.Unmarshal([]byte(lockfile), &newLock); err != nil {
+		return err
+	}
+	changes := diffLockfiles(oldPackages, newLock.Packages)
+	if err := annotateLockfile(directory, overrideCommand("caladan install", opts.Overrides), oldPackages, newLock.Packages, changes, opts.Overrides, time.Now()); err != nil {
+		printError("writing lockfile annotations: %v", err)
+		return err
+	}
+	if opts.ConflictReport {
+		reportConflicts(newLock.Packages)
+	}
+	if hoistReport != nil {
+		fmt.Print("\n" + RenderHoistReport(hoistReport))
+	}
+	if opts.LockfileOnly {
+		printLockfileOnly(lockfilePath)
+		return nil
 	}
 
-	err = InstallLockFile(lockfilePath)
+	err = InstallLockFile(lockfilePath, opts)
 	if err != nil {
-		fmt.Printf("Error installing lockfile: %v\n", err)
+		printError("installing lockfile: %v", err)
 		return err
 	}
 
 	return nil
 }
 
-func InstallLockFile(lockfilePath string) error {
+// printLockfileOnly reports that a lockfile was written and nothing
+// installed, with --lockfile-only
+func printLockfileOnly(lockfilePath string) {
+	fmt.Printf("\n%s, node_modules was left as it was (--lockfile-only)\n", colorSuccess("Wrote "+lockfilePath))
+}
+
+func InstallLockFile(lockfilePath string, opts InstallOptions) error {
 	data, err := os.ReadFile(lockfilePath)
 	if err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
+		printError("reading file: %v", err)
 		return err
 	}
 
+	// Catch what would otherwise skip packages or fail halfway through
+	if err := checkLockfile(lockfilePath, data); err != nil {
+		printError("%v", err)
+		return err
+	}
 	var packageLock PackageLock
 	if err := json.Unmarshal(data, &packageLock); err != nil {
-		fmt.Printf("Error parsing JSON: %v\n", err)
+		printError("parsing JSON: %v", err)
 		return err
 	}
+	warnLockfileDrift(lockfilePath, packageLock.Packages)
 
 	// Create the collection to hold all dependency info
 	deps := DepCollection{
-		DirectDeps:      make(map[string]PackageInfo),
-		AllPackages:     make(map[string]PackageInfo),
-		OSSpecificPkgs:  make(map[string][]string),
-		CPUSpecificPkgs: make(map[string][]string),
-		OptionalPkgs:    []string{},
+		DirectDeps:       make(map[string]PackageInfo),
+		AllPackages:      make(map[string]PackageInfo),
+		OSSpecificPkgs:   make(map[string][]string),
+		CPUSpecificPkgs:  make(map[string][]string),
+		LibcSpecificPkgs: make(map[string][]string),
+		OptionalPkgs:     []string{},
 	}
 
 	// Process direct dependencies
@@ -292,6 +1345,11 @@ func InstallLockFile(lockfilePath string) error {
 					deps.CPUSpecificPkgs[cpu] = append(deps.CPUSpecificPkgs[cpu], pkgName)
 				}
 
+				// Handle libc specific packages
+				for _, libc := range pkg.Libc {
+					deps.LibcSpecificPkgs[libc] = append(deps.LibcSpecificPkgs[libc], pkgName)
+				}
+
 				// Handle optional packages
 				if pkg.Optional {
 					deps.OptionalPkgs = append(deps.OptionalPkgs, pkgName)
@@ -303,24 +1361,257 @@ func InstallLockFile(lockfilePath string) error {
 	// Get working directory from lockfile path
 	workDir := getWorkingDir(lockfilePath)
 
-	// Create/clean node_modules directory
-	nodeModulesPath := fmt.Sprintf("%s/node_modules", workDir)
-	if err := cleanNodeModules(nodeModulesPath); err != nil {
-		fmt.Printf("Error cleaning node_modules: %v\n", err)
+	if err := enforceConstraints(workDir, &packageLock); err != nil {
+		printError("%v", err)
+		return err
+	}
+
+	// Install for the platforms the project supports, or just the target
+	config, err := loadConfig(workDir)
+	if err != nil {
+		printError("loading config: %v", err)
+		return err
+	}
+	if err := opts.applyConfig(config); err != nil {
+		return err
+	}
+	target, err := targetPlatform(opts.Target)
+	if err != nil {
 		return err
 	}
+	if target != hostPlatform() {
+		fmt.Printf("Installing for %s (host is %s)\n", target, hostPlatform())
+	}
+	if len(opts.Platforms) == 0 {
+		opts.Platforms = config.SupportedArchitectures.platforms(target)
+	}
+
+	// Only a first install offers to add node_modules to .gitignore
+	_, err = os.Lstat(opts.modulesPath(workDir))
+	firstInstall := os.IsNotExist(err)
+	state, stateErr := readInstallState(opts.modulesPath(workDir))
+	if stateErr == nil {
+		opts.previous = state.Packages
+	}
 
-	// Create the node_modules directory
-	if err := os.MkdirAll(nodeModulesPath, 0755); err != nil {
-		fmt.Printf("Error creating node_modules directory: %v\n", err)
+	// An add installs just what it added when node_modules has the rest
+	packages, adding := deps.AllPackages, false
+	if opts.keepInstalled {
+		var reason string
+		switch _, journalErr := os.Stat(filepath.Join(opts.virtualStorePath(workDir), journalFileName)); {
+		case stateErr != nil:
+			reason = "it has no install state"
+		case journalErr == nil:
+			reason = "an earlier install was interrupted"
+		case opts.Clean:
+			reason = "--clean replaces all of it"
+		case config.Budget != (BudgetConfig{}):
+			reason = "the dependency budget covers all of it"
+		default:
+			packages, reason = missingPackages(state, deps.AllPackages, opts)
+		}
+		if reason == "" {
+			adding = true
+			fmt.Printf("Keeping the %d installed packages, adding %d\n", len(state.Packages), len(packages))
+		} else {
+			packages = deps.AllPackages
+			fmt.Printf("Reinstalling node_modules, %s\n", reason)
+		}
+	}
+	if !adding {
+		// Edits to a read-only install are about to be replaced, so say so
+		checkReadOnlyInstall(opts.modulesPath(workDir))
+	}
+
+	// Create/clean node_modules directory
+	// Install into a staging directory that replaces node_modules once
+	// everything has succeeded, leaving node_modules alone otherwise
+	linkStart := time.Now()
+	_, linkSpan := startSpan(opts.context(), "link", spanKindInternal)
+	tx, err := beginInstall(opts.modulesPath(workDir), opts.virtualStorePath(workDir), opts.Durability)
+	linkSpan.finish(err)
+	if err != nil {
+		printError("preparing node_modules: %v", err)
 		return err
 	}
+	tx.clean = opts.Clean
+	tx.removed = opts.removed
+	defer tx.rollback()
+	nodeModulesPath := tx.stagingPath
+	opts.timings.since(phaseLinking, linkStart)
 
 	// Download and extract packages
 	fmt.Println("\nDownloading packages...")
-	DownloadPackages(deps.AllPackages, nodeModulesPath)
+	summary, err := DownloadPackages(packages, nodeModulesPath, opts)
+	if errors.Is(err, errInterrupted) {
+		tx.interrupt()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(summary.Failed) == 0 {
+		if err := enforceBudget(config.Budget, summary, nodeModulesPath, opts.confirm(false)); err != nil {
+			return err
+		}
+
+		// The state goes in with the packages, so it always describes the
+		// node_modules it's in
+		newState := newInstallState(summary, deps.AllPackages, workDir, opts, time.Now())
+		installed := summary
+		if adding {
+			installed = newState.keep(state, deps.AllPackages, summary)
+		}
+		if err := writeInstallState(nodeModulesPath, newState); err != nil {
+			return fmt.Errorf("error writing install state: %v", err)
+		}
+
+		linkStart := time.Now()
+		_, linkSpan := startSpan(opts.context(), "link", spanKindInternal)
+		if adding {
+			err = tx.merge(summary.Packages)
+		} else {
+			err = tx.commit()
+		}
+		linkSpan.finish(err)
+		if err != nil {
+			return fmt.Errorf("error replacing node_modules: %v", err)
+		}
+		opts.timings.since(phaseLinking, linkStart)
+
+		// Scripts run once packages are in their final place, since they
+		// resolve their dependencies from it
+		if ok, reason := shouldRunScripts(opts, target); ok {
+			scriptsStart := time.Now()
+			_, scriptsSpan := startSpan(opts.context(), "install scripts", spanKindInternal)
+			if opts.scriptNetwork.Policy != "" {
+				if opts.scriptProxy, err = startEgressProxy(opts.scriptNetwork); err != nil {
+					scriptsSpan.finish(err)
+					return err
+				}
+			}
+			fetchPrebuilts(opts.context(), summary, tx.nodeModulesPath, opts, config)
+			RunInstallScripts(summary, deps.AllPackages, tx.nodeModulesPath, opts)
+
+			// Like npm install, the project's own prepare script runs once
+			// its dependencies are in place
+			projectEnv := opts.scriptProxy.env(npmConfigEnv(opts), "the project")
+			err := runLifecycle(filepath.Dir(lockfilePath), prepareScripts, projectEnv, opts.scriptTimeouts.fallback, filepath.Join(tx.nodeModulesPath, ".bin"))
+			summary.ScriptNetwork = opts.scriptProxy.close()
+			scriptsSpan.finish(err)
+			opts.timings.since(phaseScripts, scriptsStart)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error preparing project: %w", err)
+			}
+		} else {
+			fmt.Printf("Skipping install scripts: %s\n", reason)
+		}
+
+		if err := writeHiddenLockFile(tx.nodeModulesPath, &packageLock, installed); err != nil {
+			printWarning("couldn't write %s: %v", hiddenLockfileName, err)
+		}
 
-	fmt.Println("\nInstallation complete!")
+		// After install scripts, which may build into their package
+		if opts.ReadOnly {
+			protected, err := protectPackages(tx.nodeModulesPath)
+			if err != nil {
+				printWarning("couldn't make node_modules read-only: %v", err)
+			} else if protected > 0 {
+				fmt.Printf("Made %d package files read-only\n", protected)
+			}
+		}
+
+		collectNotices(summary, deps.AllPackages, opts)
+
+		if !opts.NoAudit {
+			auditStart := time.Now()
+			auditCtx, auditSpan := startSpan(opts.context(), "audit", spanKindClient)
+			var sources []AdvisorySource
+			var exceptions []AuditException
+			sources, err = advisorySources(opts.AuditDB, opts.auditSources)
+			if err == nil {
+				exceptions, err = readAuditExceptions(filepath.Dir(lockfilePath))
+			}
+			if err == nil {
+				summary.Audit, err = auditInstall(auditCtx, summary, sources)
+			}
+			if err == nil {
+				summary.Audit.applyExceptions(exceptions, time.Now())
+				warnExpiredExceptions(summary.Audit)
+			}
+			auditSpan.finish(err)
+			opts.timings.since(phaseAudit, auditStart)
+			if err != nil {
+				if opts.AuditLevel != "" {
+					return fmt.Errorf("error auditing packages for --audit-level: %w", err)
+				}
+				printWarning("couldn't audit packages: %v", err)
+			}
+			annotateAdvisories(summary.Audit, lockfilePath, packageLock.Packages)
+		}
+
+		if len(summary.Failed) == 0 {
+			fmt.Println("\n" + colorSuccess("Installation complete!"))
+		} else {
+			fmt.Println("\n" + colorWarn("Installation finished, but install scripts failed"))
+		}
+
+		if len(summary.backfilled) > 0 {
+			if err := saveBackfilledIntegrity(lockfilePath, summary.backfilled); err != nil {
+				return err
+			}
+			fmt.Printf("Saved integrity for %d packages to %s\n", len(summary.backfilled), lockfilePath)
+		}
+
+		// Offer to keep the new node_modules out of git before it's committed
+		if firstInstall {
+			dirs := []string{opts.modulesPath(workDir), opts.virtualStorePath(workDir)}
+			if err := checkGitignore(workDir, dirs, opts.gitignore, opts.confirm(true)); err != nil {
+				printWarning("%v", err)
+			}
+		}
+	} else {
+		if err := tx.rollback(); err != nil {
+			printError("rolling back: %v", err)
+		}
+		fmt.Println("\n" + colorError("Installation failed, node_modules was left unchanged"))
+	}
+
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			return fmt.Errorf("error writing JSON summary: %v", err)
+		}
+	} else {
+		fmt.Print(RenderInstallSummary(summary))
+		fmt.Print(RenderNotices(summary))
+	}
+	if opts.Timing {
+		fmt.Print(RenderTimings(opts.timings))
+	}
+	if opts.MetricsFile != "" {
+		if err := writeMetricsFile(opts.MetricsFile, collectMetrics(summary, opts.timings, opts.cacheStats)); err != nil {
+			return fmt.Errorf("error writing metrics file: %v", err)
+		}
+		fmt.Printf("Wrote metrics to %s\n", opts.MetricsFile)
+	}
+
+	if len(summary.Failed) > 0 {
+		fmt.Print(RenderFailureReport(summary.Failed))
+		annotateFailures(summary.Failed, lockfilePath)
+		return &failuresError{failures: summary.Failed}
+	}
+	if opts.AuditLevel != "" {
+		if n := summary.Audit.atOrAbove(opts.AuditLevel); n > 0 {
+			return fmt.Errorf("found %d vulnerabilities at or above %s severity", n, opts.AuditLevel)
+		}
+	}
 
 	return nil
 }
@@ -355,52 +1646,48 @@ func extractDirPath(filePath string) string {
 	return filePath[:lastSepIndex]
 }
 
-// cleanNodeModules removes the node_modules directory if it exists
-func cleanNodeModules(nodeModulesPath string) error {
-	// Check if node_modules exists
-	if _, err := os.Stat(nodeModulesPath); err == nil {
-		fmt.Printf("Removing existing node_modules directory: %s\n", nodeModulesPath)
-		return os.RemoveAll(nodeModulesPath)
-	} else if !os.IsNotExist(err) {
-		return err
-	}
-
-	// Directory doesn't exist, nothing to clean
-	return nil
-}
-
-// DownloadPackages downloads and extracts packages to node_modules
-func DownloadPackages(packages map[string]PackageInfo, nodeModulesPath string) {
-	// Setup HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// DownloadPackages downloads and extracts packages to node_modules. A package
+// that fails is recorded in the summary while the rest carry on, unless
+// opts.FailFast is set, in which case the first failure cancels everything
+// in flight and is returned
+func DownloadPackages(packages map[string]PackageInfo, nodeModulesPath string, opts InstallOptions) (*InstallSummary, error) {
+	start := time.Now()
+	summary := &InstallSummary{Packages: []PackageStats{}, backfilled: make(map[string]string)}
+	var summaryLock sync.Mutex
+
+	// Setup the registry client, through the mirrors if there are any
+	client := opts.registryClient()
+
+	// Platforms we're installing for
+	platforms := opts.Platforms
+	if len(platforms) == 0 {
+		platforms = []Platform{hostPlatform()}
 	}
 
-	// Get current OS
-	currentOS := runtime.GOOS
-
 	// Create .bin directory
 	binDir := filepath.Join(nodeModulesPath, ".bin")
 	if err := os.MkdirAll(binDir, 0755); err != nil {
-		fmt.Printf("Error creating .bin directory: %v\n", err)
+		printError("creating .bin directory: %v", err)
+	}
+
+	g, ctx := &errgroup.Group{}, opts.context()
+	if opts.FailFast {
+		g, ctx = errgroup.WithContext(ctx)
 	}
 
-	g, ctx := errgroup.WithContext(context.Background())
+	// HTTP and extraction concurrency
+	httpLimiter, tarLimiter := newInstallLimiters(opts)
 
-	// HTTP concurrency
-	httpSemaphore := semaphore.NewWeighted(64)
+	// Package files are shared between projects through the store
+	store := NewStore(defaultStoreDir(), opts.ImportMethod)
+	pipeline := newDownloadPipeline(client, store, httpLimiter, tarLimiter)
 
-	// Default to 1.5x cores
-	tarWorkers := float64(runtime.NumCPU()) * 1.5
-	if tarWorkersEnv := os.Getenv("TAR_WORKERS"); tarWorkersEnv != "" {
-		if tw, err := parseFloat64(tarWorkersEnv); err == nil && tw > 0 {
-			tarWorkers = tw
-			fmt.Printf("Using custom TAR_WORKERS value: %v\n", tarWorkers)
-		} else {
-			fmt.Printf("Warning: Invalid TAR_WORKERS value '%s', using default: %v\n", tarWorkersEnv, tarWorkers)
-		}
+	if opts.NoVerify {
+		printWarning("--no-verify is set, package integrity won't be checked")
 	}
-	tarSemaphore := semaphore.NewWeighted(int64(tarWorkers))
+
+	// Entries that share a tarball (aliases, nested duplicates) download it once
+	shared := newSharedDownloads()
 
 	// Process each package
 	for pkgName, pkgInfo := range packages {
@@ -409,24 +1696,28 @@ func DownloadPackages(packages map[string]PackageInfo, nodeModulesPath string) {
 			// Skip packages without resolved URLs
 			if pkgInfo.Resolved == "" {
 				fmt.Printf("Skipping %s: No download URL\n", pkgName)
+				summaryLock.Lock()
+				summary.Skipped++
+				summaryLock.Unlock()
 				return nil
 			}
 
-			// Skip OS-specific packages that don't match current OS
-			if len(pkgInfo.OS) > 0 {
-				// Check if package is OS-specific and not for current OS
-				isForCurrentOS := false
-				for _, os := range pkgInfo.OS {
-					if os == currentOS {
-						isForCurrentOS = true
-						break
-					}
-				}
-
-				if !isForCurrentOS {
-					fmt.Printf("Skipping %s: Not compatible with %s\n", pkgName, currentOS)
+			// Skip platform-specific packages that don't match our platforms
+			if ok, field := isCompatibleWithAny(platforms, pkgInfo); !ok {
+				if !opts.ForcePlatform {
+					fmt.Printf("Skipping %s: Not compatible with %s (%s)\n", pkgName, platforms[0], field)
+					summaryLock.Lock()
+					summary.Skipped++
+					summaryLock.Unlock()
 					return nil
 				}
+				fmt.Printf("Installing %s despite %s mismatch (--force-platform)\n", pkgName, field)
+			}
+
+			// The lockfile may have been written against another registry
+			resolved := pkgInfo.Resolved
+			if opts.RewriteResolved {
+				resolved = opts.registries.rewriteResolved(resolvedName(pkgName, pkgInfo), resolved)
 			}
 
 			// Extract normalized package name
@@ -435,114 +1726,201 @@ func DownloadPackages(packages map[string]PackageInfo, nodeModulesPath string) {
 				normalizedPkgName = strings.TrimPrefix(normalizedPkgName, "node_modules/")
 			}
 
+			// Record a failure and carry on, or stop everything with --fail-fast.
+			// Packages stopped by Ctrl-C aren't failures
+			fail := func(err error) error {
+				if interrupted(ctx) {
+					return nil
+				}
+				if opts.FailFast {
+					return fmt.Errorf("%s: %w", normalizedPkgName, err)
+				}
+				fmt.Printf("%s %s: %v\n", colorError("Failed to install"), colorPackage(normalizedPkgName), err)
+				summaryLock.Lock()
+				summary.fail(pkgName, pkgInfo.Version, err)
+				summaryLock.Unlock()
+				return nil
+			}
+
+			// Old lockfiles may only have a hex shasum, or nothing at all
+			integrity, err := normalizeIntegrity(pkgInfo.Integrity, pkgInfo.Shasum)
+			if err != nil {
+				return fail(err)
+			}
+			if opts.NoVerify {
+				integrity = ""
+			} else if integrity == "" && !opts.UpdateIntegrity {
+				return fail(fmt.Errorf("lockfile has no integrity for it, use --update-integrity to compute and save one or --no-verify to skip the check"))
+			}
+
 			// Create package directory
 			// For scoped packages like @babel/core, we need to handle the @ symbol
 			pkgPath := filepath.Join(nodeModulesPath, normalizedPkgName)
 			if err := os.MkdirAll(pkgPath, 0755); err != nil {
-				return fmt.Errorf("error creating directory for %s: %v\n", normalizedPkgName, err)
+				return fail(fmt.Errorf("error creating directory: %v", err))
 			}
 
-			// Download and extract the package tarball
-			err := downloadAndExtractPackage(ctx, httpSemaphore, tarSemaphore, client, pkgInfo.Resolved, pkgInfo.Integrity, pkgPath)
+			// Download and extract the package tarball, or wait for another
+			// entry with the same tarball to and link its files
+			stats := PackageStats{Path: pkgName, Version: pkgInfo.Version}
+			key := integrity
+			if key == "" {
+				key = resolved
+			}
+			leader, wait := shared.claim(key)
+			if !leader {
+				if index := wait(); index != nil {
+					linkStart := time.Now()
+					stats.UnpackedBytes, err = store.linkPackage(index, pkgPath)
+					if err == nil {
+						stats.fromStore = true
+						stats.integrity = index.Integrity
+						stats.Duration = time.Since(linkStart)
+						summaryLock.Lock()
+						summary.add(stats)
+						if opts.UpdateIntegrity && !hasSHA512(pkgInfo.Integrity) {
+							summary.backfilled[pkgName] = stats.integrity
+						}
+						summaryLock.Unlock()
+						return nil
+					}
+					printWarning("%v", err)
+				}
+				// The other entry failed, so try it separately
+			} else {
+				defer func() { shared.finish(key, stats.index) }()
+			}
+			// Upgrading a package that's installed only writes the files
+			// that changed, using the store's index of the old version
+			if previous, ok := opts.previous[pkgName]; ok && previous.Integrity != "" && previous.Integrity != integrity {
+				stats.previous, _ = store.getIndex(previous.Integrity)
+			}
+			pkgCtx, pkgSpan := startSpan(ctx, "install package", spanKindInternal,
+				otlpAttr("package.path", pkgName), otlpAttr("package.version", pkgInfo.Version))
+			err = pipeline.install(pkgCtx, resolved, integrity, pkgPath, false, &stats)
+
+			// A corrupted tarball may come from a cache along the way, so
+			// fetch it once more from the origin
+			var mismatch *IntegrityError
+			if errors.As(err, &mismatch) {
+				printWarning("%v, downloading it again", err)
+				err = quarantinePackage(store, pkgPath, normalizedPkgName, integrity)
+				if err == nil {
+					stats.Retries++
+					err = pipeline.install(pkgCtx, resolved, integrity, pkgPath, true, &stats)
+				}
+				if errors.As(err, &mismatch) {
+					os.RemoveAll(pkgPath)
+				}
+			}
+			if err != nil {
+				stats.index = nil
+			}
+			pkgSpan.setAttrs(
+				otlpIntAttr("package.downloaded_bytes", stats.DownloadedBytes),
+				otlpIntAttr("package.unpacked_bytes", stats.UnpackedBytes),
+				otlpIntAttr("package.retries", int64(stats.Retries)),
+			)
+			pkgSpan.finish(err)
 			if err != nil {
 				if pkgInfo.Optional {
 					// For optional packages, just log the error and continue
-					fmt.Printf("Warning: Optional package %s failed to install: %v\n", normalizedPkgName, err)
+					printWarning("Optional package %s failed to install: %v", normalizedPkgName, err)
 					return nil
 				}
-				return fmt.Errorf("error downloading/extracting %s: %v\n", normalizedPkgName, err)
+				return fail(err)
 			}
 
+			summaryLock.Lock()
+			summary.add(stats)
+			if opts.UpdateIntegrity && !hasSHA512(pkgInfo.Integrity) {
+				summary.backfilled[pkgName] = stats.integrity
+			}
+			summaryLock.Unlock()
+			opts.timings.add(phaseDownload, stats.downloadTime)
+			opts.timings.add(phaseExtraction, stats.extractTime)
 			return nil
 		})
 	}
 
 	// Wait for all packages to complete
-	if err := g.Wait(); err != nil {
-		fmt.Printf("Error during package downloads: %v\n", err)
-		os.Exit(1)
+	if err := g.Wait(); interrupted(ctx) {
+		return summary, errInterrupted
+	} else if err != nil {
+		return summary, fmt.Errorf("error during package downloads: %w", err)
 	}
 
 	// Setup bin scripts after all packages are downloaded
-	setupBinScripts(packages, nodeModulesPath)
+	binStart := time.Now()
+	_, binSpan := startSpan(opts.context(), "bin setup", spanKindInternal)
+	summary.BrokenBins = setupBinScripts(packages, nodeModulesPath)
+	binSpan.finish(nil)
+	opts.timings.since(phaseBinSetup, binStart)
+
+	summary.Duration = time.Since(start)
+	summary.NetworkConcurrency = httpLimiter.current()
+	summary.TarWorkers = tarLimiter.current()
+	return summary, nil
 }
 
-// downloadAndExtractPackage downloads a package tarball and extracts it
-func downloadAndExtractPackage(ctx context.Context, httpSemaphore, tarSemaphore *semaphore.Weighted, client *http.Client, url, integrity, destPath string) error {
-	httpSemaphore.Acquire(ctx, 1)
-	defer httpSemaphore.Release(1)
-
-	// Download and extract the package
-	fmt.Printf("Downloading %s\n", url)
-
-	// Download the tarball
-	resp, err := client.Get(url)
-	if err != nil {
-		return fmt.Errorf("error downloading package: %v", err)
-	}
-	defer resp.Body.Close()
+// sharedDownloads lets entries of an install that resolve to the same
+// tarball download and extract it once. The first entry to claim a tarball
+// fetches it and the rest wait, then link its files from the store
+type sharedDownloads struct {
+	lock      sync.Mutex
+	downloads map[string]*sharedDownload
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed with status: %s", resp.Status)
-	}
+// sharedDownload is a tarball being fetched, done is closed once index is
+// set, nil if it failed
+type sharedDownload struct {
+	done  chan struct{}
+	index *packageIndex
+}
 
-	// Setup hash verification
-	var hash interface {
-		io.Writer
-		Sum() []byte
-	}
+func newSharedDownloads() *sharedDownloads {
+	return &sharedDownloads{downloads: make(map[string]*sharedDownload)}
+}
 
-	if strings.HasPrefix(integrity, "sha1-") {
-		h := sha1.New()
-		hash = &shaWrapper{h, func() []byte { return h.Sum(nil) }}
-	} else if strings.HasPrefix(integrity, "sha512-") {
-		h := sha512.New()
-		hash = &shaWrapper{h, func() []byte { return h.Sum(nil) }}
-	} else {
-		return fmt.Errorf("unsupported integrity check: %s", integrity)
+// claim reports whether the caller is the first for a tarball, keyed by
+// its integrity or URL, and so has to fetch it and call finish. Anyone
+// else gets a wait that returns the first one's index
+func (s *sharedDownloads) claim(key string) (bool, func() *packageIndex) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if download, ok := s.downloads[key]; ok {
+		return false, func() *packageIndex {
+			<-download.done
+			return download.index
+		}
 	}
+	s.downloads[key] = &sharedDownload{done: make(chan struct{})}
+	return true, nil
+}
 
-	// Use a TeeReader to compute hash while reading
-	teeReader := io.TeeReader(resp.Body, hash)
-	reader := teeReader
+// finish hands the extracted tarball's index to whoever is waiting on it
+func (s *sharedDownloads) finish(key string, index *packageIndex) {
+	s.lock.Lock()
+	download := s.downloads[key]
+	s.lock.Unlock()
+	download.index = index
+	close(download.done)
+}
 
-	// Extract directly from the download stream
-	tarSemaphore.Acquire(ctx, 1)
-	defer tarSemaphore.Release(1)
-	fmt.Printf("Extracting %s\n", destPath)
-	err = extractTarGz(reader, destPath)
-	if err != nil {
-		return fmt.Errorf("error extracting package: %v", err)
+// quarantinePackage throws away a package whose tarball failed its integrity
+// check, along with the cached metadata it may have been resolved from and
+// its index in the store, and leaves an empty directory to extract into again
+func quarantinePackage(store *Store, pkgPath, pkgName, integrity string) error {
+	if err := os.RemoveAll(pkgPath); err != nil {
+		return fmt.Errorf("error removing corrupted package: %v", err)
 	}
-
-	// Calculate expected hash from integrity string
-	expectedHashBase64 := strings.Split(integrity, "-")[1]
-	expectedHash, err := base64.StdEncoding.DecodeString(expectedHashBase64)
-	if err != nil {
-		return fmt.Errorf("error decoding integrity hash: %v", err)
+	if err := store.evictIndex(integrity); err != nil {
+		printWarning("failed to evict %s from the store: %v", pkgName, err)
 	}
-
-	// Compare with actual hash
-	actualHash := hash.Sum()
-	if !compareHashes(actualHash, expectedHash) {
-		return fmt.Errorf("integrity check failed")
+	if err := NewResolutionCache(defaultCacheDir()).evictMetadata(npmRegistryURL, pkgName); err != nil {
+		printWarning("failed to evict cached metadata for %s: %v", pkgName, err)
 	}
-
-	return nil
-}
-
-// shaWrapper is a helper to make different hash implementations behave the same
-type shaWrapper struct {
-	w io.Writer
-	f func() []byte
-}
-
-func (s *shaWrapper) Write(p []byte) (n int, err error) {
-	return s.w.Write(p)
-}
-
-func (s *shaWrapper) Sum() []byte {
-	return s.f()
+	return os.MkdirAll(pkgPath, 0755)
 }
 
 // compareHashes compares two byte slices for equality
@@ -558,15 +1936,20 @@ func compareHashes(a, b []byte) bool {
 	return true
 }
 
-// extractTarGz extracts a tar.gz file to the destination path
-func extractTarGz(src io.Reader, destPath string) error {
+// extractTarGz extracts a tar.gz file to the destination path and returns
+// the number of bytes written to regular files. With a store, files are
+// added to it and linked into place, and the returned index lists them
+func extractTarGz(ctx context.Context, src io.Reader, destPath string, store *Store, previous *packageIndex) (int64, *packageIndex, error) {
+	var unpacked int64
+	index := newPackageIndex()
+
 	// Use buffered I/O for better performance
 	bufReader := bufio.NewReaderSize(src, 1<<20) // 1MB buffer
 
 	// Create a gzip reader
 	gzr, err := gzip.NewReader(bufReader)
 	if err != nil {
-		return fmt.Errorf("error creating gzip reader: %v", err)
+		return unpacked, nil, fmt.Errorf("error creating gzip reader: %v", err)
 	}
 	defer gzr.Close()
 
@@ -580,14 +1963,18 @@ func extractTarGz(src io.Reader, destPath string) error {
 	// Predefine value to reduce allocations in loop
 	packagePrefix := "package/"
 
-	// Process each file in tarball
+	// Process each file in tarball, stopping between files when the install
+	// is cancelled so none is left half written
 	for {
+		if err := ctx.Err(); err != nil {
+			return unpacked, nil, context.Cause(ctx)
+		}
 		header, err := tr.Next()
 		if err == io.EOF {
 			break // End of archive
 		}
 		if err != nil {
-			return fmt.Errorf("error reading tar: %v", err)
+			return unpacked, nil, fmt.Errorf("error reading tar: %v", err)
 		}
 
 		// Skip package dir prefix (usually "package/")
@@ -610,7 +1997,7 @@ func extractTarGz(src io.Reader, destPath string) error {
 			// Create dirs with proper perms
 			if !createdDirs[target] {
 				if err := os.MkdirAll(target, 0755); err != nil {
-					return fmt.Errorf("error creating directory %s: %v", target, err)
+					return unpacked, nil, fmt.Errorf("error creating directory %s: %v", target, err)
 				}
 				createdDirs[target] = true
 			}
@@ -620,36 +2007,57 @@ func extractTarGz(src io.Reader, destPath string) error {
 			dir := filepath.Dir(target)
 			if !createdDirs[dir] {
 				if err := os.MkdirAll(dir, 0755); err != nil {
-					return fmt.Errorf("error creating directory for file %s: %v", target, err)
+					return unpacked, nil, fmt.Errorf("error creating directory for file %s: %v", target, err)
 				}
 				createdDirs[dir] = true
 			}
 
+			if store != nil {
+				// A file the version being upgraded from had at the same
+				// path and size is most likely unchanged
+				var file storeFile
+				if known, ok := previous.file(name); ok && known.Size == header.Size && header.Size <= maxDiffedFileSize {
+					file, err = store.addKnownFile(tr, os.FileMode(header.Mode))
+				} else {
+					file, err = store.addFile(tr, os.FileMode(header.Mode))
+				}
+				if err != nil {
+					return unpacked, nil, fmt.Errorf("error adding %s to the store: %v", target, err)
+				}
+				if err := store.linkFile(file, target); err != nil {
+					return unpacked, nil, fmt.Errorf("error linking %s from the store: %v", target, err)
+				}
+				index.Files[name] = file
+				unpacked += file.Size
+				continue
+			}
+
 			// Create file with buffer for better perf
 			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
 			if err != nil {
-				return fmt.Errorf("error creating file %s: %v", target, err)
+				return unpacked, nil, fmt.Errorf("error creating file %s: %v", target, err)
 			}
 
 			// Use buffered I/O for file writing
 			bufWriter := bufio.NewWriterSize(f, 1<<16) // 64KB buffer
 
 			// Copy content
-			_, err = io.Copy(bufWriter, tr)
+			n, err := io.Copy(bufWriter, tr)
+			unpacked += n
 			if err != nil {
 				bufWriter.Flush()
 				f.Close()
-				return fmt.Errorf("error writing to file %s: %v", target, err)
+				return unpacked, nil, fmt.Errorf("error writing to file %s: %v", target, err)
 			}
 
 			// Ensure all data written
 			if err = bufWriter.Flush(); err != nil {
 				f.Close()
-				return fmt.Errorf("error flushing buffer for file %s: %v", target, err)
+				return unpacked, nil, fmt.Errorf("error flushing buffer for file %s: %v", target, err)
 			}
 
 			if err := f.Close(); err != nil {
-				return fmt.Errorf("error closing file %s: %v", target, err)
+				return unpacked, nil, fmt.Errorf("error closing file %s: %v", target, err)
 			}
 
 		case tar.TypeSymlink:
@@ -657,7 +2065,7 @@ func extractTarGz(src io.Reader, destPath string) error {
 			dir := filepath.Dir(target)
 			if !createdDirs[dir] {
 				if err := os.MkdirAll(dir, 0755); err != nil {
-					return fmt.Errorf("error creating directory for symlink %s: %v", target, err)
+					return unpacked, nil, fmt.Errorf("error creating directory for symlink %s: %v", target, err)
 				}
 				createdDirs[dir] = true
 			}
@@ -665,26 +2073,32 @@ func extractTarGz(src io.Reader, destPath string) error {
 			// Remove existing symlink to avoid errors
 			err = os.Remove(target)
 			if err != nil {
-				return fmt.Errorf("error removing existing symlink %s: %v", target, err)
+				return unpacked, nil, fmt.Errorf("error removing existing symlink %s: %v", target, err)
 			}
 
+			if store != nil {
+				index.Symlinks[name] = header.Linkname
+			}
 			if err := os.Symlink(header.Linkname, target); err != nil {
 				// If symlink creation fails, create text file with link info
 				linkInfo := fmt.Sprintf("Symlink to: %s", header.Linkname)
 				if writeErr := os.WriteFile(target+".symlink", []byte(linkInfo), 0644); writeErr != nil {
-					return fmt.Errorf("error creating symlink placeholder for %s: %v", target, writeErr)
+					return unpacked, nil, fmt.Errorf("error creating symlink placeholder for %s: %v", target, writeErr)
 				}
 			}
 		}
 	}
 
-	return nil
+	return unpacked, index, nil
 }
 
-// setupBinScripts creates symlinks for executable scripts in node_modules/.bin
-func setupBinScripts(packages map[string]PackageInfo, nodeModulesPath string) {
+// setupBinScripts creates symlinks for executable scripts in
+// node_modules/.bin, returning the bins it didn't link because their target
+// is missing or isn't a file
+func setupBinScripts(packages map[string]PackageInfo, nodeModulesPath string) []BrokenBin {
 	binDir := filepath.Join(nodeModulesPath, ".bin")
 	fmt.Println("\nSetting up bin scripts...")
+	var broken []BrokenBin
 
 	for pkgName, pkgInfo := range packages {
 		binMap := make(map[string]string)
@@ -732,25 +2146,70 @@ func setupBinScripts(packages map[string]PackageInfo, nodeModulesPath string) {
 			scriptFullPath := filepath.Join(nodeModulesPath, normalizedPkgName, scriptPath)
 			binLinkPath := filepath.Join(binDir, cmdName)
 
-			// Verify script file exists and is readable
-			if _, err := os.Stat(scriptFullPath); err != nil {
-				fmt.Printf("Warning: Script %s not found for %s: %v\n", scriptPath, cmdName, err)
+			// A broken bin is reported rather than linked, so .bin never
+			// has links that go nowhere
+			if err := checkBinTarget(filepath.Join(nodeModulesPath, normalizedPkgName), scriptPath); err != nil {
+				broken = append(broken, BrokenBin{Path: pkgName, Version: pkgInfo.Version, Bin: cmdName, Target: scriptPath, Reason: err.Error()})
 				continue
 			}
 
 			// Create the symlink
 			if err := createExecutableSymlink(scriptFullPath, binLinkPath); err != nil {
-				fmt.Printf("Error creating symlink for %s: %v\n", cmdName, err)
+				printError("creating symlink for %s: %v", cmdName, err)
 			} else {
 				// Verify the symlink was created successfully
 				if _, err := os.Lstat(binLinkPath); err != nil {
-					fmt.Printf("Warning: Symlink verification failed for %s: %v\n", cmdName, err)
+					printWarning("Symlink verification failed for %s: %v", cmdName, err)
 				} else {
 					fmt.Printf("Created bin script: %s -> %s\n", cmdName, scriptFullPath)
 				}
 			}
 		}
 	}
+
+	sort.Slice(broken, func(i, j int) bool {
+		if broken[i].Path != broken[j].Path {
+			return broken[i].Path < broken[j].Path
+		}
+		return broken[i].Bin < broken[j].Bin
+	})
+	return broken
+}
+
+// checkBinTarget checks that a package's bin is a regular file inside the
+// package, following the package's own symlinks to it
+func checkBinTarget(pkgDir, target string) error {
+	path := filepath.Join(pkgDir, target)
+	if !isWithin(pkgDir, path) {
+		return fmt.Errorf("%s is outside the package", target)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s doesn't exist", target)
+	} else if err != nil {
+		return err
+	}
+	// The package itself may be a link, e.g. to a workspace
+	if realPkgDir, err := filepath.EvalSymlinks(pkgDir); err == nil && !isWithin(realPkgDir, resolved) {
+		return fmt.Errorf("%s links outside the package", target)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", target)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s isn't a regular file", target)
+	}
+	return nil
+}
+
+// isWithin reports whether path is dir or inside it
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 // readPackageJSONBin reads the bin field from a package.json file
@@ -798,12 +2257,14 @@ func readPackageJSONBin(packageJSONPath, pkgName string) (map[string]string, err
 // createExecutableSymlink creates a symlink and ensures the target is executable
 func createExecutableSymlink(targetPath, linkPath string) error {
 	// Check if the target exists
-	if _, err := os.Stat(targetPath); err != nil {
+	info, err := os.Stat(targetPath)
+	if err != nil {
 		return fmt.Errorf("target script not found: %v", err)
 	}
 
-	// Make the target executable
-	if err := os.Chmod(targetPath, 0755); err != nil {
+	// Make the target executable, without making a read-only file (or the
+	// store blob it's linked to) writable
+	if err := os.Chmod(targetPath, info.Mode().Perm()|0555); err != nil {
 		return fmt.Errorf("failed to make script executable: %v", err)
 	}
 
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -24,7 +33,7 @@ func TestDownloadPackages(t *testing.T) {
 	}
 
 	// Download the package
-	DownloadPackages(packages, tmpDir)
+	DownloadPackages(packages, tmpDir, InstallOptions{})
 
 	// Verify that the package was downloaded and extracted correctly
 	expectedFiles := []string{
@@ -41,3 +50,209 @@ func TestDownloadPackages(t *testing.T) {
 		}
 	}
 }
+
+// testTarball builds a package tarball holding a package.json and returns it
+// with its integrity string
+func testTarball(t *testing.T, name, version string) ([]byte, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	manifest := []byte(`{"name":"` + name + `","version":"` + version + `"}`)
+	if err := tw.WriteHeader(&tar.Header{Name: "package/package.json", Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha512.Sum512(buf.Bytes())
+	return buf.Bytes(), "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestDownloadPackagesCollectsFailures(t *testing.T) {
+	tarball, integrity := testTarball(t, "good", "1.0.0")
+	// A tarball with the same integrity would be linked from good's instead
+	_, missingIntegrity := testTarball(t, "missing", "1.0.0")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/good.tgz" {
+			w.Write(tarball)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+
+	packages := map[string]PackageInfo{
+		"node_modules/good":    {Version: "1.0.0", Resolved: server.URL + "/good.tgz", Integrity: integrity},
+		"node_modules/missing": {Version: "1.0.0", Resolved: server.URL + "/missing.tgz", Integrity: missingIntegrity},
+		"node_modules/corrupt": {Version: "2.0.0", Resolved: server.URL + "/good.tgz", Integrity: "sha512-AAAA"},
+	}
+
+	tmpDir := t.TempDir()
+	summary, err := DownloadPackages(packages, tmpDir, InstallOptions{})
+	if err != nil {
+		t.Fatalf("DownloadPackages() error = %v", err)
+	}
+
+	if summary.Installed != 1 {
+		t.Errorf("Installed = %d, want 1", summary.Installed)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "good", "package.json")); err != nil {
+		t.Errorf("good package wasn't installed: %v", err)
+	}
+
+	failed := sortedFailures(summary.Failed)
+	if len(failed) != 2 || failed[0].Path != "node_modules/corrupt" || failed[1].Path != "node_modules/missing" {
+		t.Fatalf("Failed = %+v, want corrupt and missing", failed)
+	}
+	if !strings.Contains(failed[0].Error, "integrity check failed") {
+		t.Errorf("corrupt failure = %q, want an integrity error", failed[0].Error)
+	}
+	if !strings.Contains(failed[1].Error, "404") {
+		t.Errorf("missing failure = %q, want a 404", failed[1].Error)
+	}
+
+	// The install's error unwraps to each failure
+	err = &failuresError{failures: failed}
+	var integrityErr *IntegrityError
+	if !errors.As(err, &integrityErr) || integrityErr.Expected != "sha512-AAAA" {
+		t.Errorf("errors.As(%v, *IntegrityError) = %+v", err, integrityErr)
+	}
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) || registryErr.StatusCode != http.StatusNotFound {
+		t.Errorf("errors.As(%v, *RegistryError) = %+v", err, registryErr)
+	}
+
+	_, err = DownloadPackages(packages, t.TempDir(), InstallOptions{FailFast: true})
+	if err == nil {
+		t.Errorf("DownloadPackages() with FailFast succeeded, want an error")
+	} else if !errors.As(err, &integrityErr) && !errors.As(err, &registryErr) {
+		t.Errorf("DownloadPackages() with FailFast error = %v, want a typed error", err)
+	}
+}
+
+func TestDownloadPackagesRetriesIntegrityMismatch(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+
+	tarball, integrity := testTarball(t, "flaky", "1.0.0")
+	corrupt, _ := testTarball(t, "flaky", "0.0.0")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// A stale cache serves the wrong tarball until told not to
+		if r.Header.Get("Cache-Control") == "no-cache" {
+			w.Write(tarball)
+		} else {
+			w.Write(corrupt)
+		}
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	packages := map[string]PackageInfo{
+		"node_modules/flaky": {Version: "1.0.0", Resolved: server.URL + "/flaky.tgz", Integrity: integrity},
+	}
+	summary, err := DownloadPackages(packages, tmpDir, InstallOptions{})
+	if err != nil {
+		t.Fatalf("DownloadPackages() error = %v", err)
+	}
+
+	if len(summary.Failed) != 0 || summary.Installed != 1 {
+		t.Fatalf("summary = %+v, want the package installed on retry", summary)
+	}
+	if requests != 2 || summary.Retries != 1 {
+		t.Errorf("requests = %d, retries = %d, want 2 and 1", requests, summary.Retries)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpDir, "flaky", "package.json"))
+	if err != nil || !strings.Contains(string(data), `"1.0.0"`) {
+		t.Errorf("package.json = %s, %v, want the good tarball's", data, err)
+	}
+}
+
+func TestDownloadPackagesMissingIntegrity(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+
+	tarball, integrity := testTarball(t, "legacy", "1.0.0")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	packages := map[string]PackageInfo{
+		"node_modules/legacy": {Version: "1.0.0", Resolved: server.URL + "/legacy.tgz"},
+	}
+
+	summary, err := DownloadPackages(packages, t.TempDir(), InstallOptions{})
+	if err != nil {
+		t.Fatalf("DownloadPackages() error = %v", err)
+	}
+	if len(summary.Failed) != 1 || !strings.Contains(summary.Failed[0].Error, "no integrity") {
+		t.Errorf("Failed = %+v, want a missing integrity failure", summary.Failed)
+	}
+
+	summary, err = DownloadPackages(packages, t.TempDir(), InstallOptions{UpdateIntegrity: true})
+	if err != nil {
+		t.Fatalf("DownloadPackages() error = %v", err)
+	}
+	if len(summary.Failed) != 0 || summary.backfilled["node_modules/legacy"] != integrity {
+		t.Errorf("backfilled = %v, failed = %+v, want %s computed", summary.backfilled, summary.Failed, integrity)
+	}
+}
+
+func TestSetupBinScriptsReportsBrokenBins(t *testing.T) {
+	nodeModules := t.TempDir()
+	pkg := filepath.Join(nodeModules, "tool")
+	writeTestFile(t, filepath.Join(pkg, "cli.js"), "#!/usr/bin/env node\n")
+	writeTestFile(t, filepath.Join(pkg, "lib", "index.js"), "")
+	writeTestFile(t, filepath.Join(nodeModules, "other", "index.js"), "")
+	if err := os.Mkdir(filepath.Join(nodeModules, ".bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Links to the package's own files are followed, links out of it aren't
+	if err := os.Symlink("cli.js", filepath.Join(pkg, "linked.js")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "other", "index.js"), filepath.Join(pkg, "escape.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	packages := map[string]PackageInfo{
+		"node_modules/tool": {Version: "1.0.0", Bin: map[string]interface{}{
+			"tool":    "cli.js",
+			"linked":  "linked.js",
+			"missing": "dist/cli.js",
+			"dir":     "lib",
+			"escape":  "escape.js",
+			"parent":  "../other/index.js",
+		}},
+	}
+	broken := setupBinScripts(packages, nodeModules)
+
+	var bins []string
+	for _, bin := range broken {
+		bins = append(bins, bin.Bin)
+	}
+	if got := strings.Join(bins, ","); got != "dir,escape,missing,parent" {
+		t.Errorf("broken bins = %s, want dir,escape,missing,parent", got)
+	}
+	for _, bin := range []string{"tool", "linked"} {
+		if _, err := os.Stat(filepath.Join(nodeModules, ".bin", bin)); err != nil {
+			t.Errorf("bin %s wasn't linked: %v", bin, err)
+		}
+	}
+	for _, bin := range bins {
+		if _, err := os.Lstat(filepath.Join(nodeModules, ".bin", bin)); !os.IsNotExist(err) {
+			t.Errorf("broken bin %s was linked", bin)
+		}
+	}
+}
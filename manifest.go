@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// How serious a manifest issue is. Errors fail caladan check, warnings are
+// only printed
+const (
+	manifestError   = "error"
+	manifestWarning = "warning"
+)
+
+// ManifestIssue is a problem with a field of package.json. Pointer is a JSON
+// pointer to the field, like /bin/tsc
+type ManifestIssue struct {
+	Severity string `json:"severity"`
+	Pointer  string `json:"pointer"`
+	Message  string `json:"message"`
+}
+
+var (
+	// strictSemver is semver.org's version grammar, without a leading v
+	strictSemver = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+		`(?:-(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*)?` +
+		`(?:\+[0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*)?$`)
+	// partialVersion is a version in a range, where x, X, or * stand for
+	// any number and trailing parts can be left out, like 1.x or 2
+	partialVersion = `v?(?:\d+|[xX*])(?:\.(?:\d+|[xX*])(?:\.(?:\d+|[xX*])` +
+		`(?:-[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?)?)?`
+	rangeComparator = regexp.MustCompile(`^(?:>=|<=|>|<|=|~>|~|\^)?` + partialVersion + `$`)
+	rangeHyphen     = regexp.MustCompile(`^(` + partialVersion + `)\s+-\s+(` + partialVersion + `)$`)
+	// rangeOperatorSpace is the space node's semver allows after an operator
+	rangeOperatorSpace = regexp.MustCompile(`(>=|<=|>|<|=|~>|~|\^)\s+`)
+)
+
+// validRange reports whether a range is in node's semver range grammar:
+// comparator sets separated by ||, like ">=18 <21 || ^22.1.0", where a set
+// may be a hyphen range like "1.2 - 2"
+func validRange(versionRange string) bool {
+	for _, set := range strings.Split(versionRange, "||") {
+		set = strings.TrimSpace(set)
+		if set == "" || rangeHyphen.MatchString(set) {
+			continue
+		}
+		for _, comparator := range strings.Fields(rangeOperatorSpace.ReplaceAllString(set, "$1")) {
+			if !rangeComparator.MatchString(comparator) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// jsonPointer builds a JSON pointer from keys, escaping ~ and /
+func jsonPointer(keys ...string) string {
+	var builder strings.Builder
+	for _, key := range keys {
+		builder.WriteString("/" + strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1"))
+	}
+	return builder.String()
+}
+
+// objectEntries decodes a JSON object keeping the order of its keys, which
+// matters for exports conditions. ok is false when raw isn't an object
+func objectEntries(raw json.RawMessage) (keys []string, values map[string]json.RawMessage, ok bool) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, nil, false
+	}
+	values = make(map[string]json.RawMessage)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, false
+		}
+		key := token.(string)
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, nil, false
+		}
+		if _, seen := values[key]; !seen {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+	return keys, values, true
+}
+
+// manifestChecker collects the issues found in a package.json
+type manifestChecker struct {
+	dir    string
+	issues []ManifestIssue
+}
+
+func (c *manifestChecker) report(severity, pointer, format string, args ...interface{}) {
+	c.issues = append(c.issues, ManifestIssue{Severity: severity, Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateManifest checks the fields of a package.json in dir: the name
+// against npm's naming rules, the version against semver, that bins exist,
+// the syntax of exports, that engines are version ranges, and that the
+// catalogs pin what catalog: ranges refer to
+func validateManifest(dir string, data []byte) ([]ManifestIssue, error) {
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing package.json: %v", err)
+	}
+	c := &manifestChecker{dir: dir}
+	var private bool
+	json.Unmarshal(manifest["private"], &private)
+
+	var name string
+	if raw, ok := manifest["name"]; !ok {
+		if !private {
+			c.report(manifestWarning, "/name", "missing, a package needs one to be published")
+		}
+	} else if err := json.Unmarshal(raw, &name); err != nil {
+		c.report(manifestError, "/name", "must be a string")
+	} else if err := validatePackageName(name); err != nil {
+		c.report(manifestError, "/name", "%v", err)
+	}
+
+	var version string
+	if raw, ok := manifest["version"]; !ok {
+		if !private {
+			c.report(manifestWarning, "/version", "missing, a package needs one to be published")
+		}
+	} else if err := json.Unmarshal(raw, &version); err != nil {
+		c.report(manifestError, "/version", "must be a string")
+	} else if !strictSemver.MatchString(version) {
+		c.report(manifestError, "/version", "%q isn't a semver version like 1.2.3 or 1.2.3-beta.1", version)
+	}
+
+	if raw, ok := manifest["bin"]; ok {
+		c.checkBin(raw, name)
+	}
+	if raw, ok := manifest["exports"]; ok {
+		c.checkExports(raw)
+	}
+	if raw, ok := manifest["engines"]; ok {
+		c.checkEngines(raw)
+	}
+	c.checkCatalogs(data)
+	return c.issues, nil
+}
+
+// checkCatalogs checks the catalogs are valid and pin everything the
+// manifest's catalog: ranges refer to
+func (c *manifestChecker) checkCatalogs(data []byte) {
+	projectCatalogs, err := parseCatalogs(data)
+	if err != nil {
+		c.report(manifestError, "/catalogs", "%v", err)
+		return
+	}
+	var manifest PackageInfo
+	json.Unmarshal(data, &manifest)
+	for _, section := range dependencySections {
+		deps := workspace{manifest: manifest}.sectionDeps(section)
+		names := make([]string, 0, len(deps))
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err := projectCatalogs.catalogRange(name, deps[name]); err != nil {
+				c.report(manifestError, jsonPointer(section, name), "%v", err)
+			}
+		}
+	}
+}
+
+// checkBin checks bin is a path or an object of command names to paths, and
+// that each path is a file in the package
+func (c *manifestChecker) checkBin(raw json.RawMessage, name string) {
+	var file string
+	if err := json.Unmarshal(raw, &file); err == nil {
+		if name == "" {
+			c.report(manifestError, "/bin", "a bin path needs a name to link it as, use an object of commands instead")
+		}
+		c.checkBinFile("/bin", file)
+		return
+	}
+	var bins map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &bins); err != nil {
+		c.report(manifestError, "/bin", "must be a path or an object of command names to paths")
+		return
+	}
+	commands := make([]string, 0, len(bins))
+	for command := range bins {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		pointer := jsonPointer("bin", command)
+		if command == "" || strings.ContainsAny(command, `/\`) || command == "." || command == ".." {
+			c.report(manifestError, pointer, "%q isn't a command name", command)
+		}
+		if err := json.Unmarshal(bins[command], &file); err != nil {
+			c.report(manifestError, pointer, "must be a path")
+			continue
+		}
+		c.checkBinFile(pointer, file)
+	}
+}
+
+// checkBinFile checks a bin's path stays in the package and is a file
+func (c *manifestChecker) checkBinFile(pointer, file string) {
+	clean := path.Clean(filepath.ToSlash(file))
+	if file == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		c.report(manifestError, pointer, "%q isn't a path in the package", file)
+		return
+	}
+	info, err := os.Stat(filepath.Join(c.dir, filepath.FromSlash(clean)))
+	switch {
+	case err != nil:
+		c.report(manifestError, pointer, "%s doesn't exist", file)
+	case info.IsDir():
+		c.report(manifestError, pointer, "%s is a directory, not a script", file)
+	}
+}
+
+// checkExports checks the syntax node's resolver expects of exports: a
+// target, an array of fallbacks, or an object of either subpaths or
+// conditions but not both
+func (c *manifestChecker) checkExports(raw json.RawMessage) {
+	keys, values, ok := objectEntries(raw)
+	if !ok {
+		c.checkExportsTarget(raw, "/exports")
+		return
+	}
+	subpaths := 0
+	for _, key := range keys {
+		if strings.HasPrefix(key, ".") {
+			subpaths++
+		}
+	}
+	if subpaths == 0 {
+		c.checkExportsTarget(raw, "/exports")
+		return
+	}
+	if subpaths != len(keys) {
+		c.report(manifestError, "/exports", "can't mix subpaths, which start with ., and conditions")
+		return
+	}
+	for _, key := range keys {
+		pointer := jsonPointer("exports", key)
+		switch {
+		case key != "." && !strings.HasPrefix(key, "./"):
+			c.report(manifestError, pointer, "subpaths are . or start with ./")
+		case strings.Count(key, "*") > 1:
+			c.report(manifestError, pointer, "a subpath pattern can only have one *")
+		}
+		c.checkExportsTarget(values[key], pointer)
+	}
+}
+
+// checkExportsTarget checks what a subpath or condition maps to: a path in
+// the package, null to hide it, an array of fallbacks, or conditions
+func (c *manifestChecker) checkExportsTarget(raw json.RawMessage, pointer string) {
+	if keys, values, ok := objectEntries(raw); ok {
+		for i, key := range keys {
+			conditionPointer := pointer + jsonPointer(key)
+			if strings.HasPrefix(key, ".") {
+				c.report(manifestError, conditionPointer, "subpaths only go at the top of exports, conditions can't start with .")
+			}
+			if key == "default" && i != len(keys)-1 {
+				c.report(manifestWarning, conditionPointer, "default matches everything, so the conditions after it are never used")
+			}
+			c.checkExportsTarget(values[key], conditionPointer)
+		}
+		return
+	}
+	var fallbacks []json.RawMessage
+	if err := json.Unmarshal(raw, &fallbacks); err == nil {
+		for i, fallback := range fallbacks {
+			c.checkExportsTarget(fallback, fmt.Sprintf("%s/%d", pointer, i))
+		}
+		return
+	}
+	if string(bytes.TrimSpace(raw)) == "null" {
+		return
+	}
+	var target string
+	if err := json.Unmarshal(raw, &target); err != nil {
+		c.report(manifestError, pointer, "must be a path, null, an array, or an object of conditions")
+		return
+	}
+	if !strings.HasPrefix(target, "./") {
+		c.report(manifestError, pointer, "%q must be relative to the package, starting with ./", target)
+		return
+	}
+	for _, segment := range strings.Split(target[2:], "/") {
+		if segment == "." || segment == ".." || segment == "node_modules" {
+			c.report(manifestError, pointer, "%q can't have . , .. or node_modules segments", target)
+			return
+		}
+	}
+}
+
+// checkEngines checks engines maps runtimes to version ranges
+func (c *manifestChecker) checkEngines(raw json.RawMessage) {
+	var engines map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &engines); err != nil {
+		c.report(manifestError, "/engines", "must be an object of runtimes to version ranges, like {\"node\": \">=18\"}")
+		return
+	}
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pointer := jsonPointer("engines", name)
+		var versionRange string
+		if err := json.Unmarshal(engines[name], &versionRange); err != nil {
+			c.report(manifestError, pointer, "must be a version range string")
+			continue
+		}
+		if !validRange(versionRange) {
+			c.report(manifestError, pointer, "%q isn't a version range", versionRange)
+		}
+	}
+}
+
+// CheckManifest validates the package.json in directory
+func CheckManifest(directory string) ([]ManifestIssue, error) {
+	data, err := os.ReadFile(filepath.Join(directory, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	return validateManifest(directory, data)
+}
+
+// manifestErrors counts the issues that are errors
+func manifestErrors(issues []ManifestIssue) int {
+	count := 0
+	for _, issue := range issues {
+		if issue.Severity == manifestError {
+			count++
+		}
+	}
+	return count
+}
+
+// RenderManifestIssues lists the issues, one per line
+func RenderManifestIssues(issues []ManifestIssue) string {
+	if len(issues) == 0 {
+		return colorSuccess("package.json is valid") + "\n"
+	}
+	var builder strings.Builder
+	for _, issue := range issues {
+		severity := colorWarn(issue.Severity)
+		if issue.Severity == manifestError {
+			severity = colorError(issue.Severity)
+		}
+		builder.WriteString(fmt.Sprintf("%s %s %s\n", severity, colorPackage(issue.Pointer), issue.Message))
+	}
+	return builder.String()
+}
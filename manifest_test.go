@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "bin", "tool.js"), "#!/usr/bin/env node\n")
+	manifest := `{
+  "name": "Tool",
+  "version": "1.02.0",
+  "bin": {"tool": "bin/tool.js", "gone": "bin/gone.js", "escape": "../outside.js"},
+  "exports": {
+    ".": {"default": "./index.js", "import": "./index.mjs"},
+    "./utils/*": "./src/*/*.js",
+    "./lib": "lib/index.js",
+    "./up": "./../x.js",
+    "./hidden": null,
+    "./both": ["./a.js", {"node": "./b.js"}]
+  },
+  "engines": {"node": ">= 18 <21 || ^22.1.0", "npm": "1.2 - 2", "bun": "latest"}
+}`
+	issues, err := validateManifest(dir, []byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ManifestIssue{
+		{manifestError, "/name", `package name "Tool" can't have capital letters`},
+		{manifestError, "/version", `"1.02.0" isn't a semver version like 1.2.3 or 1.2.3-beta.1`},
+		{manifestError, "/bin/escape", `"../outside.js" isn't a path in the package`},
+		{manifestError, "/bin/gone", "bin/gone.js doesn't exist"},
+		{manifestWarning, "/exports/./default", "default matches everything, so the conditions after it are never used"},
+		{manifestError, "/exports/.~1lib", `"lib/index.js" must be relative to the package, starting with ./`},
+		{manifestError, "/exports/.~1up", `"./../x.js" can't have . , .. or node_modules segments`},
+		{manifestError, "/engines/bun", `"latest" isn't a version range`},
+	}
+	if !reflect.DeepEqual(issues, want) {
+		t.Errorf("validateManifest() =\n%+v\nwant\n%+v", issues, want)
+	}
+
+	issues, err = validateManifest(dir, []byte(`{"private": true, "exports": {".": "./a.js", "import": "./b.mjs"}, "engines": [">=18"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []ManifestIssue{
+		{manifestError, "/exports", "can't mix subpaths, which start with ., and conditions"},
+		{manifestError, "/engines", `must be an object of runtimes to version ranges, like {"node": ">=18"}`},
+	}
+	if !reflect.DeepEqual(issues, want) {
+		t.Errorf("validateManifest() =\n%+v\nwant\n%+v", issues, want)
+	}
+}
+
+func TestValidRange(t *testing.T) {
+	for versionRange, want := range map[string]bool{
+		"":                 true,
+		"*":                true,
+		"^1.2.3":           true,
+		">=1.0.0 <2.0.0-0": true,
+		"~> 1.2":           true,
+		"1.x || >=2.5.0":   true,
+		"1.2.3 - 2.3":      true,
+		"v1.2.3+build.5":   true,
+		"latest":           false,
+		">=1.0.0 and <2":   false,
+		"1.2.3.4":          false,
+		"^1.2.3 || banana": false,
+	} {
+		if got := validRange(versionRange); got != want {
+			t.Errorf("validRange(%q) = %v, want %v", versionRange, got, want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// metricsSchemaVersion is bumped whenever a field in the metrics file is
+// renamed, removed, or changes meaning. Adding fields doesn't bump it
+const metricsSchemaVersion = 1
+
+// CacheStats counts how the resolver's metadata and decision lookups were
+// served. All methods are safe to call on a nil CacheStats
+type CacheStats struct {
+	metadataHits        int64
+	metadataRevalidated int64
+	metadataMisses      int64
+	decisionHits        int64
+	decisionMisses      int64
+}
+
+// Results of looking up a packument in the on-disk cache
+const (
+	metadataHit         = "hit"
+	metadataRevalidated = "revalidated"
+	metadataMiss        = "miss"
+)
+
+// recordMetadata counts a packument lookup
+func (c *CacheStats) recordMetadata(result string) {
+	if c == nil {
+		return
+	}
+	switch result {
+	case metadataHit:
+		atomic.AddInt64(&c.metadataHits, 1)
+	case metadataRevalidated:
+		atomic.AddInt64(&c.metadataRevalidated, 1)
+	default:
+		atomic.AddInt64(&c.metadataMisses, 1)
+	}
+}
+
+// recordDecision counts a lookup of a cached resolution decision
+func (c *CacheStats) recordDecision(hit bool) {
+	if c == nil {
+		return
+	}
+	if hit {
+		atomic.AddInt64(&c.decisionHits, 1)
+	} else {
+		atomic.AddInt64(&c.decisionMisses, 1)
+	}
+}
+
+// Metrics is the document written by --metrics-file. Its schema is meant
+// to be ingested by CI dashboards, so see metricsSchemaVersion before
+// changing it. Durations are in milliseconds
+type Metrics struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	StartedAt     time.Time        `json:"startedAt"`
+	DurationMs    float64          `json:"durationMs"`
+	Phases        PhaseMetrics     `json:"phases"`
+	Cache         CacheMetrics     `json:"cache"`
+	Totals        TotalMetrics     `json:"totals"`
+	Packages      []PackageMetrics `json:"packages"`
+}
+
+// PhaseMetrics is the time spent in each install phase. Download and
+// extraction are summed across packages since they run concurrently
+type PhaseMetrics struct {
+	ResolutionMs float64 `json:"resolutionMs"`
+	LinkingMs    float64 `json:"linkingMs"`
+	DownloadMs   float64 `json:"downloadMs"`
+	ExtractionMs float64 `json:"extractionMs"`
+	BinSetupMs   float64 `json:"binSetupMs"`
+	ScriptsMs    float64 `json:"scriptsMs"`
+	AuditMs      float64 `json:"auditMs"`
+}
+
+// CacheMetrics reports how well the resolution cache served the run. Hit
+// rates are between 0 and 1, and 0 when there were no lookups
+type CacheMetrics struct {
+	MetadataHits        int64   `json:"metadataHits"`
+	MetadataRevalidated int64   `json:"metadataRevalidated"`
+	MetadataMisses      int64   `json:"metadataMisses"`
+	MetadataHitRate     float64 `json:"metadataHitRate"`
+	DecisionHits        int64   `json:"decisionHits"`
+	DecisionMisses      int64   `json:"decisionMisses"`
+	DecisionHitRate     float64 `json:"decisionHitRate"`
+}
+
+type TotalMetrics struct {
+	Installed       int   `json:"installed"`
+	Skipped         int   `json:"skipped"`
+	Failed          int   `json:"failed"`
+	DownloadedBytes int64 `json:"downloadedBytes"`
+	UnpackedBytes   int64 `json:"unpackedBytes"`
+	Retries         int   `json:"retries"`
+}
+
+type PackageMetrics struct {
+	Path            string  `json:"path"`
+	Version         string  `json:"version"`
+	DownloadedBytes int64   `json:"downloadedBytes"`
+	UnpackedBytes   int64   `json:"unpackedBytes"`
+	Retries         int     `json:"retries"`
+	DurationMs      float64 `json:"durationMs"`
+	DownloadMs      float64 `json:"downloadMs"`
+	ExtractionMs    float64 `json:"extractionMs"`
+}
+
+// milliseconds converts a duration for the metrics file
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// hitRate returns hits as a fraction of lookups
+func hitRate(hits, lookups int64) float64 {
+	if lookups == 0 {
+		return 0
+	}
+	return float64(hits) / float64(lookups)
+}
+
+// collectMetrics builds the metrics document for a finished install
+func collectMetrics(summary *InstallSummary, timings *Timings, cacheStats *CacheStats) Metrics {
+	metrics := Metrics{
+		SchemaVersion: metricsSchemaVersion,
+		Totals: TotalMetrics{
+			Installed:       summary.Installed,
+			Skipped:         summary.Skipped,
+			Failed:          len(summary.Failed),
+			DownloadedBytes: summary.DownloadedBytes,
+			UnpackedBytes:   summary.UnpackedBytes,
+			Retries:         summary.Retries,
+		},
+		Packages: []PackageMetrics{},
+	}
+
+	if timings != nil {
+		timings.mu.Lock()
+		metrics.StartedAt = timings.start
+		metrics.DurationMs = milliseconds(time.Since(timings.start))
+		metrics.Phases = PhaseMetrics{
+			ResolutionMs: milliseconds(timings.phases[phaseResolution]),
+			LinkingMs:    milliseconds(timings.phases[phaseLinking]),
+			DownloadMs:   milliseconds(timings.phases[phaseDownload]),
+			ExtractionMs: milliseconds(timings.phases[phaseExtraction]),
+			BinSetupMs:   milliseconds(timings.phases[phaseBinSetup]),
+			ScriptsMs:    milliseconds(timings.phases[phaseScripts]),
+			AuditMs:      milliseconds(timings.phases[phaseAudit]),
+		}
+		timings.mu.Unlock()
+	}
+
+	if cacheStats != nil {
+		c := &metrics.Cache
+		c.MetadataHits = atomic.LoadInt64(&cacheStats.metadataHits)
+		c.MetadataRevalidated = atomic.LoadInt64(&cacheStats.metadataRevalidated)
+		c.MetadataMisses = atomic.LoadInt64(&cacheStats.metadataMisses)
+		c.MetadataHitRate = hitRate(c.MetadataHits+c.MetadataRevalidated, c.MetadataHits+c.MetadataRevalidated+c.MetadataMisses)
+		c.DecisionHits = atomic.LoadInt64(&cacheStats.decisionHits)
+		c.DecisionMisses = atomic.LoadInt64(&cacheStats.decisionMisses)
+		c.DecisionHitRate = hitRate(c.DecisionHits, c.DecisionHits+c.DecisionMisses)
+	}
+
+	for _, pkg := range summary.Packages {
+		metrics.Packages = append(metrics.Packages, PackageMetrics{
+			Path:            pkg.Path,
+			Version:         pkg.Version,
+			DownloadedBytes: pkg.DownloadedBytes,
+			UnpackedBytes:   pkg.UnpackedBytes,
+			Retries:         pkg.Retries,
+			DurationMs:      milliseconds(pkg.Duration),
+			DownloadMs:      milliseconds(pkg.downloadTime),
+			ExtractionMs:    milliseconds(pkg.extractTime),
+		})
+	}
+	sort.Slice(metrics.Packages, func(i, j int) bool {
+		return metrics.Packages[i].Path < metrics.Packages[j].Path
+	})
+
+	return metrics
+}
+
+// writeMetricsFile writes the metrics document for a finished install
+func writeMetricsFile(path string, metrics Metrics) error {
+	data, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCollectMetrics(t *testing.T) {
+	summary := &InstallSummary{Packages: []PackageStats{}}
+	summary.add(PackageStats{Path: "node_modules/b", Version: "1.0.0", DownloadedBytes: 10, UnpackedBytes: 30, Retries: 2,
+		Duration: 3 * time.Millisecond, downloadTime: 2 * time.Millisecond, extractTime: time.Millisecond})
+	summary.add(PackageStats{Path: "node_modules/a", Version: "2.0.0", DownloadedBytes: 5, UnpackedBytes: 20})
+	summary.Skipped = 1
+
+	timings := NewTimings()
+	timings.add(phaseResolution, 1500*time.Microsecond)
+	timings.add(phaseDownload, 2*time.Millisecond)
+
+	cacheStats := &CacheStats{}
+	cacheStats.recordMetadata(metadataHit)
+	cacheStats.recordMetadata(metadataRevalidated)
+	cacheStats.recordMetadata(metadataMiss)
+	cacheStats.recordMetadata(metadataMiss)
+	cacheStats.recordDecision(true)
+
+	metrics := collectMetrics(summary, timings, cacheStats)
+
+	if metrics.SchemaVersion != metricsSchemaVersion {
+		t.Errorf("SchemaVersion = %d, want %d", metrics.SchemaVersion, metricsSchemaVersion)
+	}
+	if want := (PhaseMetrics{ResolutionMs: 1.5, DownloadMs: 2}); metrics.Phases != want {
+		t.Errorf("Phases = %+v, want %+v", metrics.Phases, want)
+	}
+	wantCache := CacheMetrics{
+		MetadataHits:        1,
+		MetadataRevalidated: 1,
+		MetadataMisses:      2,
+		MetadataHitRate:     0.5,
+		DecisionHits:        1,
+		DecisionHitRate:     1,
+	}
+	if metrics.Cache != wantCache {
+		t.Errorf("Cache = %+v, want %+v", metrics.Cache, wantCache)
+	}
+	wantTotals := TotalMetrics{Installed: 2, Skipped: 1, DownloadedBytes: 15, UnpackedBytes: 50, Retries: 2}
+	if metrics.Totals != wantTotals {
+		t.Errorf("Totals = %+v, want %+v", metrics.Totals, wantTotals)
+	}
+	if len(metrics.Packages) != 2 || metrics.Packages[0].Path != "node_modules/a" {
+		t.Fatalf("Packages = %+v, want sorted by path", metrics.Packages)
+	}
+	wantPackage := PackageMetrics{Path: "node_modules/b", Version: "1.0.0", DownloadedBytes: 10, UnpackedBytes: 30,
+		Retries: 2, DurationMs: 3, DownloadMs: 2, ExtractionMs: 1}
+	if metrics.Packages[1] != wantPackage {
+		t.Errorf("Packages[1] = %+v, want %+v", metrics.Packages[1], wantPackage)
+	}
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	metrics := collectMetrics(&InstallSummary{Packages: []PackageStats{}}, nil, nil)
+	if err := writeMetricsFile(path, metrics); err != nil {
+		t.Fatalf("writeMetricsFile() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("metrics file isn't JSON: %v", err)
+	}
+	for _, key := range []string{"schemaVersion", "startedAt", "durationMs", "phases", "cache", "totals", "packages"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("metrics file is missing %q", key)
+		}
+	}
+}
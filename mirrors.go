@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mirrorProbeInterval is how often mirrors are re-probed during an install
+	mirrorProbeInterval = 30 * time.Second
+	// mirrorProbeTimeout bounds a single probe
+	mirrorProbeTimeout = 5 * time.Second
+	// mirrorFailureThreshold is how many failures in a row open a mirror's
+	// circuit, taking it out of rotation
+	mirrorFailureThreshold = 3
+	// mirrorCooldown is how long an open circuit stays open before a request
+	// is let through to see whether the mirror has recovered
+	mirrorCooldown = 30 * time.Second
+	// mirrorLatencyWeight is how much a new latency sample moves a mirror's
+	// moving average
+	mirrorLatencyWeight = 0.3
+)
+
+// mirror is a registry mirror and what's been seen of it
+type mirror struct {
+	url *url.URL
+
+	latency   time.Duration // Moving average of probe and response times
+	probed    bool
+	healthy   bool      // Whether the last probe succeeded
+	failures  int       // Consecutive failed requests
+	openUntil time.Time // The circuit is open, skipping the mirror, until then
+}
+
+// mirrorRouter is a RoundTripper that sends requests for the registry to
+// the lowest-latency healthy mirror instead, failing over to the next one
+// when a mirror errors. Mirrors are probed before the first request and
+// again every mirrorProbeInterval, and a mirror that fails
+// mirrorFailureThreshold requests in a row is skipped for mirrorCooldown
+type mirrorRouter struct {
+	registry  *url.URL
+	mirrors   []*mirror
+	transport http.RoundTripper
+	now       func() time.Time
+
+	lock      sync.Mutex
+	firstOnce sync.Once
+	lastProbe time.Time
+	probing   atomic.Bool
+}
+
+// newMirrorRouter routes requests for registry to mirrors
+func newMirrorRouter(registry string, mirrors []string) (*mirrorRouter, error) {
+	registryURL, err := url.Parse(strings.TrimSuffix(registry, "/"))
+	if err != nil {
+		return nil, err
+	}
+	router := &mirrorRouter{registry: registryURL, transport: http.DefaultTransport, now: time.Now}
+	for _, raw := range mirrors {
+		mirrorURL, err := url.Parse(strings.TrimSuffix(raw, "/"))
+		if err != nil || (mirrorURL.Scheme != "http" && mirrorURL.Scheme != "https") || mirrorURL.Host == "" {
+			return nil, fmt.Errorf("invalid registry mirror %q", raw)
+		}
+		router.mirrors = append(router.mirrors, &mirror{url: mirrorURL})
+	}
+	return router, nil
+}
+
+// routes reports whether a request is for the registry the mirrors stand in
+// for
+func (m *mirrorRouter) routes(u *url.URL) bool {
+	return u.Scheme == m.registry.Scheme && u.Host == m.registry.Host && strings.HasPrefix(u.Path, m.registry.Path)
+}
+
+// ranked returns the mirrors to try in order: healthy ones with a closed
+// circuit by latency, then the rest, whose circuits are tried again as a
+// last resort
+func (m *mirrorRouter) ranked() []*mirror {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.now()
+	ranked := make([]*mirror, len(m.mirrors))
+	copy(ranked, m.mirrors)
+	rank := func(mi *mirror) int {
+		switch {
+		case now.Before(mi.openUntil):
+			return 2
+		case mi.probed && !mi.healthy:
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ri, rj := rank(ranked[i]), rank(ranked[j])
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == 2 {
+			// The circuit that closes soonest is the best bet
+			return ranked[i].openUntil.Before(ranked[j].openUntil)
+		}
+		return ranked[i].latency < ranked[j].latency
+	})
+	return ranked
+}
+
+// record notes the outcome of a request or probe to a mirror
+func (m *mirrorRouter) record(mi *mirror, latency time.Duration, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ok {
+		if mi.latency == 0 {
+			mi.latency = latency
+		} else {
+			mi.latency = time.Duration(mirrorLatencyWeight*float64(latency) + (1-mirrorLatencyWeight)*float64(mi.latency))
+		}
+		mi.failures = 0
+		mi.openUntil = time.Time{}
+		return
+	}
+	mi.failures++
+	if mi.failures >= mirrorFailureThreshold {
+		if !m.now().Before(mi.openUntil) {
+			printWarning("Registry mirror %s is failing, routing around it for %s", mi.url, mirrorCooldown)
+		}
+		mi.openUntil = m.now().Add(mirrorCooldown)
+	}
+}
+
+// mirrored returns a copy of a registry request pointed at a mirror
+func (m *mirrorRouter) mirrored(req *http.Request, mi *mirror) *http.Request {
+	out := req.Clone(req.Context())
+	u := *mi.url
+	u.Path = mi.url.Path + strings.TrimPrefix(req.URL.Path, m.registry.Path)
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	out.URL = &u
+	out.Host = ""
+	return out
+}
+
+// RoundTrip sends registry requests to the best mirror, trying the next on
+// network errors and 5xx responses. Requests with a body aren't retried
+func (m *mirrorRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(m.mirrors) == 0 || !m.routes(req.URL) {
+		return m.transport.RoundTrip(req)
+	}
+	m.firstOnce.Do(func() { m.probe(req.Context()) })
+	m.maybeProbe()
+
+	var lastResp *http.Response
+	var lastErr error
+	for _, mi := range m.ranked() {
+		if lastResp != nil {
+			lastResp.Body.Close()
+			lastResp = nil
+		}
+		start := m.now()
+		resp, err := m.transport.RoundTrip(m.mirrored(req, mi))
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			m.record(mi, m.now().Sub(start), true)
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			// Cancelled, not the mirror's fault
+			return resp, err
+		}
+		m.record(mi, 0, false)
+		lastResp, lastErr = resp, err
+		if req.Body != nil && req.Body != http.NoBody {
+			break
+		}
+	}
+	return lastResp, lastErr
+}
+
+// maybeProbe re-probes the mirrors in the background when it's been
+// mirrorProbeInterval since the last probe
+func (m *mirrorRouter) maybeProbe() {
+	m.lock.Lock()
+	due := m.now().Sub(m.lastProbe) >= mirrorProbeInterval
+	m.lock.Unlock()
+	if due && m.probing.CompareAndSwap(false, true) {
+		go func() {
+			defer m.probing.Store(false)
+			m.probe(context.Background())
+		}()
+	}
+}
+
+// probe pings every mirror at once, recording its latency and health
+func (m *mirrorRouter) probe(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, mirrorProbeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, mi := range m.mirrors {
+		wg.Add(1)
+		go func(mi *mirror) {
+			defer wg.Done()
+			healthy := false
+			start := m.now()
+			req, err := http.NewRequestWithContext(ctx, "GET", mi.url.String()+"/-/ping", nil)
+			if err == nil {
+				if resp, err := m.transport.RoundTrip(req); err == nil {
+					resp.Body.Close()
+					healthy = resp.StatusCode < http.StatusInternalServerError
+				}
+			}
+			elapsed := m.now().Sub(start)
+			m.lock.Lock()
+			mi.probed, mi.healthy = true, healthy
+			m.lock.Unlock()
+			if healthy {
+				m.record(mi, elapsed, true)
+			}
+		}(mi)
+	}
+	wg.Wait()
+	m.lock.Lock()
+	m.lastProbe = m.now()
+	m.lock.Unlock()
+}
+
+// registryClient returns the client for registry requests, on the shared
+// transport and routed through the configured mirrors when there are any
+func (opts InstallOptions) registryClient() *RegistryClient {
+	client := &http.Client{Timeout: 30 * time.Second, Transport: opts.transport}
+	if opts.mirrors != nil {
+		client.Transport = opts.mirrors
+	}
+	return newRegistryClient(client, npmRegistryURL, "")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorRouter(t *testing.T) {
+	var fastFailing atomic.Bool
+	var fastHits, slowHits atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/-/ping" {
+			return
+		}
+		fastHits.Add(1)
+		if fastFailing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("fast " + r.URL.RequestURI()))
+	}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/npm/-/ping" {
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		slowHits.Add(1)
+		w.Write([]byte("slow " + r.URL.RequestURI()))
+	}))
+	defer slow.Close()
+
+	router, err := newMirrorRouter(npmRegistryURL, []string{slow.URL + "/npm/", fast.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: router}
+	get := func(url string) string {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := get(npmRegistryURL + "/is-odd?write=true"); body != "fast /is-odd?write=true" {
+		t.Errorf("first request went to %q, want the fastest mirror", body)
+	}
+
+	// The fast mirror starts failing: requests fail over, then its circuit
+	// opens and it's skipped
+	fastFailing.Store(true)
+	for i := 0; i < mirrorFailureThreshold; i++ {
+		if body := get(npmRegistryURL + "/is-even/-/is-even-1.0.0.tgz"); body != "slow /npm/is-even/-/is-even-1.0.0.tgz" {
+			t.Errorf("request %d went to %q, want the slow mirror", i, body)
+		}
+	}
+	hits := fastHits.Load()
+	get(npmRegistryURL + "/is-even")
+	if fastHits.Load() != hits {
+		t.Errorf("a mirror with an open circuit was still tried")
+	}
+
+	// Once the cooldown is over it gets another chance
+	fastFailing.Store(false)
+	router.now = func() time.Time { return time.Now().Add(mirrorCooldown) }
+	if body := get(npmRegistryURL + "/is-even"); body != "fast /is-even" {
+		t.Errorf("after the cooldown the request went to %q", body)
+	}
+
+	// Requests for anything else aren't touched
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	}))
+	defer other.Close()
+	if body := get(other.URL); body != "other" {
+		t.Errorf("a non-registry request was rerouted to %q", body)
+	}
+	if slowHits.Load() == 0 {
+		t.Errorf("the slow mirror was never used")
+	}
+}
+
+func TestNewMirrorRouterInvalid(t *testing.T) {
+	if _, err := newMirrorRouter(npmRegistryURL, []string{"registry.example.com"}); err == nil {
+		t.Errorf("newMirrorRouter() accepted a mirror without a scheme")
+	}
+}
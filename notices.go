@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeprecationNotice is a registry deprecation message for an installed version
+type DeprecationNotice struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Message string `json:"message"`
+}
+
+// BrokenBin is a bin a package declares whose target is missing, a
+// directory, or outside the package, so it isn't linked into .bin
+type BrokenBin struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Bin     string `json:"bin"`
+	Target  string `json:"target"`
+	Reason  string `json:"reason"`
+}
+
+// FundingNotice lists the installed packages that ask for funding at a URL
+type FundingNotice struct {
+	URL      string   `json:"url"`
+	Packages []string `json:"packages"`
+}
+
+// fundingURLs reads the URLs out of a funding field, which may be a URL, an
+// object with a url, or a list of either
+func fundingURLs(funding interface{}) []string {
+	switch v := funding.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case map[string]interface{}:
+		if url, ok := v["url"].(string); ok && url != "" {
+			return []string{url}
+		}
+	case []interface{}:
+		urls := []string{}
+		for _, entry := range v {
+			urls = append(urls, fundingURLs(entry)...)
+		}
+		return urls
+	}
+	return nil
+}
+
+// collectNotices gathers deprecation and funding notices for the packages
+// the install put in node_modules
+func collectNotices(summary *InstallSummary, packages map[string]PackageInfo, opts InstallOptions) {
+	funded := make(map[string][]string)
+	for _, stats := range summary.Packages {
+		pkg := packages[stats.Path]
+		name := strings.TrimPrefix(stats.Path, "node_modules/")
+		if pkg.Deprecated != "" && !opts.NoDeprecationWarnings {
+			summary.Deprecated = append(summary.Deprecated, DeprecationNotice{Path: stats.Path, Version: stats.Version, Message: pkg.Deprecated})
+		}
+		if !opts.NoFund {
+			for _, url := range fundingURLs(pkg.Funding) {
+				funded[url] = append(funded[url], name)
+			}
+		}
+	}
+
+	sort.Slice(summary.Deprecated, func(i, j int) bool {
+		return summary.Deprecated[i].Path < summary.Deprecated[j].Path
+	})
+	for url, names := range funded {
+		sort.Strings(names)
+		summary.Funding = append(summary.Funding, FundingNotice{URL: url, Packages: names})
+	}
+	sort.Slice(summary.Funding, func(i, j int) bool {
+		return summary.Funding[i].URL < summary.Funding[j].URL
+	})
+}
+
+// RenderNotices formats deprecation, broken bin, and funding notices as one
+// block
+func RenderNotices(summary *InstallSummary) string {
+	if len(summary.Deprecated) == 0 && len(summary.BrokenBins) == 0 && len(summary.Funding) == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	if len(summary.Deprecated) > 0 {
+		builder.WriteString("\n" + colorWarn(fmt.Sprintf("%d deprecated packages", len(summary.Deprecated))) + " (hide with --no-deprecation-warnings):\n")
+		for _, notice := range summary.Deprecated {
+			builder.WriteString(fmt.Sprintf("  %s: %s\n", colorPackage(strings.TrimPrefix(notice.Path, "node_modules/")+"@"+notice.Version), notice.Message))
+		}
+	}
+	if len(summary.BrokenBins) > 0 {
+		builder.WriteString("\n" + colorWarn(fmt.Sprintf("%d bins weren't linked", len(summary.BrokenBins))) + ":\n")
+		for _, bin := range summary.BrokenBins {
+			builder.WriteString(fmt.Sprintf("  %s %s: %s\n", colorPackage(strings.TrimPrefix(bin.Path, "node_modules/")+"@"+bin.Version), bin.Bin, bin.Reason))
+		}
+	}
+	if len(summary.Funding) > 0 {
+		funded := make(map[string]bool)
+		for _, notice := range summary.Funding {
+			for _, name := range notice.Packages {
+				funded[name] = true
+			}
+		}
+		builder.WriteString(fmt.Sprintf("\n%d packages are looking for funding (hide with --no-fund):\n", len(funded)))
+		for _, notice := range summary.Funding {
+			names := make([]string, len(notice.Packages))
+			for i, name := range notice.Packages {
+				names[i] = colorPackage(name)
+			}
+			builder.WriteString(fmt.Sprintf("  %s\n    %s\n", colorBold(notice.URL), strings.Join(names, ", ")))
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCollectNotices(t *testing.T) {
+	var packages map[string]PackageInfo
+	lockfileEntries := `{
+		"node_modules/request": {"version": "2.88.2", "deprecated": "request has been deprecated"},
+		"node_modules/a": {"version": "1.0.0", "funding": "https://github.com/sponsors/a"},
+		"node_modules/b": {"version": "1.0.0", "funding": {"type": "opencollective", "url": "https://opencollective.com/shared"}},
+		"node_modules/c": {"version": "1.0.0", "funding": [{"url": "https://opencollective.com/shared"}, "https://github.com/sponsors/c"]},
+		"node_modules/skipped": {"version": "1.0.0", "deprecated": "not installed"}
+	}`
+	if err := json.Unmarshal([]byte(lockfileEntries), &packages); err != nil {
+		t.Fatal(err)
+	}
+
+	newSummary := func() *InstallSummary {
+		summary := &InstallSummary{}
+		for _, path := range []string{"node_modules/request", "node_modules/a", "node_modules/b", "node_modules/c"} {
+			summary.add(PackageStats{Path: path, Version: packages[path].Version})
+		}
+		return summary
+	}
+
+	summary := newSummary()
+	collectNotices(summary, packages, InstallOptions{})
+	wantDeprecated := []DeprecationNotice{{Path: "node_modules/request", Version: "2.88.2", Message: "request has been deprecated"}}
+	if !reflect.DeepEqual(summary.Deprecated, wantDeprecated) {
+		t.Errorf("Deprecated = %+v, want %+v", summary.Deprecated, wantDeprecated)
+	}
+	wantFunding := []FundingNotice{
+		{URL: "https://github.com/sponsors/a", Packages: []string{"a"}},
+		{URL: "https://github.com/sponsors/c", Packages: []string{"c"}},
+		{URL: "https://opencollective.com/shared", Packages: []string{"b", "c"}},
+	}
+	if !reflect.DeepEqual(summary.Funding, wantFunding) {
+		t.Errorf("Funding = %+v, want %+v", summary.Funding, wantFunding)
+	}
+	rendered := RenderNotices(summary)
+	if !strings.Contains(rendered, "1 deprecated packages") || !strings.Contains(rendered, "3 packages are looking for funding") {
+		t.Errorf("RenderNotices() = %q", rendered)
+	}
+
+	summary = newSummary()
+	collectNotices(summary, packages, InstallOptions{NoFund: true, NoDeprecationWarnings: true})
+	if RenderNotices(summary) != "" {
+		t.Errorf("notices rendered with --no-fund and --no-deprecation-warnings")
+	}
+}
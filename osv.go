@@ -0,0 +1,404 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultOSVURL is OSV's bundle of every npm advisory, GHSA ones included.
+// CALADAN_OSV_URL points caladan audit db update at a mirror
+const defaultOSVURL = "https://osv-vulnerabilities.storage.googleapis.com/npm/all.zip"
+
+// osvEntry is the part of an OSV advisory caladan needs. GHSA advisories
+// are published in the same format
+type osvEntry struct {
+	ID        string   `json:"id"`
+	Aliases   []string `json:"aliases"`
+	Summary   string   `json:"summary"`
+	Withdrawn string   `json:"withdrawn"`
+	Affected  []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string              `json:"type"`
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+		Versions []string `json:"versions"`
+	} `json:"affected"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+}
+
+// severity maps the GHSA severity onto npm's names. Unrated advisories
+// count as moderate so they aren't hidden below a threshold
+func (e osvEntry) severity() string {
+	severity := strings.ToLower(e.DatabaseSpecific.Severity)
+	if severityRank(severity) < 0 {
+		return "moderate"
+	}
+	return severity
+}
+
+// osvAffects reports whether an OSV SEMVER range's events include version.
+// Events are introduced/fixed/last_affected pairs in order
+func osvAffects(events []map[string]string, version string) bool {
+	affected := false
+	for _, event := range events {
+		if introduced, ok := event["introduced"]; ok {
+			if introduced == "0" {
+				affected = true
+			} else if cmp, ok := compareSemver(version, introduced); ok && cmp >= 0 {
+				affected = true
+			}
+		}
+		if fixed, ok := event["fixed"]; ok && affected {
+			if cmp, ok := compareSemver(version, fixed); ok && cmp >= 0 {
+				affected = false
+			}
+		}
+		if last, ok := event["last_affected"]; ok && affected {
+			if cmp, ok := compareSemver(version, last); ok && cmp > 0 {
+				affected = false
+			}
+		}
+	}
+	return affected
+}
+
+// osvRangeString renders a range's events like npm's vulnerable_versions
+func osvRangeString(events []map[string]string) string {
+	ranges := []string{}
+	current := ""
+	for _, event := range events {
+		if introduced, ok := event["introduced"]; ok {
+			current = ""
+			if introduced != "0" {
+				current = ">=" + introduced
+			}
+		}
+		bound := ""
+		if fixed, ok := event["fixed"]; ok {
+			bound = "<" + fixed
+		} else if last, ok := event["last_affected"]; ok {
+			bound = "<=" + last
+		}
+		if bound != "" {
+			ranges = append(ranges, strings.TrimSpace(current+" "+bound))
+			current = ""
+		}
+	}
+	if current != "" || len(ranges) == 0 {
+		ranges = append(ranges, strings.TrimSpace(current+" *"))
+	}
+	return strings.Join(ranges, " || ")
+}
+
+// advisories returns an entry's advisories for the given package versions
+func (e osvEntry) advisories(versions map[string][]string) []Advisory {
+	if e.Withdrawn != "" {
+		return nil
+	}
+	found := []Advisory{}
+	for _, affected := range e.Affected {
+		if affected.Package.Ecosystem != "npm" {
+			continue
+		}
+		installed, ok := versions[affected.Package.Name]
+		if !ok {
+			continue
+		}
+
+		for _, version := range installed {
+			matched := false
+			vulnerable := []string{}
+			for _, listed := range affected.Versions {
+				if listed == version {
+					matched = true
+				}
+			}
+			for _, r := range affected.Ranges {
+				if r.Type != "SEMVER" {
+					continue
+				}
+				vulnerable = append(vulnerable, osvRangeString(r.Events))
+				if osvAffects(r.Events, version) {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+			found = append(found, Advisory{
+				ID:                 e.ID,
+				Aliases:            e.Aliases,
+				Name:               affected.Package.Name,
+				Version:            version,
+				Title:              e.Summary,
+				Severity:           e.severity(),
+				URL:                "https://osv.dev/vulnerability/" + e.ID,
+				VulnerableVersions: strings.Join(vulnerable, " || "),
+			})
+		}
+	}
+	return found
+}
+
+// defaultOSVAPI is OSV's API
+const defaultOSVAPI = "https://api.osv.dev/v1"
+
+// osvQueryBatch is how many versions go in one querybatch request, OSV's limit
+const osvQueryBatch = 1000
+
+// osvAdvisories queries OSV's API, or reads a database snapshot when it has
+// a path: a directory of advisory JSON files or a zip of them
+type osvAdvisories struct {
+	api  string
+	path string
+}
+
+func (o *osvAdvisories) Name() string { return sourceOSV }
+
+func (o *osvAdvisories) Lookup(ctx context.Context, versions map[string][]string) ([]Advisory, error) {
+	if o.path != "" {
+		return o.lookupSnapshot(ctx, versions)
+	}
+	api := o.api
+	if api == "" {
+		api = defaultOSVAPI
+	}
+	api = strings.TrimSuffix(api, "/")
+
+	type query struct {
+		Package struct {
+			Name      string `json:"name"`
+			Ecosystem string `json:"ecosystem"`
+		} `json:"package"`
+		Version string `json:"version"`
+	}
+	queries := []query{}
+	for name, list := range versions {
+		for _, version := range list {
+			q := query{Version: version}
+			q.Package.Name = name
+			q.Package.Ecosystem = "npm"
+			queries = append(queries, q)
+		}
+	}
+
+	// querybatch only returns IDs, so the advisories are fetched afterwards
+	client := &http.Client{Timeout: 30 * time.Second}
+	ids := []string{}
+	seen := make(map[string]bool)
+	for start := 0; start < len(queries); start += osvQueryBatch {
+		body, err := json.Marshal(map[string]interface{}{"queries": queries[start:min(start+osvQueryBatch, len(queries))]})
+		if err != nil {
+			return nil, err
+		}
+		data, err := postURL(ctx, client, api+"/querybatch", body)
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			Results []struct {
+				Vulns []struct {
+					ID string `json:"id"`
+				} `json:"vulns"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return nil, fmt.Errorf("error parsing OSV response: %v", err)
+		}
+		for _, result := range response.Results {
+			for _, vuln := range result.Vulns {
+				if !seen[vuln.ID] {
+					seen[vuln.ID] = true
+					ids = append(ids, vuln.ID)
+				}
+			}
+		}
+	}
+
+	found := []Advisory{}
+	for _, id := range ids {
+		data, err := fetchURL(ctx, client, api+"/vulns/"+url.PathEscape(id))
+		if err != nil {
+			return nil, err
+		}
+		var entry osvEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", id, err)
+		}
+		found = append(found, entry.advisories(versions)...)
+	}
+	return found, nil
+}
+
+// fetchURL GETs a URL, failing on anything but a 200
+func fetchURL(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doRequest(client, req)
+}
+
+// postURL POSTs JSON to a URL, failing on anything but a 200
+func postURL(ctx context.Context, client *http.Client, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(client, req)
+}
+
+func doRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RegistryError{URL: req.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// lookupSnapshot reads every advisory in the snapshot
+func (o *osvAdvisories) lookupSnapshot(ctx context.Context, versions map[string][]string) ([]Advisory, error) {
+	found := []Advisory{}
+	err := walkOSVDatabase(o.path, func(name string, data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var entry osvEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("error parsing %s: %v", name, err)
+		}
+		found = append(found, entry.advisories(versions)...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading advisory database %s: %w", o.path, err)
+	}
+	return found, nil
+}
+
+// walkOSVDatabase calls visit with every .json file in a directory or zip
+func walkOSVDatabase(path string, visit func(name string, data []byte) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(file, ".json") {
+				return nil
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return visit(file, data)
+		})
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if err := visit(file.Name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultAuditDB is where caladan audit db update saves the bundle
+func defaultAuditDB() string {
+	return filepath.Join(defaultCacheDir(), "advisories", "npm.zip")
+}
+
+// UpdateAuditDB downloads the latest OSV bundle to path, replacing the old
+// one only once the new one is complete and readable
+func UpdateAuditDB(path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory, updates are saved as a zip bundle", path)
+	}
+	url := os.Getenv("CALADAN_OSV_URL")
+	if url == "" {
+		url = defaultOSVURL
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	fmt.Printf("Downloading %s\n", url)
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("error downloading advisory database: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &RegistryError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error downloading advisory database: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	entries := 0
+	if err := walkOSVDatabase(tmp.Name(), func(string, []byte) error {
+		entries++
+		return nil
+	}); err != nil {
+		return fmt.Errorf("downloaded advisory database is invalid: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %d advisories to %s\n", entries, path)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testOSVEntries = map[string]string{
+	"GHSA-1.json": `{"id":"GHSA-1","summary":"Prototype Pollution","database_specific":{"severity":"CRITICAL"},
+		"affected":[{"package":{"ecosystem":"npm","name":"minimist"},"ranges":[{"type":"SEMVER","events":[{"introduced":"0"},{"fixed":"0.2.4"},{"introduced":"1.0.0"},{"fixed":"1.2.6"}]}]}]}`,
+	"GHSA-2.json": `{"id":"GHSA-2","summary":"ReDoS","database_specific":{"severity":"MODERATE"},
+		"affected":[{"package":{"ecosystem":"npm","name":"lodash"},"ranges":[{"type":"SEMVER","events":[{"introduced":"4.0.0"},{"last_affected":"4.17.20"}]}]}]}`,
+	"GHSA-3.json": `{"id":"GHSA-3","summary":"Withdrawn","withdrawn":"2024-01-01T00:00:00Z",
+		"affected":[{"package":{"ecosystem":"npm","name":"lodash"},"versions":["4.17.20"]}]}`,
+	"PYSEC-1.json": `{"id":"PYSEC-1","summary":"Other ecosystem",
+		"affected":[{"package":{"ecosystem":"PyPI","name":"lodash"},"versions":["4.17.20"]}]}`,
+}
+
+// testOSVZip returns a zip of the test advisories
+func testOSVZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, entry := range testOSVEntries {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entry))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOfflineAdvisories(t *testing.T) {
+	dir := t.TempDir()
+	for name, entry := range testOSVEntries {
+		writeTestFile(t, filepath.Join(dir, "advisories", name), entry)
+	}
+	zipPath := filepath.Join(t.TempDir(), "npm.zip")
+	if err := os.WriteFile(zipPath, testOSVZip(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := map[string][]string{
+		"minimist": {"0.0.8", "1.2.6"},
+		"lodash":   {"4.17.20", "4.17.21"},
+	}
+	for _, db := range []string{dir, zipPath} {
+		sources, err := advisorySources(db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := auditVersions(context.Background(), versions, sources)
+		if err != nil {
+			t.Fatalf("auditVersions(%s) error = %v", db, err)
+		}
+		if len(report.Advisories) != 2 {
+			t.Fatalf("auditVersions(%s) = %+v, want minimist@0.0.8 and lodash@4.17.20", db, report.Advisories)
+		}
+		minimist, lodash := report.Advisories[0], report.Advisories[1]
+		if minimist.ID != "GHSA-1" || minimist.Version != "0.0.8" || minimist.Severity != "critical" || minimist.VulnerableVersions != "<0.2.4 || >=1.0.0 <1.2.6" {
+			t.Errorf("minimist advisory = %+v", minimist)
+		}
+		if lodash.ID != "GHSA-2" || lodash.Version != "4.17.20" || lodash.Severity != "moderate" {
+			t.Errorf("lodash advisory = %+v", lodash)
+		}
+	}
+}
+
+func TestUpdateAuditDB(t *testing.T) {
+	bundle := testOSVZip(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.zip" {
+			w.Write([]byte("not a zip"))
+			return
+		}
+		w.Write(bundle)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "advisories", "npm.zip")
+	t.Setenv("CALADAN_OSV_URL", server.URL+"/all.zip")
+	if err := UpdateAuditDB(path); err != nil {
+		t.Fatalf("UpdateAuditDB() error = %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, bundle) {
+		t.Fatalf("bundle wasn't saved: %v", err)
+	}
+
+	// A bad download leaves the previous bundle in place
+	t.Setenv("CALADAN_OSV_URL", server.URL+"/broken.zip")
+	if err := UpdateAuditDB(path); err == nil {
+		t.Errorf("UpdateAuditDB() accepted an invalid bundle")
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, bundle) {
+		t.Errorf("invalid download replaced the bundle")
+	}
+}
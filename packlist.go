@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// packExcluded are never packed, whatever the files list or ignore files say
+var packExcluded = []string{
+	".git", ".svn", ".hg", "CVS", ".DS_Store", "._*", "*.orig", ".*.swp", ".lock-wscript", ".wafpickle-*",
+	"npm-debug.log", ".npmrc", ".npmignore", ".gitignore", "config.gypi", "node_modules",
+	"/package-lock.json", "/yarn.lock", "/pnpm-lock.yaml", "/bun.lockb",
+}
+
+// packAlwaysIncluded match root files that are packed even when the files
+// list or an ignore file leaves them out, case insensitively
+var packAlwaysIncluded = regexp.MustCompile(`(?i)^(package\.json|readme(\.[^/]*)?|licen[cs]e(\.[^/]*)?)$`)
+
+// ignoreRule is a line of a .npmignore or .gitignore file
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreRules parses gitignore syntax: # comments, ! to re-include, a
+// trailing / for directories only, and a / anywhere else to anchor the
+// pattern to the file's directory
+func parseIgnoreRules(content string) []ignoreRule {
+	rules := []ignoreRule{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimRight(line, " ")
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		rule.re = ignoreRegexp(line, anchored)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ignoreRegexp compiles a gitignore glob. Unanchored patterns match at any
+// depth
+func ignoreRegexp(pattern string, anchored bool) *regexp.Regexp {
+	var builder strings.Builder
+	builder.WriteString("^")
+	if !anchored {
+		builder.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			builder.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			builder.WriteString(".*")
+			i++
+		case c == '*':
+			builder.WriteString("[^/]*")
+		case c == '?':
+			builder.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(pattern[i:], ']'); end > 0 {
+				class := pattern[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				builder.WriteString("[" + class + "]")
+				i += end
+			} else {
+				builder.WriteString(`\[`)
+			}
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			builder.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	builder.WriteString("$")
+	re, err := regexp.Compile(builder.String())
+	if err != nil {
+		return regexp.MustCompile(`^\b$`) // Matches nothing
+	}
+	return re
+}
+
+// ignoredBy applies rules to a path relative to their file's directory. The
+// last matching rule wins, and matched is false when none do
+func ignoredBy(rules []ignoreRule, rel string, isDir bool) (ignored, matched bool) {
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(rel) {
+			ignored, matched = !rule.negate, true
+		}
+	}
+	return ignored, matched
+}
+
+// ignoreScope is an ignore file's rules and the directory they apply to
+type ignoreScope struct {
+	dir   string // Relative to the package, "" for its root
+	rules []ignoreRule
+}
+
+// packFiles lists the files npm would pack from a package directory,
+// relative to it and sorted. With a files list in the manifest only what it
+// covers is packed, otherwise everything is minus what .npmignore (or
+// .gitignore, when a directory has no .npmignore) excludes. Nested ignore
+// files apply either way, except the root's with a files list. Some files
+// are always excluded, and the root README, LICENSE, and package.json, the
+// main file, and bin files are always packed
+func packFiles(dir string, manifest []byte) ([]string, error) {
+	var pkg struct {
+		Files []string    `json:"files"`
+		Main  string      `json:"main"`
+		Bin   interface{} `json:"bin"`
+	}
+	if err := json.Unmarshal(manifest, &pkg); err != nil {
+		return nil, err
+	}
+	excluded := parseIgnoreRules(strings.Join(packExcluded, "\n"))
+	var allowed []ignoreRule
+	if pkg.Files != nil {
+		// Entries are relative to the package root
+		anchored := make([]string, len(pkg.Files))
+		for i, file := range pkg.Files {
+			negate := strings.HasPrefix(file, "!")
+			file = "/" + strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(file, "!"), "./"), "/")
+			if negate {
+				file = "!" + file
+			}
+			anchored[i] = file
+		}
+		allowed = parseIgnoreRules(strings.Join(anchored, "\n"))
+	}
+
+	always := make(map[string]bool)
+	for _, file := range append([]string{pkg.Main}, binPaths(pkg.Bin)...) {
+		if file = path.Clean(strings.TrimPrefix(filepath.ToSlash(file), "./")); file != "." && file != "" {
+			always[file] = true
+		}
+	}
+
+	packed := []string{}
+	var walk func(rel string, scopes []ignoreScope) error
+	walk = func(rel string, scopes []ignoreScope) error {
+		abs := filepath.Join(dir, filepath.FromSlash(rel))
+		if rel != "" || allowed == nil {
+			if rules := readIgnoreFile(abs); rules != nil {
+				scopes = append(scopes, ignoreScope{dir: rel, rules: rules})
+			}
+		}
+		entries, err := os.ReadDir(abs)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := path.Join(rel, entry.Name())
+			isDir := entry.IsDir()
+			if !isDir && !entry.Type().IsRegular() {
+				continue
+			}
+			if rel == "" && !isDir && (packAlwaysIncluded.MatchString(child) || always[child]) {
+				packed = append(packed, child)
+				continue
+			}
+			if always[child] {
+				packed = append(packed, child)
+				continue
+			}
+			if ignored, _ := ignoredBy(excluded, child, isDir); ignored {
+				continue
+			}
+			if packIgnored(scopes, child, isDir) {
+				continue
+			}
+			if isDir {
+				if err := walk(child, scopes); err != nil {
+					return err
+				}
+				continue
+			}
+			if allowed != nil && !filesListed(allowed, child) {
+				continue
+			}
+			packed = append(packed, child)
+		}
+		return nil
+	}
+	if err := walk("", nil); err != nil {
+		return nil, err
+	}
+	sort.Strings(packed)
+	return packed, nil
+}
+
+// readIgnoreFile reads a directory's .npmignore, or its .gitignore when it
+// has none, nil when it has neither
+func readIgnoreFile(dir string) []ignoreRule {
+	for _, name := range []string{".npmignore", ".gitignore"} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			return parseIgnoreRules(string(data))
+		}
+	}
+	return nil
+}
+
+// packIgnored reports whether the ignore files in scope exclude a path, the
+// deepest file that has a matching rule deciding
+func packIgnored(scopes []ignoreScope, rel string, isDir bool) bool {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		scope := scopes[i]
+		local := rel
+		if scope.dir != "" {
+			local = strings.TrimPrefix(rel, scope.dir+"/")
+		}
+		if ignored, matched := ignoredBy(scope.rules, local, isDir); matched {
+			return ignored
+		}
+	}
+	return false
+}
+
+// filesListed reports whether the files list covers a file, either by
+// matching it or one of its parent directories
+func filesListed(allowed []ignoreRule, rel string) bool {
+	listed := false
+	for p := rel; p != "."; p = path.Dir(p) {
+		// The rules here are allowlist entries, so "ignored" means listed
+		if included, matched := ignoredBy(allowed, p, p != rel); matched {
+			listed = included
+			break
+		}
+	}
+	return listed
+}
+
+// binPaths returns the files of a manifest's bin field, a path or a map of
+// command names to paths
+func binPaths(bin interface{}) []string {
+	switch bin := bin.(type) {
+	case string:
+		return []string{bin}
+	case map[string]interface{}:
+		paths := []string{}
+		for _, value := range bin {
+			if file, ok := value.(string); ok {
+				paths = append(paths, file)
+			}
+		}
+		return paths
+	}
+	return nil
+}
+
+// packedSize totals the sizes of packed files
+func packedSize(dir string, files []string) int64 {
+	var total int64
+	for _, file := range files {
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file))); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPackFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		files    map[string]string
+		want     []string
+	}{
+		{
+			name:     "files list",
+			manifest: `{"name": "a", "version": "1.0.0", "main": "lib/main.js", "bin": {"a": "./bin/a.js"}, "files": ["dist", "!dist/*.map", "types/*.d.ts"]}`,
+			files: map[string]string{
+				"dist/index.js":       "",
+				"dist/index.js.map":   "",
+				"dist/.npmignore":     "secret.js\n",
+				"dist/secret.js":      "",
+				"types/index.d.ts":    "",
+				"types/extra.ts":      "",
+				"src/index.ts":        "",
+				"lib/main.js":         "",
+				"bin/a.js":            "",
+				"README.md":           "",
+				"LICENSE":             "",
+				"CHANGELOG.md":        "",
+				".npmignore":          "README.md\n",
+				"package-lock.json":   "{}",
+				"node_modules/b/x.js": "",
+			},
+			want: []string{"LICENSE", "README.md", "bin/a.js", "dist/index.js", "lib/main.js", "package.json", "types/index.d.ts"},
+		},
+		{
+			name:     "npmignore",
+			manifest: `{"name": "a", "version": "1.0.0"}`,
+			files: map[string]string{
+				".npmignore":     "*.log\n/test\nbuild/\n!keep.log\n",
+				".gitignore":     "dist\n",
+				".eslintrc":      "",
+				"dist/index.js":  "",
+				"debug.log":      "",
+				"keep.log":       "",
+				"test/a.js":      "",
+				"src/test/b.js":  "",
+				"src/build/c.js": "",
+				"src/.gitignore": "*.tmp\n",
+				"src/x.tmp":      "",
+				".git/HEAD":      "",
+				".npmrc":         "",
+				"src/yarn.lock":  "",
+				"index.js.orig":  "",
+			},
+			want: []string{".eslintrc", "dist/index.js", "keep.log", "package.json", "src/test/b.js", "src/yarn.lock"},
+		},
+		{
+			name:     "gitignore fallback",
+			manifest: `{"name": "a", "version": "1.0.0"}`,
+			files: map[string]string{
+				".gitignore": "dist\n",
+				"dist/a.js":  "",
+				"index.js":   "",
+			},
+			want: []string{"index.js", "package.json"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, filepath.Join(dir, "package.json"), tt.manifest)
+			for name, content := range tt.files {
+				writeTestFile(t, filepath.Join(dir, name), content)
+			}
+			got, err := packFiles(dir, []byte(tt.manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("packFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackDryRun(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "@corp/a", "version": "1.2.3", "scripts": {"prepack": "echo built > built.txt"}}`)
+	writeTestFile(t, filepath.Join(dir, "index.js"), "module.exports = 1\n")
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	path, err := Pack(dir, PackOptions{DryRun: true})
+	w.Close()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make([]byte, 4096)
+	n, _ := r.Read(output)
+
+	if filepath.Base(path) != "corp-a-1.2.3.tgz" {
+		t.Errorf("Pack() path = %s", path)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s", path)
+	}
+	for _, want := range []string{"built.txt", "index.js", "package.json", "filename:      corp-a-1.2.3.tgz", "integrity:     sha512-", "total files:   3"} {
+		if !strings.Contains(string(output[:n]), want) {
+			t.Errorf("output is missing %q:\n%s", want, output[:n])
+		}
+	}
+}
+
+func TestPackReproducible(t *testing.T) {
+	manifest := `{"name": "a", "version": "1.0.0", "bin": "cli.js"}`
+	pack := func(mode os.FileMode, mtime time.Time) []byte {
+		dir := t.TempDir()
+		writeTestFile(t, filepath.Join(dir, "package.json"), manifest)
+		writeTestFile(t, filepath.Join(dir, "lib/z.js"), "z\n")
+		writeTestFile(t, filepath.Join(dir, "lib/a.js"), "a\n")
+		writeTestFile(t, filepath.Join(dir, "cli.js"), "#!/usr/bin/env node\n")
+		for _, name := range []string{"lib/z.js", "lib/a.js"} {
+			os.Chmod(filepath.Join(dir, name), mode)
+			os.Chtimes(filepath.Join(dir, name), mtime, mtime)
+		}
+		os.Chmod(filepath.Join(dir, "cli.js"), mode|0100)
+		tarball, _, err := packWorkspace(dir, []byte(manifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tarball
+	}
+
+	first := pack(0600, time.Now())
+	second := pack(0664, time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC))
+	if !bytes.Equal(first, second) {
+		t.Fatalf("packing the same files twice gave different tarballs")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gz.ModTime.IsZero() || gz.Name != "" {
+		t.Errorf("gzip header has time %v and name %q", gz.ModTime, gz.Name)
+	}
+	tr := tar.NewReader(gz)
+	names := []string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		wantMode := int64(0644)
+		if header.Name == "package/cli.js" {
+			wantMode = 0755
+		}
+		if header.Mode != wantMode || header.Uid != 0 || header.Gid != 0 || !header.ModTime.Equal(tarballMtime) {
+			t.Errorf("%s has mode %o, owner %d:%d, and mtime %v", header.Name, header.Mode, header.Uid, header.Gid, header.ModTime)
+		}
+	}
+	want := []string{"package/cli.js", "package/lib/a.js", "package/lib/z.js", "package/package.json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %v, want %v", names, want)
+	}
+}
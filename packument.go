@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// packumentReaders are the read buffers packuments are streamed through,
+// shared across the many fetched at once while resolving
+var packumentReaders = sync.Pool{
+	New: func() any { return bufio.NewReaderSize(nil, 64<<10) },
+}
+
+// decodePackument streams a packument into PackageMetadata. Popular
+// packages' packuments run to tens of megabytes, mostly readmes, publish
+// times, and fields of each version nothing reads, so rather than buffering
+// the whole document the decoder walks it: each version is decoded on its
+// own, which keeps only the fields of PackageInfo, and every other
+// top-level field is skipped token by token
+func decodePackument(r io.Reader) (*PackageMetadata, error) {
+	reader := packumentReaders.Get().(*bufio.Reader)
+	reader.Reset(r)
+	defer func() {
+		reader.Reset(nil)
+		packumentReaders.Put(reader)
+	}()
+
+	decoder := json.NewDecoder(reader)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+	metadata := &PackageMetadata{}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "name":
+			err = decoder.Decode(&metadata.Name)
+		case "dist-tags":
+			err = decoder.Decode(&metadata.DistTags)
+		case "description":
+			err = decoder.Decode(&metadata.Description)
+		case "homepage":
+			err = decoder.Decode(&metadata.Homepage)
+		case "repository":
+			err = decoder.Decode(&metadata.Repository)
+		case "author":
+			err = decoder.Decode(&metadata.Author)
+		case "license":
+			err = decoder.Decode(&metadata.License)
+		case "versions":
+			metadata.Versions, err = decodeVersions(decoder)
+		default:
+			err = skipValue(decoder)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", key, err)
+		}
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// decodeVersions decodes a packument's versions one at a time, so only one
+// version's JSON is buffered at once
+func decodeVersions(decoder *json.Decoder) (map[string]PackageInfo, error) {
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+	versions := make(map[string]PackageInfo)
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		version, _ := key.(string)
+		var info PackageInfo
+		if err := decoder.Decode(&info); err != nil {
+			return nil, fmt.Errorf("%s: %v", version, err)
+		}
+		versions[version] = info
+	}
+	return versions, expectDelim(decoder, '}')
+}
+
+// expectDelim reads the next token, failing unless it's delim
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %s, got %v", delim, token)
+	}
+	return nil
+}
+
+// skipValue reads past the next value without keeping any of it
+func skipValue(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDecodePackument(t *testing.T) {
+	packument := `{
+  "_id": "left-pad",
+  "_rev": "12-abc",
+  "name": "left-pad",
+  "description": "String left pad",
+  "dist-tags": {"latest": "1.3.0"},
+  "readme": "` + strings.Repeat("# left-pad\\n", 1000) + `",
+  "time": {"created": "2014-03-14T00:00:00.000Z", "1.3.0": "2018-04-09T00:00:00.000Z"},
+  "users": {"alice": true, "bob": true},
+  "maintainers": [{"name": "stevemao", "email": "maowenbo@gmail.com"}],
+  "license": "WTFPL",
+  "versions": {
+    "1.3.0": {
+      "name": "left-pad",
+      "version": "1.3.0",
+      "scripts": {"test": "node test"},
+      "readme": "ignored",
+      "dependencies": {"nested": "^1.0.0"},
+      "engines": {"node": ">=4"},
+      "deprecated": "use String.prototype.padStart()",
+      "_npmUser": {"name": "stevemao"},
+      "dist": {"tarball": "https://registry.npmjs.org/left-pad/-/left-pad-1.3.0.tgz", "integrity": "sha512-abc", "shasum": "5b8a", "signatures": [{"keyid": "k", "sig": "s"}]}
+    },
+    "1.2.0": {"name": "left-pad", "version": "1.2.0", "dist": {"tarball": "https://registry.npmjs.org/left-pad/-/left-pad-1.2.0.tgz", "shasum": "d30a"}}
+  }
+}`
+	metadata, err := decodePackument(strings.NewReader(packument))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever the streaming decoder keeps matches what decoding the whole
+	// document would have
+	var want PackageMetadata
+	if err := json.Unmarshal([]byte(packument), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*metadata, want) {
+		t.Errorf("decodePackument() = %+v\nwant %+v", *metadata, want)
+	}
+	if metadata.Versions["1.3.0"].Engines["node"] != ">=4" || metadata.DistTags["latest"] != "1.3.0" {
+		t.Errorf("decodePackument() lost fields: %+v", metadata)
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`{"name": "left-pad", "versions": []}`,
+		`{"name": "left-pad", "versions": {"1.0.0": {"dist": "nope"}}}`,
+		`{"name": "left-pad", "readme": "unterminated`,
+		`{"name": "left-pad"`,
+	} {
+		if _, err := decodePackument(strings.NewReader(bad)); err == nil {
+			t.Errorf("decodePackument(%s) = nil error", bad)
+		}
+	}
+}
+
+func TestDecodePackumentMemory(t *testing.T) {
+	// Thousands of versions, each with a readme the decoder has no use for
+	var builder strings.Builder
+	builder.WriteString(`{"name": "big", "dist-tags": {"latest": "1999.0.0"}, "versions": {`)
+	for i := 0; i < 2000; i++ {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		fmt.Fprintf(&builder, `"%d.0.0": {"name": "big", "version": "%d.0.0", "readme": "%s", "dist": {"tarball": "https://registry.npmjs.org/big/-/big-%d.0.0.tgz", "integrity": "sha512-x"}}`, i, i, strings.Repeat("x", 4096), i)
+	}
+	builder.WriteString(`}}`)
+	packument := builder.String()
+
+	// The whole document is never held, only one version of it at a time
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	metadata, err := decodePackument(strings.NewReader(packument))
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Versions) != 2000 || metadata.Versions["1999.0.0"].Dist.Tarball == "" {
+		t.Errorf("decoded %d versions", len(metadata.Versions))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(len(packument))/2 {
+		t.Errorf("decoding a %d byte packument allocated %d bytes", len(packument), allocated)
+	}
+}
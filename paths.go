@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// caladan keeps its cache and user config where the platform expects them:
+// the XDG directories when they're set, otherwise the OS's own (~/.cache and
+// ~/.config on Linux, ~/Library/Caches and ~/Library/Application Support on
+// macOS, %LocalAppData% and %AppData% on Windows). CALADAN_HOME puts
+// everything under one directory instead
+
+// xdgDir returns caladan's directory under the XDG base directory in
+// variable, or under the platform's own when it's unset. The XDG spec says
+// relative paths are to be ignored, so they are
+func xdgDir(variable string, platformDir func() (string, error)) string {
+	if dir := os.Getenv(variable); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "caladan")
+	}
+	dir, err := platformDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "caladan")
+}
+
+// defaultCacheDir returns the directory used for caladan's caches and store.
+// CALADAN_CACHE_DIR overrides it, then CALADAN_HOME
+func defaultCacheDir() string {
+	if dir := os.Getenv("CALADAN_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if home := os.Getenv("CALADAN_HOME"); home != "" {
+		return filepath.Join(home, "cache")
+	}
+	return xdgDir("XDG_CACHE_HOME", os.UserCacheDir)
+}
+
+// userConfigPath returns the user's config file, whose settings apply to
+// every project that doesn't set them itself
+func userConfigPath() string {
+	if home := os.Getenv("CALADAN_HOME"); home != "" {
+		return filepath.Join(home, "config.json")
+	}
+	dir := xdgDir("XDG_CONFIG_HOME", os.UserConfigDir)
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "config.json")
+}
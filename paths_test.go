@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultCacheDir(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", "")
+	t.Setenv("CALADAN_HOME", "")
+	t.Setenv("XDG_CACHE_HOME", "/xdg/cache")
+	if got, want := defaultCacheDir(), filepath.Join("/xdg/cache", "caladan"); got != want {
+		t.Errorf("defaultCacheDir() with XDG_CACHE_HOME = %q, want %q", got, want)
+	}
+
+	// Relative XDG paths are ignored
+	t.Setenv("XDG_CACHE_HOME", "relative")
+	if got := defaultCacheDir(); got == filepath.Join("relative", "caladan") {
+		t.Errorf("defaultCacheDir() used a relative XDG_CACHE_HOME")
+	}
+
+	t.Setenv("CALADAN_HOME", "/caladan")
+	if got, want := defaultCacheDir(), filepath.Join("/caladan", "cache"); got != want {
+		t.Errorf("defaultCacheDir() with CALADAN_HOME = %q, want %q", got, want)
+	}
+
+	t.Setenv("CALADAN_CACHE_DIR", "/cache")
+	if got := defaultCacheDir(); got != "/cache" {
+		t.Errorf("defaultCacheDir() with CALADAN_CACHE_DIR = %q, want /cache", got)
+	}
+}
+
+func TestUserConfigPath(t *testing.T) {
+	t.Setenv("CALADAN_HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+	if got, want := userConfigPath(), filepath.Join("/xdg/config", "caladan", "config.json"); got != want {
+		t.Errorf("userConfigPath() = %q, want %q", got, want)
+	}
+
+	t.Setenv("CALADAN_HOME", "/caladan")
+	if got, want := userConfigPath(), filepath.Join("/caladan", "config.json"); got != want {
+		t.Errorf("userConfigPath() with CALADAN_HOME = %q, want %q", got, want)
+	}
+}
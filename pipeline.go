@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// spoolQueueDepth bounds how many tarballs are downloading or waiting
+	// to be extracted. Once it's full, downloads wait for extraction to
+	// catch up rather than piling tarballs up in memory and on disk
+	spoolQueueDepth = 256
+	// spoolMemoryLimit is how big a tarball gets before it's spooled to
+	// disk instead of being held in memory until it's extracted
+	spoolMemoryLimit = 1 << 20
+)
+
+// downloadPipeline installs tarballs in two stages: downloaders spool each
+// tarball into the tarball cache, verifying it as it arrives, and hand it to
+// the extractors. A download holds a network slot only while the bytes are
+// arriving and an extraction a tar slot only while it unpacks, so slow disks
+// don't stall the network and a slow network doesn't leave extractors idle.
+// The queue between them is bounded, which is the backpressure
+type downloadPipeline struct {
+	client      *RegistryClient
+	store       *Store
+	httpLimiter limiter
+	tarLimiter  limiter
+	queue       limiter
+	// Verified tarballs by their sha512, so a package whose files aren't in
+	// the store is extracted again without downloading it. "" without a
+	// cache directory
+	tarballDir string
+}
+
+func newDownloadPipeline(client *RegistryClient, store *Store, httpLimiter, tarLimiter limiter) *downloadPipeline {
+	p := &downloadPipeline{
+		client:      client,
+		store:       store,
+		httpLimiter: httpLimiter,
+		tarLimiter:  tarLimiter,
+		queue:       newStaticLimiter(spoolQueueDepth),
+	}
+	if dir := defaultCacheDir(); dir != "" {
+		p.tarballDir = filepath.Join(dir, "tarballs")
+	}
+	return p
+}
+
+// tarballPath returns where the tarball with a sha512 integrity is cached,
+// "" for other integrities or without a cache
+func (p *downloadPipeline) tarballPath(integrity string) string {
+	algorithm, digest, err := parseIntegrity(integrity)
+	if p.tarballDir == "" || err != nil || algorithm != "sha512" {
+		return ""
+	}
+	name := hex.EncodeToString(digest)
+	return filepath.Join(p.tarballDir, name[:2], name+".tgz")
+}
+
+// cachedTarball opens the cached tarball for an integrity, if there is one
+func (p *downloadPipeline) cachedTarball(integrity string) (*spooledTarball, bool) {
+	path := p.tarballPath(integrity)
+	if path == "" {
+		return nil, false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	return &spooledTarball{file: file, cached: true}, true
+}
+
+// spooledTarball is a downloaded tarball waiting to be extracted, in
+// memory until it outgrows spoolMemoryLimit and in a temporary file after.
+// Once it's verified it's moved into the tarball cache, which is the
+// handle extraction reads from
+type spooledTarball struct {
+	dir    string // Where the temporary file goes, "" for the system's
+	buf    bytes.Buffer
+	file   *os.File
+	cached bool // file is in the tarball cache, and stays when it's closed
+}
+
+func (s *spooledTarball) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) > spoolMemoryLimit {
+		if s.dir != "" {
+			if err := os.MkdirAll(s.dir, 0755); err != nil {
+				return 0, err
+			}
+		}
+		file, err := os.CreateTemp(s.dir, "tarball-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err := s.buf.WriteTo(file); err != nil {
+			return 0, err
+		}
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// reader returns the spooled tarball from its start
+func (s *spooledTarball) reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+// persist moves a verified tarball into the cache at path, reading it from
+// there from now on
+func (s *spooledTarball) persist(path string) error {
+	if s.file == nil {
+		if err := writeFileAtomic(path, s.buf.Bytes()); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// Windows can't rename an open file
+		s.file.Close()
+		if err := os.Rename(s.file.Name(), path); err != nil {
+			os.Remove(s.file.Name())
+			s.file = nil
+			return err
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		s.file = nil
+		return err
+	}
+	s.buf = bytes.Buffer{}
+	s.file, s.cached = file, true
+	return nil
+}
+
+// close throws the spooled tarball away, or lets go of the cached one
+func (s *spooledTarball) close() {
+	if s.file != nil {
+		s.file.Close()
+		if !s.cached {
+			os.Remove(s.file.Name())
+		}
+	}
+}
+
+// install downloads a package tarball and extracts it, recording the bytes
+// transferred and written in stats. A tarball that's already in the store
+// is linked from there, and one in the tarball cache is extracted from
+// there, instead of being downloaded. bypassCache skips both
+func (p *downloadPipeline) install(ctx context.Context, url, integrity, destPath string, bypassCache bool, stats *PackageStats) (err error) {
+	start := time.Now()
+	defer func() {
+		stats.Duration = time.Since(start)
+	}()
+
+	if index, ok := p.store.getIndex(integrity); ok && !bypassCache {
+		_, linkSpan := startSpan(ctx, "link from store", spanKindInternal)
+		stats.UnpackedBytes, err = p.store.linkPackage(index, destPath)
+		linkSpan.finish(err)
+		if err == nil {
+			stats.fromStore = true
+			stats.integrity = index.Integrity
+			stats.index = index
+			stats.extractTime = time.Since(start)
+			return nil
+		}
+		// Fall back to downloading it
+		printWarning("%v", err)
+	}
+
+	// The queue slot is held from the start of the download to the end of
+	// the extraction
+	if err := p.queue.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer p.queue.Release(1)
+
+	// Cached tarballs were verified on the way in, so the content under
+	// their name is what the integrity says
+	if !bypassCache {
+		if spool, ok := p.cachedTarball(integrity); ok {
+			defer spool.close()
+			stats.integrity = integrity
+			err := p.extract(ctx, spool, url, integrity, destPath, true, stats)
+			if err == nil {
+				stats.fromTarballCache = true
+				return nil
+			}
+			// Throw the cached copy away when it's closed
+			printWarning("%v from the cached tarball, downloading it again", err)
+			spool.cached = false
+		}
+	}
+
+	spool, verified, err := p.download(ctx, url, integrity, bypassCache, stats)
+	if spool != nil {
+		defer spool.close()
+	}
+	if err != nil {
+		return err
+	}
+	return p.extract(ctx, spool, url, integrity, destPath, verified, stats)
+}
+
+// download spools a tarball, computing its sha512 as it arrives and
+// checking it against integrity, then moves it into the tarball cache by its
+// sha512. verified is false when there was no integrity to check against,
+// though the tarball is still cached by what it hashed to
+func (p *downloadPipeline) download(ctx context.Context, url, integrity string, bypassCache bool, stats *PackageStats) (spool *spooledTarball, verified bool, err error) {
+	if err := p.httpLimiter.Acquire(ctx, 1); err != nil {
+		return nil, false, err
+	}
+	defer p.httpLimiter.Release(1)
+
+	fmt.Printf("Downloading %s\n", url)
+	fetchStart := time.Now()
+	_, downloadSpan := startSpan(ctx, "download", spanKindClient, otlpAttr("url.full", url))
+	defer func() {
+		stats.downloadTime = time.Since(fetchStart)
+		downloadSpan.setAttrs(otlpIntAttr("http.response.body.size", stats.DownloadedBytes))
+		downloadSpan.finish(err)
+	}()
+
+	resp, err := p.client.tarball(ctx, url, bypassCache, func(answered bool) {
+		stats.Retries++
+		if answered {
+			p.httpLimiter.backoff()
+		}
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("error downloading package: %w", err)
+	}
+	defer resp.Body.Close()
+	downloadSpan.setAttrs(otlpIntAttr("http.response.status_code", int64(resp.StatusCode)))
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, &RegistryError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	// The sha512 is always computed so lockfiles with a sha1 (or no)
+	// integrity can be backfilled
+	algorithm, expectedHash, err := parseIntegrity(integrity)
+	if err != nil {
+		return nil, false, err
+	}
+	sha512Hash := sha512.New()
+	var expected hash.Hash
+	switch algorithm {
+	case "sha512":
+		expected = sha512Hash
+	case "sha256":
+		expected = sha256.New()
+	case "sha1":
+		expected = sha1.New()
+	}
+	writers := []io.Writer{sha512Hash}
+	if expected != nil && expected != sha512Hash {
+		writers = append(writers, expected)
+	}
+
+	spool = &spooledTarball{}
+	if p.tarballDir != "" {
+		spool.dir = filepath.Join(p.tarballDir, "tmp")
+	}
+	body := &countingReader{r: resp.Body}
+	_, err = io.Copy(io.MultiWriter(append(writers, spool)...), body)
+	stats.DownloadedBytes = body.n
+	if err != nil {
+		return spool, false, fmt.Errorf("error downloading package: %v", err)
+	}
+	p.httpLimiter.done(stats.DownloadedBytes)
+	stats.integrity = "sha512-" + base64.StdEncoding.EncodeToString(sha512Hash.Sum(nil))
+
+	// Nothing to compare against with --no-verify or --update-integrity
+	if expected != nil {
+		if actualHash := expected.Sum(nil); !compareHashes(actualHash, expectedHash) {
+			return spool, false, &IntegrityError{
+				URL:      url,
+				Expected: integrity,
+				Actual:   algorithm + "-" + base64.StdEncoding.EncodeToString(actualHash),
+			}
+		}
+	}
+	if path := p.tarballPath(stats.integrity); path != "" {
+		if err := spool.persist(path); err != nil {
+			return spool, false, fmt.Errorf("error caching package: %v", err)
+		}
+	}
+	return spool, expected != nil, nil
+}
+
+// extract unpacks a spooled tarball into destPath, indexing it in the store
+// when it was verified. Unverified tarballs aren't indexed, though other
+// entries of this install with the same tarball still link its files
+func (p *downloadPipeline) extract(ctx context.Context, spool *spooledTarball, url, integrity, destPath string, verified bool, stats *PackageStats) error {
+	if err := p.tarLimiter.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer p.tarLimiter.Release(1)
+
+	reader, err := spool.reader()
+	if err != nil {
+		return fmt.Errorf("error extracting package: %v", err)
+	}
+	fmt.Printf("Extracting %s\n", destPath)
+	extractStart := time.Now()
+	_, extractSpan := startSpan(ctx, "extract", spanKindInternal)
+	var index *packageIndex
+	stats.UnpackedBytes, index, err = extractTarGz(ctx, reader, destPath, p.store, stats.previous)
+	extractSpan.finish(err)
+	stats.extractTime = time.Since(extractStart)
+	if err != nil {
+		return fmt.Errorf("error extracting package: %v", err)
+	}
+	p.tarLimiter.done(stats.UnpackedBytes)
+
+	index.Integrity = stats.integrity
+	if verified && p.store != nil {
+		if err := p.store.putIndex(integrity, index); err != nil {
+			printWarning("failed to index %s in the store: %v", url, err)
+		}
+	}
+	stats.index = index
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpooledTarball(t *testing.T) {
+	dir := t.TempDir()
+	small := &spooledTarball{dir: dir}
+	small.Write([]byte("tarball"))
+	if small.file != nil {
+		t.Error("a small tarball was spooled to disk")
+	}
+
+	data := bytes.Repeat([]byte("x"), spoolMemoryLimit+1)
+	large := &spooledTarball{dir: dir}
+	large.Write(data[:10])
+	large.Write(data[10:])
+	if large.file == nil {
+		t.Fatal("a large tarball was kept in memory")
+	}
+	reader, err := large.reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spooled, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(spooled, data) {
+		t.Errorf("read back %d bytes, want %d", len(spooled), len(data))
+	}
+	large.close()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("close left %d files behind", len(entries))
+	}
+}
+
+func TestDownloadPipelineDecouplesExtraction(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+	names := []string{"one", "two", "three"}
+	tarballs := map[string][]byte{}
+	integrities := map[string]string{}
+	for _, name := range names {
+		tarballs["/"+name+".tgz"], integrities[name] = testTarball(t, name, "1.0.0")
+	}
+	var served atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarballs[r.URL.Path])
+		served.Add(1)
+	}))
+	defer server.Close()
+
+	// One download and one extraction at a time, with the extraction slot
+	// taken so nothing can be extracted yet
+	tarLimiter := newStaticLimiter(1)
+	tarLimiter.Acquire(context.Background(), 1)
+	pipeline := newDownloadPipeline(newRegistryClient(server.Client(), server.URL, ""), nil, newStaticLimiter(1), tarLimiter)
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats := PackageStats{}
+			errs[i] = pipeline.install(context.Background(), server.URL+"/"+name+".tgz", integrities[name], filepath.Join(dir, name), false, &stats)
+		}()
+	}
+
+	// Every tarball downloads while extraction is blocked
+	deadline := time.Now().Add(5 * time.Second)
+	for served.Load() < int32(len(names)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("downloaded %d of %d tarballs while extraction was blocked", served.Load(), len(names))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tarLimiter.Release(1)
+	wg.Wait()
+
+	for i, name := range names {
+		if errs[i] != nil {
+			t.Errorf("%s: %v", name, errs[i])
+		}
+		if _, err := os.Stat(filepath.Join(dir, name, "package.json")); err != nil {
+			t.Errorf("%s wasn't extracted: %v", name, err)
+		}
+	}
+}
+
+func TestDownloadPipelineTarballCache(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+	tarball, integrity := testTarball(t, "cached", "1.0.0")
+	_, otherIntegrity := testTarball(t, "other", "1.0.0")
+	var served atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+		served.Add(1)
+	}))
+	defer server.Close()
+	pipeline := newDownloadPipeline(newRegistryClient(server.Client(), server.URL, ""), nil, newStaticLimiter(1), newStaticLimiter(1))
+	dir := t.TempDir()
+
+	// A tarball that fails its check isn't cached under either integrity
+	stats := PackageStats{}
+	var mismatch *IntegrityError
+	if err := pipeline.install(context.Background(), server.URL, otherIntegrity, filepath.Join(dir, "bad"), false, &stats); !errors.As(err, &mismatch) {
+		t.Fatalf("install() = %v, want an integrity error", err)
+	}
+	if _, ok := pipeline.cachedTarball(otherIntegrity); ok {
+		t.Error("a tarball that failed its check was cached")
+	}
+
+	for i, name := range []string{"first", "second"} {
+		stats := PackageStats{}
+		if err := pipeline.install(context.Background(), server.URL, integrity, filepath.Join(dir, name), false, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name, "package.json")); err != nil {
+			t.Errorf("%s wasn't extracted: %v", name, err)
+		}
+		if stats.fromTarballCache != (i == 1) {
+			t.Errorf("%s: fromTarballCache = %v", name, stats.fromTarballCache)
+		}
+	}
+	if served.Load() != 2 {
+		t.Errorf("downloaded %d times, want once for each integrity", served.Load())
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Platform describes an install target using npm's names for each part
+type Platform struct {
+	OS   string // process.platform, e.g. "linux", "darwin", "win32"
+	CPU  string // process.arch, e.g. "x64", "arm64"
+	Libc string // "glibc" or "musl" on Linux, empty elsewhere
+}
+
+// hostPlatform returns the platform caladan is running on
+func hostPlatform() Platform {
+	return Platform{
+		OS:   npmOS(runtime.GOOS),
+		CPU:  npmCPU(runtime.GOARCH),
+		Libc: hostLibc(),
+	}
+}
+
+func (p Platform) String() string {
+	if p.Libc != "" {
+		return fmt.Sprintf("%s-%s-%s", p.OS, p.CPU, p.Libc)
+	}
+	return fmt.Sprintf("%s-%s", p.OS, p.CPU)
+}
+
+// Values npm understands for each platform field
+var (
+	knownOS   = []string{"aix", "android", "darwin", "freebsd", "linux", "netbsd", "openbsd", "sunos", "win32"}
+	knownCPU  = []string{"arm", "arm64", "ia32", "loong64", "mips", "mipsel", "ppc", "ppc64", "riscv64", "s390", "s390x", "x64"}
+	knownLibc = []string{"glibc", "musl"}
+)
+
+// targetPlatform fills in the empty fields of a requested install target
+// from the host and checks the result is a platform npm knows about
+func targetPlatform(target Platform) (Platform, error) {
+	host := hostPlatform()
+	if target.OS == "" {
+		target.OS = host.OS
+	}
+	if target.CPU == "" {
+		target.CPU = host.CPU
+	}
+	if target.OS != "linux" {
+		target.Libc = ""
+	} else if target.Libc == "" {
+		target.Libc = host.Libc
+		if target.Libc == "" {
+			// Cross-installing for Linux from another OS
+			target.Libc = "glibc"
+		}
+	}
+
+	for _, check := range []struct {
+		field, value string
+		known        []string
+	}{
+		{"os", target.OS, knownOS},
+		{"cpu", target.CPU, knownCPU},
+		{"libc", target.Libc, knownLibc},
+	} {
+		if check.value == "" {
+			continue
+		}
+		if !contains(check.known, check.value) {
+			return Platform{}, fmt.Errorf("unknown target %s '%s', expected one of: %s",
+				check.field, check.value, strings.Join(check.known, ", "))
+		}
+	}
+
+	return target, nil
+}
+
+// contains reports whether a string slice contains value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// npmOS maps a GOOS value to the name npm uses in the "os" field
+func npmOS(goos string) string {
+	switch goos {
+	case "windows":
+		return "win32"
+	default:
+		return goos
+	}
+}
+
+// npmCPU maps a GOARCH value to the name npm uses in the "cpu" field
+func npmCPU(goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x64"
+	case "386":
+		return "ia32"
+	case "ppc64le":
+		return "ppc64"
+	default:
+		return goarch
+	}
+}
+
+// hostLibc detects which C library the host uses. musl systems ship a
+// dynamic loader named ld-musl-<arch>.so.1, everything else is treated as glibc
+func hostLibc() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+
+	for _, pattern := range []string{"/lib/ld-musl-*.so.1", "/usr/lib/ld-musl-*.so.1"} {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return "musl"
+		}
+	}
+	return "glibc"
+}
+
+// platformListAllows checks a value against an os/cpu/libc list from
+// package.json. Entries prefixed with "!" block a value, and if there are any
+// plain entries the value must be one of them
+func platformListAllows(list []string, value string) bool {
+	hasAllowList := false
+	allowed := false
+
+	for _, entry := range list {
+		if strings.HasPrefix(entry, "!") {
+			if entry[1:] == value {
+				return false
+			}
+			continue
+		}
+		hasAllowList = true
+		if entry == value {
+			allowed = true
+		}
+	}
+
+	return !hasAllowList || allowed
+}
+
+// isCompatible reports whether a package can be installed on the platform,
+// and if not, which field ruled it out
+func (p Platform) isCompatible(pkg PackageInfo) (bool, string) {
+	if len(pkg.OS) > 0 && !platformListAllows(pkg.OS, p.OS) {
+		return false, "os"
+	}
+	if len(pkg.CPU) > 0 && !platformListAllows(pkg.CPU, p.CPU) {
+		return false, "cpu"
+	}
+	if len(pkg.Libc) > 0 {
+		// libc only means something on Linux, so any value rules out other platforms
+		if p.OS != "linux" || !platformListAllows(pkg.Libc, p.Libc) {
+			return false, "libc"
+		}
+	}
+	return true, ""
+}
+
+// isCompatibleWithAny reports whether a package can be installed on at least
+// one of the platforms, and if not, which field ruled it out on the first
+func isCompatibleWithAny(platforms []Platform, pkg PackageInfo) (bool, string) {
+	firstField := ""
+	for i, platform := range platforms {
+		ok, field := platform.isCompatible(pkg)
+		if ok {
+			return true, ""
+		}
+		if i == 0 {
+			firstField = field
+		}
+	}
+	return false, firstField
+}
+
+// platforms expands the supported architectures into every combination to
+// install for. "current" and empty lists stand for the given host's value
+func (s SupportedArchitectures) platforms(host Platform) []Platform {
+	expand := func(values []string, current string) []string {
+		if len(values) == 0 {
+			return []string{current}
+		}
+		expanded := []string{}
+		seen := make(map[string]bool)
+		for _, value := range values {
+			if value == "current" {
+				value = current
+			}
+			if !seen[value] {
+				seen[value] = true
+				expanded = append(expanded, value)
+			}
+		}
+		return expanded
+	}
+
+	platforms := []Platform{}
+	for _, os := range expand(s.OS, host.OS) {
+		for _, cpu := range expand(s.CPU, host.CPU) {
+			for _, libc := range expand(s.Libc, host.Libc) {
+				platforms = append(platforms, Platform{OS: os, CPU: cpu, Libc: libc})
+			}
+		}
+	}
+	return platforms
+}
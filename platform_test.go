@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlatformIsCompatible(t *testing.T) {
+	linuxGlibc := Platform{OS: "linux", CPU: "x64", Libc: "glibc"}
+	linuxMusl := Platform{OS: "linux", CPU: "arm64", Libc: "musl"}
+	darwin := Platform{OS: "darwin", CPU: "arm64"}
+
+	tests := []struct {
+		name     string
+		platform Platform
+		pkg      PackageInfo
+		want     bool
+	}{
+		{
+			name:     "no constraints",
+			platform: darwin,
+			pkg:      PackageInfo{},
+			want:     true,
+		},
+		{
+			name:     "matching os and cpu",
+			platform: linuxGlibc,
+			pkg:      PackageInfo{OS: []string{"linux"}, CPU: []string{"x64"}},
+			want:     true,
+		},
+		{
+			name:     "wrong cpu",
+			platform: linuxMusl,
+			pkg:      PackageInfo{OS: []string{"linux"}, CPU: []string{"x64"}},
+			want:     false,
+		},
+		{
+			name:     "negated os",
+			platform: darwin,
+			pkg:      PackageInfo{OS: []string{"!darwin"}},
+			want:     false,
+		},
+		{
+			name:     "glibc build on musl",
+			platform: linuxMusl,
+			pkg:      PackageInfo{OS: []string{"linux"}, Libc: []string{"glibc"}},
+			want:     false,
+		},
+		{
+			name:     "musl build on musl",
+			platform: linuxMusl,
+			pkg:      PackageInfo{OS: []string{"linux"}, Libc: []string{"musl"}},
+			want:     true,
+		},
+		{
+			name:     "libc outside linux",
+			platform: darwin,
+			pkg:      PackageInfo{Libc: []string{"glibc"}},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := tt.platform.isCompatible(tt.pkg); got != tt.want {
+				t.Errorf("isCompatible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSupportedArchitecturesPlatforms(t *testing.T) {
+	host := Platform{OS: "linux", CPU: "x64", Libc: "glibc"}
+
+	tests := []struct {
+		name      string
+		supported SupportedArchitectures
+		want      []Platform
+	}{
+		{
+			name:      "defaults to host",
+			supported: SupportedArchitectures{},
+			want:      []Platform{host},
+		},
+		{
+			name:      "current plus another os",
+			supported: SupportedArchitectures{OS: []string{"current", "darwin"}, CPU: []string{"arm64"}},
+			want: []Platform{
+				{OS: "linux", CPU: "arm64", Libc: "glibc"},
+				{OS: "darwin", CPU: "arm64", Libc: "glibc"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.supported.platforms(host); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("platforms() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetPlatform(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  Platform
+		want    Platform
+		wantErr bool
+	}{
+		{
+			name:   "linux lambda",
+			target: Platform{OS: "linux", CPU: "x64", Libc: "glibc"},
+			want:   Platform{OS: "linux", CPU: "x64", Libc: "glibc"},
+		},
+		{
+			name:   "libc dropped outside linux",
+			target: Platform{OS: "darwin", CPU: "arm64", Libc: "musl"},
+			want:   Platform{OS: "darwin", CPU: "arm64"},
+		},
+		{
+			name:    "go names are rejected",
+			target:  Platform{OS: "linux", CPU: "amd64"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := targetPlatform(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("targetPlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("targetPlatform() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conventions packages use to fetch a prebuilt native binary instead of
+// compiling one
+const (
+	// node-pre-gyp downloads {host}{remote_path}{package_name} from the
+	// binary field and unpacks it into module_path
+	conventionNodePreGyp = "node-pre-gyp"
+	// prebuild-install downloads a tarball from the package's GitHub
+	// releases (or binary.host), preferring one in the package's prebuilds
+	conventionPrebuildInstall = "prebuild-install"
+	// napi-rs packages depend on a package per platform, which caladan
+	// already installs as an optional dependency
+	conventionNapiRS = "napi-rs"
+)
+
+// PrebuiltConfig configures how caladan fetches prebuilt binaries. Mirrors
+// replaces URL prefixes, like "https://github.com/" with an artifact
+// proxy's. Credentials configured for a binary's host (its scheme and host,
+// like a registry) are sent as a bearer token
+type PrebuiltConfig struct {
+	Mirrors map[string]string `json:"mirrors,omitempty"`
+}
+
+// PrebuiltBinary is a prebuilt binary caladan fetched for a package before
+// its install script ran, so the script finds it instead of downloading it
+type PrebuiltBinary struct {
+	Path       string `json:"path"`
+	Convention string `json:"convention"`
+	URL        string `json:"url,omitempty"`
+	FromCache  bool   `json:"fromCache,omitempty"`
+	Error      string `json:"error,omitempty"` // Why it wasn't fetched, the script then fetches or builds it itself
+}
+
+// prebuiltPackage is the part of a package.json that says where its
+// prebuilt binaries are
+type prebuiltPackage struct {
+	Name       string            `json:"name"`
+	Version    string            `json:"version"`
+	Scripts    map[string]string `json:"scripts"`
+	Repository json.RawMessage   `json:"repository"`
+	Napi       json.RawMessage   `json:"napi"`
+	Binary     struct {
+		ModuleName     string `json:"module_name"`
+		ModulePath     string `json:"module_path"`
+		Host           string `json:"host"`
+		ProductionHost string `json:"production_host"`
+		RemotePath     string `json:"remote_path"`
+		PackageName    string `json:"package_name"`
+		NapiVersions   []int  `json:"napi_versions"`
+	} `json:"binary"`
+}
+
+// nodeRuntime is what the node install scripts run with reports, which
+// picks the binary
+type nodeRuntime struct {
+	ABI      string // process.versions.modules
+	NAPI     int    // process.versions.napi
+	Platform string
+	Arch     string
+	Libc     string // glibc or musl on Linux
+}
+
+// detectNodeRuntime asks the node on PATH about itself
+func detectNodeRuntime() (nodeRuntime, error) {
+	out, err := exec.Command("node", "-p", "[process.versions.modules, process.versions.napi, process.platform, process.arch].join(' ')").Output()
+	if err != nil {
+		return nodeRuntime{}, fmt.Errorf("error running node: %v", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 4 {
+		return nodeRuntime{}, fmt.Errorf("unexpected output from node: %q", out)
+	}
+	napi, _ := strconv.Atoi(fields[1])
+	return nodeRuntime{ABI: fields[0], NAPI: napi, Platform: fields[2], Arch: fields[3], Libc: hostLibc()}, nil
+}
+
+// prebuiltConvention returns the convention a package fetches its binary
+// with, or "" when it doesn't use one caladan knows
+func prebuiltConvention(pkg prebuiltPackage) string {
+	script := pkg.Scripts["install"] + " " + pkg.Scripts["preinstall"] + " " + pkg.Scripts["postinstall"]
+	switch {
+	case strings.Contains(script, "node-pre-gyp") && (pkg.Binary.Host != "" || pkg.Binary.ProductionHost != ""):
+		return conventionNodePreGyp
+	case strings.Contains(script, "prebuild-install"):
+		return conventionPrebuildInstall
+	case len(pkg.Napi) > 0:
+		return conventionNapiRS
+	}
+	return ""
+}
+
+// templateField matches a {placeholder} in a binary URL template
+var templateField = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// expandTemplate fills in a URL template, failing on placeholders it
+// doesn't know rather than guessing a URL
+func expandTemplate(template string, values map[string]string) (string, error) {
+	var missing string
+	expanded := templateField.ReplaceAllStringFunc(template, func(field string) string {
+		value, ok := values[field[1:len(field)-1]]
+		if !ok {
+			missing = field
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("unsupported placeholder %s in %s", missing, template)
+	}
+	return expanded, nil
+}
+
+// templateValues are the placeholders both conventions fill from the
+// package's version
+func templateValues(pkg prebuiltPackage) map[string]string {
+	values := map[string]string{"name": pkg.Name, "version": pkg.Version, "configuration": "Release", "toolset": ""}
+	if parsed, ok := parseSemver(pkg.Version); ok {
+		values["major"] = strconv.Itoa(parsed.core[0])
+		values["minor"] = strconv.Itoa(parsed.core[1])
+		values["patch"] = strconv.Itoa(parsed.core[2])
+		values["prerelease"] = strings.Join(parsed.prerelease, ".")
+	}
+	return values
+}
+
+// nodePreGypBinary returns where node-pre-gyp would download a package's
+// binary from, and the directory it unpacks it into, relative to the package.
+// A mirror replaces binary.host, like npm_config_<module_name>_binary_host_mirror
+func nodePreGypBinary(pkg prebuiltPackage, node nodeRuntime, mirror string) (string, string, error) {
+	values := templateValues(pkg)
+	values["module_name"] = pkg.Binary.ModuleName
+	values["node_abi"] = "node-v" + node.ABI
+	values["platform"] = node.Platform
+	values["arch"] = node.Arch
+	values["libc"] = node.Libc
+	if values["libc"] == "" {
+		values["libc"] = "unknown"
+	}
+
+	host := mirror
+	if host == "" {
+		host = pkg.Binary.Host
+	}
+	if host == "" {
+		host = pkg.Binary.ProductionHost
+	}
+	packageName := pkg.Binary.PackageName
+	if packageName == "" {
+		packageName = "{module_name}-v{version}-{node_abi}-{platform}-{arch}.tar.gz"
+	}
+	parts := []string{}
+	for _, template := range []string{host, pkg.Binary.RemotePath, packageName, pkg.Binary.ModulePath} {
+		expanded, err := expandTemplate(template, values)
+		if err != nil {
+			return "", "", err
+		}
+		parts = append(parts, expanded)
+	}
+	base, err := url.Parse(strings.TrimSuffix(parts[0], "/") + "/")
+	if err != nil {
+		return "", "", err
+	}
+	remotePath := parts[1]
+	if remotePath != "" && !strings.HasSuffix(remotePath, "/") {
+		remotePath += "/"
+	}
+	hosted, err := base.Parse(strings.TrimPrefix(remotePath, "/"))
+	if err != nil {
+		return "", "", err
+	}
+	tarball, err := hosted.Parse(parts[2])
+	if err != nil {
+		return "", "", err
+	}
+	return tarball.String(), parts[3], nil
+}
+
+var (
+	// githubRepository matches the owner and name of a GitHub repository
+	// URL, or of the github:owner/name and owner/name shorthands
+	githubRepository = regexp.MustCompile(`(?:github\.com[/:]|^github:|^)([\w.-]+)/([\w.-]+?)(?:\.git)?(?:[/#].*)?$`)
+	// napiRuntime matches the flag that makes prebuild-install fetch a
+	// N-API build
+	napiRuntime = regexp.MustCompile(`(-r|--runtime)[ =]napi`)
+)
+
+// prebuildInstallBinary returns where prebuild-install would download a
+// package's binary from. A mirror is used in place of the release's host,
+// like npm_config_<name>_binary_host_mirror
+func prebuildInstallBinary(pkg prebuiltPackage, node nodeRuntime, mirror string) (string, error) {
+	// Like the flags the script would pass, napi builds are picked by the
+	// newest N-API version both the package and node support
+	script := pkg.Scripts["install"] + " " + pkg.Scripts["preinstall"] + " " + pkg.Scripts["postinstall"]
+	runtime, abi := "node", node.ABI
+	if napiRuntime.MatchString(script) {
+		best := 0
+		for _, version := range pkg.Binary.NapiVersions {
+			if version <= node.NAPI && version > best {
+				best = version
+			}
+		}
+		if best == 0 {
+			return "", fmt.Errorf("no N-API version the package and node both support")
+		}
+		runtime, abi = "napi", strconv.Itoa(best)
+	}
+
+	values := templateValues(pkg)
+	values["name"] = pkg.Name[strings.Index(pkg.Name, "/")+1:]
+	values["package_name"] = values["name"]
+	values["runtime"] = runtime
+	values["abi"] = abi
+	values["node_abi"] = node.ABI
+	values["platform"] = node.Platform
+	values["arch"] = node.Arch
+	values["libc"] = ""
+	if node.Libc == "musl" {
+		values["libc"] = "musl"
+	}
+	values["module_name"] = pkg.Binary.ModuleName
+	values["tag_prefix"] = "v"
+
+	packageName := "{name}-v{version}-{runtime}-v{abi}-{platform}{libc}-{arch}.tar.gz"
+	var template string
+	if mirror != "" {
+		template = strings.TrimSuffix(mirror, "/") + "/{tag_prefix}{version}/" + packageName
+	} else if pkg.Binary.Host != "" {
+		if pkg.Binary.PackageName != "" {
+			packageName = pkg.Binary.PackageName
+		}
+		template = strings.Join([]string{strings.TrimSuffix(pkg.Binary.Host, "/"), strings.Trim(pkg.Binary.RemotePath, "/"), packageName}, "/")
+	} else {
+		var repository struct {
+			URL string `json:"url"`
+		}
+		if json.Unmarshal(pkg.Repository, &repository) != nil {
+			json.Unmarshal(pkg.Repository, &repository.URL)
+		}
+		match := githubRepository.FindStringSubmatch(repository.URL)
+		if match == nil {
+			return "", fmt.Errorf("no GitHub repository to download releases from")
+		}
+		template = "https://github.com/" + match[1] + "/" + match[2] + "/releases/download/{tag_prefix}{version}/" + packageName
+	}
+	return expandTemplate(template, values)
+}
+
+// prebuiltFetcher downloads prebuilt binaries through caladan's transport,
+// with the project's mirrors and credentials, into the cache
+type prebuiltFetcher struct {
+	client   *http.Client
+	cacheDir string // "" when there's no cache
+	mirrors  map[string]string
+	// The binaryMirrors config, whose host mirrors the install scripts
+	// would download from
+	hostMirrors BinaryMirrors
+	token       func(origin string) string
+}
+
+// mirrored rewrites a URL by the longest mirror prefix that matches it
+func (f *prebuiltFetcher) mirrored(rawURL string) string {
+	prefixes := make([]string, 0, len(f.mirrors))
+	for prefix := range f.mirrors {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, prefix := range prefixes {
+		if rest, ok := strings.CutPrefix(rawURL, prefix); ok {
+			return f.mirrors[prefix] + rest
+		}
+	}
+	return rawURL
+}
+
+// fetch returns the tarball at a URL, from the cache when it's there
+func (f *prebuiltFetcher) fetch(ctx context.Context, rawURL string) ([]byte, bool, error) {
+	cachePath := ""
+	if f.cacheDir != "" {
+		cachePath = filepath.Join(f.cacheDir, "prebuilds", cacheKey(rawURL)+"-"+path.Base(rawURL))
+		if data, err := os.ReadFile(cachePath); err == nil {
+			return data, true, nil
+		}
+	}
+
+	target := f.mirrored(rawURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.token != nil {
+		if token := f.token(req.URL.Scheme + "://" + req.URL.Host); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	data, err := doRequest(f.client, req)
+	if err != nil {
+		return nil, false, err
+	}
+	if cachePath != "" {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+			writeFileAtomic(cachePath, data)
+		}
+	}
+	return data, false, nil
+}
+
+// extractPrebuilt unpacks a gzipped tarball into dir, dropping the first
+// strip components of each path like tar --strip-components
+func extractPrebuilt(data []byte, dir string, strip int) error {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error creating gzip reader: %v", err)
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar: %v", err)
+		}
+		parts := strings.Split(path.Clean(strings.TrimPrefix(header.Name, "./")), "/")
+		if len(parts) <= strip {
+			continue
+		}
+		name := path.Join(parts[strip:]...)
+		if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return fmt.Errorf("prebuilt binary has an entry outside its directory: %s", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// Package files may be links into the store, which mustn't be
+			// written through
+			os.Remove(target)
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0755|0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// placePrebuilt fetches the binary of a package installed at pkgPath and
+// puts it where its install script looks before downloading: unpacked into
+// module_path for node-pre-gyp, which then reports it already installed,
+// and into the package's prebuilds directory for prebuild-install
+func (f *prebuiltFetcher) placePrebuilt(ctx context.Context, pkgPath string, pkg prebuiltPackage, convention string, node nodeRuntime) (PrebuiltBinary, error) {
+	binary := PrebuiltBinary{Convention: convention}
+	var err error
+	switch convention {
+	case conventionNodePreGyp:
+		var modulePath string
+		if binary.URL, modulePath, err = nodePreGypBinary(pkg, node, f.hostMirrors.hostMirror(pkg.Binary.ModuleName)); err != nil {
+			return binary, err
+		}
+		dest := filepath.Join(pkgPath, filepath.FromSlash(modulePath))
+		if rel, err := filepath.Rel(pkgPath, dest); err != nil || strings.HasPrefix(rel, "..") {
+			return binary, fmt.Errorf("module_path %s is outside the package", modulePath)
+		}
+		data, fromCache, err := f.fetch(ctx, binary.URL)
+		if err != nil {
+			return binary, err
+		}
+		binary.FromCache = fromCache
+		return binary, extractPrebuilt(data, dest, 1)
+	case conventionPrebuildInstall:
+		if binary.URL, err = prebuildInstallBinary(pkg, node, f.hostMirrors.hostMirror(pkg.Name)); err != nil {
+			return binary, err
+		}
+		data, fromCache, err := f.fetch(ctx, binary.URL)
+		if err != nil {
+			return binary, err
+		}
+		binary.FromCache = fromCache
+		dest := filepath.Join(pkgPath, "prebuilds", path.Base(binary.URL))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return binary, err
+		}
+		return binary, os.WriteFile(dest, data, 0644)
+	}
+	return binary, nil
+}
+
+// countPrebuilts counts the binaries that were fetched, and how many of
+// those came from the cache
+func countPrebuilts(binaries []PrebuiltBinary) (int, int) {
+	fetched, cached := 0, 0
+	for _, binary := range binaries {
+		if binary.URL != "" && binary.Error == "" {
+			fetched++
+			if binary.FromCache {
+				cached++
+			}
+		}
+	}
+	return fetched, cached
+}
+
+// fetchPrebuilts fetches the prebuilt binaries of the installed packages
+// whose install scripts would otherwise download them, one request per
+// package through caladan's own HTTP stack. A binary that can't be fetched
+// is left to the script
+func fetchPrebuilts(ctx context.Context, summary *InstallSummary, nodeModulesPath string, opts InstallOptions, config Config) {
+	fetcher := &prebuiltFetcher{
+		client:      &http.Client{Timeout: 5 * time.Minute, Transport: opts.transport},
+		cacheDir:    defaultCacheDir(),
+		mirrors:     config.Prebuilt.Mirrors,
+		hostMirrors: config.BinaryMirrors,
+		token: func(origin string) string {
+			if _, ok := config.Credentials[origin]; !ok {
+				return ""
+			}
+			store, err := credentialStoreFor(config, origin)
+			if err != nil {
+				return ""
+			}
+			token, _ := store.get(origin)
+			return token
+		},
+	}
+
+	var node *nodeRuntime
+	for _, stats := range summary.Packages {
+		pkgPath := filepath.Join(nodeModulesPath, strings.TrimPrefix(stats.Path, "node_modules/"))
+		data, err := os.ReadFile(filepath.Join(pkgPath, "package.json"))
+		if err != nil {
+			continue
+		}
+		var pkg prebuiltPackage
+		if json.Unmarshal(data, &pkg) != nil {
+			continue
+		}
+		convention := prebuiltConvention(pkg)
+		if convention == "" {
+			continue
+		}
+		binary := PrebuiltBinary{Path: stats.Path, Convention: convention}
+		if convention != conventionNapiRS {
+			if node == nil {
+				detected, err := detectNodeRuntime()
+				if err != nil {
+					printWarning("couldn't fetch prebuilt binaries, leaving it to install scripts: %v", err)
+					return
+				}
+				node = &detected
+			}
+			binary, err = fetcher.placePrebuilt(ctx, pkgPath, pkg, convention, *node)
+			binary.Path = stats.Path
+			if err != nil {
+				binary.Error = err.Error()
+				fmt.Println(colorDim(fmt.Sprintf("No prebuilt binary for %s (%s), leaving it to its install script: %v", stats.Path, convention, err)))
+			} else {
+				fmt.Printf("Fetched prebuilt binary of %s (%s)\n", stats.Path, convention)
+			}
+		}
+		summary.Prebuilt = append(summary.Prebuilt, binary)
+	}
+	sort.Slice(summary.Prebuilt, func(i, j int) bool { return summary.Prebuilt[i].Path < summary.Prebuilt[j].Path })
+}
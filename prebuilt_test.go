@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testNode = nodeRuntime{ABI: "115", NAPI: 9, Platform: "linux", Arch: "x64", Libc: "glibc"}
+
+func parsePrebuiltPackage(t *testing.T, data string) prebuiltPackage {
+	t.Helper()
+	var pkg prebuiltPackage
+	if err := json.Unmarshal([]byte(data), &pkg); err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func TestPrebuiltConvention(t *testing.T) {
+	tests := []struct {
+		pkg  string
+		want string
+	}{
+		{`{"scripts": {"install": "node-pre-gyp install --fallback-to-build"}, "binary": {"host": "https://example.com"}}`, conventionNodePreGyp},
+		{`{"scripts": {"install": "prebuild-install || node-gyp rebuild --release"}}`, conventionPrebuildInstall},
+		{`{"napi": {"binaryName": "swc"}}`, conventionNapiRS},
+		{`{"scripts": {"install": "node-gyp rebuild"}}`, ""},
+	}
+	for _, tt := range tests {
+		if got := prebuiltConvention(parsePrebuiltPackage(t, tt.pkg)); got != tt.want {
+			t.Errorf("prebuiltConvention(%s) = %q, want %q", tt.pkg, got, tt.want)
+		}
+	}
+}
+
+func TestPrebuiltURLs(t *testing.T) {
+	sqlite := parsePrebuiltPackage(t, `{"name": "sqlite3", "version": "5.1.6", "binary": {
+		"module_name": "node_sqlite3", "module_path": "./lib/binding/{node_abi}-{platform}-{arch}",
+		"host": "https://github.com/TryGhost/node-sqlite3/releases/download/", "remote_path": "v{version}",
+		"package_name": "{module_name}-v{version}-{node_abi}-{platform}-{libc}-{arch}.tar.gz"}}`)
+	tarball, modulePath, err := nodePreGypBinary(sqlite, testNode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/TryGhost/node-sqlite3/releases/download/v5.1.6/node_sqlite3-v5.1.6-node-v115-linux-glibc-x64.tar.gz"; tarball != want {
+		t.Errorf("node-pre-gyp URL = %s, want %s", tarball, want)
+	}
+	if modulePath != "./lib/binding/node-v115-linux-x64" {
+		t.Errorf("module path = %s", modulePath)
+	}
+
+	tarball, _, err = nodePreGypBinary(sqlite, testNode, "https://mirror.example.com/sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://mirror.example.com/sqlite3/v5.1.6/node_sqlite3-v5.1.6-node-v115-linux-glibc-x64.tar.gz"; tarball != want {
+		t.Errorf("mirrored node-pre-gyp URL = %s, want %s", tarball, want)
+	}
+
+	betterSqlite := parsePrebuiltPackage(t, `{"name": "better-sqlite3", "version": "9.4.0", "scripts": {"install": "prebuild-install || node-gyp rebuild --release"},
+		"repository": {"type": "git", "url": "git://github.com/WiseLibs/better-sqlite3.git"}}`)
+	tarball, err = prebuildInstallBinary(betterSqlite, nodeRuntime{ABI: "115", Platform: "linux", Arch: "arm64", Libc: "musl"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/WiseLibs/better-sqlite3/releases/download/v9.4.0/better-sqlite3-v9.4.0-node-v115-linuxmusl-arm64.tar.gz"; tarball != want {
+		t.Errorf("prebuild-install URL = %s, want %s", tarball, want)
+	}
+	tarball, err = prebuildInstallBinary(betterSqlite, nodeRuntime{ABI: "115", Platform: "linux", Arch: "x64"}, "https://mirror.example.com/better-sqlite3/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://mirror.example.com/better-sqlite3/v9.4.0/better-sqlite3-v9.4.0-node-v115-linux-x64.tar.gz"; tarball != want {
+		t.Errorf("mirrored prebuild-install URL = %s, want %s", tarball, want)
+	}
+
+	napi := parsePrebuiltPackage(t, `{"name": "@scope/native", "version": "1.0.0", "scripts": {"install": "prebuild-install -r napi"},
+		"repository": "github:scope/native", "binary": {"napi_versions": [3, 6, 10]}}`)
+	tarball, err = prebuildInstallBinary(napi, testNode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/scope/native/releases/download/v1.0.0/native-v1.0.0-napi-v6-linux-x64.tar.gz"; tarball != want {
+		t.Errorf("napi prebuild-install URL = %s, want %s", tarball, want)
+	}
+
+	unknown := parsePrebuiltPackage(t, `{"name": "x", "version": "1.0.0", "binary": {"module_name": "x", "host": "https://example.com", "package_name": "{napi_build_version}.tgz"}}`)
+	if _, _, err := nodePreGypBinary(unknown, testNode, ""); err == nil {
+		t.Error("nodePreGypBinary() guessed a URL for an unknown placeholder")
+	}
+}
+
+func TestPlacePrebuilt(t *testing.T) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	binary := []byte("\x7fELF binary")
+	tw.WriteHeader(&tar.Header{Name: "napi-v6/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "napi-v6/native.node", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(binary))})
+	tw.Write(binary)
+	tw.Close()
+	gzw.Close()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/mirror/native/v1.0.0/native-v1.0.0-node-v115-linux-x64.tar.gz" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	fetcher := &prebuiltFetcher{
+		client:   server.Client(),
+		cacheDir: t.TempDir(),
+		mirrors:  map[string]string{"https://downloads.example.com/": server.URL + "/mirror/"},
+		token: func(origin string) string {
+			if origin == server.URL {
+				return "secret"
+			}
+			return ""
+		},
+	}
+	pkg := parsePrebuiltPackage(t, `{"name": "native", "version": "1.0.0", "binary": {"module_name": "native", "module_path": "lib/binding",
+		"host": "https://downloads.example.com", "remote_path": "native/v{version}"}}`)
+
+	for _, wantCached := range []bool{false, true} {
+		pkgPath := t.TempDir()
+		placed, err := fetcher.placePrebuilt(context.Background(), pkgPath, pkg, conventionNodePreGyp, testNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if placed.FromCache != wantCached {
+			t.Errorf("FromCache = %v, want %v", placed.FromCache, wantCached)
+		}
+		// node-pre-gyp strips the tarball's top directory
+		if got, _ := os.ReadFile(filepath.Join(pkgPath, "lib", "binding", "native.node")); !bytes.Equal(got, binary) {
+			t.Errorf("native.node = %q", got)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want the second install to use the cache", requests)
+	}
+
+	// prebuild-install finds the tarball in the package's prebuilds
+	pkg = parsePrebuiltPackage(t, `{"name": "native", "version": "1.0.0", "scripts": {"install": "prebuild-install"}, "binary": {"host": "https://downloads.example.com", "remote_path": "native/v{version}", "package_name": "native-v{version}-node-v{abi}-{platform}{libc}-{arch}.tar.gz"}}`)
+	pkgPath := t.TempDir()
+	if _, err := fetcher.placePrebuilt(context.Background(), pkgPath, pkg, conventionPrebuildInstall, testNode); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(pkgPath, "prebuilds", "native-v1.0.0-node-v115-linux-x64.tar.gz")); !bytes.Equal(got, buf.Bytes()) {
+		t.Error("prebuild-install tarball wasn't placed in prebuilds")
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup makes a command the leader of a new process group, which
+// its children join
+func startProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup sends a signal to a process and everything in its group
+func signalProcessGroup(process *os.Process, sig os.Signal) {
+	if s, ok := sig.(syscall.Signal); ok && syscall.Kill(-process.Pid, s) == nil {
+		return
+	}
+	process.Signal(sig)
+}
+
+// killProcessGroup kills a process and everything in its group
+func killProcessGroup(process *os.Process) {
+	signalProcessGroup(process, syscall.SIGKILL)
+}
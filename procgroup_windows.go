@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// startProcessGroup does nothing on Windows, where process groups don't
+// carry children along
+func startProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup sends a signal to the process
+func signalProcessGroup(process *os.Process, sig os.Signal) {
+	process.Signal(sig)
+}
+
+// killProcessGroup kills the process. Its children are left to exit with it
+func killProcessGroup(process *os.Process) {
+	process.Kill()
+}
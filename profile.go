@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startProfiling starts the profiles requested through the environment and
+// returns a function that stops them and writes them out:
+//
+//	CPU_PROFILE  CPU profile, for go tool pprof
+//	MEM_PROFILE  heap profile taken when the command finishes
+//	TRACE        execution trace, for go tool trace
+func startProfiling() (func(), error) {
+	stops := []func(){}
+	stop := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if cpuProfilePath := os.Getenv("CPU_PROFILE"); cpuProfilePath != "" {
+		f, err := os.Create(cpuProfilePath)
+		if err != nil {
+			return stop, fmt.Errorf("error creating CPU profile file: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return stop, fmt.Errorf("error starting CPU profile: %v", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+		fmt.Printf("CPU profiling enabled, writing to: %s\n", cpuProfilePath)
+	}
+
+	if tracePath := os.Getenv("TRACE"); tracePath != "" {
+		f, err := os.Create(tracePath)
+		if err != nil {
+			return stop, fmt.Errorf("error creating trace file: %v", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return stop, fmt.Errorf("error starting trace: %v", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+		fmt.Printf("Tracing enabled, writing to: %s\n", tracePath)
+	}
+
+	if memProfilePath := os.Getenv("MEM_PROFILE"); memProfilePath != "" {
+		f, err := os.Create(memProfilePath)
+		if err != nil {
+			return stop, fmt.Errorf("error creating memory profile file: %v", err)
+		}
+		stops = append(stops, func() {
+			// Collect garbage first so the profile shows live memory
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				printError("writing memory profile: %v", err)
+			}
+			f.Close()
+		})
+		fmt.Printf("Memory profiling enabled, writing to: %s\n", memProfilePath)
+	}
+
+	return stop, nil
+}
+
+// Install phases reported by --timing, in the order they're printed
+const (
+	phaseResolution = "resolution"
+	phaseLinking    = "linking"
+	phaseDownload   = "download"
+	phaseExtraction = "extraction"
+	phaseBinSetup   = "bin setup"
+	phaseScripts    = "scripts"
+	phaseAudit      = "audit"
+)
+
+var timingPhases = []string{phaseResolution, phaseLinking, phaseDownload, phaseExtraction, phaseBinSetup, phaseScripts, phaseAudit}
+
+// Timings accumulates the time spent in each install phase. Downloads and
+// extractions overlap, so their totals are summed across packages rather than
+// wall-clock time. All methods are safe to call on a nil Timings
+type Timings struct {
+	mu     sync.Mutex
+	start  time.Time
+	phases map[string]time.Duration
+}
+
+func NewTimings() *Timings {
+	return &Timings{start: time.Now(), phases: make(map[string]time.Duration)}
+}
+
+// add records time spent in a phase
+func (t *Timings) add(phase string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases[phase] += d
+}
+
+// since records the time spent in a phase that began at start
+func (t *Timings) since(phase string, start time.Time) {
+	t.add(phase, time.Since(start))
+}
+
+// RenderTimings formats the phase breakdown printed by --timing
+func RenderTimings(t *Timings) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var builder strings.Builder
+	builder.WriteString("Timing:\n")
+	for _, phase := range timingPhases {
+		d, ok := t.phases[phase]
+		if !ok {
+			continue
+		}
+		note := ""
+		if phase == phaseDownload || phase == phaseExtraction {
+			note = " (summed across packages)"
+		}
+		builder.WriteString(fmt.Sprintf("  %-12s %s%s\n", phase, d.Round(time.Millisecond), note))
+	}
+	return builder.String()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderTimings(t *testing.T) {
+	timings := NewTimings()
+	timings.add(phaseDownload, 2*time.Second)
+	timings.add(phaseResolution, 1500*time.Millisecond)
+	timings.add(phaseDownload, time.Second)
+
+	want := "Timing:\n" +
+		"  resolution   1.5s\n" +
+		"  download     3s (summed across packages)\n"
+	if got := RenderTimings(timings); got != want {
+		t.Errorf("RenderTimings() = %q, want %q", got, want)
+	}
+
+	// Timing is off when there's no Timings
+	var disabled *Timings
+	disabled.add(phaseDownload, time.Second)
+	if got := RenderTimings(disabled); got != "" {
+		t.Errorf("RenderTimings(nil) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// provenanceFile sits next to package-lock.json and records where each
+// registry package came from and how it verified when caladan audit
+// signatures last ran. It's a sidecar so the lockfile stays readable by npm
+const provenanceFile = "caladan-provenance.json"
+
+// ProvenanceRecord is how a lockfile entry verified
+type ProvenanceRecord struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Integrity   string `json:"integrity,omitempty"`
+	Registry    string `json:"registry"`              // The registry that served it
+	PublishedAt string `json:"publishedAt,omitempty"` // As the registry reported it
+	Status      string `json:"status"`                // unsigned, signed, attested, or invalid
+	Error       string `json:"error,omitempty"`       // Why it's invalid
+	VerifiedAt  string `json:"verifiedAt"`            // RFC 3339
+}
+
+// LockfileProvenance is the provenance of a lockfile's registry packages,
+// by path
+type LockfileProvenance struct {
+	Packages map[string]ProvenanceRecord `json:"packages"`
+}
+
+// readProvenance reads a project's provenance records, empty when it has
+// none
+func readProvenance(directory string) (*LockfileProvenance, error) {
+	provenance := &LockfileProvenance{Packages: make(map[string]ProvenanceRecord)}
+	data, err := os.ReadFile(filepath.Join(directory, provenanceFile))
+	if os.IsNotExist(err) {
+		return provenance, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, provenance); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", provenanceFile, err)
+	}
+	if provenance.Packages == nil {
+		provenance.Packages = make(map[string]ProvenanceRecord)
+	}
+	return provenance, nil
+}
+
+// signatureStrength orders the statuses a package can verify with, so a
+// package that verifies weaker than it used to stands out. Invalid isn't
+// ranked, there's nothing to hold a later verification to
+func signatureStrength(status string) int {
+	switch status {
+	case signatureUnsigned:
+		return 1
+	case signatureSigned:
+		return 2
+	case signatureAttested:
+		return 3
+	}
+	return 0
+}
+
+// recordProvenance compares the report with the project's provenance
+// records and writes the new ones. A package whose lockfile entry hasn't
+// changed but now verifies weaker than it was recorded, an attestation or
+// signature that's gone missing, is marked invalid in the report, and its
+// old record is kept so it stays invalid until the entry changes. Records of
+// entries no longer in the lockfile are dropped
+func recordProvenance(directory string, packages []signedPackage, report *SignaturesReport, now time.Time) error {
+	previous, err := readProvenance(directory)
+	if err != nil {
+		return err
+	}
+	provenance := &LockfileProvenance{Packages: make(map[string]ProvenanceRecord)}
+	for i, pkg := range packages {
+		result := &report.Packages[i]
+		record := ProvenanceRecord{
+			Name:        pkg.name,
+			Version:     pkg.version,
+			Integrity:   pkg.integrity,
+			Registry:    pkg.registry,
+			PublishedAt: result.PublishedAt,
+			Status:      result.Status,
+			Error:       result.Error,
+			VerifiedAt:  now.UTC().Format(time.RFC3339),
+		}
+		for _, path := range pkg.paths {
+			old, ok := previous.Packages[path]
+			if ok && old.Version == pkg.version && old.Integrity == pkg.integrity && signatureStrength(result.Status) != 0 && signatureStrength(result.Status) < signatureStrength(old.Status) {
+				report.Counts[result.Status]--
+				report.Counts[signatureInvalid]++
+				result.Status = signatureInvalid
+				result.Error = fmt.Sprintf("was %s when verified on %s", old.Status, provenanceDate(old.VerifiedAt))
+				provenance.Packages[path] = old
+				continue
+			}
+			provenance.Packages[path] = record
+		}
+	}
+
+	out, err := json.MarshalIndent(provenance, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(directory, provenanceFile), append(out, '\n'), 0644)
+}
+
+// provenanceDate shortens a record's RFC 3339 time to its date
+func provenanceDate(date string) string {
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		return t.Format("2006-01-02")
+	}
+	return date
+}
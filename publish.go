@@ -0,0 +1,505 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tarballMtime is the modification time of every packed file, the same
+// fixed date npm uses so packing is reproducible
+var tarballMtime = time.Date(1985, time.October, 26, 8, 15, 0, 0, time.UTC)
+
+// PublishOptions configures caladan publish --workspaces
+type PublishOptions struct {
+	Tag           string // Dist tag to publish under, latest by default
+	DryRun        bool   // Pack and report without uploading
+	IgnoreScripts bool   // Don't run the pack and publish lifecycle scripts
+
+	registry    string
+	scriptShell string // From the root's config
+}
+
+// PublishResult is what happened to one workspace
+type PublishResult struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Status  string `json:"status"` // published, skipped, failed, or not attempted
+	Size    int    `json:"size,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// workspaceOrder sorts workspaces so each comes after the workspaces it
+// depends on through dependencies, optionalDependencies, or
+// peerDependencies. Ties are broken by name
+func workspaceOrder(workspaces []workspace) ([]workspace, error) {
+	byName := make(map[string]workspace)
+	for _, ws := range workspaces {
+		byName[ws.Name] = ws
+	}
+
+	ordered := []workspace{}
+	state := make(map[string]int) // 1 while visiting, 2 once ordered
+	var visit func(ws workspace, chain []string) error
+	visit = func(ws workspace, chain []string) error {
+		switch state[ws.Name] {
+		case 1:
+			return fmt.Errorf("workspace dependency cycle: %s", strings.Join(append(chain, ws.Name), " -> "))
+		case 2:
+			return nil
+		}
+		state[ws.Name] = 1
+		deps := []string{}
+		for _, section := range dependencySections {
+			if section == "devDependencies" {
+				continue
+			}
+			for dep := range ws.sectionDeps(section) {
+				if _, ok := byName[dep]; ok && dep != ws.Name {
+					deps = append(deps, dep)
+				}
+			}
+		}
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(byName[dep], append(chain, ws.Name)); err != nil {
+				return err
+			}
+		}
+		state[ws.Name] = 2
+		ordered = append(ordered, ws)
+		return nil
+	}
+	for _, ws := range workspaces {
+		if err := visit(ws, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// concreteRange turns a workspace: range into what's published: * becomes
+// the exact version, ^ and ~ prefix it, and anything else is used as is
+func concreteRange(workspaceRange, version string) string {
+	switch spec := strings.TrimPrefix(workspaceRange, "workspace:"); spec {
+	case "*", "":
+		return version
+	case "^", "~":
+		return spec + version
+	default:
+		return spec
+	}
+}
+
+// publishManifest rewrites a workspace's package.json for publishing,
+// replacing workspace: ranges with the versions they resolve to and
+// catalog: ranges with the ranges the root's catalogs pin
+func publishManifest(data []byte, ws workspace, versions map[string]string, rootCatalogs catalogs) ([]byte, error) {
+	for _, section := range dependencySections {
+		for dep, depRange := range ws.sectionDeps(section) {
+			if strings.HasPrefix(depRange, "catalog:") {
+				pinned, err := rootCatalogs.catalogRange(dep, depRange)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", ws.Name, err)
+				}
+				if data, _, err = editJSONString(data, []string{section, dep}, pinned); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if !strings.HasPrefix(depRange, "workspace:") {
+				continue
+			}
+			version, ok := versions[dep]
+			if !ok {
+				return nil, fmt.Errorf("%s depends on %s through %s, which isn't a workspace", ws.Name, dep, depRange)
+			}
+			var err error
+			if data, _, err = editJSONString(data, []string{section, dep}, concreteRange(depRange, version)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// packWorkspace builds a package's tarball, with the given package.json in
+// place of the one on disk, and returns the files it packed
+func packWorkspace(dir string, manifest []byte) ([]byte, []string, error) {
+	list, err := packFiles(dir, manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Everything that could vary between machines or runs is pinned, so the
+	// same files always pack to the same bytes and integrity: entries go in
+	// sorted order with fixed times, modes, and owners, and the gzip header
+	// carries no name, time, or OS
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+	if err != nil {
+		return nil, nil, err
+	}
+	gz.Header = gzip.Header{OS: 255}
+	tw := tar.NewWriter(gz)
+	sort.Strings(list)
+	for _, rel := range list {
+		data := manifest
+		if rel != "package.json" {
+			if data, err = os.ReadFile(filepath.Join(dir, rel)); err != nil {
+				return nil, nil, err
+			}
+		}
+		mode := int64(0644)
+		if info, err := os.Stat(filepath.Join(dir, rel)); err == nil && info.Mode()&0111 != 0 {
+			mode = 0755
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "package/" + rel,
+			Mode:     mode,
+			Size:     int64(len(data)),
+			ModTime:  tarballMtime,
+			Format:   tar.FormatPAX, // Long names get a PAX record, never a GNU one
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), list, nil
+}
+
+// PackOptions configures caladan pack
+type PackOptions struct {
+	DryRun        bool   // List what would be packed without writing the tarball
+	Destination   string // Directory to write the tarball to, the package's by default
+	IgnoreScripts bool   // Don't run prepack, prepare, and postpack scripts
+}
+
+// tarballName is the file npm pack writes, with a scope's @ dropped and its
+// slash replaced
+func tarballName(name, version string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(name, "@"), "/", "-") + "-" + version + ".tgz"
+}
+
+// Pack builds the tarball a package would be published as, printing its
+// contents. With DryRun nothing is written
+func Pack(directory string, opts PackOptions) (string, error) {
+	config, err := loadConfig(directory)
+	if err != nil {
+		return "", err
+	}
+	configEnv := npmConfigEnv(InstallOptions{ScriptShell: config.scriptShell("")})
+	if !opts.IgnoreScripts {
+		if err := runLifecycle(directory, prepackScripts, configEnv, 0); err != nil {
+			return "", err
+		}
+	}
+	manifest, err := os.ReadFile(filepath.Join(directory, "package.json"))
+	if err != nil {
+		return "", err
+	}
+	var pkg struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(manifest, &pkg); err != nil {
+		return "", fmt.Errorf("error parsing package.json: %v", err)
+	}
+	if pkg.Name == "" || pkg.Version == "" {
+		return "", fmt.Errorf("package.json needs a name and version to be packed")
+	}
+
+	tarball, files, err := packWorkspace(directory, manifest)
+	if err != nil {
+		return "", fmt.Errorf("error packing: %v", err)
+	}
+	filename := tarballName(pkg.Name, pkg.Version)
+	fmt.Print(RenderPackContents(directory, files, pkg.Name, pkg.Version, filename, tarball))
+
+	destination := opts.Destination
+	if destination == "" {
+		destination = directory
+	}
+	path := filepath.Join(destination, filename)
+	if !opts.DryRun {
+		if err := os.MkdirAll(destination, 0755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path, tarball, 0644); err != nil {
+			return "", err
+		}
+	}
+	if !opts.IgnoreScripts {
+		if err := runLifecycle(directory, postpackScripts, configEnv, 0); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// RenderPackContents lists a tarball's files with their sizes, then its
+// details, the way npm pack does
+func RenderPackContents(dir string, files []string, name, version, filename string, tarball []byte) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("Tarball contents of %s:\n", colorPackage(name+"@"+version)))
+	for _, file := range files {
+		size := int64(0)
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file))); err == nil {
+			size = info.Size()
+		}
+		builder.WriteString(fmt.Sprintf("  %-10s %s\n", formatBytes(size), file))
+	}
+	sha512sum := sha512.Sum512(tarball)
+	sha1sum := sha1.Sum(tarball)
+	builder.WriteString("Tarball details:\n")
+	builder.WriteString(fmt.Sprintf("  filename:      %s\n", filename))
+	builder.WriteString(fmt.Sprintf("  package size:  %s\n", formatBytes(int64(len(tarball)))))
+	builder.WriteString(fmt.Sprintf("  unpacked size: %s\n", formatBytes(packedSize(dir, files))))
+	builder.WriteString(fmt.Sprintf("  shasum:        %s\n", hex.EncodeToString(sha1sum[:])))
+	builder.WriteString(fmt.Sprintf("  integrity:     %s\n", "sha512-"+base64.StdEncoding.EncodeToString(sha512sum[:])))
+	builder.WriteString(fmt.Sprintf("  total files:   %d\n", len(files)))
+	return builder.String()
+}
+
+// publishedVersions returns the versions of a package the registry has, none
+// when it's never been published
+func publishedVersions(ctx context.Context, client *RegistryClient, name string) (map[string]json.RawMessage, error) {
+	var packument struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	err := client.send(ctx, "GET", packumentPath(name), nil, &packument)
+	var registryErr *RegistryError
+	if errors.As(err, &registryErr) && registryErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return packument.Versions, nil
+}
+
+// uploadPackage publishes a tarball the way npm publish does, a PUT of the
+// version's manifest with the tarball attached
+func uploadPackage(ctx context.Context, client *RegistryClient, tag string, manifest, tarball []byte) error {
+	var version map[string]interface{}
+	if err := json.Unmarshal(manifest, &version); err != nil {
+		return err
+	}
+	name, _ := version["name"].(string)
+	number, _ := version["version"].(string)
+	sha512sum := sha512.Sum512(tarball)
+	sha1sum := sha1.Sum(tarball)
+	filename := name + "-" + number + ".tgz"
+	unscoped := filename
+	if i := strings.LastIndex(filename, "/"); i >= 0 {
+		unscoped = filename[i+1:]
+	}
+	version["_id"] = name + "@" + number
+	version["dist"] = map[string]string{
+		"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sha512sum[:]),
+		"shasum":    hex.EncodeToString(sha1sum[:]),
+		"tarball":   client.registry + "/" + name + "/-/" + unscoped,
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"_id":       name,
+		"name":      name,
+		"dist-tags": map[string]string{tag: number},
+		"versions":  map[string]interface{}{number: version},
+		"_attachments": map[string]interface{}{
+			filename: map[string]interface{}{
+				"content_type": "application/octet-stream",
+				"data":         base64.StdEncoding.EncodeToString(tarball),
+				"length":       len(tarball),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return client.publish(ctx, name, body)
+}
+
+// PublishWorkspaces publishes every non-private workspace whose version
+// isn't on the registry yet, dependencies first. Publishing stops at the
+// first failure so nothing is published ahead of a dependency it needs
+func PublishWorkspaces(directory string, opts PublishOptions) ([]PublishResult, error) {
+	if opts.Tag == "" {
+		opts.Tag = "latest"
+	}
+	registry := opts.registry
+	if registry == "" {
+		registry = npmRegistryURL
+	}
+	config, err := loadConfig(directory)
+	if err != nil {
+		return nil, err
+	}
+	opts.scriptShell = config.scriptShell("")
+	token := ""
+	if !opts.DryRun {
+		if token, err = registryToken(config, registry); err != nil {
+			return nil, err
+		}
+	}
+
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return nil, err
+	}
+	rootManifest, err := os.ReadFile(filepath.Join(directory, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	rootCatalogs, err := parseCatalogs(rootManifest)
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := workspaceOrder(workspaces)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]string)
+	for _, ws := range workspaces {
+		versions[ws.Name] = ws.Version
+	}
+
+	ctx := context.Background()
+	client := newRegistryClient(&http.Client{Timeout: 2 * time.Minute}, registry, token)
+	results := []PublishResult{}
+	failed := false
+	for _, ws := range ordered {
+		if ws.Private {
+			continue
+		}
+		result := PublishResult{Name: ws.Name, Version: ws.Version}
+		if failed {
+			result.Status = "not attempted"
+			results = append(results, result)
+			continue
+		}
+		if err := publishWorkspace(ctx, client, directory, ws, versions, rootCatalogs, opts, &result); err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			failed = true
+		}
+		results = append(results, result)
+	}
+
+	if failed {
+		return results, fmt.Errorf("publishing failed, packages after the failure weren't published")
+	}
+	return results, nil
+}
+
+func publishWorkspace(ctx context.Context, client *RegistryClient, directory string, ws workspace, versions map[string]string, rootCatalogs catalogs, opts PublishOptions, result *PublishResult) error {
+	published, err := publishedVersions(ctx, client, ws.Name)
+	if err != nil {
+		return err
+	}
+	if _, ok := published[ws.Version]; ok {
+		result.Status = "skipped"
+		return nil
+	}
+
+	// prepack and friends may build the files being packed, so the
+	// manifest is read after they've run
+	dir := filepath.Join(directory, ws.Dir)
+	configEnv := npmConfigEnv(InstallOptions{ScriptShell: opts.scriptShell})
+	rootBinDir := filepath.Join(directory, "node_modules", ".bin")
+	if !opts.IgnoreScripts {
+		if err := runLifecycle(dir, append(prepublishScripts, prepackScripts...), configEnv, 0, rootBinDir); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return err
+	}
+	manifest, err := publishManifest(data, ws, versions, rootCatalogs)
+	if err != nil {
+		return err
+	}
+	tarball, _, err := packWorkspace(dir, manifest)
+	if err != nil {
+		return fmt.Errorf("error packing: %v", err)
+	}
+	result.Size = len(tarball)
+	if !opts.IgnoreScripts {
+		if err := runLifecycle(dir, postpackScripts, configEnv, 0, rootBinDir); err != nil {
+			return err
+		}
+	}
+
+	if opts.DryRun {
+		result.Status = "published"
+		return nil
+	}
+	fmt.Printf("Publishing %s@%s\n", ws.Name, ws.Version)
+	if err := uploadPackage(ctx, client, opts.Tag, manifest, tarball); err != nil {
+		return err
+	}
+	result.Status = "published"
+	if !opts.IgnoreScripts {
+		// It's out, so a failing postpublish is only worth a warning
+		if err := runLifecycle(dir, publishScripts, configEnv, 0, rootBinDir); err != nil {
+			printWarning("%s was published but %v", ws.Name, err)
+		}
+	}
+	return nil
+}
+
+// RenderPublishSummary lists each workspace's outcome and totals them up
+func RenderPublishSummary(results []PublishResult, dryRun bool) string {
+	var builder strings.Builder
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+		line := fmt.Sprintf("  %s %s", colorPackage(result.Name+"@"+result.Version), result.Status)
+		switch result.Status {
+		case "published":
+			if dryRun {
+				line = fmt.Sprintf("  %s would be published", colorPackage(result.Name+"@"+result.Version))
+			}
+			line += " " + colorDim(formatBytes(int64(result.Size)))
+		case "failed":
+			line = fmt.Sprintf("  %s %s: %s", colorPackage(result.Name+"@"+result.Version), colorError("failed"), result.Error)
+		}
+		builder.WriteString(line + "\n")
+	}
+	verb := "Published"
+	if dryRun {
+		verb = "Would publish"
+	}
+	summary := fmt.Sprintf("%s %d, skipped %d already published", verb, counts["published"], counts["skipped"])
+	if n := counts["failed"] + counts["not attempted"]; n > 0 {
+		summary += fmt.Sprintf(", %s", colorError(fmt.Sprintf("%d not published", n)))
+	}
+	builder.WriteString(summary + "\n")
+	return builder.String()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPublishWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"private": true, "workspaces": ["packages/*"]}`)
+	writeTestFile(t, filepath.Join(dir, "packages/a/package.json"), `{"name": "@corp/a", "version": "1.0.0"}`)
+	writeTestFile(t, filepath.Join(dir, "packages/b/package.json"), `{"name": "b", "version": "2.0.0", "files": ["dist"], "dependencies": {"@corp/a": "workspace:^"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages/b/dist/index.js"), "module.exports = 1\n")
+	writeTestFile(t, filepath.Join(dir, "packages/b/src/index.ts"), "export default 1\n")
+	writeTestFile(t, filepath.Join(dir, "packages/b/README.md"), "# b\n")
+	writeTestFile(t, filepath.Join(dir, "packages/c/package.json"), `{"name": "c", "version": "0.1.0", "dependencies": {"b": "workspace:*"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages/d/package.json"), `{"name": "d", "version": "0.1.0", "private": true}`)
+
+	var mu sync.Mutex
+	published := []string{}
+	tarballs := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if r.URL.Path == "/@corp/a" {
+				w.Write([]byte(`{"versions": {"1.0.0": {}}}`))
+				return
+			}
+			http.NotFound(w, r)
+		case "PUT":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var body struct {
+				Name        string `json:"name"`
+				Attachments map[string]struct {
+					Data string `json:"data"`
+				} `json:"_attachments"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			published = append(published, body.Name)
+			for _, attachment := range body.Attachments {
+				tarballs[body.Name], _ = base64.StdEncoding.DecodeString(attachment.Data)
+			}
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("NPM_TOKEN", "token")
+	results, err := PublishWorkspaces(dir, PublishOptions{registry: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(published, " "); got != "b c" {
+		t.Errorf("published %s, want b then c", got)
+	}
+	statuses := []string{}
+	for _, result := range results {
+		statuses = append(statuses, result.Name+":"+result.Status)
+	}
+	if got := strings.Join(statuses, " "); got != "@corp/a:skipped b:published c:published" {
+		t.Errorf("results = %s", got)
+	}
+	if summary := RenderPublishSummary(results, false); !strings.Contains(summary, "Published 2, skipped 1 already published") {
+		t.Errorf("RenderPublishSummary() = %q", summary)
+	}
+
+	files := readTestTarball(t, tarballs["b"])
+	if _, ok := files["package/src/index.ts"]; ok {
+		t.Errorf("b's tarball has files outside its files list: %v", files)
+	}
+	if _, ok := files["package/README.md"]; !ok {
+		t.Errorf("b's tarball is missing its README: %v", files)
+	}
+	if files["package/dist/index.js"] != "module.exports = 1\n" {
+		t.Errorf("b's tarball is missing dist: %v", files)
+	}
+	if manifest := files["package/package.json"]; !strings.Contains(manifest, `"@corp/a": "^1.0.0"`) {
+		t.Errorf("b's packed package.json = %s", manifest)
+	}
+	if manifest := readTestTarball(t, tarballs["c"])["package/package.json"]; !strings.Contains(manifest, `"b": "2.0.0"`) {
+		t.Errorf("c's packed package.json = %s", manifest)
+	}
+
+	// A failure stops dependents from being published
+	t.Setenv("NPM_TOKEN", "wrong")
+	results, err = PublishWorkspaces(dir, PublishOptions{registry: server.URL})
+	if err == nil || results[1].Status != "failed" || results[2].Status != "not attempted" {
+		t.Errorf("PublishWorkspaces() = %+v, %v", results, err)
+	}
+}
+
+func TestWorkspaceOrderCycle(t *testing.T) {
+	workspaces := []workspace{
+		{Name: "a", manifest: PackageInfo{Dependencies: map[string]string{"b": "1.0.0"}}},
+		{Name: "b", manifest: PackageInfo{PeerDependencies: map[string]string{"a": "1.0.0"}}},
+	}
+	if _, err := workspaceOrder(workspaces); err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Errorf("workspaceOrder() error = %v, want a cycle", err)
+	}
+}
+
+func readTestTarball(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+}
+
+func TestPublishLifecycleScripts(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"private": true, "workspaces": ["packages/*"]}`)
+	writeTestFile(t, filepath.Join(dir, "packages/a/package.json"), `{"name": "a", "version": "1.0.0", "files": ["dist"], "scripts": {
+		"prepublishOnly": "echo prepublishOnly >> ../../log",
+		"prepack": "echo prepack >> ../../log && mkdir -p dist && echo built > dist/index.js",
+		"prepare": "echo prepare >> ../../log",
+		"postpack": "echo postpack >> ../../log",
+		"publish": "echo publish >> ../../log",
+		"postpublish": "echo postpublish >> ../../log"
+	}}`)
+
+	var tarball []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			Attachments map[string]struct {
+				Data string `json:"data"`
+			} `json:"_attachments"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		tarball, _ = base64.StdEncoding.DecodeString(body.Attachments["a-1.0.0.tgz"].Data)
+	}))
+	defer server.Close()
+
+	t.Setenv("NPM_TOKEN", "token")
+	if _, err := PublishWorkspaces(dir, PublishOptions{registry: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	log, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(log)); strings.Join(got, " ") != "prepublishOnly prepack prepare postpack publish postpublish" {
+		t.Errorf("scripts ran in order %v", got)
+	}
+	if files := readTestTarball(t, tarball); files["package/dist/index.js"] != "built\n" {
+		t.Errorf("tarball is missing what prepack built: %v", files)
+	}
+
+	// A failing prepack stops the publish
+	writeTestFile(t, filepath.Join(dir, "packages/a/package.json"), `{"name": "a", "version": "1.0.1", "scripts": {"prepack": "exit 3"}}`)
+	results, err := PublishWorkspaces(dir, PublishOptions{registry: server.URL})
+	if err == nil || len(results) != 1 || !strings.Contains(results[0].Error, "prepack script failed with exit code 3") {
+		t.Errorf("PublishWorkspaces() = %+v, %v", results, err)
+	}
+	if _, err := PublishWorkspaces(dir, PublishOptions{registry: server.URL, IgnoreScripts: true}); err != nil {
+		t.Errorf("PublishWorkspaces() with IgnoreScripts error = %v", err)
+	}
+}
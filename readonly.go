@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// skipProtection reports whether a directory under node_modules holds files
+// that are meant to change after install: bins, tool caches, and caladan's
+// own state
+func skipProtection(path string, entry fs.DirEntry) bool {
+	if filepath.Base(filepath.Dir(path)) != "node_modules" {
+		return false
+	}
+	switch entry.Name() {
+	case ".bin", ".cache", stateDirName:
+		return true
+	}
+	return false
+}
+
+// walkPackageFiles calls fn for each regular file of the packages in
+// nodeModulesPath. Symlinks aren't followed, so linked packages are left
+// alone
+func walkPackageFiles(nodeModulesPath string, fn func(path string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(nodeModulesPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != nodeModulesPath && skipProtection(path, entry) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// npm's hidden lockfile is rewritten by every install
+		if !entry.Type().IsRegular() || filepath.Dir(path) == nodeModulesPath {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// protectPackages makes the files of the packages in nodeModulesPath
+// read-only, so an accidental edit fails instead of going unnoticed.
+// Directories stay writable, so the next install can still replace them. It
+// returns how many files it changed
+func protectPackages(nodeModulesPath string) (int, error) {
+	protected := 0
+	err := walkPackageFiles(nodeModulesPath, func(path string, info fs.FileInfo) error {
+		if info.Mode().Perm()&0222 == 0 {
+			return nil
+		}
+		protected++
+		return os.Chmod(path, info.Mode().Perm()&^0222)
+	})
+	return protected, err
+}
+
+// unprotectedFiles lists the files of a read-only install that have been
+// made writable since, relative to nodeModulesPath
+func unprotectedFiles(nodeModulesPath string) ([]string, error) {
+	var files []string
+	err := walkPackageFiles(nodeModulesPath, func(path string, info fs.FileInfo) error {
+		if info.Mode().Perm()&0222 != 0 {
+			rel, _ := filepath.Rel(nodeModulesPath, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// checkReadOnlyInstall warns about the files of a read-only node_modules
+// that were made writable, and so may have been edited, since it was
+// installed. The install about to run replaces them
+func checkReadOnlyInstall(nodeModulesPath string) {
+	state, err := readInstallState(nodeModulesPath)
+	if err != nil || !state.ReadOnly {
+		return
+	}
+	files, err := unprotectedFiles(nodeModulesPath)
+	if err != nil {
+		printWarning("couldn't check node_modules is still read-only: %v", err)
+		return
+	}
+	if len(files) == 0 {
+		return
+	}
+	printWarning("%d files in the read-only node_modules were made writable and may have been edited, this install replaces them:", len(files))
+	for i, file := range files {
+		if i == 10 {
+			printWarning("  and %d more", len(files)-i)
+			break
+		}
+		printWarning("  %s", file)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProtectPackages(t *testing.T) {
+	nodeModules := filepath.Join(t.TempDir(), "node_modules")
+	writeTestFile(t, filepath.Join(nodeModules, "a", "index.js"), "")
+	writeTestFile(t, filepath.Join(nodeModules, "a", "node_modules", "b", "index.js"), "")
+	writeTestFile(t, filepath.Join(nodeModules, ".cache", "babel", "cache.json"), "")
+	writeTestFile(t, filepath.Join(nodeModules, stateDirName, stateFileName), "")
+	writeTestFile(t, filepath.Join(nodeModules, hiddenLockfileName), "")
+
+	protected, err := protectPackages(nodeModules)
+	if err != nil {
+		t.Fatalf("protectPackages() error = %v", err)
+	}
+	if protected != 2 {
+		t.Errorf("protectPackages() = %d, want the 2 package files", protected)
+	}
+	for _, path := range []string{"a/index.js", "a/node_modules/b/index.js"} {
+		if info, err := os.Stat(filepath.Join(nodeModules, path)); err != nil || info.Mode().Perm()&0222 != 0 {
+			t.Errorf("%s is still writable", path)
+		}
+	}
+	for _, path := range []string{".cache/babel/cache.json", stateDirName + "/" + stateFileName, hiddenLockfileName} {
+		if info, err := os.Stat(filepath.Join(nodeModules, path)); err != nil || info.Mode().Perm()&0200 == 0 {
+			t.Errorf("%s was made read-only", path)
+		}
+	}
+
+	if files, err := unprotectedFiles(nodeModules); err != nil || len(files) != 0 {
+		t.Errorf("unprotectedFiles() = %v, %v, want none", files, err)
+	}
+	if err := os.Chmod(filepath.Join(nodeModules, "a", "index.js"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := unprotectedFiles(nodeModules); err != nil || !reflect.DeepEqual(files, []string{"a/index.js"}) {
+		t.Errorf("unprotectedFiles() = %v, %v, want a/index.js", files, err)
+	}
+
+	// The next install can still replace a read-only install
+	if err := os.RemoveAll(nodeModules); err != nil {
+		t.Errorf("removing a read-only node_modules: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// recursiveConcurrency is how many projects install --recursive installs at
+// once. Each install already downloads and extracts concurrently, so a few
+// are enough to keep the network busy between one project's phases
+const recursiveConcurrency = 4
+
+// findProjects returns the directories under root that have a package.json
+// and a package-lock.json, sorted. node_modules and hidden directories are
+// skipped, and so are the members of any workspaces found, since their root
+// installs them
+func findProjects(root string) ([]string, error) {
+	var projects []string
+	members := make(map[string]bool)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != root && (entry.Name() == "node_modules" || strings.HasPrefix(entry.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		if members[path] {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(path, "package.json")); err != nil {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(path, "package-lock.json")); err != nil {
+			return nil
+		}
+		projects = append(projects, path)
+
+		// Most projects have no workspaces, which findWorkspaces reports as
+		// an error
+		workspaces, _ := findWorkspaces(path)
+		for _, ws := range workspaces {
+			members[filepath.Join(path, ws.Dir)] = true
+		}
+		return nil
+	})
+	sort.Strings(projects)
+	return projects, err
+}
+
+// InstallRecursive installs every project under directory, a few at a time.
+// They share the store, the metadata cache, and one HTTP transport, so
+// connections and DNS lookups are reused across projects. A project that
+// fails doesn't stop the others
+func InstallRecursive(directory string, opts InstallOptions) error {
+	if opts.JSON || opts.MetricsFile != "" {
+		return fmt.Errorf("--json and --metrics-file describe one install, they can't be used with --recursive")
+	}
+	projects, err := findProjects(directory)
+	if err != nil {
+		return err
+	}
+	if len(projects) == 0 {
+		return fmt.Errorf("no projects with a package.json and package-lock.json under %s", directory)
+	}
+	fmt.Printf("Installing %d projects under %s\n", len(projects), directory)
+
+	// The transport is created from the config of the directory it's run
+	// in, each project's mirrors are layered on top of it
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	dns, err := newDNSCache(config.DNS)
+	if err != nil {
+		return err
+	}
+	opts.transport = registryTransport(dns)
+	if opts.HTTP3 {
+		opts.transport = newHTTP3Transport(dns, opts.transport)
+	}
+
+	// Installs run at once, so they can't share the terminal to ask
+	// questions, and print hints instead
+	opts.noPrompt = true
+
+	failures := make(map[string]error)
+	var failuresLock sync.Mutex
+	var g errgroup.Group
+	g.SetLimit(recursiveConcurrency)
+	for _, project := range projects {
+		project := project
+		g.Go(func() error {
+			if err := Install(project, opts); err != nil {
+				failuresLock.Lock()
+				failures[project] = err
+				failuresLock.Unlock()
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	fmt.Print(RenderRecursiveInstall(directory, projects, failures))
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d projects failed to install", len(failures), len(projects))
+	}
+	return nil
+}
+
+// RenderRecursiveInstall lists each project of a recursive install and
+// whether it installed
+func RenderRecursiveInstall(directory string, projects []string, failures map[string]error) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("\nInstalled %d of %d projects:\n", len(projects)-len(failures), len(projects)))
+	for _, project := range projects {
+		name := relativeTo(directory, project)
+		if err, failed := failures[project]; failed {
+			builder.WriteString(fmt.Sprintf("  %s %s: %v\n", colorError("failed"), name, err))
+		} else {
+			builder.WriteString(fmt.Sprintf("  %s %s\n", colorSuccess("ok"), name))
+		}
+	}
+	return builder.String()
+}
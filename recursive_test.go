@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindProjects(t *testing.T) {
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		"api/package.json":                       `{"name": "api"}`,
+		"api/package-lock.json":                  `{}`,
+		"api/node_modules/dep/package.json":      `{"name": "dep"}`,
+		"api/node_modules/dep/package-lock.json": `{}`,
+		"web/package.json":                       `{"name": "web", "workspaces": ["packages/*"]}`,
+		"web/package-lock.json":                  `{}`,
+		"web/packages/ui/package.json":           `{"name": "ui"}`,
+		"web/packages/ui/package-lock.json":      `{}`,
+		"scratch/package.json":                   `{"name": "scratch"}`,
+		".cache/tool/package.json":               `{"name": "tool"}`,
+		".cache/tool/package-lock.json":          `{}`,
+	} {
+		writeTestFile(t, filepath.Join(root, path), content)
+	}
+
+	projects, err := findProjects(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "api"), filepath.Join(root, "web")}
+	if !reflect.DeepEqual(projects, want) {
+		t.Errorf("findProjects() = %v, want %v", projects, want)
+	}
+}
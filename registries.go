@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultRegistryKey is the key of registries for unscoped packages, and
+// scoped ones whose scope has no registry of its own
+const defaultRegistryKey = "default"
+
+// Registries maps scopes ("@corp") and "default" to the registries their
+// tarballs are fetched from, for lockfiles written against another one
+type Registries map[string]string
+
+// validate checks that every registry is an http(s) URL and every key a
+// scope or default
+func (r Registries) validate() error {
+	for key, registry := range r {
+		if key != defaultRegistryKey && !strings.HasPrefix(key, "@") {
+			return fmt.Errorf("registries are keyed by scope (like @corp) or default, not %s", key)
+		}
+		u, err := url.Parse(registry)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid registry %q for %s", registry, key)
+		}
+	}
+	return nil
+}
+
+// registryFor returns the registry configured for a package, "" when
+// there isn't one
+func (r Registries) registryFor(name string) string {
+	if scope, _, ok := strings.Cut(name, "/"); ok && strings.HasPrefix(scope, "@") {
+		if registry, ok := r[scope]; ok {
+			return registry
+		}
+	}
+	return r[defaultRegistryKey]
+}
+
+// rewriteResolved moves a tarball URL to the package's configured registry.
+// Only registry tarballs, <registry>/<name>/-/<file>, are moved: git, file,
+// and other URLs are returned as they are
+func (r Registries) rewriteResolved(name, resolved string) string {
+	registry := r.registryFor(name)
+	if registry == "" {
+		return resolved
+	}
+	u, err := url.Parse(resolved)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return resolved
+	}
+	i := strings.Index(u.Path, "/"+name+"/-/")
+	if i < 0 {
+		return resolved
+	}
+	return strings.TrimSuffix(registry, "/") + u.Path[i:]
+}
+
+// tarballRegistry returns the registry a tarball URL, <registry>/<name>/-/<file>,
+// is on, empty when it isn't a registry tarball
+func tarballRegistry(name, resolved string) string {
+	u, err := url.Parse(resolved)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	i := strings.Index(u.Path, "/"+name+"/-/")
+	if i < 0 {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: u.Path[:i]}).String()
+}
+
+// resolvedName returns the name a lockfile entry is published under, which
+// for aliases is its name field rather than its path
+func resolvedName(path string, pkg PackageInfo) string {
+	if pkg.Name != "" {
+		return pkg.Name
+	}
+	return packageNameFromPath(path)
+}
+
+// RewriteLockfileOptions configures rewrite-lockfile
+type RewriteLockfileOptions struct {
+	DryRun bool // Print what would change without writing the lockfile
+}
+
+// RewriteLockfile moves the resolved URLs of a project's lockfile to the
+// registries its config names, keeping every other field as it was
+func RewriteLockfile(directory string, opts RewriteLockfileOptions) error {
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	if len(config.Registries) == 0 {
+		return fmt.Errorf("no registries are configured in package.json")
+	}
+	if err := config.Registries.validate(); err != nil {
+		return err
+	}
+
+	lockfilePath := filepath.Join(directory, "package-lock.json")
+	packageLock, err := readLockFile(lockfilePath)
+	if err != nil {
+		return fmt.Errorf("error reading lockfile: %v", err)
+	}
+	paths := make([]string, 0, len(packageLock.Packages))
+	for path := range packageLock.Packages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	rewritten := 0
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		var pkg PackageInfo
+		if err := json.Unmarshal(packageLock.Packages[path], &pkg); err != nil {
+			return fmt.Errorf("error parsing lockfile entry %s: %v", path, err)
+		}
+		resolved := config.Registries.rewriteResolved(resolvedName(path, pkg), pkg.Resolved)
+		if resolved == pkg.Resolved {
+			continue
+		}
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(packageLock.Packages[path], &entry); err != nil {
+			return fmt.Errorf("error parsing lockfile entry %s: %v", path, err)
+		}
+		if entry["resolved"], err = json.Marshal(resolved); err != nil {
+			return err
+		}
+		if packageLock.Packages[path], err = json.Marshal(entry); err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", colorPackage(path), colorDim(resolved))
+		rewritten++
+	}
+
+	if rewritten == 0 {
+		fmt.Println("Every resolved URL already points at its configured registry")
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Printf("Would rewrite %d resolved URLs in %s\n", rewritten, lockfilePath)
+		return nil
+	}
+	if err := writeLockFile(lockfilePath, packageLock); err != nil {
+		return fmt.Errorf("error writing lockfile: %v", err)
+	}
+	fmt.Printf("Rewrote %d resolved URLs in %s\n", rewritten, lockfilePath)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewriteResolved(t *testing.T) {
+	registries := Registries{
+		"default": "https://npm.internal/registry/",
+		"@corp":   "https://corp.internal/npm",
+	}
+	for _, tt := range []struct {
+		name, resolved, want string
+	}{
+		{"lodash", "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz", "https://npm.internal/registry/lodash/-/lodash-4.17.21.tgz"},
+		{"@corp/ui", "https://registry.npmjs.org/@corp/ui/-/ui-1.0.0.tgz", "https://corp.internal/npm/@corp/ui/-/ui-1.0.0.tgz"},
+		// Scopes without a registry of their own use the default
+		{"@babel/core", "https://registry.npmjs.org/@babel/core/-/core-7.24.0.tgz", "https://npm.internal/registry/@babel/core/-/core-7.24.0.tgz"},
+		// Anything that isn't a registry tarball is left alone
+		{"dep", "git+ssh://git@github.com/owner/dep.git#abc123", "git+ssh://git@github.com/owner/dep.git#abc123"},
+		{"dep", "https://codeload.github.com/owner/dep/tar.gz/abc123", "https://codeload.github.com/owner/dep/tar.gz/abc123"},
+		{"local", "file:../local", "file:../local"},
+	} {
+		if got := registries.rewriteResolved(tt.name, tt.resolved); got != tt.want {
+			t.Errorf("rewriteResolved(%s, %s) = %s, want %s", tt.name, tt.resolved, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, resolved, want string
+	}{
+		{"lodash", "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz", "https://registry.npmjs.org"},
+		{"@corp/ui", "https://corp.internal/npm/@corp/ui/-/ui-1.0.0.tgz", "https://corp.internal/npm"},
+		{"dep", "https://codeload.github.com/owner/dep/tar.gz/abc123", ""},
+		{"local", "file:../local", ""},
+	} {
+		if got := tarballRegistry(tt.name, tt.resolved); got != tt.want {
+			t.Errorf("tarballRegistry(%s, %s) = %q, want %q", tt.name, tt.resolved, got, tt.want)
+		}
+	}
+
+	if got := (Registries{"@corp": "https://corp.internal/npm"}).rewriteResolved("lodash", "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz"); got != "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz" {
+		t.Errorf("an unscoped package moved without a default registry: %s", got)
+	}
+	if err := (Registries{"corp": "https://corp.internal/npm"}).validate(); err == nil {
+		t.Error("validate() accepted a key that isn't a scope")
+	}
+	if err := (Registries{"default": "corp.internal"}).validate(); err == nil {
+		t.Error("validate() accepted a registry without a scheme")
+	}
+}
+
+func TestRewriteLockfile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "app", "caladan": {"registries": {"default": "https://npm.internal"}}}`)
+	lockfile := `{
+  "name": "app",
+  "lockfileVersion": 3,
+  "packages": {
+    "": {"name": "app", "dependencies": {"lodash": "^4.17.0", "old-lodash": "npm:lodash@3.10.1"}},
+    "node_modules/lodash": {"version": "4.17.21", "resolved": "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz", "integrity": "sha512-lodash"},
+    "node_modules/old-lodash": {"name": "lodash", "version": "3.10.1", "resolved": "https://registry.npmjs.org/lodash/-/lodash-3.10.1.tgz", "integrity": "sha512-old"}
+  }
+}
+`
+	lockfilePath := filepath.Join(dir, "package-lock.json")
+	writeTestFile(t, lockfilePath, lockfile)
+
+	if err := RewriteLockfile(dir, RewriteLockfileOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, lockfilePath) != lockfile {
+		t.Error("--dry-run wrote the lockfile")
+	}
+
+	if err := RewriteLockfile(dir, RewriteLockfileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := readTestFile(t, lockfilePath)
+	for _, want := range []string{
+		`"resolved": "https://npm.internal/lodash/-/lodash-4.17.21.tgz"`,
+		// Aliases are published under their name field
+		`"resolved": "https://npm.internal/lodash/-/lodash-3.10.1.tgz"`,
+		`"integrity": "sha512-old"`,
+	} {
+		if !strings.Contains(rewritten, want) {
+			t.Errorf("rewritten lockfile is missing %s:\n%s", want, rewritten)
+		}
+	}
+	if strings.Contains(rewritten, "registry.npmjs.org") {
+		t.Errorf("rewritten lockfile still points at registry.npmjs.org:\n%s", rewritten)
+	}
+}
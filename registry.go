@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDownloadRetries is how many times a registry GET is retried by default
+// when the registry is rate limiting or failing
+const maxDownloadRetries = 3
+
+// RegistryClient talks to an npm registry: packuments, tarballs, search,
+// publishing, dist-tags, and the account endpoints. Resolution, installs,
+// and the publishing commands all go through one, so they share a
+// transport, auth, and retry behavior rather than each building an
+// http.Client of its own
+type RegistryClient struct {
+	client   *http.Client
+	registry string // The base URL, without a trailing slash
+	token    string // Sent as a bearer token to the registry, never to other hosts
+	otp      string // Sent as npm-otp when set, for accounts with 2FA
+	retries  int    // How many times a failed GET is retried
+}
+
+func newRegistryClient(client *http.Client, registry, token string) *RegistryClient {
+	return &RegistryClient{client: client, registry: strings.TrimSuffix(registry, "/"), token: token, retries: maxDownloadRetries}
+}
+
+// authenticatedRegistryClient talks to the npm registry with the token from
+// NPM_TOKEN or the credential store configured in the current directory's
+// project
+func authenticatedRegistryClient() (*RegistryClient, error) {
+	config, err := loadConfig(".")
+	if err != nil {
+		return nil, err
+	}
+	token, err := registryToken(config, npmRegistryURL)
+	if err != nil {
+		return nil, err
+	}
+	return newRegistryClient(&http.Client{Timeout: 2 * time.Minute}, npmRegistryURL, token), nil
+}
+
+// escapePackage escapes a package name for a registry path, keeping a
+// scope's @ the way the registry expects
+func escapePackage(name string) string {
+	return strings.Replace(url.PathEscape(name), "%40", "@", 1)
+}
+
+// packumentPath is the path of a package's packument under the registry,
+// /@scope%2Fname for scoped packages. npmjs also answers /@scope/name, but
+// Verdaccio reads that as version name of package @scope, and Artifactory
+// only routes the escaped form
+func packumentPath(name string) string {
+	return "/" + escapePackage(name)
+}
+
+// authorize adds the token to a request for one of the registry's URLs.
+// Tarballs can live elsewhere, and those hosts don't get it
+func (r *RegistryClient) authorize(req *http.Request) {
+	if r.token == "" || !strings.HasPrefix(req.URL.String(), r.registry+"/") {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	if r.otp != "" {
+		req.Header.Set("npm-otp", r.otp)
+	}
+}
+
+// get GETs a URL, retrying with backoff on network errors, 429s, and 5xxs.
+// retried, when it's set, is called before each retry, with whether the
+// registry answered (and so pushed back) rather than the request failing.
+// The caller checks the status of the returned response
+func (r *RegistryClient) get(ctx context.Context, url string, header http.Header, retried func(answered bool)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		r.authorize(req)
+
+		resp, err := r.client.Do(req)
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt >= r.retries || ctx.Err() != nil {
+			return resp, err
+		}
+
+		reason := ""
+		delay := time.Duration(500*(1<<attempt)) * time.Millisecond
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			if retryAfter, parseErr := time.ParseDuration(resp.Header.Get("Retry-After") + "s"); parseErr == nil && retryAfter > 0 {
+				delay = min(retryAfter, 30*time.Second)
+			}
+			resp.Body.Close()
+		}
+		if retried != nil {
+			retried(err == nil)
+		}
+
+		fmt.Printf("Retrying %s in %s (%s)\n", url, delay, reason)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send makes a request to a registry path with an optional JSON body,
+// failing on anything but a 200 or 201, and decodes the response into
+// result when it's not nil
+func (r *RegistryClient) send(ctx context.Context, method, path string, body, result interface{}) error {
+	resp, err := r.do(ctx, method, r.registry+path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return &RegistryError{URL: resp.Request.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("error parsing response from %s: %v", resp.Request.URL, err)
+	}
+	return nil
+}
+
+// do makes a request with an optional JSON body. Only GETs are retried,
+// since a write the registry may have applied can't safely be repeated
+func (r *RegistryClient) do(ctx context.Context, method, url string, body interface{}) (*http.Response, error) {
+	if method == "GET" && body == nil {
+		return r.get(ctx, url, nil, nil)
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	r.authorize(req)
+	return r.client.Do(req)
+}
+
+// fetch GETs a URL with get's retries, failing on anything but a 200
+func (r *RegistryClient) fetch(ctx context.Context, url string) ([]byte, error) {
+	resp, err := r.get(ctx, url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RegistryError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// packument fetches a package's metadata. When a cached copy is given it's
+// revalidated with its etag and returned if unchanged
+func (r *RegistryClient) packument(ctx context.Context, name string, cached *cachedMetadata) (*PackageMetadata, string, error) {
+	registryURL := r.registry + packumentPath(name)
+	header := http.Header{}
+	if cached != nil && cached.ETag != "" {
+		header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := r.get(ctx, registryURL, header, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch package metadata: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return &cached.Metadata, cached.ETag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &RegistryError{URL: registryURL, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	metadata, err := decodePackument(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse package metadata: %v", err)
+	}
+
+	return metadata, resp.Header.Get("ETag"), nil
+}
+
+// tarball GETs a package tarball with get's retries. bypassCache asks
+// proxies and CDNs to fetch it from the origin rather than serve a copy
+func (r *RegistryClient) tarball(ctx context.Context, url string, bypassCache bool, retried func(answered bool)) (*http.Response, error) {
+	header := http.Header{}
+	if bypassCache {
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Pragma", "no-cache")
+	}
+	return r.get(ctx, url, header, retried)
+}
+
+// search asks the registry for up to size packages matching text, best
+// first
+func (r *RegistryClient) search(ctx context.Context, text string, size int) ([]PackageSuggestion, error) {
+	query := url.Values{"text": {text}, "size": {strconv.Itoa(size)}}
+	var results struct {
+		Objects []struct {
+			Package PackageSuggestion `json:"package"`
+		} `json:"objects"`
+	}
+	if err := r.send(ctx, "GET", "/-/v1/search?"+query.Encode(), nil, &results); err != nil {
+		return nil, err
+	}
+	suggestions := make([]PackageSuggestion, 0, len(results.Objects))
+	for _, object := range results.Objects {
+		suggestions = append(suggestions, object.Package)
+	}
+	return suggestions, nil
+}
+
+// publish PUTs a package document, the versions and attachments npm
+// publish sends
+func (r *RegistryClient) publish(ctx context.Context, name string, document json.RawMessage) error {
+	return r.send(ctx, "PUT", packumentPath(name), document, nil)
+}
+
+// distTags returns a package's dist-tags and the versions they point at
+func (r *RegistryClient) distTags(ctx context.Context, name string) (map[string]string, error) {
+	tags := make(map[string]string)
+	err := r.send(ctx, "GET", "/-/package/"+escapePackage(name)+"/dist-tags", nil, &tags)
+	return tags, err
+}
+
+// setDistTag points a dist-tag of a package at a version
+func (r *RegistryClient) setDistTag(ctx context.Context, name, tag, version string) error {
+	return r.send(ctx, "PUT", "/-/package/"+escapePackage(name)+"/dist-tags/"+url.PathEscape(tag), version, nil)
+}
+
+// removeDistTag deletes a dist-tag of a package
+func (r *RegistryClient) removeDistTag(ctx context.Context, name, tag string) error {
+	return r.send(ctx, "DELETE", "/-/package/"+escapePackage(name)+"/dist-tags/"+url.PathEscape(tag), nil, nil)
+}
+
+// advisories asks the registry's bulk advisory endpoint which of the given
+// versions have advisories. The registry only returns advisories that
+// affect one of the versions sent
+func (r *RegistryClient) advisories(ctx context.Context, versions map[string][]string) (map[string][]bulkAdvisory, error) {
+	advisories := make(map[string][]bulkAdvisory)
+	err := r.send(ctx, "POST", "/-/npm/v1/security/advisories/bulk", versions, &advisories)
+	return advisories, err
+}
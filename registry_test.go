@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRegistryClientRetries(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"name": "ms", "dist-tags": {"latest": "2.1.3"}, "versions": {}}`))
+	}))
+	defer server.Close()
+
+	client := newRegistryClient(server.Client(), server.URL+"/", "")
+	answered := 0
+	resp, err := client.tarball(context.Background(), server.URL+"/ms/-/ms-2.1.3.tgz", false, func(pushedBack bool) {
+		if pushedBack {
+			answered++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || answered != 1 {
+		t.Errorf("status %d after %d pushbacks, want 200 after 1", resp.StatusCode, answered)
+	}
+
+	// Packuments get the same retries as tarballs
+	attempts.Store(0)
+	metadata, _, err := client.packument(context.Background(), "ms", nil)
+	if err != nil || metadata.DistTags["latest"] != "2.1.3" {
+		t.Errorf("packument() = %+v, %v", metadata, err)
+	}
+
+	// Writes aren't
+	attempts.Store(0)
+	if err := client.setDistTag(context.Background(), "ms", "next", "3.0.0"); err == nil || attempts.Load() != 1 {
+		t.Errorf("setDistTag() = %v after %d attempts, want a 429 after 1", err, attempts.Load())
+	}
+}
+
+func TestRegistryClientAuth(t *testing.T) {
+	var registryAuth, otherAuth string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuth = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryAuth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	client := newRegistryClient(http.DefaultClient, server.URL, "token")
+	for _, url := range []string{server.URL + "/ms/-/ms-2.1.3.tgz", other.URL + "/ms.tgz"} {
+		resp, err := client.tarball(context.Background(), url, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if registryAuth != "Bearer token" || otherAuth != "" {
+		t.Errorf("registry got %q and another host %q, want only the registry to get the token", registryAuth, otherAuth)
+	}
+}
+
+func TestRegistryDistTags(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+		if r.Method == "GET" {
+			w.Write([]byte(`{"latest": "2.0.0", "next": "3.0.0-rc.1"}`))
+		}
+	}))
+	defer server.Close()
+
+	client := newRegistryClient(server.Client(), server.URL, "token")
+	ctx := context.Background()
+	tags, err := client.distTags(ctx, "@corp/http")
+	if err != nil || tags["next"] != "3.0.0-rc.1" {
+		t.Fatalf("distTags() = %v, %v", tags, err)
+	}
+	if err := client.setDistTag(ctx, "@corp/http", "beta", "3.0.0-beta.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.removeDistTag(ctx, "@corp/http", "beta"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /-/package/@corp%2Fhttp/dist-tags",
+		"PUT /-/package/@corp%2Fhttp/dist-tags/beta",
+		"DELETE /-/package/@corp%2Fhttp/dist-tags/beta",
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+}
+
+func TestPackumentURLEncoding(t *testing.T) {
+	packument := `{"name": "%s", "dist-tags": {"latest": "1.0.0"}, "versions": {}}`
+	for _, tt := range []struct {
+		registry string
+		base     string // Where the registry is mounted
+		// routes reports whether the registry serves a packument at the
+		// escaped path, and for which package
+		routes func(path string) (string, bool)
+	}{
+		// npmjs answers both forms
+		{"npmjs", "", func(path string) (string, bool) {
+			name := strings.Replace(strings.TrimPrefix(path, "/"), "%2F", "/", 1)
+			return name, !strings.Contains(name, "%")
+		}},
+		// Verdaccio takes /@scope/name as a version of @scope
+		{"verdaccio", "", func(path string) (string, bool) {
+			name := strings.TrimPrefix(path, "/")
+			if strings.Count(name, "/") > 0 {
+				return "", false
+			}
+			name = strings.Replace(strings.Replace(name, "%2F", "/", 1), "%2f", "/", 1)
+			return name, !strings.HasPrefix(name, "%40")
+		}},
+		// Artifactory is mounted under a path and only routes %2F
+		{"artifactory", "/artifactory/api/npm/npm", func(path string) (string, bool) {
+			name, ok := strings.CutPrefix(path, "/artifactory/api/npm/npm/")
+			if !ok || strings.Contains(name, "/") || strings.HasPrefix(name, "%40") {
+				return "", false
+			}
+			return strings.Replace(name, "%2F", "/", 1), true
+		}},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, ok := tt.routes(r.URL.EscapedPath())
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, packument, name)
+		}))
+		client := newRegistryClient(server.Client(), server.URL+tt.base, "")
+		for _, name := range []string{"left-pad", "@corp/ui"} {
+			metadata, _, err := client.packument(context.Background(), name, nil)
+			if err != nil || metadata.Name != name {
+				t.Errorf("%s: packument(%s) = %+v, %v", tt.registry, name, metadata, err)
+			}
+		}
+		server.Close()
+	}
+
+	if path := packumentPath("@corp/ui"); path != "/@corp%2Fui" {
+		t.Errorf("packumentPath(@corp/ui) = %s", path)
+	}
+}
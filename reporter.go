@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// reporterGitHub prints GitHub Actions workflow commands, which show up
+	// as annotations on the files of a pull request
+	reporterGitHub = "github"
+	// reporterProblemMatcher prints "file:line: severity: message" lines,
+	// which problem matchers of other CI systems and editors pick up
+	reporterProblemMatcher = "problem-matcher"
+)
+
+// reporterFormat is set by --reporter, "" prints no annotations
+var reporterFormat string
+
+// reporterFlag registers --reporter
+func reporterFlag(flags *flag.FlagSet) {
+	flags.Func("reporter", "also print problems as CI annotations: github or problem-matcher", func(value string) error {
+		if value != reporterGitHub && value != reporterProblemMatcher {
+			return fmt.Errorf("unknown reporter %q, use github or problem-matcher", value)
+		}
+		reporterFormat = value
+		return nil
+	})
+}
+
+// Annotation is a problem attached to a line of a file
+type Annotation struct {
+	Severity string // "error" or "warning"
+	File     string
+	Line     int // 0 when the line isn't known
+	Title    string
+	Message  string
+}
+
+// formatAnnotation renders an annotation in a reporter's format
+func formatAnnotation(format string, a Annotation) string {
+	file := annotationPath(a.File)
+	if format == reporterGitHub {
+		properties := []string{}
+		if file != "" {
+			properties = append(properties, "file="+escapeProperty(file))
+		}
+		if a.Line > 0 {
+			properties = append(properties, fmt.Sprintf("line=%d", a.Line))
+		}
+		if a.Title != "" {
+			properties = append(properties, "title="+escapeProperty(a.Title))
+		}
+		command := "::" + a.Severity
+		if len(properties) > 0 {
+			command += " " + strings.Join(properties, ",")
+		}
+		return command + "::" + escapeData(a.Message)
+	}
+
+	// Problem matchers match one line, so the message has to fit on it
+	message := strings.Join(strings.Fields(a.Message), " ")
+	if a.Title != "" {
+		message = a.Title + ": " + message
+	}
+	location := file
+	if a.Line > 0 {
+		location = fmt.Sprintf("%s:%d", file, a.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, a.Severity, message)
+}
+
+// escapeData escapes a workflow command's message
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeProperty escapes a workflow command's property value, which also
+// can't contain the separators between properties
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// annotationPath makes a path relative to the working directory, where CI
+// runs from the root of the repository, with forward slashes
+func annotationPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, abs); err == nil {
+				path = rel
+			}
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+// annotate prints an annotation when --reporter asks for them
+func annotate(a Annotation) {
+	if reporterFormat == "" {
+		return
+	}
+	fmt.Fprintln(os.Stdout, formatAnnotation(reporterFormat, a))
+}
+
+// annotationLine returns the line of a key in a JSON file, keys as for
+// jsonKeyLines, or 0 when it can't be found
+func annotationLine(file string, keys ...string) int {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	lines, _ := jsonKeyLines(data)
+	return lines[strings.Join(keys, "\x00")]
+}
+
+// annotateAdvisories attaches each advisory to the lockfile entries of the
+// package version it affects. High and critical advisories are errors
+func annotateAdvisories(report *AuditReport, lockfilePath string, packages map[string]json.RawMessage) {
+	if reporterFormat == "" || report == nil {
+		return
+	}
+	for _, advisory := range report.Advisories {
+		severity := "warning"
+		if severityRank(advisory.Severity) >= severityRank("high") {
+			severity = "error"
+		}
+		paths := []string{}
+		for path, raw := range packages {
+			if path != "" && packageNameFromPath(path) == advisory.Name && lockfileEntryVersion(raw) == advisory.Version {
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+		if len(paths) == 0 {
+			paths = []string{""}
+		}
+		for _, path := range paths {
+			line := 0
+			if path != "" {
+				line = annotationLine(lockfilePath, "packages", path)
+			}
+			annotate(Annotation{
+				Severity: severity,
+				File:     lockfilePath,
+				Line:     line,
+				Title:    fmt.Sprintf("%s advisory in %s@%s", advisory.Severity, advisory.Name, advisory.Version),
+				Message:  fmt.Sprintf("%s (vulnerable: %s) %s", advisory.Title, advisory.VulnerableVersions, advisory.URL),
+			})
+		}
+	}
+}
+
+// annotateFailures attaches integrity failures to the integrity recorded in
+// the lockfile. Other failures aren't about a line of the project
+func annotateFailures(failures []PackageFailure, lockfilePath string) {
+	if reporterFormat == "" {
+		return
+	}
+	for _, failure := range failures {
+		var integrityErr *IntegrityError
+		if !errors.As(failure.err, &integrityErr) {
+			continue
+		}
+		annotate(Annotation{
+			Severity: "error",
+			File:     lockfilePath,
+			Line:     annotationLine(lockfilePath, "packages", failure.Path, "integrity"),
+			Title:    fmt.Sprintf("integrity check failed for %s@%s", packageNameFromPath(failure.Path), failure.Version),
+			Message:  fmt.Sprintf("expected %s, got %s", integrityErr.Expected, integrityErr.Actual),
+		})
+	}
+}
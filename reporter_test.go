@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatAnnotation(t *testing.T) {
+	annotation := Annotation{
+		Severity: "error",
+		File:     "package-lock.json",
+		Line:     12,
+		Title:    "high advisory in ms@2.0.0, via a: b",
+		Message:  "ReDoS 100%\nupgrade",
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{reporterGitHub, "::error file=package-lock.json,line=12,title=high advisory in ms@2.0.0%2C via a%3A b::ReDoS 100%25%0Aupgrade"},
+		{reporterProblemMatcher, "package-lock.json:12: error: high advisory in ms@2.0.0, via a: b: ReDoS 100% upgrade"},
+	}
+	for _, tt := range tests {
+		if got := formatAnnotation(tt.format, annotation); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.format, got, tt.want)
+		}
+	}
+
+	// Without a line the annotation is on the file
+	if got := formatAnnotation(reporterGitHub, Annotation{Severity: "warning", File: "package.json", Message: "m"}); got != "::warning file=package.json::m" {
+		t.Errorf("no line = %s", got)
+	}
+}
+
+func TestFindLockfileDrift(t *testing.T) {
+	packages := map[string]json.RawMessage{
+		"": json.RawMessage(`{"dependencies": {"ms": "^2.0.0", "debug": "^4.0.0", "chalk": "^5.0.0", "glob": "10.4.5", "rimraf": "5.0.10",
+			"str": "4.2.3", "types": "npm:@types/node@20.1.0", "old": "1.0.0", "cat": "3.1.0", "local": "1.2.0", "anylocal": "0.1.0"}, "devDependencies": {"tap": "^16.0.0"}}`),
+	}
+	manifest := PackageInfo{
+		Dependencies: map[string]string{"ms": "^2.1.0", "chalk": "^5.0.0", "semver": "^7.0.0", "glob": "^10.3.0", "rimraf": "^6.0.0",
+			"str": "npm:string-width@^4.2.0", "types": "npm:@types/node@^20.0.0", "old": "npm:left-pad@^2.0.0",
+			"cat": "catalog:", "local": "workspace:^1.0.0", "anylocal": "workspace:*"},
+		DevDependencies: map[string]string{"tap": "^16.0.0"},
+	}
+	drift := findLockfileDrift(manifest, packages)
+	want := []lockfileDrift{
+		{Name: "debug", Section: "dependencies", LockfileRange: "^4.0.0"},
+		{Name: "ms", Section: "dependencies", ManifestRange: "^2.1.0", LockfileRange: "^2.0.0"},
+		{Name: "old", Section: "dependencies", ManifestRange: "npm:left-pad@^2.0.0", LockfileRange: "1.0.0"},
+		{Name: "rimraf", Section: "dependencies", ManifestRange: "^6.0.0", LockfileRange: "5.0.10"},
+		{Name: "semver", Section: "dependencies", ManifestRange: "^7.0.0"},
+	}
+	if len(drift) != len(want) {
+		t.Fatalf("drift = %+v, want %+v", drift, want)
+	}
+	for i := range want {
+		if drift[i] != want[i] {
+			t.Errorf("drift[%d] = %+v, want %+v", i, drift[i], want[i])
+		}
+	}
+}
+
+func TestWarnLockfileDriftAnnotates(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), "{\n  \"dependencies\": {\n    \"ms\": \"^2.1.0\"\n  }\n}\n")
+	lockfilePath := filepath.Join(dir, "package-lock.json")
+	packages := map[string]json.RawMessage{"": json.RawMessage(`{"dependencies": {"ms": "^2.0.0"}}`)}
+
+	reporterFormat = reporterProblemMatcher
+	defer func() { reporterFormat = "" }()
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	warnLockfileDrift(lockfilePath, packages)
+	w.Close()
+	os.Stdout = stdout
+	output := make([]byte, 4096)
+	n, _ := r.Read(output)
+
+	want := annotationPath(filepath.Join(dir, "package.json")) + ":3: warning: lockfile out of date"
+	if !strings.Contains(string(output[:n]), want) {
+		t.Errorf("output = %q, want it to contain %q", output[:n], want)
+	}
+}
@@ -4,26 +4,67 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 )
 
+// npmRegistryURL is the default registry packages are resolved against
+const npmRegistryURL = "https://registry.npmjs.org"
+
+// maxResolutionDepth caps how long a chain of dependencies can be
+const maxResolutionDepth = 128
+
 type PackageResolver struct {
 	resolved     map[string]PackageInfo
 	resolvedLock sync.RWMutex
-	client       *http.Client
+	client       *RegistryClient
 	semaphore    *semaphore.Weighted
+	cache        *ResolutionCache
+	stats        *CacheStats // Counts cache lookups when set
+
+	// avoidDeprecated picks the newest satisfying version that isn't
+	// deprecated when there is one, hideDeprecated skips the warnings
+	avoidDeprecated bool
+	hideDeprecated  bool
+	deprecatedSeen  sync.Map
+	// cyclesSeen holds the packages circular dependencies were cut at,
+	// which are only warned about once
+	cyclesSeen sync.Map
+
+	// manifestPath is the package.json the dependencies come from, which
+	// unmet peer dependencies are annotated on
+	manifestPath string
+
+	// overrides replaces the range of every dependency on a package, from
+	// --override
+	overrides map[string]string
+
+	// Packuments fetched during this run, with in-flight fetches coalesced
+	// so that each package's metadata is requested at most once
+	metadata     map[string]fetchedMetadata
+	metadataLock sync.Mutex
+	inflight     singleflight.Group
+}
+
+// fetchedMetadata is a packument held in memory for the rest of the run
+type fetchedMetadata struct {
+	metadata *PackageMetadata
+	etag     string
 }
 
-func NewPackageResolver(client *http.Client, httpSemaphore *semaphore.Weighted) *PackageResolver {
+func NewPackageResolver(client *RegistryClient, httpSemaphore *semaphore.Weighted) *PackageResolver {
 	return &PackageResolver{
 		resolved:  make(map[string]PackageInfo),
 		client:    client,
 		semaphore: httpSemaphore,
+		cache:     NewResolutionCache(defaultCacheDir()),
+		metadata:  make(map[string]fetchedMetadata),
 	}
 }
 
@@ -41,6 +82,10 @@ func (r *PackageResolver) collectPeerDependencies(
 		g.Go(func() error {
 			resolved, err := r.ResolveDependency(ctx, dep.Name, dep.Version)
 			if err != nil {
+				if dep.Optional {
+					// Reported when the dependency is resolved for real
+					return nil
+				}
 				return err
 			}
 
@@ -56,8 +101,23 @@ func (r *PackageResolver) collectPeerDependencies(
 				}
 
 				if !isDirectDep {
-					fmt.Printf("Warning: Package %s has unmet peer dependency %s@%s\n",
+					printWarning("Package %s has unmet peer dependency %s@%s",
 						dep.Name, name, version)
+					if r.manifestPath != "" {
+						section := "dependencies"
+						if dep.Dev {
+							section = "devDependencies"
+						} else if dep.Optional {
+							section = "optionalDependencies"
+						}
+						annotate(Annotation{
+							Severity: "warning",
+							File:     r.manifestPath,
+							Line:     annotationLine(r.manifestPath, section, dep.Name),
+							Title:    "unmet peer dependency",
+							Message:  fmt.Sprintf("%s needs %s@%s, which isn't a dependency", dep.Name, name, version),
+						})
+					}
 				}
 			}
 			peerDepsLock.Unlock()
@@ -90,13 +150,24 @@ func (r *PackageResolver) ResolveDependencies(
 	g, ctx := errgroup.WithContext(ctx)
 	resolvedDeps := make([]PackageInfo, len(dependencies))
 
+	failedOptional := make([]bool, len(dependencies))
+
 	for i, dep := range dependencies {
 		i, dep := i, dep // capture loop variables
 		g.Go(func() error {
 			resolved, err := r.ResolveDependency(ctx, dep.Name, dep.Version)
 			if err != nil {
+				if dep.Optional {
+					printWarning("Skipping optional dependency %s@%s: %v", dep.Name, dep.Version, err)
+					failedOptional[i] = true
+					return nil
+				}
 				return err
 			}
+
+			// Keep how the root depends on the package
+			resolved.Dev = dep.Dev
+			resolved.Optional = dep.Optional
 			resolvedDeps[i] = resolved
 			return nil
 		})
@@ -105,7 +176,14 @@ func (r *PackageResolver) ResolveDependencies(
 	if err := g.Wait(); err != nil {
 		return nil, err
 	}
-	return resolvedDeps, nil
+
+	result := make([]PackageInfo, 0, len(resolvedDeps))
+	for i, resolved := range resolvedDeps {
+		if !failedOptional[i] {
+			result = append(result, resolved)
+		}
+	}
+	return result, nil
 }
 
 func (r *PackageResolver) ResolveDependency(
@@ -113,6 +191,26 @@ func (r *PackageResolver) ResolveDependency(
 	name string,
 	version string,
 ) (PackageInfo, error) {
+	return r.resolveDependency(ctx, name, version, nil)
+}
+
+// resolveDependency resolves a package and its dependencies. path holds the
+// name@version of every package currently being resolved above this one, so
+// circular dependencies can be cut and runaway chains can be stopped
+func (r *PackageResolver) resolveDependency(
+	ctx context.Context,
+	name string,
+	version string,
+	path []string,
+) (PackageInfo, error) {
+	if len(path) >= maxResolutionDepth {
+		return PackageInfo{}, fmt.Errorf("dependency chain is deeper than %d packages: %s",
+			maxResolutionDepth, strings.Join(append(path, name+"@"+version), " > "))
+	}
+	if override, ok := r.overrides[name]; ok {
+		version = override
+	}
+
 	// First check if we've already resolved any version of this package
 	r.resolvedLock.RLock()
 	nameWithAt := name + "@"
@@ -131,50 +229,90 @@ func (r *PackageResolver) ResolveDependency(
 	// No compatible version found, continue with normal resolution...
 	uniqueKey := name + "@" + version
 
-	if err := r.semaphore.Acquire(ctx, 1); err != nil {
-		return PackageInfo{}, err
+	ctx, span := startSpan(ctx, "resolve", spanKindInternal,
+		otlpAttr("package.name", name), otlpAttr("package.range", version))
+	pkgInfo, cut, err := r.resolvePackage(ctx, name, version, path)
+	if err == nil {
+		span.setAttrs(otlpAttr("package.version", pkgInfo.Version))
 	}
-	defer r.semaphore.Release(1)
-
-	// Resolve package metadata first (we need this for both paths)
-	metadata, err := resolvePackageMetadata(ctx, r.client, name, version)
+	span.finish(err)
 	if err != nil {
 		return PackageInfo{}, err
 	}
-
-	// Get all available versions
-	keys := make([]string, len(metadata.Versions))
-	i := 0
-	for k := range metadata.Versions {
-		keys[i] = k
-		i++
+	if cut {
+		// Without its dependencies it's only good where the cycle was cut,
+		// any other dependent has to get the ancestor's entry
+		return pkgInfo, nil
 	}
 
-	// Try to match as semver range first
-	_, err = GetMatchingVersions(version, keys)
+	// Cache result with write lock
+	r.resolvedLock.Lock()
+	r.resolved[uniqueKey] = pkgInfo
+	r.resolvedLock.Unlock()
+	return pkgInfo, nil
+}
+
+// resolvePackage picks the version of a package and resolves its
+// dependencies. It reports cut when the version is already being resolved
+// further up path, in which case it returns the package without them
+func (r *PackageResolver) resolvePackage(
+	ctx context.Context,
+	name string,
+	version string,
+	path []string,
+) (pkgInfo PackageInfo, cut bool, err error) {
+	// Resolve package metadata first (we need this for both paths)
+	metadata, etag, err := r.packageMetadata(ctx, name, version)
 	if err != nil {
-		// If semver matching failed, check if it's a dist tag
-		if tagVersion, ok := metadata.DistTags[version]; ok {
-			fmt.Printf("Using '%s' tag for %s: %s\n", version, name, tagVersion)
-			version = tagVersion
-		} else {
-			// Not a valid version or known tag
-			fmt.Printf("Warning: Tag '%s' for package '%s' doesn't exist\n", version, name)
-			return PackageInfo{}, fmt.Errorf("'%s' is not a valid version or tag", version)
+		return PackageInfo{}, false, err
+	}
+
+	// Reuse the previous run's decision if the metadata hasn't changed
+	cachedVersion, ok := r.cache.getDecision(r.client.registry, name, version, etag)
+	if ok && r.avoidDeprecated && metadata.Versions[cachedVersion].Deprecated != "" {
+		// Decided before --no-deprecated was set, there may be a better version
+		ok = false
+	}
+	r.stats.recordDecision(ok)
+	if ok {
+		pkgInfo, err = packageVersionInfo(metadata, cachedVersion)
+	} else {
+		pkgInfo, err = resolveVersion(name, version, metadata, r.avoidDeprecated)
+		if err == nil {
+			if err := r.cache.putDecision(r.client.registry, name, version, etag, pkgInfo.Version); err != nil {
+				printWarning("failed to cache resolution of %s@%s: %v", name, version, err)
+			}
 		}
 	}
-
-	// Find exact version
-	pkgInfo, err := latestMatchingVersion(version, metadata)
 	if err != nil {
-		return PackageInfo{}, err
+		return PackageInfo{}, false, err
+	}
+	r.warnDeprecated(name, pkgInfo)
+
+	// If this exact version is already being resolved further up the chain we've
+	// found a cycle. The ancestor's entry carries the dependencies, so this one
+	// is cut off here, which always breaks the cycle at the same place
+	resolvedKey := name + "@" + pkgInfo.Version
+	for _, ancestor := range path {
+		if ancestor == resolvedKey {
+			r.warnCycle(path, resolvedKey)
+			return pkgInfo, true, nil
+		}
 	}
+	childPath := make([]string, len(path), len(path)+1)
+	copy(childPath, path)
+	childPath = append(childPath, resolvedKey)
 
-	// Collect all dependencies
+	// Collect all dependencies, an optional entry wins over a regular one
 	allDeps := make(map[string]string)
 	for k, v := range pkgInfo.Dependencies {
 		allDeps[k] = v
 	}
+	optionalDeps := make(map[string]bool)
+	for k, v := range pkgInfo.OptionalDependencies {
+		allDeps[k] = v
+		optionalDeps[k] = true
+	}
 
 	// Resolve dependencies concurrently using errgroup
 	g, gctx := errgroup.WithContext(ctx)
@@ -184,9 +322,15 @@ func (r *PackageResolver) ResolveDependency(
 	for depName, depVersion := range allDeps {
 		depName, depVersion := depName, depVersion // capture loop variables
 		g.Go(func() error {
-			depPkg, err := r.ResolveDependency(gctx, depName, depVersion)
+			depPkg, err := r.resolveDependency(gctx, depName, depVersion, childPath)
 			if err != nil {
-				return fmt.Errorf("failed to resolve %s@%s: %v", depName, depVersion, err)
+				if optionalDeps[depName] {
+					// Usually a platform-specific build that doesn't exist
+					printWarning("Skipping optional dependency %s@%s of %s: %v",
+						depName, depVersion, name, err)
+					return nil
+				}
+				return fmt.Errorf("failed to resolve %s@%s: %w", depName, depVersion, err)
 			}
 
 			resolvedLock.Lock()
@@ -197,36 +341,134 @@ func (r *PackageResolver) ResolveDependency(
 	}
 
 	if err := g.Wait(); err != nil {
-		return PackageInfo{}, err
+		return PackageInfo{}, false, err
 	}
 
 	// Update package info
 	pkgInfo.Dependencies = make(map[string]string)
 	pkgInfo.DevDependencies = make(map[string]string)
+	pkgInfo.OptionalDependencies = make(map[string]string)
 	pkgInfo.ResolvedDeps = resolvedDeps
 	for depName, depPkg := range resolvedDeps {
-		pkgInfo.Dependencies[depName] = depPkg.Version
+		if optionalDeps[depName] {
+			pkgInfo.OptionalDependencies[depName] = depPkg.Version
+		} else {
+			pkgInfo.Dependencies[depName] = depPkg.Version
+		}
 	}
 
-	// Cache result with write lock
-	r.resolvedLock.Lock()
-	r.resolved[uniqueKey] = pkgInfo
-	r.resolvedLock.Unlock()
-	return pkgInfo, nil
+	return pkgInfo, false, nil
+}
+
+// MarkDevDependencies sets the dev flag on every package that can only be
+// reached through the root's devDependencies. Root packages must already
+// carry their own dev flag
+func MarkDevDependencies(dependencies []PackageInfo) []PackageInfo {
+	// Find everything a production dependency needs
+	prod := make(map[string]bool)
+	var visit func(dep PackageInfo)
+	visit = func(dep PackageInfo) {
+		key := dep.Name + "@" + dep.Version
+		if prod[key] {
+			return
+		}
+		prod[key] = true
+		for _, child := range dep.ResolvedDeps {
+			visit(child)
+		}
+	}
+	for _, dep := range dependencies {
+		if !dep.Dev {
+			visit(dep)
+		}
+	}
+
+	var mark func(dep PackageInfo) PackageInfo
+	mark = func(dep PackageInfo) PackageInfo {
+		dep.Dev = !prod[dep.Name+"@"+dep.Version]
+		if len(dep.ResolvedDeps) > 0 {
+			children := make(map[string]PackageInfo, len(dep.ResolvedDeps))
+			for name, child := range dep.ResolvedDeps {
+				children[name] = mark(child)
+			}
+			dep.ResolvedDeps = children
+		}
+		return dep
+	}
+
+	marked := make([]PackageInfo, len(dependencies))
+	for i, dep := range dependencies {
+		marked[i] = mark(dep)
+	}
+	return marked
+}
+
+// MarkOptionalDependencies sets the optional flag on every package that is
+// only reached through optionalDependencies, either the root's or a package's.
+// Root packages must already carry their own optional flag
+func MarkOptionalDependencies(dependencies []PackageInfo) []PackageInfo {
+	// Find everything reachable without crossing an optional edge
+	required := make(map[string]bool)
+	var visit func(dep PackageInfo)
+	visit = func(dep PackageInfo) {
+		key := dep.Name + "@" + dep.Version
+		if required[key] {
+			return
+		}
+		required[key] = true
+		for name, child := range dep.ResolvedDeps {
+			if _, optional := dep.OptionalDependencies[name]; !optional {
+				visit(child)
+			}
+		}
+	}
+	for _, dep := range dependencies {
+		if !dep.Optional {
+			visit(dep)
+		}
+	}
+
+	var mark func(dep PackageInfo) PackageInfo
+	mark = func(dep PackageInfo) PackageInfo {
+		dep.Optional = !required[dep.Name+"@"+dep.Version]
+		if len(dep.ResolvedDeps) > 0 {
+			children := make(map[string]PackageInfo, len(dep.ResolvedDeps))
+			for name, child := range dep.ResolvedDeps {
+				children[name] = mark(child)
+			}
+			dep.ResolvedDeps = children
+		}
+		return dep
+	}
+
+	marked := make([]PackageInfo, len(dependencies))
+	for i, dep := range dependencies {
+		marked[i] = mark(dep)
+	}
+	return marked
 }
 
 func HoistDependencies(dependencies []PackageInfo) []PackageInfo {
+	return hoistDependencies(dependencies, nil)
+}
+
+// hoistDependencies hoists every package that appears more than once to the
+// root, unless another version of it is already there. Each decision, and
+// the dependents behind it, is recorded in report when it isn't nil
+func hoistDependencies(dependencies []PackageInfo, report *HoistReport) []PackageInfo {
 	// Track all unique packages by name@version
 	packages := make(map[string]PackageInfo)
 	counts := make(map[string]int)
+	dependents := make(map[string][]string) // name@version -> name@version of its dependents, "" for the project
 
 	// Recursively collect all packages and their counts
-	var collectPackages func(deps []PackageInfo, level int)
-	collectPackages = func(deps []PackageInfo, level int) {
+	var collectPackages func(deps []PackageInfo, parent string)
+	collectPackages = func(deps []PackageInfo, parent string) {
 		for _, dep := range deps {
 			key := dep.Name + "@" + dep.Version
 			packages[key] = dep
 			counts[key]++
+			dependents[key] = appendUnique(dependents[key], parent)
 
 			// Process nested dependencies
 			if len(dep.ResolvedDeps) > 0 {
@@ -234,11 +476,11 @@ func HoistDependencies(dependencies []PackageInfo) []PackageInfo {
 				for _, pkg := range dep.ResolvedDeps {
 					nested = append(nested, pkg)
 				}
-				collectPackages(nested, level+1)
+				collectPackages(nested, key)
 			}
 		}
 	}
-	collectPackages(dependencies, 0)
+	collectPackages(dependencies, "")
 
 	// Start with direct dependencies
 	hoisted := make([]PackageInfo, len(dependencies))
@@ -250,21 +492,39 @@ func HoistDependencies(dependencies []PackageInfo) []PackageInfo {
 		rootPackages[dep.Name] = dep.Version
 	}
 
-	// Try to hoist packages that appear multiple times
-	for key, count := range counts {
-		if count <= 1 {
-			continue
+	// Try to hoist packages that appear multiple times, the most shared
+	// first so they're the ones that win the root
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
 		}
-
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		count := counts[key]
 		pkg := packages[key]
 		name, version := pkg.Name, pkg.Version
+		existingVersion, exists := rootPackages[name]
+		if count <= 1 {
+			if report != nil && (!exists || existingVersion != version) {
+				report.nested(pkg, dependents[key], "", nil)
+			}
+			continue
+		}
 
 		// Check if we can hoist to root
-		if existingVersion, exists := rootPackages[name]; !exists || existingVersion == version {
+		if !exists || existingVersion == version {
 			// No conflict at root, can be hoisted
 			if !exists {
 				rootPackages[name] = version
 				hoisted = append(hoisted, pkg)
+				if report != nil {
+					report.hoisted(pkg, dependents[key])
+				}
 			}
 
 			// Update all references to use the hoisted version
@@ -286,9 +546,15 @@ func HoistDependencies(dependencies []PackageInfo) []PackageInfo {
 				}
 			}
 			updateRefs(hoisted)
+		} else if report != nil {
+			rootKey := name + "@" + existingVersion
+			report.nested(pkg, dependents[key], existingVersion, dependents[rootKey])
 		}
 	}
 
+	if report != nil {
+		report.measure(hoisted)
+	}
 	return hoisted
 }
 
@@ -303,18 +569,25 @@ func GenerateLockFile(dependencies []PackageInfo) (string, error) {
 		Packages:        make(map[string]PackageInfo),
 	}
 
-	// Add root package
-	lockfile.Packages[""] = PackageInfo{
-		Dependencies: func() map[string]string {
-			deps := make(map[string]string)
-			for _, d := range dependencies {
-				if d.Name != "" && d.Version != "" {
-					deps[d.Name] = d.Version
-				}
-			}
-			return deps
-		}(),
+	// Add root package, keeping dev and optional dependencies separate
+	root := PackageInfo{
+		Dependencies:         make(map[string]string),
+		DevDependencies:      make(map[string]string),
+		OptionalDependencies: make(map[string]string),
 	}
+	for _, d := range dependencies {
+		if d.Name == "" || d.Version == "" {
+			continue
+		}
+		if d.Dev {
+			root.DevDependencies[d.Name] = d.Version
+		} else if d.Optional {
+			root.OptionalDependencies[d.Name] = d.Version
+		} else {
+			root.Dependencies[d.Name] = d.Version
+		}
+	}
+	lockfile.Packages[""] = root
 
 	seen := make(map[string]bool)
 	var addPackage func(pkg PackageInfo, path string) error
@@ -354,34 +627,108 @@ func GenerateLockFile(dependencies []PackageInfo) (string, error) {
 	return string(out), nil
 }
 
-func resolvePackageMetadata(ctx context.Context, client *http.Client, dep string, version string) (*PackageMetadata, error) {
-	fmt.Printf("Resolving package metadata for %s@%s\n", dep, version)
+// packageMetadata returns a package's metadata and etag. Concurrent callers
+// asking for the same package share a single fetch, and the result is kept
+// in memory for the rest of the run
+func (r *PackageResolver) packageMetadata(ctx context.Context, name, version string) (*PackageMetadata, string, error) {
+	r.metadataLock.Lock()
+	fetched, ok := r.metadata[name]
+	r.metadataLock.Unlock()
+	if ok {
+		return fetched.metadata, fetched.etag, nil
+	}
+
+	result, err, _ := r.inflight.Do(name, func() (interface{}, error) {
+		metadata, etag, err := r.fetchMetadata(ctx, name, version)
+		if err != nil {
+			return nil, err
+		}
 
-	registryURL := fmt.Sprintf("https://registry.npmjs.org/%s", dep)
-	req, err := http.NewRequestWithContext(ctx, "GET", registryURL, nil)
+		fetched := fetchedMetadata{metadata: metadata, etag: etag}
+		r.metadataLock.Lock()
+		r.metadata[name] = fetched
+		r.metadataLock.Unlock()
+		return fetched, nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return nil, "", err
+	}
+
+	fetched = result.(fetchedMetadata)
+	return fetched.metadata, fetched.etag, nil
+}
+
+// fetchMetadata returns a package's metadata and etag, from the on-disk cache
+// when it's fresh and from the registry (revalidating the cached copy) otherwise
+func (r *PackageResolver) fetchMetadata(ctx context.Context, name, version string) (*PackageMetadata, string, error) {
+	ctx, span := startSpan(ctx, "fetch metadata", spanKindClient,
+		otlpAttr("package.name", name), otlpAttr("registry", r.client.registry))
+
+	cached, ok := r.cache.getMetadata(r.client.registry, name)
+	if ok && time.Since(cached.FetchedAt) < metadataMaxAge {
+		r.stats.recordMetadata(metadataHit)
+		span.setAttrs(otlpAttr("cache.result", metadataHit))
+		span.finish(nil)
+		return &cached.Metadata, cached.ETag, nil
+	}
+	if !ok {
+		cached = nil
 	}
 
-	resp, err := client.Do(req)
+	// Only hold an HTTP slot for the request itself, never while recursing
+	if err := r.semaphore.Acquire(ctx, 1); err != nil {
+		span.finish(err)
+		return nil, "", err
+	}
+	fmt.Printf("Resolving package metadata for %s@%s\n", name, version)
+	metadata, etag, err := r.client.packument(ctx, name, cached)
+	r.semaphore.Release(1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch package metadata: %v", err)
+		span.finish(err)
+		return nil, "", err
+	}
+	result := metadataMiss
+	if cached != nil && metadata == &cached.Metadata {
+		result = metadataRevalidated
 	}
-	defer resp.Body.Close()
+	r.stats.recordMetadata(result)
+	span.setAttrs(otlpAttr("cache.result", result))
+	span.finish(nil)
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("npm registry returned status %d", resp.StatusCode)
+	entry := cachedMetadata{ETag: etag, FetchedAt: time.Now(), Metadata: *metadata}
+	if err := r.cache.putMetadata(r.client.registry, name, entry); err != nil {
+		printWarning("failed to cache metadata for %s: %v", name, err)
 	}
 
-	var metadata PackageMetadata
-	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
-		return nil, fmt.Errorf("failed to parse package metadata: %v", err)
+	return metadata, etag, nil
+}
+
+// warnDeprecated prints the registry's deprecation message for a resolved
+// version, once per version
+func (r *PackageResolver) warnDeprecated(name string, pkgInfo PackageInfo) {
+	if pkgInfo.Deprecated == "" || r.hideDeprecated {
+		return
+	}
+	if _, seen := r.deprecatedSeen.LoadOrStore(name+"@"+pkgInfo.Version, true); seen {
+		return
 	}
+	printWarning("%s is deprecated: %s", colorPackage(name+"@"+pkgInfo.Version), pkgInfo.Deprecated)
+}
 
-	return &metadata, nil
+// warnCycle warns about a circular dependency, once for each package it's
+// cut at
+func (r *PackageResolver) warnCycle(path []string, resolvedKey string) {
+	if _, seen := r.cyclesSeen.LoadOrStore(resolvedKey, true); seen {
+		return
+	}
+	printWarning("circular dependency: %s > %s", strings.Join(path, " > "), resolvedKey)
 }
 
-func latestMatchingVersion(version string, metadata *PackageMetadata) (PackageInfo, error) {
+// resolveVersion picks the version of a package that a range or dist tag
+// refers to. With avoidDeprecated, a range resolves to its newest version
+// that isn't deprecated, if it has one
+func resolveVersion(name, version string, metadata *PackageMetadata, avoidDeprecated bool) (PackageInfo, error) {
+	// Get all available versions
 	keys := make([]string, len(metadata.Versions))
 	i := 0
 	for k := range metadata.Versions {
@@ -389,28 +736,80 @@ func latestMatchingVersion(version string, metadata *PackageMetadata) (PackageIn
 		i++
 	}
 
-	matches, err := GetMatchingVersions(version, keys)
+	// Try to match as semver range first
+	_, err := GetMatchingVersions(version, keys)
 	if err != nil {
-		return PackageInfo{}, err
+		sort.Strings(keys)
+		// If semver matching failed, check if it's a dist tag
+		if tagVersion, ok := metadata.DistTags[version]; ok {
+			fmt.Printf("Using '%s' tag for %s: %s\n", version, name, tagVersion)
+			version = tagVersion
+		} else {
+			// Not a valid version or known tag
+			printWarning("Tag '%s' for package '%s' doesn't exist", version, name)
+			return PackageInfo{}, &ResolutionError{Name: name, Range: version, Candidates: keys, Err: err}
+		}
 	}
-	if len(matches) == 0 {
-		return PackageInfo{}, fmt.Errorf("no matching versions found for %s", version)
+
+	// Find exact version
+	return latestMatchingVersion(name, version, metadata, avoidDeprecated)
+}
+
+func latestMatchingVersion(name, version string, metadata *PackageMetadata, avoidDeprecated bool) (PackageInfo, error) {
+	keys := make([]string, len(metadata.Versions))
+	i := 0
+	for k := range metadata.Versions {
+		keys[i] = k
+		i++
+	}
+
+	matches, err := GetMatchingVersions(version, keys)
+	if err != nil || len(matches) == 0 {
+		sort.Strings(keys)
+		return PackageInfo{}, &ResolutionError{Name: name, Range: version, Candidates: keys, Err: err}
 	}
 
 	// Get the package info for the latest matching version
-	pkgInfo := metadata.Versions[matches[len(matches)-1]]
+	if avoidDeprecated {
+		return packageVersionInfo(metadata, newestNotDeprecated(matches, metadata))
+	}
+	return packageVersionInfo(metadata, matches[len(matches)-1])
+}
+
+// newestNotDeprecated returns the newest of the sorted matching versions that
+// isn't deprecated, or the newest one when they all are
+func newestNotDeprecated(matches []string, metadata *PackageMetadata) string {
+	for i := len(matches) - 1; i >= 0; i-- {
+		if metadata.Versions[matches[i]].Deprecated == "" {
+			return matches[i]
+		}
+	}
+	return matches[len(matches)-1]
+}
+
+// packageVersionInfo returns the package info of an exact version with its dist information copied over
+func packageVersionInfo(metadata *PackageMetadata, version string) (PackageInfo, error) {
+	pkgInfo, ok := metadata.Versions[version]
+	if !ok {
+		return PackageInfo{}, fmt.Errorf("version %s not found in package metadata", version)
+	}
 
 	// Verify required dist information
 	if pkgInfo.Dist.Tarball == "" {
 		return PackageInfo{}, fmt.Errorf("missing tarball URL in package metadata")
 	}
-	if pkgInfo.Dist.Integrity == "" {
+	// Packages published before integrity existed only have a sha1 shasum
+	integrity, err := normalizeIntegrity(pkgInfo.Dist.Integrity, pkgInfo.Dist.Shasum)
+	if err != nil {
+		return PackageInfo{}, err
+	}
+	if integrity == "" {
 		return PackageInfo{}, fmt.Errorf("missing integrity hash in package metadata")
 	}
 
 	// Copy dist information
 	pkgInfo.Resolved = pkgInfo.Dist.Tarball
-	pkgInfo.Integrity = pkgInfo.Dist.Integrity
+	pkgInfo.Integrity = integrity
 
 	return pkgInfo, nil
 }
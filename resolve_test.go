@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestPackageMetadataSingleflight(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write([]byte(`{"name":"tslib","dist-tags":{"latest":"2.8.1"}}`))
+	}))
+	defer server.Close()
+
+	resolver := NewPackageResolver(newRegistryClient(server.Client(), server.URL, ""), semaphore.NewWeighted(64))
+	resolver.cache = nil
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metadata, _, err := resolver.packageMetadata(context.Background(), "tslib", "^2.0.0")
+			if err != nil || metadata.Name != "tslib" {
+				t.Errorf("packageMetadata() = %v, %v", metadata, err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+
+	// A later lookup is served from memory
+	if _, _, err := resolver.packageMetadata(context.Background(), "tslib", "^2.0.0"); err != nil {
+		t.Fatalf("packageMetadata() error = %v", err)
+	}
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("registry received %d requests, want 1", got)
+	}
+}
+
+// newTestResolver returns a resolver backed by a fake registry serving the given
+// packuments, with an empty resolution cache so every range is matched
+// against the packument's versions
+func newTestResolver(t *testing.T, packuments map[string]PackageMetadata) *PackageResolver {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		metadata, ok := packuments[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+name+`"`)
+		json.NewEncoder(w).Encode(metadata)
+	}))
+	t.Cleanup(server.Close)
+
+	resolver := NewPackageResolver(newRegistryClient(server.Client(), server.URL, ""), semaphore.NewWeighted(64))
+	resolver.cache = NewResolutionCache(t.TempDir())
+	return resolver
+}
+
+// testPackument builds a single-version packument
+func testPackument(name, version string, deps map[string]string) PackageMetadata {
+	info := PackageInfo{Name: name, Version: version, Dependencies: deps}
+	info.Dist.Tarball = fmt.Sprintf("https://registry.example/%s/-/%s-%s.tgz", name, name, version)
+	info.Dist.Integrity = "sha512-AAAA"
+	return PackageMetadata{
+		Name:     name,
+		Versions: map[string]PackageInfo{version: info},
+		DistTags: map[string]string{"latest": version},
+	}
+}
+
+func TestResolveDependencyCycle(t *testing.T) {
+	resolver := newTestResolver(t, map[string]PackageMetadata{
+		"a": testPackument("a", "1.0.0", map[string]string{"b": "1.0.0"}),
+		"b": testPackument("b", "1.0.0", map[string]string{"a": "1.0.0"}),
+	})
+
+	a, err := resolver.ResolveDependency(context.Background(), "a", "1.0.0")
+	if err != nil {
+		t.Fatalf("ResolveDependency() error = %v", err)
+	}
+
+	b, ok := a.ResolvedDeps["b"]
+	if !ok {
+		t.Fatalf("a is missing its dependency on b")
+	}
+	cut, ok := b.ResolvedDeps["a"]
+	if !ok {
+		t.Fatalf("b is missing its dependency on a")
+	}
+	if len(cut.ResolvedDeps) != 0 {
+		t.Errorf("cycle wasn't cut, a's second occurrence has dependencies %v", cut.ResolvedDeps)
+	}
+}
+
+func TestResolveDependencyCycleMixedRanges(t *testing.T) {
+	packuments := map[string]PackageMetadata{
+		"x": testPackument("x", "1.0.0", map[string]string{"a": "1.0.0"}),
+		"a": testPackument("a", "1.0.0", map[string]string{"b": "^1.0.0"}),
+		"b": testPackument("b", "1.0.0", map[string]string{"a": "^1.0.0"}),
+		"c": testPackument("c", "1.0.0", map[string]string{"a": "~1.0.0"}),
+	}
+	// x resolves the cycle first, and c's a can be matched by either of
+	// the a entries it left behind, so try it a few times
+	for i := 0; i < 20; i++ {
+		resolver := newTestResolver(t, packuments)
+		if _, err := resolver.ResolveDependency(context.Background(), "x", "^1.0.0"); err != nil {
+			t.Fatalf("ResolveDependency() error = %v", err)
+		}
+		deps, err := resolver.ResolveDependencies(context.Background(), []PackageInfo{{Name: "x", Version: "^1.0.0"}, {Name: "c", Version: "^1.0.0"}})
+		if err != nil {
+			t.Fatalf("ResolveDependencies() error = %v", err)
+		}
+		lockfile, err := GenerateLockFile(hoistDependencies(deps, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lock PackageLock
+		if err := json.Unmarshal([]byte(lockfile), &lock); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := lock.Packages["node_modules/b"]; !ok {
+			t.Fatal("b is missing from the lockfile, c got the copy of a the cycle was cut at")
+		}
+	}
+}
+
+func TestResolveDependencyMaxDepth(t *testing.T) {
+	packuments := make(map[string]PackageMetadata)
+	for i := 0; i <= maxResolutionDepth; i++ {
+		deps := map[string]string{fmt.Sprintf("p%d", i+1): "1.0.0"}
+		if i == maxResolutionDepth {
+			deps = nil
+		}
+		name := fmt.Sprintf("p%d", i)
+		packuments[name] = testPackument(name, "1.0.0", deps)
+	}
+	resolver := newTestResolver(t, packuments)
+
+	_, err := resolver.ResolveDependency(context.Background(), "p0", "1.0.0")
+	if err == nil || !strings.Contains(err.Error(), "deeper than") {
+		t.Errorf("ResolveDependency() error = %v, want depth limit error", err)
+	}
+}
+
+func TestMarkDevDependencies(t *testing.T) {
+	shared := PackageInfo{Name: "shared", Version: "1.0.0"}
+	devOnly := PackageInfo{Name: "dev-only", Version: "1.0.0"}
+
+	deps := []PackageInfo{
+		{Name: "app-dep", Version: "1.0.0", ResolvedDeps: map[string]PackageInfo{"shared": shared}},
+		{Name: "test-runner", Version: "1.0.0", Dev: true, ResolvedDeps: map[string]PackageInfo{
+			"shared":   shared,
+			"dev-only": devOnly,
+		}},
+	}
+
+	marked := MarkDevDependencies(deps)
+
+	tests := []struct {
+		name string
+		pkg  PackageInfo
+		want bool
+	}{
+		{name: "production root", pkg: marked[0], want: false},
+		{name: "dependency shared with production", pkg: marked[0].ResolvedDeps["shared"], want: false},
+		{name: "dev root", pkg: marked[1], want: true},
+		{name: "shared dependency under dev root", pkg: marked[1].ResolvedDeps["shared"], want: false},
+		{name: "dev-only dependency", pkg: marked[1].ResolvedDeps["dev-only"], want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pkg.Dev != tt.want {
+				t.Errorf("%s dev = %v, want %v", tt.pkg.Name, tt.pkg.Dev, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveOverrides(t *testing.T) {
+	lodash := testPackument("lodash", "4.17.21", nil)
+	lodash.Versions["4.17.20"] = testPackument("lodash", "4.17.20", nil).Versions["4.17.20"]
+	resolver := newTestResolver(t, map[string]PackageMetadata{
+		"app":    testPackument("app", "1.0.0", map[string]string{"lodash": "^4.17.0"}),
+		"lodash": lodash,
+	})
+	resolver.overrides = map[string]string{"lodash": "4.17.20"}
+
+	app, err := resolver.ResolveDependency(context.Background(), "app", "1.0.0")
+	if err != nil {
+		t.Fatalf("ResolveDependency() error = %v", err)
+	}
+	if got := app.ResolvedDeps["lodash"].Version; got != "4.17.20" {
+		t.Errorf("lodash resolved to %s, want the override's 4.17.20", got)
+	}
+}
+
+func TestResolveOptionalDependencies(t *testing.T) {
+	app := testPackument("app", "1.0.0", nil)
+	info := app.Versions["1.0.0"]
+	info.OptionalDependencies = map[string]string{
+		"native-linux": "1.0.0",
+		"native-gone":  "1.0.0",
+	}
+	app.Versions["1.0.0"] = info
+
+	resolver := newTestResolver(t, map[string]PackageMetadata{
+		"app":          app,
+		"native-linux": testPackument("native-linux", "1.0.0", nil),
+	})
+
+	deps, err := resolver.ResolveDependencies(context.Background(), []PackageInfo{
+		{Name: "app", Version: "1.0.0"},
+		{Name: "also-gone", Version: "1.0.0", Optional: true},
+	})
+	if err != nil {
+		t.Fatalf("ResolveDependencies() error = %v", err)
+	}
+	if len(deps) != 1 {
+		t.Fatalf("ResolveDependencies() returned %d packages, want 1", len(deps))
+	}
+
+	deps = MarkOptionalDependencies(deps)
+	if deps[0].Optional {
+		t.Errorf("app is marked optional")
+	}
+	native, ok := deps[0].ResolvedDeps["native-linux"]
+	if !ok || !native.Optional {
+		t.Errorf("native-linux = %+v, want an optional dependency", native)
+	}
+	if _, ok := deps[0].ResolvedDeps["native-gone"]; ok {
+		t.Errorf("native-gone failed to resolve but was kept")
+	}
+	if deps[0].OptionalDependencies["native-linux"] != "1.0.0" {
+		t.Errorf("app optionalDependencies = %v", deps[0].OptionalDependencies)
+	}
+}
+
+func TestNewestNotDeprecated(t *testing.T) {
+	metadata := &PackageMetadata{Versions: map[string]PackageInfo{
+		"1.0.0": {Version: "1.0.0"},
+		"1.1.0": {Version: "1.1.0"},
+		"1.2.0": {Version: "1.2.0", Deprecated: "use 2.x"},
+		"2.0.0": {Version: "2.0.0", Deprecated: "broken"},
+	}}
+
+	tests := []struct {
+		matches []string
+		want    string
+	}{
+		{[]string{"1.0.0", "1.1.0", "1.2.0"}, "1.1.0"},
+		{[]string{"1.0.0", "1.1.0"}, "1.1.0"},
+		// Every match is deprecated, so the newest is still used
+		{[]string{"1.2.0", "2.0.0"}, "2.0.0"},
+	}
+	for _, tt := range tests {
+		if got := newestNotDeprecated(tt.matches, metadata); got != tt.want {
+			t.Errorf("newestNotDeprecated(%v) = %s, want %s", tt.matches, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRegistryError(t *testing.T) {
+	resolver := newTestResolver(t, map[string]PackageMetadata{
+		"app": testPackument("app", "1.0.0", map[string]string{"gone": "1.0.0"}),
+	})
+
+	_, err := resolver.ResolveDependencies(context.Background(), []PackageInfo{{Name: "app", Version: "1.0.0"}})
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) || registryErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("ResolveDependencies() error = %v, want a 404 RegistryError", err)
+	}
+	if !strings.HasSuffix(registryErr.URL, "/gone") {
+		t.Errorf("RegistryError.URL = %s, want the gone packument", registryErr.URL)
+	}
+}
+
+func TestHoistReport(t *testing.T) {
+	ms2 := PackageInfo{Name: "ms", Version: "2.1.3"}
+	ms1 := PackageInfo{Name: "ms", Version: "2.0.0"}
+	debug := PackageInfo{Name: "debug", Version: "4.3.4", ResolvedDeps: map[string]PackageInfo{"ms": ms2}}
+	deps := []PackageInfo{
+		{Name: "ms", Version: "2.0.0"},
+		{Name: "a", Version: "1.0.0", ResolvedDeps: map[string]PackageInfo{"debug": debug, "ms": ms1}},
+		{Name: "b", Version: "1.0.0", ResolvedDeps: map[string]PackageInfo{"debug": debug}},
+		{Name: "c", Version: "1.0.0", ResolvedDeps: map[string]PackageInfo{"ms": ms2, "once": {Name: "once", Version: "1.4.0"}}},
+	}
+	report := &HoistReport{}
+	hoisted := hoistDependencies(deps, report)
+
+	if len(report.Hoisted) != 1 || report.Hoisted[0].Name != "debug" || strings.Join(report.Hoisted[0].Dependents, " ") != "a@1.0.0 b@1.0.0" {
+		t.Fatalf("hoisted = %+v, want debug shared by a and b", report.Hoisted)
+	}
+	if len(report.Nested) != 2 {
+		t.Fatalf("nested = %+v, want ms@2.1.3 and once", report.Nested)
+	}
+	ms := report.Nested[0]
+	if ms.Name != "ms" || ms.Version != "2.1.3" || ms.RootVersion != "2.0.0" || strings.Join(ms.RootDependents, " ") != " a@1.0.0" {
+		t.Errorf("nested ms = %+v, want it blocked by the project's and a's 2.0.0", ms)
+	}
+	if once := report.Nested[1]; once.Name != "once" || once.RootVersion != "" || strings.Join(once.Dependents, " ") != "c@1.0.0" {
+		t.Errorf("nested once = %+v, want it under its only dependent", once)
+	}
+
+	if len(hoisted) != 5 || report.Packages != 8 {
+		t.Errorf("%d root packages and %d in all, want 5 and 8", len(hoisted), report.Packages)
+	}
+	if strings.Join(strings.Fields(fmt.Sprint(report.Depths)), " ") != "[5 3]" || !strings.HasPrefix(report.Deepest, "node_modules/") {
+		t.Errorf("depths = %v, deepest %s", report.Depths, report.Deepest)
+	}
+	if rendered := RenderHoistReport(report); !strings.Contains(rendered, "node_modules has ms@2.0.0 for the project, a@1.0.0") {
+		t.Errorf("report doesn't say why ms@2.1.3 is nested:\n%s", rendered)
+	}
+}
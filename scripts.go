@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// installScripts are the lifecycle scripts run for each installed package,
+// in order
+var installScripts = []string{"preinstall", "install", "postinstall"}
+
+// Lifecycle scripts of a project or workspace rather than an installed
+// package, at the points npm runs them
+var (
+	// After the project's dependencies are installed
+	prepareScripts = []string{"preprepare", "prepare", "postprepare"}
+	// Around packing, for pack and publish alike
+	prepackScripts  = []string{"prepack", "prepare"}
+	postpackScripts = []string{"postpack"}
+	// Before packing for publish only, and after it's been published
+	prepublishScripts = []string{"prepublishOnly"}
+	publishScripts    = []string{"publish", "postpublish"}
+)
+
+// ScriptTimeoutConfig bounds how long scripts run, as durations like "10m".
+// Default applies to each install script and caladan run, Packages to the
+// scripts of the packages named instead
+type ScriptTimeoutConfig struct {
+	Default  string            `json:"default,omitempty"`
+	Packages map[string]string `json:"packages,omitempty"`
+}
+
+// scriptTimeouts is a parsed ScriptTimeoutConfig, zero means no timeout
+type scriptTimeouts struct {
+	fallback time.Duration
+	packages map[string]time.Duration
+}
+
+// parse checks the durations of a timeout config
+func (c ScriptTimeoutConfig) parse() (scriptTimeouts, error) {
+	timeouts := scriptTimeouts{packages: make(map[string]time.Duration)}
+	parse := func(what, value string) (time.Duration, error) {
+		if value == "" {
+			return 0, nil
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return 0, fmt.Errorf("script timeout for %s must be a duration like 10m, got %s", what, value)
+		}
+		return timeout, nil
+	}
+	var err error
+	if timeouts.fallback, err = parse("scripts", c.Default); err != nil {
+		return timeouts, err
+	}
+	for name, value := range c.Packages {
+		if timeouts.packages[name], err = parse(name, value); err != nil {
+			return timeouts, err
+		}
+	}
+	return timeouts, nil
+}
+
+// forPackage returns how long each of a package's scripts may run
+func (t scriptTimeouts) forPackage(name string) time.Duration {
+	if timeout, ok := t.packages[name]; ok {
+		return timeout
+	}
+	return t.fallback
+}
+
+// scriptPackage is the part of a package's package.json scripts need
+type scriptPackage struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version"`
+	Scripts map[string]string `json:"scripts"`
+}
+
+// readScriptPackage reads the package.json of an installed package
+func readScriptPackage(pkgPath string) (scriptPackage, error) {
+	var pkg scriptPackage
+	data, err := os.ReadFile(filepath.Join(pkgPath, "package.json"))
+	if err != nil {
+		return pkg, err
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return pkg, fmt.Errorf("error parsing %s: %v", filepath.Join(pkgPath, "package.json"), err)
+	}
+
+	// Like npm, a package with a binding.gyp and no install scripts is
+	// built with node-gyp
+	_, hasInstall := pkg.Scripts["install"]
+	_, hasPreinstall := pkg.Scripts["preinstall"]
+	if !hasInstall && !hasPreinstall {
+		if _, err := os.Stat(filepath.Join(pkgPath, "binding.gyp")); err == nil {
+			if pkg.Scripts == nil {
+				pkg.Scripts = map[string]string{}
+			}
+			pkg.Scripts["install"] = "node-gyp rebuild"
+		}
+	}
+	return pkg, nil
+}
+
+// npmConfigEnv converts caladan's effective configuration into the
+// npm_config_* variables that install scripts (node-pre-gyp, prebuild-install,
+// husky) read registry, proxy, cache, and platform settings from, along with
+// the variables of the configured binary mirrors. Variables the user already
+// set are left as they are
+func npmConfigEnv(opts InstallOptions) map[string]string {
+	config := map[string]string{
+		"registry":   npmRegistryURL + "/",
+		"user_agent": fmt.Sprintf("caladan/%s %s %s", version, runtime.GOOS, runtime.GOARCH),
+	}
+	if cacheDir := defaultCacheDir(); cacheDir != "" {
+		config["cache"] = cacheDir
+	}
+
+	// caladan's own requests use the standard proxy variables
+	for key, names := range map[string][]string{
+		"proxy":       {"HTTP_PROXY", "http_proxy"},
+		"https_proxy": {"HTTPS_PROXY", "https_proxy"},
+		"noproxy":     {"NO_PROXY", "no_proxy"},
+	} {
+		for _, name := range names {
+			if value := os.Getenv(name); value != "" {
+				config[key] = value
+				break
+			}
+		}
+	}
+
+	if opts.Target.OS != "" {
+		config["platform"] = opts.Target.OS
+		config["target_platform"] = opts.Target.OS
+	}
+	if opts.Target.CPU != "" {
+		config["arch"] = opts.Target.CPU
+		config["target_arch"] = opts.Target.CPU
+	}
+	if opts.Target.Libc != "" {
+		config["libc"] = opts.Target.Libc
+	}
+
+	env := make(map[string]string, len(config))
+	for key, value := range config {
+		name := "npm_config_" + key
+		if _, set := os.LookupEnv(name); !set {
+			env[name] = value
+		}
+	}
+	for name, value := range opts.binaryMirrors.env() {
+		env[name] = value
+	}
+	// The shell already takes npm_config_script_shell into account, and
+	// runScript reads it from here
+	if opts.ScriptShell != "" {
+		env["npm_config_script_shell"] = opts.ScriptShell
+	}
+	return env
+}
+
+// scriptShell returns the shell scripts run with: the one given as a flag,
+// npm_config_script_shell, or the config's, empty for the default
+func (c Config) scriptShell(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	if shell := os.Getenv("npm_config_script_shell"); shell != "" {
+		return shell
+	}
+	return c.ScriptShell
+}
+
+// shellCommand returns the command that runs script with shell, sh by
+// default, or ComSpec on Windows. Like npm, cmd.exe gets /d /s /c and any
+// other shell or interpreter gets -c
+func shellCommand(shell, script string) *exec.Cmd {
+	if shell == "" {
+		shell = "sh"
+		if runtime.GOOS == "windows" {
+			shell = os.Getenv("ComSpec")
+			if shell == "" {
+				shell = "cmd.exe"
+			}
+		}
+	}
+	// Windows paths separate with backslashes, which filepath only splits on Windows
+	name := strings.ToLower(shell[strings.LastIndexAny(shell, `/\`)+1:])
+	if name == "cmd" || name == "cmd.exe" {
+		return exec.Command(shell, "/d", "/s", "/c", script)
+	}
+	return exec.Command(shell, "-c", script)
+}
+
+// invocationEnv describes how caladan was run, for tools that look at
+// npm_execpath to tell which package manager is running them (husky, lerna,
+// only-allow) and at INIT_CWD for the directory it was run from.
+// npm_node_execpath is the node on PATH, and left out when there isn't one
+func invocationEnv() map[string]string {
+	env := make(map[string]string, 3)
+	if cwd, err := os.Getwd(); err == nil {
+		env["INIT_CWD"] = cwd
+	}
+	if executable, err := os.Executable(); err == nil {
+		env["npm_execpath"] = executable
+	}
+	if node, err := exec.LookPath("node"); err == nil {
+		if abs, err := filepath.Abs(node); err == nil {
+			env["npm_node_execpath"] = abs
+		}
+	}
+	return env
+}
+
+// scriptEnv returns the environment a script runs in: the current
+// environment plus how caladan was run and extra variables, with bin
+// directories put first on PATH
+func scriptEnv(extra map[string]string, binDirs ...string) []string {
+	invocation := invocationEnv()
+	for key, value := range extra {
+		invocation[key] = value
+	}
+	extra = invocation
+
+	env := []string{}
+	path := os.Getenv("PATH")
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, overridden := extra[key]; overridden || key == "PATH" {
+			continue
+		}
+		env = append(env, kv)
+	}
+
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+extra[key])
+	}
+
+	if len(binDirs) > 0 {
+		path = strings.Join(binDirs, string(os.PathListSeparator)) + string(os.PathListSeparator) + path
+	}
+	return append(env, "PATH="+path)
+}
+
+// shouldRunScripts reports whether install scripts run for this install,
+// explaining why not when they don't
+func shouldRunScripts(opts InstallOptions, target Platform) (bool, string) {
+	if opts.IgnoreScripts {
+		return false, "--ignore-scripts is set"
+	}
+	if target != hostPlatform() {
+		// Anything a script builds would be for the host, not the target
+		return false, fmt.Sprintf("installing for %s", target)
+	}
+	return true, ""
+}
+
+// RunInstallScripts runs the install scripts of the packages installed in
+// nodeModulesPath, each once the packages it depends on have run theirs, so
+// a package is built after its dependencies are. Packages that don't
+// depend on each other run at the same time, in opts.Jobs job slots, or
+// one at a time with ForegroundScripts so their output doesn't interleave.
+// A failing script fails its package and skips the scripts of the packages
+// depending on it, or is reported and skipped for optional packages
+func RunInstallScripts(summary *InstallSummary, packages map[string]PackageInfo, nodeModulesPath string, opts InstallOptions) {
+	paths := make([]string, 0, len(summary.Packages))
+	for _, stats := range summary.Packages {
+		paths = append(paths, stats.Path)
+	}
+	sort.Strings(paths)
+
+	// Scripts run in their package's directory, so PATH needs absolute paths
+	if abs, err := filepath.Abs(nodeModulesPath); err == nil {
+		nodeModulesPath = abs
+	}
+
+	configEnv := npmConfigEnv(opts)
+	rootBinDir := filepath.Join(nodeModulesPath, ".bin")
+	logsDir := filepath.Join(nodeModulesPath, stateDirName, scriptLogsDirName)
+	if !opts.ForegroundScripts {
+		// The logs are of this install's scripts only
+		os.RemoveAll(logsDir)
+	}
+	scriptPackages := make(map[string]scriptPackage)
+	for _, path := range paths {
+		pkg, err := readScriptPackage(filepath.Join(nodeModulesPath, strings.TrimPrefix(path, "node_modules/")))
+		if err != nil {
+			continue
+		}
+		for _, event := range installScripts {
+			if _, ok := pkg.Scripts[event]; ok {
+				scriptPackages[path] = pkg
+				break
+			}
+		}
+	}
+	if len(scriptPackages) == 0 {
+		return
+	}
+
+	jobs := opts.Jobs
+	if jobs == 0 {
+		jobs = defaultJobs()
+	}
+	if opts.ForegroundScripts {
+		jobs = 1
+	}
+	// Guards summary and the output of failed scripts. installScriptDeps
+	// breaks cycles, so there's no cycle to fail scheduling
+	var mu sync.Mutex
+	results, _ := scheduleTasks(paths, installScriptDeps(paths, packages), jobs, func(path string) bool {
+		_, ok := scriptPackages[path]
+		return ok
+	}, func(string) TaskConfig {
+		return TaskConfig{}
+	}, func(path string) error {
+		pkg := scriptPackages[path]
+		pkgPath := filepath.Join(nodeModulesPath, strings.TrimPrefix(path, "node_modules/"))
+		if err := detachFiles(pkgPath); err != nil {
+			err = fmt.Errorf("error copying its files out of the store: %v", err)
+			mu.Lock()
+			defer mu.Unlock()
+			summary.fail(path, pkg.Version, err)
+			return err
+		}
+		var log *scriptLog
+		defer func() { log.close() }()
+		for _, event := range installScripts {
+			script, ok := pkg.Scripts[event]
+			if !ok {
+				continue
+			}
+			if log == nil && !opts.ForegroundScripts {
+				var err error
+				if log, err = createScriptLog(logsDir, path); err != nil {
+					printWarning("couldn't capture the script output of %s, showing it instead: %v", path, err)
+				}
+			}
+			fmt.Printf("Running %s script of %s: %s\n", event, path, script)
+			binDirs := []string{filepath.Join(pkgPath, "node_modules", ".bin"), rootBinDir}
+			env := lifecycleEnv(opts.scriptProxy.env(configEnv, path), pkg, event, script)
+			start := time.Now()
+			err := runScript(pkgPath, script, env, opts.scriptTimeouts.forPackage(packageNameFromPath(path)), log.start(event, script), binDirs...)
+			if err == nil {
+				log.summarize(time.Since(start))
+				continue
+			}
+
+			scriptErr := newScriptError(path, event, script, err)
+			mu.Lock()
+			defer mu.Unlock()
+			log.dump(scriptErr)
+			if packages[path].Optional {
+				printWarning("Optional package %s failed to install: %v", path, scriptErr)
+				return nil
+			}
+			summary.fail(path, pkg.Version, scriptErr)
+			return scriptErr
+		}
+		return nil
+	})
+
+	for _, result := range results {
+		if result.Status != "skipped" {
+			continue
+		}
+		if packages[result.Name].Optional {
+			printWarning("Optional package %s wasn't built, a dependency's install scripts failed", result.Name)
+			continue
+		}
+		summary.fail(result.Name, scriptPackages[result.Name].Version, fmt.Errorf("install scripts didn't run, a dependency's install scripts failed"))
+	}
+}
+
+// installScriptDeps returns the packages each of paths depends on among
+// paths, found the way node's module resolution finds them. Dependency
+// cycles are allowed, so the edge that closes one, walking depth first in
+// path order, is left out, and the packages in a cycle run in that order
+func installScriptDeps(paths []string, packages map[string]PackageInfo) map[string][]string {
+	included := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		included[path] = true
+	}
+	direct := make(map[string][]string)
+	for _, path := range paths {
+		pkg := packages[path]
+		for _, section := range []map[string]string{pkg.Dependencies, pkg.OptionalDependencies, pkg.PeerDependencies} {
+			names := make([]string, 0, len(section))
+			for name := range section {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				dep, ok := findLockfileDependency(packages, path, name)
+				if ok && dep != path && included[dep] && !slices.Contains(direct[path], dep) {
+					direct[path] = append(direct[path], dep)
+				}
+			}
+		}
+	}
+
+	deps := make(map[string][]string)
+	state := make(map[string]int) // 1 while visiting, 2 once visited
+	var visit func(path string)
+	visit = func(path string) {
+		state[path] = 1
+		for _, dep := range direct[path] {
+			if state[dep] == 1 {
+				continue
+			}
+			deps[path] = append(deps[path], dep)
+			if state[dep] == 0 {
+				visit(dep)
+			}
+		}
+		state[path] = 2
+	}
+	for _, path := range paths {
+		if state[path] == 0 {
+			visit(path)
+		}
+	}
+	return deps
+}
+
+// scriptLogsDirName is where install script output is saved, in the
+// modules directory's .caladan
+const scriptLogsDirName = "logs"
+
+// scriptLog captures the output of a package's install scripts to a file,
+// so hundreds of packages' build output doesn't interleave on the terminal.
+// A nil log leaves the output on the terminal
+type scriptLog struct {
+	path  string
+	file  *os.File
+	lines lineCounter
+}
+
+// lineCounter counts the lines written through it
+type lineCounter struct {
+	w     io.Writer
+	lines int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	c.lines += bytes.Count(p, []byte("\n"))
+	return c.w.Write(p)
+}
+
+// createScriptLog creates the log of the package at a lockfile path, named
+// after the path with its slashes replaced
+func createScriptLog(dir, path string) (*scriptLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := strings.ReplaceAll(strings.TrimPrefix(path, "node_modules/"), "/", "+") + ".log"
+	logPath := filepath.Join(dir, name)
+	file, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptLog{path: logPath, file: file, lines: lineCounter{w: file}}, nil
+}
+
+// start marks the start of a script in the log and returns where its output
+// goes, nil for the terminal
+func (l *scriptLog) start(event, script string) io.Writer {
+	if l == nil {
+		return nil
+	}
+	fmt.Fprintf(l.file, "> %s: %s\n", event, script)
+	l.lines.lines = 0
+	return &l.lines
+}
+
+// summarize prints how a script that succeeded went, instead of its output
+func (l *scriptLog) summarize(elapsed time.Duration) {
+	if l == nil {
+		return
+	}
+	fmt.Println(colorDim(fmt.Sprintf("  done in %s, %d lines of output in %s", elapsed.Round(time.Millisecond), l.lines.lines, l.path)))
+}
+
+// dump prints the whole log of a package whose script failed, and points
+// the error at it
+func (l *scriptLog) dump(err *ScriptError) {
+	if l == nil {
+		return
+	}
+	err.LogPath = l.path
+	data, readErr := os.ReadFile(l.path)
+	if readErr != nil {
+		return
+	}
+	fmt.Printf("Output of the scripts of %s:\n", err.Package)
+	os.Stdout.Write(data)
+}
+
+func (l *scriptLog) close() {
+	if l != nil {
+		l.file.Close()
+	}
+}
+
+// runLifecycle runs the scripts a package in dir has for events, in order,
+// stopping at the first that fails or runs longer than timeout. Its own
+// node_modules/.bin comes before binDirs on PATH
+func runLifecycle(dir string, events []string, configEnv map[string]string, timeout time.Duration, binDirs ...string) error {
+	pkg, err := readScriptPackage(dir)
+	if err != nil {
+		return err
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	binDirs = append([]string{filepath.Join(dir, "node_modules", ".bin")}, binDirs...)
+	for i, binDir := range binDirs {
+		if abs, err := filepath.Abs(binDir); err == nil {
+			binDirs[i] = abs
+		}
+	}
+	for _, event := range events {
+		script, ok := pkg.Scripts[event]
+		if !ok {
+			continue
+		}
+		fmt.Printf("Running %s script of %s: %s\n", event, pkg.Name, script)
+		if err := runScript(dir, script, lifecycleEnv(configEnv, pkg, event, script), timeout, nil, binDirs...); err != nil {
+			return newScriptError(pkg.Name, event, script, err)
+		}
+	}
+	return nil
+}
+
+// newScriptError describes a script that failed to run, exited nonzero, or
+// was killed for running too long
+func newScriptError(path, event, script string, err error) *ScriptError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	var timeout time.Duration
+	var timeoutErr *scriptTimeoutError
+	if errors.As(err, &timeoutErr) {
+		exitCode, timeout = -1, timeoutErr.timeout
+	}
+	return &ScriptError{Package: path, Event: event, Script: script, ExitCode: exitCode, Timeout: timeout, Err: err}
+}
+
+// lifecycleEnv adds the npm_lifecycle_* and npm_package_* variables
+// describing the script being run to the config variables
+func lifecycleEnv(configEnv map[string]string, pkg scriptPackage, event, script string) map[string]string {
+	env := make(map[string]string, len(configEnv)+4)
+	for key, value := range configEnv {
+		env[key] = value
+	}
+	env["npm_lifecycle_event"] = event
+	env["npm_lifecycle_script"] = script
+	env["npm_package_name"] = pkg.Name
+	env["npm_package_version"] = pkg.Version
+	return env
+}
+
+// runScript runs a script in dir with the shell in env's
+// npm_config_script_shell, or sh, writing both its stdout and stderr to
+// output, or streaming them to the terminal when output is nil
+func runScript(dir, script string, env map[string]string, timeout time.Duration, output io.Writer, binDirs ...string) error {
+	shell, ok := env["npm_config_script_shell"]
+	if !ok {
+		shell = os.Getenv("npm_config_script_shell")
+	}
+	cmd := shellCommand(shell, script)
+	cmd.Dir = dir
+	cmd.Env = scriptEnv(env, binDirs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if output != nil {
+		cmd.Stdout = output
+		cmd.Stderr = output
+	}
+	return runWithTimeout(cmd, timeout)
+}
+
+// scriptTimeoutError reports a script killed for running too long
+type scriptTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *scriptTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.timeout)
+}
+
+// runWithTimeout runs a command in its own process group, and kills the
+// whole group once it's run for timeout, so a script's children (a compiler
+// started by node-gyp, a server started by a test) don't outlive it. Zero
+// means no timeout
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout <= 0 {
+		return cmd.Run()
+	}
+	startProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Out of the terminal's process group, Ctrl-C has to be passed on
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			signalProcessGroup(cmd.Process, sig)
+		}
+	}()
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		killProcessGroup(cmd.Process)
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	signal.Stop(signals)
+	close(signals)
+	if timedOut.Load() {
+		return &scriptTimeoutError{timeout: timeout}
+	}
+	return err
+}
+
+// lifecycleScriptNames are the scripts npm runs on its own, at install,
+// publish, version, and the like, or as its built-in commands. npm run lists
+// them apart from the project's own
+var lifecycleScriptNames = map[string]bool{
+	"preinstall": true, "install": true, "postinstall": true,
+	"preuninstall": true, "uninstall": true, "postuninstall": true,
+	"preprepare": true, "prepare": true, "postprepare": true,
+	"prepack": true, "postpack": true, "prepublish": true, "prepublishOnly": true,
+	"publish": true, "postpublish": true, "dependencies": true,
+	"preversion": true, "version": true, "postversion": true,
+	"pretest": true, "test": true, "posttest": true,
+	"prestart": true, "start": true, "poststart": true,
+	"prestop": true, "stop": true, "poststop": true,
+	"prerestart": true, "restart": true, "postrestart": true,
+}
+
+// ProjectScript is a script in a project's package.json
+type ProjectScript struct {
+	Name    string
+	Command string
+}
+
+// ProjectScripts reads the scripts of the project in directory, in the
+// order package.json has them, and its name@version
+func ProjectScripts(directory string) (string, []ProjectScript, error) {
+	packageJSONPath := filepath.Join(directory, "package.json")
+	data, err := os.ReadFile(packageJSONPath)
+	if err != nil {
+		return "", nil, err
+	}
+	var manifest struct {
+		Name    string          `json:"name"`
+		Version string          `json:"version"`
+		Scripts json.RawMessage `json:"scripts"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", nil, fmt.Errorf("error parsing %s: %v", packageJSONPath, err)
+	}
+	project := manifest.Name
+	if project == "" {
+		project = filepath.Base(directory)
+	}
+	if manifest.Version != "" {
+		project += "@" + manifest.Version
+	}
+
+	var scripts []ProjectScript
+	keys, values, _ := objectEntries(manifest.Scripts)
+	for _, name := range keys {
+		var command string
+		if err := json.Unmarshal(values[name], &command); err != nil {
+			return "", nil, fmt.Errorf("script %s in %s isn't a string", name, packageJSONPath)
+		}
+		scripts = append(scripts, ProjectScript{Name: name, Command: command})
+	}
+	return project, scripts, nil
+}
+
+// RenderScripts lists a project's scripts and their commands like npm run
+// does, its lifecycle scripts apart from the rest
+func RenderScripts(project string, scripts []ProjectScript) string {
+	if len(scripts) == 0 {
+		return fmt.Sprintf("%s has no scripts\n", colorPackage(project))
+	}
+	var lifecycle, custom []ProjectScript
+	for _, script := range scripts {
+		if lifecycleScriptNames[script.Name] {
+			lifecycle = append(lifecycle, script)
+		} else {
+			custom = append(custom, script)
+		}
+	}
+
+	var builder strings.Builder
+	group := func(heading string, scripts []ProjectScript) {
+		if len(scripts) == 0 {
+			return
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(fmt.Sprintf(heading+"\n", colorPackage(project)))
+		for _, script := range scripts {
+			builder.WriteString(fmt.Sprintf("  %s\n    %s\n", script.Name, colorDim(script.Command)))
+		}
+	}
+	group("Lifecycle scripts in %s:", lifecycle)
+	group("Custom scripts in %s:", custom)
+	return builder.String()
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNpmConfigEnv(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", "/tmp/caladan-cache")
+	t.Setenv("HTTPS_PROXY", "http://proxy.internal:3128")
+	t.Setenv("npm_config_registry", "https://mirror.internal/")
+	t.Setenv("SASS_BINARY_SITE", "https://sass.internal/")
+
+	env := npmConfigEnv(InstallOptions{Target: Platform{OS: "linux", CPU: "arm64"}, binaryMirrors: BinaryMirrors{
+		"electron":      "https://electron.internal/",
+		"node-sass":     "https://mirror.internal/node-sass/",
+		"@scope/native": "https://mirror.internal/native/",
+	}})
+	want := map[string]string{
+		"npm_config_cache":                           "/tmp/caladan-cache",
+		"npm_config_https_proxy":                     "http://proxy.internal:3128",
+		"npm_config_target_platform":                 "linux",
+		"npm_config_target_arch":                     "arm64",
+		"ELECTRON_MIRROR":                            "https://electron.internal/",
+		"npm_config_electron_mirror":                 "https://electron.internal/",
+		"npm_config_scope_native_binary_host_mirror": "https://mirror.internal/native/",
+	}
+	for key, value := range want {
+		if env[key] != value {
+			t.Errorf("%s = %q, want %q", key, env[key], value)
+		}
+	}
+	if _, ok := env["npm_config_registry"]; ok {
+		t.Errorf("npm_config_registry overrode the user's setting")
+	}
+	if _, ok := env["SASS_BINARY_SITE"]; ok {
+		t.Errorf("SASS_BINARY_SITE overrode the user's setting")
+	}
+}
+
+// writeScriptPackage fakes an installed package with the given scripts
+func writeScriptPackage(t *testing.T, nodeModulesPath, name, scripts string) {
+	t.Helper()
+	writeTestFile(t, filepath.Join(nodeModulesPath, name, "package.json"),
+		`{"name":"`+name+`","version":"1.0.0","scripts":{`+scripts+`}}`)
+}
+
+func TestRunInstallScripts(t *testing.T) {
+	// Restored when the test ends
+	t.Setenv("npm_config_registry", "")
+	os.Unsetenv("npm_config_registry")
+
+	nodeModulesPath := t.TempDir()
+	writeScriptPackage(t, nodeModulesPath, "built", `"preinstall":"echo pre > order","postinstall":"echo $npm_lifecycle_event $npm_package_name $npm_config_registry >> order"`)
+	writeScriptPackage(t, nodeModulesPath, "broken", `"install":"exit 3","postinstall":"touch ran"`)
+	writeScriptPackage(t, nodeModulesPath, "optional", `"install":"exit 1"`)
+	writeScriptPackage(t, nodeModulesPath, "plain", `"test":"exit 1"`)
+
+	summary := &InstallSummary{}
+	packages := map[string]PackageInfo{}
+	for _, name := range []string{"built", "broken", "optional", "plain"} {
+		summary.add(PackageStats{Path: "node_modules/" + name, Version: "1.0.0"})
+		packages["node_modules/"+name] = PackageInfo{Version: "1.0.0", Optional: name == "optional"}
+	}
+
+	RunInstallScripts(summary, packages, nodeModulesPath, InstallOptions{})
+
+	got := readTestFile(t, filepath.Join(nodeModulesPath, "built", "order"))
+	if want := "pre\npostinstall built " + npmRegistryURL + "/\n"; got != want {
+		t.Errorf("built scripts wrote %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(nodeModulesPath, "broken", "ran")); !os.IsNotExist(err) {
+		t.Errorf("postinstall ran after install failed")
+	}
+	if len(summary.Failed) != 1 || summary.Failed[0].Path != "node_modules/broken" || !strings.Contains(summary.Failed[0].Error, "install script failed") {
+		t.Errorf("Failed = %+v, want only broken", summary.Failed)
+	}
+	var scriptErr *ScriptError
+	if len(summary.Failed) == 1 && (!errors.As(summary.Failed[0].err, &scriptErr) || scriptErr.ExitCode != 3 || scriptErr.Event != "install") {
+		t.Errorf("broken error = %+v, want install exiting with 3", scriptErr)
+	}
+}
+
+func TestInstallScriptsDontWriteToStore(t *testing.T) {
+	store := NewStore(t.TempDir(), importHardlink)
+	index := newPackageIndex()
+	for name, content := range map[string]string{
+		"package.json": `{"name":"built","version":"1.0.0","scripts":{"postinstall":"echo patched >> index.js"}}`,
+		"index.js":     "module.exports = 1\n",
+	} {
+		file, err := store.addFile(strings.NewReader(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.Files[name] = file
+	}
+
+	nodeModulesPath := t.TempDir()
+	if _, err := store.linkPackage(index, filepath.Join(nodeModulesPath, "built")); err != nil {
+		t.Fatal(err)
+	}
+	summary := &InstallSummary{}
+	summary.add(PackageStats{Path: "node_modules/built", Version: "1.0.0"})
+	RunInstallScripts(summary, map[string]PackageInfo{"node_modules/built": {Version: "1.0.0"}}, nodeModulesPath, InstallOptions{})
+
+	if got := readTestFile(t, filepath.Join(nodeModulesPath, "built", "index.js")); got != "module.exports = 1\npatched\n" {
+		t.Errorf("installed index.js = %q, want the script's change", got)
+	}
+	if got := readTestFile(t, store.blobPath(index.Files["index.js"])); got != "module.exports = 1\n" {
+		t.Errorf("stored index.js = %q, want it untouched by the script", got)
+	}
+}
+
+func TestInstallScriptLogs(t *testing.T) {
+	nodeModulesPath := t.TempDir()
+	writeScriptPackage(t, nodeModulesPath, "@scope/noisy", `"install":"echo building; echo warning >&2","postinstall":"echo done"`)
+	writeScriptPackage(t, nodeModulesPath, "broken", `"install":"echo gyp ERR!; exit 1"`)
+
+	summary := &InstallSummary{}
+	packages := map[string]PackageInfo{}
+	for _, path := range []string{"node_modules/@scope/noisy", "node_modules/broken"} {
+		summary.add(PackageStats{Path: path, Version: "1.0.0"})
+		packages[path] = PackageInfo{Version: "1.0.0"}
+	}
+	RunInstallScripts(summary, packages, nodeModulesPath, InstallOptions{})
+
+	logsDir := filepath.Join(nodeModulesPath, stateDirName, scriptLogsDirName)
+	if log := readTestFile(t, filepath.Join(logsDir, "@scope+noisy.log")); log != "> install: echo building; echo warning >&2\nbuilding\nwarning\n> postinstall: echo done\ndone\n" {
+		t.Errorf("noisy log = %q", log)
+	}
+	var scriptErr *ScriptError
+	if len(summary.Failed) != 1 || !errors.As(summary.Failed[0].err, &scriptErr) {
+		t.Fatalf("Failed = %+v, want broken", summary.Failed)
+	}
+	if want := filepath.Join(logsDir, "broken.log"); scriptErr.LogPath != want || !strings.Contains(scriptErr.Error(), "see "+want) {
+		t.Errorf("broken error = %v, want it to point at %s", scriptErr, want)
+	}
+}
+
+func TestInstallScriptOrder(t *testing.T) {
+	nodeModulesPath := t.TempDir()
+	// app needs native, which needs bindings (no scripts) whose nested
+	// node-gyp-build has to be built first. lone has nothing to wait for
+	writeScriptPackage(t, nodeModulesPath, "app", `"postinstall":"cat ../native/built > built"`)
+	writeScriptPackage(t, nodeModulesPath, "native", `"install":"sleep 0.1; cat ../bindings/node_modules/node-gyp-build/built > built"`)
+	writeScriptPackage(t, nodeModulesPath, "bindings", ``)
+	writeScriptPackage(t, nodeModulesPath, "bindings/node_modules/node-gyp-build", `"install":"echo ok > built"`)
+	writeScriptPackage(t, nodeModulesPath, "lone", `"install":"touch ../native/lone"`)
+
+	packages := map[string]PackageInfo{
+		"node_modules/app":                                  {Dependencies: map[string]string{"native": "^1.0.0"}},
+		"node_modules/native":                               {Dependencies: map[string]string{"bindings": "^1.0.0"}},
+		"node_modules/bindings":                             {Dependencies: map[string]string{"node-gyp-build": "^4.0.0"}},
+		"node_modules/bindings/node_modules/node-gyp-build": {},
+		"node_modules/lone":                                 {},
+	}
+	summary := &InstallSummary{}
+	for path := range packages {
+		summary.add(PackageStats{Path: path, Version: "1.0.0"})
+	}
+	RunInstallScripts(summary, packages, nodeModulesPath, InstallOptions{Jobs: 4})
+
+	if len(summary.Failed) != 0 {
+		t.Fatalf("Failed = %+v", summary.Failed)
+	}
+	if got := readTestFile(t, filepath.Join(nodeModulesPath, "app", "built")); got != "ok\n" {
+		t.Errorf("app built %q, want its dependencies built first", got)
+	}
+	// lone doesn't wait for native's slow install
+	if _, err := os.Stat(filepath.Join(nodeModulesPath, "native", "lone")); err != nil {
+		t.Errorf("lone didn't run: %v", err)
+	}
+}
+
+func TestInstallScriptDeps(t *testing.T) {
+	packages := map[string]PackageInfo{
+		"node_modules/a": {Dependencies: map[string]string{"b": "1"}},
+		"node_modules/b": {Dependencies: map[string]string{"a": "1"}, PeerDependencies: map[string]string{"c": "1"}},
+		"node_modules/c": {OptionalDependencies: map[string]string{"missing": "1"}},
+	}
+	deps := installScriptDeps([]string{"node_modules/a", "node_modules/b", "node_modules/c"}, packages)
+	// The cycle is broken where it closes, at b -> a
+	want := map[string][]string{"node_modules/a": {"node_modules/b"}, "node_modules/b": {"node_modules/c"}}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("installScriptDeps() = %v, want %v", deps, want)
+	}
+}
+
+func TestInstallScriptsSkipDependents(t *testing.T) {
+	nodeModulesPath := t.TempDir()
+	writeScriptPackage(t, nodeModulesPath, "broken", `"install":"exit 1"`)
+	writeScriptPackage(t, nodeModulesPath, "app", `"install":"touch ran"`)
+	packages := map[string]PackageInfo{
+		"node_modules/app":    {Dependencies: map[string]string{"broken": "1"}},
+		"node_modules/broken": {},
+	}
+	summary := &InstallSummary{}
+	for path := range packages {
+		summary.add(PackageStats{Path: path, Version: "1.0.0"})
+	}
+	RunInstallScripts(summary, packages, nodeModulesPath, InstallOptions{})
+
+	if _, err := os.Stat(filepath.Join(nodeModulesPath, "app", "ran")); !os.IsNotExist(err) {
+		t.Errorf("app's install ran after its dependency failed")
+	}
+	failed := sortedFailures(summary.Failed)
+	if len(failed) != 2 || failed[0].Path != "node_modules/app" || !strings.Contains(failed[0].Error, "a dependency's install scripts failed") {
+		t.Errorf("Failed = %+v, want broken and app", failed)
+	}
+}
+
+func TestShouldRunScripts(t *testing.T) {
+	if ok, _ := shouldRunScripts(InstallOptions{}, hostPlatform()); !ok {
+		t.Error("scripts don't run for the host")
+	}
+	if ok, _ := shouldRunScripts(InstallOptions{IgnoreScripts: true}, hostPlatform()); ok {
+		t.Error("scripts run with --ignore-scripts")
+	}
+	other := hostPlatform()
+	other.OS = "win32"
+	if ok, _ := shouldRunScripts(InstallOptions{}, other); ok {
+		t.Error("scripts run when installing for another platform")
+	}
+}
+
+func TestRunLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "app", "scripts": {"prepare": "echo $npm_lifecycle_event >> log", "postprepare": "exit 2"}}`)
+
+	err := runLifecycle(dir, prepareScripts, nil, 0)
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || scriptErr.Event != "postprepare" || scriptErr.ExitCode != 2 {
+		t.Fatalf("runLifecycle() error = %v, want postprepare to fail", err)
+	}
+	if log, _ := os.ReadFile(filepath.Join(dir, "log")); string(log) != "prepare\n" {
+		t.Errorf("log = %q, want prepare to have run", log)
+	}
+
+	if err := runLifecycle(t.TempDir(), prepareScripts, nil, 0); !os.IsNotExist(err) {
+		t.Errorf("runLifecycle() without a package.json error = %v", err)
+	}
+}
+
+func TestRunLifecycleScriptShell(t *testing.T) {
+	// A custom interpreter gets -c and the script, like sh
+	shellDir := t.TempDir()
+	shell := filepath.Join(shellDir, "fake-shell")
+	writeTestFile(t, shell, "#!/bin/sh\necho \"$1 $2\" > \"$(dirname \"$0\")/ran\"\n")
+	if err := os.Chmod(shell, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "app", "scripts": {"prepare": "build all"}}`)
+	configEnv := npmConfigEnv(InstallOptions{ScriptShell: shell})
+	if err := runLifecycle(dir, prepareScripts, configEnv, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(shellDir, "ran")); got != "-c build all\n" {
+		t.Errorf("shell ran with %q, want -c and the script", got)
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  []string
+	}{
+		{shell: "bash", want: []string{"bash", "-c", "echo hi"}},
+		{shell: "/usr/bin/dash", want: []string{"/usr/bin/dash", "-c", "echo hi"}},
+		{shell: `C:\Windows\System32\cmd.exe`, want: []string{`C:\Windows\System32\cmd.exe`, "/d", "/s", "/c", "echo hi"}},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct {
+			shell string
+			want  []string
+		}{shell: "", want: []string{"sh", "-c", "echo hi"}})
+	}
+	for _, tt := range tests {
+		if got := shellCommand(tt.shell, "echo hi").Args; strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("shellCommand(%q) = %q, want %q", tt.shell, got, tt.want)
+		}
+	}
+}
+
+func TestScriptEnvInvocation(t *testing.T) {
+	cwd, _ := os.Getwd()
+	executable, _ := os.Executable()
+	t.Setenv("npm_execpath", "/usr/lib/node_modules/npm/bin/npm-cli.js")
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "app", "scripts": {"prepare": "echo \"$INIT_CWD|$npm_execpath\" > log"}}`)
+	if err := runLifecycle(dir, prepareScripts, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The script runs in the package, but INIT_CWD is where caladan ran, and
+	// npm_execpath is caladan even when run from an npm script
+	if log := readTestFile(t, filepath.Join(dir, "log")); log != cwd+"|"+executable+"\n" {
+		t.Errorf("log = %q", log)
+	}
+
+	// Variables a caller passes win
+	for _, kv := range scriptEnv(map[string]string{"INIT_CWD": "/elsewhere"}) {
+		if strings.HasPrefix(kv, "INIT_CWD=") && kv != "INIT_CWD=/elsewhere" {
+			t.Errorf("%s, want the caller's INIT_CWD", kv)
+		}
+	}
+}
+
+func TestScriptTimeouts(t *testing.T) {
+	timeouts, err := ScriptTimeoutConfig{Default: "10m", Packages: map[string]string{"esbuild": "30s", "@swc/core": "0"}}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]time.Duration{"left-pad": 10 * time.Minute, "esbuild": 30 * time.Second, "@swc/core": 0} {
+		if got := timeouts.forPackage(name); got != want {
+			t.Errorf("forPackage(%s) = %s, want %s", name, got, want)
+		}
+	}
+	if _, err := (ScriptTimeoutConfig{Packages: map[string]string{"esbuild": "soon"}}).parse(); err == nil {
+		t.Error("parse() accepted a timeout that isn't a duration")
+	}
+}
+
+func TestRunLifecycleTimeout(t *testing.T) {
+	dir := t.TempDir()
+	// The background subshell is in the script's process group, so it's
+	// killed along with the script before it can write late
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "app", "scripts": {"prepare": "(sleep 1; touch late) & wait"}}`)
+
+	err := runLifecycle(dir, prepareScripts, nil, 200*time.Millisecond)
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || scriptErr.Timeout != 200*time.Millisecond {
+		t.Fatalf("runLifecycle() error = %v, want a timeout", err)
+	}
+	if !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Errorf("error = %q", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "late")); err == nil {
+		t.Error("the script's child outlived the timeout")
+	}
+}
+
+func TestProjectScripts(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name":"app","version":"1.0.0","scripts":{"test":"jest","build":"tsc","postinstall":"patch-package","lint":"eslint ."}}`)
+
+	project, scripts, err := ProjectScripts(dir)
+	if err != nil {
+		t.Fatalf("ProjectScripts() error = %v", err)
+	}
+	if project != "app@1.0.0" || len(scripts) != 4 || scripts[1] != (ProjectScript{Name: "build", Command: "tsc"}) {
+		t.Fatalf("ProjectScripts() = %q, %v, want app@1.0.0 and the scripts in package.json order", project, scripts)
+	}
+
+	setColor(t, false)
+	want := `Lifecycle scripts in app@1.0.0:
+  test
+    jest
+  postinstall
+    patch-package
+
+Custom scripts in app@1.0.0:
+  build
+    tsc
+  lint
+    eslint .
+`
+	if got := RenderScripts(project, scripts); got != want {
+		t.Errorf("RenderScripts() = %q, want %q", got, want)
+	}
+}
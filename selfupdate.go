@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Set at release build time with -ldflags "-X main.version=... -X
+// main.releasePublicKey=...". Development builds have neither
+var (
+	version          = "dev"
+	releasePublicKey = "" // base64 ed25519 key that signs checksums.txt
+)
+
+// defaultReleasesURL is the project's latest release, overridable with
+// CALADAN_RELEASES_URL for mirrors
+const defaultReleasesURL = "https://api.github.com/repos/healeycodes/caladan/releases/latest"
+
+// Release assets next to the binaries. checksums.txt is in sha256sum format
+// and checksums.txt.sig is its base64 ed25519 signature
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// SelfUpdateOptions configures caladan self-update
+type SelfUpdateOptions struct {
+	Check         bool // Only report whether an update is available
+	Force         bool // Reinstall or downgrade to the latest release
+	AllowUnsigned bool // Update even though this build has no release key
+
+	// Overridden by tests
+	executable  string
+	releasesURL string
+	publicKey   string
+}
+
+// release is the part of a GitHub release caladan needs
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// asset returns the URL of a release asset
+func (r release) asset(name string) (string, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, true
+		}
+	}
+	return "", false
+}
+
+// binaryAssetName returns the name of the release binary for this platform
+func binaryAssetName() string {
+	return fmt.Sprintf("caladan_%s_%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// SelfUpdate replaces the running caladan with the latest release
+func SelfUpdate(opts SelfUpdateOptions) error {
+	releasesURL := opts.releasesURL
+	if releasesURL == "" {
+		releasesURL = os.Getenv("CALADAN_RELEASES_URL")
+	}
+	if releasesURL == "" {
+		releasesURL = defaultReleasesURL
+	}
+	publicKey := opts.publicKey
+	if publicKey == "" {
+		publicKey = releasePublicKey
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	data, err := fetchReleaseAsset(client, releasesURL)
+	if err != nil {
+		return fmt.Errorf("error checking for releases: %v", err)
+	}
+	var latest release
+	if err := json.Unmarshal(data, &latest); err != nil {
+		return fmt.Errorf("error parsing release: %v", err)
+	}
+
+	latestVersion := strings.TrimPrefix(latest.TagName, "v")
+	installed := strings.TrimPrefix(version, "v")
+	// Development builds have no version to compare, so any release replaces them
+	cmp, comparable := compareSemver(latestVersion, installed)
+	if (latestVersion == installed || comparable && cmp == 0) && !opts.Force {
+		fmt.Printf("caladan %s is the latest version\n", version)
+		return nil
+	}
+	if comparable && cmp < 0 && !opts.Force {
+		if opts.Check {
+			fmt.Printf("caladan %s is newer than the latest release %s\n", version, latestVersion)
+			return nil
+		}
+		return fmt.Errorf("the latest release %s is older than caladan %s, use --force to downgrade", latestVersion, version)
+	}
+	if opts.Check {
+		fmt.Printf("caladan %s is available (installed: %s)\n", latestVersion, version)
+		return nil
+	}
+	if publicKey == "" && !opts.AllowUnsigned {
+		return fmt.Errorf("this build has no release key to check the release signature with, use --allow-unsigned to update anyway")
+	}
+
+	name := binaryAssetName()
+	binaryURL, ok := latest.asset(name)
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s", latest.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	checksumsURL, ok := latest.asset(checksumsAsset)
+	if !ok {
+		return fmt.Errorf("release %s has no %s", latest.TagName, checksumsAsset)
+	}
+
+	checksums, err := fetchReleaseAsset(client, checksumsURL)
+	if err != nil {
+		return fmt.Errorf("error downloading checksums: %v", err)
+	}
+	if publicKey != "" {
+		signatureURL, ok := latest.asset(signatureAsset)
+		if !ok {
+			return fmt.Errorf("release %s isn't signed", latest.TagName)
+		}
+		signature, err := fetchReleaseAsset(client, signatureURL)
+		if err != nil {
+			return fmt.Errorf("error downloading signature: %v", err)
+		}
+		if err := verifyChecksumsSignature(checksums, signature, publicKey); err != nil {
+			return err
+		}
+	} else {
+		printWarning("not checking the release signature, this build has no release key")
+	}
+
+	expected, err := findChecksum(checksums, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Downloading caladan %s\n", latestVersion)
+	binary, err := fetchReleaseAsset(client, binaryURL)
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", name, err)
+	}
+	actual := sha256.Sum256(binary)
+	if !bytes.Equal(actual[:], expected) {
+		return fmt.Errorf("checksum mismatch for %s: expected %x, got %x", name, expected, actual)
+	}
+
+	executable := opts.executable
+	if executable == "" {
+		executable, err = os.Executable()
+		if err != nil {
+			return fmt.Errorf("error finding caladan executable: %v", err)
+		}
+	}
+	if err := replaceExecutable(executable, binary); err != nil {
+		return fmt.Errorf("error replacing %s: %v", executable, err)
+	}
+	fmt.Println(colorSuccess(fmt.Sprintf("Updated caladan %s to %s", version, latestVersion)))
+	return nil
+}
+
+// fetchReleaseAsset GETs a release document or asset
+func fetchReleaseAsset(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// verifyChecksumsSignature checks checksums.txt against its signature
+func verifyChecksumsSignature(checksums, signature []byte, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid release public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("error decoding release signature: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), checksums, sig) {
+		return fmt.Errorf("release signature doesn't match %s", checksumsAsset)
+	}
+	return nil
+}
+
+// findChecksum returns the sha256 of name from a sha256sum-format file
+func findChecksum(checksums []byte, name string) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Binary mode entries mark the name with a '*'
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			sum, err := hex.DecodeString(fields[0])
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("invalid checksum for %s", name)
+			}
+			return sum, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no checksum for %s", checksumsAsset, name)
+}
+
+// replaceExecutable writes the new binary next to the old one and renames
+// it into place, so the executable is never half-written
+func replaceExecutable(executable string, binary []byte) error {
+	// Replace the real file rather than a symlink to it
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(executable), ".caladan-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), executable)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// releaseServer serves a release of caladan 9.9.9 for this platform
+func releaseServer(t *testing.T, binary string, key ed25519.PrivateKey, tamper bool) *httptest.Server {
+	t.Helper()
+
+	sum := sha256.Sum256([]byte(binary))
+	checksums := fmt.Sprintf("%x  %s\n%x  caladan_other_arch\n", sum, binaryAssetName(), sha256.Sum256(nil))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(checksums)))
+	if tamper {
+		binary += "!"
+	}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest":
+			json.NewEncoder(w).Encode(release{TagName: "v9.9.9", Assets: []releaseAsset{
+				{Name: binaryAssetName(), URL: server.URL + "/binary"},
+				{Name: checksumsAsset, URL: server.URL + "/checksums"},
+				{Name: signatureAsset, URL: server.URL + "/signature"},
+			}})
+		case "/binary":
+			w.Write([]byte(binary))
+		case "/checksums":
+			w.Write([]byte(checksums))
+		case "/signature":
+			w.Write([]byte(signature))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSelfUpdate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		key           ed25519.PrivateKey
+		tamper        bool
+		noPublicKey   bool
+		allowUnsigned bool
+		installed     string
+		force         bool
+		wantErr       string
+	}{
+		{name: "verified", key: privateKey},
+		{name: "tampered binary", key: privateKey, tamper: true, wantErr: "checksum mismatch"},
+		{name: "wrong signing key", key: otherKey, wantErr: "signature"},
+		{name: "no release key", key: privateKey, noPublicKey: true, wantErr: "no release key"},
+		{name: "no release key allowed", key: privateKey, noPublicKey: true, allowUnsigned: true},
+		{name: "downgrade", key: privateKey, installed: "v10.0.0", wantErr: "older"},
+		{name: "forced downgrade", key: privateKey, installed: "v10.0.0", force: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := releaseServer(t, "new caladan", tt.key, tt.tamper)
+			executable := filepath.Join(t.TempDir(), "caladan")
+			writeTestFile(t, executable, "old caladan")
+
+			if tt.installed != "" {
+				defer func(previous string) { version = previous }(version)
+				version = tt.installed
+			}
+			key := base64.StdEncoding.EncodeToString(publicKey)
+			if tt.noPublicKey {
+				key = ""
+			}
+
+			err := SelfUpdate(SelfUpdateOptions{
+				Force:         tt.force,
+				AllowUnsigned: tt.allowUnsigned,
+				executable:    executable,
+				releasesURL:   server.URL + "/latest",
+				publicKey:     key,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SelfUpdate() error = %v, want %q", err, tt.wantErr)
+				}
+				if got := readTestFile(t, executable); got != "old caladan" {
+					t.Errorf("executable = %q after a failed update, want it unchanged", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SelfUpdate() error = %v", err)
+			}
+			if got := readTestFile(t, executable); got != "new caladan" {
+				t.Errorf("executable = %q, want the new release", got)
+			}
+		})
+	}
+}
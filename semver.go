@@ -1,58 +1,510 @@
 package main
 
 import (
-	"bytes"
-	"context"
 	"fmt"
-	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+)
 
-	"golang.org/x/sync/semaphore"
+// Versions and ranges follow node's semver package (without its loose and
+// includePrerelease options), so ranges resolve the way npm resolves them
+const (
+	semverNumber     = `0|[1-9]\d*`
+	semverIdentifier = `(?:0|[1-9]\d*|\d*[a-zA-Z-][a-zA-Z0-9-]*)`
+	semverPrerelease = `(?:-(` + semverIdentifier + `(?:\.` + semverIdentifier + `)*))`
+	semverBuild      = `(?:\+([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))`
+	// A version in a range, where x, X, or * stand for any number and
+	// trailing parts can be left out, like 1.x or 2. It captures the major,
+	// minor, patch, prerelease, and build
+	semverPartial = `[v=\s]*(` + semverNumber + `|x|X|\*)(?:\.(` + semverNumber + `|x|X|\*)(?:\.(` + semverNumber + `|x|X|\*)` +
+		semverPrerelease + `?` + semverBuild + `?)?)?`
 )
 
-var semverSemaphore = semaphore.NewWeighted(64)
+var (
+	fullVersionPattern = regexp.MustCompile(`^v?(` + semverNumber + `)\.(` + semverNumber + `)\.(` + semverNumber + `)` + semverPrerelease + `?` + semverBuild + `?$`)
+	coercePattern      = regexp.MustCompile(`(?:^|[^\d])(\d{1,16})(?:\.(\d{1,16}))?(?:\.(\d{1,16}))?(?:$|[^\d])`)
+	hyphenRangePattern = regexp.MustCompile(`^\s*(` + semverPartial + `)\s+-\s+(` + semverPartial + `)\s*$`)
+	caretPattern       = regexp.MustCompile(`^\^` + semverPartial + `$`)
+	tildePattern       = regexp.MustCompile(`^~>?` + semverPartial + `$`)
+	xRangePattern      = regexp.MustCompile(`^([<>]?=?)\s*` + semverPartial + `$`)
+	comparatorPattern  = regexp.MustCompile(`^([<>]?=?)\s*(v?(?:` + semverNumber + `)\.(?:` + semverNumber + `)\.(?:` + semverNumber + `)` + semverPrerelease + `?` + semverBuild + `?)$`)
+	// The space allowed between an operator and its version
+	operatorSpacePattern = regexp.MustCompile(`(\s*)([<>]?=?)\s*(` + semverPartial + `)`)
+	tildeSpacePattern    = regexp.MustCompile(`(\s*)~>?\s+`)
+	caretSpacePattern    = regexp.MustCompile(`(\s*)\^\s+`)
+	// >=0.0.0 and * are any version
+	anyVersionPattern = regexp.MustCompile(`^\s*>=\s*0\.0\.0\s*$`)
+	starPattern       = regexp.MustCompile(`(<|>)?=?\s*\*`)
+)
 
-// RunSemver executes the semver command with given arguments and returns the output
-func RunSemver(args ...string) (string, error) {
-	err := semverSemaphore.Acquire(context.Background(), 1)
-	defer semverSemaphore.Release(1)
+// IsValidSemver returns true if the version string can be coerced into a valid semver
+func IsValidSemver(version string) bool {
+	_, ok := coerceSemver(version)
+	return ok
+}
 
+// coerceSemver finds the first version-like run of numbers in a string, like
+// semver.coerce, so 1.2 is 1.2.0 and v3-beta is 3.0.0
+func coerceSemver(version string) (string, bool) {
+	match := coercePattern.FindStringSubmatch(version)
+	if match == nil {
+		return "", false
+	}
+	parts := []string{match[1], "0", "0"}
+	for i, part := range match[2:] {
+		if part != "" {
+			parts[i+1] = part
+		}
+	}
+	// Leading zeros aren't dropped, so 01.2 isn't a version
+	coerced := strings.Join(parts, ".")
+	_, ok := parseStrictSemver(coerced)
+	return coerced, ok
+}
+
+// GetMatchingVersions returns all versions that match the given version
+// string, oldest first. Versions that aren't valid semver are left out. It
+// fails when the range isn't valid, which is how callers tell a dist tag
+// from a range, or when nothing matches
+func GetMatchingVersions(version string, versions []string) ([]string, error) {
+	versionRange, err := parseRange(version)
 	if err != nil {
-		return "", fmt.Errorf("semver semaphore error: %v", err)
+		return []string{}, err
 	}
 
-	cmd := exec.Command("node", append([]string{"./node_modules/semver/bin/semver.js"}, args...)...)
+	type candidate struct {
+		raw    string
+		parsed parsedSemver
+	}
+	candidates := []candidate{}
+	for _, raw := range versions {
+		parsed, ok := parseStrictSemver(raw)
+		if ok && versionRange.test(parsed) {
+			candidates = append(candidates, candidate{raw, parsed})
+		}
+	}
+	if len(candidates) == 0 {
+		return []string{}, fmt.Errorf("no versions match %q", version)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].parsed.compare(candidates[j].parsed) < 0
+	})
+	matches := make([]string, len(candidates))
+	for i, c := range candidates {
+		matches[i] = c.raw
+	}
+	return matches, nil
+}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// semverRange is a parsed range: sets of comparators separated by ||, any
+// one of which a version has to satisfy all of
+type semverRange [][]semverComparator
 
-	err = cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("semver error: %v\nstdout: %s\nstderr: %s",
-			err, stdout.String(), stderr.String())
+// semverComparator is an operator and a version, or any version at all
+type semverComparator struct {
+	operator string // <, <=, >, >=, or empty for equal
+	version  parsedSemver
+	any      bool
+}
+
+// parseRange parses a range the way node's semver does: hyphen ranges, x
+// ranges, ~ and ^ are rewritten into plain comparators first
+func parseRange(versionRange string) (semverRange, error) {
+	versionRange = strings.Join(strings.Fields(versionRange), " ")
+	var parsed semverRange
+	for _, set := range strings.Split(versionRange, "||") {
+		comparators, err := parseComparatorSet(strings.TrimSpace(set))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %v", versionRange, err)
+		}
+		parsed = append(parsed, comparators)
 	}
-	return strings.TrimSpace(stdout.String()), nil
+	// Like node's semver, a set that allows any version replaces the
+	// others, so the prereleases they'd have let in no longer match
+	for _, set := range parsed {
+		if isAnySet(set) {
+			return semverRange{set}, nil
+		}
+	}
+	return parsed, nil
 }
 
-// IsValidSemver returns true if the version string can be coerced into a valid semver
-func IsValidSemver(version string) bool {
-	_, err := RunSemver("-c", version)
-	return err == nil
+// isAnySet reports whether a set of comparators allows any version
+func isAnySet(set []semverComparator) bool {
+	for _, comparator := range set {
+		if !comparator.any {
+			return false
+		}
+	}
+	return true
 }
 
-// GetMatchingVersions returns all versions that match the given version string
-func GetMatchingVersions(version string, versions []string) ([]string, error) {
-	// Always try version range matching first
-	versionArgs := []string{"-r", version}
-	versionArgs = append(versionArgs, versions...)
-	matchingVersions, err := RunSemver(versionArgs...)
+func parseComparatorSet(set string) ([]semverComparator, error) {
+	if match := hyphenRangePattern.FindStringSubmatch(set); match != nil {
+		set = replaceHyphen(match)
+	}
+	set = operatorSpacePattern.ReplaceAllString(set, "${1}${2}${3}")
+	set = tildeSpacePattern.ReplaceAllString(set, "${1}~")
+	set = caretSpacePattern.ReplaceAllString(set, "${1}^")
 
-	// If it fails, it could be a dist tag or invalid version
-	// Let the caller handle the error and check for dist tags
-	if err != nil {
-		return []string{}, err
+	var expanded []string
+	for _, comparator := range strings.Split(set, " ") {
+		comparator = replaceStars(replaceXRange(replaceTilde(replaceCaret(comparator))))
+		expanded = append(expanded, comparator)
+	}
+
+	var comparators []semverComparator
+	for _, comparator := range strings.Fields(strings.Join(expanded, " ")) {
+		if anyVersionPattern.MatchString(comparator) {
+			comparator = ""
+		}
+		parsed, err := parseComparator(comparator)
+		if err != nil {
+			return nil, err
+		}
+		comparators = append(comparators, parsed)
 	}
+	if len(comparators) == 0 {
+		comparators = append(comparators, semverComparator{any: true})
+	}
+	return comparators, nil
+}
+
+func parseComparator(comparator string) (semverComparator, error) {
+	if comparator == "" {
+		return semverComparator{any: true}, nil
+	}
+	match := comparatorPattern.FindStringSubmatch(comparator)
+	if match == nil {
+		return semverComparator{}, fmt.Errorf("%q isn't a comparator", comparator)
+	}
+	version, ok := parseStrictSemver(match[2])
+	if !ok {
+		return semverComparator{}, fmt.Errorf("%q isn't a version", match[2])
+	}
+	operator := match[1]
+	if operator == "=" {
+		operator = ""
+	}
+	return semverComparator{operator: operator, version: version}, nil
+}
+
+// isX reports whether a part of a partial version matches anything
+func isX(part string) bool {
+	return part == "" || part == "x" || part == "X" || part == "*"
+}
+
+// inc adds one to a numeric part of a version
+func inc(part string) int {
+	n, _ := strconv.Atoi(part)
+	return n + 1
+}
+
+// replaceHyphen turns 1.2 - 2.3.4 into >=1.2.0 <=2.3.4
+func replaceHyphen(match []string) string {
+	from, fM, fm, fp := match[1], match[2], match[3], match[4]
+	to, tM, tm, tp, tpr := match[7], match[8], match[9], match[10], match[11]
+	switch {
+	case isX(fM):
+		from = ""
+	case isX(fm):
+		from = fmt.Sprintf(">=%s.0.0", fM)
+	case isX(fp):
+		from = fmt.Sprintf(">=%s.%s.0", fM, fm)
+	default:
+		from = ">=" + from
+	}
+	switch {
+	case isX(tM):
+		to = ""
+	case isX(tm):
+		to = fmt.Sprintf("<%d.0.0-0", inc(tM))
+	case isX(tp):
+		to = fmt.Sprintf("<%s.%d.0-0", tM, inc(tm))
+	case tpr != "":
+		to = fmt.Sprintf("<=%s.%s.%s-%s", tM, tm, tp, tpr)
+	default:
+		to = "<=" + to
+	}
+	return strings.TrimSpace(from + " " + to)
+}
+
+// replaceCaret turns ^1.2.3 into >=1.2.3 <2.0.0-0. Below 1.0.0 the first
+// nonzero part is the one that can't change
+func replaceCaret(comparator string) string {
+	match := caretPattern.FindStringSubmatch(comparator)
+	if match == nil {
+		return comparator
+	}
+	M, m, p, pr := match[1], match[2], match[3], match[4]
+	if pr != "" {
+		pr = "-" + pr
+	}
+	switch {
+	case isX(M):
+		return ""
+	case isX(m):
+		return fmt.Sprintf(">=%s.0.0 <%d.0.0-0", M, inc(M))
+	case isX(p):
+		if M == "0" {
+			return fmt.Sprintf(">=%s.%s.0 <%s.%d.0-0", M, m, M, inc(m))
+		}
+		return fmt.Sprintf(">=%s.%s.0 <%d.0.0-0", M, m, inc(M))
+	case M == "0" && m == "0":
+		return fmt.Sprintf(">=%s.%s.%s%s <%s.%s.%d-0", M, m, p, pr, M, m, inc(p))
+	case M == "0":
+		return fmt.Sprintf(">=%s.%s.%s%s <%s.%d.0-0", M, m, p, pr, M, inc(m))
+	}
+	return fmt.Sprintf(">=%s.%s.%s%s <%d.0.0-0", M, m, p, pr, inc(M))
+}
 
-	return strings.Split(matchingVersions, "\n"), nil
+// replaceTilde turns ~1.2.3 into >=1.2.3 <1.3.0-0, and ~1 into
+// >=1.0.0 <2.0.0-0
+func replaceTilde(comparator string) string {
+	match := tildePattern.FindStringSubmatch(comparator)
+	if match == nil {
+		return comparator
+	}
+	M, m, p, pr := match[1], match[2], match[3], match[4]
+	if pr != "" {
+		pr = "-" + pr
+	}
+	switch {
+	case isX(M):
+		return ""
+	case isX(m):
+		return fmt.Sprintf(">=%s.0.0 <%d.0.0-0", M, inc(M))
+	case isX(p):
+		return fmt.Sprintf(">=%s.%s.0 <%s.%d.0-0", M, m, M, inc(m))
+	}
+	return fmt.Sprintf(">=%s.%s.%s%s <%s.%d.0-0", M, m, p, pr, M, inc(m))
+}
+
+// replaceXRange turns partial versions into bounds, so 1.2.x is
+// >=1.2.0 <1.3.0-0 and >1 is >=2.0.0. Full versions are left alone
+func replaceXRange(comparator string) string {
+	var expanded []string
+	for _, part := range strings.Fields(comparator) {
+		expanded = append(expanded, replaceXRangePart(part))
+	}
+	return strings.Join(expanded, " ")
+}
+
+func replaceXRangePart(comparator string) string {
+	match := xRangePattern.FindStringSubmatch(comparator)
+	if match == nil {
+		return comparator
+	}
+	operator, M, m, p := match[1], match[2], match[3], match[4]
+	xM := isX(M)
+	xm := xM || isX(m)
+	xp := xm || isX(p)
+	if operator == "=" && xp {
+		operator = ""
+	}
+	switch {
+	case xM:
+		if operator == ">" || operator == "<" {
+			// Nothing is allowed
+			return "<0.0.0-0"
+		}
+		return "*"
+	case operator != "" && xp:
+		major, _ := strconv.Atoi(M)
+		minor, _ := strconv.Atoi(m)
+		if xm {
+			minor = 0
+		}
+		patch := 0
+		switch operator {
+		case ">":
+			operator = ">="
+			if xm {
+				major, minor = major+1, 0
+			} else {
+				minor++
+			}
+		case "<=":
+			operator = "<"
+			if xm {
+				major++
+			} else {
+				minor++
+			}
+		}
+		if operator == "<" {
+			return fmt.Sprintf("<%d.%d.%d-0", major, minor, patch)
+		}
+		return fmt.Sprintf("%s%d.%d.%d", operator, major, minor, patch)
+	case xm:
+		return fmt.Sprintf(">=%s.0.0 <%d.0.0-0", M, inc(M))
+	case xp:
+		return fmt.Sprintf(">=%s.%s.0 <%s.%d.0-0", M, m, M, inc(m))
+	}
+	return comparator
+}
+
+// replaceStars drops the * that means any version
+func replaceStars(comparator string) string {
+	return starPattern.ReplaceAllString(strings.TrimSpace(comparator), "")
+}
+
+// test reports whether a version satisfies any of the range's sets
+func (r semverRange) test(version parsedSemver) bool {
+	for _, set := range r {
+		if testSet(set, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// testSet reports whether a version satisfies every comparator of a set. A
+// prerelease only does when a comparator names a prerelease of the same
+// major.minor.patch, so ^1.2.3 doesn't pick up 1.3.0-beta
+func testSet(set []semverComparator, version parsedSemver) bool {
+	for _, comparator := range set {
+		if !comparator.test(version) {
+			return false
+		}
+	}
+	if len(version.prerelease) == 0 {
+		return true
+	}
+	for _, comparator := range set {
+		if !comparator.any && len(comparator.version.prerelease) > 0 && comparator.version.core == version.core {
+			return true
+		}
+	}
+	return false
+}
+
+func (c semverComparator) test(version parsedSemver) bool {
+	if c.any {
+		return true
+	}
+	cmp := version.compare(c.version)
+	switch c.operator {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// maxSafeInteger is the largest number JavaScript, and so node's semver,
+// can hold exactly
+const maxSafeInteger = 1<<53 - 1
+
+// parseStrictSemver parses a full version in semver's grammar, with an
+// optional leading v
+func parseStrictSemver(version string) (parsedSemver, bool) {
+	version = strings.TrimSpace(version)
+	if len(version) > 256 || !fullVersionPattern.MatchString(version) {
+		return parsedSemver{}, false
+	}
+	parsed, ok := parseSemver(version)
+	for _, n := range parsed.core {
+		if n > maxSafeInteger {
+			return parsedSemver{}, false
+		}
+	}
+	return parsed, ok
+}
+
+// parsedSemver is a version split into its numeric core and prerelease
+type parsedSemver struct {
+	core       [3]int
+	prerelease []string
+}
+
+// parseSemver parses a full major.minor.patch version, ignoring a leading v
+// and build metadata
+func parseSemver(version string) (parsedSemver, bool) {
+	var parsed parsedSemver
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	version, _, _ = strings.Cut(version, "+")
+	version, prerelease, hasPrerelease := strings.Cut(version, "-")
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed.core[i] = n
+	}
+	if hasPrerelease {
+		parsed.prerelease = strings.Split(prerelease, ".")
+	}
+	return parsed, true
+}
+
+// compareSemver orders two versions by semver precedence, returning -1, 0,
+// or 1. ok is false if either isn't a version
+func compareSemver(a, b string) (result int, ok bool) {
+	va, okA := parseSemver(a)
+	vb, okB := parseSemver(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	return va.compare(vb), true
+}
+
+// compare orders two versions by semver precedence, returning -1, 0, or 1
+func (va parsedSemver) compare(vb parsedSemver) int {
+	for i := range va.core {
+		if va.core[i] != vb.core[i] {
+			return compareInts(va.core[i], vb.core[i])
+		}
+	}
+
+	// A prerelease comes before its release
+	switch {
+	case len(va.prerelease) == 0 && len(vb.prerelease) == 0:
+		return 0
+	case len(va.prerelease) == 0:
+		return 1
+	case len(vb.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(va.prerelease) && i < len(vb.prerelease); i++ {
+		pa, pb := va.prerelease[i], vb.prerelease[i]
+		if pa == pb {
+			continue
+		}
+		na, errA := strconv.Atoi(pa)
+		nb, errB := strconv.Atoi(pb)
+		switch {
+		case errA == nil && errB == nil:
+			return compareInts(na, nb)
+		case errA == nil:
+			// Numeric identifiers sort before alphanumeric ones
+			return -1
+		case errB == nil:
+			return 1
+		default:
+			return strings.Compare(pa, pb)
+		}
+	}
+	return compareInts(len(va.prerelease), len(vb.prerelease))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
 }
@@ -88,3 +88,132 @@ func TestGetMatchingVersions(t *testing.T) {
 		})
 	}
 }
+
+func TestCompareSemver(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.10.0", -1},
+		{"v2.0.0", "1.99.99", 1},
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.11", "1.0.0-beta.2", 1},
+		{"1.0.0-rc.1", "1.0.0-rc.1.1", -1},
+		{"1.0.0+build.5", "1.0.0", 0},
+	}
+	for _, tt := range tests {
+		got, ok := compareSemver(tt.a, tt.b)
+		if !ok || got != tt.want {
+			t.Errorf("compareSemver(%s, %s) = %d, %v, want %d", tt.a, tt.b, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := compareSemver("1.2", "1.2.0"); ok {
+		t.Errorf("compareSemver() accepted a partial version")
+	}
+}
+
+func TestRangeSatisfies(t *testing.T) {
+	// From node-semver's range-include and range-exclude fixtures
+	include := [][2]string{
+		{"1.0.0 - 2.0.0", "1.2.3"},
+		{"^1.2.3+build", "1.3.0"},
+		{"1.2.3-pre+asdf - 2.4.3-pre+asdf", "1.2.3-pre.2"},
+		{"1.2.3-pre+asdf - 2.4.3-pre+asdf", "2.4.3-alpha"},
+		{"1.2.3+asdf - 2.4.3+asdf", "1.2.3"},
+		{"", "1.0.0"},
+		{"*", "1.2.3"},
+		{">=*", "0.2.4"},
+		{">1.0.0", "1.0.1"},
+		{"<2.0.0", "1.9999.9999"},
+		{">=  1.0.0", "1.0.1"},
+		{"<    2.0.0", "0.2.9"},
+		{"0.1.20 || 1.2.4", "1.2.4"},
+		{">=0.2.3 || <0.0.1", "0.0.0"},
+		{"||", "1.3.4"},
+		{"2.x.x", "2.1.3"},
+		{"1.2.x || 2.x", "2.1.3"},
+		{"2.*.*", "2.1.3"},
+		{"2.3", "2.3.1"},
+		{"~0.0.1", "0.0.2"},
+		{"~x", "0.0.9"},
+		{"~2.4", "2.4.5"},
+		{"~>3.2.1", "3.2.2"},
+		{"~> 1", "1.2.3"},
+		{"~ 1.0.3", "1.0.12"},
+		{">= 1", "1.0.0"},
+		{"< 1.2", "1.1.1"},
+		{"~v0.5.4-pre", "0.5.4"},
+		{"=0.7.x", "0.7.2"},
+		{"<=0.7.x", "0.7.2"},
+		{"~1.2.1 >=1.2.3", "1.2.3"},
+		{"~1.2.1 =1.2.3", "1.2.3"},
+		{"^0.1", "0.1.2"},
+		{"^1.2 ^1", "1.4.2"},
+		{"^1.2.3-alpha", "1.2.3-pre"},
+		{"^0.0.1-alpha", "0.0.1-beta"},
+		{"^0.1.1-alpha", "0.1.1-beta"},
+		{"^x", "1.2.3"},
+		{"x - 1.0.0", "0.9.7"},
+		{"1.x - x", "1.9.7"},
+		{"<=7.x", "7.9.9"},
+		{"v1.2.3", "1.2.3"},
+	}
+	exclude := [][2]string{
+		{"1.0.0 - 2.0.0", "2.2.3"},
+		{"1.2.3+asdf - 2.4.3+asdf", "1.2.3-pre.2"},
+		{"^1.2.3+build", "2.0.0"},
+		{"^1.2.3", "1.2.3-pre"},
+		{"^1.2", "1.2.0-pre"},
+		{">1.2", "1.3.0-beta"},
+		{"<=1.2.3", "1.2.3-beta"},
+		{"=0.7.x", "0.7.0-asdf"},
+		{">=0.7.x", "0.7.0-asdf"},
+		{"<2.0.0", "2.0.0"},
+		{"0.1.20 || 1.2.4", "1.2.3"},
+		{">=0.2.3 || <0.0.1", "0.0.3"},
+		{"1.2.x || 2.x", "3.1.3"},
+		{"2", "1.1.2"},
+		{"~0.0.1", "0.1.0-alpha"},
+		{"~2.4", "2.5.0"},
+		{"~>3.2.1", "3.2.0"},
+		{"~1.0", "1.1.0"},
+		{"<1", "1.0.0"},
+		{"~v0.5.4-beta", "0.5.4-alpha"},
+		{"<0.7.x", "0.7.2"},
+		{">1.2", "1.2.8"},
+		{"^0.0.1", "0.0.2"},
+		{"^1.2.3", "2.0.0-alpha"},
+		{"*", "1.2.3-foo"},
+		{"1 - 2", "2.0.0-pre"},
+		{"1.1.x", "1.1.0-a"},
+		{">=1.0.0 <1.1.0", "1.1.0-pre"},
+		{"<=0.0.0", "0.0.1"},
+		{"blerg", "1.2.3"},
+		{"^1.2.3", "not.a.version"},
+	}
+	for _, tt := range include {
+		if _, err := GetMatchingVersions(tt[0], []string{tt[1]}); err != nil {
+			t.Errorf("%s doesn't match %q: %v", tt[1], tt[0], err)
+		}
+	}
+	for _, tt := range exclude {
+		if _, err := GetMatchingVersions(tt[0], []string{tt[1]}); err == nil {
+			t.Errorf("%s matches %q", tt[1], tt[0])
+		}
+	}
+}
+
+func TestGetMatchingVersionsOrder(t *testing.T) {
+	versions := []string{"2.0.0", "1.10.0", "1.2.0-beta.2", "1.2.0", "1.2.0-beta.10", "v1.9.0", "1.3"}
+	got, err := GetMatchingVersions(">=1.2.0-beta.2", versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.2.0-beta.2", "1.2.0-beta.10", "1.2.0", "v1.9.0", "1.10.0", "2.0.0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMatchingVersions() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Signature statuses of an installed package, weakest first
+const (
+	signatureUnsigned = "unsigned" // The registry has no signature for it
+	signatureSigned   = "signed"   // Its registry signature verified
+	signatureAttested = "attested" // Signed, with a provenance attestation for its tarball
+	signatureInvalid  = "invalid"  // A signature or attestation didn't verify
+)
+
+// signaturesConcurrency is how many packuments are fetched at once
+const signaturesConcurrency = 16
+
+// provenancePredicates are the SLSA provenance predicate types npm publishes
+var provenancePredicates = []string{"https://slsa.dev/provenance/v1", "https://slsa.dev/provenance/v0.2"}
+
+// registryKey is a public key the registry signs packages with
+type registryKey struct {
+	KeyID   string `json:"keyid"`
+	KeyType string `json:"keytype"`
+	Scheme  string `json:"scheme"`
+	Key     string `json:"key"` // base64 DER of the public key
+}
+
+// signedManifest is the part of a version in a packument that says how it
+// was signed
+type signedManifest struct {
+	Dist struct {
+		Integrity  string `json:"integrity"`
+		Signatures []struct {
+			KeyID string `json:"keyid"`
+			Sig   string `json:"sig"` // base64 ASN.1 ECDSA signature
+		} `json:"signatures"`
+		Attestations *struct {
+			URL        string `json:"url"`
+			Provenance struct {
+				PredicateType string `json:"predicateType"`
+			} `json:"provenance"`
+		} `json:"attestations"`
+	} `json:"dist"`
+}
+
+// PackageSignature is the signature status of an installed package
+type PackageSignature struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`       // Why it's invalid
+	PublishedAt string `json:"publishedAt,omitempty"` // When the registry says the version was published
+}
+
+// SignaturesReport is what verifying the installed packages found
+type SignaturesReport struct {
+	Packages []PackageSignature `json:"packages"`
+	Counts   map[string]int     `json:"counts"` // Packages by status
+}
+
+// SignaturesOptions configures caladan audit signatures
+type SignaturesOptions struct {
+	JSON bool // Print the report as JSON
+
+	jsonOutput io.Writer
+	registry   string
+}
+
+// signedPackage is an installed registry package to verify, at each of its
+// lockfile paths
+type signedPackage struct {
+	name, version, integrity string
+	registry                 string // Where its resolved URL, or the project's registries, say it's from
+	paths                    []string
+}
+
+// AuditSignatures verifies the registry signatures and provenance
+// attestations of the packages in a project's lockfile, like npm audit
+// signatures, and records the results in the project's provenance file. It
+// fails when any package is unsigned, doesn't verify, or verifies weaker
+// than it was recorded
+func AuditSignatures(directory string, opts SignaturesOptions) error {
+	registry := opts.registry
+	if registry == "" {
+		registry = npmRegistryURL
+	}
+
+	lockfilePath := filepath.Join(directory, "package-lock.json")
+	packageLock, err := readLockFile(lockfilePath)
+	if err != nil {
+		return fmt.Errorf("error reading lockfile (run caladan install first): %v", err)
+	}
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	packages, err := registryPackages(packageLock, registry, config.Registries)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client := newRegistryClient(&http.Client{Timeout: 30 * time.Second}, registry, "")
+	keys, err := fetchRegistryKeys(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Verifying signatures of %d packages against %s\n", len(packages), registry)
+	report, err := verifySignatures(ctx, client, keys, packages)
+	if err != nil {
+		return err
+	}
+	if err := recordProvenance(directory, packages, report, time.Now()); err != nil {
+		return fmt.Errorf("error recording provenance: %v", err)
+	}
+
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("error writing JSON report: %v", err)
+		}
+	} else {
+		fmt.Print(RenderSignatures(report))
+	}
+
+	if n := report.Counts[signatureInvalid] + report.Counts[signatureUnsigned]; n > 0 {
+		return fmt.Errorf("%d packages have missing or invalid registry signatures", n)
+	}
+	return nil
+}
+
+// registryPackages returns the lockfile's packages that came from registry,
+// once per version. A package is from the registry its resolved URL is on,
+// or without one, the one registries has for it. Linked, git, and tarball
+// URL packages have nothing to verify, and packages from other registries
+// aren't signed with its keys
+func registryPackages(packageLock *PackageLock, registry string, registries Registries) ([]signedPackage, error) {
+	packages := []signedPackage{}
+	seen := make(map[string]int)
+	paths := make([]string, 0, len(packageLock.Packages))
+	for path := range packageLock.Packages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		raw := packageLock.Packages[path]
+		if path == "" {
+			continue
+		}
+		var entry PackageInfo
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("error parsing lockfile entry %s: %v", path, err)
+		}
+		name := packageNameFromPath(path)
+		from := registries.registryFor(name)
+		if entry.Resolved != "" {
+			from = tarballRegistry(resolvedName(path, entry), entry.Resolved)
+		} else if from == "" {
+			from = registry
+		}
+		from = strings.TrimSuffix(from, "/")
+		if entry.Version == "" || from != strings.TrimSuffix(registry, "/") {
+			continue
+		}
+		if i, ok := seen[name+"@"+entry.Version]; ok {
+			packages[i].paths = append(packages[i].paths, path)
+			continue
+		}
+		seen[name+"@"+entry.Version] = len(packages)
+		packages = append(packages, signedPackage{name: name, version: entry.Version, integrity: entry.Integrity, registry: from, paths: []string{path}})
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].name != packages[j].name {
+			return packages[i].name < packages[j].name
+		}
+		return packages[i].version < packages[j].version
+	})
+	return packages, nil
+}
+
+// fetchRegistryKeys returns the registry's signing keys by key ID
+func fetchRegistryKeys(ctx context.Context, client *RegistryClient) (map[string]*ecdsa.PublicKey, error) {
+	data, err := client.fetch(ctx, client.registry+"/-/npm/v1/keys")
+	if err != nil {
+		return nil, fmt.Errorf("registry doesn't publish signing keys: %w", err)
+	}
+	var response struct {
+		Keys []registryKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("error parsing registry keys: %v", err)
+	}
+
+	keys := make(map[string]*ecdsa.PublicKey)
+	for _, key := range response.Keys {
+		if key.KeyType != "ecdsa-sha2-nistp256" {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding registry key %s: %v", key.KeyID, err)
+		}
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing registry key %s: %v", key.KeyID, err)
+		}
+		if ecdsaKey, ok := pub.(*ecdsa.PublicKey); ok {
+			keys[key.KeyID] = ecdsaKey
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("registry doesn't publish any ECDSA signing keys")
+	}
+	return keys, nil
+}
+
+// verifySignatures checks every package's manifest against the keys
+func verifySignatures(ctx context.Context, client *RegistryClient, keys map[string]*ecdsa.PublicKey, packages []signedPackage) (*SignaturesReport, error) {
+	// Each package's packument is fetched once for all its versions
+	byName := make(map[string][]int)
+	names := []string{}
+	for i, pkg := range packages {
+		if _, ok := byName[pkg.name]; !ok {
+			names = append(names, pkg.name)
+		}
+		byName[pkg.name] = append(byName[pkg.name], i)
+	}
+
+	report := &SignaturesReport{Packages: make([]PackageSignature, len(packages)), Counts: make(map[string]int)}
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(signaturesConcurrency)
+	for _, name := range names {
+		name := name
+		g.Go(func() error {
+			data, err := client.fetch(gctx, client.registry+packumentPath(name))
+			if err != nil {
+				return err
+			}
+			var packument struct {
+				Versions map[string]signedManifest `json:"versions"`
+				Time     map[string]string         `json:"time"`
+			}
+			if err := json.Unmarshal(data, &packument); err != nil {
+				return fmt.Errorf("error parsing metadata for %s: %v", name, err)
+			}
+
+			for _, i := range byName[name] {
+				pkg := packages[i]
+				result := PackageSignature{Name: pkg.name, Version: pkg.version, Status: signatureInvalid, PublishedAt: packument.Time[pkg.version]}
+				if manifest, ok := packument.Versions[pkg.version]; ok {
+					var err error
+					result.Status, err = verifyPackage(gctx, client, keys, pkg, manifest)
+					if err != nil {
+						result.Error = err.Error()
+					}
+				} else {
+					result.Error = "version isn't in the registry"
+				}
+				report.Packages[i] = result
+				mu.Lock()
+				report.Counts[result.Status]++
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyPackage returns a package's signature status, with an error saying
+// why when it's invalid
+func verifyPackage(ctx context.Context, client *RegistryClient, keys map[string]*ecdsa.PublicKey, pkg signedPackage, manifest signedManifest) (string, error) {
+	if pkg.integrity != "" && manifest.Dist.Integrity != pkg.integrity {
+		return signatureInvalid, fmt.Errorf("lockfile integrity %s doesn't match the registry's %s", pkg.integrity, manifest.Dist.Integrity)
+	}
+	if len(manifest.Dist.Signatures) == 0 {
+		return signatureUnsigned, nil
+	}
+
+	// The registry signs name@version:integrity
+	digest := sha256.Sum256([]byte(pkg.name + "@" + pkg.version + ":" + manifest.Dist.Integrity))
+	verified := false
+	for _, signature := range manifest.Dist.Signatures {
+		key, ok := keys[signature.KeyID]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err != nil {
+			return signatureInvalid, fmt.Errorf("error decoding signature: %v", err)
+		}
+		if !ecdsa.VerifyASN1(key, digest[:], sig) {
+			return signatureInvalid, fmt.Errorf("registry signature by %s doesn't verify", signature.KeyID)
+		}
+		verified = true
+	}
+	if !verified {
+		return signatureInvalid, fmt.Errorf("signed by a key the registry doesn't publish")
+	}
+
+	if manifest.Dist.Attestations == nil {
+		return signatureSigned, nil
+	}
+	if err := verifyProvenance(ctx, client, manifest.Dist.Attestations.URL, pkg.name, pkg.version, manifest.Dist.Integrity); err != nil {
+		return signatureInvalid, err
+	}
+	return signatureAttested, nil
+}
+
+// verifyProvenance checks that a package's provenance attestation is about
+// its tarball: the in-toto statement's subject must be the package and its
+// sha512. The attestation's Sigstore certificate isn't checked against
+// Sigstore's roots
+func verifyProvenance(ctx context.Context, client *RegistryClient, url, name, version, integrity string) error {
+	data, err := client.fetch(ctx, url)
+	if err != nil {
+		return fmt.Errorf("error fetching attestations: %w", err)
+	}
+	var response struct {
+		Attestations []struct {
+			PredicateType string `json:"predicateType"`
+			Bundle        struct {
+				DSSEEnvelope struct {
+					Payload string `json:"payload"` // base64 in-toto statement
+				} `json:"dsseEnvelope"`
+			} `json:"bundle"`
+		} `json:"attestations"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("error parsing attestations: %v", err)
+	}
+
+	algorithm, digest, ok := strings.Cut(integrity, "-")
+	if !ok || algorithm != "sha512" {
+		return fmt.Errorf("attested package has no sha512 integrity")
+	}
+	sum, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil {
+		return fmt.Errorf("error decoding integrity: %v", err)
+	}
+	subject := "pkg:npm/" + strings.Replace(name, "@", "%40", 1) + "@" + version
+
+	for _, attestation := range response.Attestations {
+		provenance := false
+		for _, predicate := range provenancePredicates {
+			if attestation.PredicateType == predicate {
+				provenance = true
+			}
+		}
+		if !provenance {
+			continue
+		}
+		payload, err := base64.StdEncoding.DecodeString(attestation.Bundle.DSSEEnvelope.Payload)
+		if err != nil {
+			return fmt.Errorf("error decoding provenance: %v", err)
+		}
+		var statement struct {
+			Subject []struct {
+				Name   string            `json:"name"`
+				Digest map[string]string `json:"digest"`
+			} `json:"subject"`
+		}
+		if err := json.Unmarshal(payload, &statement); err != nil {
+			return fmt.Errorf("error parsing provenance: %v", err)
+		}
+		for _, s := range statement.Subject {
+			if s.Name == subject && s.Digest["sha512"] == hex.EncodeToString(sum) {
+				return nil
+			}
+		}
+		return fmt.Errorf("provenance attestation isn't for %s@%s's tarball", name, version)
+	}
+	return fmt.Errorf("no provenance attestation found")
+}
+
+// RenderSignatures summarizes the statuses and lists the packages that
+// failed verification
+func RenderSignatures(report *SignaturesReport) string {
+	var builder strings.Builder
+	verified := report.Counts[signatureSigned] + report.Counts[signatureAttested]
+	builder.WriteString(colorSuccess(fmt.Sprintf("%d packages have verified registry signatures", verified)) + "\n")
+	if n := report.Counts[signatureAttested]; n > 0 {
+		builder.WriteString(colorSuccess(fmt.Sprintf("%d packages have verified attestations", n)) + "\n")
+	}
+
+	for _, status := range []string{signatureUnsigned, signatureInvalid} {
+		if report.Counts[status] == 0 {
+			continue
+		}
+		if status == signatureUnsigned {
+			builder.WriteString(colorWarn(fmt.Sprintf("%d packages have missing registry signatures:", report.Counts[status])) + "\n")
+		} else {
+			builder.WriteString(colorError(fmt.Sprintf("%d packages have invalid registry signatures or attestations:", report.Counts[status])) + "\n")
+		}
+		for _, pkg := range report.Packages {
+			if pkg.Status != status {
+				continue
+			}
+			line := "  " + colorPackage(pkg.Name+"@"+pkg.Version)
+			if pkg.Error != "" {
+				line += ": " + pkg.Error
+			}
+			builder.WriteString(line + "\n")
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditSignatures(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	integrity := func(name string) string {
+		sum := sha512.Sum512([]byte(name))
+		return "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	sign := func(name, version string) string {
+		digest := sha256.Sum256([]byte(name + "@" + version + ":" + integrity(name)))
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	statement := func(subject, name string) string {
+		sum := sha512.Sum512([]byte(name))
+		payload, _ := json.Marshal(map[string]interface{}{
+			"subject": []map[string]interface{}{{"name": subject, "digest": map[string]string{"sha512": hex.EncodeToString(sum[:])}}},
+		})
+		return base64.StdEncoding.EncodeToString(payload)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		packument := func(name, dist string) {
+			fmt.Fprintf(w, `{"versions": {"1.0.0": {"dist": {"integrity": %q%s}}}, "time": {"1.0.0": "2024-03-01T12:00:00.000Z"}}`, integrity(name), dist)
+		}
+		switch r.URL.Path {
+		case "/-/npm/v1/keys":
+			fmt.Fprintf(w, `{"keys": [{"keyid": "SHA256:test", "keytype": "ecdsa-sha2-nistp256", "scheme": "ecdsa-sha2-nistp256", "key": %q}]}`, base64.StdEncoding.EncodeToString(der))
+		case "/signed":
+			packument("signed", fmt.Sprintf(`, "signatures": [{"keyid": "SHA256:test", "sig": %q}]`, sign("signed", "1.0.0")))
+		case "/@scope/attested":
+			packument("@scope/attested", fmt.Sprintf(`, "signatures": [{"keyid": "SHA256:test", "sig": %q}], "attestations": {"url": %q}`,
+				sign("@scope/attested", "1.0.0"), server.URL+"/-/npm/v1/attestations/@scope/attested@1.0.0"))
+		case "/-/npm/v1/attestations/@scope/attested@1.0.0":
+			fmt.Fprintf(w, `{"attestations": [{"predicateType": "https://slsa.dev/provenance/v1", "bundle": {"dsseEnvelope": {"payload": %q}}}]}`,
+				statement("pkg:npm/%40scope/attested@1.0.0", "@scope/attested"))
+		case "/unsigned":
+			packument("unsigned", "")
+		case "/tampered":
+			// Signed for another package's tarball
+			packument("tampered", fmt.Sprintf(`, "signatures": [{"keyid": "SHA256:test", "sig": %q}]`, sign("signed", "1.0.0")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	packages := map[string]interface{}{"": map[string]interface{}{}}
+	for _, name := range []string{"signed", "@scope/attested", "unsigned", "tampered"} {
+		packages["node_modules/"+name] = map[string]string{"version": "1.0.0", "resolved": server.URL + "/" + name + "/-/x-1.0.0.tgz", "integrity": integrity(name)}
+	}
+	// Not from the registry, so not checked
+	packages["node_modules/local"] = map[string]string{"version": "1.0.0", "resolved": "file:../local"}
+	packages["node_modules/@corp/private"] = map[string]string{"version": "1.0.0"}
+	lockfile, _ := json.Marshal(map[string]interface{}{"lockfileVersion": 3, "packages": packages})
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package-lock.json"), string(lockfile))
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"caladan": {"registries": {"@corp": "https://corp.internal/npm"}}}`)
+
+	var output bytes.Buffer
+	err = AuditSignatures(dir, SignaturesOptions{JSON: true, jsonOutput: &output, registry: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "2 packages have missing or invalid registry signatures") {
+		t.Errorf("AuditSignatures() error = %v", err)
+	}
+
+	var report SignaturesReport
+	if err := json.Unmarshal(output.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"@scope/attested": signatureAttested, "signed": signatureSigned, "tampered": signatureInvalid, "unsigned": signatureUnsigned}
+	if len(report.Packages) != len(want) {
+		t.Fatalf("Packages = %+v", report.Packages)
+	}
+	for _, pkg := range report.Packages {
+		if pkg.Status != want[pkg.Name] {
+			t.Errorf("%s status = %s (%s), want %s", pkg.Name, pkg.Status, pkg.Error, want[pkg.Name])
+		}
+	}
+
+	rendered := RenderSignatures(&report)
+	for _, line := range []string{"2 packages have verified registry signatures", "1 packages have verified attestations", "tampered@1.0.0"} {
+		if !strings.Contains(rendered, line) {
+			t.Errorf("RenderSignatures() = %q, missing %q", rendered, line)
+		}
+	}
+
+	provenance, err := readProvenance(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := provenance.Packages["node_modules/@scope/attested"]
+	if record.Registry != server.URL || record.PublishedAt != "2024-03-01T12:00:00.000Z" || record.Status != signatureAttested || record.VerifiedAt == "" {
+		t.Errorf("provenance of @scope/attested = %+v", record)
+	}
+	_, local := provenance.Packages["node_modules/local"]
+	_, corp := provenance.Packages["node_modules/@corp/private"]
+	if local || corp || len(provenance.Packages) != 4 {
+		t.Errorf("provenance = %+v, want the registry packages", provenance.Packages)
+	}
+
+	// signed was attested when it was last verified, and its entry hasn't
+	// changed, so the missing attestation fails it
+	record = provenance.Packages["node_modules/signed"]
+	record.Status = signatureAttested
+	record.VerifiedAt = "2024-04-01T00:00:00Z"
+	provenance.Packages["node_modules/signed"] = record
+	data, _ := json.Marshal(provenance)
+	writeTestFile(t, filepath.Join(dir, provenanceFile), string(data))
+	output.Reset()
+	err = AuditSignatures(dir, SignaturesOptions{JSON: true, jsonOutput: &output, registry: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "3 packages have missing or invalid registry signatures") {
+		t.Errorf("AuditSignatures() error = %v", err)
+	}
+	if err := json.Unmarshal(output.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range report.Packages {
+		if pkg.Name == "signed" && (pkg.Status != signatureInvalid || pkg.Error != "was attested when verified on 2024-04-01") {
+			t.Errorf("signed = %+v, want invalid since it was attested", pkg)
+		}
+	}
+	if provenance, err = readProvenance(dir); err != nil || provenance.Packages["node_modules/signed"].Status != signatureAttested {
+		t.Errorf("provenance of signed = %+v, %v, want the attested record kept", provenance.Packages["node_modules/signed"], err)
+	}
+}
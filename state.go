@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// stateFileName is the install state caladan keeps in node_modules/.caladan
+const stateFileName = "state.json"
+
+// installStateVersion only changes when existing fields do
+const installStateVersion = 1
+
+// Package sources recorded in the install state
+const (
+	sourceDownload = "download" // Fetched from its resolved URL
+	sourceStore    = "store"    // Linked from a tarball already in the store
+)
+
+// InstallState describes how node_modules was installed, so later commands
+// can work from it instead of re-deriving the layout from the lockfile
+type InstallState struct {
+	SchemaVersion   int                     `json:"schemaVersion"`
+	InstalledAt     string                  `json:"installedAt"`
+	Layout          string                  `json:"layout"` // Always "hoisted" for now
+	ModulesDir      string                  `json:"modulesDir"`
+	VirtualStoreDir string                  `json:"virtualStoreDir"`
+	Store           string                  `json:"store"`
+	ImportMethod    string                  `json:"importMethod"`
+	Platforms       []string                `json:"platforms"`
+	ReadOnly        bool                    `json:"readOnly,omitempty"` // Package files were made read-only
+	Packages        map[string]PackageState `json:"packages"`
+}
+
+// PackageState is where an installed package came from
+type PackageState struct {
+	Version   string `json:"version"`
+	Resolved  string `json:"resolved"`
+	Integrity string `json:"integrity,omitempty"` // sha512 of the tarball that was installed
+	Source    string `json:"source"`
+	Dev       bool   `json:"dev,omitempty"`
+	Optional  bool   `json:"optional,omitempty"`
+}
+
+// newInstallState records the packages an install put in node_modules.
+// Skipped and failed packages aren't in summary.Packages, so they're left out
+func newInstallState(summary *InstallSummary, packages map[string]PackageInfo, workDir string, opts InstallOptions, now time.Time) InstallState {
+	platforms := []string{}
+	for _, platform := range opts.Platforms {
+		platforms = append(platforms, platform.String())
+	}
+	importMethod := opts.ImportMethod
+	if importMethod == "" {
+		importMethod = importAuto
+	}
+	state := InstallState{
+		SchemaVersion:   installStateVersion,
+		InstalledAt:     now.UTC().Format(time.RFC3339),
+		Layout:          "hoisted",
+		ModulesDir:      relativeTo(workDir, opts.modulesPath(workDir)),
+		VirtualStoreDir: relativeTo(workDir, opts.virtualStorePath(workDir)),
+		Store:           defaultStoreDir(),
+		ImportMethod:    importMethod,
+		Platforms:       platforms,
+		ReadOnly:        opts.ReadOnly,
+		Packages:        make(map[string]PackageState, len(summary.Packages)),
+	}
+	for _, stats := range summary.Packages {
+		pkg := packages[stats.Path]
+		source := sourceDownload
+		if stats.fromStore {
+			source = sourceStore
+		}
+		state.Packages[stats.Path] = PackageState{
+			Version:   stats.Version,
+			Resolved:  pkg.Resolved,
+			Integrity: stats.integrity,
+			Source:    source,
+			Dev:       pkg.Dev,
+			Optional:  pkg.Optional,
+		}
+	}
+	return state
+}
+
+// missingPackages returns the lockfile entries node_modules doesn't have,
+// for an add to install without replacing the rest of it. It returns why
+// node_modules can't be kept instead, when it was installed differently or
+// has packages the lockfile no longer has at the same version
+func missingPackages(state InstallState, packages map[string]PackageInfo, opts InstallOptions) (map[string]PackageInfo, string) {
+	platforms := []string{}
+	for _, platform := range opts.Platforms {
+		platforms = append(platforms, platform.String())
+	}
+	if !slices.Equal(state.Platforms, platforms) {
+		return nil, "it was installed for other platforms"
+	}
+	if state.ReadOnly != opts.ReadOnly {
+		return nil, "it was installed with a different --read-only"
+	}
+	for path, installed := range state.Packages {
+		if pkg, ok := packages[path]; !ok || pkg.Version != installed.Version {
+			return nil, fmt.Sprintf("the lockfile no longer has %s@%s", path, installed.Version)
+		}
+	}
+
+	missing := make(map[string]PackageInfo)
+	for path, pkg := range packages {
+		if _, ok := state.Packages[path]; !ok {
+			missing[path] = pkg
+		}
+	}
+	return missing, ""
+}
+
+// keep adds the packages of the install an add built on to the state of
+// what it added, with the dev and optional flags the lockfile has now. It
+// returns a summary of everything installed, for the hidden lockfile
+func (s *InstallState) keep(previous InstallState, packages map[string]PackageInfo, summary *InstallSummary) *InstallSummary {
+	installed := &InstallSummary{Packages: slices.Clone(summary.Packages), backfilled: summary.backfilled}
+	for path, state := range previous.Packages {
+		state.Dev = packages[path].Dev
+		state.Optional = packages[path].Optional
+		s.Packages[path] = state
+		installed.Packages = append(installed.Packages, PackageStats{Path: path, Version: state.Version})
+	}
+	return installed
+}
+
+// relativeTo returns path relative to dir when it's inside it
+func relativeTo(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// writeInstallState saves the state into a node_modules directory
+func writeInstallState(nodeModulesPath string, state InstallState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(nodeModulesPath, stateDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, stateFileName), append(data, '\n'))
+}
+
+// readInstallState loads the state of an installed node_modules. It returns
+// an error satisfying os.IsNotExist when node_modules predates it
+func readInstallState(nodeModulesPath string) (InstallState, error) {
+	var state InstallState
+	path := filepath.Join(nodeModulesPath, stateDirName, stateFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if state.SchemaVersion > installStateVersion {
+		return state, fmt.Errorf("%s was written by a newer caladan (schema version %d)", path, state.SchemaVersion)
+	}
+	return state, nil
+}
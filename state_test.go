@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInstallState(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+
+	tarball, integrity := storeTarball(t, map[string]string{"package.json": `{"name":"shared"}`})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	packages := map[string]PackageInfo{
+		"node_modules/shared":                {Version: "1.0.0", Resolved: server.URL + "/shared.tgz", Integrity: integrity},
+		"node_modules/a/node_modules/shared": {Version: "1.0.0", Resolved: server.URL + "/shared.tgz", Integrity: integrity, Dev: true},
+	}
+	project := t.TempDir()
+	nodeModules := filepath.Join(project, "node_modules")
+	summary, err := DownloadPackages(packages, nodeModules, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := InstallOptions{Platforms: []Platform{{OS: "linux", CPU: "x64", Libc: "glibc"}}}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := writeInstallState(nodeModules, newInstallState(summary, packages, project, opts, now)); err != nil {
+		t.Fatal(err)
+	}
+	state, err := readInstallState(nodeModules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.SchemaVersion != installStateVersion || state.InstalledAt != "2024-01-02T03:04:05Z" || state.Layout != "hoisted" {
+		t.Errorf("state = %+v", state)
+	}
+	if state.ModulesDir != "node_modules" || state.VirtualStoreDir != ".caladan" || state.ImportMethod != importAuto {
+		t.Errorf("modulesDir = %q, virtualStoreDir = %q, importMethod = %q", state.ModulesDir, state.VirtualStoreDir, state.ImportMethod)
+	}
+	if len(state.Platforms) != 1 || state.Platforms[0] != opts.Platforms[0].String() {
+		t.Errorf("platforms = %v", state.Platforms)
+	}
+	if len(state.Packages) != 2 {
+		t.Fatalf("packages = %+v, want both copies", state.Packages)
+	}
+	top, nested := state.Packages["node_modules/shared"], state.Packages["node_modules/a/node_modules/shared"]
+	if top.Integrity != integrity || top.Resolved != server.URL+"/shared.tgz" || nested.Integrity != integrity {
+		t.Errorf("packages = %+v", state.Packages)
+	}
+	if !nested.Dev || top.Dev {
+		t.Errorf("dev flags = %v, %v", top.Dev, nested.Dev)
+	}
+	// One copy downloads the tarball, the other links the extraction
+	if top.Source == nested.Source || (top.Source != sourceStore && nested.Source != sourceStore) {
+		t.Errorf("sources = %s, %s, want one download and one store", top.Source, nested.Source)
+	}
+}
+
+func TestReadInstallStateMissing(t *testing.T) {
+	_, err := readInstallState(t.TempDir())
+	if !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
+
+func TestMissingPackages(t *testing.T) {
+	opts := InstallOptions{Platforms: []Platform{{OS: "linux", CPU: "x64", Libc: "glibc"}}}
+	state := InstallState{
+		Platforms: []string{opts.Platforms[0].String()},
+		Packages:  map[string]PackageState{"node_modules/a": {Version: "1.0.0"}},
+	}
+	packages := map[string]PackageInfo{
+		"node_modules/a": {Version: "1.0.0"},
+		"node_modules/b": {Version: "2.0.0"},
+	}
+
+	missing, reason := missingPackages(state, packages, opts)
+	if reason != "" || len(missing) != 1 || missing["node_modules/b"].Version != "2.0.0" {
+		t.Errorf("missingPackages() = %v, %q, want just b", missing, reason)
+	}
+
+	// An installed package the lockfile changed can't be kept
+	packages["node_modules/a"] = PackageInfo{Version: "1.1.0"}
+	if _, reason := missingPackages(state, packages, opts); reason == "" {
+		t.Error("kept node_modules with a package the lockfile upgraded")
+	}
+	packages["node_modules/a"] = PackageInfo{Version: "1.0.0"}
+	if _, reason := missingPackages(state, packages, InstallOptions{}); reason == "" {
+		t.Error("kept node_modules installed for other platforms")
+	}
+}
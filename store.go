@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Store is a content-addressed store of package files shared by every
+// project. Each file is kept once, named by the hash of its content, and
+// cloned or hard linked into node_modules, so files that are identical
+// across packages and versions (licenses, bundled dists) take up space once.
+// Alongside the files the store keeps an index per verified tarball, listing
+// the files it unpacks to, so a package can be installed without downloading
+// it again.
+// All methods are safe to call on a nil Store
+type Store struct {
+	dir          string
+	importMethod string
+
+	// Set once cloning has failed, so it isn't attempted for every file
+	cloneUnsupported atomic.Bool
+}
+
+// How files are put into node_modules from the store
+const (
+	importAuto     = "auto"     // Clone, else hard link, else copy
+	importHardlink = "hardlink" // Hard link, else copy
+	importClone    = "clone"    // Copy-on-write clone, else copy
+	importCopy     = "copy"     // Always copy
+)
+
+// validImportMethod reports whether method is a known import method
+func validImportMethod(method string) bool {
+	switch method {
+	case importAuto, importHardlink, importClone, importCopy:
+		return true
+	}
+	return false
+}
+
+// storeFile is a file in a package, pointing at its content in the store
+type storeFile struct {
+	Hash string      `json:"hash"`
+	Mode os.FileMode `json:"mode"`
+	Size int64       `json:"size"`
+}
+
+// packageIndex lists the files a tarball unpacks to
+type packageIndex struct {
+	Integrity string               `json:"integrity"` // sha512 of the tarball
+	Files     map[string]storeFile `json:"files"`
+	Symlinks  map[string]string    `json:"symlinks,omitempty"`
+}
+
+func newPackageIndex() *packageIndex {
+	return &packageIndex{Files: make(map[string]storeFile), Symlinks: make(map[string]string)}
+}
+
+// file looks up a file of the index, which may be nil
+func (index *packageIndex) file(name string) (storeFile, bool) {
+	if index == nil {
+		return storeFile{}, false
+	}
+	file, ok := index.Files[name]
+	return file, ok
+}
+
+// NewStore returns a store rooted at dir that imports files with the given
+// method, empty meaning auto. It returns nil if dir is empty
+func NewStore(dir, importMethod string) *Store {
+	if dir == "" {
+		return nil
+	}
+	if importMethod == "" {
+		importMethod = importAuto
+	}
+	return &Store{dir: dir, importMethod: importMethod}
+}
+
+// defaultStoreDir returns the store inside caladan's cache directory
+func defaultStoreDir() string {
+	dir := defaultCacheDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "store")
+}
+
+// storeMode normalizes a file mode to what the store keeps, since every
+// hard link to a blob shares its permissions and clones copy them
+func storeMode(mode os.FileMode) os.FileMode {
+	if mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// blobPath returns where a file's content lives. Executable files are kept
+// apart from identical non-executable ones
+func (s *Store) blobPath(file storeFile) string {
+	name := file.Hash
+	if file.Mode&0111 != 0 {
+		name += "-exec"
+	}
+	return filepath.Join(s.dir, "files", file.Hash[:2], name)
+}
+
+// addFile copies a file's content into the store
+func (s *Store) addFile(r io.Reader, mode os.FileMode) (storeFile, error) {
+	tmpDir := filepath.Join(s.dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return storeFile{}, err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "blob-*")
+	if err != nil {
+		return storeFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		tmp.Close()
+		return storeFile{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return storeFile{}, err
+	}
+
+	file := storeFile{Hash: hex.EncodeToString(h.Sum(nil)), Mode: storeMode(mode), Size: size}
+	blob := s.blobPath(file)
+	if _, err := os.Stat(blob); err == nil {
+		// Already stored
+		return file, nil
+	}
+	if err := os.Chmod(tmp.Name(), file.Mode); err != nil {
+		return storeFile{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return storeFile{}, err
+	}
+	if err := os.Rename(tmp.Name(), blob); err != nil {
+		return storeFile{}, err
+	}
+	return file, nil
+}
+
+// maxDiffedFileSize is the largest file that's hashed in memory to check
+// whether it's unchanged from the version being upgraded from
+const maxDiffedFileSize = 16 << 20
+
+// addKnownFile stores a file that's expected to be in the store already,
+// like one an upgraded package had at the same path with the same size. Its
+// content is hashed in memory and only written out when the store doesn't
+// have it, so unchanged files of an upgrade aren't copied through the
+// store's temporary files
+func (s *Store) addKnownFile(r io.Reader, mode os.FileMode) (storeFile, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return storeFile{}, err
+	}
+	sum := sha256.Sum256(content)
+	file := storeFile{Hash: hex.EncodeToString(sum[:]), Mode: storeMode(mode), Size: int64(len(content))}
+	if _, err := os.Stat(s.blobPath(file)); err == nil {
+		return file, nil
+	}
+	return s.addFile(bytes.NewReader(content), mode)
+}
+
+// linkFile puts a stored file at target using the store's import method,
+// falling back to a copy when the filesystem can't clone or link it there
+func (s *Store) linkFile(file storeFile, target string) error {
+	blob := s.blobPath(file)
+	err := s.importFile(blob, target, file.Mode)
+	if os.IsExist(err) {
+		// Replace whatever an earlier extraction left there
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+		err = s.importFile(blob, target, file.Mode)
+	}
+	return err
+}
+
+// importFile tries each way of importing a file that the import method
+// allows, in order, and returns the last error
+func (s *Store) importFile(blob, target string, mode os.FileMode) error {
+	if s.importMethod == importClone || s.importMethod == importAuto {
+		err := s.clone(blob, target, mode)
+		if err == nil || os.IsExist(err) {
+			return err
+		}
+	}
+	if s.importMethod == importHardlink || s.importMethod == importAuto {
+		err := os.Link(blob, target)
+		if err == nil || os.IsExist(err) {
+			return err
+		}
+	}
+	return copyBlob(blob, target, mode)
+}
+
+// clone clones a stored file, remembering when the filesystem can't
+func (s *Store) clone(blob, target string, mode os.FileMode) error {
+	if s.cloneUnsupported.Load() {
+		return errors.ErrUnsupported
+	}
+	err := cloneFile(blob, target, mode)
+	if err != nil && !os.IsExist(err) {
+		s.cloneUnsupported.Store(true)
+	}
+	return err
+}
+
+// copyBlob copies a stored file to target, which must not exist
+func copyBlob(blob, target string, mode os.FileMode) error {
+	src, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// detachFiles gives every file of an installed package its own copy, so
+// install scripts rewriting them can't write through a hard link into the
+// store. Packages nested in its node_modules are detached on their own
+func detachFiles(pkgPath string) error {
+	return filepath.WalkDir(pkgPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "node_modules" && path != pkgPath {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		tmp := filepath.Join(filepath.Dir(path), ".caladan-detach-"+d.Name())
+		os.Remove(tmp)
+		if err := cloneFile(path, tmp, info.Mode().Perm()); err != nil {
+			os.Remove(tmp)
+			if err := copyBlob(path, tmp, info.Mode().Perm()); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	})
+}
+
+// indexPath returns where the index of a tarball with the given integrity lives
+func (s *Store) indexPath(integrity string) string {
+	return filepath.Join(s.dir, "index", cacheKey(integrity)+".json")
+}
+
+// getIndex returns the index of a previously stored tarball, provided all
+// of its files are still in the store
+func (s *Store) getIndex(integrity string) (*packageIndex, bool) {
+	if s == nil || integrity == "" {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(s.indexPath(integrity))
+	if err != nil {
+		return nil, false
+	}
+	index := newPackageIndex()
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, false
+	}
+	for _, file := range index.Files {
+		if _, err := os.Stat(s.blobPath(file)); err != nil {
+			return nil, false
+		}
+	}
+	return index, true
+}
+
+// putIndex records the files a verified tarball unpacked to
+func (s *Store) putIndex(integrity string, index *packageIndex) error {
+	if s == nil || integrity == "" {
+		return nil
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.indexPath(integrity), data)
+}
+
+// evictIndex forgets a tarball, so the next install downloads it again
+func (s *Store) evictIndex(integrity string) error {
+	if s == nil || integrity == "" {
+		return nil
+	}
+	err := os.Remove(s.indexPath(integrity))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// linkPackage recreates a stored package in destPath and returns the
+// number of bytes in its files
+func (s *Store) linkPackage(index *packageIndex, destPath string) (int64, error) {
+	var unpacked int64
+	createdDirs := make(map[string]bool)
+	mkdir := func(dir string) error {
+		if createdDirs[dir] {
+			return nil
+		}
+		createdDirs[dir] = true
+		return os.MkdirAll(dir, 0755)
+	}
+
+	for name, file := range index.Files {
+		target := filepath.Join(destPath, name)
+		if err := mkdir(filepath.Dir(target)); err != nil {
+			return unpacked, fmt.Errorf("error creating directory for file %s: %v", target, err)
+		}
+		if err := s.linkFile(file, target); err != nil {
+			return unpacked, fmt.Errorf("error linking %s from the store: %v", target, err)
+		}
+		unpacked += file.Size
+	}
+
+	for name, linkname := range index.Symlinks {
+		target := filepath.Join(destPath, name)
+		if err := mkdir(filepath.Dir(target)); err != nil {
+			return unpacked, fmt.Errorf("error creating directory for symlink %s: %v", target, err)
+		}
+		os.Remove(target)
+		if err := os.Symlink(linkname, target); err != nil {
+			return unpacked, fmt.Errorf("error creating symlink %s: %v", target, err)
+		}
+	}
+
+	return unpacked, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// storeTarball builds a package tarball holding the given files
+func storeTarball(t *testing.T, files map[string]string) ([]byte, string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: "package/" + name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha512.Sum512(buf.Bytes())
+	return buf.Bytes(), "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestExtractStopsWhenCancelled(t *testing.T) {
+	tarball, _ := storeTarball(t, map[string]string{"package.json": `{"name":"a"}`})
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errInterrupted)
+
+	dest := filepath.Join(t.TempDir(), "a")
+	_, _, err := extractTarGz(ctx, bytes.NewReader(tarball), dest, NewStore(t.TempDir(), importHardlink), nil)
+	if err != errInterrupted {
+		t.Errorf("extractTarGz() error = %v, want errInterrupted", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "package.json")); !os.IsNotExist(err) {
+		t.Errorf("package.json was extracted after the install was cancelled")
+	}
+}
+
+func TestExtractUpgradeSkipsUnchangedFiles(t *testing.T) {
+	store := NewStore(t.TempDir(), importHardlink)
+	dest := t.TempDir()
+
+	old, _ := storeTarball(t, map[string]string{"package.json": `{"version":"1.0.0"}`, "lib.js": "unchanged"})
+	_, previous, err := extractTarGz(context.Background(), bytes.NewReader(old), filepath.Join(dest, "old"), store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// New files go through the store's temporary directory, so without it
+	// they can't be added
+	tmp := filepath.Join(store.dir, "tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged, _ := storeTarball(t, map[string]string{"package.json": `{"version":"1.0.0"}`, "lib.js": "unchanged"})
+	_, index, err := extractTarGz(context.Background(), bytes.NewReader(unchanged), filepath.Join(dest, "new"), store, previous)
+	if err != nil {
+		t.Fatalf("extractTarGz() of unchanged files error = %v", err)
+	}
+	if !reflect.DeepEqual(index.Files, previous.Files) {
+		t.Errorf("index files = %v, want %v", index.Files, previous.Files)
+	}
+	if content := readTestFile(t, filepath.Join(dest, "new", "lib.js")); content != "unchanged" {
+		t.Errorf("lib.js = %q, want unchanged", content)
+	}
+
+	// A file of the same size with new content is still stored
+	changed, _ := storeTarball(t, map[string]string{"package.json": `{"version":"1.0.1"}`})
+	if _, _, err := extractTarGz(context.Background(), bytes.NewReader(changed), filepath.Join(dest, "changed"), store, previous); err == nil {
+		t.Errorf("extractTarGz() of a changed file succeeded without the store's temporary directory")
+	}
+}
+
+func TestStoreDeduplicatesFiles(t *testing.T) {
+	store := NewStore(t.TempDir(), importHardlink)
+	dest := t.TempDir()
+
+	a, _ := storeTarball(t, map[string]string{"package.json": `{"name":"a"}`, "LICENSE": "MIT"})
+	b, _ := storeTarball(t, map[string]string{"package.json": `{"name":"b"}`, "LICENSE": "MIT"})
+	if _, _, err := extractTarGz(context.Background(), bytes.NewReader(a), filepath.Join(dest, "a"), store, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, index, err := extractTarGz(context.Background(), bytes.NewReader(b), filepath.Join(dest, "b"), store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Files) != 2 {
+		t.Errorf("index has %d files, want 2", len(index.Files))
+	}
+
+	blobs, err := filepath.Glob(filepath.Join(store.dir, "files", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 3 {
+		t.Errorf("store has %d files, want 3 with the license stored once", len(blobs))
+	}
+
+	licenseA, err := os.Stat(filepath.Join(dest, "a", "LICENSE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	licenseB, err := os.Stat(filepath.Join(dest, "b", "LICENSE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(licenseA, licenseB) {
+		t.Error("LICENSE files aren't linked to the same stored file")
+	}
+}
+
+func TestDownloadPackagesLinksFromStore(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+
+	tarball, integrity := storeTarball(t, map[string]string{"package.json": `{"name":"shared"}`, "index.js": "module.exports = 1"})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	packages := map[string]PackageInfo{
+		"node_modules/shared": {Version: "1.0.0", Resolved: server.URL + "/shared.tgz", Integrity: integrity},
+	}
+	if _, err := DownloadPackages(packages, t.TempDir(), InstallOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second project gets the package from the store
+	project := t.TempDir()
+	summary, err := DownloadPackages(packages, project, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+	if summary.FromStore != 1 || summary.Installed != 1 {
+		t.Errorf("summary = %+v, want the package linked from the store", summary)
+	}
+	data, err := os.ReadFile(filepath.Join(project, "shared", "index.js"))
+	if err != nil || string(data) != "module.exports = 1" {
+		t.Errorf("index.js = %q, %v", data, err)
+	}
+}
+
+func TestDownloadPackagesDeduplicatesTarballs(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+
+	tarball, integrity := storeTarball(t, map[string]string{"package.json": `{"name":"shared"}`, "index.js": "module.exports = 1"})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	// An alias and nested copies of the same tarball, one of them with no
+	// integrity to key on but the same URL
+	packages := map[string]PackageInfo{
+		"node_modules/shared":                  {Version: "1.0.0", Resolved: server.URL + "/shared.tgz", Integrity: integrity},
+		"node_modules/shared-alias":            {Version: "1.0.0", Resolved: server.URL + "/shared.tgz", Integrity: integrity},
+		"node_modules/a/node_modules/shared":   {Version: "1.0.0", Resolved: server.URL + "/shared.tgz", Integrity: integrity},
+		"node_modules/b/node_modules/unpinned": {Version: "1.0.0", Resolved: server.URL + "/unpinned.tgz"},
+		"node_modules/c/node_modules/unpinned": {Version: "1.0.0", Resolved: server.URL + "/unpinned.tgz"},
+	}
+	project := t.TempDir()
+	summary, err := DownloadPackages(packages, project, InstallOptions{UpdateIntegrity: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("requests = %d, want one per tarball", requests.Load())
+	}
+	if summary.Installed != 5 || summary.FromStore != 3 {
+		t.Errorf("summary = %+v, want 5 installed with 3 linked", summary)
+	}
+	for path := range packages {
+		data, err := os.ReadFile(filepath.Join(project, strings.TrimPrefix(path, "node_modules/"), "index.js"))
+		if err != nil || string(data) != "module.exports = 1" {
+			t.Errorf("%s/index.js = %q, %v", path, data, err)
+		}
+	}
+}
+
+func TestDownloadPackagesLinksNestedCopies(t *testing.T) {
+	t.Setenv("CALADAN_CACHE_DIR", t.TempDir())
+
+	tarball, integrity := storeTarball(t, map[string]string{"package.json": `{"name":"shared"}`, "index.js": "module.exports = 1"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	packages := map[string]PackageInfo{}
+	for _, path := range []string{"node_modules/shared", "node_modules/a/node_modules/shared", "node_modules/b/node_modules/shared"} {
+		packages[path] = PackageInfo{Version: "1.0.0", Resolved: server.URL + "/shared.tgz", Integrity: integrity}
+	}
+	project := t.TempDir()
+	if _, err := DownloadPackages(packages, project, InstallOptions{ImportMethod: importHardlink}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Extracted once, every copy is a link to the same file
+	var first os.FileInfo
+	for path := range packages {
+		info, err := os.Stat(filepath.Join(project, strings.TrimPrefix(path, "node_modules/"), "index.js"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = info
+		} else if !os.SameFile(first, info) {
+			t.Errorf("%s/index.js isn't linked to the other copies", path)
+		}
+	}
+}
+
+func TestStoreImportMethods(t *testing.T) {
+	tests := []struct {
+		method     string
+		wantShared bool
+	}{
+		{importHardlink, true},
+		{importCopy, false},
+		// Falls back to a copy where the filesystem can't clone
+		{importClone, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			store := NewStore(t.TempDir(), tt.method)
+			file, err := store.addFile(bytes.NewReader([]byte("MIT")), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := filepath.Join(t.TempDir(), "LICENSE")
+			if err := store.linkFile(file, target); err != nil {
+				t.Fatalf("linkFile() error = %v", err)
+			}
+			// Linking again replaces the file
+			if err := store.linkFile(file, target); err != nil {
+				t.Fatalf("linkFile() over an existing file error = %v", err)
+			}
+
+			data, err := os.ReadFile(target)
+			if err != nil || string(data) != "MIT" {
+				t.Fatalf("LICENSE = %q, %v", data, err)
+			}
+			blob, err := os.Stat(store.blobPath(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			linked, err := os.Stat(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shared := os.SameFile(blob, linked); shared != tt.wantShared {
+				t.Errorf("shares the stored file = %v, want %v", shared, tt.wantShared)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PackageStats records what installing a single package cost
+type PackageStats struct {
+	Path            string        `json:"path"`
+	Version         string        `json:"version"`
+	DownloadedBytes int64         `json:"downloadedBytes"`
+	UnpackedBytes   int64         `json:"unpackedBytes"`
+	Retries         int           `json:"retries"`
+	Duration        time.Duration `json:"-"`
+
+	// Time spent downloading and extracting, reported by --timing
+	downloadTime time.Duration
+	extractTime  time.Duration
+
+	// sha512 integrity of the downloaded tarball
+	integrity string
+
+	// Linked from the store without being downloaded
+	fromStore bool
+	// Extracted from the tarball cache without being downloaded
+	fromTarballCache bool
+
+	// The files that were installed, for entries sharing the tarball
+	index *packageIndex
+	// The files of the version installed at the same path before, when
+	// this install upgrades it, so unchanged files aren't written again
+	previous *packageIndex
+}
+
+// PackageFailure records a package that couldn't be installed
+type PackageFailure struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Error   string `json:"error"`
+
+	err error
+}
+
+// InstallSummary totals up the packages an install downloaded and extracted
+type InstallSummary struct {
+	Installed       int            `json:"installed"`
+	Skipped         int            `json:"skipped"`
+	DownloadedBytes int64          `json:"downloadedBytes"`
+	UnpackedBytes   int64          `json:"unpackedBytes"`
+	Retries         int            `json:"retries"`
+	FromStore       int            `json:"fromStore,omitempty"`
+	FromCache       int            `json:"fromCache,omitempty"` // Extracted from a cached tarball
+	Duration        time.Duration  `json:"-"`
+	Packages        []PackageStats `json:"packages"`
+
+	// Packages that failed, the install carries on without them unless
+	// --fail-fast is set
+	Failed []PackageFailure `json:"failed,omitempty"`
+
+	// Notices for the installed packages, printed together at the end
+	Deprecated []DeprecationNotice `json:"deprecated,omitempty"`
+	Funding    []FundingNotice     `json:"funding,omitempty"`
+	// Bins that weren't linked because their target is missing or isn't a
+	// file
+	BrokenBins []BrokenBin `json:"brokenBins,omitempty"`
+
+	// Prebuilt binaries fetched for install scripts, and the ones that
+	// couldn't be
+	Prebuilt []PrebuiltBinary `json:"prebuilt,omitempty"`
+
+	// Where install scripts connected to, with a script network policy
+	ScriptNetwork []ScriptConnection `json:"scriptNetwork,omitempty"`
+
+	// What the audit found, nil when it didn't run
+	Audit *AuditReport `json:"audit,omitempty"`
+
+	// Concurrency in effect at the end of the install
+	NetworkConcurrency int `json:"networkConcurrency"`
+	TarWorkers         int `json:"tarWorkers"`
+
+	// sha512 integrity computed for lockfile entries without one, by path,
+	// with --update-integrity
+	backfilled map[string]string
+}
+
+// MarshalJSON reports the duration in milliseconds
+func (s PackageStats) MarshalJSON() ([]byte, error) {
+	type stats PackageStats
+	return json.Marshal(struct {
+		stats
+		DurationMs int64 `json:"durationMs"`
+	}{stats(s), s.Duration.Milliseconds()})
+}
+
+// MarshalJSON reports the duration in milliseconds and sorts packages by path
+func (s InstallSummary) MarshalJSON() ([]byte, error) {
+	type summary InstallSummary
+	packages := append([]PackageStats{}, s.Packages...)
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Path < packages[j].Path
+	})
+	s.Packages = packages
+	s.Failed = sortedFailures(s.Failed)
+	return json.Marshal(struct {
+		summary
+		DurationMs int64 `json:"durationMs"`
+	}{summary(s), s.Duration.Milliseconds()})
+}
+
+// add records an installed package
+func (s *InstallSummary) add(stats PackageStats) {
+	s.Installed++
+	s.DownloadedBytes += stats.DownloadedBytes
+	s.UnpackedBytes += stats.UnpackedBytes
+	s.Retries += stats.Retries
+	if stats.fromStore {
+		s.FromStore++
+	}
+	if stats.fromTarballCache {
+		s.FromCache++
+	}
+	s.Packages = append(s.Packages, stats)
+}
+
+// fail records a package that couldn't be installed
+func (s *InstallSummary) fail(path, version string, err error) {
+	s.Failed = append(s.Failed, PackageFailure{Path: path, Version: version, Error: err.Error(), err: err})
+}
+
+// sortedFailures returns a copy of failures sorted by path
+func sortedFailures(failures []PackageFailure) []PackageFailure {
+	if failures == nil {
+		return nil
+	}
+	sorted := append([]PackageFailure{}, failures...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	return sorted
+}
+
+// RenderFailureReport lists every package that failed to install
+func RenderFailureReport(failures []PackageFailure) string {
+	var builder strings.Builder
+	builder.WriteString("\n" + colorError(fmt.Sprintf("%d packages failed to install:", len(failures))) + "\n")
+	for _, failure := range sortedFailures(failures) {
+		builder.WriteString(fmt.Sprintf("  %s: %s\n", colorPackage(failure.Path+"@"+failure.Version), failure.Error))
+	}
+	return builder.String()
+}
+
+// RenderInstallSummary renders the totals and the heaviest packages
+func RenderInstallSummary(summary *InstallSummary) string {
+	var builder strings.Builder
+
+	builder.WriteString(fmt.Sprintf("%s in %s (%s downloaded, %s unpacked)",
+		colorSuccess(fmt.Sprintf("Installed %d packages", summary.Installed)), summary.Duration.Round(time.Millisecond),
+		formatBytes(summary.DownloadedBytes), formatBytes(summary.UnpackedBytes)))
+	if summary.Skipped > 0 {
+		builder.WriteString(fmt.Sprintf(", skipped %d", summary.Skipped))
+	}
+	if summary.FromStore > 0 {
+		builder.WriteString(fmt.Sprintf(", %d linked from the store", summary.FromStore))
+	}
+	if summary.FromCache > 0 {
+		builder.WriteString(fmt.Sprintf(", %d extracted from cached tarballs", summary.FromCache))
+	}
+	if summary.Retries > 0 {
+		builder.WriteString(fmt.Sprintf(", %d retries", summary.Retries))
+	}
+	if len(summary.Failed) > 0 {
+		builder.WriteString(", " + colorError(fmt.Sprintf("%d failed", len(summary.Failed))))
+	}
+	builder.WriteString("\n")
+	builder.WriteString(fmt.Sprintf("Concurrency: %d downloads, %d extractions\n", summary.NetworkConcurrency, summary.TarWorkers))
+	if summary.Audit != nil {
+		builder.WriteString("Audit: " + RenderAuditCounts(summary.Audit) + "\n")
+	}
+	if fetched, cached := countPrebuilts(summary.Prebuilt); fetched > 0 {
+		builder.WriteString(fmt.Sprintf("Prebuilt binaries: %d fetched for install scripts (%d from the cache)\n", fetched, cached))
+	}
+	builder.WriteString(RenderScriptNetwork(summary.ScriptNetwork))
+
+	largest := append([]PackageStats{}, summary.Packages...)
+	sort.Slice(largest, func(i, j int) bool {
+		return largest[i].UnpackedBytes > largest[j].UnpackedBytes
+	})
+	if len(largest) > 5 {
+		largest = largest[:5]
+	}
+	if len(largest) > 0 {
+		builder.WriteString("Largest packages:\n")
+		for _, stats := range largest {
+			builder.WriteString(fmt.Sprintf("  %s %s\n", colorPackage(stats.Path+"@"+stats.Version), colorDim(formatBytes(stats.UnpackedBytes))))
+		}
+	}
+
+	return builder.String()
+}
+
+// formatBytes formats a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
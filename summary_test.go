@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0 B"},
+		{n: 1023, want: "1023 B"},
+		{n: 1536, want: "1.5 KiB"},
+		{n: 5 * 1024 * 1024, want: "5.0 MiB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestInstallSummaryJSON(t *testing.T) {
+	summary := &InstallSummary{}
+	summary.add(PackageStats{Path: "node_modules/b", Version: "1.0.0", DownloadedBytes: 10, UnpackedBytes: 30, Duration: 2 * time.Millisecond})
+	summary.add(PackageStats{Path: "node_modules/a", Version: "2.0.0", DownloadedBytes: 5, UnpackedBytes: 20, Duration: time.Millisecond})
+	summary.Duration = 1500 * time.Millisecond
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	want := `{"installed":2,"skipped":0,"downloadedBytes":15,"unpackedBytes":50,"retries":0,"packages":[` +
+		`{"path":"node_modules/a","version":"2.0.0","downloadedBytes":5,"unpackedBytes":20,"retries":0,"durationMs":1},` +
+		`{"path":"node_modules/b","version":"1.0.0","downloadedBytes":10,"unpackedBytes":30,"retries":0,"durationMs":2}],` +
+		`"networkConcurrency":0,"tarWorkers":0,"durationMs":1500}`
+	if string(data) != want {
+		t.Errorf("json.Marshal() = %s, want %s", data, want)
+	}
+}
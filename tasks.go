@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TaskConfig is how caladan run --workspaces schedules a script. The
+// config's tasks have them by script name (build), or for one workspace's
+// script (@corp/ui#build), which wins
+type TaskConfig struct {
+	Resource string `json:"resource,omitempty"` // cpu-heavy, io-heavy, or light, the default
+	Weight   int    `json:"weight,omitempty"`   // Job slots the task takes, 2 for cpu-heavy tasks and 1 otherwise by default
+}
+
+// Resource hints for tasks
+const (
+	resourceLight = "light"
+	resourceCPU   = "cpu-heavy"
+	resourceIO    = "io-heavy"
+)
+
+// maxIOTasks is how many io-heavy tasks run at once however many jobs are
+// allowed, since the disk doesn't get faster with more cores
+const maxIOTasks = 2
+
+// validateTasks checks the resource hints and weights of the config's tasks
+func validateTasks(tasks map[string]TaskConfig) error {
+	for name, task := range tasks {
+		switch task.Resource {
+		case "", resourceLight, resourceCPU, resourceIO:
+		default:
+			return fmt.Errorf("resource of task %s must be light, cpu-heavy, or io-heavy, got %s", name, task.Resource)
+		}
+		if task.Weight < 0 || task.Weight > maxConcurrency {
+			return fmt.Errorf("weight of task %s must be between 1 and %d, got %d", name, maxConcurrency, task.Weight)
+		}
+	}
+	return nil
+}
+
+// taskConfig returns the config of a workspace's script
+func (c Config) taskConfig(workspace, script string) TaskConfig {
+	if task, ok := c.Tasks[workspace+"#"+script]; ok {
+		return task
+	}
+	return c.Tasks[script]
+}
+
+// slots returns how many of jobs slots the task takes. A task heavier than
+// jobs takes them all, so it still runs, alone
+func (t TaskConfig) slots(jobs int) int {
+	weight := t.Weight
+	if weight == 0 {
+		weight = 1
+		if t.Resource == resourceCPU {
+			weight = 2
+		}
+	}
+	return min(weight, jobs)
+}
+
+// defaultJobs is how many job slots tasks share without --jobs or the
+// config's jobs
+func defaultJobs() int {
+	return runtime.NumCPU()
+}
+
+// RunWorkspacesOptions configures caladan run --workspaces
+type RunWorkspacesOptions struct {
+	Jobs    int           // Job slots the tasks share, the config's or the number of CPUs when 0
+	Timeout time.Duration // Kill a task that runs longer than this, the config's scriptTimeout when 0
+	Shell   string        // Run tasks with this shell instead of the config's or sh
+}
+
+// TaskResult is how one task went, a workspace's script or a package's
+// install scripts
+type TaskResult struct {
+	Name     string
+	Status   string // done, failed, or skipped when a dependency's failed
+	Duration time.Duration
+	Err      error
+}
+
+// scheduledTask is a task waiting for its dependencies and for room to run
+type scheduledTask struct {
+	config   TaskConfig
+	hasTask  bool // Nodes without a task only pass their dependencies' completion on
+	waiting  int  // Dependencies that haven't completed
+	blocked  bool // A dependency failed or was skipped
+	children []string
+}
+
+// scheduleTasks runs the task of each of names once the names it depends on
+// have run theirs, as many at a time as fit in jobs slots. Each task takes
+// its config's slots, and io-heavy tasks are also limited to maxIOTasks at
+// once. Ready tasks start in the order they became ready, sorted among
+// those that became ready together, and one that doesn't fit waits for
+// room rather than letting smaller ones past it, unless it's waiting for an
+// io-heavy task to finish. A failed task's dependents are skipped, while
+// everything else carries on. Names hasTask says have no task are passed
+// through, so their dependents still wait for the names below them. deps
+// must only name names, and a cycle fails the run once nothing else can
+func scheduleTasks(names []string, deps map[string][]string, jobs int, hasTask func(name string) bool, config func(name string) TaskConfig, run func(name string) error) ([]TaskResult, error) {
+	tasks := make(map[string]*scheduledTask, len(names))
+	for _, name := range names {
+		tasks[name] = &scheduledTask{hasTask: hasTask(name), config: config(name)}
+	}
+	for _, name := range names {
+		for _, dep := range deps[name] {
+			tasks[name].waiting++
+			tasks[dep].children = append(tasks[dep].children, name)
+		}
+	}
+
+	type finished struct {
+		name     string
+		err      error
+		duration time.Duration
+	}
+	done := make(chan finished)
+	results := []TaskResult{}
+	ready := []string{}
+	for _, name := range names {
+		if tasks[name].waiting == 0 {
+			ready = append(ready, name)
+		}
+	}
+	sort.Strings(ready)
+	remaining, used, ioRunning, running := len(names), 0, 0, 0
+
+	// complete records a finished task and readies the dependents it was
+	// the last dependency of
+	complete := func(name string, failed bool) {
+		remaining--
+		var next []string
+		for _, child := range tasks[name].children {
+			task := tasks[child]
+			task.waiting--
+			task.blocked = task.blocked || failed
+			if task.waiting == 0 {
+				next = append(next, child)
+			}
+		}
+		sort.Strings(next)
+		ready = append(ready, next...)
+	}
+
+	for remaining > 0 {
+		// Start what fits, in order, and pass through what has nothing to run
+		for i := 0; i < len(ready); {
+			name := ready[i]
+			task := tasks[name]
+			if task.blocked || !task.hasTask {
+				ready = append(ready[:i], ready[i+1:]...)
+				if task.blocked && task.hasTask {
+					results = append(results, TaskResult{Name: name, Status: "skipped"})
+				}
+				complete(name, task.blocked)
+				continue
+			}
+			if task.config.Resource == resourceIO && ioRunning >= maxIOTasks {
+				i++
+				continue
+			}
+			slots := task.config.slots(jobs)
+			if used+slots > jobs {
+				break
+			}
+			ready = append(ready[:i], ready[i+1:]...)
+			used += slots
+			running++
+			if task.config.Resource == resourceIO {
+				ioRunning++
+			}
+			go func() {
+				start := time.Now()
+				err := run(name)
+				done <- finished{name: name, err: err, duration: time.Since(start)}
+			}()
+		}
+		if remaining == 0 {
+			break
+		}
+		if running == 0 {
+			var cycle []string
+			for name, task := range tasks {
+				if task.waiting > 0 {
+					cycle = append(cycle, name)
+				}
+			}
+			sort.Strings(cycle)
+			return results, fmt.Errorf("dependency cycle between %s", strings.Join(cycle, ", "))
+		}
+
+		result := <-done
+		task := tasks[result.name]
+		running--
+		used -= task.config.slots(jobs)
+		if task.config.Resource == resourceIO {
+			ioRunning--
+		}
+		status := "done"
+		if result.err != nil {
+			status = "failed"
+		}
+		results = append(results, TaskResult{Name: result.name, Status: status, Duration: result.duration, Err: result.err})
+		complete(result.name, result.err != nil)
+	}
+	return results, nil
+}
+
+// prefixWriter writes whole lines to w with a prefix, so the output of
+// tasks running at once stays readable. Writers share mu
+type prefixWriter struct {
+	mu      *sync.Mutex
+	w       io.Writer
+	prefix  string
+	partial []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.partial = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		p.mu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.partial[:i])
+		p.mu.Unlock()
+		p.partial = p.partial[i+1:]
+		if err != nil {
+			return len(data), err
+		}
+	}
+}
+
+// flush writes what's left of a last line without a newline
+func (p *prefixWriter) flush() {
+	if len(p.partial) > 0 {
+		p.Write([]byte("\n"))
+	}
+}
+
+// RunWorkspaces runs a script in every workspace of the project in
+// directory that has it, dependencies first, with the rest of args passed
+// to it. Output lines are prefixed with the workspace's name
+func RunWorkspaces(directory string, args []string, opts RunWorkspacesOptions) ([]TaskResult, error) {
+	script := args[0]
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadConfig(directory)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTasks(config.Tasks); err != nil {
+		return nil, err
+	}
+	jobs := opts.Jobs
+	if jobs == 0 {
+		jobs = config.Jobs
+	}
+	if jobs == 0 {
+		jobs = defaultJobs()
+	}
+	if jobs < 0 || jobs > maxConcurrency {
+		return nil, fmt.Errorf("jobs must be between 1 and %d, got %d", maxConcurrency, jobs)
+	}
+	timeouts, err := config.ScriptTimeout.parse()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout > 0 {
+		timeouts.fallback = opts.Timeout
+	}
+
+	packages := make(map[string]scriptPackage)
+	for _, ws := range workspaces {
+		pkg, err := readScriptPackage(filepath.Join(directory, ws.Dir))
+		if err != nil {
+			return nil, err
+		}
+		packages[ws.Name] = pkg
+	}
+	rootBinDir, err := filepath.Abs(filepath.Join(projectPath(directory, config.ModulesDir, "node_modules"), ".bin"))
+	if err != nil {
+		return nil, err
+	}
+	configEnv := npmConfigEnv(InstallOptions{ScriptShell: config.scriptShell(opts.Shell), binaryMirrors: config.BinaryMirrors})
+
+	byName := make(map[string]workspace, len(workspaces))
+	names := make([]string, 0, len(workspaces))
+	for _, ws := range workspaces {
+		byName[ws.Name] = ws
+		names = append(names, ws.Name)
+	}
+	deps := make(map[string][]string)
+	for _, edge := range workspaceEdges(workspaces) {
+		if !slices.Contains(deps[edge.From], edge.To) {
+			deps[edge.From] = append(deps[edge.From], edge.To)
+		}
+	}
+	var mu sync.Mutex
+
+	fmt.Printf("Running %s in workspaces with %d jobs\n", script, jobs)
+	results, err := scheduleTasks(names, deps, jobs, func(name string) bool {
+		_, ok := packages[name].Scripts[script]
+		return ok
+	}, func(name string) TaskConfig {
+		return config.taskConfig(name, script)
+	}, func(name string) error {
+		pkg := packages[name]
+		command := strings.Join(append([]string{pkg.Scripts[script]}, args[1:]...), " ")
+		dir, err := filepath.Abs(filepath.Join(directory, byName[name].Dir))
+		if err != nil {
+			return err
+		}
+		output := &prefixWriter{mu: &mu, w: os.Stdout, prefix: colorPackage(name) + ": "}
+		defer output.flush()
+		fmt.Fprintf(output, "> %s\n", command)
+		err = runScript(dir, command, lifecycleEnv(configEnv, pkg, script, command), timeouts.forPackage(name), output, filepath.Join(dir, "node_modules", ".bin"), rootBinDir)
+		if err != nil {
+			return newScriptError(name, script, command, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return results, fmt.Errorf("workspace %v", err)
+	}
+	return results, nil
+}
+
+// RenderTaskResults lists how each workspace's script went
+func RenderTaskResults(results []TaskResult) string {
+	var builder strings.Builder
+	for _, result := range results {
+		switch result.Status {
+		case "done":
+			builder.WriteString(fmt.Sprintf("%s %s %s\n", colorSuccess("ok"), colorPackage(result.Name), colorDim(result.Duration.Round(time.Millisecond).String())))
+		case "failed":
+			builder.WriteString(fmt.Sprintf("%s %s: %v\n", colorError("failed"), colorPackage(result.Name), result.Err))
+		default:
+			builder.WriteString(fmt.Sprintf("%s %s %s\n", colorWarn("skipped"), colorPackage(result.Name), colorDim("a dependency failed")))
+		}
+	}
+	return builder.String()
+}
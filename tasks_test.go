@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduleTasks(t *testing.T) {
+	// app -> ui -> (tokens, nothing to run -> utils), and lint tasks on the side
+	names := []string{"app", "docs", "lint-a", "lint-b", "lint-c", "nothing", "tokens", "ui", "utils"}
+	deps := map[string][]string{
+		"app":     {"ui"},
+		"ui":      {"tokens", "nothing"},
+		"nothing": {"utils"},
+	}
+	configs := map[string]TaskConfig{
+		"app":    {Resource: resourceCPU},
+		"lint-a": {Resource: resourceIO},
+		"lint-b": {Resource: resourceIO},
+		"lint-c": {Resource: resourceIO},
+		"docs":   {Weight: 10},
+	}
+
+	var mu sync.Mutex
+	finished := make(map[string]time.Time)
+	started := make(map[string]time.Time)
+	used, maxUsed, ioRunning, maxIO := 0, 0, 0, 0
+	results, err := scheduleTasks(names, deps, 3, func(name string) bool {
+		return name != "nothing"
+	}, func(name string) TaskConfig {
+		return configs[name]
+	}, func(name string) error {
+		slots := configs[name].slots(3)
+		mu.Lock()
+		started[name] = time.Now()
+		used += slots
+		maxUsed = max(maxUsed, used)
+		if configs[name].Resource == resourceIO {
+			ioRunning++
+			maxIO = max(maxIO, ioRunning)
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		used -= slots
+		if configs[name].Resource == resourceIO {
+			ioRunning--
+		}
+		finished[name] = time.Now()
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 8 {
+		t.Errorf("got %d results, want one per name with a task", len(results))
+	}
+	for _, result := range results {
+		if result.Status != "done" {
+			t.Errorf("%s: %s", result.Name, result.Status)
+		}
+	}
+	if maxUsed > 3 {
+		t.Errorf("used %d slots at once, only 3 jobs", maxUsed)
+	}
+	if maxIO > maxIOTasks {
+		t.Errorf("ran %d io-heavy tasks at once", maxIO)
+	}
+	// ui waits for utils through nothing, which has no task
+	for _, dep := range [][2]string{{"app", "ui"}, {"ui", "tokens"}, {"ui", "utils"}} {
+		if started[dep[0]].Before(finished[dep[1]]) {
+			t.Errorf("%s started before %s finished", dep[0], dep[1])
+		}
+	}
+}
+
+func TestScheduleTasksFailure(t *testing.T) {
+	always := func(string) bool { return true }
+	noConfig := func(string) TaskConfig { return TaskConfig{} }
+	results, err := scheduleTasks([]string{"app", "lib", "other"}, map[string][]string{"app": {"lib"}}, 1, always, noConfig, func(name string) error {
+		if name == "lib" {
+			return fmt.Errorf("exit status 2")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]string)
+	for _, result := range results {
+		statuses[result.Name] = result.Status
+	}
+	if statuses["lib"] != "failed" || statuses["app"] != "skipped" || statuses["other"] != "done" {
+		t.Errorf("statuses = %v", statuses)
+	}
+
+	_, err = scheduleTasks([]string{"a", "b"}, map[string][]string{"a": {"b"}, "b": {"a"}}, 1, always, noConfig, func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "cycle between a, b") {
+		t.Errorf("scheduleTasks() error = %v, want a cycle", err)
+	}
+}
+
+func TestRunWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "package.json"), `{"name": "root", "workspaces": ["packages/*"], "caladan": {"jobs": 2}}`)
+	writeTestFile(t, filepath.Join(dir, "packages", "lib", "package.json"), `{"name": "lib", "scripts": {"build": "echo built > out.txt"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages", "app", "package.json"), `{"name": "app", "dependencies": {"lib": "workspace:*"}, "scripts": {"build": "cat ../lib/out.txt > out.txt; echo"}}`)
+	writeTestFile(t, filepath.Join(dir, "packages", "docs", "package.json"), `{"name": "docs"}`)
+
+	results, err := RunWorkspaces(dir, []string{"build", "--minify"}, RunWorkspacesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Name != "lib" || results[1].Name != "app" {
+		t.Fatalf("results = %+v", results)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "packages", "app", "out.txt"))
+	if err != nil || string(data) != "built --minify\n" {
+		t.Errorf("app built %q, %v", data, err)
+	}
+}
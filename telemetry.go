@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// otlpBatchSize caps how many spans go in one export request
+const otlpBatchSize = 1000
+
+// Tracer records spans for an install and exports them over OTLP/HTTP when the
+// command finishes. It's configured with the standard OTEL_* environment
+// variables, and all methods are safe to call on a nil Tracer
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	resource []otlpKeyValue
+
+	// Trace and span to parent the root span under, from TRACEPARENT
+	traceID, parentID string
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// Span is one timed operation. All methods are safe to call on a nil Span
+type Span struct {
+	tracer   *Tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []otlpKeyValue
+	err   error
+}
+
+type spanContextKey struct{}
+type tracerContextKey struct{}
+
+// newTracerFromEnv returns a tracer if an OTLP endpoint is configured
+func newTracerFromEnv() *Tracer {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil
+	}
+	if exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter != "" && exporter != "otlp" {
+		return nil
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	protocol := otelEnv("PROTOCOL")
+	if protocol != "" && protocol != "http/json" {
+		printWarning("OTLP protocol %s isn't supported, exporting traces as http/json", protocol)
+	}
+
+	timeout := 10 * time.Second
+	if ms, err := strconv.Atoi(otelEnv("TIMEOUT")); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	resourceAttrs := parseOtelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if serviceName == "" {
+		serviceName = resourceAttrs["service.name"]
+	}
+	if serviceName == "" {
+		serviceName = "caladan"
+	}
+	resourceAttrs["service.name"] = serviceName
+
+	resource := []otlpKeyValue{}
+	for key, value := range resourceAttrs {
+		resource = append(resource, otlpAttr(key, value))
+	}
+
+	tracer := &Tracer{
+		endpoint: endpoint,
+		headers:  parseOtelList(otelEnv("HEADERS")),
+		client:   &http.Client{Timeout: timeout},
+		resource: resource,
+	}
+	tracer.traceID, tracer.parentID = parseTraceparent(os.Getenv("TRACEPARENT"))
+	return tracer
+}
+
+// otelEnv reads an exporter setting, preferring the traces-specific variable
+func otelEnv(name string) string {
+	if value := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_" + name); value != "" {
+		return value
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+}
+
+// parseOtelList parses the key1=value1,key2=value2 format used by
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_RESOURCE_ATTRIBUTES
+func parseOtelList(list string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if decoded, err := url.PathUnescape(strings.TrimSpace(value)); err == nil {
+			value = decoded
+		}
+		if key != "" {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// parseTraceparent extracts the trace and span ids from a W3C traceparent,
+// so a CI job that already has a trace can nest the install inside it
+func parseTraceparent(traceparent string) (string, string) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", ""
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+// randomID returns n random bytes as hex
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withTracer returns a context whose spans are recorded by tracer
+func withTracer(ctx context.Context, tracer *Tracer) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerContextKey{}, tracer)
+}
+
+// startSpan starts a span under the context's current span and returns a
+// context carrying the new one. Without a tracer it returns a nil span
+func startSpan(ctx context.Context, name string, kind int, attrs ...otlpKeyValue) (context.Context, *Span) {
+	tracer, _ := ctx.Value(tracerContextKey{}).(*Tracer)
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: tracer,
+		spanID: randomID(8),
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  attrs,
+	}
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else if tracer.traceID != "" {
+		span.traceID = tracer.traceID
+		span.parentID = tracer.parentID
+	} else {
+		span.traceID = randomID(16)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// setAttrs adds attributes to the span
+func (s *Span) setAttrs(attrs ...otlpKeyValue) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// finish ends the span, marking it failed if err isn't nil
+func (s *Span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mu.Unlock()
+}
+
+// shutdown exports every finished span
+func (t *Tracer) shutdown() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+
+	for len(spans) > 0 {
+		batch := spans[:min(len(spans), otlpBatchSize)]
+		spans = spans[len(batch):]
+		if err := t.export(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export sends spans to the collector as an OTLP/HTTP JSON request
+func (t *Tracer) export(spans []*Span) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = span.toOTLP()
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: t.resource},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "caladan"},
+			Spans: otlpSpans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error exporting traces: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error exporting traces: collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.err != nil {
+		span.Status = &otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+	}
+	return span
+}
+
+// OTLP JSON encoding of an export request. Ids are hex strings and 64-bit
+// integers are decimal strings, as the OTLP JSON mapping requires
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+// otlpAttr builds a string attribute
+func otlpAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+// otlpIntAttr builds an integer attribute
+func otlpIntAttr(key string, value int64) otlpKeyValue {
+	s := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpValue{IntValue: &s}}
+}
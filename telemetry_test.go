@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracerExportsSpans(t *testing.T) {
+	var got otlpRequest
+	var gotAuth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("export path = %s, want /v1/traces", r.URL.Path)
+		}
+		gotAuth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding export: %v", err)
+		}
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20token")
+	t.Setenv("OTEL_SERVICE_NAME", "ci-install")
+	t.Setenv("TRACEPARENT", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	tracer := newTracerFromEnv()
+	if tracer == nil {
+		t.Fatal("newTracerFromEnv() = nil with an endpoint set")
+	}
+
+	ctx, root := startSpan(withTracer(context.Background(), tracer), "caladan install", spanKindInternal)
+	_, child := startSpan(ctx, "download", spanKindClient, otlpAttr("url.full", "https://example.com/a.tgz"))
+	child.finish(errors.New("boom"))
+	root.finish(nil)
+
+	if err := tracer.shutdown(); err != nil {
+		t.Fatalf("shutdown() error = %v", err)
+	}
+
+	if gotAuth != "Bearer token" {
+		t.Errorf("Authorization header = %q, want %q", gotAuth, "Bearer token")
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export shape: %+v", got)
+	}
+	resource := got.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || *resource[0].Value.StringValue != "ci-install" {
+		t.Errorf("resource attributes = %+v, want service.name=ci-install", resource)
+	}
+
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	download, install := spans[0], spans[1]
+	if install.TraceID != "0af7651916cd43dd8448eb211c80319c" || install.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("root span isn't parented under TRACEPARENT: %+v", install)
+	}
+	if download.TraceID != install.TraceID || download.ParentSpanID != install.SpanID {
+		t.Errorf("download span isn't a child of the root span: %+v", download)
+	}
+	if download.Status == nil || download.Status.Code != spanStatusError || download.Status.Message != "boom" {
+		t.Errorf("download span status = %+v, want error boom", download.Status)
+	}
+}
+
+func TestTracerDisabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if tracer := newTracerFromEnv(); tracer != nil {
+		t.Errorf("newTracerFromEnv() = %+v without an endpoint, want nil", tracer)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	if tracer := newTracerFromEnv(); tracer != nil {
+		t.Errorf("newTracerFromEnv() = %+v with OTEL_SDK_DISABLED, want nil", tracer)
+	}
+
+	// Spans are no-ops without a tracer
+	_, span := startSpan(context.Background(), "resolve", spanKindInternal)
+	if span != nil {
+		t.Errorf("startSpan() without a tracer = %+v, want nil", span)
+	}
+	span.setAttrs(otlpAttr("package.name", "a"))
+	span.finish(nil)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// TokenOptions configures caladan token create. A token with a Name is a
+// granular access token, scoped to Packages, Scopes, and Orgs, otherwise
+// it's a legacy token with publish rights unless ReadOnly is set
+type TokenOptions struct {
+	ReadOnly   bool
+	Automation bool     // Bypasses two-factor authentication, for CI
+	CIDR       []string // Ranges the token may be used from, anywhere if empty
+
+	Name               string
+	Description        string
+	ExpiresDays        int
+	Packages           []string
+	Scopes             []string
+	Orgs               []string
+	PackagesPermission string // read-only, read-write, or no-access
+	OrgsPermission     string
+	OTP                string // One-time password, for accounts with 2FA
+}
+
+// RegistryToken is a token as the registry lists it. Only the first and
+// last few characters of existing tokens are returned, the full token only
+// when it's created
+type RegistryToken struct {
+	Key        string   `json:"key"`
+	Token      string   `json:"token"`
+	Name       string   `json:"name,omitempty"`
+	ReadOnly   bool     `json:"readonly"`
+	Automation bool     `json:"automation,omitempty"`
+	CIDR       []string `json:"cidr_whitelist"`
+	Created    string   `json:"created"`
+	Expires    string   `json:"expires,omitempty"`
+}
+
+// tokenRequest is the body of a token create. npm's registry wants the
+// account password again, even with a valid token
+func tokenRequest(password string, opts TokenOptions) map[string]interface{} {
+	body := map[string]interface{}{
+		"password":       password,
+		"readonly":       opts.ReadOnly,
+		"cidr_whitelist": opts.CIDR,
+	}
+	if opts.CIDR == nil {
+		body["cidr_whitelist"] = []string{}
+	}
+	if opts.Automation {
+		body["automation"] = true
+	}
+	if opts.Name != "" {
+		body["name"] = opts.Name
+		body["token_description"] = opts.Description
+		body["expires"] = opts.ExpiresDays
+		body["packages"] = opts.Packages
+		body["scopes"] = opts.Scopes
+		body["orgs"] = opts.Orgs
+		body["packages_and_scopes_permission"] = opts.PackagesPermission
+		body["orgs_permission"] = opts.OrgsPermission
+		delete(body, "readonly")
+	}
+	return body
+}
+
+// validateTokenOptions checks the options make sense together
+func validateTokenOptions(opts TokenOptions) error {
+	for _, cidr := range opts.CIDR {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR range %q", cidr)
+		}
+	}
+	if opts.Name == "" {
+		if len(opts.Packages) > 0 || len(opts.Scopes) > 0 || len(opts.Orgs) > 0 || opts.ExpiresDays != 0 {
+			return fmt.Errorf("--packages, --scopes, --orgs, and --expires need a --name for a granular token")
+		}
+		return nil
+	}
+	if opts.ExpiresDays <= 0 {
+		return fmt.Errorf("granular tokens need --expires, in days")
+	}
+	if opts.ReadOnly {
+		return fmt.Errorf("granular tokens take --packages-permission and --orgs-permission instead of --read-only")
+	}
+	for _, permission := range []string{opts.PackagesPermission, opts.OrgsPermission} {
+		if permission != "" && permission != "read-only" && permission != "read-write" && permission != "no-access" {
+			return fmt.Errorf("permissions must be read-only, read-write, or no-access, got %q", permission)
+		}
+	}
+	return nil
+}
+
+// createToken makes a token, returning it in full
+func (r *RegistryClient) createToken(ctx context.Context, password string, opts TokenOptions) (RegistryToken, error) {
+	var token RegistryToken
+	err := r.send(ctx, "POST", "/-/npm/v1/tokens", tokenRequest(password, opts), &token)
+	return token, err
+}
+
+// listTokens returns every token of the account, following the registry's
+// pages
+func (r *RegistryClient) listTokens(ctx context.Context) ([]RegistryToken, error) {
+	tokens := []RegistryToken{}
+	path := "/-/npm/v1/tokens"
+	for path != "" {
+		var page struct {
+			Objects []RegistryToken `json:"objects"`
+			URLs    struct {
+				Next string `json:"next"`
+			} `json:"urls"`
+		}
+		if err := r.send(ctx, "GET", path, nil, &page); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, page.Objects...)
+		path = strings.TrimPrefix(page.URLs.Next, r.registry)
+	}
+	return tokens, nil
+}
+
+// revokeToken deletes the token whose key or token starts with id, which
+// has to pick out exactly one
+func (r *RegistryClient) revokeToken(ctx context.Context, id string) (RegistryToken, error) {
+	tokens, err := r.listTokens(ctx)
+	if err != nil {
+		return RegistryToken{}, err
+	}
+	matches := []RegistryToken{}
+	for _, token := range tokens {
+		if strings.HasPrefix(token.Key, id) || strings.HasPrefix(token.Token, id) {
+			matches = append(matches, token)
+		}
+	}
+	if len(matches) == 0 {
+		return RegistryToken{}, fmt.Errorf("no token matches %s", id)
+	}
+	if len(matches) > 1 {
+		return RegistryToken{}, fmt.Errorf("%s matches %d tokens, give more of its key", id, len(matches))
+	}
+	return matches[0], r.send(ctx, "DELETE", "/-/npm/v1/tokens/token/"+matches[0].Key, nil, nil)
+}
+
+// readPassword takes the account password from NPM_PASSWORD, or the first
+// line of stdin so CI can pipe it in
+func readPassword(stdin io.Reader) (string, error) {
+	if password := os.Getenv("NPM_PASSWORD"); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password given, set NPM_PASSWORD or pipe it to stdin")
+	}
+	return password, nil
+}
+
+// CreateToken runs caladan token create, printing the new token
+func CreateToken(opts TokenOptions) error {
+	if err := validateTokenOptions(opts); err != nil {
+		return err
+	}
+	api, err := authenticatedRegistryClient()
+	if err != nil {
+		return err
+	}
+	api.otp = opts.OTP
+	password, err := readPassword(os.Stdin)
+	if err != nil {
+		return err
+	}
+	token, err := api.createToken(context.Background(), password, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Print(RenderTokens([]RegistryToken{token}))
+	return nil
+}
+
+// ListTokens runs caladan token list
+func ListTokens(jsonOutput bool) error {
+	api, err := authenticatedRegistryClient()
+	if err != nil {
+		return err
+	}
+	tokens, err := api.listTokens(context.Background())
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(tokens)
+	}
+	fmt.Print(RenderTokens(tokens))
+	return nil
+}
+
+// RevokeToken runs caladan token revoke for each id
+func RevokeToken(ids []string, otp string) error {
+	api, err := authenticatedRegistryClient()
+	if err != nil {
+		return err
+	}
+	api.otp = otp
+	for _, id := range ids {
+		token, err := api.revokeToken(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %s\n", token.Key)
+	}
+	return nil
+}
+
+// RenderTokens lists tokens with what they're allowed to do
+func RenderTokens(tokens []RegistryToken) string {
+	var builder strings.Builder
+	for _, token := range tokens {
+		kind := "publish"
+		switch {
+		case token.Name != "":
+			kind = "granular " + colorPackage(token.Name)
+		case token.Automation:
+			kind = "automation"
+		case token.ReadOnly:
+			kind = "read-only"
+		}
+		key := token.Key
+		if len(key) > 6 {
+			key = key[:6]
+		}
+		builder.WriteString(fmt.Sprintf("%s  %s  %s", key, token.Token, kind))
+		if token.Created != "" {
+			builder.WriteString(colorDim(", created " + token.Created))
+		}
+		if token.Expires != "" {
+			builder.WriteString(colorDim(", expires " + token.Expires))
+		}
+		if len(token.CIDR) > 0 {
+			builder.WriteString(colorDim(", from " + strings.Join(token.CIDR, ", ")))
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
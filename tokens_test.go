@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegistryTokens(t *testing.T) {
+	deleted := []string{}
+	var created map[string]interface{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/-/npm/v1/tokens":
+			if r.Header.Get("npm-otp") != "123456" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&created)
+			w.Write([]byte(`{"key": "c0ffee00", "token": "npm_full", "readonly": false, "automation": true, "cidr_whitelist": ["192.0.2.0/24"]}`))
+		case r.Method == "GET" && r.URL.Path == "/-/npm/v1/tokens" && r.URL.Query().Get("page") == "":
+			w.Write([]byte(`{"objects": [{"key": "a1b2c3d4", "token": "npm_ab...cd"}], "urls": {"next": "` + server.URL + `/-/npm/v1/tokens?page=2"}}`))
+		case r.Method == "GET" && r.URL.Path == "/-/npm/v1/tokens":
+			w.Write([]byte(`{"objects": [{"key": "a1ffffff", "token": "npm_ef...gh", "readonly": true}], "urls": {}}`))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/-/npm/v1/tokens/token/"):
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/-/npm/v1/tokens/token/"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	api := newRegistryClient(server.Client(), server.URL, "token")
+	api.otp = "123456"
+	ctx := context.Background()
+	opts := TokenOptions{Automation: true, CIDR: []string{"192.0.2.0/24"}}
+	token, err := api.createToken(ctx, "hunter2", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "npm_full" || created["password"] != "hunter2" || created["automation"] != true {
+		t.Errorf("created %+v with %v", token, created)
+	}
+
+	tokens, err := api.listTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("listTokens() = %+v, want both pages", tokens)
+	}
+	if rendered := RenderTokens(tokens); !strings.Contains(rendered, "a1ffff  npm_ef...gh  read-only") {
+		t.Errorf("RenderTokens() = %q", rendered)
+	}
+
+	if _, err := api.revokeToken(ctx, "a1"); err == nil {
+		t.Errorf("revoking an ambiguous key succeeded")
+	}
+	if _, err := api.revokeToken(ctx, "a1b"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"a1b2c3d4"}) {
+		t.Errorf("deleted %v", deleted)
+	}
+}
+
+func TestValidateTokenOptions(t *testing.T) {
+	tests := []struct {
+		opts  TokenOptions
+		valid bool
+	}{
+		{TokenOptions{ReadOnly: true, CIDR: []string{"10.0.0.0/8"}}, true},
+		{TokenOptions{CIDR: []string{"10.0.0.1"}}, false},
+		{TokenOptions{Packages: []string{"@corp/http"}}, false},
+		{TokenOptions{Name: "ci", ExpiresDays: 30, Scopes: []string{"@corp"}, PackagesPermission: "read-write"}, true},
+		{TokenOptions{Name: "ci", Scopes: []string{"@corp"}}, false},
+		{TokenOptions{Name: "ci", ExpiresDays: 30, PackagesPermission: "admin"}, false},
+	}
+	for _, tt := range tests {
+		if err := validateTokenOptions(tt.opts); (err == nil) != tt.valid {
+			t.Errorf("validateTokenOptions(%+v) = %v", tt.opts, err)
+		}
+	}
+}
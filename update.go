@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Update re-resolves a single direct dependency and rewrites only the lockfile
+// entries that belong to it, leaving every other entry untouched
+func Update(directory string, pkgName string, opts InstallOptions) error {
+	packageJSONPath := filepath.Join(directory, "package.json")
+	data, err := os.ReadFile(packageJSONPath)
+	if err != nil {
+		return err
+	}
+
+	var packageJSON PackageInfo
+	if err := json.Unmarshal(data, &packageJSON); err != nil {
+		return fmt.Errorf("error parsing %s: %v", packageJSONPath, err)
+	}
+	projectCatalogs, err := parseCatalogs(data)
+	if err != nil {
+		return err
+	}
+	if err := projectCatalogs.resolveManifestCatalogs(&packageJSON); err != nil {
+		return err
+	}
+	if packageJSON, _, err = withWorkspaceDependencies(directory, packageJSON, projectCatalogs); err != nil {
+		return err
+	}
+
+	isDev, isOptional := false, false
+	versionRange, ok := packageJSON.Dependencies[pkgName]
+	if !ok {
+		versionRange, ok = packageJSON.DevDependencies[pkgName]
+		isDev = ok
+	}
+	if !ok {
+		versionRange, ok = packageJSON.OptionalDependencies[pkgName]
+		isOptional = ok
+	}
+	if !ok {
+		return fmt.Errorf("%s is not a direct dependency in %s", pkgName, packageJSONPath)
+	}
+
+	config, err := loadConfig(directory)
+	if err != nil {
+		return err
+	}
+	if err := opts.applyConfig(config); err != nil {
+		return err
+	}
+
+	lockfilePath := filepath.Join(directory, "package-lock.json")
+	packageLock, err := readLockFile(lockfilePath)
+	if err != nil {
+		return fmt.Errorf("error reading lockfile (run caladan install first): %v", err)
+	}
+
+	// Keep a copy of the original entries to diff against
+	oldPackages := make(map[string]json.RawMessage, len(packageLock.Packages))
+	for path, raw := range packageLock.Packages {
+		oldPackages[path] = raw
+	}
+
+	client := opts.registryClient()
+	httpSemaphore := semaphore.NewWeighted(opts.networkConcurrency())
+	resolver := NewPackageResolver(client, httpSemaphore)
+	resolver.stats = opts.cacheStats
+	resolver.avoidDeprecated = opts.NoDeprecated
+	resolver.hideDeprecated = opts.NoDeprecationWarnings
+	resolveStart := time.Now()
+	resolveCtx, resolveSpan := startSpan(opts.context(), "resolve", spanKindInternal)
+	resolved, err := resolver.ResolveDependency(resolveCtx, pkgName, versionRange)
+	resolveSpan.finish(err)
+	if err != nil {
+		return fmt.Errorf("error resolving %s@%s: %w", pkgName, versionRange, err)
+	}
+	resolved = markDirectDependency(resolved, isDev, isOptional)
+	opts.timings.since(phaseResolution, resolveStart)
+	linkStart := time.Now()
+
+	oldVersion, err := relockPackage(packageLock.Packages, pkgName, resolved)
+	if err != nil {
+		return err
+	}
+
+	if err := updateRootVersion(packageLock.Packages, pkgName, oldVersion, resolved.Version); err != nil {
+		return err
+	}
+	opts.timings.since(phaseLinking, linkStart)
+
+	changes := diffLockfiles(oldPackages, packageLock.Packages)
+	if len(changes) == 0 {
+		fmt.Printf("%s@%s is already up to date\n", pkgName, resolved.Version)
+		return nil
+	}
+	fmt.Println("Lockfile changes:")
+	fmt.Println(RenderLockfileDiff(changes))
+
+	if err := writeLockFile(lockfilePath, packageLock); err != nil {
+		return fmt.Errorf("error writing lockfile: %v", err)
+	}
+	if err := annotateLockfile(directory, "caladan update "+pkgName, oldPackages, packageLock.Packages, changes, nil, time.Now()); err != nil {
+		return fmt.Errorf("error writing lockfile annotations: %v", err)
+	}
+	if opts.ConflictReport {
+		reportConflicts(packageLock.Packages)
+	}
+	if opts.LockfileOnly {
+		printLockfileOnly(lockfilePath)
+		return nil
+	}
+
+	return InstallLockFile(lockfilePath, opts)
+}
+
+// markDirectDependency marks a newly resolved direct dependency, and what
+// it needs, dev or optional the way the root depends on it
+func markDirectDependency(resolved PackageInfo, isDev, isOptional bool) PackageInfo {
+	if isDev {
+		// Entries shared with production dependencies already exist in the
+		// lockfile and are reused, so everything newly placed is dev-only
+		resolved.Dev = true
+		resolved = MarkDevDependencies([]PackageInfo{resolved})[0]
+	}
+	resolved.Optional = isOptional
+	return MarkOptionalDependencies([]PackageInfo{resolved})[0]
+}
+
+// relockPackage replaces the lockfile entries of the direct dependency
+// pkgName with a newly resolved copy, leaving every other entry as it was. It returns the
+// version the root had before, empty when it had none
+func relockPackage(packages map[string]json.RawMessage, pkgName string, resolved PackageInfo) (string, error) {
+	pkgPath := "node_modules/" + pkgName
+	oldVersion := lockfileEntryVersion(packages[pkgPath])
+
+	// Other packages may also depend on the root copy. If the new version no
+	// longer satisfies them, they keep the old version nested under themselves
+	if oldVersion != "" && oldVersion != resolved.Version {
+		if err := nestForDependents(packages, pkgName, resolved.Version); err != nil {
+			return "", err
+		}
+	}
+
+	// Drop the old package along with its nested node_modules
+	for path := range packages {
+		if path == pkgPath || strings.HasPrefix(path, pkgPath+"/node_modules/") {
+			delete(packages, path)
+		}
+	}
+
+	// Drop hoisted packages that only the old version needed
+	if reachable := reachableLockfilePaths(packages); reachable != nil {
+		for path := range packages {
+			if !reachable[path] {
+				delete(packages, path)
+			}
+		}
+	}
+
+	return oldVersion, placeLockfilePackage(packages, resolved, pkgPath)
+}
+
+// nestForDependents copies the root entry of pkgName (and its nested
+// node_modules) under every dependent whose range the new version won't satisfy
+func nestForDependents(packages map[string]json.RawMessage, pkgName, newVersion string) error {
+	pkgPath := "node_modules/" + pkgName
+
+	dependents := []string{}
+	for path, raw := range packages {
+		if path == "" || path == pkgPath || strings.HasPrefix(path, pkgPath+"/") {
+			continue
+		}
+
+		var entry PackageInfo
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			continue
+		}
+		depRange, ok := entry.Dependencies[pkgName]
+		if !ok {
+			depRange, ok = entry.OptionalDependencies[pkgName]
+		}
+		if !ok {
+			continue
+		}
+		if resolvedPath, found := findLockfileDependency(packages, path, pkgName); !found || resolvedPath != pkgPath {
+			continue
+		}
+
+		matches, err := GetMatchingVersions(depRange, []string{newVersion})
+		if err == nil && len(matches) > 0 && matches[0] != "" {
+			continue
+		}
+
+		dependents = append(dependents, path)
+	}
+
+	// Collect the subtree before adding to the map we're reading from
+	subtree := make(map[string]json.RawMessage)
+	for path, raw := range packages {
+		if path == pkgPath || strings.HasPrefix(path, pkgPath+"/node_modules/") {
+			subtree[strings.TrimPrefix(path, pkgPath)] = raw
+		}
+	}
+
+	for _, path := range dependents {
+		fmt.Printf("Keeping %s@%s nested under %s\n", pkgName, lockfileEntryVersion(packages[pkgPath]), path)
+		nestedPath := path + "/node_modules/" + pkgName
+		for suffix, raw := range subtree {
+			packages[nestedPath+suffix] = raw
+		}
+	}
+
+	return nil
+}
+
+// updateRootVersion bumps the root entry's pinned version of pkgName. Ranges
+// copied from package.json are left alone since they didn't change
+func updateRootVersion(packages map[string]json.RawMessage, pkgName, oldVersion, newVersion string) error {
+	rawRoot, ok := packages[""]
+	if !ok {
+		return nil
+	}
+
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(rawRoot, &root); err != nil {
+		return fmt.Errorf("error parsing root lockfile entry: %v", err)
+	}
+
+	for _, field := range []string{"dependencies", "devDependencies", "optionalDependencies"} {
+		var deps map[string]string
+		if err := json.Unmarshal(root[field], &deps); err != nil || deps[pkgName] != oldVersion {
+			continue
+		}
+		deps[pkgName] = newVersion
+		data, err := json.Marshal(deps)
+		if err != nil {
+			return err
+		}
+		root[field] = data
+	}
+
+	data, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	packages[""] = data
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ViewTarballOptions controls caladan view-tarball
+type ViewTarballOptions struct {
+	JSON bool
+
+	jsonOutput io.Writer // Where JSON goes, stdout when nil
+}
+
+// TarballFile is a file in a package tarball
+type TarballFile struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Executable bool   `json:"executable,omitempty"`
+}
+
+// TarballListing is what's in a published version's tarball, read without
+// installing it
+type TarballListing struct {
+	Name           string            `json:"name"`
+	Version        string            `json:"version"`
+	Tarball        string            `json:"tarball"`
+	PackageSize    int64             `json:"packageSize"`
+	UnpackedSize   int64             `json:"unpackedSize"`
+	Files          []TarballFile     `json:"files"`
+	InstallScripts map[string]string `json:"installScripts,omitempty"`
+	Bins           map[string]string `json:"bins,omitempty"`
+	NativeAddons   []string          `json:"nativeAddons,omitempty"` // Prebuilt .node files
+}
+
+// listTarball reads a package tarball's file headers and its package.json,
+// skipping over the other files' contents, so nothing is written to disk
+func listTarball(src io.Reader) (TarballListing, error) {
+	listing := TarballListing{}
+	compressed := &countingReader{r: src}
+	gzr, err := gzip.NewReader(bufio.NewReader(compressed))
+	if err != nil {
+		return listing, fmt.Errorf("error creating gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	var manifest struct {
+		Name    string            `json:"name"`
+		Scripts map[string]string `json:"scripts"`
+		Bin     interface{}       `json:"bin"`
+	}
+	hasBindingGyp := false
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return listing, fmt.Errorf("error reading tar: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The top level folder is usually package/, but not always
+		_, name, ok := strings.Cut(header.Name, "/")
+		if !ok || name == "" {
+			continue
+		}
+		listing.Files = append(listing.Files, TarballFile{Path: name, Size: header.Size, Executable: header.Mode&0111 != 0})
+		listing.UnpackedSize += header.Size
+		switch {
+		case name == "package.json":
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return listing, fmt.Errorf("error parsing package.json: %v", err)
+			}
+		case name == "binding.gyp":
+			hasBindingGyp = true
+		case strings.HasSuffix(name, ".node"):
+			listing.NativeAddons = append(listing.NativeAddons, name)
+		}
+	}
+	// Read to the end so the package size covers the whole tarball
+	if _, err := io.Copy(io.Discard, compressed); err != nil {
+		return listing, err
+	}
+	listing.PackageSize = compressed.n
+
+	sort.Slice(listing.Files, func(i, j int) bool {
+		return listing.Files[i].Path < listing.Files[j].Path
+	})
+	sort.Strings(listing.NativeAddons)
+	for _, event := range installScripts {
+		if script, ok := manifest.Scripts[event]; ok {
+			if listing.InstallScripts == nil {
+				listing.InstallScripts = make(map[string]string)
+			}
+			listing.InstallScripts[event] = script
+		}
+	}
+	// Like npm, a package with a binding.gyp and no install scripts is
+	// built with node-gyp
+	_, hasInstall := manifest.Scripts["install"]
+	_, hasPreinstall := manifest.Scripts["preinstall"]
+	if hasBindingGyp && !hasInstall && !hasPreinstall {
+		if listing.InstallScripts == nil {
+			listing.InstallScripts = make(map[string]string)
+		}
+		listing.InstallScripts["install"] = "node-gyp rebuild"
+	}
+	if bins := npmBins(manifest.Bin, manifest.Name); len(bins) > 0 {
+		listing.Bins = bins
+	}
+	return listing, nil
+}
+
+// ViewTarball lists the files of a published version of a package, with
+// their sizes, and whether it runs install scripts or links bins, before
+// it's depended on. The tarball is streamed and only its headers and
+// package.json are read
+func ViewTarball(spec string, opts ViewTarballOptions) error {
+	name, versionRange := parsePackageSpec(spec)
+	config, err := loadConfig(".")
+	if err != nil {
+		return err
+	}
+	installOpts := InstallOptions{}
+	if err := installOpts.applyConfig(config); err != nil {
+		return err
+	}
+	client := installOpts.registryClient()
+	resolver := NewPackageResolver(client, semaphore.NewWeighted(1))
+
+	ctx := context.Background()
+	metadata, _, err := resolver.packageMetadata(ctx, name, versionRange)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", name, err)
+	}
+	pkgInfo, err := resolveVersion(name, versionRange, metadata, false)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.tarball(ctx, pkgInfo.Dist.Tarball, false, nil)
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", pkgInfo.Dist.Tarball, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &RegistryError{URL: pkgInfo.Dist.Tarball, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	listing, err := listTarball(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", pkgInfo.Dist.Tarball, err)
+	}
+	listing.Name = name
+	listing.Version = pkgInfo.Version
+	listing.Tarball = pkgInfo.Dist.Tarball
+
+	if opts.JSON {
+		output := opts.jsonOutput
+		if output == nil {
+			output = os.Stdout
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listing)
+	}
+	fmt.Print(RenderTarballListing(listing))
+	return nil
+}
+
+// RenderTarballListing lists a tarball's files with their sizes, like
+// caladan pack does, then what installing it would run and link
+func RenderTarballListing(listing TarballListing) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("Tarball contents of %s:\n", colorPackage(listing.Name+"@"+listing.Version)))
+	for _, file := range listing.Files {
+		builder.WriteString(fmt.Sprintf("  %-10s %s\n", formatBytes(file.Size), file.Path))
+	}
+	builder.WriteString("Tarball details:\n")
+	builder.WriteString(fmt.Sprintf("  tarball:       %s\n", listing.Tarball))
+	builder.WriteString(fmt.Sprintf("  package size:  %s\n", formatBytes(listing.PackageSize)))
+	builder.WriteString(fmt.Sprintf("  unpacked size: %s\n", formatBytes(listing.UnpackedSize)))
+	builder.WriteString(fmt.Sprintf("  total files:   %d\n", len(listing.Files)))
+
+	if len(listing.InstallScripts) == 0 {
+		builder.WriteString(colorDim("No install scripts") + "\n")
+	} else {
+		builder.WriteString(colorWarn("Install scripts:") + "\n")
+		for _, event := range installScripts {
+			if script, ok := listing.InstallScripts[event]; ok {
+				builder.WriteString(fmt.Sprintf("  %-12s %s\n", event+":", script))
+			}
+		}
+	}
+	if len(listing.NativeAddons) > 0 {
+		builder.WriteString("Native addons:\n")
+		for _, addon := range listing.NativeAddons {
+			builder.WriteString(fmt.Sprintf("  %s\n", addon))
+		}
+	}
+	if len(listing.Bins) > 0 {
+		commands := make([]string, 0, len(listing.Bins))
+		for command := range listing.Bins {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		builder.WriteString("Bins:\n")
+		for _, command := range commands {
+			builder.WriteString(fmt.Sprintf("  %s -> %s\n", command, listing.Bins[command]))
+		}
+	}
+	return builder.String()
+}
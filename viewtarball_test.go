@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+func TestListTarball(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, file := range []struct {
+		name    string
+		mode    int64
+		content string
+	}{
+		{"package/package.json", 0644, `{"name": "@scope/tool", "scripts": {"postinstall": "node setup.js", "test": "jest"}, "bin": "cli.js"}`},
+		{"package/cli.js", 0755, "#!/usr/bin/env node\n"},
+		{"package/binding.gyp", 0644, "{}"},
+		{"package/build/Release/tool.node", 0644, "\x7fELF"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: file.mode, Size: int64(len(file.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(buf.Len())
+
+	listing, err := listTarball(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, file := range listing.Files {
+		paths = append(paths, file.Path)
+	}
+	if want := []string{"binding.gyp", "build/Release/tool.node", "cli.js", "package.json"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("files = %v, want %v", paths, want)
+	}
+	if !listing.Files[2].Executable || listing.Files[3].Executable {
+		t.Errorf("executable flags = %+v", listing.Files)
+	}
+	if listing.PackageSize != size {
+		t.Errorf("package size = %d, want %d", listing.PackageSize, size)
+	}
+	// binding.gyp adds node-gyp rebuild, as there's no install script
+	wantScripts := map[string]string{"install": "node-gyp rebuild", "postinstall": "node setup.js"}
+	if !reflect.DeepEqual(listing.InstallScripts, wantScripts) {
+		t.Errorf("install scripts = %v, want %v", listing.InstallScripts, wantScripts)
+	}
+	if want := map[string]string{"tool": "cli.js"}; !reflect.DeepEqual(listing.Bins, want) {
+		t.Errorf("bins = %v, want %v", listing.Bins, want)
+	}
+	if want := []string{"build/Release/tool.node"}; !reflect.DeepEqual(listing.NativeAddons, want) {
+		t.Errorf("native addons = %v, want %v", listing.NativeAddons, want)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// WorkspacesOptions configures the workspaces commands
+type WorkspacesOptions struct {
+	JSON bool // Print JSON on stdout
+	DOT  bool // Print the graph in Graphviz's DOT language
+
+	// Where the JSON goes, stdout when nil
+	jsonOutput io.Writer
+}
+
+// WorkspaceEdge is a dependency of one workspace on another
+type WorkspaceEdge struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Section string `json:"section"` // dependencies, optionalDependencies, peerDependencies, or devDependencies
+	Range   string `json:"range"`
+}
+
+// WorkspaceInfo is a workspace with its dependencies on the other
+// workspaces and theirs on it
+type WorkspaceInfo struct {
+	Name         string          `json:"name"`
+	Version      string          `json:"version,omitempty"`
+	Path         string          `json:"path"` // Relative to the root
+	Private      bool            `json:"private,omitempty"`
+	Dependencies []WorkspaceEdge `json:"dependencies"`
+	Dependents   []WorkspaceEdge `json:"dependents"`
+}
+
+// workspaceEdges returns the dependencies between workspaces, by
+// dependent, then dependency, then section in dependencySections' order.
+// Dependencies on packages from the registry aren't edges
+func workspaceEdges(workspaces []workspace) []WorkspaceEdge {
+	names := make(map[string]bool)
+	for _, ws := range workspaces {
+		names[ws.Name] = true
+	}
+	edges := []WorkspaceEdge{}
+	for _, ws := range workspaces {
+		for _, section := range dependencySections {
+			for dep, depRange := range ws.sectionDeps(section) {
+				if names[dep] && dep != ws.Name {
+					edges = append(edges, WorkspaceEdge{From: ws.Name, To: dep, Section: section, Range: depRange})
+				}
+			}
+		}
+	}
+	slices.SortStableFunc(edges, func(a, b WorkspaceEdge) int {
+		if c := strings.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.To, b.To); c != 0 {
+			return c
+		}
+		return slices.Index(dependencySections, a.Section) - slices.Index(dependencySections, b.Section)
+	})
+	return edges
+}
+
+// workspaceInfos returns each workspace with its edges, sorted by name
+func workspaceInfos(workspaces []workspace) []WorkspaceInfo {
+	edges := workspaceEdges(workspaces)
+	infos := make([]WorkspaceInfo, 0, len(workspaces))
+	for _, ws := range workspaces {
+		info := WorkspaceInfo{Name: ws.Name, Version: ws.Version, Path: ws.Dir, Private: ws.Private, Dependencies: []WorkspaceEdge{}, Dependents: []WorkspaceEdge{}}
+		for _, edge := range edges {
+			if edge.From == ws.Name {
+				info.Dependencies = append(info.Dependencies, edge)
+			}
+			if edge.To == ws.Name {
+				info.Dependents = append(info.Dependents, edge)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ListWorkspaces prints the workspaces of the project in directory
+func ListWorkspaces(directory string, opts WorkspacesOptions) error {
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return err
+	}
+	infos := workspaceInfos(workspaces)
+	if opts.JSON {
+		return writeWorkspacesJSON(infos, opts)
+	}
+	fmt.Print(RenderWorkspaceList(infos))
+	return nil
+}
+
+// ShowWorkspace prints a workspace of the project in directory, found by
+// name or path, with what it depends on and what depends on it
+func ShowWorkspace(directory, name string, opts WorkspacesOptions) error {
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return err
+	}
+	for _, info := range workspaceInfos(workspaces) {
+		if info.Name != name && info.Path != strings.TrimSuffix(name, "/") {
+			continue
+		}
+		if opts.JSON {
+			return writeWorkspacesJSON(info, opts)
+		}
+		fmt.Print(RenderWorkspaceInfo(info))
+		return nil
+	}
+	return fmt.Errorf("no workspace named %s", name)
+}
+
+// WorkspaceGraph prints the dependencies between the workspaces of the
+// project in directory
+func WorkspaceGraph(directory string, opts WorkspacesOptions) error {
+	workspaces, err := findWorkspaces(directory)
+	if err != nil {
+		return err
+	}
+	edges := workspaceEdges(workspaces)
+	switch {
+	case opts.JSON:
+		return writeWorkspacesJSON(edges, opts)
+	case opts.DOT:
+		fmt.Print(RenderWorkspaceDOT(workspaces, edges))
+	default:
+		fmt.Print(RenderWorkspaceGraph(edges))
+	}
+	return nil
+}
+
+func writeWorkspacesJSON(value interface{}, opts WorkspacesOptions) error {
+	output := opts.jsonOutput
+	if output == nil {
+		output = os.Stdout
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// RenderWorkspaceList shows a line per workspace with its version, path,
+// and how many workspaces it depends on and are its dependents
+func RenderWorkspaceList(infos []WorkspaceInfo) string {
+	nameWidth, versionWidth, pathWidth := len("NAME"), len("VERSION"), len("PATH")
+	for _, info := range infos {
+		nameWidth = max(nameWidth, len(info.Name))
+		versionWidth = max(versionWidth, len(info.Version))
+		pathWidth = max(pathWidth, len(info.Path))
+	}
+	var builder strings.Builder
+	builder.WriteString(colorDim(fmt.Sprintf("%-*s  %-*s  %-*s  DEPS  DEPENDENTS", nameWidth, "NAME", versionWidth, "VERSION", pathWidth, "PATH")) + "\n")
+	for _, info := range infos {
+		line := fmt.Sprintf("%s  %-*s  %-*s  %4d  %10d", colorPackage(fmt.Sprintf("%-*s", nameWidth, info.Name)), versionWidth, info.Version, pathWidth, info.Path, len(workspaceNames(info.Dependencies, true)), len(workspaceNames(info.Dependents, false)))
+		if info.Private {
+			line += colorDim("  private")
+		}
+		builder.WriteString(line + "\n")
+	}
+	return builder.String()
+}
+
+// RenderWorkspaceInfo shows a workspace's dependencies on other workspaces
+// and its dependents, with the sections and ranges they're in
+func RenderWorkspaceInfo(info WorkspaceInfo) string {
+	var builder strings.Builder
+	title := colorPackage(info.Name)
+	if info.Version != "" {
+		title += "@" + info.Version
+	}
+	builder.WriteString(title + colorDim(" ("+info.Path+")"))
+	if info.Private {
+		builder.WriteString(colorDim(", private"))
+	}
+	builder.WriteString("\n")
+
+	builder.WriteString("Depends on:\n")
+	if len(info.Dependencies) == 0 {
+		builder.WriteString(colorDim("  no other workspaces") + "\n")
+	}
+	for _, edge := range info.Dependencies {
+		builder.WriteString(fmt.Sprintf("  %s %s %s\n", colorPackage(edge.To), edge.Range, colorDim("in "+edge.Section)))
+	}
+	builder.WriteString("Depended on by:\n")
+	if len(info.Dependents) == 0 {
+		builder.WriteString(colorDim("  no other workspaces") + "\n")
+	}
+	for _, edge := range info.Dependents {
+		builder.WriteString(fmt.Sprintf("  %s %s %s\n", colorPackage(edge.From), edge.Range, colorDim("in "+edge.Section)))
+	}
+	return builder.String()
+}
+
+// RenderWorkspaceGraph shows a line per edge, dependent first
+func RenderWorkspaceGraph(edges []WorkspaceEdge) string {
+	var builder strings.Builder
+	for _, edge := range edges {
+		builder.WriteString(fmt.Sprintf("%s -> %s %s\n", colorPackage(edge.From), colorPackage(edge.To), colorDim(edge.Range+" in "+edge.Section)))
+	}
+	return builder.String()
+}
+
+// RenderWorkspaceDOT writes the graph for Graphviz, e.g. caladan workspaces
+// graph --dot . | dot -Tsvg. Every workspace is a node, so ones without
+// edges show up too, and devDependencies edges are dashed since they're
+// only needed to work on the dependent
+func RenderWorkspaceDOT(workspaces []workspace, edges []WorkspaceEdge) string {
+	var builder strings.Builder
+	builder.WriteString("digraph workspaces {\n")
+	builder.WriteString("  rankdir=LR;\n")
+	for _, ws := range workspaces {
+		builder.WriteString(fmt.Sprintf("  %s;\n", strconv.Quote(ws.Name)))
+	}
+	for _, edge := range edges {
+		attributes := fmt.Sprintf("label=%s", strconv.Quote(edge.Range))
+		if edge.Section == "devDependencies" {
+			attributes += ", style=dashed"
+		}
+		builder.WriteString(fmt.Sprintf("  %s -> %s [%s];\n", strconv.Quote(edge.From), strconv.Quote(edge.To), attributes))
+	}
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+// workspaceNames returns the distinct workspaces at the other end of edges,
+// their dependencies when to is set, their dependents otherwise
+func workspaceNames(edges []WorkspaceEdge, to bool) []string {
+	names := []string{}
+	for _, edge := range edges {
+		name := edge.From
+		if to {
+			name = edge.To
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
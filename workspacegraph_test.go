@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceInfos(t *testing.T) {
+	workspaces := []workspace{
+		{Name: "@corp/cli", Dir: "packages/cli", manifest: PackageInfo{
+			Dependencies:    map[string]string{"@corp/http": "workspace:^", "chalk": "^5.0.0"},
+			DevDependencies: map[string]string{"@corp/http": "workspace:*", "@corp/test": "workspace:*"},
+		}},
+		{Name: "@corp/http", Dir: "packages/http", manifest: PackageInfo{Dependencies: map[string]string{"@corp/http": "1.0.0"}}},
+		{Name: "@corp/test", Dir: "packages/test", Private: true, manifest: PackageInfo{PeerDependencies: map[string]string{"@corp/http": "^1.0.0"}}},
+	}
+	infos := workspaceInfos(workspaces)
+
+	cli := []WorkspaceEdge{
+		{From: "@corp/cli", To: "@corp/http", Section: "dependencies", Range: "workspace:^"},
+		{From: "@corp/cli", To: "@corp/http", Section: "devDependencies", Range: "workspace:*"},
+		{From: "@corp/cli", To: "@corp/test", Section: "devDependencies", Range: "workspace:*"},
+	}
+	if !reflect.DeepEqual(infos[0].Dependencies, cli) || len(infos[0].Dependents) != 0 {
+		t.Errorf("@corp/cli = %+v", infos[0])
+	}
+	http := []WorkspaceEdge{cli[0], cli[1], {From: "@corp/test", To: "@corp/http", Section: "peerDependencies", Range: "^1.0.0"}}
+	if len(infos[1].Dependencies) != 0 || !reflect.DeepEqual(infos[1].Dependents, http) {
+		t.Errorf("@corp/http = %+v", infos[1])
+	}
+	if got := workspaceNames(infos[1].Dependents, false); !reflect.DeepEqual(got, []string{"@corp/cli", "@corp/test"}) {
+		t.Errorf("dependents of @corp/http = %v", got)
+	}
+
+	dot := RenderWorkspaceDOT(workspaces, workspaceEdges(workspaces))
+	for _, want := range []string{
+		`"@corp/test";`,
+		`"@corp/cli" -> "@corp/http" [label="workspace:^"];`,
+		`"@corp/cli" -> "@corp/test" [label="workspace:*", style=dashed];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output is missing %s:\n%s", want, dot)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+// workspace is a package of a monorepo, listed by the root package.json's
+// workspaces globs
+type workspace struct {
+	Dir     string // Relative to the root
+	Name    string
+	Version string
+	Private bool
+
+	manifest PackageInfo
+}
+
+// dependencySections are the package.json fields that depend on other
+// packages, in the order they're checked
+var dependencySections = []string{"dependencies", "optionalDependencies", "peerDependencies", "devDependencies"}
+
+// sectionDeps returns a manifest's dependency ranges in a section
+func (w workspace) sectionDeps(section string) map[string]string {
+	switch section {
+	case "dependencies":
+		return w.manifest.Dependencies
+	case "optionalDependencies":
+		return w.manifest.OptionalDependencies
+	case "peerDependencies":
+		return w.manifest.PeerDependencies
+	default:
+		return w.manifest.DevDependencies
+	}
+}
+
+// findWorkspaces returns the workspaces of the project at root, sorted by
+// name. The workspaces field is either a list of globs or, as yarn writes
+// it, an object with a packages list
+func findWorkspaces(root string) ([]workspace, error) {
+	data, err := os.ReadFile(filepath.Join(root, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Workspaces json.RawMessage `json:"workspaces"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing package.json: %v", err)
+	}
+	if len(manifest.Workspaces) == 0 {
+		return nil, fmt.Errorf("package.json has no workspaces")
+	}
+	var patterns []string
+	if err := json.Unmarshal(manifest.Workspaces, &patterns); err != nil {
+		var object struct {
+			Packages []string `json:"packages"`
+		}
+		if err := json.Unmarshal(manifest.Workspaces, &object); err != nil {
+			return nil, fmt.Errorf("workspaces must be a list of globs")
+		}
+		patterns = object.Packages
+	}
+
+	workspaces := []workspace{}
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace glob %q: %v", pattern, err)
+		}
+		for _, match := range matches {
+			data, err := os.ReadFile(filepath.Join(match, "package.json"))
+			if err != nil {
+				// Globs like packages/* also match stray files and folders
+				continue
+			}
+			var ws struct {
+				PackageInfo
+				Private bool `json:"private"`
+			}
+			if err := json.Unmarshal(data, &ws); err != nil {
+				return nil, fmt.Errorf("error parsing %s: %v", filepath.Join(match, "package.json"), err)
+			}
+			if ws.Name == "" || seen[ws.Name] {
+				continue
+			}
+			seen[ws.Name] = true
+			dir, _ := filepath.Rel(root, match)
+			workspaces = append(workspaces, workspace{Dir: dir, Name: ws.Name, Version: ws.Version, Private: ws.Private, manifest: ws.PackageInfo})
+		}
+	}
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].Name < workspaces[j].Name
+	})
+	return workspaces, nil
+}
+
+// editJSONString replaces the string at path in a JSON document, leaving the
+// rest of it (key order, indentation) as it was. It reports false when
+// there's no string at path
+func editJSONString(data []byte, path []string, value string) ([]byte, bool, error) {
+	type frame struct {
+		object    bool
+		key       string
+		expectKey bool
+	}
+	stack := []frame{}
+	atPath := func() bool {
+		if len(stack) != len(path) {
+			return false
+		}
+		for i, f := range stack {
+			if !f.object || f.key != path[i] {
+				return false
+			}
+		}
+		return true
+	}
+	// valueDone moves the enclosing object on to its next key
+	valueDone := func() {
+		if len(stack) > 0 && stack[len(stack)-1].object {
+			stack[len(stack)-1].expectKey = true
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		before := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return data, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(stack) > 0 && stack[len(stack)-1].object && stack[len(stack)-1].expectKey {
+			if key, ok := token.(string); ok {
+				stack[len(stack)-1].key = key
+				stack[len(stack)-1].expectKey = false
+				continue
+			}
+		}
+
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, frame{object: true, expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, frame{})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			valueDone()
+		default:
+			if _, ok := token.(string); ok && atPath() {
+				// The token starts after the separators following the last one
+				start := int(before) + bytes.IndexByte(data[before:], '"')
+				encoded, err := json.Marshal(value)
+				if err != nil {
+					return nil, false, err
+				}
+				edited := append([]byte{}, data[:start]...)
+				edited = append(edited, encoded...)
+				return append(edited, data[decoder.InputOffset():]...), true, nil
+			}
+			valueDone()
+		}
+	}
+}
+
+// withWorkspaceDependencies adds the dependencies of a project's workspaces
+// to its root manifest, which is how they share its lockfile and its
+// node_modules. When two ask for a package at different ranges the root's
+// wins, then the first workspace's by name, and conflicts describes the
+// ranges that lost. Dependencies on the workspaces themselves aren't
+// resolved from the registry, so they're left out
+func withWorkspaceDependencies(directory string, root PackageInfo, rootCatalogs catalogs) (merged PackageInfo, conflicts []string, err error) {
+	manifests, err := projectManifests(directory)
+	if err != nil || len(manifests) == 1 {
+		return root, nil, err
+	}
+	local := make(map[string]bool)
+	for _, ws := range manifests[1:] {
+		local[ws.Name] = true
+	}
+
+	merged = root
+	sections := map[string]*map[string]string{
+		"dependencies":         &merged.Dependencies,
+		"devDependencies":      &merged.DevDependencies,
+		"optionalDependencies": &merged.OptionalDependencies,
+	}
+	wanted := make(map[string]string) // Who the range in merged came from
+	for section, deps := range sections {
+		copied := make(map[string]string, len(*deps))
+		for name, versionRange := range *deps {
+			if !local[name] {
+				copied[name] = versionRange
+				wanted[name] = "package.json " + section
+			}
+		}
+		*deps = copied
+	}
+	rangeOf := func(name string) (string, bool) {
+		for _, deps := range sections {
+			if versionRange, ok := (*deps)[name]; ok {
+				return versionRange, true
+			}
+		}
+		return "", false
+	}
+
+	for _, ws := range manifests[1:] {
+		if err := rootCatalogs.resolveManifestCatalogs(&ws.manifest); err != nil {
+			return root, nil, fmt.Errorf("%s: %v", ws.Name, err)
+		}
+		for _, section := range []string{"dependencies", "devDependencies", "optionalDependencies"} {
+			names := make([]string, 0, len(ws.sectionDeps(section)))
+			for name := range ws.sectionDeps(section) {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				versionRange := ws.sectionDeps(section)[name]
+				if local[name] {
+					continue
+				}
+				if existing, ok := rangeOf(name); ok {
+					if existing != versionRange {
+						conflicts = append(conflicts, fmt.Sprintf("%s %s wants %s@%s, installing %s from %s", ws.Name, section, name, versionRange, existing, wanted[name]))
+					}
+					continue
+				}
+				(*sections[section])[name] = versionRange
+				wanted[name] = ws.Name + " " + section
+			}
+		}
+	}
+	return merged, conflicts, nil
+}
+
+// jsonIndent returns the indentation of a JSON document's first nested
+// line, two spaces when it's all on one line
+func jsonIndent(data []byte) string {
+	newline := bytes.IndexByte(data, '\n')
+	if newline < 0 {
+		return "  "
+	}
+	rest := data[newline+1:]
+	indent := rest[:len(rest)-len(bytes.TrimLeft(rest, " \t"))]
+	if len(indent) == 0 {
+		return "  "
+	}
+	return string(indent)
+}
+
+// setJSONDependency sets the range of a dependency in a section of a
+// package.json, or removes it when versionRange is "". Only the section is
+// rewritten: a new dependency goes where it sorts among the others, and the
+// section is added at the end when it's missing
+func setJSONDependency(data []byte, section, name, versionRange string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("package.json isn't an object")
+	}
+	start, end := -1, -1
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		if token == section {
+			end = int(decoder.InputOffset())
+			start = end - len(value)
+		}
+	}
+
+	keys, values := []string{}, map[string]json.RawMessage{}
+	if start >= 0 {
+		var ok bool
+		if keys, values, ok = objectEntries(json.RawMessage(data[start:end])); !ok {
+			return nil, fmt.Errorf("%s in package.json isn't an object", section)
+		}
+	}
+	_, exists := values[name]
+	switch {
+	case versionRange == "" && !exists:
+		return data, nil
+	case versionRange == "":
+		delete(values, name)
+		keys = slices.DeleteFunc(keys, func(key string) bool { return key == name })
+	default:
+		if !exists {
+			keys = slices.Insert(keys, sort.SearchStrings(keys, name), name)
+		}
+		// Ranges like >=1 <2 stay readable
+		var encoded bytes.Buffer
+		encoder := json.NewEncoder(&encoded)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(versionRange); err != nil {
+			return nil, err
+		}
+		values[name] = bytes.TrimSpace(encoded.Bytes())
+	}
+
+	indent := jsonIndent(data)
+	var object bytes.Buffer
+	if len(keys) == 0 {
+		object.WriteString("{}")
+	} else {
+		object.WriteString("{\n")
+		for i, key := range keys {
+			encodedKey, _ := json.Marshal(key)
+			object.WriteString(indent + indent + string(encodedKey) + ": " + string(values[key]))
+			if i < len(keys)-1 {
+				object.WriteString(",")
+			}
+			object.WriteString("\n")
+		}
+		object.WriteString(indent + "}")
+	}
+
+	if start >= 0 {
+		return slices.Concat(data[:start], object.Bytes(), data[end:]), nil
+	}
+	closing := bytes.LastIndexByte(data, '}')
+	body := bytes.TrimRight(data[:closing], " \t\r\n")
+	separator := ",\n"
+	if bytes.HasSuffix(body, []byte("{")) {
+		separator = "\n"
+	}
+	encodedSection, _ := json.Marshal(section)
+	return slices.Concat(body, []byte(separator+indent+string(encodedSection)+": "), object.Bytes(), []byte("\n"), data[closing:]), nil
+}